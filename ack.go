@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The KV prefix acks are stored under, keyed by alert fingerprint
+const ackKVRoot = alertingKVRoot + "/ack/"
+
+// The status API path PagerDuty posts incident webhooks to
+const pagerdutyWebhookPath = "/v1/pagerduty/webhook"
+
+// Ack records that the on-call acknowledged an alert, either through its PagerDuty incident or
+// a signed ack link. While an alert is acked, reminders for it are skipped and changes in its
+// failing status are only sent to PagerDuty handlers. The ack is cleared when the alert
+// recovers, or when the incident is unacknowledged or resolved in PagerDuty.
+type Ack struct {
+	Fingerprint string    `json:"fingerprint"`
+	User        string    `json:"user"`
+	Incident    string    `json:"incident"`
+	Since       time.Time `json:"since"`
+
+	// How the alert was acked, if not through PagerDuty
+	Source string `json:"source,omitempty"`
+}
+
+// Describes the ack for inclusion in notifications
+func (a *Ack) describe() string {
+	if a.Source != "" {
+		return fmt.Sprintf("Acknowledged through %s at %s", a.Source, a.Since.Format("Jan 2 15:04 MST"))
+	}
+	return fmt.Sprintf("Acknowledged by %s in PagerDuty at %s", a.User, a.Since.Format("Jan 2 15:04 MST"))
+}
+
+// Loads the ack for the given alert fingerprint, returning nil if there isn't one
+func getAck(fingerprint string, client *api.Client) (*Ack, error) {
+	kvPair, _, err := client.KV().Get(ackKVRoot+fingerprint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading ack: %s", err)
+	}
+
+	if kvPair == nil || len(kvPair.Value) == 0 {
+		return nil, nil
+	}
+
+	ack := &Ack{}
+	if err := json.Unmarshal(kvPair.Value, ack); err != nil {
+		return nil, fmt.Errorf("Error parsing ack: %s", err)
+	}
+
+	return ack, nil
+}
+
+// Stores an ack in the KV store
+func setAck(ack *Ack, client *api.Client) error {
+	serialized, err := json.Marshal(ack)
+	if err != nil {
+		return fmt.Errorf("Error forming ack: %s", err)
+	}
+
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   ackKVRoot + ack.Fingerprint,
+		Value: serialized,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error storing ack: %s", err)
+	}
+
+	return nil
+}
+
+// Removes the ack for the given alert fingerprint
+func deleteAck(fingerprint string, client *api.Client) error {
+	_, err := client.KV().Delete(ackKVRoot+fingerprint, nil)
+	if err != nil {
+		return fmt.Errorf("Error removing ack: %s", err)
+	}
+	return nil
+}
+
+// Checks for an ack on the alert, returning the notification to send. A failing alert that's
+// acked is marked to only go to PagerDuty handlers, and a recovery clears the ack.
+func applyAck(alert *AlertState, client *api.Client) *AlertState {
+	fingerprint := alertFingerprint(alert)
+	ack, err := getAck(fingerprint, client)
+	if err != nil {
+		log.Error(err)
+		return alert
+	}
+	if ack == nil {
+		return alert
+	}
+
+	notification := *alert
+	notification.Details = strings.TrimSpace(ack.describe() + "\n" + alert.Details)
+
+	if alert.Status == api.HealthPassing {
+		if !shadowed() {
+			if err := deleteAck(fingerprint, client); err != nil {
+				log.Error(err)
+			}
+		}
+		return &notification
+	}
+
+	notification.acknowledged = true
+	return &notification
+}
+
+// Returns true if the alert has been acked in PagerDuty
+func alertAcked(alert *AlertState, client *api.Client) bool {
+	ack, err := getAck(alertFingerprint(alert), client)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return ack != nil
+}
+
+// The parts of a PagerDuty (v2) webhook used for acks
+type pagerdutyWebhook struct {
+	Messages []struct {
+		Event    string `json:"event"`
+		Incident struct {
+			ID            string `json:"id"`
+			IncidentKey   string `json:"incident_key"`
+			Acknowledgers []struct {
+				Acknowledger struct {
+					Summary string `json:"summary"`
+				} `json:"acknowledger"`
+			} `json:"acknowledgers"`
+			LastStatusChangeBy struct {
+				Summary string `json:"summary"`
+			} `json:"last_status_change_by"`
+		} `json:"incident"`
+	} `json:"messages"`
+}
+
+// An acknowledgement (or its removal) for an incident, parsed from a webhook
+type pagerdutyAckEvent struct {
+	incidentKey string
+	incident    string
+	user        string
+	acked       bool
+}
+
+// Returns the acknowledge, unacknowledge and resolve events in a webhook body
+func parsePagerdutyWebhook(body []byte) ([]pagerdutyAckEvent, error) {
+	var webhook pagerdutyWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, err
+	}
+
+	events := make([]pagerdutyAckEvent, 0)
+	for _, message := range webhook.Messages {
+		incident := message.Incident
+		if incident.IncidentKey == "" {
+			continue
+		}
+
+		event := pagerdutyAckEvent{incidentKey: incident.IncidentKey, incident: incident.ID}
+		switch message.Event {
+		case "incident.acknowledge":
+			event.acked = true
+			event.user = incident.LastStatusChangeBy.Summary
+			if len(incident.Acknowledgers) > 0 && incident.Acknowledgers[0].Acknowledger.Summary != "" {
+				event.user = incident.Acknowledgers[0].Acknowledger.Summary
+			}
+			if event.user == "" {
+				event.user = "PagerDuty"
+			}
+		case "incident.unacknowledge", "incident.resolve":
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// POST /v1/pagerduty/webhook receives incident webhooks from PagerDuty, recording an ack for
+// the alert whose incident was acknowledged. PagerDuty can't send the status API's credentials,
+// so the webhook is authenticated with pagerduty_webhook_token in the token query parameter.
+func (s *StatusServer) pagerdutyWebhook(w http.ResponseWriter, r *http.Request) {
+	if !secureEqual(r.URL.Query().Get("token"), s.config.PagerdutyWebhookToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	events, err := parsePagerdutyWebhook(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.applyPagerdutyEvents(events); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Records or clears the acks for the alerts matching each event's incident key
+func (s *StatusServer) applyPagerdutyEvents(events []pagerdutyAckEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	alerts, err := s.alerts()
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		for _, alert := range alerts {
+			if pagerdutyIncidentKey(s.config.ConsulDatacenter, &alert.AlertState) != event.incidentKey {
+				continue
+			}
+
+			if !event.acked {
+				log.Infof("PagerDuty incident %s for %s is no longer acknowledged", event.incident, alertName(&alert.AlertState))
+				if err := deleteAck(alert.Fingerprint, s.client); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Only failing alerts can be acked, so a late webhook can't silence the next incident
+			if alert.LastAlerted == api.HealthPassing {
+				continue
+			}
+
+			ack := &Ack{
+				Fingerprint: alert.Fingerprint,
+				User:        event.user,
+				Incident:    event.incident,
+				Since:       time.Now(),
+			}
+			if err := setAck(ack, s.client); err != nil {
+				return err
+			}
+			log.Infof("PagerDuty incident %s for %s acknowledged by %s", event.incident, alertName(&alert.AlertState), ack.User)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAck_parsePagerdutyWebhook(t *testing.T) {
+	body := `{"messages": [
+		{"event": "incident.acknowledge", "incident": {"id": "P1", "incident_key": "dc1-redis--",
+			"acknowledgers": [{"acknowledger": {"summary": "Alice"}}]}},
+		{"event": "incident.acknowledge", "incident": {"id": "P2", "incident_key": "dc1-web--",
+			"last_status_change_by": {"summary": "Bob"}}},
+		{"event": "incident.resolve", "incident": {"id": "P1", "incident_key": "dc1-redis--"}},
+		{"event": "incident.trigger", "incident": {"id": "P3", "incident_key": "dc1-db--"}},
+		{"event": "incident.acknowledge", "incident": {"id": "P4"}}
+	]}`
+
+	events, err := parsePagerdutyWebhook([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []pagerdutyAckEvent{
+		{incidentKey: "dc1-redis--", incident: "P1", user: "Alice", acked: true},
+		{incidentKey: "dc1-web--", incident: "P2", user: "Bob", acked: true},
+		{incidentKey: "dc1-redis--", incident: "P1"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+
+	if _, err := parsePagerdutyWebhook([]byte("not json")); err == nil {
+		t.Error("expected error parsing invalid body")
+	}
+}
+
+// Make sure acked alerts are only sent to PagerDuty handlers
+func TestAck_dispatchAcknowledged(t *testing.T) {
+	config, alertCh := testAlertConfig()
+
+	dispatchAlert(config, testServiceName, &AlertState{Status: api.HealthCritical, acknowledged: true})
+	select {
+	case <-alertCh:
+		t.Error("got unexpected acknowledged alert on non-PagerDuty handler")
+	default:
+	}
+
+	dispatchAlert(config, testServiceName, &AlertState{Status: api.HealthCritical})
+	select {
+	case <-alertCh:
+	default:
+		t.Error("didn't get unacknowledged alert")
+	}
+
+	if !isPagerdutyHandler(newMiddlewareHandler(PagerdutyHandler{}, nil)) {
+		t.Error("expected wrapped PagerDuty handler to be recognized")
+	}
+}
+
+// Ack an alert through the webhook and make sure it's recorded, then cleared by a recovery
+func TestAPI_pagerdutyWebhook(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	alert := &AlertState{
+		Service:     testServiceName,
+		Status:      api.HealthCritical,
+		LastAlerted: api.HealthCritical,
+	}
+	if err := setAlertState(alertingKVRoot+"/service/"+testServiceName+"/alert", alert, client); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{ConsulDatacenter: "dc1", StatusToken: "secret", PagerdutyWebhookToken: "pd"}
+	status := newStatusServer(config, client)
+
+	body := `{"messages": [{"event": "incident.acknowledge", "incident": {"id": "P1", "incident_key": "` +
+		pagerdutyIncidentKey("dc1", alert) + `", "acknowledgers": [{"acknowledger": {"summary": "Alice"}}]}}]}`
+	req, _ := http.NewRequest("POST", pagerdutyWebhookPath+"?token=pd", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	notification := applyAck(alert, client)
+	if !notification.acknowledged {
+		t.Error("expected alert to be acknowledged")
+	}
+	if !strings.HasPrefix(notification.Details, "Acknowledged by Alice in PagerDuty") {
+		t.Errorf("expected ack attribution in details, got '%s'", notification.Details)
+	}
+
+	recovery := *alert
+	recovery.Status = api.HealthPassing
+	if notification := applyAck(&recovery, client); notification.acknowledged {
+		t.Error("expected recovery not to be acknowledged")
+	}
+	if alertAcked(alert, client) {
+		t.Error("expected recovery to clear the ack")
+	}
+}
+
+func TestAPI_pagerdutyWebhookToken(t *testing.T) {
+	config := &Config{StatusToken: "secret", PagerdutyWebhookToken: "pd"}
+	status := newStatusServer(config, nil)
+
+	for _, token := range []string{"", "secret", "wrong"} {
+		req, _ := http.NewRequest("POST", pagerdutyWebhookPath+"?token="+token, strings.NewReader("{}"))
+		resp := httptest.NewRecorder()
+		status.handler().ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for token '%s', got %d", token, resp.Code)
+		}
+	}
+
+	// Without a webhook token the path falls under the status API's authentication
+	status = newStatusServer(&Config{StatusToken: "secret"}, nil)
+	req, _ := http.NewRequest("POST", pagerdutyWebhookPath+"?token=", strings.NewReader("{}"))
+	resp := httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a webhook token, got %d", resp.Code)
+	}
+
+}
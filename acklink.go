@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The status API path prefix signed ack links are served under
+const ackLinkPath = "/v1/links/"
+
+// Who acks and silences made through signed links are attributed to
+const ackLinkSource = "a signed link"
+
+// The actions a signed link can take on an alert
+const (
+	LinkActionAck     = "ack"
+	LinkActionSilence = "silence"
+)
+
+// AckLinks are signed links to the status API for acknowledging or silencing an alert,
+// attached to failing alerts when ack_link_secret is set so recipients can act on them
+// without access to Consul or chat
+type AckLinks struct {
+	Ack     string `json:"ack"`
+	Silence string `json:"silence"`
+}
+
+// Returns the signature authorizing an action on an alert until the expiry time
+func signAckLink(secret string, action string, fingerprint string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%s:%d", action, fingerprint, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the signed link for an action on an alert
+func ackLink(baseURL string, secret string, action string, fingerprint string, expires int64) string {
+	query := url.Values{
+		"expires": []string{strconv.FormatInt(expires, 10)},
+		"sig":     []string{signAckLink(secret, action, fingerprint, expires)},
+	}
+	return fmt.Sprintf("%s%s%s/%s?%s", strings.TrimSuffix(baseURL, "/"), ackLinkPath, action, fingerprint, query.Encode())
+}
+
+// Returns a copy of the alert with signed ack links attached, if links are enabled and the
+// alert is failing and not already acknowledged
+func (c *Config) withAckLinks(alert *AlertState, now time.Time) *AlertState {
+	c.lock.RLock()
+	secret, baseURL, ttl := c.AckLinkSecret, c.AckLinkBaseURL, c.AckLinkTTL
+	c.lock.RUnlock()
+
+	if secret == "" || alert.acknowledged ||
+		(alert.Status != api.HealthWarning && alert.Status != api.HealthCritical) {
+		return alert
+	}
+
+	fingerprint := alertFingerprint(alert)
+	expires := now.Add(time.Duration(ttl) * time.Second).Unix()
+
+	linked := *alert
+	linked.Links = &AckLinks{
+		Ack:     ackLink(baseURL, secret, LinkActionAck, fingerprint, expires),
+		Silence: ackLink(baseURL, secret, LinkActionSilence, fingerprint, expires),
+	}
+	return &linked
+}
+
+// Describes an alert's ack links for plain text notifications
+func (l *AckLinks) describe() string {
+	return fmt.Sprintf("Acknowledge: %s\nSilence: %s", l.Ack, l.Silence)
+}
+
+// The confirmation page for an ack link. Following the link only shows this page, so links
+// opened by mail scanners and previews don't act on the alert.
+var ackLinkPage = template.Must(template.New("ackLink").Parse(`<!DOCTYPE html>
+<html>
+<head><title>consul-alerting</title></head>
+<body>
+<p>{{.Message}}</p>
+<form method="POST">
+<button type="submit">{{.Label}}</button>
+</form>
+</body>
+</html>
+`))
+
+// GET /v1/links/{action}/{fingerprint}?expires=...&sig=... shows a confirmation page for a
+// signed ack link, and POST performs the action. Links are authenticated by their signature
+// instead of the status API's credentials.
+func (s *StatusServer) ackLinkAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, ackLinkPath), "/")
+	if len(parts) != 2 || (parts[0] != LinkActionAck && parts[0] != LinkActionSilence) {
+		http.NotFound(w, r)
+		return
+	}
+	action, fingerprint := parts[0], parts[1]
+
+	s.config.lock.RLock()
+	secret, silence := s.config.AckLinkSecret, time.Duration(s.config.AckLinkSilence)*time.Second
+	s.config.lock.RUnlock()
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(signAckLink(secret, action, fingerprint, expires))) {
+		http.Error(w, "invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "this link has expired", http.StatusGone)
+		return
+	}
+
+	found, err := s.findAlert(fingerprint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		http.Error(w, fmt.Sprintf("no alert with fingerprint %s", fingerprint), http.StatusNotFound)
+		return
+	}
+	name := alertName(&found.AlertState)
+
+	switch r.Method {
+	case "GET":
+		page := struct{ Message, Label string }{found.Message, "Acknowledge " + name}
+		if action == LinkActionSilence {
+			page.Label = fmt.Sprintf("Silence %s for %s", name, silence)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := ackLinkPage.Execute(w, page); err != nil {
+			log.Error("Error writing ack link page: ", err)
+		}
+		return
+	case "POST":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var result string
+	if action == LinkActionAck {
+		err = setAck(&Ack{Fingerprint: fingerprint, Source: ackLinkSource, Since: time.Now()}, s.client)
+		result = "Acknowledged " + name
+	} else {
+		err = setSnooze(&Snooze{Fingerprint: fingerprint, User: ackLinkSource, Until: time.Now().Add(silence)}, s.client)
+		result = fmt.Sprintf("Silenced %s for %s", name, silence)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("%s (alert %s) through a signed link", result, fingerprint)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, result)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAckLink_withAckLinks(t *testing.T) {
+	config, err := ParseConfig(`
+	status_address = "127.0.0.1:9110"
+	ack_link_secret = "secret"
+	ack_link_base_url = "https://alerts.example.com/"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical}
+	linked := config.withAckLinks(alert, now)
+	if alert.Links != nil || linked.Links == nil {
+		t.Fatal("expected links on a copy of the alert")
+	}
+
+	link, err := url.Parse(linked.Links.Ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Host != "alerts.example.com" || link.Path != ackLinkPath+LinkActionAck+"/"+alertFingerprint(alert) {
+		t.Errorf("unexpected ack link: %s", linked.Links.Ack)
+	}
+	if link.Query().Get("expires") != "1700003600" {
+		t.Errorf("expected the link to expire after ack_link_ttl, got %s", link.Query().Get("expires"))
+	}
+	if link.Query().Get("sig") != signAckLink("secret", LinkActionAck, alertFingerprint(alert), 1700003600) {
+		t.Errorf("unexpected signature in %s", linked.Links.Ack)
+	}
+
+	// Recoveries and acked alerts don't need links
+	for _, other := range []*AlertState{
+		&AlertState{Service: "redis", Status: api.HealthPassing},
+		&AlertState{Service: "redis", Status: api.HealthCritical, acknowledged: true},
+	} {
+		if config.withAckLinks(other, now).Links != nil {
+			t.Errorf("expected no links for %+v", other)
+		}
+	}
+}
+
+func TestAckLink_invalidLinks(t *testing.T) {
+	config, err := ParseConfig(`
+	status_address = "127.0.0.1:9110"
+	status_token = "token"
+	ack_link_secret = "secret"
+	ack_link_base_url = "https://alerts.example.com"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := (&StatusServer{config: config}).handler()
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	cases := map[string]int{
+		ackLink("", "secret", LinkActionAck, "abcd", expired):                         http.StatusGone,
+		ackLink("", "wrong", LinkActionAck, "abcd", time.Now().Add(time.Hour).Unix()): http.StatusForbidden,
+		ackLinkPath + "unknown/abcd":                                                  http.StatusNotFound,
+	}
+
+	for link, expected := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", link, nil))
+		if w.Code != expected {
+			t.Errorf("%s: expected %d, got %d: %s", link, expected, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
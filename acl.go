@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The KV key written and removed to check for write access under alertingKVRoot
+const preflightKVPath = alertingKVRoot + "/preflight/"
+
+// Returns true if a Consul API error was caused by the token lacking a permission
+func isPermissionDenied(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "403") || strings.Contains(msg, "Permission denied") ||
+		strings.Contains(msg, "ACL not found")
+}
+
+// Checks that the Consul token has each of the ACL permissions needed to run, returning a
+// description of each one that's missing. Read endpoints that filter their results instead of
+// denying the request are checked by looking for the local node and the consul service.
+// Other errors are returned, since they don't say anything about the token's permissions.
+func preflightACLs(client *api.Client, nodeName string) ([]string, error) {
+	missing := make([]string, 0)
+
+	// Record a missing permission, or stop on an unrelated error
+	check := func(permission string, err error) error {
+		if err == nil {
+			return nil
+		}
+		if isPermissionDenied(err) {
+			missing = append(missing, permission)
+			return nil
+		}
+		return fmt.Errorf("Error checking ACL permission (%s): %s", permission, err)
+	}
+
+	_, _, err := client.KV().Get(preflightKVPath+escapeKVSegment(nodeName), nil)
+	if err := check(fmt.Sprintf("key_prefix %q read", alertingKVRoot), err); err != nil {
+		return nil, err
+	}
+
+	_, err = client.KV().Put(&api.KVPair{Key: preflightKVPath + escapeKVSegment(nodeName)}, nil)
+	if err == nil {
+		_, err = client.KV().Delete(preflightKVPath+escapeKVSegment(nodeName), nil)
+	}
+	if err := check(fmt.Sprintf("key_prefix %q write", alertingKVRoot), err); err != nil {
+		return nil, err
+	}
+
+	session, _, err := client.Session().Create(&api.SessionEntry{Name: "consul-alerting preflight", TTL: "10s"}, nil)
+	if err == nil {
+		_, err = client.Session().Destroy(session, nil)
+	}
+	if err := check(fmt.Sprintf("session %q write", nodeName), err); err != nil {
+		return nil, err
+	}
+
+	node, _, err := client.Catalog().Node(nodeName, nil)
+	if err == nil && node == nil {
+		err = fmt.Errorf("Permission denied")
+	}
+	if err := check(`node_prefix "" read`, err); err != nil {
+		return nil, err
+	}
+
+	services, _, err := client.Catalog().Services(nil)
+	if err == nil && len(services) == 0 {
+		err = fmt.Errorf("Permission denied")
+	}
+	if err := check(`service_prefix "" read`, err); err != nil {
+		return nil, err
+	}
+
+	// Every node has a serfHealth check, so the local node's checks are never empty
+	checks, _, err := client.Health().Node(nodeName, nil)
+	if err == nil && len(checks) == 0 {
+		err = fmt.Errorf("Permission denied")
+	}
+	if err := check(fmt.Sprintf("node %q read (health checks)", nodeName), err); err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
+// Runs the ACL pre-flight checks at startup, logging each missing permission. Returns an
+// error if any are missing, since watches would otherwise fail later with retried 403s.
+func checkStartupACLs(client *api.Client, nodeName string) error {
+	missing, err := preflightACLs(client, nodeName)
+	if err != nil {
+		log.Warnf("Skipping ACL pre-flight check: %s", err)
+		return nil
+	}
+
+	for _, permission := range missing {
+		log.Errorf("Consul token is missing ACL permission: %s", permission)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Consul token is missing %d ACL permissions", len(missing))
+	}
+	return nil
+}
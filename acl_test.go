@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Set up a client for a fake Consul agent that denies every request to the given paths
+func testDenyingConsul(t *testing.T, denied ...string) (*api.Client, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range denied {
+			if strings.HasPrefix(r.URL.Path, path) {
+				http.Error(w, "Permission denied", http.StatusForbidden)
+				return
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			if r.Method == "GET" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, "true")
+		case strings.HasPrefix(r.URL.Path, "/v1/session/create"):
+			fmt.Fprint(w, `{"ID": "abc"}`)
+		case strings.HasPrefix(r.URL.Path, "/v1/session/destroy"):
+			fmt.Fprint(w, "true")
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/node/"):
+			fmt.Fprint(w, `{"Node": {"Node": "node1"}, "Services": {}}`)
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/services"):
+			fmt.Fprint(w, `{"consul": []}`)
+		case strings.HasPrefix(r.URL.Path, "/v1/health/node/"):
+			fmt.Fprint(w, `[{"Node": "node1", "CheckID": "serfHealth", "Status": "passing"}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestACL_preflight(t *testing.T) {
+	client, server := testDenyingConsul(t)
+	missing, err := preflightACLs(client, "node1")
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("expected no missing permissions, got %v", missing)
+	}
+
+	client, server = testDenyingConsul(t, "/v1/kv/", "/v1/session/")
+	defer server.Close()
+	missing, err = preflightACLs(client, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`key_prefix "service/consul-alerting" read`,
+		`key_prefix "service/consul-alerting" write`,
+		`session "node1" write`,
+	}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("expected %v, got %v", expected, missing)
+	}
+
+	if err := checkStartupACLs(client, "node1"); err == nil {
+		t.Error("expected error for missing permissions")
+	}
+}
+
+// Reads that are filtered by ACLs show up as missing permissions when they come back empty
+func TestACL_preflightFiltered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			if r.Method == "GET" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, "true")
+		case strings.HasPrefix(r.URL.Path, "/v1/session/create"):
+			fmt.Fprint(w, `{"ID": "abc"}`)
+		case strings.HasPrefix(r.URL.Path, "/v1/session/destroy"):
+			fmt.Fprint(w, "true")
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/node/"):
+			fmt.Fprint(w, "null")
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/services"):
+			fmt.Fprint(w, "{}")
+		case strings.HasPrefix(r.URL.Path, "/v1/health/node/"):
+			fmt.Fprint(w, "[]")
+		}
+	}))
+	defer server.Close()
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := preflightACLs(client, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{`node_prefix "" read`, `service_prefix "" read`, `node "node1" read (health checks)`}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("expected %v, got %v", expected, missing)
+	}
+}
+
+func TestACL_preflightError(t *testing.T) {
+	// An agent that isn't reachable says nothing about the token's permissions
+	client, server := testDenyingConsul(t)
+	server.Close()
+
+	if _, err := preflightACLs(client, "node1"); err == nil {
+		t.Error("expected error for unreachable agent")
+	}
+	if err := checkStartupACLs(client, "node1"); err != nil {
+		t.Errorf("expected unrelated errors to be skipped, got %s", err)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The path clusters forward alerts to on the aggregator
+const aggregatorAlertsPath = "/v1/aggregator/alerts"
+
+// The datacenter deduplicated service alerts are sent as, so that handlers which key
+// incidents on the datacenter (like PagerDuty) open one incident across every cluster
+const globalDatacenter = "global"
+
+// Aggregator receives the alerts forwarded by consul-alerting instances in many clusters and
+// routes them through its own handlers. Alerts for a service are deduplicated across clusters:
+// a notification is only sent when the service's worst status over all the clusters changes.
+// Node alerts are specific to their cluster, so they're routed as they are. The forwarded
+// alerts are kept in an in-memory history, served along with the clusters' status over HTTP.
+type Aggregator struct {
+	config *Config
+	client *api.Client
+
+	// Verifies the signatures of forwarded alerts, if aggregator_signing_secret is set
+	replays *replayGuard
+
+	lock     sync.Mutex
+	history  []aggregatorEvent
+	clusters map[string]*aggregatorCluster
+	alerts   map[string]*globalAlert
+}
+
+// A forwarded alert, as kept in the aggregator's history
+type aggregatorEvent struct {
+	ReceivedAt   time.Time  `json:"received_at"`
+	Cluster      string     `json:"cluster"`
+	Datacenter   string     `json:"datacenter"`
+	Alert        AlertState `json:"alert"`
+	Deduplicated bool       `json:"deduplicated"`
+}
+
+// A cluster that has forwarded alerts to the aggregator
+type aggregatorCluster struct {
+	Cluster    string    `json:"cluster"`
+	Datacenter string    `json:"datacenter"`
+	LastSeen   time.Time `json:"last_seen"`
+	Received   int       `json:"received"`
+}
+
+// The state of a service across every cluster that has alerted on it
+type globalAlert struct {
+	Service    string            `json:"service"`
+	Tag        string            `json:"tag,omitempty"`
+	Status     string            `json:"status"`
+	Clusters   map[string]string `json:"clusters"`
+	LastChange time.Time         `json:"last_change"`
+
+	// The latest details and failing checks from each cluster
+	details map[string]string
+	checks  map[string][]CheckSummary
+}
+
+func newAggregator(config *Config, client *api.Client) *Aggregator {
+	return &Aggregator{
+		config:   config,
+		client:   client,
+		replays:  newReplayGuard(time.Duration(config.AggregatorReplayWindow) * time.Second),
+		history:  make([]aggregatorEvent, 0),
+		clusters: make(map[string]*aggregatorCluster),
+		alerts:   make(map[string]*globalAlert),
+	}
+}
+
+// Returns the router for the aggregator's API and status page
+func (a *Aggregator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(aggregatorAlertsPath, a.alertsEndpoint)
+	mux.HandleFunc("/v1/aggregator/history", a.listHistory)
+	mux.HandleFunc("/v1/aggregator/clusters", a.listClusters)
+	mux.HandleFunc("/", a.statusPage)
+	return a.authenticate(mux)
+}
+
+// Starts serving the aggregator on the configured address, using TLS if a certificate is set
+func (a *Aggregator) start() {
+	server := &http.Server{
+		Addr:    a.config.AggregatorAddress,
+		Handler: a.handler(),
+	}
+
+	var err error
+	if a.config.AggregatorTLSCert != "" {
+		log.Infof("Serving aggregator on %s (TLS)", a.config.AggregatorAddress)
+		err = server.ListenAndServeTLS(a.config.AggregatorTLSCert, a.config.AggregatorTLSKey)
+	} else {
+		log.Infof("Serving aggregator on %s", a.config.AggregatorAddress)
+		err = server.ListenAndServe()
+	}
+
+	if err != nil {
+		fatalError(a.config, a.client, ExitFatal, fmt.Errorf("Error running aggregator: %s", err))
+	}
+}
+
+// Wraps the given handler to require the aggregator token, either as a bearer token or as the
+// password for basic auth (so the status page can be opened in a browser). If no token is
+// configured, requests are passed through as-is.
+func (a *Aggregator) authenticate(next http.Handler) http.Handler {
+	token := a.config.AggregatorToken
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pass, ok := r.BasicAuth(); ok && secureEqual(pass, token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") &&
+			secureEqual(strings.TrimPrefix(header, "Bearer "), token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="consul-alerting aggregator"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// POST /v1/aggregator/alerts receives a forwarded alert, and GET lists the services that are
+// failing in any cluster. With aggregator_signing_secret set, forwarded alerts must be signed
+// with it, within the replay window and with a signature that hasn't been used before.
+func (a *Aggregator) alertsEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, a.activeAlerts())
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if secret := a.config.AggregatorSigningSecret; secret != "" {
+			if err := a.replays.verify(r, secret, body, time.Now()); err != nil {
+				log.Warnf("Rejected forwarded alert from %s: %s", r.RemoteAddr, err)
+				http.Error(w, fmt.Sprintf("invalid signature: %s", err), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		var forwarded forwardedAlert
+		if err := json.Unmarshal(body, &forwarded); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if forwarded.Cluster == "" || forwarded.Alert.Status == "" {
+			http.Error(w, "cluster and alert status are required", http.StatusBadRequest)
+			return
+		}
+
+		a.receive(&forwarded)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /v1/aggregator/history lists the most recently forwarded alerts, newest first. The
+// cluster, service and node query parameters filter the list, and limit caps its length
+// (defaulting to 100).
+func (a *Aggregator) listHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit: %s", raw), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	query := r.URL.Query()
+	writeJSON(w, a.recentEvents(query.Get("cluster"), query.Get("service"), query.Get("node"), limit))
+}
+
+// GET /v1/aggregator/clusters lists the clusters that have forwarded alerts
+func (a *Aggregator) listClusters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, a.clusterList())
+}
+
+// Records a forwarded alert and sends a notification for it if it changes the global state.
+// The notification is sent in the background so the forwarding cluster isn't held up by
+// the aggregator's handlers retrying.
+func (a *Aggregator) receive(forwarded *forwardedAlert) {
+	notification, datacenter := a.aggregate(forwarded, time.Now())
+	if notification == nil {
+		log.Infof("Deduplicated alert from cluster %s: %s", forwarded.Cluster, forwarded.Alert.Message)
+		return
+	}
+
+	log.Infof("Routing alert from cluster %s: %s", forwarded.Cluster, notification.Message)
+	go dispatchAlertFrom(a.config, datacenter, notification.Service, notification)
+}
+
+// Adds a forwarded alert to the history and global state. Returns the notification to send
+// and the datacenter to send it as, or nil if the alert was a duplicate.
+func (a *Aggregator) aggregate(forwarded *forwardedAlert, now time.Time) (*AlertState, string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	cluster, ok := a.clusters[forwarded.Cluster]
+	if !ok {
+		cluster = &aggregatorCluster{Cluster: forwarded.Cluster}
+		a.clusters[forwarded.Cluster] = cluster
+		log.Infof("Receiving alerts from new cluster %s", forwarded.Cluster)
+	}
+	cluster.Datacenter = forwarded.Datacenter
+	cluster.LastSeen = now
+	cluster.Received++
+
+	event := aggregatorEvent{
+		ReceivedAt: now,
+		Cluster:    forwarded.Cluster,
+		Datacenter: forwarded.Datacenter,
+		Alert:      forwarded.Alert,
+	}
+
+	// Nodes only exist in one cluster, so their alerts are routed as they are
+	alert := forwarded.Alert
+	if alert.Service == "" {
+		a.record(event)
+		return &alert, forwarded.Datacenter
+	}
+
+	key := alert.Service + "/" + alert.Tag
+	global, ok := a.alerts[key]
+	if !ok {
+		global = &globalAlert{
+			Service:  alert.Service,
+			Tag:      alert.Tag,
+			Status:   api.HealthPassing,
+			Clusters: make(map[string]string),
+			details:  make(map[string]string),
+			checks:   make(map[string][]CheckSummary),
+		}
+		a.alerts[key] = global
+	}
+	global.Clusters[forwarded.Cluster] = alert.Status
+	global.details[forwarded.Cluster] = alert.Details
+	global.checks[forwarded.Cluster] = alert.Checks
+
+	status := computeHealth(global.Clusters)
+	if status == global.Status {
+		event.Deduplicated = true
+		a.record(event)
+		return nil, ""
+	}
+	a.record(event)
+
+	global.Status = status
+	global.LastChange = now
+	notification := global.notification(alert)
+
+	// Forget services once they've recovered everywhere
+	if status == api.HealthPassing {
+		delete(a.alerts, key)
+	}
+
+	return notification, globalDatacenter
+}
+
+// Adds an event to the history, dropping the oldest one if it's full
+func (a *Aggregator) record(event aggregatorEvent) {
+	size := a.config.AggregatorHistorySize
+	if len(a.history) >= size && size > 0 {
+		copy(a.history, a.history[1:])
+		a.history[len(a.history)-1] = event
+		return
+	}
+	a.history = append(a.history, event)
+}
+
+// Returns the notification for a change in a service's global status, listing the
+// clusters it's failing in along with each of their details
+func (g *globalAlert) notification(alert AlertState) *AlertState {
+	failing := g.failingClusters()
+
+	alert.Status = g.Status
+	alert.Message = fmt.Sprintf("[%s] %s is now %s", globalDatacenter, alertName(&alert), g.Status)
+	alert.Checks = nil
+	if len(failing) == 0 {
+		alert.Details = "Recovered in every cluster"
+		return &alert
+	}
+
+	alert.Message = alert.Message + " in " + strings.Join(failing, ", ")
+	details := make([]string, 0, len(failing))
+	for _, cluster := range failing {
+		details = append(details, fmt.Sprintf("%s (%s):\n%s", cluster, g.Clusters[cluster], g.details[cluster]))
+		alert.Checks = append(alert.Checks, g.checks[cluster]...)
+	}
+	alert.Details = strings.Join(details, "\n\n")
+
+	return &alert
+}
+
+// Returns the sorted names of the clusters the service isn't passing in
+func (g *globalAlert) failingClusters() []string {
+	failing := make([]string, 0)
+	for cluster, status := range g.Clusters {
+		if status != api.HealthPassing {
+			failing = append(failing, cluster)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+// Returns the services that are failing in any cluster, sorted by name
+func (a *Aggregator) activeAlerts() []globalAlert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	alerts := make([]globalAlert, 0, len(a.alerts))
+	for _, global := range a.alerts {
+		if global.Status != api.HealthPassing {
+			alert := *global
+			alert.Clusters = make(map[string]string)
+			for cluster, status := range global.Clusters {
+				alert.Clusters[cluster] = status
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+	sort.Sort(globalAlertsByName(alerts))
+	return alerts
+}
+
+type globalAlertsByName []globalAlert
+
+func (s globalAlertsByName) Len() int      { return len(s) }
+func (s globalAlertsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s globalAlertsByName) Less(i, j int) bool {
+	return s[i].Service+"/"+s[i].Tag < s[j].Service+"/"+s[j].Tag
+}
+
+// Returns up to limit of the most recent events matching the filters, newest first
+func (a *Aggregator) recentEvents(cluster string, service string, node string, limit int) []aggregatorEvent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	events := make([]aggregatorEvent, 0)
+	for i := len(a.history) - 1; i >= 0 && len(events) < limit; i-- {
+		event := a.history[i]
+		if (cluster != "" && event.Cluster != cluster) || (service != "" && event.Alert.Service != service) ||
+			(node != "" && event.Alert.Node != node) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Returns the clusters that have forwarded alerts, sorted by name
+func (a *Aggregator) clusterList() []aggregatorCluster {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	names := make([]string, 0, len(a.clusters))
+	for name, _ := range a.clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clusters := make([]aggregatorCluster, 0, len(names))
+	for _, name := range names {
+		clusters = append(clusters, *a.clusters[name])
+	}
+	return clusters
+}
+
+var aggregatorPageTemplate = template.Must(template.New("aggregator").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>consul-alerting aggregator</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+.critical { color: #c00; } .warning { color: #c80; } .passing { color: #080; }
+</style>
+</head>
+<body>
+<h1>consul-alerting aggregator</h1>
+
+<h2>Failing services</h2>
+<table>
+<tr><th>Service</th><th>Status</th><th>Clusters</th><th>Since</th></tr>
+{{range .Alerts}}<tr><td>{{.Service}}{{if .Tag}} ({{.Tag}}){{end}}</td><td class="{{.Status}}">{{.Status}}</td>
+<td>{{range $cluster, $status := .Clusters}}<span class="{{$status}}">{{$cluster}}</span> {{end}}</td><td>{{.LastChange.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+{{else}}<tr><td colspan="4">None</td></tr>
+{{end}}</table>
+
+<h2>Clusters</h2>
+<table>
+<tr><th>Cluster</th><th>Datacenter</th><th>Last alert</th><th>Alerts received</th></tr>
+{{range .Clusters}}<tr><td>{{.Cluster}}</td><td>{{.Datacenter}}</td><td>{{.LastSeen.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Received}}</td></tr>
+{{else}}<tr><td colspan="4">None</td></tr>
+{{end}}</table>
+
+<h2>Recent alerts</h2>
+<table>
+<tr><th>Received</th><th>Cluster</th><th>Status</th><th>Message</th></tr>
+{{range .History}}<tr><td>{{.ReceivedAt.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Cluster}}</td>
+<td class="{{.Alert.Status}}">{{.Alert.Status}}</td><td>{{.Alert.Message}}{{if .Deduplicated}} <i>(deduplicated)</i>{{end}}</td></tr>
+{{else}}<tr><td colspan="4">None</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// GET / serves a page with the failing services, clusters and recent alerts
+func (a *Aggregator) statusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Alerts":   a.activeAlerts(),
+		"Clusters": a.clusterList(),
+		"History":  a.recentEvents("", "", "", 50),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := aggregatorPageTemplate.Execute(w, data); err != nil {
+		log.Error("Error rendering aggregator page: ", err)
+	}
+}
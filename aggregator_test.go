@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func testAggregator(t *testing.T, raw string) (*Aggregator, chan *AlertState) {
+	config, err := ParseConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := make(chan *AlertState, 10)
+	config.Handlers = map[string]AlertHandler{"test.alerts": testHandler{alerts: alerts}}
+	return newAggregator(config, nil), alerts
+}
+
+func TestAggregator_dedup(t *testing.T) {
+	aggregator, _ := testAggregator(t, ``)
+	now := time.Now()
+
+	forward := func(cluster string, status string) (*AlertState, string) {
+		return aggregator.aggregate(&forwardedAlert{
+			Cluster:    cluster,
+			Datacenter: "dc1",
+			Alert: AlertState{
+				Service: "redis",
+				Status:  status,
+				Message: "[dc1] service redis is now " + status,
+				Details: "details from " + cluster,
+			},
+		}, now)
+	}
+
+	// The first cluster to fail triggers a global alert
+	notification, datacenter := forward("east", api.HealthCritical)
+	if notification == nil || datacenter != globalDatacenter {
+		t.Fatalf("expected a global notification, got %v (%s)", notification, datacenter)
+	}
+	if notification.Message != "[global] service redis is now critical in east" || notification.Details != "east (critical):\ndetails from east" {
+		t.Errorf("unexpected notification: %#v", notification)
+	}
+
+	// The same failure in another cluster is a duplicate
+	if notification, _ := forward("west", api.HealthCritical); notification != nil {
+		t.Errorf("expected the second cluster's alert to be deduplicated, got %#v", notification)
+	}
+
+	// Recovering in one cluster doesn't change the global status
+	if notification, _ := forward("east", api.HealthPassing); notification != nil {
+		t.Errorf("expected no notification while still failing in west, got %#v", notification)
+	}
+	if alerts := aggregator.activeAlerts(); len(alerts) != 1 || alerts[0].Clusters["west"] != api.HealthCritical {
+		t.Errorf("expected redis to still be failing in west, got %v", alerts)
+	}
+
+	// Recovering everywhere resolves the global alert
+	notification, _ = forward("west", api.HealthPassing)
+	if notification == nil || notification.Status != api.HealthPassing || notification.Message != "[global] service redis is now passing" {
+		t.Fatalf("expected a recovery notification, got %#v", notification)
+	}
+	if alerts := aggregator.activeAlerts(); len(alerts) != 0 {
+		t.Errorf("expected no active alerts, got %v", alerts)
+	}
+
+	events := aggregator.recentEvents("", "", "", 10)
+	if len(events) != 4 || events[0].Cluster != "west" || events[0].Deduplicated || !events[1].Deduplicated {
+		t.Errorf("unexpected history: %v", events)
+	}
+	if events := aggregator.recentEvents("east", "", "", 10); len(events) != 2 {
+		t.Errorf("expected 2 events from east, got %d", len(events))
+	}
+
+	// Node alerts aren't deduplicated across clusters
+	for _, cluster := range []string{"east", "west"} {
+		notification, datacenter := aggregator.aggregate(&forwardedAlert{
+			Cluster:    cluster,
+			Datacenter: "dc-" + cluster,
+			Alert:      AlertState{Node: "node1", Status: api.HealthCritical, Message: "node node1 is now critical"},
+		}, now)
+		if notification == nil || datacenter != "dc-"+cluster {
+			t.Errorf("expected the node alert from %s to be routed as-is, got %v (%s)", cluster, notification, datacenter)
+		}
+	}
+}
+
+func TestAggregator_historySize(t *testing.T) {
+	aggregator, _ := testAggregator(t, `aggregator_history_size = 3`)
+	for i := 0; i < 5; i++ {
+		aggregator.aggregate(&forwardedAlert{
+			Cluster: "east",
+			Alert:   AlertState{Node: "node" + string('0'+rune(i)), Status: api.HealthCritical},
+		}, time.Now())
+	}
+
+	events := aggregator.recentEvents("", "", "", 10)
+	if len(events) != 3 || events[0].Alert.Node != "node4" || events[2].Alert.Node != "node2" {
+		t.Errorf("expected the 3 newest events, got %v", events)
+	}
+}
+
+func TestAggregator_forward(t *testing.T) {
+	aggregator, alerts := testAggregator(t, `aggregator_token = "secret"`)
+	server := httptest.NewServer(aggregator.handler())
+	defer server.Close()
+
+	// Alerts are rejected without the token
+	handler := ForwardHandler{Address: server.URL, Cluster: "east"}
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "[dc1] service redis is now critical"}
+	if err := handler.Alert("dc1", alert); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+
+	handler.Token = "secret"
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case notification := <-alerts:
+		if notification.Message != "[global] service redis is now critical in east" {
+			t.Errorf("unexpected notification: %s", notification.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the forwarded alert to be routed")
+	}
+
+	// The cluster shows up in the API, and the page can be opened with basic auth
+	req, _ := http.NewRequest("GET", server.URL+"/v1/aggregator/clusters", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clusters []aggregatorCluster
+	if err := json.NewDecoder(resp.Body).Decode(&clusters); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(clusters) != 1 || clusters[0].Cluster != "east" || clusters[0].Datacenter != "dc1" || clusters[0].Received != 1 {
+		t.Errorf("unexpected clusters: %v", clusters)
+	}
+
+	req, _ = http.NewRequest("GET", server.URL+"/", nil)
+	req.SetBasicAuth("admin", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("expected the status page, got %d (%s)", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestAggregator_signed(t *testing.T) {
+	aggregator, alerts := testAggregator(t, `aggregator_signing_secret = "shared"`)
+	server := httptest.NewServer(aggregator.handler())
+	defer server.Close()
+
+	// Unsigned alerts are rejected
+	handler := ForwardHandler{Address: server.URL, Cluster: "east"}
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "[dc1] service redis is now critical"}
+	if err := handler.Alert("dc1", alert); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+
+	handler.SigningSecret = "shared"
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-alerts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the forwarded alert to be routed")
+	}
+
+	// A captured request can't be sent again
+	body := []byte(`{"cluster": "east", "datacenter": "dc1", "alert": {"Service": "redis", "Status": "passing"}}`)
+	signedAt := time.Now()
+	post := func() int {
+		req, _ := http.NewRequest("POST", server.URL+aggregatorAlertsPath, strings.NewReader(string(body)))
+		setWebhookSignature(req, "shared", body, signedAt)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(); code != http.StatusAccepted {
+		t.Fatalf("expected the signed alert to be accepted, got %d", code)
+	}
+	if code := post(); code != http.StatusUnauthorized {
+		t.Errorf("expected the replayed alert to be rejected, got %d", code)
+	}
+}
@@ -3,22 +3,95 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/hashicorp/consul/api"
 )
 
+// The status used for informational alerts, which aren't about a failure
+const InfoStatus = "info"
+
 type AlertState struct {
 	Status      string `json:"status"`
 	Node        string `json:"node"`
 	Service     string `json:"service"`
 	Tag         string `json:"tag"`
+	Route       string `json:"route,omitempty"`
 	UpdateIndex int64  `json:"update_index"`
 	LastAlerted string `json:"last_alerted"`
 	Message     string `json:"message"`
 	Details     string `json:"details"`
+
+	// A structured summary of the failing checks, for handlers that can display them as a table
+	Checks []CheckSummary `json:"checks,omitempty"`
+
+	// Labels attached by handler middleware
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// The alert_fields of the alert's service
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// The team owning the alert's service (or HTTP watch, composite or node route), set when
+	// it's dispatched so handlers can pick the team's credentials
+	Team string `json:"team,omitempty"`
+
+	// Whether the last alert was downgraded to informational during a deployment window
+	Downgraded bool `json:"downgraded,omitempty"`
+
+	// The number of status changes since the last alert was sent
+	Transitions int `json:"transitions,omitempty"`
+
+	// The unix time the status last changed
+	Changed int64 `json:"changed,omitempty"`
+
+	// The number of notifications (including reminders) sent since the alert last recovered
+	Notifications int `json:"notifications,omitempty"`
+
+	// Signed links for acknowledging or silencing the alert, if ack_link_secret is set
+	Links *AckLinks `json:"links,omitempty"`
+
+	// Identifies the delivery of this transition to the handler, if delivery_tracking is set,
+	// so receivers can deduplicate alerts that are sent again after a crash
+	DeliveryID string `json:"delivery_id,omitempty"`
+
+	// The Slack messages the alert was last posted in, by channel, so its recovery can be
+	// posted as a reply in their threads
+	SlackThreads map[string]SlackThread `json:"slack_threads,omitempty"`
+
+	// Records the deliveries of this transition to each handler in the KV store
+	delivery *deliveryTracker
+
+	// Records the Slack threads started or closed by sending this transition
+	threads *slackThreadTracker
+
+	// Records the intent to send this transition until every handler has it
+	intent *intentTracker
+
+	// The handlers the alert was routed to when it was dispatched, kept in its history
+	handlers []string
+
+	// The emoji, colors and prefixes set by presentation middleware, for handlers to use
+	presentation *PresentationMiddleware
+
+	// Whether the alert was acked in PagerDuty, so it should only go to PagerDuty handlers
+	acknowledged bool
+
+	// The order the watch raised this update in, used to drop updates that lost a race
+	// with a newer one
+	seq uint64
+}
+
+// CheckSummary describes the state of a single failing check at the time of an alert
+type CheckSummary struct {
+	Node    string `json:"node"`
+	CheckID string `json:"check_id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Output  string `json:"output"`
 }
 
 // Parses a CheckState from a given Consul K/V path
@@ -64,6 +137,7 @@ func setAlertState(kvPath string, alert *AlertState, client *api.Client) error {
 	if err != nil {
 		return fmt.Errorf("Error storing state for alert in Consul: %s", err)
 	}
+	atomic.AddUint64(&stateWrites, 1)
 
 	return nil
 }
@@ -71,8 +145,29 @@ func setAlertState(kvPath string, alert *AlertState, client *api.Client) error {
 // Waits for changeThreshold duration, then alerts if LastUpdated has not
 // changed in the meantime (which would indicate another alert resetting the timer)
 func tryAlert(kvPath string, update AlertState, watchOpts *WatchOptions) {
+	changeThreshold := watchOpts.config.serviceChangeThreshold(watchOpts.service)
+	if consulThrottle.throttled() {
+		changeThreshold *= throttledThresholdFactor
+	}
+	tryAlertAfter(kvPath, update, watchOpts, time.Duration(changeThreshold)*time.Second)
+}
+
+// Same as tryAlert, but waits for the given delay instead of the change threshold
+func tryAlertAfter(kvPath string, update AlertState, watchOpts *WatchOptions, delay time.Duration) {
 	// Lock the mutex while reading or writing the alert state to avoid race conditions
 	watchOpts.alertLock.Lock()
+
+	// Updates are sent from separate goroutines, so a newer update can get the lock first. If
+	// that happened, this update is already stale and the newer one's timer takes over.
+	if update.seq != 0 {
+		if update.seq < watchOpts.alertSeqs[kvPath] {
+			log.Debugf("Dropping out of order update for alert: '%s'", update.Message)
+			watchOpts.alertLock.Unlock()
+			return
+		}
+		watchOpts.alertSeqs[kvPath] = update.seq
+	}
+
 	alert, err := getAlertState(kvPath, watchOpts.client)
 
 	if err != nil {
@@ -87,13 +182,21 @@ func tryAlert(kvPath string, update AlertState, watchOpts *WatchOptions) {
 			Node:        watchOpts.node,
 			Service:     watchOpts.service,
 			Tag:         watchOpts.tag,
+			Route:       update.Route,
 			LastAlerted: api.HealthPassing,
 		}
 	}
 
+	// Count the status changes within the change threshold, so flapping can be noted
+	if alert.Status != update.Status {
+		alert.Transitions++
+		alert.Changed = time.Now().Unix()
+	}
+
 	alert.Status = update.Status
 	alert.Message = update.Message
 	alert.Details = update.Details
+	alert.Checks = update.Checks
 
 	// Increment the update index and store it, so we can check later to see if it changed
 	alert.UpdateIndex++
@@ -107,10 +210,10 @@ func tryAlert(kvPath string, update AlertState, watchOpts *WatchOptions) {
 		return
 	}
 	watchOpts.alertLock.Unlock()
+	watchOpts.config.logEvent(EventPending, alert)
 
-	changeThreshold := watchOpts.config.serviceChangeThreshold(watchOpts.service)
 	log.Debugf("Starting timer for alert: '%s'", update.Message)
-	time.Sleep(time.Duration(changeThreshold) * time.Second)
+	time.Sleep(delay)
 
 	watchOpts.alertLock.Lock()
 	defer watchOpts.alertLock.Unlock()
@@ -127,27 +230,297 @@ func tryAlert(kvPath string, update AlertState, watchOpts *WatchOptions) {
 		return
 	}
 
-	// If no new alerts were triggered during the sleep, send the alert to each handler to be processed
-	if alert.UpdateIndex == updateIndex && update.Status != alert.LastAlerted {
-		for _, handler := range watchOpts.config.serviceHandlers(watchOpts.service) {
-			handler.Alert(watchOpts.config.ConsulDatacenter, alert)
+	if alert.UpdateIndex != updateIndex {
+		return
+	}
+
+	// If no new alerts were triggered during the sleep, send the alert to each handler to be
+	// processed. Any flapping during the sleep is collapsed into this one notification for the
+	// net status, and if the status ended up back where it was, nothing is sent.
+	var threads *slackThreadTracker
+	if update.Status != alert.LastAlerted {
+		notification, downgraded := applyDeploymentWindow(flappingNote(alert), watchOpts.config, time.Now())
+		notification = applyAck(notification, watchOpts.client)
+		notification = applyReachability(notification, watchOpts.config, watchOpts.client)
+		notify, notification := applySnooze(notification, watchOpts.client)
+		capped := false
+		if notify {
+			notify, notification = spendNotification(alert, notification, watchOpts.config.MaxNotifications)
+			capped = !notify
+		}
+		if notify {
+			if watchOpts.config.DeliveryTracking {
+				notification.delivery = newDeliveryTracker(watchOpts.client, watchOpts.config, kvPath, notification)
+			}
+			threads = newSlackThreadTracker(watchOpts.client, kvPath, watchOpts.alertLock)
+			notification.threads = threads
+			if watchOpts.config.DeliveryIntents {
+				notification.intent = newIntentTracker(watchOpts.client, watchOpts.config.stateKVRoot(), kvPath, update.Status)
+			}
+			dispatchAlert(watchOpts.config, watchOpts.service, notification)
+			watchOpts.config.logEvent(EventSent, notification)
+		} else if capped {
+			watchOpts.config.logEvent(EventCapped, alert)
+		} else {
+			watchOpts.config.logEvent(EventSnoozed, alert)
+
+			// Leave LastAlerted alone so the alert is still sent if the check is failing
+			// when the snooze runs out
+			go alertAfterSnooze(kvPath, watchOpts)
+		}
+		if notify || capped {
+			alert.LastAlerted = update.Status
+			alert.Downgraded = downgraded
+			if update.Status == api.HealthPassing {
+				alert.Notifications = 0
+			}
+		}
+	} else if alert.Transitions > 1 {
+		log.Infof("Not alerting on %s, which flapped %d times before returning to %s", alertName(alert), alert.Transitions, alert.Status)
+		watchOpts.config.logEvent(EventUnchanged, alert)
+	}
+	alert.Transitions = 0
+	if threads != nil {
+		threads.apply(alert)
+	}
+
+	err = setAlertState(kvPath, alert, watchOpts.client)
+	if err != nil {
+		log.Error("Error setting alert state: ", err)
+	}
+}
+
+// Returns the alert with a note about how many times it flapped while waiting out the change
+// threshold, if it changed more than once
+func flappingNote(alert *AlertState) *AlertState {
+	if alert.Transitions <= 1 {
+		return alert
+	}
+
+	notification := *alert
+	notification.Details = strings.TrimSpace(fmt.Sprintf("Flapped %d times during evaluation\n%s", alert.Transitions, alert.Details))
+	return &notification
+}
+
+// Replaces the details and failing checks of an alert that's already been sent for the update's
+// status, such as when a failing check's output changed, without alerting again. Alerts with a
+// status change still waiting out the change threshold are left alone, so they're sent with the
+// details of the change.
+func refreshAlertDetails(kvPath string, update AlertState, watchOpts *WatchOptions) {
+	watchOpts.alertLock.Lock()
+	defer watchOpts.alertLock.Unlock()
+
+	alert, err := getAlertState(kvPath, watchOpts.client)
+	if err != nil {
+		log.Error("Error fetching alert state: ", err)
+		return
+	}
+	if alert == nil || alert.Status != update.Status || alert.LastAlerted != update.Status {
+		return
+	}
+
+	log.Debugf("Refreshing details for alert '%s'", alert.Message)
+	alert.Details = update.Details
+	alert.Checks = update.Checks
+	if err := setAlertState(kvPath, alert, watchOpts.client); err != nil {
+		log.Error("Error setting alert state: ", err)
+	}
+}
+
+// Stores the state of a newly discovered node/service as already alerted on, without sending
+// anything, so that only its next transition triggers an alert
+func setBaselineAlert(kvPath string, update AlertState, watchOpts *WatchOptions) {
+	watchOpts.alertLock.Lock()
+	defer watchOpts.alertLock.Unlock()
+
+	alert, err := getAlertState(kvPath, watchOpts.client)
+	if err != nil {
+		log.Error("Error fetching alert state: ", err)
+		return
+	}
+	if alert == nil {
+		alert = &AlertState{
+			Node:    watchOpts.node,
+			Service: watchOpts.service,
+			Tag:     watchOpts.tag,
+		}
+	}
+
+	alert.Status = update.Status
+	alert.Message = update.Message
+	alert.Details = update.Details
+	alert.Checks = update.Checks
+	alert.LastAlerted = update.Status
+	alert.Transitions = 0
+	alert.UpdateIndex++
+
+	if err := setAlertState(kvPath, alert, watchOpts.client); err != nil {
+		log.Error("Error setting alert state: ", err)
+	}
+	watchOpts.config.logEvent(EventBaseline, alert)
+}
+
+// Sends an alert to each of the service's handlers (or its tier's), or the node route's
+// handlers if the alert is for a node route. If dispatch_workers is set, the alert is queued for the workers to send
+// in priority order instead.
+func dispatchAlert(config *Config, service string, alert *AlertState) {
+	recordFiredAlert(config, alert)
+	alert.handlers = config.alertHandlerIDs(service, alert)
+
+	// Nothing is sent in shadow mode. The event the caller logs for the alert records what
+	// would have been sent in the shadow's history instead.
+	if config.ShadowMode {
+		log.Infof("Shadow mode, not sending alert '%s' to %v", alert.Message, alert.handlers)
+		return
+	}
+
+	alert = config.withAlertFields(service, alert)
+	dispatchAlertFrom(config, config.ConsulDatacenter, service, config.withAckLinks(alert, time.Now()))
+}
+
+// Returns the handlers for an alert: the HTTP watch's, composite's or node route's handlers if
+// it's for one, otherwise the service's handlers (or its tier's)
+func (c *Config) alertHandlerIDs(service string, alert *AlertState) []string {
+	if name, ok := httpWatchName(alert); ok {
+		return c.httpWatchHandlerIDs(name, c.alertTier(alert))
+	}
+	if name, ok := compositeName(alert); ok {
+		return c.compositeHandlerIDs(name, c.alertTier(alert))
+	}
+	if alert.Route != "" && alert.Service == "" {
+		return c.nodeRouteHandlerIDs(alert.Route)
+	}
+	return c.serviceTierHandlerIDs(service, c.alertTier(alert))
+}
+
+// Sends an alert from the given datacenter through the handlers for the service (or the
+// alert's node route), such as for alerts forwarded to the aggregator from other clusters
+func dispatchAlertFrom(config *Config, datacenter string, service string, alert *AlertState) {
+	dispatchAlertTo(config, datacenter, service, alert, config.alertHandlerIDs(service, alert))
+}
+
+// Sends an alert from the given datacenter through the given handlers
+func dispatchAlertTo(config *Config, datacenter string, service string, alert *AlertState, ids []string) {
+	alert = config.withAlertTeam(service, alert)
+
+	// Record the intent to send the alert before any handler is called, so it can be sent
+	// again if the process crashes partway through
+	if alert.intent != nil {
+		alert.intent.write(datacenter, service, ids, alert)
+	}
+
+	for _, id := range ids {
+		// Acked alerts only update the PagerDuty incident, without paging other channels
+		if alert.acknowledged {
+			if handler, ok := config.handler(id); !ok || !isPagerdutyHandler(handler) {
+				log.Debugf("Not sending acknowledged alert '%s' to %s", alert.Message, id)
+				alert.intent.done(id)
+				continue
+			}
 		}
-		alert.LastAlerted = update.Status
 
-		err = setAlertState(kvPath, alert, watchOpts.client)
-		if err != nil {
-			log.Error("Error setting alert state: ", err)
+		// Skip handlers this transition was already sent to, such as by a leader that crashed
+		// before storing the alert state
+		delivery := alert
+		if alert.delivery != nil {
+			handler, ok := config.handler(id)
+			if !ok {
+				alert.intent.done(id)
+				continue
+			}
+			deliveryID, send := alert.delivery.claim(id, handler)
+			if !send {
+				alert.intent.done(id)
+				continue
+			}
+			copied := *alert
+			copied.DeliveryID = deliveryID
+			delivery = &copied
 		}
+
+		if dispatch := config.dispatchQueue; dispatch != nil {
+			if handler, ok := config.handler(id); ok {
+				dispatch.push(id, handler, datacenter, delivery)
+			} else {
+				alert.intent.done(id)
+			}
+			continue
+		}
+
+		deliverAlert(config, id, datacenter, delivery)
+	}
+}
+
+// Sends an alert to a single handler. If a delivery queue is configured, alerts that the
+// handler fails to deliver are queued to be sent once the handler recovers. The alert's
+// delivery intent is cleared for the handler once it has the alert, it's safely queued, or
+// delivering it failed for good.
+func deliverAlert(config *Config, id string, datacenter string, alert *AlertState) {
+	queue := config.deliveryQueue
+	defer alert.intent.done(id)
+
+	// Keep alerts in order behind any that are already waiting on this handler
+	if queue != nil && queue.pending(id) {
+		if err := queue.push(id, datacenter, alert); err != nil {
+			log.Errorf("Error queueing alert for %s: %s", id, err)
+		}
+		return
+	}
+
+	handler, ok := config.handler(id)
+	if !ok {
+		return
+	}
+
+	err := handler.Alert(datacenter, alert)
+	if err == nil && alert.delivery != nil {
+		alert.delivery.delivered(id, alert.DeliveryID)
+	}
+	if err != nil && queue != nil {
+		log.Warnf("Queueing alert for %s after failing to deliver it: %s", id, err)
+		if err := queue.push(id, datacenter, alert); err != nil {
+			log.Errorf("Error queueing alert for %s: %s", id, err)
+		}
+	} else if err != nil {
+		log.Errorf("Giving up on delivering alert '%s' to %s: %s", alert.Message, id, err)
+	}
+}
+
+// Returns true if the handler (underneath any middleware) sends alerts to PagerDuty
+func isPagerdutyHandler(handler AlertHandler) bool {
+	_, ok := unwrapHandler(handler).(PagerdutyHandler)
+	return ok
+}
+
+// Returns a readable name for the node/service an alert is about
+func alertName(alert *AlertState) string {
+	if name, ok := httpWatchName(alert); ok {
+		return "http watch " + name
 	}
+	if name, ok := compositeName(alert); ok {
+		return "composite " + name
+	}
+	if alert.Service == "" {
+		if alert.Route != "" {
+			return fmt.Sprintf("node %s (route: %s)", alert.Node, alert.Route)
+		}
+		return "node " + alert.Node
+	}
+
+	name := "service " + alert.Service
+	if alert.Tag != "" {
+		name = name + fmt.Sprintf(" (tag: %s)", alert.Tag)
+	}
+	return name
 }
 
 // Returns each failing check and its output, used for formatting alert details
-func nodeDetails(checks []*api.HealthCheck) string {
+func nodeDetails(checks []*api.HealthCheck, runbooks []checkRunbook) string {
 	details := ""
 
 	for _, check := range checks {
 		if check.ServiceID == "" && (check.Status == api.HealthCritical || check.Status == api.HealthWarning) {
-			details = details + fmt.Sprintf("=> (check) %s:\n%s", check.Name, check.Output)
+			details = details + fmt.Sprintf("=> (check) %s:\n%s", check.Name, check.Output) + runbookLinks(check, runbooks)
 		}
 	}
 
@@ -160,7 +533,7 @@ func nodeDetails(checks []*api.HealthCheck) string {
 }
 
 // Returns each failing check and its output, grouped by node, used for formatting alert details
-func serviceDetails(checks []*api.HealthCheck) string {
+func serviceDetails(checks []*api.HealthCheck, runbooks []checkRunbook) string {
 	details := ""
 	// Make a map for combining the failing health check outputs on each node
 	nodeStatuses := make(map[string]string)
@@ -170,7 +543,8 @@ func serviceDetails(checks []*api.HealthCheck) string {
 			if _, ok := nodeStatuses[check.Node]; !ok {
 				nodeStatuses[check.Node] = ""
 			}
-			nodeStatuses[check.Node] = nodeStatuses[check.Node] + fmt.Sprintf("==> (check) %s:\n%s", check.Name, check.Output)
+			nodeStatuses[check.Node] = nodeStatuses[check.Node] + fmt.Sprintf("==> (check) %s:\n%s", check.Name, check.Output) +
+				runbookLinks(check, runbooks)
 		}
 	}
 
@@ -184,3 +558,34 @@ func serviceDetails(checks []*api.HealthCheck) string {
 
 	return strings.TrimSpace(details)
 }
+
+// Returns a summary of each failing check, sorted by node and check name. Node watches only
+// include the node-level checks, to match nodeDetails.
+func failingCheckSummaries(checks []*api.HealthCheck, mode string) []CheckSummary {
+	summaries := make([]CheckSummary, 0)
+	for _, check := range checks {
+		if mode == NodeWatch && check.ServiceID != "" {
+			continue
+		}
+		if check.Status != api.HealthCritical && check.Status != api.HealthWarning {
+			continue
+		}
+
+		summaries = append(summaries, CheckSummary{
+			Node:    check.Node,
+			CheckID: check.CheckID,
+			Name:    check.Name,
+			Status:  check.Status,
+			Output:  strings.TrimSpace(check.Output),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Node != summaries[j].Node {
+			return summaries[i].Node < summaries[j].Node
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	return summaries
+}
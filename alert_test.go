@@ -74,6 +74,153 @@ func TestAlert_tryAlert(t *testing.T) {
 	}
 }
 
+// Flap critical/passing/critical within the change threshold, with the updates arriving out of
+// order, and make sure a single alert for the net status is sent
+func TestAlert_collapseTransitions(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config, alertCh := testAlertConfig()
+	config.ChangeThreshold = 1
+	opts := &WatchOptions{
+		client:    client,
+		config:    config,
+		alertLock: &sync.Mutex{},
+		alertSeqs: make(map[string]uint64),
+	}
+
+	go tryAlert(testAlertKVPath, AlertState{seq: 1, Status: api.HealthCritical}, opts)
+	time.Sleep(100 * time.Millisecond)
+	go tryAlert(testAlertKVPath, AlertState{seq: 2, Status: api.HealthPassing}, opts)
+	time.Sleep(100 * time.Millisecond)
+	go tryAlert(testAlertKVPath, AlertState{seq: 4, Status: api.HealthCritical, Details: "disk full"}, opts)
+	time.Sleep(100 * time.Millisecond)
+	go tryAlert(testAlertKVPath, AlertState{seq: 3, Status: api.HealthPassing}, opts)
+
+	select {
+	case alert := <-alertCh:
+		if alert.Status != api.HealthCritical {
+			t.Errorf("expected a critical alert, got %s", alert.Status)
+		}
+		if alert.Details != "Flapped 3 times during evaluation\ndisk full" {
+			t.Errorf("unexpected details: %q", alert.Details)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("didn't get alert")
+	}
+
+	select {
+	case alert := <-alertCh:
+		t.Errorf("expected only one alert, got %#v", alert)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+// Refresh the details of a sent alert and make sure nothing is sent, and that an alert still
+// waiting out its change threshold isn't touched
+func TestAlert_refreshAlertDetails(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config, alertCh := testAlertConfig()
+	opts := &WatchOptions{
+		client:    client,
+		config:    config,
+		alertLock: &sync.Mutex{},
+	}
+
+	sent := &AlertState{Status: api.HealthCritical, LastAlerted: api.HealthCritical, Details: "disk 91% full"}
+	if err := setAlertState(testAlertKVPath, sent, client); err != nil {
+		t.Fatal(err)
+	}
+	refreshAlertDetails(testAlertKVPath, AlertState{Status: api.HealthCritical, Details: "disk 97% full"}, opts)
+
+	alert, err := getAlertState(testAlertKVPath, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alert.Details != "disk 97% full" || alert.UpdateIndex != sent.UpdateIndex {
+		t.Errorf("expected only the details to be refreshed, got %#v", alert)
+	}
+
+	pending := &AlertState{Status: api.HealthWarning, LastAlerted: api.HealthCritical, Details: "disk 80% full"}
+	if err := setAlertState(testAlertKVPath, pending, client); err != nil {
+		t.Fatal(err)
+	}
+	refreshAlertDetails(testAlertKVPath, AlertState{Status: api.HealthCritical, Details: "disk 97% full"}, opts)
+	if alert, _ := getAlertState(testAlertKVPath, client); alert.Details != "disk 80% full" {
+		t.Errorf("expected a pending alert to be left alone, got %q", alert.Details)
+	}
+
+	select {
+	case alert := <-alertCh:
+		t.Errorf("expected no alert to be sent, got %#v", alert)
+	default:
+	}
+}
+
+func TestAlert_flappingNote(t *testing.T) {
+	alert := &AlertState{Status: api.HealthCritical, Details: "details", Transitions: 1}
+	if flappingNote(alert) != alert {
+		t.Error("expected a single transition to be left alone")
+	}
+
+	alert.Transitions = 3
+	if note := flappingNote(alert); note.Details != "Flapped 3 times during evaluation\ndetails" || alert.Details != "details" {
+		t.Errorf("unexpected details: %q", note.Details)
+	}
+}
+
+// Snooze an alert and make sure it's held back until the snooze runs out, then sent
+// because the check is still failing
+func TestAlert_snoozeExpires(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config, alertCh := testAlertConfig()
+
+	snooze := &Snooze{
+		Fingerprint: alertFingerprint(&AlertState{Service: testServiceName}),
+		User:        "alice",
+		Until:       time.Now().Add(2 * time.Second),
+	}
+	if err := setSnooze(snooze, client); err != nil {
+		t.Fatal(err)
+	}
+
+	go tryAlert(testAlertKVPath, AlertState{
+		Status: api.HealthCritical,
+	}, &WatchOptions{
+		service:   testServiceName,
+		client:    client,
+		config:    config,
+		alertLock: &sync.Mutex{},
+	})
+
+	select {
+	case <-alertCh:
+		t.Fatal("expected alert to be held back while snoozed")
+	case <-time.After(1 * time.Second):
+	}
+
+	alert, err := getAlertState(testAlertKVPath, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alert.LastAlerted != api.HealthPassing {
+		t.Errorf("expected snoozed alert not to be marked as sent, got %s", alert.LastAlerted)
+	}
+
+	select {
+	case alert := <-alertCh:
+		if alert.Status != api.HealthCritical {
+			t.Errorf("expected critical alert, got %s", alert.Status)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("didn't get alert after the snooze ran out")
+	}
+}
+
 // Set up two handlers but only add one to DefaultHandlers
 func TestAlert_defaultHandler(t *testing.T) {
 	client, server := testConsul(t)
@@ -153,3 +300,27 @@ func TestAlert_serviceHandler(t *testing.T) {
 	case <-time.After(1 * time.Second):
 	}
 }
+
+func TestAlert_failingCheckSummaries(t *testing.T) {
+	checks := []*api.HealthCheck{
+		&api.HealthCheck{Node: "b", CheckID: "redis", Name: "redis", ServiceID: "redis", Status: api.HealthCritical, Output: "refused\n"},
+		&api.HealthCheck{Node: "a", CheckID: "redis", Name: "redis", ServiceID: "redis", Status: api.HealthWarning, Output: "slow"},
+		&api.HealthCheck{Node: "a", CheckID: "mem", Name: "mem", Status: api.HealthCritical, Output: "oom"},
+		&api.HealthCheck{Node: "a", CheckID: "disk", Name: "disk", Status: api.HealthPassing},
+	}
+
+	expected := []CheckSummary{
+		CheckSummary{Node: "a", CheckID: "mem", Name: "mem", Status: api.HealthCritical, Output: "oom"},
+		CheckSummary{Node: "a", CheckID: "redis", Name: "redis", Status: api.HealthWarning, Output: "slow"},
+		CheckSummary{Node: "b", CheckID: "redis", Name: "redis", Status: api.HealthCritical, Output: "refused"},
+	}
+	if summaries := failingCheckSummaries(checks, ServiceWatch); !reflect.DeepEqual(summaries, expected) {
+		t.Errorf("expected %v, got %v", expected, summaries)
+	}
+
+	// Node watches only summarize node-level checks
+	expected = expected[:1]
+	if summaries := failingCheckSummaries(checks, NodeWatch); !reflect.DeepEqual(summaries, expected) {
+		t.Errorf("expected %v, got %v", expected, summaries)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// StatusServer serves the HTTP status API for inspecting and managing alerts
+type StatusServer struct {
+	config *Config
+	client *api.Client
+}
+
+// An alert as returned by the status API
+type alertStatus struct {
+	Fingerprint string `json:"fingerprint"`
+	AlertState
+}
+
+// The request body for snoozing an alert
+type snoozeRequest struct {
+	Duration string `json:"duration"`
+	User     string `json:"user"`
+	Reason   string `json:"reason"`
+}
+
+// The request body for pausing a watch
+type pauseRequest struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+// The request/response body for the log level endpoint
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+func newStatusServer(config *Config, client *api.Client) *StatusServer {
+	return &StatusServer{
+		config: config,
+		client: client,
+	}
+}
+
+// Returns the router for the status API
+func (s *StatusServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/alerts", s.listAlerts)
+	mux.HandleFunc("/v1/alerts/", s.alertAction)
+	mux.HandleFunc("/v1/alerts/history", s.alertHistory)
+	mux.HandleFunc("/v1/alerts/aging", s.alertAging)
+	mux.HandleFunc("/v1/loglevel", s.logLevel)
+	mux.HandleFunc("/v1/metrics", s.metrics)
+	mux.HandleFunc("/v1/shadow/report", s.shadowReport)
+	mux.HandleFunc("/v1/watches/paused", s.listPaused)
+	mux.HandleFunc("/v1/watches/", s.watchAction)
+
+	// Probes from the kubelet can't send the status API's credentials, and don't reveal
+	// anything about alerts
+	root := http.NewServeMux()
+	root.HandleFunc(livenessPath, s.liveness)
+	root.HandleFunc(readinessPath, s.readiness)
+	root.Handle("/", s.authenticate(mux))
+
+	// PagerDuty can't send them either, so its webhook checks its own token, and ack links
+	// are checked by their signature
+	if s.config.PagerdutyWebhookToken != "" {
+		root.HandleFunc(pagerdutyWebhookPath, s.pagerdutyWebhook)
+	}
+	if s.config.AckLinkSecret != "" {
+		root.HandleFunc(ackLinkPath, s.ackLinkAction)
+	}
+	return root
+}
+
+// Starts serving the status API on the configured address, using TLS if a certificate is set
+func (s *StatusServer) start() {
+	server := &http.Server{
+		Addr:    s.config.StatusAddress,
+		Handler: s.handler(),
+	}
+
+	var err error
+	if s.config.StatusTLSCert != "" {
+		server.TLSConfig, err = statusTLSConfig(s.config)
+		if err != nil {
+			fatalError(s.config, s.client, ExitConfig, err)
+		}
+
+		log.Infof("Serving status API on %s (TLS)", s.config.StatusAddress)
+		err = server.ListenAndServeTLS(s.config.StatusTLSCert, s.config.StatusTLSKey)
+	} else {
+		log.Infof("Serving status API on %s", s.config.StatusAddress)
+		err = server.ListenAndServe()
+	}
+
+	if err != nil {
+		fatalError(s.config, s.client, ExitFatal, fmt.Errorf("Error running status API: %s", err))
+	}
+}
+
+// Returns the TLS config for the status API, requiring client certificates signed by
+// status_tls_client_ca if it's set
+func statusTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.StatusTLSClientCA == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(config.StatusTLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading status_tls_client_ca: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Error reading status_tls_client_ca: no certificates found in %s", config.StatusTLSClientCA)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
+
+// Wraps the given handler to require the configured basic auth credentials or bearer
+// token. If neither is configured, requests are passed through as-is.
+func (s *StatusServer) authenticate(next http.Handler) http.Handler {
+	username, password, token := s.config.StatusUsername, s.config.StatusPassword, s.config.StatusToken
+	if username == "" && token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && username != "" && secureEqual(user, username) && secureEqual(pass, password) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if header := r.Header.Get("Authorization"); token != "" && strings.HasPrefix(header, "Bearer ") &&
+			secureEqual(strings.TrimPrefix(header, "Bearer "), token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="consul-alerting"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Compares two strings in constant time
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// GET /v1/alerts lists the stored state of every alert
+func (s *StatusServer) listAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	alerts, err := s.alerts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, alerts)
+}
+
+// Dispatches requests of the form /v1/alerts/{fingerprint}/{action}
+func (s *StatusServer) alertAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/alerts/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[1] {
+	case "snooze":
+		s.snooze(parts[0], w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// POST /v1/alerts/{fingerprint}/snooze silences an alert for a duration, attributed to a user
+func (s *StatusServer) snooze(fingerprint string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req snoozeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		http.Error(w, fmt.Sprintf("invalid duration: %q", req.Duration), http.StatusBadRequest)
+		return
+	}
+
+	if req.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+
+	found, err := s.findAlert(fingerprint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		http.Error(w, fmt.Sprintf("no alert with fingerprint %s", fingerprint), http.StatusNotFound)
+		return
+	}
+
+	snooze := &Snooze{
+		Fingerprint: fingerprint,
+		User:        req.User,
+		Reason:      req.Reason,
+		Until:       time.Now().Add(duration),
+	}
+	if err := setSnooze(snooze, s.client); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Alert %s (%s) snoozed by %s until %s: %s", fingerprint, alertName(&found.AlertState),
+		snooze.User, snooze.Until.Format(time.RFC3339), snooze.Reason)
+
+	writeJSON(w, snooze)
+}
+
+// GET /v1/watches/paused lists the paused watches
+func (s *StatusServer) listPaused(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	paused, _, err := listPausedWatches(s.client, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]PausedWatch, 0, len(paused))
+	for _, watch := range paused {
+		list = append(list, watch)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Watch < list[j].Watch
+	})
+
+	writeJSON(w, list)
+}
+
+// Dispatches requests of the form /v1/watches/{watch}/{action}, where the action is pause or resume
+func (s *StatusServer) watchAction(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/watches/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	id, action := path[:i], path[i+1:]
+
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "pause":
+		var req pauseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if req.User == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+		if err := validateWatchID(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		paused := &PausedWatch{Watch: id, User: req.User, Reason: req.Reason, Since: time.Now()}
+		if err := pauseWatch(paused, s.client); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Infof("Watch %s paused by %s: %s", id, paused.User, paused.Reason)
+		writeJSON(w, paused)
+	case "resume":
+		if err := validateWatchID(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := resumeWatch(id, s.client); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Infof("Watch %s resumed", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// GET /v1/loglevel returns the current log level, and PUT changes it
+func (s *StatusServer) logLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var req logLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := setLogLevel(req.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, logLevelRequest{Level: log.GetLevel().String()})
+}
+
+// The counters reported by GET /v1/metrics
+type metricsResponse struct {
+	StateWrites     uint64                        `json:"state_writes"`
+	UnknownStatuses map[string]uint64             `json:"unknown_statuses"`
+	Throttled       bool                          `json:"throttled"`
+	CheckStates     checkStateMetrics             `json:"check_states"`
+	HeapBytes       uint64                        `json:"heap_bytes"`
+	StartupSync     map[string]startupSyncMetrics `json:"startup_sync"`
+}
+
+// GET /v1/metrics returns internal counters: the number of state writes made to the KV store
+// and how many times checks were seen with each unknown status, along with whether requests
+// to Consul are being throttled, the memory held by check states and the progress of the
+// startup sync. With format=prometheus, they're returned in the Prometheus
+// text format along with the per-entity metrics.
+func (s *StatusServer) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "prometheus" {
+		// The alert states are only loaded if they could be reported
+		states := make([]alertStatus, 0)
+		s.config.lock.RLock()
+		enabled := len(s.config.entityMetricPatterns) > 0
+		s.config.lock.RUnlock()
+		if enabled {
+			var err error
+			if states, err = s.alerts(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var buf bytes.Buffer
+		writePrometheusMetrics(&buf, s.config, states, firedAlerts.snapshot(), time.Now())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	writeJSON(w, metricsResponse{
+		StateWrites:     atomic.LoadUint64(&stateWrites),
+		UnknownStatuses: unknownStatuses.snapshot(),
+		Throttled:       consulThrottle.throttled(),
+		CheckStates:     currentCheckStateMetrics(),
+		StartupSync:     startupSync.snapshot(),
+		HeapBytes:       heapBytes(),
+	})
+}
+
+// Loads every alert state stored in the KV store
+func (s *StatusServer) alerts() ([]alertStatus, error) {
+	return listAlertStates(s.client)
+}
+
+// Loads every alert state stored in the KV store, along with its fingerprint
+func listAlertStates(client *api.Client) ([]alertStatus, error) {
+	keys, _, err := client.KV().Keys(alertingKVRoot+"/", "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing alerts: %s", err)
+	}
+
+	alerts := make([]alertStatus, 0)
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/alert") {
+			continue
+		}
+
+		alert, err := getAlertState(key, client)
+		if err != nil {
+			return nil, err
+		}
+		if alert == nil {
+			continue
+		}
+
+		alerts = append(alerts, alertStatus{
+			Fingerprint: alertFingerprint(alert),
+			AlertState:  *alert,
+		})
+	}
+
+	return alerts, nil
+}
+
+// Returns the alert with the given fingerprint, or nil if there isn't one
+func (s *StatusServer) findAlert(fingerprint string) (*alertStatus, error) {
+	alerts, err := s.alerts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alert := range alerts {
+		if alert.Fingerprint == fingerprint {
+			return &alert, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Error writing status API response: ", err)
+	}
+}
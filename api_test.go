@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Snooze a stored alert through the status API and make sure the following
+// critical notification is suppressed
+func TestAPI_snooze(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	alert := &AlertState{
+		Service: testServiceName,
+		Status:  api.HealthCritical,
+	}
+	if err := setAlertState(alertingKVRoot+"/service/"+testServiceName+"/alert", alert, client); err != nil {
+		t.Fatal(err)
+	}
+
+	status := newStatusServer(&Config{}, client)
+	fingerprint := alertFingerprint(alert)
+
+	body := strings.NewReader(`{"duration": "1h", "user": "alice", "reason": "known issue"}`)
+	req, _ := http.NewRequest("POST", "/v1/alerts/"+fingerprint+"/snooze", body)
+	resp := httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	notify, _ := applySnooze(alert, client)
+	if notify {
+		t.Error("expected critical alert to be suppressed while snoozed")
+	}
+
+	recovery := *alert
+	recovery.Status = api.HealthPassing
+	notify, notification := applySnooze(&recovery, client)
+	if !notify {
+		t.Fatal("expected recovery to be sent while snoozed")
+	}
+	if !strings.HasPrefix(notification.Details, "Snoozed by alice until ") {
+		t.Errorf("expected snooze attribution in details, got '%s'", notification.Details)
+	}
+}
+
+func TestAPI_snoozeUnknownAlert(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	status := newStatusServer(&Config{}, client)
+
+	body := strings.NewReader(`{"duration": "1h", "user": "alice"}`)
+	req, _ := http.NewRequest("POST", "/v1/alerts/0123456789abcdef/snooze", body)
+	resp := httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", resp.Code)
+	}
+}
+
+func TestAPI_snoozeBadRequest(t *testing.T) {
+	status := newStatusServer(&Config{}, nil)
+
+	for _, body := range []string{`{"user": "alice"}`, `{"duration": "1h"}`, `not json`} {
+		req, _ := http.NewRequest("POST", "/v1/alerts/0123456789abcdef/snooze", strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		status.handler().ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for body %s, got %d", body, resp.Code)
+		}
+	}
+}
+
+func TestAPI_logLevel(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+
+	status := newStatusServer(&Config{}, nil)
+
+	req, _ := http.NewRequest("PUT", "/v1/loglevel", strings.NewReader(`{"level": "debug"}`))
+	resp := httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Fatalf("expected log level %s, got %s", log.DebugLevel, log.GetLevel())
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/loglevel", nil)
+	resp = httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+
+	expected := `{"level":"debug"}`
+	if strings.TrimSpace(resp.Body.String()) != expected {
+		t.Errorf("expected %s, got %s", expected, resp.Body.String())
+	}
+
+	req, _ = http.NewRequest("PUT", "/v1/loglevel", strings.NewReader(`{"level": "loud"}`))
+	resp = httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for invalid level, got %d", resp.Code)
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Fatalf("expected log level to stay %s, got %s", log.DebugLevel, log.GetLevel())
+	}
+}
+
+func TestAPI_authentication(t *testing.T) {
+	status := newStatusServer(&Config{
+		StatusUsername: "admin",
+		StatusPassword: "hunter2",
+		StatusToken:    "s3cret",
+	}, nil)
+
+	cases := []struct {
+		setup    func(r *http.Request)
+		expected int
+	}{
+		{func(r *http.Request) {}, http.StatusUnauthorized},
+		{func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{func(r *http.Request) { r.SetBasicAuth("admin", "hunter2") }, http.StatusOK},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest("GET", "/v1/loglevel", nil)
+		c.setup(req)
+		resp := httptest.NewRecorder()
+		status.handler().ServeHTTP(resp, req)
+
+		if resp.Code != c.expected {
+			t.Errorf("case %d: expected %d, got %d", i, c.expected, resp.Code)
+		}
+	}
+}
+
+func TestAPI_tlsClientCA(t *testing.T) {
+	tlsConfig, err := statusTLSConfig(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientCAs != nil {
+		t.Error("expected client certificates not to be required without a CA")
+	}
+
+	if _, err := statusTLSConfig(&Config{StatusTLSClientCA: "/nonexistent/ca.pem"}); err == nil {
+		t.Error("expected an error for a missing CA file")
+	}
+}
+
+// Pause and resume a watch through the status API
+func TestAPI_pauseWatch(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config := &Config{}
+	status := newStatusServer(config, client)
+
+	body := strings.NewReader(`{"user": "alice", "reason": "maintenance"}`)
+	req, _ := http.NewRequest("POST", "/v1/watches/service:redis/pause", body)
+	resp := httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	paused, _, err := listPausedWatches(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.setPausedWatches(paused)
+	if !config.watchPaused("service:redis") || paused["service:redis"].User != "alice" {
+		t.Errorf("expected service:redis to be paused, got %v", paused)
+	}
+	if config.watchPaused("service:redis:primary") || config.watchPaused("node:redis") {
+		t.Error("expected only service:redis to be paused")
+	}
+
+	req, _ = http.NewRequest("POST", "/v1/watches/service:redis/resume", nil)
+	resp = httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	paused, _, err = listPausedWatches(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paused) != 0 {
+		t.Errorf("expected no paused watches, got %v", paused)
+	}
+
+	// Watch IDs must name a service or node
+	req, _ = http.NewRequest("POST", "/v1/watches/redis/pause", strings.NewReader(`{"user": "alice"}`))
+	resp = httptest.NewRecorder()
+	status.handler().ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The status used for the informational alerts raised by the catalog audit
+const AuditStatus = InfoStatus
+
+const auditKVPath = alertingKVRoot + "/audit/"
+
+// Periodically audits the catalog for registration anomalies that can leave blind spots in
+// alerting (duplicate service IDs, checks for unregistered services and services without checks),
+// raising an informational alert when new ones are found. Only one process performs the audit at
+// a time, using a lock in the KV store.
+func auditCatalog(config *Config, shutdownCh chan struct{}, client *api.Client) {
+	interval := time.Duration(config.CatalogAuditInterval) * time.Second
+
+	apiLock, err := client.LockKey(auditKVPath + "leader")
+	if err != nil {
+		fatalError(config, client, ExitLockFailure, fmt.Errorf("Error initializing lock for catalog audit: %s", err))
+	}
+
+	lock := LockHelper{
+		target:   "catalog audit",
+		client:   client,
+		lock:     apiLock,
+		stopCh:   make(chan struct{}, 1),
+		lockCh:   make(chan struct{}, 1),
+		callback: func() {},
+	}
+	go lock.start()
+
+	// The anomalies found in the last audit, so we only alert on new ones
+	reported := make(map[string]bool)
+
+	for {
+		select {
+		case <-shutdownCh:
+			log.Info("Shutting down catalog audit")
+			lock.stop()
+			<-shutdownCh
+			return
+		case <-time.After(interval):
+		}
+
+		if !lock.acquired {
+			continue
+		}
+
+		anomalies, err := auditCatalogOnce(client)
+		if err != nil {
+			log.Errorf("Error auditing catalog: %s", err)
+			continue
+		}
+
+		current := make(map[string]bool)
+		newAnomalies := make([]string, 0)
+		for _, anomaly := range anomalies {
+			current[anomaly] = true
+			if !reported[anomaly] {
+				newAnomalies = append(newAnomalies, anomaly)
+			}
+		}
+		reported = current
+
+		if len(newAnomalies) == 0 {
+			continue
+		}
+
+		log.Infof("Catalog audit found %d new registration anomalies", len(newAnomalies))
+		dispatchAlert(config, "", &AlertState{
+			Status:  AuditStatus,
+			Message: fmt.Sprintf("[%s] catalog audit found %d new registration anomalies", config.ConsulDatacenter, len(newAnomalies)),
+			Details: "Anomalies:\n=> " + strings.Join(newAnomalies, "\n=> "),
+		})
+	}
+}
+
+// Fetches the catalog and health checks and returns the anomalies found in them. The service
+// instances are fetched per service rather than per node, since clusters have far fewer
+// services than nodes.
+func auditCatalogOnce(client *api.Client) ([]string, error) {
+	queryOpts := &api.QueryOptions{AllowStale: true}
+
+	nodeList, _, err := client.Catalog().Nodes(queryOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*api.CatalogNode, len(nodeList))
+	for _, node := range nodeList {
+		nodes[node.Node] = &api.CatalogNode{Node: node, Services: make(map[string]*api.AgentService)}
+	}
+
+	services, _, err := client.Catalog().Services(queryOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	for service := range services {
+		instances, _, err := client.Catalog().Service(service, "", queryOpts)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			node, ok := nodes[instance.Node]
+			if !ok {
+				continue
+			}
+			node.Services[instance.ServiceID] = &api.AgentService{
+				ID:      instance.ServiceID,
+				Service: instance.ServiceName,
+				Tags:    instance.ServiceTags,
+			}
+		}
+	}
+
+	checks, _, err := client.Health().State(api.HealthAny, queryOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return findCatalogAnomalies(nodes, checks), nil
+}
+
+// Returns a sorted list of descriptions of the registration anomalies in the given catalog
+// nodes and health checks
+func findCatalogAnomalies(nodes map[string]*api.CatalogNode, checks []*api.HealthCheck) []string {
+	anomalies := make([]string, 0)
+
+	// Index the checks by node/service ID
+	checkCounts := make(map[string]int)
+	for _, check := range checks {
+		if check.ServiceID == "" {
+			continue
+		}
+		checkCounts[check.Node+"/"+check.ServiceID]++
+
+		node, ok := nodes[check.Node]
+		if !ok {
+			continue
+		}
+		if _, ok := node.Services[check.ServiceID]; !ok {
+			anomalies = append(anomalies, fmt.Sprintf("check '%s' on node %s references unregistered service ID '%s'",
+				check.CheckID, check.Node, check.ServiceID))
+		}
+	}
+
+	// Service IDs default to the service name, so those are expected to be repeated
+	// across nodes; explicitly set IDs should be unique
+	idNodes := make(map[string][]string)
+	for nodeName, node := range nodes {
+		for id, service := range node.Services {
+			if id != service.Service {
+				idNodes[id] = append(idNodes[id], nodeName)
+			}
+
+			if service.Service != "consul" && checkCounts[nodeName+"/"+id] == 0 {
+				anomalies = append(anomalies, fmt.Sprintf("service '%s' (ID '%s') on node %s has no checks",
+					service.Service, id, nodeName))
+			}
+		}
+	}
+
+	for id, nodeNames := range idNodes {
+		if len(nodeNames) > 1 {
+			sort.Strings(nodeNames)
+			anomalies = append(anomalies, fmt.Sprintf("service ID '%s' is registered on multiple nodes: %s",
+				id, strings.Join(nodeNames, ", ")))
+		}
+	}
+
+	sort.Strings(anomalies)
+	return anomalies
+}
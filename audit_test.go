@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAudit_findAnomalies(t *testing.T) {
+	nodes := map[string]*api.CatalogNode{
+		"node1": &api.CatalogNode{
+			Services: map[string]*api.AgentService{
+				"redis":   &api.AgentService{ID: "redis", Service: "redis"},
+				"web-1":   &api.AgentService{ID: "web-1", Service: "web"},
+				"nocheck": &api.AgentService{ID: "nocheck", Service: "nocheck"},
+			},
+		},
+		"node2": &api.CatalogNode{
+			Services: map[string]*api.AgentService{
+				"redis": &api.AgentService{ID: "redis", Service: "redis"},
+				"web-1": &api.AgentService{ID: "web-1", Service: "web"},
+			},
+		},
+	}
+
+	checks := []*api.HealthCheck{
+		&api.HealthCheck{Node: "node1", CheckID: "service:redis", ServiceID: "redis"},
+		&api.HealthCheck{Node: "node1", CheckID: "service:web-1", ServiceID: "web-1"},
+		&api.HealthCheck{Node: "node2", CheckID: "service:redis", ServiceID: "redis"},
+		&api.HealthCheck{Node: "node2", CheckID: "service:web-1", ServiceID: "web-1"},
+		&api.HealthCheck{Node: "node2", CheckID: "service:gone", ServiceID: "gone"},
+		&api.HealthCheck{Node: "node2", CheckID: "serfHealth"},
+	}
+
+	expected := []string{
+		"check 'service:gone' on node node2 references unregistered service ID 'gone'",
+		"service 'nocheck' (ID 'nocheck') on node node1 has no checks",
+		"service ID 'web-1' is registered on multiple nodes: node1, node2",
+	}
+
+	anomalies := findCatalogAnomalies(nodes, checks)
+	if !reflect.DeepEqual(anomalies, expected) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expected, anomalies)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long before they expire to refresh assumed role credentials
+const awsCredentialRefreshWindow = 5 * time.Minute
+
+// Credentials for signing requests to AWS
+type awsCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expiration   time.Time
+}
+
+// Credentials from assuming roles, shared between handlers and kept across reloads. Keyed by
+// the role ARN, external ID and the access key used to assume the role.
+var awsRoleCredentials = struct {
+	lock  sync.Mutex
+	cache map[string]awsCredentials
+}{cache: make(map[string]awsCredentials)}
+
+// The settings for authenticating to AWS, shared by the handlers for AWS services
+type awsAuthConfig struct {
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	RoleARN      string
+	ExternalID   string
+	STSEndpoint  string
+	Proxy        string
+}
+
+// Returns the credentials to sign requests with: the configured keys, or the standard
+// AWS_* environment variables if they aren't set. If a role is given, it's assumed using
+// those credentials.
+func (c awsAuthConfig) credentials(now time.Time) (awsCredentials, error) {
+	creds := awsCredentials{
+		AccessKey:    c.AccessKey,
+		SecretKey:    c.SecretKey,
+		SessionToken: c.SessionToken,
+	}
+	if creds.AccessKey == "" {
+		creds.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		creds.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		creds.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return creds, fmt.Errorf("No AWS credentials given and none set in the environment")
+	}
+
+	if c.RoleARN == "" {
+		return creds, nil
+	}
+
+	key := c.RoleARN + "/" + c.ExternalID + "/" + creds.AccessKey
+	awsRoleCredentials.lock.Lock()
+	defer awsRoleCredentials.lock.Unlock()
+
+	if cached, ok := awsRoleCredentials.cache[key]; ok && now.Add(awsCredentialRefreshWindow).Before(cached.Expiration) {
+		return cached, nil
+	}
+
+	assumed, err := c.assumeRole(creds, now)
+	if err != nil {
+		return assumed, err
+	}
+	awsRoleCredentials.cache[key] = assumed
+	return assumed, nil
+}
+
+type stsAssumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+// Gets temporary credentials for the configured role from STS
+func (c awsAuthConfig) assumeRole(creds awsCredentials, now time.Time) (awsCredentials, error) {
+	params := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {c.RoleARN},
+		"RoleSessionName": {"consul-alerting"},
+	}
+	if c.ExternalID != "" {
+		params.Set("ExternalId", c.ExternalID)
+	}
+
+	endpoint := c.STSEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", c.Region)
+	}
+
+	body, err := awsRequest(proxyHTTPClient(c.Proxy), endpoint, params, creds, c.Region, "sts", now)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("Error assuming role %s: %s", c.RoleARN, err)
+	}
+
+	var resp stsAssumeRoleResponse
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return awsCredentials{}, fmt.Errorf("Error parsing credentials for role %s: %s", c.RoleARN, err)
+	}
+
+	return awsCredentials{
+		AccessKey:    resp.Credentials.AccessKeyID,
+		SecretKey:    resp.Credentials.SecretAccessKey,
+		SessionToken: resp.Credentials.SessionToken,
+		Expiration:   resp.Credentials.Expiration,
+	}, nil
+}
+
+type awsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// Makes a signed request to an AWS query API, returning the response body
+func awsRequest(client *http.Client, endpoint string, params url.Values, creds awsCredentials, region string, service string, now time.Time) ([]byte, error) {
+	payload := []byte(strings.Replace(params.Encode(), "+", "%20", -1))
+
+	req, err := http.NewRequest("POST", endpoint+"/", strings.NewReader(string(payload)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, payload, creds, region, service, now)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errResp awsErrorResponse
+		if err := xml.Unmarshal(body, &errResp); err == nil && errResp.Code != "" {
+			return nil, fmt.Errorf("%s: %s", errResp.Code, errResp.Message)
+		}
+		return nil, fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
+// Signs a request with AWS Signature Version 4, setting its X-Amz-Date, X-Amz-Security-Token
+// and Authorization headers. The host, content type and X-Amz-* headers are signed.
+func signAWSRequest(req *http.Request, payload []byte, creds awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name, _ := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		query,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
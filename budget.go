@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Counts a notification towards its alert's incident, which lasts until the alert recovers,
+// and returns whether to send it. The notification that uses up the budget (max_notifications,
+// or unlimited if 0) says that no more will follow; after that, only the recovery is sent.
+// The count is kept on the stored alert state, so it carries over between instances.
+func spendNotification(alert *AlertState, notification *AlertState, budget int) (bool, *AlertState) {
+	if notification.Status == api.HealthPassing {
+		return true, notification
+	}
+
+	if budget > 0 && alert.Notifications >= budget {
+		log.Debugf("Not notifying for %s, which already sent %d notifications for this incident", alertName(alert), alert.Notifications)
+		return false, notification
+	}
+
+	alert.Notifications++
+	if budget > 0 && alert.Notifications == budget {
+		log.Infof("Sending the last notification allowed for %s until it recovers", alertName(alert))
+		capped := *notification
+		capped.Details = strings.TrimSpace(fmt.Sprintf("%s\nNotification limit reached: capped at %d notifications for this incident, no further notifications will be sent until it recovers", notification.Details, budget))
+		return true, &capped
+	}
+	return true, notification
+}
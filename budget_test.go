@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestBudget_spendNotification(t *testing.T) {
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Details: "check failed"}
+
+	for i := 1; i <= 3; i++ {
+		notify, notification := spendNotification(alert, alert, 3)
+		if !notify {
+			t.Fatalf("expected notification %d to be sent", i)
+		}
+		capped := strings.Contains(notification.Details, "no further notifications")
+		if capped != (i == 3) {
+			t.Errorf("notification %d: unexpected details %q", i, notification.Details)
+		}
+	}
+	if alert.Notifications != 3 || alert.Details != "check failed" {
+		t.Fatalf("unexpected alert state: %+v", alert)
+	}
+
+	if notify, _ := spendNotification(alert, alert, 3); notify {
+		t.Error("expected notifications past the budget to be dropped")
+	}
+
+	recovery := &AlertState{Service: "redis", Status: api.HealthPassing}
+	if notify, _ := spendNotification(alert, recovery, 3); !notify {
+		t.Error("expected the recovery to be sent")
+	}
+
+	unlimited := &AlertState{Service: "redis", Status: api.HealthCritical, Notifications: 100}
+	if notify, notification := spendNotification(unlimited, unlimited, 0); !notify || notification != unlimited {
+		t.Error("expected notifications to be unlimited without a budget")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Loads the named discovery cache file into v, returning true if it was found. The cache
+// holds the last-known services/nodes so watches can be started before the agent responds.
+func loadDiscoveryCache(config *Config, name string, v interface{}) bool {
+	if config.DiscoveryCacheDir == "" {
+		return false
+	}
+
+	raw, err := ioutil.ReadFile(discoveryCachePath(config, name))
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		log.Errorf("Error reading discovery cache: %s", err)
+		return false
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		log.Errorf("Error parsing discovery cache: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// Writes v to the named discovery cache file, replacing it atomically
+func saveDiscoveryCache(config *Config, name string, v interface{}) {
+	if config.DiscoveryCacheDir == "" {
+		return
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Error forming discovery cache: %s", err)
+		return
+	}
+
+	path := discoveryCachePath(config, name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		log.Errorf("Error writing discovery cache: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		log.Errorf("Error writing discovery cache: %s", err)
+	}
+}
+
+func discoveryCachePath(config *Config, name string) string {
+	return filepath.Join(config.DiscoveryCacheDir, name+".json")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCache_saveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{DiscoveryCacheDir: dir}
+
+	var services map[string][]string
+	if loadDiscoveryCache(config, "services", &services) {
+		t.Fatal("expected no cache before saving")
+	}
+
+	expected := map[string][]string{
+		"redis": []string{"alpha", "beta"},
+		"nginx": []string{},
+	}
+	saveDiscoveryCache(config, "services", expected)
+
+	if !loadDiscoveryCache(config, "services", &services) {
+		t.Fatal("expected cache to be loaded")
+	}
+	if !reflect.DeepEqual(services, expected) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expected, services)
+	}
+}
+
+func TestCache_disabled(t *testing.T) {
+	config := &Config{}
+
+	saveDiscoveryCache(config, "nodes", []string{"node1"})
+
+	var nodes []string
+	if loadDiscoveryCache(config, "nodes", &nodes) {
+		t.Fatal("expected cache to be disabled")
+	}
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -11,6 +15,49 @@ import (
 
 const alertingKVRoot = "service/consul-alerting"
 
+// The status of checks for nodes/services in Consul's maintenance mode. Maintenance is tracked
+// as its own state, but never contributes to an alert.
+const HealthMaintenance = "maintenance"
+
+// The check ID Consul registers for node maintenance mode, and the prefix of the IDs for
+// service maintenance mode
+const (
+	nodeMaintenanceCheckID   = "_node_maintenance"
+	serviceMaintenancePrefix = "_service_maintenance:"
+)
+
+// The number of check/alert state writes made to the KV store, used for measuring
+// write amplification
+var stateWrites uint64
+
+// The number of times a check was seen with each unrecognized status, reported by the
+// status API's metrics
+var unknownStatuses = &statusCounter{counts: make(map[string]uint64)}
+
+// Counts occurrences of check statuses
+type statusCounter struct {
+	lock   sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *statusCounter) add(status string) {
+	c.lock.Lock()
+	c.counts[status]++
+	c.lock.Unlock()
+}
+
+// Returns a copy of the counts
+func (c *statusCounter) snapshot() map[string]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counts := make(map[string]uint64, len(c.counts))
+	for status, count := range c.counts {
+		counts[status] = count
+	}
+	return counts
+}
+
 // CheckState is used for storing recent state for a given health check on a specific node,
 // in order to preserve alert state across restarts
 type CheckState struct {
@@ -28,6 +75,11 @@ func getCheckStates(kvPath string, client *api.Client) (map[string]*CheckState,
 	}
 
 	for _, path := range keys {
+		// The watch's saved index is kept alongside its check states
+		if path == kvPath+watchIndexKey {
+			continue
+		}
+
 		checkState, err := getCheckState(path, client)
 
 		if err != nil {
@@ -39,8 +91,7 @@ func getCheckStates(kvPath string, client *api.Client) (map[string]*CheckState,
 
 		keyName := strings.Split(path, "/")
 		if keyName[len(keyName)-1] != "alert" && keyName[len(keyName)-1] != "leader" {
-			checkName := keyName[len(keyName)-2] + "/" + keyName[len(keyName)-1]
-			checkStates[checkName] = checkState
+			checkStates[checkKeyFromKVPath(path)] = checkState
 		}
 	}
 
@@ -75,25 +126,45 @@ func getCheckState(kvPath string, client *api.Client) (*CheckState, error) {
 	return check, nil
 }
 
+// A health check along with the index it was last modified at, which the vendored API's
+// HealthCheck leaves out
+type indexedHealthCheck struct {
+	api.HealthCheck
+	ModifyIndex uint64
+}
+
+// Queries a health endpoint that returns a list of checks, such as /v1/health/node/<node>,
+// returning the checks along with the ModifyIndex of each one keyed by node/checkID
+func queryIndexedChecks(client *api.Client, endpoint string, q *api.QueryOptions) ([]*api.HealthCheck, map[string]uint64, *api.QueryMeta, error) {
+	var results []indexedHealthCheck
+	queryMeta, err := client.Raw().Query(endpoint, &results, q)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	checks := make([]*api.HealthCheck, len(results))
+	indexes := make(map[string]uint64, len(results))
+	for i := range results {
+		checks[i] = &results[i].HealthCheck
+		indexes[results[i].Node+"/"+results[i].CheckID] = results[i].ModifyIndex
+	}
+	return checks, indexes, queryMeta, nil
+}
+
 type CheckUpdate struct {
 	ServiceTag string
 	*api.HealthCheck
 }
 
-// Updates the last known state of a check in Consul. Returns true if succeeded.
-func updateCheckState(update CheckUpdate, client *api.Client) bool {
+// Updates the last known state of a check under the given KV root in Consul. Returns true
+// if succeeded.
+func updateCheckState(update CheckUpdate, root string, client *api.Client) bool {
 	check := update.HealthCheck
 
-	kvPath := alertingKVRoot
-
+	kvPath := nodeKVPath(root, check.Node) + escapeKVSegment(check.CheckID)
 	if check.ServiceID != "" {
-		tagPath := ""
-		if update.ServiceTag != "" {
-			tagPath = fmt.Sprintf("%s/", update.ServiceTag)
-		}
-		kvPath = kvPath + fmt.Sprintf("/service/%s/%s%s/%s", check.ServiceName, tagPath, check.Node, check.CheckID)
-	} else {
-		kvPath = kvPath + fmt.Sprintf("/node/%s/%s", check.Node, check.CheckID)
+		kvPath = serviceKVPath(root, check.ServiceName, update.ServiceTag) +
+			escapeKVSegment(check.Node) + "/" + escapeKVSegment(check.CheckID)
 	}
 
 	status, err := json.Marshal(CheckState{
@@ -113,11 +184,13 @@ func updateCheckState(update CheckUpdate, client *api.Client) bool {
 		log.Errorf("Error storing state for alert in Consul: %s", err)
 		return false
 	}
+	atomic.AddUint64(&stateWrites, 1)
 
 	return true
 }
 
-// Given a map of node/checkID:statuses, compute the health of the node/service
+// Given a map of node/checkID:statuses, compute the health of the node/service. Checks in
+// maintenance don't affect the health.
 func computeHealth(checks map[string]string) string {
 	health := api.HealthPassing
 
@@ -134,3 +207,133 @@ func computeHealth(checks map[string]string) string {
 
 	return health
 }
+
+// Returns true if the check was registered by Consul's node or service maintenance mode
+func isMaintenanceCheck(check *api.HealthCheck) bool {
+	return check.CheckID == nodeMaintenanceCheckID || strings.HasPrefix(check.CheckID, serviceMaintenancePrefix)
+}
+
+// Reclassifies maintenance mode checks as maintenance, and checks with a status Consul doesn't
+// define as the given status, counting each unknown status seen. Like muteCheckOutputs,
+// reclassified checks are copied rather than modified.
+func normalizeCheckStatuses(checks []*api.HealthCheck, unknownStatus string) []*api.HealthCheck {
+	var normalized []*api.HealthCheck
+	for i, check := range checks {
+		status := check.Status
+		switch {
+		case isMaintenanceCheck(check):
+			status = HealthMaintenance
+		case status == api.HealthPassing, status == api.HealthWarning, status == api.HealthCritical,
+			status == HealthMaintenance:
+		default:
+			unknownStatuses.add(status)
+			log.Debugf("Treating check '%s' on %s as %s, unknown status '%s'", check.Name, check.Node, unknownStatus, status)
+			status = unknownStatus
+		}
+
+		if status != check.Status {
+			if normalized == nil {
+				normalized = append(make([]*api.HealthCheck, 0, len(checks)), checks[:i]...)
+			}
+			reclassified := *check
+			reclassified.Status = status
+			check = &reclassified
+		}
+		if normalized != nil {
+			normalized = append(normalized, check)
+		}
+	}
+
+	if normalized == nil {
+		return checks
+	}
+	return normalized
+}
+
+// Returns the severity of a health status, for comparing statuses
+func healthRank(status string) int {
+	switch status {
+	case api.HealthCritical:
+		return 2
+	case api.HealthWarning:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Reclassifies failing checks whose output matches one of the patterns as the given status,
+// so that known-benign failures don't contribute to the alert state. Checks are only ever
+// downgraded, and matching checks are copied rather than modified.
+func muteCheckOutputs(checks []*api.HealthCheck, patterns []*regexp.Regexp, status string) []*api.HealthCheck {
+	if len(patterns) == 0 {
+		return checks
+	}
+
+	muted := make([]*api.HealthCheck, 0, len(checks))
+	for _, check := range checks {
+		if healthRank(check.Status) > healthRank(status) {
+			for _, pattern := range patterns {
+				if pattern.MatchString(check.Output) {
+					log.Debugf("Treating check '%s' on %s as %s, output matches ignored pattern '%s'",
+						check.Name, check.Node, status, pattern)
+					reclassified := *check
+					reclassified.Status = status
+					check = &reclassified
+					break
+				}
+			}
+		}
+		muted = append(muted, check)
+	}
+
+	return muted
+}
+
+// The last observed state of a check, used for detecting when it goes stale
+type checkHeartbeat struct {
+	status string
+	output string
+	seen   time.Time
+}
+
+// Marks checks as critical if their status and output haven't changed within maxStaleness.
+// This is for services registered directly in the catalog whose checks are kept up to date
+// by an external heartbeat rather than an agent, where a dead heartbeat would otherwise leave
+// the last status in place forever. The heartbeats map is updated with the latest observations,
+// and checks that are no longer present are dropped from it.
+func markStaleChecks(checks []*api.HealthCheck, heartbeats map[string]*checkHeartbeat, maxStaleness time.Duration, now time.Time) []*api.HealthCheck {
+	if maxStaleness <= 0 {
+		return checks
+	}
+
+	marked := make([]*api.HealthCheck, 0, len(checks))
+	current := make(map[string]bool, len(checks))
+	for _, check := range checks {
+		key := check.Node + "/" + check.CheckID
+		current[key] = true
+		heartbeat, ok := heartbeats[key]
+		if !ok || heartbeat.status != check.Status || heartbeat.output != check.Output {
+			heartbeats[key] = &checkHeartbeat{
+				status: check.Status,
+				output: check.Output,
+				seen:   now,
+			}
+		} else if age := now.Sub(heartbeat.seen); age > maxStaleness {
+			stale := *check
+			stale.Status = api.HealthCritical
+			stale.Output = fmt.Sprintf("Check has not been updated in %s (max staleness: %s)",
+				age-age%time.Second, maxStaleness)
+			check = &stale
+		}
+		marked = append(marked, check)
+	}
+
+	for key := range heartbeats {
+		if !current[key] {
+			delete(heartbeats, key)
+		}
+	}
+
+	return marked
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 )
 
 func testSetCheckState(update CheckUpdate, client *api.Client, t *testing.T) {
-	success := updateCheckState(update, client)
+	success := updateCheckState(update, alertingKVRoot, client)
 
 	if !success {
 		t.Fatal("Failed to write check state to Consul")
@@ -117,3 +118,126 @@ func TestCheck_getSetChecks(t *testing.T) {
 		}
 	}
 }
+
+func TestCheck_muteCheckOutputs(t *testing.T) {
+	patterns, err := compilePatterns([]string{"connection reset by peer during deploy", "^timeout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []*api.HealthCheck{
+		&api.HealthCheck{CheckID: "a", Status: api.HealthCritical, Output: "read: connection reset by peer during deploy"},
+		&api.HealthCheck{CheckID: "b", Status: api.HealthCritical, Output: "disk full"},
+		&api.HealthCheck{CheckID: "c", Status: api.HealthWarning, Output: "timeout after 5s"},
+		&api.HealthCheck{CheckID: "d", Status: api.HealthPassing, Output: "timeout after 5s"},
+	}
+
+	muted := muteCheckOutputs(checks, patterns, api.HealthPassing)
+	expected := []string{api.HealthPassing, api.HealthCritical, api.HealthPassing, api.HealthPassing}
+	for i, check := range muted {
+		if check.Status != expected[i] {
+			t.Errorf("expected check %s to be %s, got %s", check.CheckID, expected[i], check.Status)
+		}
+	}
+
+	// The original checks shouldn't be modified
+	if checks[0].Status != api.HealthCritical {
+		t.Errorf("expected original check to be left alone, got %s", checks[0].Status)
+	}
+
+	// Reclassifying as warning should only downgrade critical checks
+	muted = muteCheckOutputs(checks, patterns, api.HealthWarning)
+	expected = []string{api.HealthWarning, api.HealthCritical, api.HealthWarning, api.HealthPassing}
+	for i, check := range muted {
+		if check.Status != expected[i] {
+			t.Errorf("expected check %s to be %s, got %s", check.CheckID, expected[i], check.Status)
+		}
+	}
+}
+
+func TestCheck_normalizeCheckStatuses(t *testing.T) {
+	checks := []*api.HealthCheck{
+		&api.HealthCheck{CheckID: "a", Status: api.HealthPassing},
+		&api.HealthCheck{CheckID: "b", Status: "unknown"},
+		&api.HealthCheck{CheckID: nodeMaintenanceCheckID, Status: api.HealthCritical},
+		&api.HealthCheck{CheckID: serviceMaintenancePrefix + "redis", Status: api.HealthCritical},
+		&api.HealthCheck{CheckID: "e", Status: HealthMaintenance},
+	}
+
+	before := unknownStatuses.snapshot()["unknown"]
+	normalized := normalizeCheckStatuses(checks, api.HealthCritical)
+	expected := []string{api.HealthPassing, api.HealthCritical, HealthMaintenance, HealthMaintenance, HealthMaintenance}
+	for i, check := range normalized {
+		if check.Status != expected[i] {
+			t.Errorf("expected check %s to be %s, got %s", check.CheckID, expected[i], check.Status)
+		}
+	}
+	if count := unknownStatuses.snapshot()["unknown"] - before; count != 1 {
+		t.Errorf("expected 1 unknown status to be counted, got %d", count)
+	}
+
+	// The original checks shouldn't be modified
+	if checks[1].Status != "unknown" {
+		t.Errorf("expected original check to be left alone, got %s", checks[1].Status)
+	}
+
+	// Maintenance doesn't affect the health
+	statuses := make(map[string]string)
+	for _, check := range normalized {
+		statuses[check.CheckID] = check.Status
+	}
+	delete(statuses, "b")
+	if health := computeHealth(statuses); health != api.HealthPassing {
+		t.Errorf("expected maintenance to be ignored, got %s", health)
+	}
+
+	// Known statuses are returned as-is
+	if normalized := normalizeCheckStatuses(checks[:1], api.HealthCritical); &normalized[0] != &checks[0] {
+		t.Error("expected checks with known statuses not to be copied")
+	}
+}
+
+func TestCheck_markStaleChecks(t *testing.T) {
+	heartbeats := make(map[string]*checkHeartbeat)
+	start := time.Now()
+	checks := []*api.HealthCheck{
+		&api.HealthCheck{Node: "ext", CheckID: "a", Status: api.HealthPassing, Output: "ok at 1"},
+		&api.HealthCheck{Node: "ext", CheckID: "b", Status: api.HealthPassing, Output: "ok"},
+	}
+
+	// Staleness tracking is disabled without a max staleness
+	if marked := markStaleChecks(checks, heartbeats, 0, start); len(heartbeats) != 0 || marked[0] != checks[0] {
+		t.Fatal("expected checks to be left alone with staleness disabled")
+	}
+
+	// The first observation starts the clock
+	marked := markStaleChecks(checks, heartbeats, time.Minute, start)
+	for _, check := range marked {
+		if check.Status != api.HealthPassing {
+			t.Errorf("expected check %s to be passing, got %s", check.CheckID, check.Status)
+		}
+	}
+
+	// Check a gets a fresh heartbeat, b doesn't change
+	later := start.Add(2 * time.Minute)
+	updated := []*api.HealthCheck{
+		&api.HealthCheck{Node: "ext", CheckID: "a", Status: api.HealthPassing, Output: "ok at 2"},
+		checks[1],
+	}
+	marked = markStaleChecks(updated, heartbeats, time.Minute, later)
+	if marked[0].Status != api.HealthPassing {
+		t.Errorf("expected updated check to be passing, got %s", marked[0].Status)
+	}
+	if marked[1].Status != api.HealthCritical {
+		t.Errorf("expected stale check to be critical, got %s", marked[1].Status)
+	}
+	if checks[1].Status != api.HealthPassing {
+		t.Errorf("expected original check to be left alone, got %s", checks[1].Status)
+	}
+
+	// Heartbeats for checks that have been removed are dropped
+	markStaleChecks(updated[:1], heartbeats, time.Minute, later)
+	if _, ok := heartbeats["ext/b"]; ok || len(heartbeats) != 1 {
+		t.Errorf("expected only the remaining check's heartbeat to be kept, got %d", len(heartbeats))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"runtime"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Counters for the check states the watches hold in memory, reported by the status API's
+// metrics
+var checkStateMemory struct {
+	// The number of check states cached across all watches, and the number of watches
+	entries int64
+	watches int64
+
+	// The number of check states evicted from the caches, and reloaded from the KV store
+	evictions int64
+	reloads   int64
+
+	// The number of checks held by the shared node health feed, in global node mode
+	feedChecks int64
+}
+
+// The check state counters, as reported by the status API
+type checkStateMetrics struct {
+	Entries    int64 `json:"entries"`
+	Watches    int64 `json:"watches"`
+	Evictions  int64 `json:"evictions"`
+	Reloads    int64 `json:"reloads"`
+	FeedChecks int64 `json:"feed_checks"`
+}
+
+func currentCheckStateMetrics() checkStateMetrics {
+	return checkStateMetrics{
+		Entries:    atomic.LoadInt64(&checkStateMemory.entries),
+		Watches:    atomic.LoadInt64(&checkStateMemory.watches),
+		Evictions:  atomic.LoadInt64(&checkStateMemory.evictions),
+		Reloads:    atomic.LoadInt64(&checkStateMemory.reloads),
+		FeedChecks: atomic.LoadInt64(&checkStateMemory.feedChecks),
+	}
+}
+
+// Returns the bytes of heap memory the process has allocated and not yet freed
+func heapBytes() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// checkStateCache holds a watch's last known status for each of its checks, keyed by
+// node/checkID. Passing checks don't affect a watch's health, so when check_state_cache_size or
+// check_state_cache_total is set, the ones that changed least recently are evicted to keep the
+// cache within its limit. Only their keys are kept: an evicted check that's still passing is
+// unchanged, and its stored state is only reloaded from the KV store once it starts failing.
+// Failing checks are never evicted.
+type checkStateCache struct {
+	// The cached statuses, which the diffing and health computations read directly
+	statuses map[string]string
+
+	// The keys of the cached passing checks, least recently updated first
+	passing  *list.List
+	elements map[string]*list.Element
+
+	// The keys of the checks evicted from the cache, which were all passing
+	evicted map[string]bool
+}
+
+func newCheckStateCache() *checkStateCache {
+	atomic.AddInt64(&checkStateMemory.watches, 1)
+	return &checkStateCache{
+		statuses: make(map[string]string),
+		passing:  list.New(),
+		elements: make(map[string]*list.Element),
+		evicted:  make(map[string]bool),
+	}
+}
+
+// Sets the status of a check, marking it as the most recently updated
+func (c *checkStateCache) set(key string, status string) {
+	if _, ok := c.statuses[key]; !ok {
+		atomic.AddInt64(&checkStateMemory.entries, 1)
+	}
+	c.statuses[key] = status
+	delete(c.evicted, key)
+
+	evictable := status == api.HealthPassing
+	if elem, ok := c.elements[key]; ok {
+		if evictable {
+			c.passing.MoveToBack(elem)
+			return
+		}
+		c.passing.Remove(elem)
+		delete(c.elements, key)
+	} else if evictable {
+		c.elements[key] = c.passing.PushBack(key)
+	}
+}
+
+// Evicts the least recently updated passing checks until the cache holds at most limit
+// checks, or only failing ones. A limit of 0 means there's no limit.
+func (c *checkStateCache) trim(limit int) {
+	if limit <= 0 {
+		return
+	}
+
+	for len(c.statuses) > limit && c.passing.Len() > 0 {
+		key := c.passing.Remove(c.passing.Front()).(string)
+		delete(c.elements, key)
+		delete(c.statuses, key)
+		c.evicted[key] = true
+		atomic.AddInt64(&checkStateMemory.entries, -1)
+		atomic.AddInt64(&checkStateMemory.evictions, 1)
+	}
+}
+
+// Returns the checks to diff against the cache, leaving out evicted checks that are still
+// passing, which haven't changed. Evicted checks that are now failing have their stored
+// states reloaded from under the watch's KV path first, so they're diffed against their last
+// known status instead of looking new (which the ignore_new strategy would drop). For a node
+// watch, node is set and only the node's own checks are considered. Checks are left out of
+// the cache if their states can't be loaded, so at worst their states are written again.
+func (c *checkStateCache) reload(checks []*api.HealthCheck, node string, keyPath string, client *api.Client) []*api.HealthCheck {
+	if len(c.evicted) == 0 {
+		return checks
+	}
+
+	diffed := make([]*api.HealthCheck, 0, len(checks))
+	seen := make(map[string]bool)
+	for _, check := range checks {
+		key := check.Node + "/" + check.CheckID
+		kvPath := keyPath + escapeKVSegment(check.Node) + "/" + escapeKVSegment(check.CheckID)
+		if node != "" {
+			if check.ServiceID != "" {
+				diffed = append(diffed, check)
+				continue
+			}
+			key = node + "/" + check.CheckID
+			kvPath = keyPath + escapeKVSegment(check.CheckID)
+		}
+
+		if !c.evicted[key] {
+			diffed = append(diffed, check)
+			continue
+		}
+		seen[key] = true
+		if check.Status == api.HealthPassing {
+			continue
+		}
+
+		diffed = append(diffed, check)
+		pair, _, err := client.KV().Get(kvPath, nil)
+		if err != nil {
+			log.Errorf("Error reloading check state from %s: %s", kvPath, err)
+			continue
+		}
+		if pair == nil {
+			continue
+		}
+		var state CheckState
+		if err := json.Unmarshal(pair.Value, &state); err != nil {
+			continue
+		}
+		atomic.AddInt64(&checkStateMemory.reloads, 1)
+		c.set(key, state.Status)
+	}
+
+	// Forget evicted checks that no longer exist
+	for key := range c.evicted {
+		if !seen[key] {
+			delete(c.evicted, key)
+		}
+	}
+	return diffed
+}
+
+// Removes the cache's checks from the counters when its watch stops
+func (c *checkStateCache) release() {
+	atomic.AddInt64(&checkStateMemory.entries, -int64(len(c.statuses)))
+	atomic.AddInt64(&checkStateMemory.watches, -1)
+}
+
+// Returns how many check states each watch can keep in memory, or 0 if there's no limit.
+// While the watches hold more than check_state_cache_total between them, each is limited to
+// an even share of it, so the ones holding more than their share give some up.
+func (c *Config) checkStateCacheLimit() int {
+	c.lock.RLock()
+	limit, total := c.CheckStateCacheSize, c.CheckStateCacheTotal
+	c.lock.RUnlock()
+
+	watches := atomic.LoadInt64(&checkStateMemory.watches)
+	if total > 0 && watches > 0 && atomic.LoadInt64(&checkStateMemory.entries) > int64(total) {
+		share := int(int64(total) / watches)
+		if share < 1 {
+			share = 1
+		}
+		if limit == 0 || share < limit {
+			limit = share
+		}
+	}
+	return limit
+}
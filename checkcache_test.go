@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestCheckStateCache_trim(t *testing.T) {
+	cache := newCheckStateCache()
+	defer cache.release()
+
+	cache.set("node1/a", api.HealthPassing)
+	cache.set("node1/b", api.HealthCritical)
+	cache.set("node1/c", api.HealthPassing)
+	cache.set("node1/d", api.HealthPassing)
+	// Updating a check makes it the most recently used
+	cache.set("node1/a", api.HealthPassing)
+
+	cache.trim(3)
+	if _, ok := cache.statuses["node1/c"]; ok || len(cache.statuses) != 3 || !cache.evicted["node1/c"] {
+		t.Fatalf("expected the least recently updated check to be evicted, got %v", cache.statuses)
+	}
+
+	// Failing checks are kept even when over the limit, as they decide the watch's health
+	cache.set("node1/a", api.HealthWarning)
+	cache.trim(1)
+	expected := map[string]string{"node1/a": api.HealthWarning, "node1/b": api.HealthCritical}
+	if len(cache.statuses) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, cache.statuses)
+	}
+	for key, status := range expected {
+		if cache.statuses[key] != status {
+			t.Errorf("expected %s to be %s, got %v", key, status, cache.statuses)
+		}
+	}
+	if computeHealth(cache.statuses) != api.HealthCritical {
+		t.Errorf("expected the health to be unaffected by evictions")
+	}
+
+	// A recovered check can be evicted again
+	cache.set("node1/b", api.HealthPassing)
+	cache.trim(1)
+	if len(cache.statuses) != 1 || cache.statuses["node1/a"] != api.HealthWarning {
+		t.Errorf("expected only the warning check to be left, got %v", cache.statuses)
+	}
+}
+
+func TestCheckStateCache_limit(t *testing.T) {
+	config, err := ParseConfig(`
+	check_state_cache_size = 100
+	check_state_cache_total = 4
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := newCheckStateCache(), newCheckStateCache()
+	defer a.release()
+	defer b.release()
+	watches := int(atomic.LoadInt64(&checkStateMemory.watches))
+
+	// Under the total, only the per-watch size applies
+	a.set("node1/a", api.HealthPassing)
+	if limit := config.checkStateCacheLimit(); limit != 100 {
+		t.Errorf("expected a limit of 100, got %d", limit)
+	}
+
+	// Over it, each watch gets an even share
+	for _, key := range []string{"node1/b", "node1/c", "node1/d", "node1/e"} {
+		a.set(key, api.HealthPassing)
+	}
+	share := 4 / watches
+	if share < 1 {
+		share = 1
+	}
+	if limit := config.checkStateCacheLimit(); limit != share {
+		t.Errorf("expected a limit of %d, got %d", share, limit)
+	}
+
+	for _, raw := range []string{"check_state_cache_size = -1", "check_state_cache_total = -1"} {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+// Make sure checks evicted from the cache are diffed against their stored states, so the
+// ignore_new strategy doesn't drop their changes as if they were new
+func TestCheckStateCache_reload(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	keyPath := serviceKVPath(alertingKVRoot, "redis", "")
+	for _, check := range []string{"a", "b"} {
+		value, _ := json.Marshal(CheckState{Status: api.HealthPassing})
+		if _, err := client.KV().Put(&api.KVPair{Key: keyPath + "node1/" + check, Value: value}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := newCheckStateCache()
+	defer cache.release()
+	cache.set("node1/a", api.HealthPassing)
+	cache.set("node1/b", api.HealthPassing)
+	cache.trim(1)
+
+	checks := []*api.HealthCheck{
+		{Node: "node1", CheckID: "a", Status: api.HealthCritical},
+		{Node: "node1", CheckID: "b", Status: api.HealthCritical},
+		{Node: "node1", CheckID: "c", Status: api.HealthCritical},
+	}
+	diffed := cache.reload(checks, "", keyPath, client)
+
+	differ, err := newCheckDiffer(ServiceWatch, DiffIgnoreNew, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := differ.diff(diffed, cache.statuses, &WatchOptions{service: "redis"})
+	if len(updates) != 2 || updates["node1/c"].HealthCheck != nil {
+		t.Errorf("expected updates for the known checks and not the new one, got %v", updates)
+	}
+}
+
+// Make sure evicted checks that are still passing are treated as unchanged without going to
+// the KV store, so a cache smaller than the watch's checks doesn't reload them on every pass
+func TestCheckStateCache_steadyState(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := newCheckStateCache()
+	defer cache.release()
+
+	var checks []*api.HealthCheck
+	for _, id := range []string{"a", "b", "c", "d"} {
+		checks = append(checks, &api.HealthCheck{Node: "node1", CheckID: id, Status: api.HealthPassing})
+		cache.set("node1/"+id, api.HealthPassing)
+	}
+
+	for i := 0; i < 3; i++ {
+		cache.trim(1)
+		diffed := cache.reload(checks, "", "service/redis/", client)
+		if len(diffed) != 1 || diffed[0].CheckID != "d" {
+			t.Fatalf("expected only the cached check to be diffed, got %v", diffed)
+		}
+		if len(cache.statuses) != 1 || len(cache.evicted) != 3 {
+			t.Fatalf("expected 1 cached and 3 evicted checks, got %v and %v", cache.statuses, cache.evicted)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("expected no KV requests in steady state, got %d", n)
+	}
+
+	// Evicted checks that are gone are forgotten
+	cache.reload(checks[2:], "", "service/redis/", client)
+	if len(cache.evicted) != 1 || !cache.evicted["node1/c"] {
+		t.Errorf("expected only node1/c to stay evicted, got %v", cache.evicted)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// The prefix of the route set on alerts from composites, which have no node or service
+const compositeRoutePrefix = "composite:"
+
+// CompositeConfig groups several services into one business-level entity, such as checkout,
+// whose health is aggregated from the alert states of its member services
+type CompositeConfig struct {
+	Name              string
+	Services          []string `mapstructure:"services"`
+	WarningThreshold  int      `mapstructure:"warning_threshold"`
+	CriticalThreshold int      `mapstructure:"critical_threshold"`
+	Interval          int      `mapstructure:"interval"`
+	ChangeThreshold   int      `mapstructure:"change_threshold"`
+	Handlers          []string `mapstructure:"handlers"`
+	Team              string   `mapstructure:"team"`
+}
+
+// Parse the raw composite objects into the config
+func parseComposites(list *ast.ObjectList, config *Config) error {
+	for _, c := range list.Items {
+		name := c.Keys[0].Token.Value().(string)
+
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, c.Val); err != nil {
+			return err
+		}
+
+		composite := CompositeConfig{
+			WarningThreshold:  1,
+			CriticalThreshold: 1,
+			Interval:          10,
+		}
+		if err := mapstructure.WeakDecode(m, &composite); err != nil {
+			return err
+		}
+		composite.Name = name
+
+		if len(composite.Services) == 0 {
+			return fmt.Errorf("No services given for composite %s", name)
+		}
+		for i, service := range composite.Services {
+			if service == "" {
+				return fmt.Errorf("Invalid services for composite %s: empty service name", name)
+			}
+			if contains(composite.Services[:i], service) {
+				return fmt.Errorf("Invalid services for composite %s: %s is listed more than once", name, service)
+			}
+		}
+		if composite.WarningThreshold < 1 || composite.WarningThreshold > len(composite.Services) {
+			return fmt.Errorf("Invalid warning_threshold for composite %s: %d (must be between 1 and %d)", name, composite.WarningThreshold, len(composite.Services))
+		}
+		if composite.CriticalThreshold < 1 || composite.CriticalThreshold > len(composite.Services) {
+			return fmt.Errorf("Invalid critical_threshold for composite %s: %d (must be between 1 and %d)", name, composite.CriticalThreshold, len(composite.Services))
+		}
+		if composite.Interval <= 0 {
+			return fmt.Errorf("Invalid interval for composite %s: %d", name, composite.Interval)
+		}
+		if composite.ChangeThreshold < 0 {
+			return fmt.Errorf("Invalid change_threshold for composite %s: %d", name, composite.ChangeThreshold)
+		}
+
+		for _, id := range composite.Handlers {
+			_, isGroup := config.HandlerGroups[id]
+			if _, ok := config.Handlers[id]; !ok && !isGroup {
+				return fmt.Errorf("Unknown handler for composite %s: %s", name, id)
+			}
+		}
+		if _, ok := config.Teams[composite.Team]; composite.Team != "" && !ok {
+			return fmt.Errorf("Unknown team for composite %s: %s", name, composite.Team)
+		}
+		composite.Handlers = config.expandHandlerGroups(composite.Handlers)
+
+		config.Composites[name] = composite
+	}
+
+	return nil
+}
+
+// Aggregates the statuses of the member services, returning the composite's status and a
+// line for each member that isn't passing. Members without a status are passing.
+func (c *CompositeConfig) evaluate(statuses map[string]string) (string, []string) {
+	critical, unhealthy := 0, 0
+	failures := make([]string, 0)
+	for _, service := range c.Services {
+		status, ok := statuses[service]
+		if !ok || status == api.HealthPassing {
+			continue
+		}
+		unhealthy++
+		if status == api.HealthCritical {
+			critical++
+		}
+		failures = append(failures, fmt.Sprintf("=> service %s is %s", service, status))
+	}
+
+	switch {
+	case critical >= c.CriticalThreshold:
+		return api.HealthCritical, failures
+	case unhealthy >= c.WarningThreshold:
+		return api.HealthWarning, failures
+	}
+	return api.HealthPassing, failures
+}
+
+// Returns the worst status of a member service's alerts. Services with distinct_tags have an
+// alert for each tag instead of one for the whole service, so those are all looked at, and
+// services with a tag_set are looked at through their tag set's alert.
+func compositeMemberStatus(service string, config *Config, client *api.Client) (string, error) {
+	serviceConfig := config.serviceConfig(service)
+	keyPath := serviceKVPath(config.stateKVRoot(), service, "")
+	paths := []string{keyPath + "alert"}
+
+	if serviceConfig != nil && len(serviceConfig.TagSet) > 0 {
+		paths = []string{serviceKVPath(config.stateKVRoot(), service, serviceConfig.tagSetName()) + "alert"}
+	} else if serviceConfig != nil && serviceConfig.DistinctTags {
+		keys, _, err := client.KV().Keys(keyPath, "", &api.QueryOptions{AllowStale: true})
+		if err != nil {
+			return "", fmt.Errorf("Error listing alerts for service %s: %s", service, err)
+		}
+		paths = make([]string, 0)
+		for _, key := range keys {
+			if strings.HasSuffix(key, "/alert") {
+				paths = append(paths, key)
+			}
+		}
+	}
+
+	status := api.HealthPassing
+	for _, path := range paths {
+		alert, err := getAlertState(path, client)
+		if err != nil {
+			return "", err
+		}
+		if alert == nil || alert.Service != service {
+			continue
+		}
+		if alert.Status == api.HealthCritical || (alert.Status == api.HealthWarning && status == api.HealthPassing) {
+			status = alert.Status
+		}
+	}
+	return status, nil
+}
+
+// Returns the handlers for a composite's alerts: its handlers and team's handlers, or the
+// default handlers if it has neither
+func (c *Config) compositeHandlerIDs(name string, tier string) []string {
+	c.lock.RLock()
+	composite, ok := c.Composites[name]
+	var ids []string
+	if ok {
+		ids = append(ids, composite.Handlers...)
+		if team, ok := c.Teams[composite.Team]; ok {
+			ids = append(ids, team.handlerIDs...)
+		}
+	}
+	c.lock.RUnlock()
+
+	if len(ids) == 0 {
+		return c.serviceTierHandlerIDs("", tier)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Returns the name of the composite an alert is for, if it's from one
+func compositeName(alert *AlertState) (string, bool) {
+	if alert.Node != "" || alert.Service != "" || !strings.HasPrefix(alert.Route, compositeRoutePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(alert.Route, compositeRoutePrefix), true
+}
+
+// Checks a composite's member services every interval, alerting when its aggregated status
+// changes and stays changed for the change threshold. Like the other watches, only the
+// process holding the composite's lock checks it, and its alert state is kept in the KV store.
+func runComposite(composite CompositeConfig, config *Config, shutdownCh chan struct{}, client *api.Client) {
+	keyPath := config.stateKVRoot() + "/composite/" + escapeKVSegment(composite.Name) + "/"
+	alertPath := keyPath + "alert"
+	name := "composite " + composite.Name
+
+	opts := &WatchOptions{
+		config:    config,
+		client:    client,
+		alertLock: &sync.Mutex{},
+		alertSeqs: make(map[string]uint64),
+	}
+
+	// The status last seen, loaded from the alert state on gaining the lock
+	lastStatus := api.HealthPassing
+	loadStatus := func() {
+		alert, err := getAlertState(alertPath, client)
+		if err != nil {
+			log.Errorf("Error loading alert state for %s: %s", name, err)
+			return
+		}
+		if alert != nil {
+			lastStatus = alert.Status
+		}
+	}
+
+	hookTarget := watchHookTarget(name, opts)
+	hookTarget.Composite = composite.Name
+	fireWatchHooks(config, WatchCreated, hookTarget)
+
+	var lock LockHelper
+	if config.ShadowMode {
+		loadStatus()
+		lock.acquired = true
+	} else {
+		apiLock, err := client.LockKey(keyPath + "leader")
+		if err != nil {
+			fatalError(config, client, ExitLockFailure, fmt.Errorf("Error initializing lock for %s: %s", name, err))
+		}
+		lock = LockHelper{
+			target: name,
+			client: client,
+			lock:   apiLock,
+			stopCh: make(chan struct{}, 1),
+			lockCh: make(chan struct{}, 1),
+			callback: func() {
+				loadStatus()
+				if config.DeliveryIntents {
+					go replayIntents(keyPath, opts)
+				}
+				fireWatchHooks(config, WatchLockAcquired, hookTarget)
+			},
+			lostCallback: func() {
+				fireWatchHooks(config, WatchLockLost, hookTarget)
+			},
+		}
+		go lock.start()
+	}
+
+	// Check right away, then every interval
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-shutdownCh:
+			log.Infof("Shutting down %s", name)
+			if !config.ShadowMode {
+				lock.stop()
+			}
+			fireWatchHooks(config, WatchRemoved, hookTarget)
+			<-shutdownCh
+			return
+		case <-time.After(wait):
+		}
+		wait = time.Duration(composite.Interval) * time.Second
+
+		if !lock.acquired {
+			continue
+		}
+
+		statuses := make(map[string]string)
+		var err error
+		for _, service := range composite.Services {
+			if statuses[service], err = compositeMemberStatus(service, config, client); err != nil {
+				break
+			}
+		}
+		// Skip this round rather than alert on a partial view of the members
+		if err != nil {
+			log.Errorf("Error checking members of %s: %s", name, err)
+			continue
+		}
+
+		status, failures := composite.evaluate(statuses)
+		if status == lastStatus {
+			continue
+		}
+		log.Debugf("Got status %s for %s", status, name)
+		lastStatus = status
+
+		opts.alertSeq++
+		go tryAlertAfter(alertPath, AlertState{
+			seq:     opts.alertSeq,
+			Route:   compositeRoutePrefix + composite.Name,
+			Status:  status,
+			Message: fmt.Sprintf("[%s] %s is now %s", config.ConsulDatacenter, name, status),
+			Details: strings.Join(failures, "\n"),
+		}, opts, time.Duration(composite.ChangeThreshold)*time.Second)
+	}
+}
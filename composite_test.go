@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestComposite_evaluate(t *testing.T) {
+	composite := CompositeConfig{
+		Services:          []string{"cart", "payments", "inventory"},
+		WarningThreshold:  1,
+		CriticalThreshold: 2,
+	}
+
+	cases := []struct {
+		statuses map[string]string
+		expected string
+		failures int
+	}{
+		{map[string]string{}, api.HealthPassing, 0},
+		{map[string]string{"cart": api.HealthPassing, "payments": api.HealthPassing}, api.HealthPassing, 0},
+		{map[string]string{"cart": api.HealthWarning}, api.HealthWarning, 1},
+		{map[string]string{"cart": api.HealthCritical}, api.HealthWarning, 1},
+		{map[string]string{"cart": api.HealthCritical, "payments": api.HealthCritical}, api.HealthCritical, 2},
+		{map[string]string{"cart": api.HealthCritical, "payments": api.HealthWarning}, api.HealthWarning, 2},
+	}
+	for _, tc := range cases {
+		status, failures := composite.evaluate(tc.statuses)
+		if status != tc.expected || len(failures) != tc.failures {
+			t.Errorf("%v: expected %s with %d failures, got %s with %v", tc.statuses, tc.expected, tc.failures, status, failures)
+		}
+	}
+}
+
+func TestComposite_config(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "slack" "ops" {
+		api_token = "token"
+		channel_name = "ops"
+	}
+	composite "checkout" {
+		services = ["cart", "payments", "inventory"]
+		critical_threshold = 2
+		handlers = ["slack.ops"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := CompositeConfig{
+		Name:              "checkout",
+		Services:          []string{"cart", "payments", "inventory"},
+		WarningThreshold:  1,
+		CriticalThreshold: 2,
+		Interval:          10,
+		Handlers:          []string{"slack.ops"},
+	}
+	if composite := config.Composites["checkout"]; !reflect.DeepEqual(composite, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, composite)
+	}
+
+	alert := &AlertState{Route: compositeRoutePrefix + "checkout", Status: api.HealthCritical}
+	if name := alertName(alert); name != "composite checkout" {
+		t.Errorf("unexpected alert name: %s", name)
+	}
+	if ids := config.alertHandlerIDs("", alert); !reflect.DeepEqual(ids, []string{"slack.ops"}) {
+		t.Errorf("expected the composite's handlers, got %v", ids)
+	}
+
+	cases := []string{
+		`composite "a" {}`,
+		`composite "a" { services = ["cart", "cart"] }`,
+		`composite "a" { services = ["cart"], critical_threshold = 2 }`,
+		`composite "a" { services = ["cart"], warning_threshold = 0 }`,
+		`composite "a" { services = ["cart"], interval = 0 }`,
+		`composite "a" { services = ["cart"], handlers = ["missing"] }`,
+		`composite "a" { services = ["cart"], team = "missing" }`,
+	}
+	for _, raw := range cases {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+func TestComposite_memberStatus(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config, err := ParseConfig(`
+	service "payments" {
+		distinct_tags = true
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := map[string]*AlertState{
+		serviceKVPath(config.stateKVRoot(), "cart", "") + "alert":            {Service: "cart", Status: api.HealthWarning},
+		serviceKVPath(config.stateKVRoot(), "payments", "primary") + "alert": {Service: "payments", Tag: "primary", Status: api.HealthCritical},
+		serviceKVPath(config.stateKVRoot(), "payments", "replica") + "alert": {Service: "payments", Tag: "replica", Status: api.HealthWarning},
+	}
+	for path, alert := range states {
+		if err := setAlertState(path, alert, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		"cart":      api.HealthWarning,
+		"payments":  api.HealthCritical,
+		"inventory": api.HealthPassing,
+	}
+	for service, status := range expected {
+		actual, err := compositeMemberStatus(service, config, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != status {
+			t.Errorf("expected %s to be %s, got %s", service, status, actual)
+		}
+	}
+}
@@ -3,8 +3,15 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/hcl/ast"
 	"github.com/mitchellh/mapstructure"
@@ -13,27 +20,296 @@ import (
 const LocalMode = "local"
 const GlobalMode = "global"
 
+// How service watches query Consul for health check results
+const (
+	// Long-poll blocking queries against /v1/health/checks
+	BackendBlocking = "blocking"
+
+	// Long-poll blocking queries against the service's health entries at /v1/health/service
+	BackendHealthService = "health_service"
+)
+
+var watchBackends = []string{BackendBlocking, BackendHealthService}
+
+// How to alert on a node/service that's already failing when it's first discovered
+const (
+	// Alert right away, without waiting for the change threshold
+	NewEntityImmediate = "immediate"
+
+	// Alert after the change threshold, like any other transition
+	NewEntityThreshold = "threshold"
+
+	// Don't alert on the initial state, only on the next transition
+	NewEntityTransition = "transition"
+)
+
+var newEntityAlertModes = []string{NewEntityImmediate, NewEntityThreshold, NewEntityTransition}
+
 type Config struct {
 	ConsulAddress    string   `mapstructure:"consul_address"`
 	ConsulToken      string   `mapstructure:"consul_token"`
 	ConsulDatacenter string   `mapstructure:"datacenter"`
+	NodeName         string   `mapstructure:"node_name"`
 	DevMode          bool     `mapstructure:"dev_mode"`
+	Agentless        bool     `mapstructure:"agentless"`
 	NodeWatch        string   `mapstructure:"node_watch"`
 	ServiceWatch     string   `mapstructure:"service_watch"`
 	ChangeThreshold  int      `mapstructure:"change_threshold"`
+	ReminderInterval int      `mapstructure:"reminder_interval"`
+	MaxNotifications int      `mapstructure:"max_notifications"`
+	RefreshDetails   bool     `mapstructure:"refresh_details"`
+	NewEntityAlerts  string   `mapstructure:"new_entity_alerts"`
 	DefaultHandlers  []string `mapstructure:"default_handlers"`
 	LogLevel         string   `mapstructure:"log_level"`
+	LogLevelKey      string   `mapstructure:"log_level_key"`
+
+	WatchBackend string `mapstructure:"watch_backend"`
+
+	NodeWatchSharding bool `mapstructure:"node_watch_sharding"`
+
+	SelfThrottle      bool    `mapstructure:"self_throttle"`
+	ThrottleRTT       int     `mapstructure:"throttle_rtt"`
+	ThrottleErrorRate float64 `mapstructure:"throttle_error_rate"`
+
+	StartupSyncRate      int `mapstructure:"startup_sync_rate"`
+	StartupSyncBatchSize int `mapstructure:"startup_sync_batch_size"`
+
+	// How often each watch saves its last index to the KV store, in seconds, so a restarted
+	// leader can resume its blocking queries instead of fetching everything at once
+	WatchIndexInterval int `mapstructure:"watch_index_interval"`
+
+	DiscoveryCacheDir string `mapstructure:"discovery_cache_dir"`
+	RemovalThreshold  int    `mapstructure:"removal_threshold"`
+
+	RemovalGracePeriod int `mapstructure:"removal_grace_period"`
+
+	QueuePath     string `mapstructure:"queue_path"`
+	StatusAddress string `mapstructure:"status_address"`
+
+	DispatchWorkers int `mapstructure:"dispatch_workers"`
+	ShutdownTimeout int `mapstructure:"shutdown_timeout"`
+
+	StatusTLSCert     string `mapstructure:"status_tls_cert"`
+	StatusTLSKey      string `mapstructure:"status_tls_key"`
+	StatusTLSClientCA string `mapstructure:"status_tls_client_ca"`
+	StatusUsername    string `mapstructure:"status_username"`
+	StatusPassword    string `mapstructure:"status_password"`
+	StatusToken       string `mapstructure:"status_token"`
+
+	DeliveryTracking bool `mapstructure:"delivery_tracking"`
+	DeliveryIntents  bool `mapstructure:"delivery_intents"`
+
+	ReachabilityProbe   string `mapstructure:"reachability_probe"`
+	ReachabilityPort    int    `mapstructure:"reachability_port"`
+	ReachabilityTimeout int    `mapstructure:"reachability_timeout"`
+
+	EntityMetrics      []string `mapstructure:"entity_metrics"`
+	EntityMetricsLimit int      `mapstructure:"entity_metrics_limit"`
+
+	CheckStateCacheSize  int `mapstructure:"check_state_cache_size"`
+	CheckStateCacheTotal int `mapstructure:"check_state_cache_total"`
+
+	PagerdutyWebhookToken string `mapstructure:"pagerduty_webhook_token"`
+
+	AckLinkSecret  string `mapstructure:"ack_link_secret"`
+	AckLinkBaseURL string `mapstructure:"ack_link_base_url"`
+	AckLinkTTL     int    `mapstructure:"ack_link_ttl"`
+	AckLinkSilence int    `mapstructure:"ack_link_silence"`
+
+	CatalogAuditInterval int `mapstructure:"catalog_audit_interval"`
+	JanitorInterval      int `mapstructure:"janitor_interval"`
+	StaleAlertAge        int `mapstructure:"stale_alert_age"`
+
+	FatalEvent         bool   `mapstructure:"fatal_event"`
+	FatalHandler       string `mapstructure:"fatal_handler"`
+	FatalWebhook       string `mapstructure:"fatal_webhook"`
+	FatalOnReloadError bool   `mapstructure:"fatal_on_reload_error"`
+
+	Proxy string `mapstructure:"proxy"`
+
+	StartupTimeout int `mapstructure:"startup_timeout"`
+
+	IgnoreOutputPatterns []string `mapstructure:"ignore_output_patterns"`
+	OutputPatternStatus  string   `mapstructure:"output_pattern_status"`
+
+	Runbooks map[string]string `mapstructure:"runbooks"`
+
+	UnknownStatus string `mapstructure:"unknown_status"`
 
-	Services map[string]ServiceConfig
-	Handlers map[string]AlertHandler
+	DiffStrategy string   `mapstructure:"diff_strategy"`
+	IgnoreChecks []string `mapstructure:"ignore_checks"`
+
+	ServiceMetaConfig bool `mapstructure:"service_meta_config"`
+
+	NomadCompat     bool     `mapstructure:"nomad_compat"`
+	NomadCanaryTags []string `mapstructure:"nomad_canary_tags"`
+
+	DeploymentPrefix string `mapstructure:"deployment_prefix"`
+
+	HealthSummaryPrefix string `mapstructure:"health_summary_prefix"`
+	HealthSummaryNode   string `mapstructure:"health_summary_node"`
+
+	EventLogPath string `mapstructure:"event_log_path"`
+	HistorySize  int    `mapstructure:"history_size"`
+
+	ShadowMode     bool   `mapstructure:"shadow_mode"`
+	ShadowKVPrefix string `mapstructure:"shadow_kv_prefix"`
+
+	AggregatorAddress     string `mapstructure:"aggregator_address"`
+	AggregatorToken       string `mapstructure:"aggregator_token"`
+	AggregatorTLSCert     string `mapstructure:"aggregator_tls_cert"`
+	AggregatorTLSKey      string `mapstructure:"aggregator_tls_key"`
+	AggregatorHistorySize int    `mapstructure:"aggregator_history_size"`
+
+	AggregatorSigningSecret string `mapstructure:"aggregator_signing_secret"`
+	AggregatorReplayWindow  int    `mapstructure:"aggregator_replay_window"`
+
+	Services      map[string]ServiceConfig
+	Handlers      map[string]AlertHandler
+	Teams         map[string]TeamConfig
+	HandlerGroups map[string]HandlerGroupConfig
+	NodeRoutes    map[string]NodeRouteConfig
+	Tiers         map[string]TierConfig
+	HTTPWatches   map[string]HTTPWatchConfig
+	Composites    map[string]CompositeConfig
+	WatchHooks    map[string]WatchHookConfig
+
+	// The handler IDs for each service and tier, built on first use after the config is loaded
+	routing     *routingTable
+	routingLock sync.Mutex
+
+	// The local queue for alerts that couldn't be delivered, if queue_path is set
+	deliveryQueue *DeliveryQueue
+
+	// The priority queue alerts are dispatched through, if dispatch_workers is set
+	dispatchQueue *DispatchQueue
+
+	// The machine-readable log of alert events, if event_log_path is set
+	eventLog *EventLog
+
+	// The per-alert history of lifecycle events in the KV store, if history_size is set
+	history *AlertHistory
+
+	// Compiled versions of IgnoreOutputPatterns
+	outputPatterns []*regexp.Regexp
+
+	// Compiled versions of EntityMetrics
+	entityMetricPatterns []servicePattern
+
+	// Compiled versions of Runbooks
+	runbooks []checkRunbook
+
+	// The service blocks keyed by a glob or regex, in order of precedence
+	servicePatterns []servicePattern
+
+	// Alerting settings read from each service's meta, if service_meta_config is set
+	serviceMeta map[string]map[string]string
+
+	// The watches paused through the KV store, keyed by watch ID
+	pausedWatches map[string]PausedWatch
+
+	// The end of each service's open deployment window, if deployment_prefix is set
+	deployments map[string]time.Time
+
+	// Guards the settings that can be changed by reloading the config
+	lock sync.RWMutex
 }
 
 type ServiceConfig struct {
-	Name            string
-	ChangeThreshold int      `mapstructure:"change_threshold"`
-	DistinctTags    bool     `mapstructure:"distinct_tags"`
-	IgnoredTags     []string `mapstructure:"ignored_tags"`
-	Handlers        []string `mapstructure:"handlers"`
+	Name             string
+	ChangeThreshold  int      `mapstructure:"change_threshold"`
+	ReminderInterval int      `mapstructure:"reminder_interval"`
+	NewEntityAlerts  string   `mapstructure:"new_entity_alerts"`
+	DistinctTags     bool     `mapstructure:"distinct_tags"`
+	IgnoredTags      []string `mapstructure:"ignored_tags"`
+	TagSet           []string `mapstructure:"tag_set"`
+	Handlers         []string `mapstructure:"handlers"`
+
+	IgnoreOutputPatterns []string `mapstructure:"ignore_output_patterns"`
+	Team                 string   `mapstructure:"team"`
+	MaxStaleness         int      `mapstructure:"max_staleness"`
+	DiffStrategy         string   `mapstructure:"diff_strategy"`
+	IgnoreChecks         []string `mapstructure:"ignore_checks"`
+
+	SLO         float64 `mapstructure:"slo"`
+	SLOWindow   int     `mapstructure:"slo_window"`
+	SLOBurnRate float64 `mapstructure:"slo_burn_rate"`
+
+	// Extra fields attached to the service's alerts, such as a cost center
+	AlertFields map[string]string `mapstructure:"alert_fields"`
+
+	// Compiled versions of IgnoreOutputPatterns
+	outputPatterns []*regexp.Regexp
+}
+
+// A service block whose name is a glob (such as "api-*") or a regular expression wrapped in
+// slashes (such as "/^api-v[0-9]+$/"), applying to every service it matches
+type servicePattern struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+// Returns true if the service block name is a pattern rather than an exact service name
+func isServicePattern(name string) bool {
+	return (len(name) > 1 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/")) ||
+		strings.ContainsAny(name, "*?[")
+}
+
+func newServicePattern(name string) (servicePattern, error) {
+	if strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/") {
+		regex, err := regexp.Compile(name[1 : len(name)-1])
+		if err != nil {
+			return servicePattern{}, err
+		}
+		return servicePattern{name: name, regex: regex}, nil
+	}
+
+	if _, err := path.Match(name, ""); err != nil {
+		return servicePattern{}, err
+	}
+	return servicePattern{name: name}, nil
+}
+
+func (p servicePattern) matches(service string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(service)
+	}
+	matched, _ := path.Match(p.name, service)
+	return matched
+}
+
+// Returns the number of characters in a glob that aren't wildcards, for ordering globs by
+// how specific they are
+func (p servicePattern) literalLength() int {
+	return len(p.name) - strings.Count(p.name, "*") - strings.Count(p.name, "?")
+}
+
+// Sorts service patterns into their order of precedence: globs before regular expressions,
+// globs with more literal characters first, then alphabetically
+func sortServicePatterns(patterns []servicePattern) {
+	sort.Slice(patterns, func(i, j int) bool {
+		a, b := patterns[i], patterns[j]
+		if (a.regex == nil) != (b.regex == nil) {
+			return a.regex == nil
+		}
+		if a.regex == nil && a.literalLength() != b.literalLength() {
+			return a.literalLength() > b.literalLength()
+		}
+		return a.name < b.name
+	})
+}
+
+// TeamConfig describes how to reach a team, so services can be routed to their owners
+// with `team = "name"` instead of listing handlers for each service
+type TeamConfig struct {
+	Name         string
+	Slack        string   `mapstructure:"slack"`
+	SlackToken   string   `mapstructure:"slack_token"`
+	Email        []string `mapstructure:"email"`
+	PagerdutyKey string   `mapstructure:"pagerduty_key"`
+
+	// The IDs of the handlers generated for this team
+	handlerIDs []string
 }
 
 // Parses a given file path for config and returns a Config object and an array
@@ -83,6 +359,13 @@ func ParseConfig(raw string) (*Config, error) {
 	}
 	delete(m, "service")
 	delete(m, "handler")
+	delete(m, "team")
+	delete(m, "handler_group")
+	delete(m, "node_route")
+	delete(m, "tier")
+	delete(m, "http_watch")
+	delete(m, "composite")
+	delete(m, "watch_hook")
 
 	// Set defaults for unset keys
 	defaultConfig := map[string]interface{}{
@@ -91,6 +374,33 @@ func ParseConfig(raw string) (*Config, error) {
 		"service_watch":    "local",
 		"change_threshold": 60,
 		"log_level":        "info",
+		"watch_backend":    BackendBlocking,
+
+		"throttle_rtt":        1000,
+		"throttle_error_rate": 0.25,
+
+		"output_pattern_status": "passing",
+		"unknown_status":        api.HealthWarning,
+		"diff_strategy":         DiffAll,
+		"new_entity_alerts":     NewEntityThreshold,
+
+		"startup_sync_rate":       0,
+		"startup_sync_batch_size": 100,
+		"removal_threshold":       1,
+
+		"nomad_canary_tags": []string{"canary"},
+
+		"ack_link_ttl":     3600,
+		"ack_link_silence": 3600,
+
+		"aggregator_history_size":  1000,
+		"aggregator_replay_window": 300,
+		"history_size":             100,
+		"shadow_kv_prefix":         alertingKVRoot + "-shadow",
+		"entity_metrics_limit":     1000,
+		"delivery_tracking":        false,
+		"reachability_port":        8301,
+		"reachability_timeout":     2,
 	}
 	for k, v := range defaultConfig {
 		if _, ok := m[k]; !ok {
@@ -121,6 +431,89 @@ func ParseConfig(raw string) (*Config, error) {
 		}
 	}
 
+	// Use parser function for team blocks, which generate handlers for each team
+	config.Teams = make(map[string]TeamConfig)
+	if obj := list.Filter("team"); len(obj.Items) > 0 {
+		err = parseTeams(obj, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use parser function for handler group blocks, which refer to handlers (including the teams')
+	config.HandlerGroups = make(map[string]HandlerGroupConfig)
+	if obj := list.Filter("handler_group"); len(obj.Items) > 0 {
+		err = parseHandlerGroups(obj, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Expand any groups in the service handler lists now that they're known
+	config.DefaultHandlers = config.expandHandlerGroups(config.DefaultHandlers)
+	for name, service := range config.Services {
+		service.Handlers = config.expandHandlerGroups(service.Handlers)
+		config.Services[name] = service
+	}
+
+	// Use parser function for node route blocks, which can refer to handlers, groups and teams
+	config.NodeRoutes = make(map[string]NodeRouteConfig)
+	if obj := list.Filter("node_route"); len(obj.Items) > 0 {
+		err = parseNodeRoutes(obj, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use parser function for tier blocks, which refer to handlers (including the teams') and groups
+	config.Tiers = make(map[string]TierConfig)
+	if obj := list.Filter("tier"); len(obj.Items) > 0 {
+		err = parseTiers(obj, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use parser function for http watch blocks, which refer to handlers, groups and teams
+	config.HTTPWatches = make(map[string]HTTPWatchConfig)
+	if obj := list.Filter("http_watch"); len(obj.Items) > 0 {
+		err = parseHTTPWatches(obj, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use parser function for composite blocks, which refer to handlers, groups and teams
+	config.Composites = make(map[string]CompositeConfig)
+	if obj := list.Filter("composite"); len(obj.Items) > 0 {
+		err = parseComposites(obj, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config.WatchHooks = make(map[string]WatchHookConfig)
+	if obj := list.Filter("watch_hook"); len(obj.Items) > 0 {
+		err = parseWatchHooks(obj, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, service := range config.Services {
+		if _, ok := config.Teams[service.Team]; service.Team != "" && !ok {
+			return nil, fmt.Errorf("Unknown team for service %s: %s", name, service.Team)
+		}
+	}
+
+	for id, handler := range config.Handlers {
+		if slack, ok := unwrapHandler(handler).(SlackHandler); ok {
+			if err := config.validateScopedCredentials(id, "api_tokens", slack.Tokens); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// Validate config
 	validWatchModes := []string{LocalMode, GlobalMode}
 
@@ -128,16 +521,231 @@ func ParseConfig(raw string) (*Config, error) {
 		return nil, fmt.Errorf("Invalid value for node_watch: %s", config.NodeWatch)
 	}
 
+	if config.NodeWatchSharding && config.NodeWatch != GlobalMode {
+		return nil, fmt.Errorf("node_watch_sharding requires node_watch = \"global\"")
+	}
+
 	if !contains(validWatchModes, config.ServiceWatch) {
 		return nil, fmt.Errorf("Invalid value for service_watch: %s", config.ServiceWatch)
 	}
 
+	if !contains(watchBackends, config.WatchBackend) {
+		return nil, fmt.Errorf("Invalid value for watch_backend: %s", config.WatchBackend)
+	}
+
+	if config.StartupSyncRate < 0 {
+		return nil, fmt.Errorf("Invalid value for startup_sync_rate: %d", config.StartupSyncRate)
+	}
+
+	_, isGroup := config.HandlerGroups[config.FatalHandler]
+	if _, ok := config.Handlers[config.FatalHandler]; config.FatalHandler != "" && !ok && !isGroup {
+		return nil, fmt.Errorf("Unknown handler for fatal_handler: %s", config.FatalHandler)
+	}
+
+	if config.FatalWebhook != "" && !strings.HasPrefix(config.FatalWebhook, "http://") && !strings.HasPrefix(config.FatalWebhook, "https://") {
+		return nil, fmt.Errorf("Invalid value for fatal_webhook: %s must be an http:// or https:// URL", config.FatalWebhook)
+	}
+
+	if config.Agentless && config.ConsulDatacenter == "" {
+		return nil, fmt.Errorf("agentless requires datacenter")
+	}
+
+	if config.Agentless && config.DevMode {
+		return nil, fmt.Errorf("dev_mode can't be used with agentless")
+	}
+
+	if config.StartupTimeout < 0 {
+		return nil, fmt.Errorf("Invalid value for startup_timeout: %d", config.StartupTimeout)
+	}
+
+	config.outputPatterns, err = compilePatterns(config.IgnoreOutputPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ignore_output_patterns: %s", err)
+	}
+
+	for _, name := range config.EntityMetrics {
+		pattern, err := newServicePattern(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid entity_metrics pattern %q: %s", name, err)
+		}
+		config.entityMetricPatterns = append(config.entityMetricPatterns, pattern)
+	}
+
+	if !contains(reachabilityProbes, config.ReachabilityProbe) {
+		return nil, fmt.Errorf("Invalid value for reachability_probe: %s", config.ReachabilityProbe)
+	}
+
+	if config.ReachabilityPort <= 0 || config.ReachabilityPort > 65535 {
+		return nil, fmt.Errorf("Invalid value for reachability_port: %d", config.ReachabilityPort)
+	}
+
+	if config.ReachabilityTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid value for reachability_timeout: %d", config.ReachabilityTimeout)
+	}
+
+	if config.EntityMetricsLimit <= 0 {
+		return nil, fmt.Errorf("Invalid value for entity_metrics_limit: %d", config.EntityMetricsLimit)
+	}
+
+	if config.CheckStateCacheSize < 0 {
+		return nil, fmt.Errorf("Invalid value for check_state_cache_size: %d", config.CheckStateCacheSize)
+	}
+
+	if config.CheckStateCacheTotal < 0 {
+		return nil, fmt.Errorf("Invalid value for check_state_cache_total: %d", config.CheckStateCacheTotal)
+	}
+
+	config.runbooks, err = compileRunbooks(config.Runbooks)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid runbooks: %s", err)
+	}
+
+	if !contains([]string{api.HealthPassing, api.HealthWarning}, config.OutputPatternStatus) {
+		return nil, fmt.Errorf("Invalid value for output_pattern_status: %s", config.OutputPatternStatus)
+	}
+
+	if !contains(diffStrategies, config.DiffStrategy) {
+		return nil, fmt.Errorf("Invalid value for diff_strategy: %s", config.DiffStrategy)
+	}
+
+	if (config.StatusTLSCert == "") != (config.StatusTLSKey == "") {
+		return nil, fmt.Errorf("status_tls_cert and status_tls_key must be set together")
+	}
+
+	if config.StatusTLSClientCA != "" && config.StatusTLSCert == "" {
+		return nil, fmt.Errorf("status_tls_client_ca requires status_tls_cert and status_tls_key")
+	}
+
+	if config.StatusUsername != "" && config.StatusPassword == "" {
+		return nil, fmt.Errorf("status_password must be set when status_username is")
+	}
+
+	if (config.AggregatorTLSCert == "") != (config.AggregatorTLSKey == "") {
+		return nil, fmt.Errorf("aggregator_tls_cert and aggregator_tls_key must be set together")
+	}
+
+	if !contains([]string{api.HealthPassing, api.HealthWarning, api.HealthCritical}, config.UnknownStatus) {
+		return nil, fmt.Errorf("Invalid value for unknown_status: %s", config.UnknownStatus)
+	}
+
+	if config.ThrottleRTT <= 0 {
+		return nil, fmt.Errorf("Invalid value for throttle_rtt: %d", config.ThrottleRTT)
+	}
+
+	if config.ThrottleErrorRate <= 0 || config.ThrottleErrorRate > 1 {
+		return nil, fmt.Errorf("Invalid value for throttle_error_rate: %v", config.ThrottleErrorRate)
+	}
+
+	if config.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("Invalid value for shutdown_timeout: %d", config.ShutdownTimeout)
+	}
+
+	if config.HistorySize < 0 {
+		return nil, fmt.Errorf("Invalid value for history_size: %d", config.HistorySize)
+	}
+
+	config.ShadowKVPrefix = strings.TrimSuffix(config.ShadowKVPrefix, "/")
+	if config.ShadowKVPrefix == "" || config.ShadowKVPrefix == alertingKVRoot || strings.HasPrefix(config.ShadowKVPrefix, alertingKVRoot+"/") {
+		return nil, fmt.Errorf("Invalid value for shadow_kv_prefix: %q must be outside %s", config.ShadowKVPrefix, alertingKVRoot)
+	}
+
+	if config.ShadowMode && config.HistorySize == 0 {
+		return nil, fmt.Errorf("shadow_mode requires history_size")
+	}
+
+	if config.ShadowMode && config.NodeWatchSharding {
+		return nil, fmt.Errorf("node_watch_sharding can't be used with shadow_mode")
+	}
+
+	if config.DispatchWorkers < 0 {
+		return nil, fmt.Errorf("Invalid value for dispatch_workers: %d", config.DispatchWorkers)
+	}
+
+	if config.AggregatorHistorySize <= 0 {
+		return nil, fmt.Errorf("Invalid value for aggregator_history_size: %d", config.AggregatorHistorySize)
+	}
+
+	if config.AggregatorReplayWindow <= 0 {
+		return nil, fmt.Errorf("Invalid value for aggregator_replay_window: %d", config.AggregatorReplayWindow)
+	}
+
+	if config.PagerdutyWebhookToken != "" && config.StatusAddress == "" {
+		return nil, fmt.Errorf("pagerduty_webhook_token requires status_address")
+	}
+
+	if config.AckLinkSecret != "" {
+		if config.StatusAddress == "" {
+			return nil, fmt.Errorf("ack_link_secret requires status_address")
+		}
+		if !strings.HasPrefix(config.AckLinkBaseURL, "http://") && !strings.HasPrefix(config.AckLinkBaseURL, "https://") {
+			return nil, fmt.Errorf("ack_link_secret requires ack_link_base_url to be an http:// or https:// URL")
+		}
+	}
+
+	if config.AckLinkTTL <= 0 {
+		return nil, fmt.Errorf("Invalid value for ack_link_ttl: %d", config.AckLinkTTL)
+	}
+
+	if config.AckLinkSilence <= 0 {
+		return nil, fmt.Errorf("Invalid value for ack_link_silence: %d", config.AckLinkSilence)
+	}
+
+	if !contains(newEntityAlertModes, config.NewEntityAlerts) {
+		return nil, fmt.Errorf("Invalid value for new_entity_alerts: %s", config.NewEntityAlerts)
+	}
+
+	if config.ReminderInterval < 0 {
+		return nil, fmt.Errorf("Invalid value for reminder_interval: %d", config.ReminderInterval)
+	}
+
+	if config.MaxNotifications < 0 {
+		return nil, fmt.Errorf("Invalid value for max_notifications: %d", config.MaxNotifications)
+	}
+
+	if config.CatalogAuditInterval < 0 {
+		return nil, fmt.Errorf("Invalid value for catalog_audit_interval: %d", config.CatalogAuditInterval)
+	}
+
+	if config.JanitorInterval < 0 {
+		return nil, fmt.Errorf("Invalid value for janitor_interval: %d", config.JanitorInterval)
+	}
+
+	if config.WatchIndexInterval < 0 {
+		return nil, fmt.Errorf("Invalid value for watch_index_interval: %d", config.WatchIndexInterval)
+	}
+
+	if config.StaleAlertAge < 0 {
+		return nil, fmt.Errorf("Invalid value for stale_alert_age: %d", config.StaleAlertAge)
+	}
+	if config.StaleAlertAge > 0 && config.JanitorInterval == 0 {
+		return nil, fmt.Errorf("stale_alert_age requires janitor_interval")
+	}
+
+	if config.RemovalThreshold <= 0 {
+		return nil, fmt.Errorf("Invalid value for removal_threshold: %d", config.RemovalThreshold)
+	}
+
+	if config.RemovalGracePeriod < 0 {
+		return nil, fmt.Errorf("Invalid value for removal_grace_period: %d", config.RemovalGracePeriod)
+	}
+
+	if config.StartupSyncBatchSize <= 0 {
+		return nil, fmt.Errorf("Invalid value for startup_sync_batch_size: %d", config.StartupSyncBatchSize)
+	}
+
 	return &config, nil
 }
 
 // Parse the raw service objects into the config
+// Returns the name of a service's tag set, which its watch uses in place of a tag, or an
+// empty string if it has none
+func (s *ServiceConfig) tagSetName() string {
+	return strings.Join(s.TagSet, ",")
+}
+
 func parseServices(list *ast.ObjectList, config *Config) error {
 	config.Services = make(map[string]ServiceConfig)
+	config.servicePatterns = nil
 
 	for _, s := range list.Items {
 		name := s.Keys[0].Token.Value().(string)
@@ -152,25 +760,74 @@ func parseServices(list *ast.ObjectList, config *Config) error {
 			m["change_threshold"] = config.ChangeThreshold
 		}
 
+		if _, ok := m["reminder_interval"]; !ok {
+			m["reminder_interval"] = config.ReminderInterval
+		}
+
 		if err := mapstructure.WeakDecode(m, &service); err != nil {
 			return err
 		}
 
-		service.Name = name
-		config.Services[name] = service
-	}
+		patterns, err := compilePatterns(service.IgnoreOutputPatterns)
+		if err != nil {
+			return fmt.Errorf("Invalid ignore_output_patterns for service %s: %s", name, err)
+		}
+		service.outputPatterns = patterns
 
-	return nil
-}
+		if service.NewEntityAlerts != "" && !contains(newEntityAlertModes, service.NewEntityAlerts) {
+			return fmt.Errorf("Invalid value for new_entity_alerts for service %s: %s", name, service.NewEntityAlerts)
+		}
 
-// Parse the raw handler objects into the config
-func parseHandlers(list *ast.ObjectList, config *Config) error {
-	config.Handlers = make(map[string]AlertHandler)
+		if service.DiffStrategy != "" && !contains(diffStrategies, service.DiffStrategy) {
+			return fmt.Errorf("Invalid value for diff_strategy for service %s: %s", name, service.DiffStrategy)
+		}
 
-	defaultConfig := map[string]map[string]interface{}{
-		"stdout": map[string]interface{}{
-			"log_level": "warn",
-		},
+		if len(service.TagSet) > 0 && service.DistinctTags {
+			return fmt.Errorf("tag_set for service %s can't be used with distinct_tags", name)
+		}
+
+		for i, tag := range service.TagSet {
+			if tag == "" || contains(service.TagSet[:i], tag) {
+				return fmt.Errorf("Invalid tag_set for service %s: tags must be non-empty and distinct", name)
+			}
+		}
+
+		if service.SLO < 0 || service.SLO >= 100 {
+			return fmt.Errorf("Invalid value for slo for service %s: %v", name, service.SLO)
+		}
+
+		if service.SLOWindow < 0 || service.SLOBurnRate < 0 {
+			return fmt.Errorf("Invalid SLO window or burn rate for service %s", name)
+		}
+
+		if service.SLO != 0 && config.HistorySize == 0 {
+			return fmt.Errorf("slo for service %s requires history_size", name)
+		}
+
+		if isServicePattern(name) {
+			pattern, err := newServicePattern(name)
+			if err != nil {
+				return fmt.Errorf("Invalid pattern for service %s: %s", name, err)
+			}
+			config.servicePatterns = append(config.servicePatterns, pattern)
+		}
+
+		service.Name = name
+		config.Services[name] = service
+	}
+	sortServicePatterns(config.servicePatterns)
+
+	return nil
+}
+
+// Parse the raw handler objects into the config
+func parseHandlers(list *ast.ObjectList, config *Config) error {
+	config.Handlers = make(map[string]AlertHandler)
+
+	defaultConfig := map[string]map[string]interface{}{
+		"stdout": map[string]interface{}{
+			"log_level": "warn",
+		},
 		"email": map[string]interface{}{
 			"max_retries": 5,
 		},
@@ -180,6 +837,87 @@ func parseHandlers(list *ast.ObjectList, config *Config) error {
 		"slack": map[string]interface{}{
 			"max_retries": 5,
 		},
+		"statuspage": map[string]interface{}{
+			"warning_status":  "degraded_performance",
+			"critical_status": "major_outage",
+			"base_url":        "https://api.statuspage.io/v1",
+			"max_retries":     5,
+		},
+		"cachet": map[string]interface{}{
+			"warning_status":  cachetPerformanceIssues,
+			"critical_status": cachetMajorOutage,
+			"max_retries":     5,
+		},
+		"sns": map[string]interface{}{
+			"max_retries": 5,
+		},
+		"pubsub": map[string]interface{}{
+			"endpoint":    "https://pubsub.googleapis.com",
+			"max_retries": 5,
+		},
+		"elasticsearch": map[string]interface{}{
+			"index":           "consul-alerts-" + esDatePlaceholder,
+			"manage_template": true,
+			"template_name":   "consul-alerts",
+			"max_retries":     5,
+		},
+		"azure": map[string]interface{}{
+			"target":      AzureEventHub,
+			"max_retries": 5,
+		},
+		"forward": map[string]interface{}{
+			"max_retries": 5,
+		},
+		"teams": map[string]interface{}{
+			"card_format": TeamsMessageCard,
+			"max_retries": 5,
+		},
+		"alerta": map[string]interface{}{
+			"event":       "ConsulHealth",
+			"origin":      "consul-alerting",
+			"max_retries": 5,
+		},
+		"alertmanager": map[string]interface{}{
+			"alert_name":     "ConsulHealth",
+			"active_timeout": 86400,
+			"max_retries":    5,
+		},
+		"webex": map[string]interface{}{
+			"base_url":    "https://webexapis.com/v1",
+			"max_retries": 5,
+		},
+		"influx": map[string]interface{}{
+			"measurement": "consul_health",
+			"max_retries": 5,
+		},
+		"file": map[string]interface{}{
+			"max_size_mb": 100,
+			"max_backups": 5,
+		},
+		"exec": map[string]interface{}{
+			"timeout": 30,
+		},
+		"plugin": map[string]interface{}{
+			"timeout": 30,
+		},
+		"consul_event": map[string]interface{}{
+			"name":           "consul-alerting",
+			"max_event_size": 512,
+			"max_retries":    5,
+		},
+		"nagios": map[string]interface{}{
+			"protocol":     NSCAProtocol,
+			"encryption":   "none",
+			"node_service": "Consul Health",
+			"max_retries":  5,
+		},
+		"snmp": map[string]interface{}{
+			"version":     "2c",
+			"community":   "public",
+			"trap_oid":    "1.3.6.1.4.1.8072.9999.9999.1.0.1",
+			"varbind_oid": "1.3.6.1.4.1.8072.9999.9999.1.1",
+			"engine_id":   snmpDefaultEngineID,
+		},
 	}
 
 	for _, s := range list.Items {
@@ -194,6 +932,7 @@ func parseHandlers(list *ast.ObjectList, config *Config) error {
 		if err := hcl.DecodeObject(&m, s.Val); err != nil {
 			return err
 		}
+		delete(m, "middleware")
 
 		// Set defaults
 		if _, ok := defaultConfig[handlerType]; ok {
@@ -204,6 +943,18 @@ func parseHandlers(list *ast.ObjectList, config *Config) error {
 			}
 		}
 
+		// Send requests through the global proxy, unless the handler sets its own
+		if contains(proxyHandlerTypes, handlerType) {
+			if _, ok := m["proxy"]; !ok && config.Proxy != "" {
+				m["proxy"] = config.Proxy
+			}
+			if proxy, ok := m["proxy"].(string); ok && proxy != "" {
+				if err := validateProxy(proxy); err != nil {
+					return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+				}
+			}
+		}
+
 		// Decode based on the handler type.
 		// TODO: look into a more compact way to do this when we have more handlers
 		switch handlerType {
@@ -219,65 +970,569 @@ func parseHandlers(list *ast.ObjectList, config *Config) error {
 			if err := mapstructure.WeakDecode(m, &handler); err != nil {
 				return err
 			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
 			config.Handlers[id] = handler
 		case "pagerduty":
 			var handler PagerdutyHandler
 			if err := mapstructure.WeakDecode(m, &handler); err != nil {
 				return err
 			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
 			config.Handlers[id] = handler
 		case "slack":
 			var handler SlackHandler
 			if err := mapstructure.WeakDecode(m, &handler); err != nil {
 				return err
 			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "statuspage":
+			var handler StatuspageHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "cachet":
+			var handler CachetHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "nagios":
+			var handler NagiosHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "snmp":
+			var handler SNMPHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "pubsub":
+			var handler PubsubHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "elasticsearch":
+			var handler ElasticsearchHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "azure":
+			var handler AzureHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "sns":
+			var handler SNSHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "teams":
+			var handler TeamsHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "alerta":
+			var handler AlertaHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "alertmanager":
+			var handler AlertmanagerHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "webex":
+			var handler WebexHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "influx":
+			var handler InfluxHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "file":
+			var handler FileHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "exec":
+			var handler ExecHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "plugin":
+			var handler PluginHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "consul_event":
+			// Fire events through the agent and token used for everything else, unless the
+			// handler sets its own
+			if _, ok := m["address"]; !ok {
+				m["address"] = config.ConsulAddress
+			}
+			if _, ok := m["token"]; !ok {
+				m["token"] = config.ConsulToken
+			}
+
+			var handler ConsulEventHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
+			config.Handlers[id] = handler
+		case "forward":
+			var handler ForwardHandler
+			if err := mapstructure.WeakDecode(m, &handler); err != nil {
+				return err
+			}
+			if err := handler.validate(); err != nil {
+				return fmt.Errorf("Invalid config for handler %s: %s", id, err)
+			}
 			config.Handlers[id] = handler
 		default:
 			return fmt.Errorf("Unknown handler type: %s", handlerType)
 		}
 
+		middleware, err := parseMiddleware(id, s.Val)
+		if err != nil {
+			return err
+		}
+		if len(middleware) > 0 {
+			config.Handlers[id] = newMiddlewareHandler(config.Handlers[id], middleware)
+		}
+
 		log.Infof("Loaded handler: %s", id)
 	}
 
 	return nil
 }
 
+// Parse the raw team objects into the config, generating handlers for each team
+func parseTeams(list *ast.ObjectList, config *Config) error {
+	config.Teams = make(map[string]TeamConfig)
+
+	for _, t := range list.Items {
+		name := t.Keys[0].Token.Value().(string)
+
+		var m map[string]interface{}
+		var team TeamConfig
+		if err := hcl.DecodeObject(&m, t.Val); err != nil {
+			return err
+		}
+
+		if err := mapstructure.WeakDecode(m, &team); err != nil {
+			return err
+		}
+		team.Name = name
+
+		if team.Slack != "" {
+			// Fall back to the token of a configured slack handler, preferring one scoped to
+			// the team in its api_tokens. Incoming webhooks can only post to their own channel,
+			// so handlers using one don't have a token to lend.
+			token := team.SlackToken
+			if token == "" {
+				ids := make([]string, 0)
+				for id, _ := range config.Handlers {
+					ids = append(ids, id)
+				}
+				sort.Strings(ids)
+				for _, id := range ids {
+					if handler, ok := unwrapHandler(config.Handlers[id]).(SlackHandler); ok && handler.Tokens[name] != "" {
+						token = handler.Tokens[name]
+						break
+					}
+				}
+				for _, id := range ids {
+					if handler, ok := unwrapHandler(config.Handlers[id]).(SlackHandler); ok && token == "" && handler.Token != "" {
+						token = handler.Token
+						break
+					}
+				}
+			}
+			if token == "" {
+				return fmt.Errorf("No slack_token for team %s, and no slack handler to take one from", name)
+			}
+
+			err := team.addHandler(config, "slack", SlackHandler{
+				Token:       token,
+				ChannelName: team.Slack,
+				MaxRetries:  5,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(team.Email) > 0 {
+			err := team.addHandler(config, "email", EmailHandler{
+				Recipients: team.Email,
+				MaxRetries: 5,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if team.PagerdutyKey != "" {
+			err := team.addHandler(config, "pagerduty", PagerdutyHandler{
+				ServiceKey: team.PagerdutyKey,
+				MaxRetries: 5,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		config.Teams[name] = team
+	}
+
+	return nil
+}
+
+// Adds a handler generated for the team to the config
+func (team *TeamConfig) addHandler(config *Config, handlerType string, handler AlertHandler) error {
+	id := handlerType + ".team_" + team.Name
+	if _, ok := config.Handlers[id]; ok {
+		return fmt.Errorf("Handler %s for team %s conflicts with a configured handler of the same name", id, team.Name)
+	}
+	config.Handlers[id] = handler
+	team.handlerIDs = append(team.handlerIDs, id)
+	log.Infof("Loaded handler: %s", id)
+	return nil
+}
+
 func (config *Config) serviceConfig(service string) *ServiceConfig {
-	if s, ok := config.Services[service]; ok {
-		return &s
-	} else {
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+
+	return config.serviceConfigLocked(service)
+}
+
+// Same as serviceConfig, but assumes the config lock is already held
+func (config *Config) serviceConfigLocked(service string) *ServiceConfig {
+	s, ok := config.Services[service]
+
+	// Fall back to the first service block with a matching pattern
+	if !ok {
+		if block := config.routingLocked().serviceBlock(service, config.servicePatterns); block != "" {
+			s, ok = config.Services[block]
+			s.Name = service
+		}
+	}
+
+	meta, hasMeta := config.serviceMeta[service]
+	if !ok && !hasMeta {
 		return nil
 	}
+
+	// Services configured only through their meta start from the global defaults
+	if !ok {
+		s = ServiceConfig{
+			Name:             service,
+			ChangeThreshold:  config.ChangeThreshold,
+			ReminderInterval: config.ReminderInterval,
+		}
+	}
+	if hasMeta {
+		s = applyServiceMeta(s, meta)
+		s.Handlers = config.expandHandlerGroups(s.Handlers)
+	}
+
+	return &s
+}
+
+// Returns the handler with the given ID
+func (c *Config) handler(id string) (AlertHandler, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	handler, ok := c.Handlers[id]
+	return handler, ok
+}
+
+// Returns a copy of the configured handlers, keyed by ID
+func (c *Config) handlerMap() map[string]AlertHandler {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	handlers := make(map[string]AlertHandler)
+	for id, handler := range c.Handlers {
+		handlers[id] = handler
+	}
+	return handlers
 }
 
 // Loads the configured alert handlers for a given service, filtering if applicable
 func (c *Config) serviceHandlers(service string) []AlertHandler {
 	handlers := make([]AlertHandler, 0)
+	for _, id := range c.serviceHandlerIDs(service) {
+		if handler, ok := c.handler(id); ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
+
+// Returns the sorted IDs of the alert handlers for a given service, filtering if applicable
+func (c *Config) serviceHandlerIDs(service string) []string {
+	return c.serviceTierHandlerIDs(service, "")
+}
+
+// Returns the sorted IDs of the alert handlers for an alert on a given service routed through
+// the given tier. The tier's handlers take the place of the default handlers for services
+// that don't list their own. The returned list is shared, so it must not be modified.
+func (c *Config) serviceTierHandlerIDs(service string, tier string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	// Services configured through their meta can change at any time, so aren't in the table
+	if _, hasMeta := c.serviceMeta[service]; hasMeta {
+		return c.filterHandlerIDsLocked(c.serviceHandlerFiltersLocked(c.serviceConfigLocked(service), tier))
+	}
+	routing := c.routingLocked()
+	return routing.serviceHandlerIDs(routing.serviceBlock(service, c.servicePatterns), tier)
+}
+
+// Returns the handler IDs listed for a service (including its team's), falling back to the
+// tier's handlers and then the default handlers. Assumes the config lock is held.
+func (c *Config) serviceHandlerFiltersLocked(serviceConfig *ServiceConfig, tier string) []string {
 	filters := make([]string, 0)
-	serviceConfig := c.serviceConfig(service)
 	if serviceConfig != nil {
 		filters = serviceConfig.Handlers
+		if team, ok := c.Teams[serviceConfig.Team]; ok {
+			filters = append(append([]string{}, filters...), team.handlerIDs...)
+		}
+	}
+	if len(filters) == 0 {
+		filters = c.Tiers[tier].Handlers
 	}
 	if len(filters) == 0 {
 		filters = c.DefaultHandlers
 	}
-	for name, handler := range c.Handlers {
-		if len(filters) == 0 || contains(filters, name) {
-			handlers = append(handlers, handler)
+	return filters
+}
+
+// Returns the sorted IDs of the configured handlers in filters, or every handler except the
+// teams' if there are no filters. Assumes the config lock is held.
+func (c *Config) filterHandlerIDsLocked(filters []string) []string {
+	// Team handlers are only used by the team's services, not as a default
+	teamHandlers := make(map[string]bool)
+	for _, team := range c.Teams {
+		for _, id := range team.handlerIDs {
+			teamHandlers[id] = true
 		}
 	}
-	return handlers
+
+	ids := make([]string, 0)
+	for name, _ := range c.Handlers {
+		if (len(filters) == 0 && !teamHandlers[name]) || contains(filters, name) {
+			ids = append(ids, name)
+		}
+	}
+	sort.Strings(ids)
+	return ids
 }
 
 // Compute the changeThreshold for alerts on a service, defaulting to the global threshold
 // if no config for the service is specified
 func (c *Config) serviceChangeThreshold(service string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	changeThreshold := c.ChangeThreshold
 
 	// Override the global changeThreshold config if we have a service-specific one
-	if c.serviceConfig(service) != nil {
-		changeThreshold = c.serviceConfig(service).ChangeThreshold
+	if serviceConfig := c.serviceConfigLocked(service); serviceConfig != nil {
+		changeThreshold = serviceConfig.ChangeThreshold
 	}
 
 	return changeThreshold
 }
+
+// Returns how to alert on a newly discovered service (or node, for an empty service name)
+// that's already failing
+func (c *Config) serviceNewEntityAlerts(service string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if serviceConfig := c.serviceConfigLocked(service); serviceConfig != nil && serviceConfig.NewEntityAlerts != "" {
+		return serviceConfig.NewEntityAlerts
+	}
+
+	return c.NewEntityAlerts
+}
+
+// Returns how often to send reminders for a service's alerts while they stay failing,
+// defaulting to the global reminder interval. Returns 0 if reminders are disabled.
+func (c *Config) serviceReminderInterval(service string) time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	reminderInterval := c.ReminderInterval
+	if serviceConfig := c.serviceConfigLocked(service); serviceConfig != nil {
+		reminderInterval = serviceConfig.ReminderInterval
+	}
+
+	return time.Duration(reminderInterval) * time.Second
+}
+
+// Returns the output patterns to ignore for a service's checks (including the global ones),
+// along with the status to reclassify matching checks as
+func (c *Config) serviceOutputPatterns(service string) ([]*regexp.Regexp, string) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	patterns := c.outputPatterns
+	if serviceConfig := c.serviceConfigLocked(service); serviceConfig != nil && len(serviceConfig.outputPatterns) > 0 {
+		patterns = append(append([]*regexp.Regexp{}, patterns...), serviceConfig.outputPatterns...)
+	}
+
+	return patterns, c.OutputPatternStatus
+}
+
+// Returns the status to treat checks with an unrecognized status as
+func (c *Config) unknownStatus() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.UnknownStatus == "" {
+		return api.HealthWarning
+	}
+	return c.UnknownStatus
+}
+
+// Compiles a list of regular expressions, returning nil if there are none
+func compilePatterns(raw []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, pattern := range raw {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, compiled)
+	}
+	return patterns, nil
+}
+
+// Returns how long a service's checks can go without an update before they're considered
+// stale, or 0 if staleness isn't tracked for the service
+func (c *Config) serviceMaxStaleness(service string) time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if serviceConfig := c.serviceConfigLocked(service); serviceConfig != nil {
+		return time.Duration(serviceConfig.MaxStaleness) * time.Second
+	}
+
+	return 0
+}
+
+// Returns the diff strategy for a watch: the service's own, if it's a service watch that sets
+// one, otherwise the global one
+func (c *Config) diffStrategy(mode string, service string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if serviceConfig := c.serviceConfigLocked(service); mode == ServiceWatch && serviceConfig != nil && serviceConfig.DiffStrategy != "" {
+		return serviceConfig.DiffStrategy
+	}
+	return c.DiffStrategy
+}
+
+// Returns the differ to use for a watch, combining the global diff settings with the
+// service's own (for service watches)
+func (c *Config) checkDiffer(mode string, service string) CheckDiffer {
+	strategy := c.diffStrategy(mode, service)
+
+	c.lock.RLock()
+	ignoreChecks := c.IgnoreChecks
+	if serviceConfig := c.serviceConfigLocked(service); mode == ServiceWatch && serviceConfig != nil {
+		if len(serviceConfig.IgnoreChecks) > 0 {
+			ignoreChecks = append(append([]string{}, ignoreChecks...), serviceConfig.IgnoreChecks...)
+		}
+	}
+	c.lock.RUnlock()
+
+	differ, err := newCheckDiffer(mode, strategy, ignoreChecks)
+	if err != nil {
+		// The strategies are validated when parsing the config, so this shouldn't happen
+		log.Errorf("Error creating check differ, falling back to %s: %s", DiffAll, err)
+		differ, _ = newCheckDiffer(mode, DiffAll, ignoreChecks)
+	}
+
+	return differ
+}
@@ -79,6 +79,28 @@ func TestConfig_parseValues(t *testing.T) {
 		ChangeThreshold:  30,
 		DefaultHandlers:  []string{"stdout.warn", "email.admin"},
 		LogLevel:         "warn",
+		WatchBackend:     "blocking",
+
+		ThrottleRTT:       1000,
+		ThrottleErrorRate: 0.25,
+
+		OutputPatternStatus:    "passing",
+		UnknownStatus:          "warning",
+		DiffStrategy:           "all",
+		NewEntityAlerts:        "threshold",
+		StartupSyncBatchSize:   100,
+		RemovalThreshold:       1,
+		NomadCanaryTags:        []string{"canary"},
+		AggregatorHistorySize:  1000,
+		AggregatorReplayWindow: 300,
+		HistorySize:            100,
+		ShadowKVPrefix:         "service/consul-alerting-shadow",
+		EntityMetricsLimit:     1000,
+		ReachabilityPort:       8301,
+		ReachabilityTimeout:    2,
+		AckLinkTTL:             3600,
+		AckLinkSilence:         3600,
+
 		Services: map[string]ServiceConfig{
 			"redis": ServiceConfig{
 				Name:            "redis",
@@ -111,6 +133,13 @@ func TestConfig_parseValues(t *testing.T) {
 				MaxRetries:  5,
 			},
 		},
+		Teams:         map[string]TeamConfig{},
+		HandlerGroups: map[string]HandlerGroupConfig{},
+		HTTPWatches:   map[string]HTTPWatchConfig{},
+		Composites:    map[string]CompositeConfig{},
+		WatchHooks:    map[string]WatchHookConfig{},
+		NodeRoutes:    map[string]NodeRouteConfig{},
+		Tiers:         map[string]TierConfig{},
 	}
 
 	if !reflect.DeepEqual(config, expected) {
@@ -168,3 +197,357 @@ func TestConfig_serviceHandlers(t *testing.T) {
 		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", config.Handlers["stdout.warn"], config)
 	}
 }
+
+func TestConfig_statuspageHandler(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "statuspage" "public" {
+		api_key = "key"
+		page_id = "page1"
+		open_incidents = true
+		components {
+			redis = "comp1"
+			webapp = "comp2"
+		}
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := StatuspageHandler{
+		APIKey:         "key",
+		PageID:         "page1",
+		Components:     map[string]string{"redis": "comp1", "webapp": "comp2"},
+		WarningStatus:  "degraded_performance",
+		CriticalStatus: "major_outage",
+		OpenIncidents:  true,
+		BaseURL:        "https://api.statuspage.io/v1",
+		MaxRetries:     5,
+	}
+
+	if !reflect.DeepEqual(config.Handlers["statuspage.public"], expected) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expected, config.Handlers["statuspage.public"])
+	}
+}
+
+func TestConfig_consulEventHandler(t *testing.T) {
+	config, err := ParseConfig(`
+	consul_address = "https://consul.example.com:8501"
+	consul_token = "token"
+	handler "consul_event" "watchers" {
+		service_filter = "deployer"
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ConsulEventHandler{
+		Name:          "consul-alerting",
+		Address:       "https://consul.example.com:8501",
+		Token:         "token",
+		ServiceFilter: "deployer",
+		MaxEventSize:  512,
+		MaxRetries:    5,
+	}
+
+	if !reflect.DeepEqual(config.Handlers["consul_event.watchers"], expected) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expected, config.Handlers["consul_event.watchers"])
+	}
+}
+
+func TestConfig_pluginHandler(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "plugin" "mine" {
+		command = "./my-handler"
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := PluginHandler{
+		Command: "./my-handler",
+		Timeout: 30,
+	}
+
+	if !reflect.DeepEqual(config.Handlers["plugin.mine"], expected) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expected, config.Handlers["plugin.mine"])
+	}
+
+	if _, err := ParseConfig(`handler "plugin" "mine" {}`); err == nil || !strings.Contains(err.Error(), "command must be set") {
+		t.Errorf("expected an error for a missing command, got %v", err)
+	}
+}
+
+func TestConfig_outputPatterns(t *testing.T) {
+	config, err := ParseConfig(`
+	ignore_output_patterns = ["^timeout"]
+
+	service "redis" {
+		ignore_output_patterns = ["connection reset by peer"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, status := config.serviceOutputPatterns("redis")
+	if len(patterns) != 2 || status != "passing" {
+		t.Fatalf("expected 2 patterns with status passing, got %d (%s)", len(patterns), status)
+	}
+
+	patterns, _ = config.serviceOutputPatterns("webapp")
+	if len(patterns) != 1 {
+		t.Fatalf("expected only the global pattern, got %d", len(patterns))
+	}
+
+	_, err = ParseConfig(`ignore_output_patterns = ["(unclosed"]`)
+	if err == nil || !strings.Contains(err.Error(), "Invalid ignore_output_patterns") {
+		t.Fatalf("expected invalid pattern error, got %v", err)
+	}
+}
+
+func TestConfig_teams(t *testing.T) {
+	config, err := ParseConfig(`
+	service "payments-api" {
+		team = "payments"
+		handlers = ["stdout.log"]
+	}
+
+	team "payments" {
+		slack = "#payments-alerts"
+		email = ["payments@example.com"]
+		pagerduty_key = "abcd"
+	}
+
+	handler "stdout" "log" {}
+
+	handler "slack" "ops" {
+		api_token = "token"
+		channel_name = "ops"
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"email.team_payments", "pagerduty.team_payments", "slack.team_payments", "stdout.log"}
+	if ids := config.serviceHandlerIDs("payments-api"); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected handlers %v, got %v", expected, ids)
+	}
+
+	expectedSlack := SlackHandler{
+		Token:       "token",
+		ChannelName: "#payments-alerts",
+		MaxRetries:  5,
+	}
+	if !reflect.DeepEqual(config.Handlers["slack.team_payments"], expectedSlack) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expectedSlack, config.Handlers["slack.team_payments"])
+	}
+
+	// Team handlers shouldn't be used for services without a team
+	expected = []string{"slack.ops", "stdout.log"}
+	if ids := config.serviceHandlerIDs("webapp"); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected handlers %v, got %v", expected, ids)
+	}
+
+	_, err = ParseConfig(`
+	service "webapp" {
+		team = "missing"
+	}
+	`)
+	if err == nil || err.Error() != "Unknown team for service webapp: missing" {
+		t.Fatalf("expected unknown team error, got %v", err)
+	}
+
+	// A team's generated handlers can't replace configured ones
+	_, err = ParseConfig(`
+	team "payments" {
+		email = ["payments@example.com"]
+	}
+
+	handler "email" "team_payments" {
+		recipients = ["oncall@example.com"]
+	}
+	`)
+	expectedErr := "Handler email.team_payments for team payments conflicts with a configured handler of the same name"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected handler conflict error, got %v", err)
+	}
+
+	// Slack handlers posting to an incoming webhook have no token for teams to use
+	_, err = ParseConfig(`
+	team "payments" {
+		slack = "#payments-alerts"
+	}
+
+	handler "slack" "ops" {
+		webhook_url = "https://hooks.slack.com/services/T000/B000/XXXX"
+	}
+	`)
+	if err == nil || err.Error() != "No slack_token for team payments, and no slack handler to take one from" {
+		t.Fatalf("expected missing token error, got %v", err)
+	}
+}
+
+func TestConfig_watchBackend(t *testing.T) {
+	config, err := ParseConfig(`watch_backend = "health_service"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.WatchBackend != BackendHealthService {
+		t.Errorf("expected health_service backend, got %s", config.WatchBackend)
+	}
+
+	_, err = ParseConfig(`watch_backend = "grpc"`)
+	if err == nil || err.Error() != "Invalid value for watch_backend: grpc" {
+		t.Errorf("expected invalid watch_backend error, got %v", err)
+	}
+}
+
+func TestConfig_statusTLS(t *testing.T) {
+	cases := map[string]string{
+		`status_tls_cert = "/etc/cert.pem"`:    "status_tls_cert and status_tls_key must be set together",
+		`status_tls_client_ca = "/etc/ca.pem"`: "status_tls_client_ca requires status_tls_cert and status_tls_key",
+		`status_username = "admin"`:            "status_password must be set when status_username is",
+	}
+
+	for configString, expected := range cases {
+		_, err := ParseConfig(configString)
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestConfig_servicePatterns(t *testing.T) {
+	config, err := ParseConfig(`
+	service "api-*" {
+		change_threshold = 10
+	}
+
+	service "api-internal-*" {
+		change_threshold = 20
+	}
+
+	service "/^api-v[0-9]+$/" {
+		change_threshold = 30
+	}
+
+	service "api-internal-billing" {
+		change_threshold = 40
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]int{
+		"api-web":              10,
+		"api-internal-auth":    20,
+		"api-v2":               10,
+		"api-internal-billing": 40,
+		"redis":                60,
+	}
+	for service, expected := range cases {
+		if actual := config.serviceChangeThreshold(service); actual != expected {
+			t.Errorf("expected change threshold %d for %s, got %d", expected, service, actual)
+		}
+	}
+
+	if service := config.serviceConfig("api-web"); service == nil || service.Name != "api-web" {
+		t.Errorf("expected config for api-web, got %#v", service)
+	}
+	if service := config.serviceConfig("redis"); service != nil {
+		t.Errorf("expected no config for redis, got %#v", service)
+	}
+
+	// Regular expressions are used when no glob matches
+	regexConfig, err := ParseConfig(`
+	service "/^db-[0-9]+$/" {
+		change_threshold = 5
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threshold := regexConfig.serviceChangeThreshold("db-12"); threshold != 5 {
+		t.Errorf("expected change threshold 5, got %d", threshold)
+	}
+
+	if _, err := ParseConfig(`service "/[/" {}`); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestConfig_tagSet(t *testing.T) {
+	config, err := ParseConfig(`
+	service "db" {
+		tag_set = ["prod", "primary"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := config.serviceConfig("db")
+	if service == nil || service.tagSetName() != "prod,primary" {
+		t.Fatalf("unexpected tag set: %#v", service)
+	}
+
+	opts := &WatchOptions{service: "db", tag: service.tagSetName(), tagSet: service.TagSet}
+	if id := watchID(opts); id != "service:db:prod,primary" {
+		t.Errorf("unexpected watch ID: %s", id)
+	}
+	if !containsAll([]string{"primary", "v2", "prod"}, opts.tags()) {
+		t.Error("expected an instance with all of the tags to match")
+	}
+	if containsAll([]string{"prod", "replica"}, opts.tags()) {
+		t.Error("expected an instance missing a tag not to match")
+	}
+
+	cases := []string{
+		`service "db" { tag_set = ["prod", "prod"] }`,
+		`service "db" { tag_set = ["prod", ""] }`,
+		`service "db" {
+			tag_set = ["prod", "primary"]
+			distinct_tags = true
+		}`,
+	}
+	for _, raw := range cases {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+func TestConfig_agentless(t *testing.T) {
+	config, err := ParseConfig(`
+	agentless = true
+	consul_address = "consul-server.consul:8500"
+	datacenter = "dc1"
+	node_name = "alerter"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Agentless {
+		t.Error("expected agentless to be set")
+	}
+	if name := localNodeName(config, nil); name != "alerter" {
+		t.Errorf("expected configured node name, got %q", name)
+	}
+
+	cases := []string{
+		`agentless = true`,
+		`agentless = true
+		datacenter = "dc1"
+		dev_mode = true`,
+	}
+	for _, c := range cases {
+		if _, err := ParseConfig(c); err == nil {
+			t.Errorf("expected error for config: %s", c)
+		}
+	}
+}
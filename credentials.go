@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The prefix for keys in a handler's scoped credentials that pick out a single service rather
+// than a team
+const credentialServicePrefix = "service:"
+
+// Returns the team owning an alert: its HTTP watch's, composite's or node route's team if it's
+// for one, otherwise its service's. Returns an empty string if nothing owns it.
+func (c *Config) alertTeam(service string, alert *AlertState) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if name, ok := httpWatchName(alert); ok {
+		return c.HTTPWatches[name].Team
+	}
+	if name, ok := compositeName(alert); ok {
+		return c.Composites[name].Team
+	}
+	if alert.Route != "" && alert.Service == "" {
+		return c.NodeRoutes[alert.Route].Team
+	}
+	if serviceConfig := c.serviceConfigLocked(service); serviceConfig != nil {
+		return serviceConfig.Team
+	}
+	return ""
+}
+
+// Returns the alert with its owning team set, so handlers can pick the credentials to send it
+// with. The alert itself is returned if its team is already set.
+func (c *Config) withAlertTeam(service string, alert *AlertState) *AlertState {
+	team := c.alertTeam(service, alert)
+	if team == alert.Team {
+		return alert
+	}
+
+	withTeam := *alert
+	withTeam.Team = team
+	return &withTeam
+}
+
+// Returns the credential from a handler's scoped credentials for an alert: the one for its
+// service (keyed service:<name>) if there is one, then the one for its team, falling back to
+// the handler's unscoped credential. Returns an empty string if nothing matches and there's
+// no fallback, so an alert is never sent with credentials meant for someone else.
+func scopedCredential(credentials map[string]string, alert *AlertState, fallback string) string {
+	if credential, ok := credentials[credentialServicePrefix+alert.Service]; ok && alert.Service != "" {
+		return credential
+	}
+	if credential, ok := credentials[alert.Team]; ok && alert.Team != "" {
+		return credential
+	}
+	return fallback
+}
+
+// Checks that a handler's scoped credentials are keyed by known teams or services, and aren't
+// empty
+func (c *Config) validateScopedCredentials(id string, setting string, credentials map[string]string) error {
+	keys := make([]string, 0, len(credentials))
+	for key, _ := range credentials {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if credentials[key] == "" {
+			return fmt.Errorf("Empty %s entry for %s in handler %s", setting, key, id)
+		}
+		if strings.HasPrefix(key, credentialServicePrefix) {
+			if key == credentialServicePrefix {
+				return fmt.Errorf("Missing service name in %s for handler %s", setting, id)
+			}
+			continue
+		}
+		if _, ok := c.Teams[key]; !ok {
+			return fmt.Errorf("Unknown team in %s for handler %s: %s", setting, id, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The states of a delivery record
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+)
+
+// IdempotentHandler is implemented by handlers whose destination deduplicates repeated
+// deliveries of the same alert (such as by its incident key or labels), so a delivery that was
+// interrupted by a crash can safely be sent again.
+type IdempotentHandler interface {
+	Idempotent() bool
+}
+
+// The record of an alert transition's delivery to a handler, stored in the KV store under the
+// delivery section of the KV root
+type deliveryRecord struct {
+	ID      string `json:"id"`
+	State   string `json:"state"`
+	Updated int64  `json:"updated"`
+}
+
+// Tracks the deliveries of an alert transition to each handler in the KV store. A delivery is
+// claimed before the alert is sent and marked delivered afterwards, so if the process crashes
+// before the alert state is updated, the next leader doesn't send the same transition again.
+type deliveryTracker struct {
+	client     *api.Client
+	prefix     string
+	transition string
+
+	// Set with delivery_intents, which promises at-least-once delivery, so interrupted
+	// deliveries are sent again to every handler
+	resend bool
+}
+
+// Returns the tracker for the transition an alert is being sent for. The transition is
+// identified by the alert, its previous and new status and when the status changed, which
+// stay the same when a new leader re-evaluates the alert after a crash. The alert is stored at
+// kvPath.
+func newDeliveryTracker(client *api.Client, config *Config, kvPath string, alert *AlertState) *deliveryTracker {
+	return &deliveryTracker{
+		client:     client,
+		prefix:     alertRecordPath(config.stateKVRoot(), "delivery", kvPath),
+		transition: fmt.Sprintf("%s/%s/%s/%d", alertFingerprint(alert), alert.LastAlerted, alert.Status, alert.Changed),
+		resend:     config.DeliveryIntents,
+	}
+}
+
+// Returns the delivery ID for the transition's delivery to a handler
+func (t *deliveryTracker) deliveryID(handlerID string) string {
+	sum := sha1.Sum([]byte(t.transition + "/" + handlerID))
+	return hex.EncodeToString(sum[:])[:20]
+}
+
+// Claims the delivery of the transition to a handler, returning its delivery ID and whether
+// the alert should be sent. Deliveries that were already made are skipped, and ones that were
+// claimed but never finished (by a process that crashed) are only sent again to idempotent
+// handlers, or to every handler with delivery_intents. If the KV store can't be reached the
+// alert is sent anyway, since paging twice is better than not paging at all.
+func (t *deliveryTracker) claim(handlerID string, handler AlertHandler) (string, bool) {
+	id := t.deliveryID(handlerID)
+	key := t.prefix + handlerID
+
+	pair, _, err := t.client.KV().Get(key, nil)
+	if err != nil {
+		log.Errorf("Error loading delivery record for %s: %s", handlerID, err)
+		return id, true
+	}
+
+	var modifyIndex uint64
+	if pair != nil {
+		modifyIndex = pair.ModifyIndex
+
+		var record deliveryRecord
+		if err := json.Unmarshal(pair.Value, &record); err == nil && record.ID == id {
+			if record.State == deliveryDelivered {
+				log.Infof("Not sending alert to %s again, delivery %s was already made", handlerID, id)
+				return id, false
+			}
+			if !t.resend && !isIdempotentHandler(handler) {
+				log.Warnf("Not sending alert to %s again, delivery %s was interrupted and the handler isn't idempotent", handlerID, id)
+				return id, false
+			}
+			log.Infof("Resending interrupted delivery %s to %s", id, handlerID)
+			return id, true
+		}
+	}
+
+	// Only claim the delivery if nobody else has since the record was read
+	ok, err := t.put(&api.KVPair{Key: key, ModifyIndex: modifyIndex}, id, deliveryPending)
+	if err != nil {
+		log.Errorf("Error storing delivery record for %s: %s", handlerID, err)
+		return id, true
+	}
+	if !ok {
+		log.Infof("Not sending alert to %s, delivery %s was claimed by another process", handlerID, id)
+	}
+	return id, ok
+}
+
+// Marks the delivery to a handler as made
+func (t *deliveryTracker) delivered(handlerID string, id string) {
+	if _, err := t.put(&api.KVPair{Key: t.prefix + handlerID}, id, deliveryDelivered); err != nil {
+		log.Errorf("Error storing delivery record for %s: %s", handlerID, err)
+	}
+}
+
+// Writes a delivery record, using a check-and-set if the pair has a modify index (or is new)
+func (t *deliveryTracker) put(pair *api.KVPair, id string, state string) (bool, error) {
+	value, err := json.Marshal(deliveryRecord{ID: id, State: state, Updated: time.Now().Unix()})
+	if err != nil {
+		return false, err
+	}
+	pair.Value = value
+
+	ok := true
+	if state == deliveryPending {
+		ok, _, err = t.client.KV().CAS(pair, nil)
+	} else {
+		_, err = t.client.KV().Put(pair, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+	atomic.AddUint64(&stateWrites, 1)
+	return ok, nil
+}
+
+// Returns true if the handler (underneath any middleware) is idempotent
+func isIdempotentHandler(handler AlertHandler) bool {
+	idempotent, ok := unwrapHandler(handler).(IdempotentHandler)
+	return ok && idempotent.Idempotent()
+}
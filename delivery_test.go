@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestDelivery_claim(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	kvPath := alertingKVRoot + "/service/redis/alert"
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, LastAlerted: api.HealthPassing, Changed: 100}
+	tracker := newDeliveryTracker(client, &Config{}, kvPath, alert)
+
+	plain := testHandler{make(chan *AlertState, 1)}
+	idempotent := AlertmanagerHandler{}
+
+	id, send := tracker.claim("test.plain", plain)
+	if !send {
+		t.Fatal("expected the first delivery to be sent")
+	}
+	if id != tracker.deliveryID("test.plain") {
+		t.Fatalf("unexpected delivery ID %s", id)
+	}
+
+	// A claimed delivery that never finished is only resent to idempotent handlers
+	if _, send := tracker.claim("test.plain", plain); send {
+		t.Fatal("expected an interrupted delivery not to be resent to a plain handler")
+	}
+	if _, send := tracker.claim("alertmanager.idem", idempotent); !send {
+		t.Fatal("expected the first delivery to an idempotent handler to be sent")
+	}
+	if _, send := tracker.claim("alertmanager.idem", idempotent); !send {
+		t.Fatal("expected an interrupted delivery to be resent to an idempotent handler")
+	}
+
+	// Finished deliveries are never resent
+	tracker.delivered("alertmanager.idem", tracker.deliveryID("alertmanager.idem"))
+	if _, send := tracker.claim("alertmanager.idem", idempotent); send {
+		t.Fatal("expected a finished delivery not to be resent")
+	}
+
+	// With delivery intents, interrupted deliveries are resent to every handler
+	resending := newDeliveryTracker(client, &Config{DeliveryIntents: true}, kvPath, alert)
+	if _, send := resending.claim("test.plain", plain); !send {
+		t.Fatal("expected an interrupted delivery to be resent to a plain handler with delivery intents")
+	}
+
+	// The next transition is a new delivery
+	recovery := &AlertState{Service: "redis", Status: api.HealthPassing, LastAlerted: api.HealthCritical, Changed: 200}
+	if _, send := newDeliveryTracker(client, &Config{}, kvPath, recovery).claim("test.plain", plain); !send {
+		t.Fatal("expected the next transition to be sent")
+	}
+}
+
+func TestDelivery_deliveryID(t *testing.T) {
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, LastAlerted: api.HealthPassing, Changed: 100}
+	tracker := newDeliveryTracker(nil, &Config{}, alertingKVRoot+"/service/redis/alert", alert)
+
+	if tracker.prefix != alertingKVRoot+"/delivery/service/redis/" {
+		t.Errorf("unexpected prefix %s", tracker.prefix)
+	}
+
+	// Re-evaluating the same transition (such as on a new leader) gives the same IDs
+	again := *alert
+	again.UpdateIndex = 5
+	if id := newDeliveryTracker(nil, &Config{}, "", &again).deliveryID("slack.ops"); id != tracker.deliveryID("slack.ops") {
+		t.Errorf("expected the same delivery ID for the same transition, got %s and %s", id, tracker.deliveryID("slack.ops"))
+	}
+	if tracker.deliveryID("slack.ops") == tracker.deliveryID("email.ops") {
+		t.Error("expected different delivery IDs for different handlers")
+	}
+
+	later := *alert
+	later.Changed = 300
+	if newDeliveryTracker(nil, &Config{}, "", &later).deliveryID("slack.ops") == tracker.deliveryID("slack.ops") {
+		t.Error("expected different delivery IDs for different transitions")
+	}
+}
+
+func TestDelivery_idempotentHandler(t *testing.T) {
+	if !isIdempotentHandler(PagerdutyHandler{}) {
+		t.Error("expected pagerduty handlers to be idempotent")
+	}
+	if !isIdempotentHandler(newMiddlewareHandler(AlertaHandler{}, nil)) {
+		t.Error("expected alerta handlers to be idempotent underneath middleware")
+	}
+	if !isIdempotentHandler(StatuspageHandler{}) || isIdempotentHandler(StatuspageHandler{OpenIncidents: true}) {
+		t.Error("expected statuspage handlers to only be idempotent without open_incidents")
+	}
+	if !isIdempotentHandler(CachetHandler{}) || isIdempotentHandler(CachetHandler{OpenIncidents: true}) {
+		t.Error("expected cachet handlers to only be idempotent without open_incidents")
+	}
+	if isIdempotentHandler(testHandler{}) {
+		t.Error("expected test handlers not to be idempotent")
+	}
+}
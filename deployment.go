@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Watches the deployment_prefix in the KV store for services being deployed. A key under the
+// prefix named after a service opens a deployment window for it, which lasts until the key is
+// removed (such as by the expiry of a session with a TTL holding it) or, if the key's value is
+// an RFC 3339 timestamp, until that time.
+func watchDeployments(config *Config, client *api.Client) {
+	queryOpts := &api.QueryOptions{
+		AllowStale: true,
+		WaitTime:   watchWaitTime,
+	}
+
+	log.Infof("Watching %s for deployment windows", config.DeploymentPrefix)
+
+	for {
+		kvPairs, queryMeta, err := client.KV().List(config.DeploymentPrefix, queryOpts)
+		if err != nil {
+			log.Errorf("Error watching deployment windows: %s, retrying in 10s...", err)
+			time.Sleep(errorWaitTime)
+			continue
+		}
+
+		// Skip the update if the blocking query just timed out
+		if queryMeta.LastIndex == queryOpts.WaitIndex {
+			continue
+		}
+		queryOpts.WaitIndex = queryMeta.LastIndex
+
+		config.setDeployments(parseDeployments(config.DeploymentPrefix, kvPairs))
+	}
+}
+
+// Returns the end of the deployment window for each service with a key under the prefix.
+// Windows without an end time are given the zero time.
+func parseDeployments(prefix string, kvPairs api.KVPairs) map[string]time.Time {
+	deployments := make(map[string]time.Time)
+	for _, kvPair := range kvPairs {
+		service := strings.TrimPrefix(kvPair.Key, prefix)
+		if service == "" || strings.Contains(service, "/") {
+			continue
+		}
+
+		var until time.Time
+		if value := strings.TrimSpace(string(kvPair.Value)); value != "" {
+			if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+				until = parsed
+			}
+		}
+		deployments[service] = until
+	}
+	return deployments
+}
+
+// Replaces the set of open deployment windows
+func (c *Config) setDeployments(deployments map[string]time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for service, _ := range deployments {
+		if _, ok := c.deployments[service]; !ok {
+			log.Infof("Deployment window opened for service %s", service)
+		}
+	}
+	for service, _ := range c.deployments {
+		if _, ok := deployments[service]; !ok {
+			log.Infof("Deployment window closed for service %s", service)
+		}
+	}
+	c.deployments = deployments
+}
+
+// Returns true if the given service has an open deployment window
+func (c *Config) serviceDeploying(service string, now time.Time) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	until, ok := c.deployments[service]
+	return ok && (until.IsZero() || now.Before(until))
+}
+
+// Downgrades a failing alert for a service with an open deployment window to informational,
+// returning the notification to send and whether it was downgraded
+func applyDeploymentWindow(alert *AlertState, config *Config, now time.Time) (*AlertState, bool) {
+	if alert.Service == "" || alert.Status == api.HealthPassing || !config.serviceDeploying(alert.Service, now) {
+		return alert, false
+	}
+
+	notification := *alert
+	notification.Status = InfoStatus
+	notification.Message = alert.Message + " (during deployment)"
+	return &notification, true
+}
+
+// Re-sends a downgraded alert at its full severity once the service's deployment window has
+// closed, if the service is still failing
+func rearmAlert(kvPath string, name string, watchOpts *WatchOptions) {
+	watchOpts.alertLock.Lock()
+	defer watchOpts.alertLock.Unlock()
+
+	alert, err := getAlertState(kvPath, watchOpts.client)
+	if err != nil {
+		log.Error("Error fetching alert state: ", err)
+		return
+	}
+	if alert == nil || !alert.Downgraded {
+		return
+	}
+
+	alert.Downgraded = false
+	if alert.LastAlerted != api.HealthPassing && alert.Status == alert.LastAlerted {
+		rearmed := *alert
+		rearmed.Message = fmt.Sprintf("[%s] %s is still %s after deployment", watchOpts.config.ConsulDatacenter, name, alert.Status)
+		notify, notification := applySnooze(&rearmed, watchOpts.client)
+		if notify {
+			notify, notification = spendNotification(alert, notification, watchOpts.config.MaxNotifications)
+			if !notify {
+				watchOpts.config.logEvent(EventCapped, alert)
+			}
+		}
+		if notify {
+			dispatchAlert(watchOpts.config, watchOpts.service, notification)
+			watchOpts.config.logEvent(EventSent, notification)
+		}
+	}
+
+	if err := setAlertState(kvPath, alert, watchOpts.client); err != nil {
+		log.Error("Error setting alert state: ", err)
+	}
+}
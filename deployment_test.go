@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestDeployment_window(t *testing.T) {
+	now := time.Now()
+	deployments := parseDeployments("deployments/", api.KVPairs{
+		&api.KVPair{Key: "deployments/webapp"},
+		&api.KVPair{Key: "deployments/redis", Value: []byte(now.Add(-time.Minute).Format(time.RFC3339))},
+		&api.KVPair{Key: "deployments/api", Value: []byte(now.Add(time.Hour).Format(time.RFC3339))},
+		&api.KVPair{Key: "deployments/nested/key"},
+	})
+	if len(deployments) != 3 {
+		t.Fatalf("expected 3 deployment windows, got %v", deployments)
+	}
+
+	config := &Config{}
+	config.setDeployments(deployments)
+
+	cases := map[string]bool{
+		"webapp": true,
+		"api":    true,
+		"redis":  false,
+		"nginx":  false,
+	}
+	for service, expected := range cases {
+		if actual := config.serviceDeploying(service, now); actual != expected {
+			t.Errorf("expected deploying=%v for %s, got %v", expected, service, actual)
+		}
+	}
+
+	alert := &AlertState{Service: "webapp", Status: api.HealthCritical, Message: "webapp is now critical"}
+	notification, downgraded := applyDeploymentWindow(alert, config, now)
+	if !downgraded || notification.Status != InfoStatus || notification.Message != "webapp is now critical (during deployment)" {
+		t.Errorf("expected alert to be downgraded, got %#v", notification)
+	}
+	if alert.Status != api.HealthCritical {
+		t.Error("expected the original alert to be left alone")
+	}
+
+	// Recoveries and alerts for services that aren't deploying are sent as-is
+	for _, alert := range []*AlertState{
+		&AlertState{Service: "webapp", Status: api.HealthPassing},
+		&AlertState{Service: "redis", Status: api.HealthCritical},
+	} {
+		if notification, downgraded := applyDeploymentWindow(alert, config, now); downgraded || notification != alert {
+			t.Errorf("expected alert to be unchanged, got %#v", notification)
+		}
+	}
+}
+
+// Make sure alerts downgraded during a deployment window don't page anyone
+func TestDeployment_pagerduty(t *testing.T) {
+	transport := &recordingTransport{}
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	config := &Config{}
+	config.setDeployments(map[string]time.Time{"webapp": time.Time{}})
+
+	alert := &AlertState{Service: "webapp", Status: api.HealthCritical, Message: "webapp is now critical"}
+	notification, _ := applyDeploymentWindow(alert, config, time.Now())
+
+	// Neither the Events API v1 nor v2 should be sent anything
+	for _, handler := range []PagerdutyHandler{
+		PagerdutyHandler{ServiceKey: "test"},
+		PagerdutyHandler{ServiceKey: "test", Severities: map[string]string{api.HealthCritical: "critical"}},
+	} {
+		if err := handler.Alert("dc1", notification); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(transport.requests) != 0 {
+		t.Errorf("expected no PagerDuty events during a deployment window, got %d", len(transport.requests))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// The strategies for deciding which checks count as updates
+const (
+	// Every check whose status differs from its last known status is an update, including
+	// newly registered checks
+	DiffAll = "all"
+
+	// Newly registered checks aren't counted as updates until they've passed once, so a
+	// check that starts out critical doesn't alert before it's had a chance to run
+	DiffIgnoreNew = "ignore_new"
+
+	// A status change isn't counted until a later query result shows the check hasn't been
+	// modified since (by its ModifyIndex), so a check that flaps and recovers between two
+	// results doesn't alert
+	DiffModifyIndex = "modify_index"
+)
+
+var diffStrategies = []string{DiffAll, DiffIgnoreNew, DiffModifyIndex}
+
+// CheckDiffer compares a watch's latest health checks against their last known statuses,
+// returning the checks that should be counted as updates keyed by check hash. The result
+// is nil if nothing changed.
+type CheckDiffer interface {
+	diff(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate
+}
+
+// Adapts one of the plain diff functions to the CheckDiffer interface
+type diffFunc func(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate
+
+func (f diffFunc) diff(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate {
+	return f(checks, lastStatus, opts)
+}
+
+// Drops updates for checks that haven't been seen before unless they're passing
+type ignoreNewDiffer struct {
+	differ CheckDiffer
+}
+
+func (d ignoreNewDiffer) diff(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate {
+	updates := d.differ.diff(checks, lastStatus, opts)
+	for checkHash, update := range updates {
+		if _, ok := lastStatus[checkHash]; !ok && update.Status != api.HealthPassing {
+			delete(updates, checkHash)
+		}
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return updates
+}
+
+// Holds back each update until the check is seen again at the same ModifyIndex, using the
+// indexes the watch fetched its checks with. Checks without a known index are counted right away.
+type modifyIndexDiffer struct {
+	differ CheckDiffer
+}
+
+func (d modifyIndexDiffer) diff(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate {
+	updates := d.differ.diff(checks, lastStatus, opts)
+
+	// Changes that were waiting to be confirmed and are gone went back to their last status
+	for checkHash := range opts.pendingIndexes {
+		if _, ok := updates[checkHash]; !ok {
+			delete(opts.pendingIndexes, checkHash)
+		}
+	}
+
+	for checkHash := range updates {
+		index, ok := opts.checkIndexes[checkHash]
+		if !ok {
+			continue
+		}
+		if pending, ok := opts.pendingIndexes[checkHash]; ok && pending == index {
+			delete(opts.pendingIndexes, checkHash)
+			continue
+		}
+
+		if opts.pendingIndexes == nil {
+			opts.pendingIndexes = make(map[string]uint64)
+		}
+		opts.pendingIndexes[checkHash] = index
+		delete(updates, checkHash)
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return updates
+}
+
+// Leaves out the checks with the given IDs before diffing
+type ignoreChecksDiffer struct {
+	checkIDs map[string]bool
+	differ   CheckDiffer
+}
+
+func (d ignoreChecksDiffer) diff(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate {
+	// Only copy the list if there's something to leave out
+	for i, check := range checks {
+		if !d.checkIDs[check.CheckID] {
+			continue
+		}
+
+		filtered := append(make([]*api.HealthCheck, 0, len(checks)), checks[:i]...)
+		for _, check := range checks[i+1:] {
+			if !d.checkIDs[check.CheckID] {
+				filtered = append(filtered, check)
+			}
+		}
+		checks = filtered
+		break
+	}
+
+	return d.differ.diff(checks, lastStatus, opts)
+}
+
+// Returns the differ to use for a watch in the given mode, using the given strategy and
+// leaving out the given check IDs
+func newCheckDiffer(mode string, strategy string, ignoreChecks []string) (CheckDiffer, error) {
+	var differ CheckDiffer = diffFunc(diffNodeChecks)
+	if mode == ServiceWatch {
+		differ = diffFunc(diffServiceChecks)
+	}
+
+	switch strategy {
+	case DiffAll, "":
+	case DiffIgnoreNew:
+		differ = ignoreNewDiffer{differ: differ}
+	case DiffModifyIndex:
+		differ = modifyIndexDiffer{differ: differ}
+	default:
+		return nil, fmt.Errorf("Invalid diff strategy: %s", strategy)
+	}
+
+	if len(ignoreChecks) > 0 {
+		checkIDs := make(map[string]bool)
+		for _, id := range ignoreChecks {
+			checkIDs[id] = true
+		}
+		differ = ignoreChecksDiffer{checkIDs: checkIDs, differ: differ}
+	}
+
+	return differ, nil
+}
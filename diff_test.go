@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestDiff_ignoreNew(t *testing.T) {
+	differ, err := newCheckDiffer(ServiceWatch, DiffIgnoreNew, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &WatchOptions{service: "redis"}
+	lastStatus := map[string]string{
+		"node1/redis": api.HealthPassing,
+	}
+	checks := []*api.HealthCheck{
+		&api.HealthCheck{Node: "node1", CheckID: "redis", Status: api.HealthCritical},
+		&api.HealthCheck{Node: "node2", CheckID: "redis", Status: api.HealthCritical},
+		&api.HealthCheck{Node: "node3", CheckID: "redis", Status: api.HealthPassing},
+	}
+
+	// The new critical check on node2 shouldn't count until it passes
+	updates := differ.diff(checks, lastStatus, opts)
+	if len(updates) != 2 {
+		t.Fatalf("expected 2 updates, got %d: %v", len(updates), updates)
+	}
+	if _, ok := updates["node2/redis"]; ok {
+		t.Error("expected new critical check to be ignored")
+	}
+
+	// Nothing counts if the only change is a new failing check
+	if updates := differ.diff(checks[1:2], lastStatus, opts); updates != nil {
+		t.Errorf("expected no updates, got %v", updates)
+	}
+}
+
+func TestDiff_modifyIndex(t *testing.T) {
+	differ, err := newCheckDiffer(ServiceWatch, DiffModifyIndex, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &WatchOptions{service: "redis"}
+	lastStatus := map[string]string{
+		"node1/redis": api.HealthPassing,
+		"node2/redis": api.HealthPassing,
+	}
+	critical := []*api.HealthCheck{
+		&api.HealthCheck{Node: "node1", CheckID: "redis", Status: api.HealthCritical},
+		&api.HealthCheck{Node: "node2", CheckID: "redis", Status: api.HealthCritical},
+	}
+
+	// The changes are held back until they're seen again unmodified
+	opts.checkIndexes = map[string]uint64{"node1/redis": 10, "node2/redis": 11}
+	if updates := differ.diff(critical, lastStatus, opts); updates != nil {
+		t.Fatalf("expected no updates yet, got %v", updates)
+	}
+
+	// node1 stayed critical, node2 was modified again before it could be confirmed
+	opts.checkIndexes = map[string]uint64{"node1/redis": 10, "node2/redis": 12}
+	updates := differ.diff(critical, lastStatus, opts)
+	if _, ok := updates["node1/redis"]; !ok || len(updates) != 1 {
+		t.Fatalf("expected only node1's change to be confirmed, got %v", updates)
+	}
+	lastStatus["node1/redis"] = api.HealthCritical
+
+	// node2 recovers before being confirmed, so it's never counted
+	recovered := []*api.HealthCheck{
+		critical[0],
+		&api.HealthCheck{Node: "node2", CheckID: "redis", Status: api.HealthPassing},
+	}
+	opts.checkIndexes = map[string]uint64{"node1/redis": 10, "node2/redis": 13}
+	if updates := differ.diff(recovered, lastStatus, opts); updates != nil {
+		t.Errorf("expected the flap to be ignored, got %v", updates)
+	}
+	if len(opts.pendingIndexes) != 0 {
+		t.Errorf("expected no pending changes, got %v", opts.pendingIndexes)
+	}
+
+	// Checks without a known index are counted right away
+	opts.checkIndexes = nil
+	if updates := differ.diff(critical, lastStatus, opts); len(updates) != 1 {
+		t.Errorf("expected node2's change to count, got %v", updates)
+	}
+}
+
+func TestDiff_ignoreChecks(t *testing.T) {
+	differ, err := newCheckDiffer(NodeWatch, DiffAll, []string{"noisy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &WatchOptions{node: "node1"}
+	lastStatus := map[string]string{
+		"node1/noisy":      api.HealthPassing,
+		"node1/serfHealth": api.HealthPassing,
+	}
+	checks := []*api.HealthCheck{
+		&api.HealthCheck{Node: "node1", CheckID: "noisy", Status: api.HealthCritical},
+		&api.HealthCheck{Node: "node1", CheckID: "serfHealth", Status: api.HealthCritical},
+	}
+
+	updates := differ.diff(checks, lastStatus, opts)
+	if len(updates) != 1 {
+		t.Fatalf("expected 1 update, got %d: %v", len(updates), updates)
+	}
+	if _, ok := updates["node1/serfHealth"]; !ok {
+		t.Errorf("expected an update for serfHealth, got %v", updates)
+	}
+}
+
+func TestDiff_invalidStrategy(t *testing.T) {
+	if _, err := newCheckDiffer(ServiceWatch, "bogus", nil); err == nil {
+		t.Fatal("expected an error for an invalid strategy")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -24,15 +25,31 @@ func discoverServices(nodeName string, config *Config, shutdownCh chan struct{},
 	// Used to store services we've already started watches for
 	services := make(map[string]bool)
 
+	// Tracks services missing from the results, so their watches survive brief deregistrations
+	removals := newRemovalTracker("Service")
+
+	// Start watches for the last-known services right away, if we have them cached
+	var cachedServices map[string][]string
+	if loadDiscoveryCache(config, "services", &cachedServices) {
+		log.Infof("Loaded %d services from the discovery cache", len(cachedServices))
+	}
+
 	// Share a stop channel among watches for faster shutdown
 	stopCh := make(map[string]chan struct{})
 
+	// The catalog services covered by each logical service, in Nomad compatibility mode
+	groups := make(map[string]*ServiceGroup)
+
+	// Closed on shutdown to stop starting the watches of a throttled startup sync
+	syncStopCh := make(chan struct{})
+
 	// Loop indefinitely to run the watch, doing repeated blocking queries to Consul
 	for {
 		// Check for shutdown event
 		select {
 		case <-shutdownCh:
 			log.Infof("Shutting down service watches (count: %d)...", len(services))
+			close(syncStopCh)
 
 			// Use a wait group to shut down all the watches at the same time
 			var wg sync.WaitGroup
@@ -57,7 +74,13 @@ func discoverServices(nodeName string, config *Config, shutdownCh chan struct{},
 		var err error
 
 		// Watch either all services or just the local node's, depending on whether GlobalMode is set
-		if config.ServiceWatch == GlobalMode {
+		queryOpts.WaitTime = consulThrottle.waitTime()
+		queried := cachedServices == nil
+		if cachedServices != nil {
+			currentServices = cachedServices
+			queryMeta = &api.QueryMeta{}
+			cachedServices = nil
+		} else if config.ServiceWatch == GlobalMode {
 			currentServices, queryMeta, err = client.Catalog().Services(queryOpts)
 		} else {
 			var node *api.CatalogNode
@@ -74,23 +97,73 @@ func discoverServices(nodeName string, config *Config, shutdownCh chan struct{},
 			}
 		}
 
+		if queried {
+			consulThrottle.observe(err)
+		}
 		if err != nil {
-			log.Errorf("Error trying to watch services: %s, retrying in 10s...", err)
-			time.Sleep(errorWaitTime)
+			wait := consulThrottle.errorWaitTime()
+			log.Errorf("Error trying to watch services: %s, retrying in %s...", err, wait)
+			time.Sleep(wait)
 			continue
 		}
 
-		// Update our WaitIndex for the next query
+		// Only throttle the first pass over the catalog; services discovered after that
+		// have their watches started right away
+		initialSync := queryOpts.WaitIndex == 0
+
+		// Update our WaitIndex for the next query, and keep the cache up to date
+		catalogChanged := queryMeta.LastIndex != queryOpts.WaitIndex
+		if catalogChanged {
+			saveDiscoveryCache(config, "services", currentServices)
+		}
 		queryOpts.WaitIndex = queryMeta.LastIndex
 
+		// In Nomad compatibility mode, watch the allocations of each job as one logical service
+		var members map[string][]string
+		if config.NomadCompat {
+			currentServices, members = groupNomadServices(currentServices)
+			for service, serviceMembers := range members {
+				if group, ok := groups[service]; ok {
+					group.set(serviceMembers)
+				} else {
+					groups[service] = newServiceGroup(serviceMembers)
+				}
+			}
+		}
+
 		// Reset the map so we can detect removed services
 		for service, _ := range services {
 			services[service] = false
 		}
 
+		// Go through the services in a fixed order so the startup sync batches are stable
+		serviceNames := make([]string, 0, len(currentServices))
+		for service, _ := range currentServices {
+			serviceNames = append(serviceNames, service)
+		}
+		sort.Strings(serviceNames)
+
+		// Pick up any alerting settings from the services' meta before starting their watches
+		if config.ServiceMetaConfig && catalogChanged {
+			for _, service := range serviceNames {
+				metaService := service
+				if members != nil {
+					metaService = members[service][0]
+				}
+				meta, err := fetchServiceMeta(client, metaService)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+				config.setServiceMeta(service, meta)
+			}
+		}
+
 		// Compare the new list of services with our stored one to see if we need to
 		// spawn any new watches
-		for service, tags := range currentServices {
+		var pending []*WatchOptions
+		for _, service := range serviceNames {
+			tags := currentServices[service]
 			serviceConfig := config.serviceConfig(service)
 
 			// If DistinctTags is specified, spawn a separate watch for each tag on the service
@@ -100,51 +173,92 @@ func discoverServices(nodeName string, config *Config, shutdownCh chan struct{},
 						watchOpts := &WatchOptions{
 							service: service,
 							tag:     tag,
+							group:   groups[service],
 							config:  config,
 							client:  client,
 							stopCh:  make(chan struct{}, 0),
 						}
 						stopCh[service+":"+tag] = watchOpts.stopCh
 						log.Infof("Discovered new service: %s (tag: %s)", service, tag)
-						go watch(watchOpts)
+						pending = append(pending, watchOpts)
 					}
 					services[service+":"+tag] = true
 				}
+			} else if serviceConfig != nil && len(serviceConfig.TagSet) > 0 {
+				// With a tag set, watch only the instances carrying all of its tags, once
+				// the service has them registered
+				if !containsAll(tags, serviceConfig.TagSet) {
+					continue
+				}
+				key := service + ":" + serviceConfig.tagSetName()
+				if _, ok := services[key]; !ok {
+					watchOpts := &WatchOptions{
+						service: service,
+						tag:     serviceConfig.tagSetName(),
+						tagSet:  serviceConfig.TagSet,
+						group:   groups[service],
+						config:  config,
+						client:  client,
+						stopCh:  make(chan struct{}, 0),
+					}
+					stopCh[key] = watchOpts.stopCh
+					log.Infof("Discovered new service: %s (tags: %s)", service, watchOpts.tag)
+					pending = append(pending, watchOpts)
+				}
+				services[key] = true
 			} else {
 				if _, ok := services[service]; !ok {
 					watchOpts := &WatchOptions{
 						service: service,
+						group:   groups[service],
 						config:  config,
 						client:  client,
 						stopCh:  make(chan struct{}, 0),
 					}
 					stopCh[service] = watchOpts.stopCh
 					log.Infof("Discovered new service: %s", service)
-					go watch(watchOpts)
+					pending = append(pending, watchOpts)
 				}
 				services[service] = true
 			}
 		}
 
-		// Shut down watched for removed services
+		// Start the new watches, at the throttled rate during the initial sync
+		if initialSync {
+			startWatches("service", pending, config, syncStopCh)
+		} else {
+			for _, watchOpts := range pending {
+				go watch(watchOpts)
+			}
+		}
+
+		// Shut down watches for removed services, once they've been missing for long enough
 		for service, alive := range services {
-			if !alive {
-				log.Infof("Service %s left, removing", service)
+			if alive {
+				removals.seen(service)
+				continue
+			}
 
-				ch := stopCh[service]
-				delete(services, service)
-				delete(stopCh, service)
-				go func() {
-					ch <- struct{}{}
-					ch <- struct{}{}
-				}()
+			if !removals.shouldRemove(service, catalogChanged, config, time.Now()) {
+				continue
 			}
+
+			log.Infof("Service %s left, removing", service)
+
+			ch := stopCh[service]
+			delete(services, service)
+			delete(stopCh, service)
+			go func() {
+				ch <- struct{}{}
+				ch <- struct{}{}
+			}()
 		}
 	}
 }
 
-// Queries the catalog for nodes and starts watches for them
-func discoverNodes(config *Config, shutdownCh chan struct{}, client *api.Client) {
+// Queries the catalog for nodes and starts watches for them. If node watches are sharded,
+// only the nodes assigned to this instance (named by instanceID) are watched.
+func discoverNodes(instanceID string, config *Config, shutdownCh chan struct{}, client *api.Client) {
 	queryOpts := &api.QueryOptions{
 		AllowStale: true,
 		WaitTime:   watchWaitTime,
@@ -153,15 +267,60 @@ func discoverNodes(config *Config, shutdownCh chan struct{}, client *api.Client)
 	// Used to store nodes we've already started watches for
 	nodes := make(map[string]bool, 0)
 
+	// Tracks nodes missing from the results, so their watches survive brief deregistrations
+	removals := newRemovalTracker("Node")
+
+	// Start watches for the last-known nodes right away, if we have them cached
+	var cachedNodes []string
+	if loadDiscoveryCache(config, "nodes", &cachedNodes) {
+		log.Infof("Loaded %d nodes from the discovery cache", len(cachedNodes))
+	}
+
 	// Share a stop channel among watches for faster shutdown
 	stopCh := make(map[string]chan struct{})
 
+	// Feed all the node watches from a single blocking query on the health checks
+	feed := newNodeHealthFeed()
+	feedStopCh := make(chan struct{})
+	go feed.run(client, feedStopCh)
+
+	// Closed on shutdown to stop starting the watches of a throttled startup sync
+	syncStopCh := make(chan struct{})
+
+	// Stops a node's watch and forgets it
+	stopWatch := func(node string) {
+		ch := stopCh[node]
+		delete(nodes, node)
+		delete(stopCh, node)
+		go func() {
+			ch <- struct{}{}
+			ch <- struct{}{}
+			feed.forget(node)
+		}()
+	}
+
+	// Join the other instances, and wait to know who they are before taking any nodes
+	var sharder *nodeSharder
+	if config.NodeWatchSharding {
+		log.Infof("Sharding node watches with the other alerting instances as %s", instanceID)
+		sharder = newNodeSharder(instanceID, client)
+		go sharder.run(feedStopCh)
+		select {
+		case <-sharder.readyCh:
+		case <-shutdownCh:
+			close(feedStopCh)
+			<-shutdownCh
+			return
+		}
+	}
+
 	// Loop indefinitely to run the watch, doing repeated blocking queries to Consul
 	for {
 		// Check for shutdown event
 		select {
 		case <-shutdownCh:
 			log.Infof("Shutting down node watches (count: %d)...", len(nodes))
+			close(syncStopCh)
 
 			// Use a wait group to shut down all the watches at the same time
 			var wg sync.WaitGroup
@@ -175,21 +334,48 @@ func discoverNodes(config *Config, shutdownCh chan struct{}, client *api.Client)
 				}()
 			}
 			wg.Wait()
+			close(feedStopCh)
 			log.Info("Finished shutting down node watches")
 
 			<-shutdownCh
 			return
 		default:
 		}
-		currentNodes, queryMeta, err := client.Catalog().Nodes(queryOpts)
+		var currentNodes []*api.Node
+		var queryMeta *api.QueryMeta
+		var err error
+
+		if cachedNodes != nil {
+			for _, node := range cachedNodes {
+				currentNodes = append(currentNodes, &api.Node{Node: node})
+			}
+			queryMeta = &api.QueryMeta{}
+			cachedNodes = nil
+		} else {
+			queryOpts.WaitTime = consulThrottle.waitTime()
+			currentNodes, queryMeta, err = client.Catalog().Nodes(queryOpts)
+			consulThrottle.observe(err)
+		}
 
 		if err != nil {
-			log.Errorf("Error trying to watch node list: %s, retrying in 10s...", err)
-			time.Sleep(errorWaitTime)
+			wait := consulThrottle.errorWaitTime()
+			log.Errorf("Error trying to watch node list: %s, retrying in %s...", err, wait)
+			time.Sleep(wait)
 			continue
 		}
 
-		// Update our WaitIndex for the next query
+		// Only throttle the first pass over the catalog
+		initialSync := queryOpts.WaitIndex == 0
+
+		// Update our WaitIndex for the next query, and keep the cache up to date
+		catalogChanged := queryMeta.LastIndex != queryOpts.WaitIndex
+		if catalogChanged {
+			nodeNames := make([]string, 0, len(currentNodes))
+			for _, node := range currentNodes {
+				nodeNames = append(nodeNames, node.Node)
+			}
+			saveDiscoveryCache(config, "nodes", nodeNames)
+		}
 		queryOpts.WaitIndex = queryMeta.LastIndex
 
 		// Reset the map so we can detect removed nodes
@@ -197,10 +383,38 @@ func discoverNodes(config *Config, shutdownCh chan struct{}, client *api.Client)
 			nodes[node] = false
 		}
 
+		var members []string
+		var view string
+		converged := true
+		if sharder != nil {
+			members, view, converged = sharder.snapshot()
+		}
+		disowned := make([]string, 0)
+
 		// Compare the new list of nodes with our stored one to see if we need to
 		// spawn any new watches
+		var pending []*WatchOptions
 		for _, node := range currentNodes {
 			nodeName := node.Node
+
+			// Don't alert on the checks exported as health summaries
+			if nodeName == config.HealthSummaryNode {
+				continue
+			}
+
+			// Leave the nodes assigned to other instances to them, but keep watching the ones
+			// that are moving away until every instance has started its new watches
+			if sharder != nil && rendezvousOwner(nodeName, members) != instanceID {
+				if _, ok := nodes[nodeName]; ok {
+					if converged {
+						disowned = append(disowned, nodeName)
+					} else {
+						nodes[nodeName] = true
+					}
+				}
+				continue
+			}
+
 			if _, ok := nodes[nodeName]; !ok {
 				log.Infof("Discovered new node: %s", nodeName)
 				opts := &WatchOptions{
@@ -208,26 +422,216 @@ func discoverNodes(config *Config, shutdownCh chan struct{}, client *api.Client)
 					config: config,
 					client: client,
 					stopCh: make(chan struct{}, 0),
+					feed:   feed,
 				}
 				stopCh[nodeName] = opts.stopCh
-				go watch(opts)
+				pending = append(pending, opts)
 			}
 			nodes[nodeName] = true
 		}
 
-		// Shut down watches for removed nodes
+		// Start the new watches, at the throttled rate during the initial sync
+		if initialSync {
+			startWatches("node", pending, config, syncStopCh)
+		} else {
+			for _, opts := range pending {
+				go watch(opts)
+			}
+		}
+
+		if sharder != nil {
+			sharder.started(view)
+			for _, node := range disowned {
+				log.Infof("Node %s is now watched by another instance, stopping its watch", node)
+				removals.seen(node)
+				stopWatch(node)
+			}
+		}
+
+		// Shut down watches for removed nodes, once they've been missing for long enough
 		for node, alive := range nodes {
-			if !alive {
-				log.Infof("Node %s left, removing", node)
+			if alive {
+				removals.seen(node)
+				continue
+			}
 
-				ch := stopCh[node]
-				delete(nodes, node)
-				delete(stopCh, node)
-				go func() {
-					ch <- struct{}{}
-					ch <- struct{}{}
-				}()
+			if !removals.shouldRemove(node, catalogChanged, config, time.Now()) {
+				continue
 			}
+
+			log.Infof("Node %s left, removing", node)
+			stopWatch(node)
 		}
 	}
 }
+
+// Tracks how long watched services or nodes have been missing from the discovery results,
+// so that their watches (along with their locks and in-memory state) are kept if they're
+// re-registered shortly after disappearing
+type removalTracker struct {
+	kind         string
+	missed       map[string]int
+	missingSince map[string]time.Time
+}
+
+func newRemovalTracker(kind string) *removalTracker {
+	return &removalTracker{
+		kind:         kind,
+		missed:       make(map[string]int),
+		missingSince: make(map[string]time.Time),
+	}
+}
+
+// Records that the given service or node is present in the latest results
+func (r *removalTracker) seen(name string) {
+	if _, ok := r.missed[name]; ok {
+		log.Infof("%s %s is back, reusing its existing watch", r.kind, name)
+	}
+	delete(r.missed, name)
+	delete(r.missingSince, name)
+}
+
+// Records that the given service or node is missing from the latest results, returning true
+// if it has been missing from at least removal_threshold consecutive catalog changes and for
+// longer than removal_grace_period. Results where the catalog didn't change, such as when the
+// blocking query times out, only count towards the grace period.
+func (r *removalTracker) shouldRemove(name string, changed bool, config *Config, now time.Time) bool {
+	_, missing := r.missingSince[name]
+	if !missing {
+		r.missingSince[name] = now
+		r.missed[name] = 1
+	} else if changed {
+		r.missed[name]++
+	}
+
+	gracePeriod := time.Duration(config.RemovalGracePeriod) * time.Second
+	missingFor := now.Sub(r.missingSince[name])
+	if r.missed[name] < config.RemovalThreshold || missingFor < gracePeriod {
+		if !missing {
+			log.Infof("%s %s missing from results, keeping its watch until it's been missing from %d catalog changes and for %s",
+				r.kind, name, config.RemovalThreshold, gracePeriod)
+		}
+		return false
+	}
+
+	delete(r.missed, name)
+	delete(r.missingSince, name)
+	return true
+}
+
+// Returns how often to start a batch of watches during the initial catalog sync, so that
+// watches are started at a rate of startup_sync_rate per second
+func startupSyncInterval(config *Config) time.Duration {
+	return time.Duration(startupSyncBatchSize(config)) * time.Second / time.Duration(config.StartupSyncRate)
+}
+
+func startupSyncBatchSize(config *Config) int {
+	if config.StartupSyncBatchSize <= 0 {
+		return 1
+	}
+	return config.StartupSyncBatchSize
+}
+
+// The progress of the initial catalog sync for each kind of watch, reported by the status
+// API's metrics
+var startupSync = &startupSyncTracker{kinds: make(map[string]startupSyncMetrics)}
+
+// The number of watches found by the initial catalog sync, and how many have been started
+type startupSyncMetrics struct {
+	Total   int `json:"total"`
+	Started int `json:"started"`
+}
+
+type startupSyncTracker struct {
+	lock  sync.Mutex
+	kinds map[string]startupSyncMetrics
+}
+
+func (t *startupSyncTracker) set(kind string, total int, started int) {
+	t.lock.Lock()
+	t.kinds[kind] = startupSyncMetrics{Total: total, Started: started}
+	t.lock.Unlock()
+}
+
+// Returns a copy of the progress of each kind of watch
+func (t *startupSyncTracker) snapshot() map[string]startupSyncMetrics {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	kinds := make(map[string]startupSyncMetrics, len(t.kinds))
+	for kind, progress := range t.kinds {
+		kinds[kind] = progress
+	}
+	return kinds
+}
+
+// Starts the watches found by the initial catalog sync. With startup_sync_rate set, a ticker
+// releases them in batches of startup_sync_batch_size to avoid flooding the agent in very
+// large clusters, until they've all been started or stopCh is closed.
+func startWatches(kind string, watches []*WatchOptions, config *Config, stopCh <-chan struct{}) {
+	if config.StartupSyncRate <= 0 || len(watches) == 0 {
+		startupSync.set(kind, len(watches), len(watches))
+		for _, opts := range watches {
+			go watch(opts)
+		}
+		return
+	}
+
+	batchSize := startupSyncBatchSize(config)
+	log.Infof("Starting %d %s watches in batches of %d (%d/s)", len(watches), kind, batchSize, config.StartupSyncRate)
+
+	ticker := time.NewTicker(startupSyncInterval(config))
+	go func() {
+		defer ticker.Stop()
+		startWatchBatches(kind, watches, batchSize, ticker.C, stopCh, startSyncedWatch)
+	}()
+}
+
+// Starts the watches a batch at a time, the first right away and the rest on each tick,
+// recording the progress of the sync as it goes. Once stopCh is closed, the watches that
+// haven't been started are left to be stopped.
+func startWatchBatches(kind string, watches []*WatchOptions, batchSize int, ticks <-chan time.Time, stopCh <-chan struct{}, start func(*WatchOptions)) {
+	began := time.Now()
+	startupSync.set(kind, len(watches), 0)
+
+	for started := 0; started < len(watches); {
+		if started > 0 {
+			select {
+			case <-ticks:
+			case <-stopCh:
+				// Take the stop signals meant for the watches, as they would have
+				for _, opts := range watches[started:] {
+					go func(opts *WatchOptions) {
+						<-opts.stopCh
+						<-opts.stopCh
+					}(opts)
+				}
+				return
+			}
+		}
+
+		end := started + batchSize
+		if end > len(watches) {
+			end = len(watches)
+		}
+		for _, opts := range watches[started:end] {
+			start(opts)
+		}
+		started = end
+
+		startupSync.set(kind, len(watches), started)
+		log.Infof("Startup sync progress: started %d/%d %s watches", started, len(watches), kind)
+	}
+	log.Infof("Startup sync of %s watches finished in %s", kind, time.Since(began))
+}
+
+// Starts a watch released by the startup sync, unless it was stopped while waiting for its
+// batch
+func startSyncedWatch(opts *WatchOptions) {
+	select {
+	case <-opts.stopCh:
+		<-opts.stopCh
+	default:
+		go watch(opts)
+	}
+}
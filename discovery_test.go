@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
@@ -169,7 +171,7 @@ func TestDiscovery_rediscoverNode(t *testing.T) {
 		c.Server = false
 	}
 
-	go discoverNodes(config, nil, client)
+	go discoverNodes("", config, nil, client)
 
 	<-time.After(1 * time.Second)
 
@@ -212,7 +214,7 @@ func TestDiscovery_existingNode(t *testing.T) {
 	config := DefaultConfig()
 	config.ChangeThreshold = 0
 	config.Handlers["test"] = testHandler{alertCh}
-	go discoverNodes(config, nil, client)
+	go discoverNodes("", config, nil, client)
 
 	<-time.After(1 * time.Second)
 
@@ -229,7 +231,7 @@ func TestDiscovery_discoveredNode(t *testing.T) {
 	config := DefaultConfig()
 	config.ChangeThreshold = 0
 	config.Handlers["test"] = testHandler{alertCh}
-	go discoverNodes(config, nil, client)
+	go discoverNodes("", config, nil, client)
 
 	<-time.After(1 * time.Second)
 
@@ -245,3 +247,126 @@ func TestDiscovery_discoveredNode(t *testing.T) {
 
 	testWaitForAlert(t, alertCh, structs.HealthCritical, 5*time.Second)
 }
+
+// Make sure watches in the initial sync get started in batches at the configured rate
+func TestDiscovery_startupSyncInterval(t *testing.T) {
+	config := &Config{
+		StartupSyncRate:      10,
+		StartupSyncBatchSize: 5,
+	}
+	if interval := startupSyncInterval(config); interval != 500*time.Millisecond {
+		t.Errorf("expected an interval of 500ms, got %s", interval)
+	}
+
+	config.StartupSyncBatchSize = 0
+	if interval := startupSyncInterval(config); interval != 100*time.Millisecond {
+		t.Errorf("expected an interval of 100ms for single watch batches, got %s", interval)
+	}
+}
+
+// Make sure the startup sync releases a batch of watches per tick, and records its progress
+// for the metrics as batches start
+func TestDiscovery_startupSyncProgress(t *testing.T) {
+	defer func() { startupSync = &startupSyncTracker{kinds: make(map[string]startupSyncMetrics)} }()
+
+	config := &Config{}
+	startWatches("node", nil, config, nil)
+	if progress := startupSync.snapshot()["node"]; progress.Total != 0 || progress.Started != 0 {
+		t.Errorf("expected an empty sync to be finished, got %+v", progress)
+	}
+
+	watches := make([]*WatchOptions, 5)
+	for i := range watches {
+		watches[i] = &WatchOptions{service: fmt.Sprintf("service%d", i), stopCh: make(chan struct{})}
+	}
+
+	// Pass each started watch back along with the progress recorded when it was started
+	type start struct {
+		service string
+		started int
+	}
+	startCh := make(chan start)
+	record := func(opts *WatchOptions) {
+		startCh <- start{opts.service, startupSync.snapshot()["service"].Started}
+	}
+
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		startWatchBatches("service", watches, 2, ticks, nil, record)
+		close(done)
+	}()
+
+	// Each batch has to be started before the next tick is taken
+	batches := [][]start{
+		{{"service0", 0}, {"service1", 0}},
+		{{"service2", 2}, {"service3", 2}},
+		{{"service4", 4}},
+	}
+	for i, batch := range batches {
+		for _, expected := range batch {
+			if actual := <-startCh; actual != expected {
+				t.Errorf("expected start %+v, got %+v", expected, actual)
+			}
+		}
+		if i == len(batches)-1 {
+			break
+		}
+		select {
+		case actual := <-startCh:
+			t.Fatalf("%s was started before the next tick", actual.service)
+		case ticks <- time.Now():
+		}
+	}
+	<-done
+	if progress := startupSync.snapshot()["service"]; progress.Total != 5 || progress.Started != 5 {
+		t.Errorf("expected the sync to have finished, got %+v", progress)
+	}
+
+	// Stopping the sync leaves the rest of the watches unstarted, and takes their stop signals
+	started := 0
+	stopCh := make(chan struct{})
+	close(stopCh)
+	startWatchBatches("service", watches, 2, ticks, stopCh, func(*WatchOptions) { started++ })
+	if started != 2 {
+		t.Errorf("expected only the first batch to be started, got %d", started)
+	}
+	watches[4].stopCh <- struct{}{}
+	watches[4].stopCh <- struct{}{}
+}
+
+func TestDiscovery_removalTracker(t *testing.T) {
+	config := &Config{
+		RemovalThreshold:   2,
+		RemovalGracePeriod: 60,
+	}
+	removals := newRemovalTracker("Service")
+	start := time.Now()
+
+	// Missing enough times, but not for long enough
+	if removals.shouldRemove("redis", true, config, start) {
+		t.Fatal("expected watch to be kept after the first miss")
+	}
+	if removals.shouldRemove("redis", true, config, start.Add(10*time.Second)) {
+		t.Fatal("expected watch to be kept within the grace period")
+	}
+
+	// Coming back resets the tracking
+	removals.seen("redis")
+	if removals.shouldRemove("redis", true, config, start.Add(90*time.Second)) {
+		t.Fatal("expected watch to be kept after the service came back")
+	}
+
+	// Results where the catalog didn't change don't count as misses
+	if removals.shouldRemove("redis", false, config, start.Add(151*time.Second)) {
+		t.Fatal("expected watch to be kept when the catalog hasn't changed")
+	}
+	if !removals.shouldRemove("redis", true, config, start.Add(161*time.Second)) {
+		t.Fatal("expected watch to be removed after the grace period")
+	}
+
+	// The default of removing on the first miss still works
+	if !removals.shouldRemove("web", false, &Config{RemovalThreshold: 1}, start) {
+		t.Fatal("expected watch to be removed right away with no grace period")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DispatchQueue is an in-memory priority queue of alerts waiting to be sent to their handlers,
+// used when dispatch_workers is set. During a mass outage, critical alerts are sent before
+// warnings and recoveries, and page-class handlers (such as PagerDuty) are sent to before
+// chat-class handlers, so the most important notifications aren't stuck behind a backlog.
+// Alerts for the same handler and fingerprint are still sent in the order they were queued.
+type DispatchQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	jobs dispatchJobs
+	seq  uint64
+
+	// The number of queued jobs for each handler/fingerprint, and the lowest priority among
+	// them, so later alerts for the same key can't overtake earlier ones
+	pending map[string]int
+	floor   map[string]int
+
+	// The handler/fingerprint keys currently being sent by a worker
+	inflight map[string]bool
+
+	// Signalled when a job is done, for waiting until the queue is empty
+	idle *sync.Cond
+}
+
+// A single alert waiting to be sent to a handler
+type dispatchJob struct {
+	key        string
+	handler    string
+	datacenter string
+	alert      *AlertState
+	priority   int
+	seq        uint64
+}
+
+// Implements heap.Interface, ordering jobs by priority and then by the order they were queued
+type dispatchJobs []*dispatchJob
+
+func (j dispatchJobs) Len() int { return len(j) }
+func (j dispatchJobs) Less(a, b int) bool {
+	if j[a].priority != j[b].priority {
+		return j[a].priority > j[b].priority
+	}
+	return j[a].seq < j[b].seq
+}
+func (j dispatchJobs) Swap(a, b int)       { j[a], j[b] = j[b], j[a] }
+func (j *dispatchJobs) Push(x interface{}) { *j = append(*j, x.(*dispatchJob)) }
+func (j *dispatchJobs) Pop() interface{} {
+	old := *j
+	job := old[len(old)-1]
+	*j = old[:len(old)-1]
+	return job
+}
+
+func newDispatchQueue() *DispatchQueue {
+	q := &DispatchQueue{
+		pending:  make(map[string]int),
+		floor:    make(map[string]int),
+		inflight: make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.lock)
+	q.idle = sync.NewCond(&q.lock)
+	return q
+}
+
+// Returns the priority for sending an alert to a handler: the alert's severity first, then
+// whether the handler pages someone
+func dispatchPriority(alert *AlertState, handler AlertHandler) int {
+	priority := healthRank(alert.Status) * 2
+	if isPageHandler(handler) {
+		priority++
+	}
+	return priority
+}
+
+// Returns true if the handler (underneath any middleware) pages someone, rather than posting
+// to a chat channel, inbox or log
+func isPageHandler(handler AlertHandler) bool {
+	switch unwrapHandler(handler).(type) {
+	case PagerdutyHandler, SNSHandler:
+		return true
+	}
+	return false
+}
+
+// Queues an alert to be sent to the given handler. The alert is copied, since callers keep
+// updating their alert state after dispatching it.
+func (q *DispatchQueue) push(handlerID string, handler AlertHandler, datacenter string, alert *AlertState) {
+	copied := *alert
+	key := handlerID + "/" + alertFingerprint(alert)
+	priority := dispatchPriority(alert, handler)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.pending[key] > 0 && q.floor[key] < priority {
+		priority = q.floor[key]
+	}
+	q.pending[key]++
+	q.floor[key] = priority
+
+	q.seq++
+	heap.Push(&q.jobs, &dispatchJob{
+		key:        key,
+		handler:    handlerID,
+		datacenter: datacenter,
+		alert:      &copied,
+		priority:   priority,
+		seq:        q.seq,
+	})
+	q.cond.Signal()
+}
+
+// Removes and returns the highest priority job whose key isn't already being sent, waiting
+// until there is one. The key is marked in flight until done is called for the job.
+func (q *DispatchQueue) pop() *dispatchJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		var skipped []*dispatchJob
+		var job *dispatchJob
+		for q.jobs.Len() > 0 {
+			next := heap.Pop(&q.jobs).(*dispatchJob)
+			if !q.inflight[next.key] {
+				job = next
+				break
+			}
+			skipped = append(skipped, next)
+		}
+		for _, s := range skipped {
+			heap.Push(&q.jobs, s)
+		}
+
+		if job != nil {
+			q.inflight[job.key] = true
+			q.pending[job.key]--
+			if q.pending[job.key] == 0 {
+				delete(q.pending, job.key)
+				delete(q.floor, job.key)
+			}
+			return job
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// Marks a job as sent, letting the next job for its key be popped
+func (q *DispatchQueue) done(job *dispatchJob) {
+	q.lock.Lock()
+	delete(q.inflight, job.key)
+	q.lock.Unlock()
+	q.cond.Broadcast()
+	q.idle.Broadcast()
+}
+
+// Waits until every queued alert has been sent
+func (q *DispatchQueue) drain() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.jobs.Len() > 0 || len(q.inflight) > 0 {
+		q.idle.Wait()
+	}
+}
+
+// Returns the number of queued jobs
+func (q *DispatchQueue) size() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.jobs.Len()
+}
+
+// Starts the given number of workers sending queued alerts to their handlers
+func (q *DispatchQueue) run(config *Config, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				job := q.pop()
+				log.Debugf("Sending alert '%s' to %s (%d more queued)", job.alert.Message, job.handler, q.size())
+				deliverAlert(config, job.handler, job.datacenter, job.alert)
+				q.done(job)
+			}
+		}()
+	}
+}
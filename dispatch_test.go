@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestDispatch_priority(t *testing.T) {
+	queue := newDispatchQueue()
+	chat := StdoutHandler{}
+	page := newMiddlewareHandler(PagerdutyHandler{}, nil)
+
+	queue.push("chat", chat, "dc1", &AlertState{Service: "a", Status: api.HealthPassing})
+	queue.push("chat", chat, "dc1", &AlertState{Service: "b", Status: api.HealthWarning})
+	queue.push("chat", chat, "dc1", &AlertState{Service: "c", Status: api.HealthCritical})
+	queue.push("page", page, "dc1", &AlertState{Service: "d", Status: api.HealthWarning})
+	queue.push("page", page, "dc1", &AlertState{Service: "e", Status: api.HealthCritical})
+	queue.push("chat", chat, "dc1", &AlertState{Service: "f", Status: api.HealthCritical})
+
+	expected := []string{"e", "c", "f", "d", "b", "a"}
+	for _, service := range expected {
+		job := queue.pop()
+		if job.alert.Service != service {
+			t.Fatalf("expected alert for %s, got %s", service, job.alert.Service)
+		}
+		queue.done(job)
+	}
+
+	if size := queue.size(); size != 0 {
+		t.Errorf("expected empty queue, got %d jobs", size)
+	}
+}
+
+// Alerts for the same handler and fingerprint shouldn't overtake each other
+func TestDispatch_sameAlertOrder(t *testing.T) {
+	queue := newDispatchQueue()
+	handler := StdoutHandler{}
+
+	queue.push("chat", handler, "dc1", &AlertState{Service: "a", Status: api.HealthWarning, Message: "first"})
+	queue.push("chat", handler, "dc1", &AlertState{Service: "a", Status: api.HealthCritical, Message: "second"})
+	queue.push("chat", handler, "dc1", &AlertState{Service: "b", Status: api.HealthCritical, Message: "other"})
+
+	// The critical alert for a waits behind the earlier warning
+	for _, message := range []string{"other", "first", "second"} {
+		job := queue.pop()
+		if job.alert.Message != message {
+			t.Fatalf("expected %s, got %s", message, job.alert.Message)
+		}
+		queue.done(job)
+	}
+
+	// A queued alert waits while an earlier one for the same key is being sent
+	queue.push("chat", handler, "dc1", &AlertState{Service: "a", Status: api.HealthWarning, Message: "first"})
+	inflight := queue.pop()
+	queue.push("chat", handler, "dc1", &AlertState{Service: "a", Status: api.HealthCritical, Message: "second"})
+
+	popped := make(chan *dispatchJob)
+	go func() { popped <- queue.pop() }()
+	select {
+	case job := <-popped:
+		t.Fatalf("expected pop to wait for the in-flight alert, got %s", job.alert.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	queue.done(inflight)
+	select {
+	case job := <-popped:
+		if job.alert.Message != "second" {
+			t.Errorf("expected second, got %s", job.alert.Message)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("didn't get queued alert")
+	}
+}
+
+func TestDispatch_workers(t *testing.T) {
+	config, alertCh := testAlertConfig()
+	config.dispatchQueue = newDispatchQueue()
+	config.dispatchQueue.run(config, 2)
+
+	alert := &AlertState{Status: api.HealthCritical, Message: "critical"}
+	dispatchAlert(config, testServiceName, alert)
+
+	// Changes made after dispatching shouldn't affect the queued alert
+	alert.Message = "changed"
+
+	select {
+	case sent := <-alertCh:
+		if sent.Message != "critical" {
+			t.Errorf("expected queued copy of alert, got %s", sent.Message)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("didn't get alert")
+	}
+}
+
+func TestDispatch_drain(t *testing.T) {
+	config, alertCh := testAlertConfig()
+	config.dispatchQueue = newDispatchQueue()
+
+	dispatchAlert(config, testServiceName, &AlertState{Status: api.HealthCritical, Message: "critical"})
+
+	drained := make(chan struct{})
+	go func() {
+		config.dispatchQueue.drain()
+		close(drained)
+	}()
+
+	// Nothing has been sent until the workers start
+	select {
+	case <-drained:
+		t.Fatal("expected drain to wait for the queued alert")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	config.dispatchQueue.run(config, 1)
+	<-alertCh
+	select {
+	case <-drained:
+	case <-time.After(1 * time.Second):
+		t.Error("expected drain to return once the alert was sent")
+	}
+}
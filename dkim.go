@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The DKIM private keys loaded by email handlers, keyed by path. These are kept outside of the
+// handlers so that handlers stay comparable when the config is reloaded.
+var dkimKeys = struct {
+	sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}{keys: make(map[string]*rsa.PrivateKey)}
+
+// Loads an RSA private key from a PEM file, in either PKCS #1 or PKCS #8 form. Keys are only
+// read once, so a key has to be replaced under a new path to take effect on a reload.
+func loadDKIMKey(path string) (*rsa.PrivateKey, error) {
+	dkimKeys.Lock()
+	defer dkimKeys.Unlock()
+
+	if key, ok := dkimKeys.keys[path]; ok {
+		return key, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading DKIM key: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Error reading DKIM key: no PEM data found in %s", path)
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = parsed
+	} else if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("Error reading DKIM key: %s isn't an RSA key", path)
+		}
+		key = rsaKey
+	} else {
+		return nil, fmt.Errorf("Error reading DKIM key: %s", err)
+	}
+
+	dkimKeys.keys[path] = key
+	return key, nil
+}
+
+// Signs a rendered email (with CRLF line endings) using rsa-sha256 and relaxed/relaxed
+// canonicalization, as described in RFC 6376, returning it with the DKIM-Signature header
+// prepended
+func dkimSign(message []byte, domain string, selector string, key *rsa.PrivateKey, now time.Time) ([]byte, error) {
+	split := bytes.Index(message, []byte("\r\n\r\n"))
+	if split < 0 {
+		return nil, fmt.Errorf("Error signing email: no end of headers found")
+	}
+	headers := parseRawHeaders(string(message[:split+2]))
+	body := message[split+4:]
+
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+
+	// Every header of a rendered email is signed
+	names := make([]string, 0, len(emailHeaders))
+	for _, name := range emailHeaders {
+		if _, ok := headers[strings.ToLower(name)]; ok {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+
+	signature := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		domain, selector, now.Unix(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	// The header hash covers the signed headers and then the signature header itself with an
+	// empty b= tag, without its trailing CRLF
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(dkimRelaxedHeader(name, headers[name])))
+	}
+	canonical := dkimRelaxedHeader("DKIM-Signature", signature)
+	hash.Write([]byte(strings.TrimSuffix(canonical, "\r\n")))
+
+	signed, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Error signing email: %s", err)
+	}
+
+	header := "DKIM-Signature: " + signature + base64.StdEncoding.EncodeToString(signed) + "\r\n"
+	return append([]byte(header), message...), nil
+}
+
+// Parses a raw header block into a map of lowercased names to their (possibly folded) values.
+// Only the first occurrence of each header is kept, since rendered emails don't repeat them.
+func parseRawHeaders(raw string) map[string]string {
+	headers := make(map[string]string)
+	var name string
+	for _, line := range strings.SplitAfter(raw, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && name != "" {
+			headers[name] += line
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		name = strings.ToLower(line[:colon])
+		if _, ok := headers[name]; ok {
+			name = ""
+			continue
+		}
+		headers[name] = line[colon+1:]
+	}
+	return headers
+}
+
+// Canonicalizes a header with the relaxed algorithm: the name is lowercased, the value is
+// unfolded, runs of whitespace become a single space, and whitespace around the value is removed
+func dkimRelaxedHeader(name string, value string) string {
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWhitespace(value)) + "\r\n"
+}
+
+// Canonicalizes a body with the relaxed algorithm: whitespace at the end of each line is
+// removed, runs of whitespace become a single space, and empty lines at the end are dropped
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWhitespace(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// Replaces each run of spaces and tabs with a single space
+func collapseWhitespace(s string) string {
+	var buf bytes.Buffer
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			buf.WriteByte(' ')
+			space = false
+		}
+		buf.WriteByte(s[i])
+	}
+	if space {
+		buf.WriteByte(' ')
+	}
+	return buf.String()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The canonicalization examples from RFC 6376, section 3.4.5
+func TestDKIM_relaxedCanonicalization(t *testing.T) {
+	headers := parseRawHeaders("A: X\r\nB : Y\t\r\n\tZ  \r\n")
+	if canonical := dkimRelaxedHeader("A", headers["a"]) + dkimRelaxedHeader("B", headers["b "]); canonical != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected canonical headers %q", canonical)
+	}
+
+	if body := dkimRelaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n")); string(body) != " C\r\nD E\r\n" {
+		t.Errorf("unexpected canonical body %q", body)
+	}
+	if body := dkimRelaxedBody([]byte("\r\n\r\n")); len(body) != 0 {
+		t.Errorf("expected an empty body, got %q", body)
+	}
+}
+
+func TestDKIM_sign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dkim.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(path, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := EmailHandler{From: "alerts@example.com", DKIMDomain: "example.com", DKIMSelector: "alerts", DKIMKey: path}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+	from, _ := handler.fromAddress()
+	message, err := handler.render(from, "ops@example.com", "[dc1] redis is now critical", "connection refused", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(message)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(parsed.Header.Get("DKIM-Signature"), ";") {
+		parts := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		tags[parts[0]] = parts[1]
+	}
+	if tags["d"] != "example.com" || tags["s"] != "alerts" || tags["a"] != "rsa-sha256" || tags["c"] != "relaxed/relaxed" {
+		t.Fatalf("unexpected signature tags: %v", tags)
+	}
+
+	// Verify the signature the way a receiving server would
+	split := strings.Index(string(message), "\r\n\r\n")
+	bodyHash := sha256.Sum256(dkimRelaxedBody(message[split+4:]))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("body hash doesn't match")
+	}
+
+	headers := parseRawHeaders(string(message[:split+2]))
+	hash := sha256.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		hash.Write([]byte(dkimRelaxedHeader(name, headers[name])))
+	}
+	unsigned := strings.Replace(headers["dkim-signature"], tags["b"], "", 1)
+	hash.Write([]byte(strings.TrimSuffix(dkimRelaxedHeader("DKIM-Signature", unsigned), "\r\n")))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash.Sum(nil), signature); err != nil {
+		t.Errorf("invalid signature: %s", err)
+	}
+
+	// DKIM settings have to be given together
+	handler.DKIMSelector = ""
+	if err := handler.validate(); err == nil {
+		t.Error("expected an error for incomplete DKIM settings")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The lifecycle events written to the event log
+const (
+	// A status change started waiting out the change threshold
+	EventPending = "pending"
+
+	// A notification was sent to the handlers
+	EventSent = "sent"
+
+	// A notification was suppressed by a snooze
+	EventSnoozed = "snoozed"
+
+	// The status flapped back to the last alerted one during the change threshold
+	EventUnchanged = "unchanged"
+
+	// A reminder was sent for an alert that's still failing
+	EventReminder = "reminder"
+
+	// A notification wasn't sent because its incident used up max_notifications
+	EventCapped = "capped"
+
+	// The state of a newly discovered node/service was stored without alerting
+	EventBaseline = "baseline"
+
+	// An alert for a removed node/service was closed after being critical for stale_alert_age
+	EventStale = "stale"
+)
+
+// EventLog writes alert lifecycle events as one JSON object per line, separately from the
+// human-readable log, so log pipelines can ingest them without parsing logrus output. Events
+// are encoded by hand into pooled buffers, so logging them doesn't allocate.
+type EventLog struct {
+	lock sync.Mutex
+	out  io.WriteCloser
+}
+
+// Buffers for encoding an event and building its fingerprint key
+type eventBuffer struct {
+	buf []byte
+	key []byte
+}
+
+var eventBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &eventBuffer{
+			buf: make([]byte, 0, 2048),
+			key: make([]byte, 0, 256),
+		}
+	},
+}
+
+// Opens the event log at the given path, appending to it if it exists. A path of the form
+// fd:N writes to the already open file descriptor N instead.
+func openEventLog(path string) (*EventLog, error) {
+	if strings.HasPrefix(path, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(path, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("Invalid file descriptor for event log: %s", path)
+		}
+		return &EventLog{out: os.NewFile(uintptr(fd), path)}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening event log: %s", err)
+	}
+	return &EventLog{out: file}, nil
+}
+
+// Writes an event for the given alert
+func (l *EventLog) write(event string, datacenter string, alert *AlertState) {
+	b := eventBufferPool.Get().(*eventBuffer)
+	b.buf, b.key = appendAlertEvent(b.buf[:0], b.key[:0], time.Now(), event, datacenter, alert)
+
+	l.lock.Lock()
+	_, err := l.out.Write(b.buf)
+	l.lock.Unlock()
+	eventBufferPool.Put(b)
+
+	if err != nil {
+		log.Errorf("Error writing to event log: %s", err)
+	}
+}
+
+func (l *EventLog) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Close()
+}
+
+// Writes an event for the given alert to the event log and alert history, if they're enabled
+func (c *Config) logEvent(event string, alert *AlertState) {
+	if c.eventLog != nil {
+		c.eventLog.write(event, c.ConsulDatacenter, alert)
+	}
+	// History is skipped while Consul is under duress, to avoid adding to its load
+	if c.history != nil && !consulThrottle.throttled() {
+		if err := c.history.record(event, c.ConsulDatacenter, alert, time.Now()); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Appends the JSON line for an event to buf, using key as scratch space for the fingerprint.
+// Both buffers are returned for reuse.
+func appendAlertEvent(buf []byte, key []byte, now time.Time, event string, datacenter string, alert *AlertState) ([]byte, []byte) {
+	buf = append(buf, `{"time":"`...)
+	buf = now.UTC().AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, `","event":`...)
+	buf = appendJSONString(buf, event)
+	buf = append(buf, `,"datacenter":`...)
+	buf = appendJSONString(buf, datacenter)
+
+	// Same as alertFingerprint
+	key = append(key, alert.Node...)
+	key = append(key, '/')
+	key = append(key, alert.Service...)
+	key = append(key, '/')
+	key = append(key, alert.Tag...)
+	if alert.Route != "" {
+		key = append(key, '/')
+		key = append(key, alert.Route...)
+	}
+	sum := sha1.Sum(key)
+	buf = append(buf, `,"fingerprint":"`...)
+	for _, b := range sum[:8] {
+		buf = append(buf, hexDigits[b>>4], hexDigits[b&0x0f])
+	}
+	buf = append(buf, '"')
+
+	buf = append(buf, `,"node":`...)
+	buf = appendJSONString(buf, alert.Node)
+	buf = append(buf, `,"service":`...)
+	buf = appendJSONString(buf, alert.Service)
+	buf = append(buf, `,"tag":`...)
+	buf = appendJSONString(buf, alert.Tag)
+	buf = append(buf, `,"route":`...)
+	buf = appendJSONString(buf, alert.Route)
+	buf = append(buf, `,"status":`...)
+	buf = appendJSONString(buf, alert.Status)
+	buf = append(buf, `,"last_alerted":`...)
+	buf = appendJSONString(buf, alert.LastAlerted)
+	buf = append(buf, `,"message":`...)
+	buf = appendJSONString(buf, alert.Message)
+	buf = append(buf, `,"details":`...)
+	buf = appendJSONString(buf, alert.Details)
+	buf = append(buf, "}\n"...)
+
+	return buf, key
+}
+
+const hexDigits = "0123456789abcdef"
+
+// Appends s to buf as a quoted JSON string
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0x0f])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
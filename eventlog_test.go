@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestEventLog_appendAlertEvent(t *testing.T) {
+	alert := &AlertState{
+		Node:        "node1",
+		Service:     "redis",
+		Tag:         "primary",
+		Route:       "disk",
+		Status:      api.HealthCritical,
+		LastAlerted: api.HealthPassing,
+		Message:     `[dc1] service "redis" is now critical`,
+		Details:     "line one\nline two\t\\ \x01",
+	}
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	buf, _ := appendAlertEvent(nil, nil, now, EventSent, "dc1", alert)
+	if !strings.HasSuffix(string(buf), "}\n") || strings.Count(string(buf), "\n") != 1 {
+		t.Fatalf("expected a single line, got %q", buf)
+	}
+
+	var event map[string]string
+	if err := json.Unmarshal(buf, &event); err != nil {
+		t.Fatalf("invalid event JSON %q: %s", buf, err)
+	}
+
+	expected := map[string]string{
+		"time":         "2017-03-01T12:00:00Z",
+		"event":        EventSent,
+		"datacenter":   "dc1",
+		"fingerprint":  alertFingerprint(alert),
+		"node":         alert.Node,
+		"service":      alert.Service,
+		"tag":          alert.Tag,
+		"route":        alert.Route,
+		"status":       alert.Status,
+		"last_alerted": alert.LastAlerted,
+		"message":      alert.Message,
+		"details":      alert.Details,
+	}
+	for key, value := range expected {
+		if event[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, event[key])
+		}
+	}
+}
+
+func TestEventLog_appendAlertEventAllocs(t *testing.T) {
+	alert := &AlertState{
+		Node:    "node1",
+		Service: "redis",
+		Status:  api.HealthCritical,
+		Message: "[dc1] service redis is now critical",
+		Details: "=> (critical) Service 'redis' check: connection refused",
+	}
+	now := time.Now()
+	buf := make([]byte, 0, 2048)
+	key := make([]byte, 0, 256)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, key = appendAlertEvent(buf[:0], key[:0], now, EventSent, "dc1", alert)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestEventLog_write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	eventLog, err := openEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{ConsulDatacenter: "dc1", eventLog: eventLog}
+
+	alert := &AlertState{Node: "node1", Status: api.HealthCritical}
+	config.logEvent(EventPending, alert)
+	config.logEvent(EventSent, alert)
+	eventLog.close()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, got %q", contents)
+	}
+	for i, event := range []string{EventPending, EventSent} {
+		var parsed map[string]string
+		if err := json.Unmarshal([]byte(lines[i]), &parsed); err != nil {
+			t.Fatalf("invalid event JSON %q: %s", lines[i], err)
+		}
+		if parsed["event"] != event || parsed["node"] != "node1" {
+			t.Errorf("unexpected event: %v", parsed)
+		}
+	}
+
+	if _, err := openEventLog("fd:abc"); err == nil {
+		t.Error("expected an error for an invalid file descriptor")
+	}
+}
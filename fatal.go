@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The name of the Consul user event fired when exiting on a fatal error
+const fatalEventName = "consul-alerting-fatal"
+
+// The process exit codes, so supervisors can tell why the alerter exited without parsing logs
+const (
+	ExitFatal             = 1
+	ExitConfig            = 2
+	ExitConsulUnreachable = 3
+	ExitLockFailure       = 4
+	ExitShutdownTimeout   = 5
+)
+
+// How long to wait for the fatal webhook to respond before exiting anyway
+const fatalWebhookTimeout = 10 * time.Second
+
+// The body posted to the fatal webhook
+type fatalReport struct {
+	Datacenter string    `json:"datacenter"`
+	Hostname   string    `json:"hostname"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+// Logs an irrecoverable error, announces it if configured and exits with the given code
+func fatalError(config *Config, client *api.Client, code int, err error) {
+	log.Error(err)
+	announceFatal(config, client, code, err)
+	os.Exit(code)
+}
+
+// Announces that the alerter is exiting because of the given error, so that its failure
+// doesn't go unnoticed. Depending on the config, this fires a Consul user event, posts to
+// the fatal webhook and sends a last-gasp alert through the fatal handler.
+func announceFatal(config *Config, client *api.Client, code int, err error) {
+	hostname, _ := os.Hostname()
+	message := fmt.Sprintf("[%s] consul-alerting on %s is exiting after a fatal error", config.ConsulDatacenter, hostname)
+
+	if config.FatalWebhook != "" {
+		webhookErr := postFatalReport(config.FatalWebhook, &fatalReport{
+			Datacenter: config.ConsulDatacenter,
+			Hostname:   hostname,
+			ExitCode:   code,
+			Error:      err.Error(),
+			Time:       time.Now(),
+		})
+		if webhookErr != nil {
+			log.Error("Error posting to fatal webhook: ", webhookErr)
+		}
+	}
+
+	if config.FatalEvent && client != nil {
+		_, _, eventErr := client.Event().Fire(&api.UserEvent{
+			Name:    fatalEventName,
+			Payload: []byte(message + ": " + err.Error()),
+		}, nil)
+		if eventErr != nil {
+			log.Error("Error firing fatal error event: ", eventErr)
+		}
+	}
+
+	if config.FatalHandler != "" {
+		// The fatal handler can be a handler group, in which case every member is alerted
+		for _, id := range config.resolveHandlerIDs([]string{config.FatalHandler}) {
+			handler, ok := config.handler(id)
+			if !ok {
+				continue
+			}
+			alertErr := handler.Alert(config.ConsulDatacenter, &AlertState{
+				Status:  api.HealthCritical,
+				Message: message,
+				Details: err.Error(),
+			})
+			if alertErr != nil {
+				log.Error("Error sending fatal error alert: ", alertErr)
+			}
+		}
+	}
+}
+
+// Posts a fatal error report to the fatal webhook as JSON
+func postFatalReport(url string, report *fatalReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: fatalWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Make sure a last-gasp alert is sent through the fatal handler
+func TestFatal_announceHandler(t *testing.T) {
+	alertCh := make(chan *AlertState, 1)
+	config := &Config{
+		ConsulDatacenter: "dc1",
+		FatalHandler:     "test",
+		Handlers: map[string]AlertHandler{
+			"test": testHandler{alertCh},
+		},
+	}
+
+	announceFatal(config, nil, ExitLockFailure, errors.New("lock subsystem is dead"))
+
+	select {
+	case alert := <-alertCh:
+		if alert.Status != api.HealthCritical {
+			t.Errorf("expected critical alert, got %s", alert.Status)
+		}
+		if !strings.HasPrefix(alert.Message, "[dc1] consul-alerting on ") {
+			t.Errorf("unexpected message: %s", alert.Message)
+		}
+		if alert.Details != "lock subsystem is dead" {
+			t.Errorf("expected error in details, got '%s'", alert.Details)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("didn't get alert")
+	}
+}
+
+func TestFatal_unknownHandler(t *testing.T) {
+	_, err := ParseConfig(`fatal_handler = "slack.missing"`)
+	if err == nil {
+		t.Fatal("expected error, but nothing was returned")
+	}
+
+	expected := "Unknown handler for fatal_handler: slack.missing"
+	if err.Error() != expected {
+		t.Fatalf("expected '%s', got '%s'", expected, err.Error())
+	}
+}
+
+// Make sure the fatal webhook gets the error and exit code
+func TestFatal_announceWebhook(t *testing.T) {
+	reportCh := make(chan fatalReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report fatalReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Error(err)
+		}
+		reportCh <- report
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	datacenter = "dc1"
+	fatal_webhook = "` + server.URL + `"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announceFatal(config, nil, ExitConsulUnreachable, errors.New("connection refused"))
+
+	select {
+	case report := <-reportCh:
+		if report.Datacenter != "dc1" || report.ExitCode != ExitConsulUnreachable || report.Error != "connection refused" {
+			t.Errorf("unexpected report: %+v", report)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("didn't get report")
+	}
+
+	_, err = ParseConfig(`fatal_webhook = "hooks.example.com"`)
+	if err == nil || !strings.Contains(err.Error(), "Invalid value for fatal_webhook") {
+		t.Fatalf("expected invalid fatal_webhook error, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Returns the alert with its service's alert_fields attached, or the alert itself if the
+// service has none
+func (c *Config) withAlertFields(service string, alert *AlertState) *AlertState {
+	if service == "" {
+		return alert
+	}
+
+	c.lock.RLock()
+	serviceConfig := c.serviceConfigLocked(service)
+	c.lock.RUnlock()
+	if serviceConfig == nil || len(serviceConfig.AlertFields) == 0 {
+		return alert
+	}
+
+	withFields := *alert
+	withFields.Fields = make(map[string]string)
+	for key, value := range alert.Fields {
+		withFields.Fields[key] = value
+	}
+	for key, value := range serviceConfig.AlertFields {
+		withFields.Fields[key] = value
+	}
+	return &withFields
+}
+
+// Returns the alert's fields as a line of key=value pairs sorted by key, for handlers that
+// show alerts as text, or an empty string if it has none
+func alertFieldsText(alert *AlertState) string {
+	if len(alert.Fields) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(alert.Fields))
+	for key, _ := range alert.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+alert.Fields[key])
+	}
+	return "Fields: " + strings.Join(pairs, ", ")
+}
+
+// Returns the alert's details followed by its fields, for handlers that show alerts as text
+func detailsWithFields(alert *AlertState) string {
+	return strings.TrimSpace(alert.Details + "\n" + alertFieldsText(alert))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAlertFields_attached(t *testing.T) {
+	config, err := ParseConfig(`
+	service "redis" {
+		alert_fields {
+			cost_center = "cc-42"
+			escalation_policy = "db-oncall"
+		}
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Details: "check failed"}
+	withFields := config.withAlertFields("redis", alert)
+	expected := map[string]string{"cost_center": "cc-42", "escalation_policy": "db-oncall"}
+	if !reflect.DeepEqual(withFields.Fields, expected) {
+		t.Fatalf("expected fields %v, got %v", expected, withFields.Fields)
+	}
+	if alert.Fields != nil {
+		t.Error("expected the original alert to be left alone")
+	}
+
+	// Services without fields, and node alerts, are unchanged
+	if config.withAlertFields("webapp", alert) != alert || config.withAlertFields("", alert) != alert {
+		t.Error("expected alerts without fields to be unchanged")
+	}
+
+	if details := detailsWithFields(withFields); details != "check failed\nFields: cost_center=cc-42, escalation_policy=db-oncall" {
+		t.Errorf("unexpected details: %q", details)
+	}
+}
+
+func TestAlertFields_handlerPayloads(t *testing.T) {
+	alert := &AlertState{
+		Service: "redis",
+		Status:  api.HealthCritical,
+		Details: "check failed",
+		Fields:  map[string]string{"cost-center": "cc-42"},
+	}
+
+	details, ok := pagerdutyDetails(alert).(map[string]interface{})
+	if !ok || details["cost-center"] != "cc-42" || details["summary"] != "check failed" {
+		t.Errorf("unexpected PagerDuty details: %v", pagerdutyDetails(alert))
+	}
+
+	if env := execEnv("dc1", alert); !contains(env, "ALERT_FIELD_COST_CENTER=cc-42") {
+		t.Errorf("expected the field in the exec environment, got %v", env)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long before they expire to refresh access tokens
+const gcpTokenRefreshWindow = 5 * time.Minute
+
+// The default endpoint for exchanging a service account's signed assertion for a token
+const gcpDefaultTokenURI = "https://oauth2.googleapis.com/token"
+
+// The metadata server's endpoint for the attached service account's token, used with
+// workload identity or on GCE. A var so tests can point it elsewhere.
+var gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// Access tokens shared between handlers and kept across reloads, keyed by the credentials
+// file (empty for the metadata server) and scope
+var gcpTokens = struct {
+	lock  sync.Mutex
+	cache map[string]gcpToken
+}{cache: make(map[string]gcpToken)}
+
+// An OAuth2 access token for GCP APIs
+type gcpToken struct {
+	AccessToken string
+	Expiration  time.Time
+}
+
+// The fields used from a service account's JSON key file
+type gcpServiceAccountKey struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// The response from the token endpoint or the metadata server
+type gcpTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// The settings for authenticating to GCP, shared by the handlers for GCP services
+type gcpAuthConfig struct {
+	CredentialsFile string
+	Scope           string
+	Proxy           string
+}
+
+// Returns an access token for the configured scope: from the service account key in the
+// credentials file (or the GOOGLE_APPLICATION_CREDENTIALS environment variable), or if there
+// isn't one, from the metadata server for the attached service account (workload identity).
+func (c gcpAuthConfig) token(now time.Time) (string, error) {
+	path := c.CredentialsFile
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	key := path + "/" + c.Scope
+	gcpTokens.lock.Lock()
+	defer gcpTokens.lock.Unlock()
+
+	if cached, ok := gcpTokens.cache[key]; ok && now.Add(gcpTokenRefreshWindow).Before(cached.Expiration) {
+		return cached.AccessToken, nil
+	}
+
+	var token gcpToken
+	var err error
+	if path != "" {
+		token, err = c.serviceAccountToken(path, now)
+	} else {
+		token, err = c.metadataToken(now)
+	}
+	if err != nil {
+		return "", err
+	}
+	gcpTokens.cache[key] = token
+	return token.AccessToken, nil
+}
+
+// Gets a token by signing an assertion with a service account's private key and exchanging
+// it at the account's token endpoint
+func (c gcpAuthConfig) serviceAccountToken(path string, now time.Time) (gcpToken, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return gcpToken{}, fmt.Errorf("Error reading GCP credentials file: %s", err)
+	}
+
+	var account gcpServiceAccountKey
+	if err := json.Unmarshal(raw, &account); err != nil {
+		return gcpToken{}, fmt.Errorf("Error parsing GCP credentials file %s: %s", path, err)
+	}
+	if account.Type != "service_account" {
+		return gcpToken{}, fmt.Errorf("GCP credentials file %s isn't a service account key", path)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = gcpDefaultTokenURI
+	}
+
+	assertion, err := gcpAssertion(account, c.Scope, now)
+	if err != nil {
+		return gcpToken{}, fmt.Errorf("Error signing assertion for %s: %s", account.ClientEmail, err)
+	}
+
+	resp, err := proxyHTTPClient(c.Proxy).PostForm(account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return gcpToken{}, fmt.Errorf("Error getting token for %s: %s", account.ClientEmail, err)
+	}
+	return parseGCPToken(resp, now)
+}
+
+// Gets the attached service account's token from the metadata server
+func (c gcpAuthConfig) metadataToken(now time.Time) (gcpToken, error) {
+	req, err := http.NewRequest("GET", gcpMetadataTokenURL+"?scopes="+url.QueryEscape(c.Scope), nil)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	// The metadata server is link-local, so it's never reached through a proxy
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return gcpToken{}, fmt.Errorf("No GCP credentials file given, and error getting token from the metadata server: %s", err)
+	}
+	return parseGCPToken(resp, now)
+}
+
+// Reads a token from a token endpoint's response
+func parseGCPToken(resp *http.Response, now time.Time) (gcpToken, error) {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	if resp.StatusCode != 200 {
+		return gcpToken{}, fmt.Errorf("Error getting GCP token: unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token gcpTokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return gcpToken{}, fmt.Errorf("Error parsing GCP token: %s", err)
+	}
+	return gcpToken{
+		AccessToken: token.AccessToken,
+		Expiration:  now.Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// Builds the signed JWT a service account exchanges for an access token
+func gcpAssertion(account gcpServiceAccountKey, scope string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("no PEM data found in private_key")
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return "", fmt.Errorf("private_key isn't an RSA key")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": account.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": scope,
+		"aud":   account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
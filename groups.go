@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// HandlerGroupConfig names a set of handlers, so that a combination used in several places
+// (such as paging and posting to chat) is defined once. A group's name can be given anywhere
+// a handler ID is accepted, and stands for all of its members.
+type HandlerGroupConfig struct {
+	Name    string
+	Members []string `mapstructure:"members"`
+
+	// The handler IDs the group stands for, with any nested groups expanded
+	handlerIDs []string
+}
+
+// Parse the raw handler group objects into the config. Members can be handlers (including the
+// teams') or other groups.
+func parseHandlerGroups(list *ast.ObjectList, config *Config) error {
+	config.HandlerGroups = make(map[string]HandlerGroupConfig)
+
+	for _, g := range list.Items {
+		name := g.Keys[0].Token.Value().(string)
+
+		var m map[string]interface{}
+		var group HandlerGroupConfig
+		if err := hcl.DecodeObject(&m, g.Val); err != nil {
+			return err
+		}
+
+		if err := mapstructure.WeakDecode(m, &group); err != nil {
+			return err
+		}
+		group.Name = name
+
+		// Handler IDs always contain a '.', so group names without one can't clash with them
+		if name == "" || strings.Contains(name, ".") {
+			return fmt.Errorf("Invalid name for handler group %s: must be non-empty and can't contain '.'", name)
+		}
+		if len(group.Members) == 0 {
+			return fmt.Errorf("No members given for handler group %s", name)
+		}
+
+		config.HandlerGroups[name] = group
+	}
+
+	// Resolve the members once all the groups are known, since they can refer to each other
+	for name, group := range config.HandlerGroups {
+		ids, err := config.resolveHandlerGroup(name, nil)
+		if err != nil {
+			return err
+		}
+		group.handlerIDs = ids
+		config.HandlerGroups[name] = group
+	}
+
+	return nil
+}
+
+// Returns the handler IDs of a group's members, expanding nested groups. The chain of groups
+// being expanded is used to catch cycles.
+func (c *Config) resolveHandlerGroup(name string, chain []string) ([]string, error) {
+	if contains(chain, name) {
+		return nil, fmt.Errorf("Handler group %s includes itself: %s", name, strings.Join(append(chain, name), " -> "))
+	}
+	chain = append(chain, name)
+
+	ids := make([]string, 0)
+	for _, member := range c.HandlerGroups[name].Members {
+		if _, ok := c.HandlerGroups[member]; ok {
+			nested, err := c.resolveHandlerGroup(member, chain)
+			if err != nil {
+				return nil, err
+			}
+			ids = appendUnique(ids, nested...)
+			continue
+		}
+		if _, ok := c.Handlers[member]; !ok {
+			return nil, fmt.Errorf("Unknown handler for handler group %s: %s", name, member)
+		}
+		ids = appendUnique(ids, member)
+	}
+	return ids, nil
+}
+
+// Replaces any handler group names in a list of handler IDs with the groups' members, keeping
+// the first occurrence of each ID. Names that aren't groups are left as they are.
+func (c *Config) expandHandlerGroups(ids []string) []string {
+	if len(c.HandlerGroups) == 0 || len(ids) == 0 {
+		return ids
+	}
+
+	expanded := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if group, ok := c.HandlerGroups[id]; ok {
+			expanded = appendUnique(expanded, group.handlerIDs...)
+		} else {
+			expanded = appendUnique(expanded, id)
+		}
+	}
+	return expanded
+}
+
+// Returns the handler IDs with any handler group names replaced by the groups' members
+func (c *Config) resolveHandlerIDs(ids []string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.expandHandlerGroups(ids)
+}
+
+// Appends the values not already in the list
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		if !contains(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
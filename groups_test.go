@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHandlerGroups_expansion(t *testing.T) {
+	config, err := ParseConfig(`
+	default_handlers = ["chat"]
+
+	handler "pagerduty" "ops" {
+		service_key = "abcd"
+	}
+
+	handler "slack" "alerts" {
+		api_token = "token"
+		channel_name = "alerts"
+	}
+
+	handler "stdout" "log" {}
+
+	handler_group "chat" {
+		members = ["slack.alerts"]
+	}
+
+	handler_group "oncall" {
+		members = ["pagerduty.ops", "chat"]
+	}
+
+	service "redis" {
+		handlers = ["oncall", "stdout.log"]
+	}
+
+	node_route "disks" {
+		checks = ["^disk"]
+		handlers = ["oncall"]
+	}
+
+	tier "page" {
+		handlers = ["oncall"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"pagerduty.ops", "slack.alerts", "stdout.log"}
+	if ids := config.serviceHandlerIDs("redis"); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected service handlers %v, got %v", expected, ids)
+	}
+
+	expected = []string{"slack.alerts"}
+	if ids := config.serviceHandlerIDs("webapp"); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected default handlers %v, got %v", expected, ids)
+	}
+
+	expected = []string{"pagerduty.ops", "slack.alerts"}
+	if ids := config.nodeRouteHandlerIDs("disks"); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected route handlers %v, got %v", expected, ids)
+	}
+	if ids := config.serviceTierHandlerIDs("webapp", TierPage); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected tier handlers %v, got %v", expected, ids)
+	}
+}
+
+func TestHandlerGroups_invalid(t *testing.T) {
+	cases := map[string]string{
+		`handler_group "oncall" {}`:                                                     "No members given for handler group oncall",
+		`handler_group "on.call" { members = ["stdout.log"] }`:                          "Invalid name for handler group on.call: must be non-empty and can't contain '.'",
+		`handler_group "oncall" { members = ["stdout.missing"] }`:                       "Unknown handler for handler group oncall: stdout.missing",
+		`handler_group "oncall" { members = ["oncall"] }`:                               "Handler group oncall includes itself: oncall -> oncall",
+		`tier "page" { handlers = ["oncall"] }`:                                         "Unknown handler for tier page: oncall",
+		`handler_group "a" { members = ["stdout.log"] }` + "\n" + `fatal_handler = "b"`: "Unknown handler for fatal_handler: b",
+	}
+
+	for raw, expected := range cases {
+		_, err := ParseConfig(`handler "stdout" "log" {}` + "\n" + raw)
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
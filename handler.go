@@ -1,23 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
 	"strings"
-
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/darkcrux/gopherduty"
 	"github.com/hashicorp/consul/api"
 	"github.com/nlopes/slack"
-	"gopkg.in/gomail.v2"
 )
 
 // AlertHandlers are responsible for alerting to some external endpoint
-// when given an alert (email, pagerduty, etc)
+// when given an alert (email, pagerduty, etc). An error is returned if the
+// alert couldn't be delivered after retrying.
 type AlertHandler interface {
-	Alert(datacenter string, alert *AlertState)
+	Alert(datacenter string, alert *AlertState) error
 }
 
 type StdoutHandler struct {
@@ -25,10 +30,10 @@ type StdoutHandler struct {
 	logger   *log.Logger
 }
 
-func (handler StdoutHandler) Alert(datacenter string, alert *AlertState) {
+func (handler StdoutHandler) Alert(datacenter string, alert *AlertState) error {
 	text := []string{alert.Message}
-	if alert.Details != "" {
-		text = append(text, strings.Split(alert.Details, "\n")...)
+	if details := detailsWithFields(alert); details != "" {
+		text = append(text, strings.Split(details, "\n")...)
 	}
 	for _, line := range text {
 		switch strings.ToLower(handler.LogLevel) {
@@ -46,87 +51,289 @@ func (handler StdoutHandler) Alert(datacenter string, alert *AlertState) {
 			handler.logger.Debug(line)
 		}
 	}
+
+	return nil
 }
 
-type EmailHandler struct {
-	Recipients []string `mapstructure:"recipients"`
-	MaxRetries int      `mapstructure:"max_retries"`
+type PagerdutyHandler struct {
+	ServiceKey string `mapstructure:"service_key"`
+	MaxRetries int    `mapstructure:"max_retries"`
+	Sandbox    bool   `mapstructure:"sandbox"`
+	Proxy      string `mapstructure:"proxy"`
+
+	// The PagerDuty severity and priority name to use for each status. Mapping severities
+	// sends events through the Events API v2, and priorities are set through the REST API.
+	Severities map[string]string `mapstructure:"severities"`
+	Priorities map[string]string `mapstructure:"priorities"`
+	APIToken   string            `mapstructure:"api_token"`
+	FromEmail  string            `mapstructure:"from_email"`
+
+	// Services whose incidents are left open for someone to resolve by hand when they recover
+	ManualResolve []string `mapstructure:"manual_resolve"`
 }
 
-func (handler EmailHandler) Alert(datacenter string, alert *AlertState) {
-	for _, recipient := range handler.Recipients {
-		// Get the mail server to use for this recipient
-		records, err := net.LookupMX(strings.Split(recipient, "@")[1])
-		if err != nil {
-			log.Error("Error looking up email server: ", err)
-			continue
-		}
+// The PagerDuty events API endpoint
+var pagerdutyEventsURL = "https://events.pagerduty.com/generic/2010-04-15/create_event.json"
+
+// The base delay between retries of a PagerDuty event, doubled on each retry
+const pagerdutyRetryInterval = 10 * time.Second
+
+// An event sent to the PagerDuty events API
+type pagerdutyEvent struct {
+	ServiceKey  string      `json:"service_key"`
+	EventType   string      `json:"event_type"`
+	IncidentKey string      `json:"incident_key,omitempty"`
+	Description string      `json:"description"`
+	Details     interface{} `json:"details"`
+}
+
+// PagerDuty deduplicates events for the same alert by their incident key
+func (handler PagerdutyHandler) Idempotent() bool {
+	return true
+}
+
+func (handler PagerdutyHandler) Alert(datacenter string, alert *AlertState) error {
+	// Informational alerts, like catalog audit findings and alerts downgraded during a
+	// deployment window, aren't worth paging anyone over
+	if alert.Status == InfoStatus {
+		log.Debugf("Not sending informational alert '%s' to PagerDuty", alert.Message)
+		return nil
+	}
+
+	if handler.manuallyResolved(alert) {
+		log.Infof("Not resolving PagerDuty incident for %s, which is resolved manually", alertName(alert))
+		return nil
+	}
 
-		m := gomail.NewMessage()
-		m.SetAddressHeader("From", "consul-alerting@noreply.com", "Consul Alerting")
-		m.SetAddressHeader("To", recipient, "")
+	var endpoint string
+	var event interface{}
+	var sandboxPayload map[string]interface{}
+	if len(handler.Severities) > 0 {
+		v2Event := handler.v2Event(datacenter, alert)
+		endpoint, event = pagerdutyEventsV2URL, v2Event
+		sandboxPayload = map[string]interface{}{
+			"routing_key":  "<redacted>",
+			"event_action": v2Event.EventAction,
+			"dedup_key":    v2Event.DedupKey,
+			"payload":      v2Event.Payload,
+		}
+	} else {
+		v1Event := &pagerdutyEvent{
+			ServiceKey:  handler.ServiceKey,
+			EventType:   "trigger",
+			IncidentKey: pagerdutyIncidentKey(datacenter, alert),
+			Description: alert.Message,
+			Details:     pagerdutyDetails(alert),
+		}
+		if alert.Status == api.HealthPassing {
+			v1Event.EventType = "resolve"
+		}
+		endpoint, event = pagerdutyEventsURL, v1Event
+		sandboxPayload = map[string]interface{}{
+			"service_key":  "<redacted>",
+			"event_type":   v1Event.EventType,
+			"incident_key": v1Event.IncidentKey,
+			"description":  v1Event.Description,
+			"details":      v1Event.Details,
+		}
+	}
 
-		m.SetHeader("Subject", alert.Message)
-		m.SetBody("text/plain", alert.Details)
+	if handler.Sandbox {
+		if priority, ok := handler.Priorities[alert.Status]; ok {
+			sandboxPayload["priority"] = priority
+		}
+		logSandboxPayload("pagerduty", "events.pagerduty.com", sandboxJSON(sandboxPayload))
+		return nil
+	}
 
-		d := gomail.NewPlainDialer(records[0].Host, 25, "", "")
+	// gopherduty only sends events through the default HTTP client, so events are posted
+	// directly when they need to go through a proxy or to the Events API v2
+	client := proxyHTTPClient(handler.Proxy)
+	if handler.Proxy == "" && len(handler.Severities) == 0 {
+		if err := handler.trigger(datacenter, alert); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		for tries := 0; tries <= handler.MaxRetries; tries++ {
+			if tries > 0 {
+				delay := pagerdutyRetryInterval << uint(tries-1)
+				log.Errorf("Retrying alert to PagerDuty in %s...", delay)
+				time.Sleep(delay)
+			}
 
-		tries := 0
-		for tries <= handler.MaxRetries {
-			if err := d.DialAndSend(m); err != nil {
-				log.Error("Error sending alert email: ", err)
-				log.Error("Retrying email in 5s...")
-				time.Sleep(5 * time.Second)
-				tries++
-			} else {
+			err = postPagerdutyEvent(client, endpoint, event)
+			if err == nil {
 				break
 			}
+			log.Errorf("Error sending alert to PagerDuty: %v (details: %v, message: %v)", err, alert.Details, alert.Message)
+		}
+		if err != nil {
+			return fmt.Errorf("error sending alert to PagerDuty: %s", err)
 		}
 	}
-}
 
-type PagerdutyHandler struct {
-	ServiceKey string `mapstructure:"service_key"`
-	MaxRetries int    `mapstructure:"max_retries"`
+	// The alert was delivered, so failing to set its priority isn't a failure to deliver it
+	if err := handler.setPriority(client, datacenter, alert); err != nil {
+		log.Errorf("Error setting PagerDuty priority for %s: %s", alertName(alert), err)
+	}
+	return nil
 }
 
-func (handler PagerdutyHandler) Alert(datacenter string, alert *AlertState) {
+// Triggers or resolves the alert's incident through gopherduty, which retries failed events
+// with an exponential delay starting at 10s
+func (handler PagerdutyHandler) trigger(datacenter string, alert *AlertState) error {
 	client := gopherduty.NewClient(handler.ServiceKey)
 	client.MaxRetry = handler.MaxRetries
 
-	// This key needs to be unique to the datacenter and service/node we're alerting on
-	incidentKey := datacenter + "-" + alert.Service + "-" + alert.Tag + "-" + alert.Node
+	incidentKey := pagerdutyIncidentKey(datacenter, alert)
+	details := pagerdutyDetails(alert)
 
 	var resp *gopherduty.PagerDutyResponse
 	if alert.Status != api.HealthPassing {
-		resp = client.Trigger(incidentKey, alert.Message, "", "", alert.Details)
+		resp = client.Trigger(incidentKey, alert.Message, "", "", details)
 	} else {
-		resp = client.Resolve(incidentKey, alert.Message, alert.Details)
+		resp = client.Resolve(incidentKey, alert.Message, details)
 	}
 
 	for _, err := range resp.Errors {
 		log.Errorf("Error sending alert to PagerDuty: %v (details: %v, message: %v)", err, alert.Details, alert.Message)
 	}
+
+	if resp.HasErrors() {
+		return fmt.Errorf("error sending alert to PagerDuty: %s", resp.Errors[len(resp.Errors)-1])
+	}
+	return nil
+}
+
+// Sends an event to a PagerDuty events API endpoint
+func postPagerdutyEvent(client *http.Client, endpoint string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status  string   `json:"status"`
+		Message string   `json:"message"`
+		Errors  []string `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, err)
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%s: %s", result.Message, strings.Join(result.Errors, ", "))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, result.Message)
+	}
+	return nil
+}
+
+// Returns the incident key for an alert, which needs to be unique to the datacenter and
+// service/node we're alerting on
+func pagerdutyIncidentKey(datacenter string, alert *AlertState) string {
+	return datacenter + "-" + alert.Service + "-" + alert.Tag + "-" + alert.Node
+}
+
+// Returns the custom details for a PagerDuty event. If the alert has failing checks, they're
+// included as a structured list so each check's status and output show up separately in the
+// incident, rather than as one block of text.
+func pagerdutyDetails(alert *AlertState) interface{} {
+	if len(alert.Checks) == 0 && len(alert.Fields) == 0 {
+		return alert.Details
+	}
+
+	details := map[string]interface{}{
+		"summary": alert.Details,
+	}
+	if len(alert.Checks) > 0 {
+		details["failing_checks"] = alert.Checks
+	}
+	for key, value := range alert.Fields {
+		if _, ok := details[key]; !ok {
+			details[key] = value
+		}
+	}
+	return details
 }
 
 type SlackHandler struct {
 	Token       string `mapstructure:"api_token"`
 	ChannelName string `mapstructure:"channel_name"`
 	MaxRetries  int    `mapstructure:"max_retries"`
+	Sandbox     bool   `mapstructure:"sandbox"`
+	Proxy       string `mapstructure:"proxy"`
+
+	// Tokens for other workspaces, keyed by team name or service:<name>, so each team's alerts
+	// are posted to its own workspace. Alerts without a scoped token use api_token.
+	Tokens map[string]string `mapstructure:"api_tokens"`
+
+	// An incoming webhook to post to instead of using the API, which posts to the channel
+	// the webhook was created for
+	WebhookURL string `mapstructure:"webhook_url"`
+
+	// The base URL of the Consul UI (such as https://consul.example.com/ui) to link alerts to
+	ConsulUIURL string `mapstructure:"consul_ui_url"`
+
+	// Post recoveries as replies in the thread of the alert they recover from, optionally
+	// marking the original message as resolved
+	ThreadRecoveries bool `mapstructure:"thread_recoveries"`
+	MarkResolved     bool `mapstructure:"mark_resolved"`
 }
 
-const slackMessageFormat = `
-*%s*
-%s
-`
+func (handler SlackHandler) Alert(datacenter string, alert *AlertState) error {
+	// The alert is summarized in an attachment colored by its status, followed by one
+	// attachment for each failing check
+	attachments := append([]slack.Attachment{handler.summaryAttachment(datacenter, alert)}, slackAttachments(alert)...)
+
+	// Recoveries go in the thread of the message for the alert they recover from
+	var thread SlackThread
+	if handler.ThreadRecoveries && alert.Status == api.HealthPassing {
+		thread = alert.SlackThreads[handler.ChannelName]
+	}
+
+	if handler.Sandbox {
+		target := handler.ChannelName
+		if handler.WebhookURL != "" {
+			target = "incoming webhook"
+		}
+		payload := map[string]interface{}{
+			"channel":     handler.ChannelName,
+			"attachments": attachments,
+		}
+		if thread.TS != "" {
+			payload["thread_ts"] = thread.TS
+		}
+		logSandboxPayload("slack", target, sandboxJSON(payload))
+		return nil
+	}
+
+	// Alerts are only posted with a token scoped to their team or service, or the default one
+	token := handler.token(alert)
+	if token == "" && handler.WebhookURL == "" {
+		log.Errorf("Not sending alert '%s' to Slack (channel: %s): no api_tokens entry for its team or service, and no api_token", alert.Message, handler.ChannelName)
+		return nil
+	}
 
-func (handler SlackHandler) Alert(datacenter string, alert *AlertState) {
-	api := slack.New(handler.Token)
-	message := fmt.Sprintf(slackMessageFormat, alert.Message, alert.Details)
 	tries := 0
 
+	var err error
+	var posted SlackThread
 	for tries <= handler.MaxRetries {
-		_, _, err := api.PostMessage(handler.ChannelName, message, slack.PostMessageParameters{})
+		if handler.WebhookURL != "" {
+			err = postSlackWebhook(proxyHTTPClient(handler.Proxy), handler.WebhookURL, attachments)
+		} else if handler.Proxy == "" && thread.TS == "" {
+			posted.Channel, posted.TS, err = slack.New(token).PostMessage(handler.ChannelName, "", slack.PostMessageParameters{Attachments: attachments})
+		} else {
+			posted, err = postSlackMessage(proxyHTTPClient(handler.Proxy), token, handler.ChannelName, "", attachments, thread.TS)
+		}
 
 		if err != nil {
 			log.Errorf("Error sending alert to Slack (channel: %s): %s", handler.ChannelName, err)
@@ -138,4 +345,238 @@ func (handler SlackHandler) Alert(datacenter string, alert *AlertState) {
 
 		tries++
 	}
+
+	if err == nil && handler.ThreadRecoveries {
+		handler.trackThread(alert, posted, thread)
+	}
+	return err
+}
+
+// Records the message a failing alert was posted in as the thread for its recovery, or closes
+// the thread once the recovery has been posted in it, marking the original message as resolved
+// if mark_resolved is set
+func (handler SlackHandler) trackThread(alert *AlertState, posted SlackThread, thread SlackThread) {
+	if alert.Status != api.HealthPassing {
+		thread = posted
+	} else if thread.TS != "" {
+		if handler.MarkResolved {
+			err := updateSlackMessage(proxyHTTPClient(handler.Proxy), handler.token(alert), thread, "\u2705 "+alert.Message)
+			if err != nil {
+				log.Errorf("Error marking Slack message as resolved (channel: %s): %s", handler.ChannelName, err)
+			}
+		}
+		thread = SlackThread{}
+	} else {
+		return
+	}
+
+	if alert.threads == nil {
+		log.Debugf("Not recording Slack thread for '%s', which isn't being sent from a watch", alert.Message)
+		return
+	}
+	alert.threads.record(handler.ChannelName, thread)
+}
+
+// Returns the token to post an alert with: the one in api_tokens for its service or team, or
+// api_token if it has none
+func (handler SlackHandler) token(alert *AlertState) string {
+	return scopedCredential(handler.Tokens, alert, handler.Token)
+}
+
+// Posts a message through Slack's chat.postMessage API. The slack package only sends requests
+// through a shared HTTP client and can't reply in a thread, so messages are posted directly to
+// use the handler's proxy or to reply to the alert's thread.
+// Link unfurling and markdown are turned off, as the slack package did with its zero-valued
+// message parameters. The message is posted as a reply if a thread timestamp is given, and the
+// channel ID and timestamp of the posted message are returned.
+func postSlackMessage(client *http.Client, token string, channel string, text string, attachments []slack.Attachment, threadTS string) (SlackThread, error) {
+	values := url.Values{
+		"token":        {token},
+		"channel":      {channel},
+		"text":         {text},
+		"unfurl_media": {"false"},
+		"mrkdwn":       {"false"},
+	}
+	if attachments != nil {
+		encoded, err := json.Marshal(attachments)
+		if err != nil {
+			return SlackThread{}, err
+		}
+		values.Set("attachments", string(encoded))
+	}
+	if threadTS != "" {
+		values.Set("thread_ts", threadTS)
+	}
+
+	var result struct {
+		slack.SlackResponse
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	}
+	if err := postSlackAPI(client, "chat.postMessage", values, &result); err != nil {
+		return SlackThread{}, err
+	}
+	if !result.Ok {
+		return SlackThread{}, errors.New(result.Error)
+	}
+	return SlackThread{Channel: result.Channel, TS: result.TS}, nil
+}
+
+// Replaces the text of a posted message through Slack's chat.update API, keeping its
+// attachments
+func updateSlackMessage(client *http.Client, token string, message SlackThread, text string) error {
+	values := url.Values{
+		"token":   {token},
+		"channel": {message.Channel},
+		"ts":      {message.TS},
+		"text":    {text},
+	}
+
+	var result slack.SlackResponse
+	if err := postSlackAPI(client, "chat.update", values, &result); err != nil {
+		return err
+	}
+	if !result.Ok {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+// Calls a Slack API method, decoding its response into result
+func postSlackAPI(client *http.Client, method string, values url.Values, result interface{}) error {
+	resp, err := client.PostForm(slack.SLACK_API+method, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, err)
+	}
+	return nil
+}
+
+// Posts a message to a Slack incoming webhook, which responds with "ok" or the reason the
+// message was rejected
+func postSlackWebhook(client *http.Client, webhookURL string, attachments []slack.Attachment) error {
+	body, err := json.Marshal(map[string]interface{}{"attachments": attachments})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// Checks that the handler has a token and channel to post with, or a webhook to post to
+func (handler SlackHandler) validate() error {
+	if handler.MarkResolved && !handler.ThreadRecoveries {
+		return fmt.Errorf("mark_resolved requires thread_recoveries")
+	}
+	if handler.WebhookURL != "" {
+		if handler.ThreadRecoveries {
+			return fmt.Errorf("thread_recoveries requires api_token, since webhooks can't reply in threads")
+		}
+		if handler.Token != "" || len(handler.Tokens) > 0 {
+			return fmt.Errorf("only one of api_token (or api_tokens) and webhook_url can be set")
+		}
+		if !strings.HasPrefix(handler.WebhookURL, "http://") && !strings.HasPrefix(handler.WebhookURL, "https://") {
+			return fmt.Errorf("webhook_url must be an http:// or https:// URL")
+		}
+		return nil
+	}
+	if (handler.Token == "" && len(handler.Tokens) == 0) || handler.ChannelName == "" {
+		return fmt.Errorf("api_token (or api_tokens) and channel_name are required unless webhook_url is set")
+	}
+	return nil
+}
+
+// Returns the attachment summarizing an alert, titled with its message and linked to its node
+// or service in the Consul UI. The alert's fields are shown as attachment fields, and its
+// details as text when there are no failing checks to show instead.
+func (handler SlackHandler) summaryAttachment(datacenter string, alert *AlertState) slack.Attachment {
+	attachment := slack.Attachment{
+		Color:     presentationColor(alert, alert.Status, slackColor(alert.Status)),
+		Fallback:  alert.Message,
+		Title:     alert.Message,
+		TitleLink: consulUILink(handler.ConsulUIURL, datacenter, alert),
+	}
+	if len(alert.Checks) == 0 {
+		attachment.Text = strings.TrimSpace(alert.Details)
+	}
+
+	keys := make([]string, 0, len(alert.Fields))
+	for key := range alert.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attachment.Fields = append(attachment.Fields, slack.AttachmentField{Title: key, Value: alert.Fields[key], Short: true})
+	}
+	return attachment
+}
+
+// Returns the Slack attachment color for a status: green when passing, yellow for warnings
+// and red when critical
+func slackColor(status string) string {
+	switch status {
+	case api.HealthCritical:
+		return "danger"
+	case api.HealthWarning:
+		return "warning"
+	case api.HealthPassing:
+		return "good"
+	default:
+		return ""
+	}
+}
+
+// Returns the link to an alert's service or node in the Consul UI under the given base URL,
+// or an empty string if there's no base URL or the alert has neither (such as for HTTP watches)
+func consulUILink(baseURL string, datacenter string, alert *AlertState) string {
+	if baseURL == "" {
+		return ""
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if alert.Service != "" {
+		return fmt.Sprintf("%s/%s/services/%s", baseURL, url.PathEscape(datacenter), url.PathEscape(alert.Service))
+	}
+	if alert.Node != "" {
+		return fmt.Sprintf("%s/%s/nodes/%s", baseURL, url.PathEscape(datacenter), url.PathEscape(alert.Node))
+	}
+	return ""
+}
+
+// Returns a Slack attachment for each of the alert's failing checks, colored by the check's
+// status (using the alert's presentation colors, if it has any)
+func slackAttachments(alert *AlertState) []slack.Attachment {
+	attachments := make([]slack.Attachment, 0, len(alert.Checks))
+	for _, check := range alert.Checks {
+		color := "danger"
+		if check.Status == api.HealthWarning {
+			color = "warning"
+		}
+		color = presentationColor(alert, check.Status, color)
+
+		attachments = append(attachments, slack.Attachment{
+			Color:    color,
+			Fallback: fmt.Sprintf("%s on %s is %s: %s", check.Name, check.Node, check.Status, check.Output),
+			Title:    presentationEmoji(alert, check.Status) + check.Name,
+			Text:     check.Output,
+			Fields: []slack.AttachmentField{
+				{Title: "Node", Value: check.Node, Short: true},
+				{Title: "Status", Value: check.Status, Short: true},
+			},
+		})
+	}
+	return attachments
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// AlertaHandler sends alerts to an Alerta server, using the datacenter as the environment and
+// the node or service as the resource. Status changes update the same Alerta alert, and
+// recoveries are sent with the normal severity so Alerta closes it.
+type AlertaHandler struct {
+	Endpoint   string `mapstructure:"endpoint"`
+	APIKey     string `mapstructure:"api_key"`
+	Event      string `mapstructure:"event"`
+	Origin     string `mapstructure:"origin"`
+	MaxRetries int    `mapstructure:"max_retries"`
+	Sandbox    bool   `mapstructure:"sandbox"`
+	Proxy      string `mapstructure:"proxy"`
+}
+
+// An alert in Alerta's API format
+type alertaAlert struct {
+	Resource    string            `json:"resource"`
+	Event       string            `json:"event"`
+	Environment string            `json:"environment"`
+	Severity    string            `json:"severity"`
+	Service     []string          `json:"service"`
+	Group       string            `json:"group"`
+	Value       string            `json:"value"`
+	Text        string            `json:"text"`
+	Origin      string            `json:"origin"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	RawData     string            `json:"rawData,omitempty"`
+}
+
+// Alerta deduplicates alerts by their environment, resource and event
+func (handler AlertaHandler) Idempotent() bool {
+	return true
+}
+
+func (handler AlertaHandler) Alert(datacenter string, alert *AlertState) error {
+	body, err := json.Marshal(handler.alertaAlert(datacenter, alert))
+	if err != nil {
+		return fmt.Errorf("Error forming Alerta alert: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("alerta", handler.Endpoint, string(body))
+		return nil
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if err = handler.post(body); err == nil {
+			return nil
+		}
+
+		log.Errorf("Error sending alert to Alerta (endpoint: %s): %s", handler.Endpoint, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying alert to Alerta in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler AlertaHandler) validate() error {
+	if !strings.HasPrefix(handler.Endpoint, "http://") && !strings.HasPrefix(handler.Endpoint, "https://") {
+		return fmt.Errorf("endpoint must be an http:// or https:// URL")
+	}
+	if handler.Event == "" {
+		return fmt.Errorf("event must be set")
+	}
+	return nil
+}
+
+// Returns the Alerta alert for an alert
+func (handler AlertaHandler) alertaAlert(datacenter string, alert *AlertState) *alertaAlert {
+	resource := alert.Node
+	services := []string{}
+	if alert.Service != "" {
+		resource = alert.Service
+		if alert.Tag != "" {
+			resource = resource + ":" + alert.Tag
+		}
+		services = append(services, alert.Service)
+	}
+	if alert.Route != "" {
+		resource = resource + "/" + alert.Route
+	}
+
+	attributes := make(map[string]string)
+	for name, value := range map[string]string{"node": alert.Node, "tag": alert.Tag, "route": alert.Route} {
+		if value != "" {
+			attributes[name] = value
+		}
+	}
+	for name, value := range alert.Labels {
+		attributes[name] = value
+	}
+	for name, value := range alert.Fields {
+		attributes[name] = value
+	}
+
+	return &alertaAlert{
+		Resource:    resource,
+		Event:       handler.Event,
+		Environment: datacenter,
+		Severity:    alertaSeverity(alert.Status),
+		Service:     services,
+		Group:       "Consul",
+		Value:       alert.Status,
+		Text:        alert.Message,
+		Origin:      handler.Origin,
+		Attributes:  attributes,
+		RawData:     alert.Details,
+	}
+}
+
+// Returns the Alerta severity for a status
+func alertaSeverity(status string) string {
+	switch status {
+	case api.HealthCritical:
+		return "critical"
+	case api.HealthWarning:
+		return "warning"
+	case api.HealthPassing:
+		return "normal"
+	case InfoStatus:
+		return "informational"
+	default:
+		return "indeterminate"
+	}
+}
+
+// Posts an alert to Alerta
+func (handler AlertaHandler) post(body []byte) error {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(handler.Endpoint, "/")+"/alert", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if handler.APIKey != "" {
+		req.Header.Set("Authorization", "Key "+handler.APIKey)
+	}
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
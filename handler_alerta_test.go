@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAlertaHandler_alert(t *testing.T) {
+	posted := make(chan alertaAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/alert" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Key secret" {
+			t.Errorf("unexpected authorization header %q", auth)
+		}
+		var alert alertaAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		posted <- alert
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "alerta" "ops" {
+		endpoint = "` + server.URL + `/api"
+		api_key = "secret"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{
+		Service: "redis",
+		Tag:     "primary",
+		Status:  api.HealthCritical,
+		Message: "[dc1] service redis (tag: primary) is now critical",
+		Details: "redis ping: connection refused",
+	}
+	if err := config.Handlers["alerta.ops"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := alertaAlert{
+		Resource:    "redis:primary",
+		Event:       "ConsulHealth",
+		Environment: "dc1",
+		Severity:    "critical",
+		Service:     []string{"redis"},
+		Group:       "Consul",
+		Value:       api.HealthCritical,
+		Text:        alert.Message,
+		Origin:      "consul-alerting",
+		Attributes:  map[string]string{"tag": "primary"},
+		RawData:     alert.Details,
+	}
+	if got := <-posted; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	// Recoveries are sent with the normal severity to close the alert
+	alert.Status = api.HealthPassing
+	if err := config.Handlers["alerta.ops"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-posted; got.Severity != "normal" || got.Resource != "redis:primary" {
+		t.Errorf("unexpected recovery: %+v", got)
+	}
+}
+
+func TestAlertaHandler_validate(t *testing.T) {
+	_, err := ParseConfig(`
+	handler "alerta" "ops" {
+		endpoint = "alerta.example.com"
+	}
+	`)
+	if err == nil {
+		t.Fatal("expected an error for an endpoint without a scheme")
+	}
+}
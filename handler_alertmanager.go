@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The path of Alertmanager's API for posting alerts
+const alertmanagerAlertsPath = "/api/v2/alerts"
+
+// AlertmanagerHandler posts alerts to a Prometheus Alertmanager, so that routing, silencing
+// and inhibition can be done there. The alert's identity (datacenter, service, node, tag and
+// route) is sent as labels and its status as an annotation, so a status change updates the
+// same Alertmanager alert instead of starting a new one.
+type AlertmanagerHandler struct {
+	Address       string            `mapstructure:"address"`
+	AlertName     string            `mapstructure:"alert_name"`
+	Labels        map[string]string `mapstructure:"labels"`
+	ActiveTimeout int               `mapstructure:"active_timeout"`
+	MaxRetries    int               `mapstructure:"max_retries"`
+	Sandbox       bool              `mapstructure:"sandbox"`
+	Proxy         string            `mapstructure:"proxy"`
+}
+
+// An alert in Alertmanager's API format
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    string            `json:"startsAt,omitempty"`
+	EndsAt      string            `json:"endsAt,omitempty"`
+}
+
+// Alertmanager deduplicates alerts by their labels
+func (handler AlertmanagerHandler) Idempotent() bool {
+	return true
+}
+
+func (handler AlertmanagerHandler) Alert(datacenter string, alert *AlertState) error {
+	body, err := json.Marshal([]alertmanagerAlert{handler.alertmanagerAlert(datacenter, alert, time.Now())})
+	if err != nil {
+		return fmt.Errorf("Error forming Alertmanager alert: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("alertmanager", handler.Address, string(body))
+		return nil
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if err = handler.post(body); err == nil {
+			return nil
+		}
+
+		log.Errorf("Error sending alert to Alertmanager (address: %s): %s", handler.Address, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying alert to Alertmanager in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler AlertmanagerHandler) validate() error {
+	if !strings.HasPrefix(handler.Address, "http://") && !strings.HasPrefix(handler.Address, "https://") {
+		return fmt.Errorf("address must be an http:// or https:// URL")
+	}
+	if handler.AlertName == "" {
+		return fmt.Errorf("alert_name must be set")
+	}
+	if handler.ActiveTimeout <= 0 {
+		return fmt.Errorf("invalid active_timeout: %d", handler.ActiveTimeout)
+	}
+	return nil
+}
+
+// Returns the Alertmanager alert for an alert. Failing alerts start when their status changed
+// and stay active for the active timeout unless they're resent (such as by a reminder) or
+// resolved, in case the recovery is never sent. Recoveries end the alert when the status changed.
+func (handler AlertmanagerHandler) alertmanagerAlert(datacenter string, alert *AlertState, now time.Time) alertmanagerAlert {
+	labels := map[string]string{"alertname": handler.AlertName}
+	for name, value := range handler.Labels {
+		labels[name] = value
+	}
+	for name, value := range map[string]string{
+		"datacenter": datacenter,
+		"service":    alert.Service,
+		"node":       alert.Node,
+		"tag":        alert.Tag,
+		"route":      alert.Route,
+	} {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	for name, value := range alert.Labels {
+		labels[name] = value
+	}
+
+	changed := now
+	if alert.Changed != 0 {
+		changed = time.Unix(alert.Changed, 0)
+	}
+
+	amAlert := alertmanagerAlert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary":     alert.Message,
+			"description": alert.Details,
+			"status":      alert.Status,
+		},
+	}
+	for name, value := range alert.Fields {
+		if _, ok := amAlert.Annotations[name]; !ok {
+			amAlert.Annotations[name] = value
+		}
+	}
+	if alert.Status == api.HealthPassing {
+		amAlert.EndsAt = changed.UTC().Format(time.RFC3339)
+	} else {
+		amAlert.StartsAt = changed.UTC().Format(time.RFC3339)
+		amAlert.EndsAt = now.Add(time.Duration(handler.ActiveTimeout) * time.Second).UTC().Format(time.RFC3339)
+	}
+	return amAlert
+}
+
+// Posts alerts to Alertmanager
+func (handler AlertmanagerHandler) post(body []byte) error {
+	resp, err := proxyHTTPClient(handler.Proxy).Post(strings.TrimSuffix(handler.Address, "/")+alertmanagerAlertsPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAlertmanagerHandler_alert(t *testing.T) {
+	posted := make(chan []alertmanagerAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != alertmanagerAlertsPath {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		var alerts []alertmanagerAlert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Error(err)
+		}
+		posted <- alerts
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "alertmanager" "prod" {
+		address = "` + server.URL + `"
+		max_retries = 0
+		labels {
+			team = "infra"
+		}
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	alert := &AlertState{
+		Service: "redis",
+		Tag:     "primary",
+		Status:  api.HealthCritical,
+		Message: "[dc1] service redis (tag: primary) is now critical",
+		Details: "redis ping: connection refused",
+		Changed: changed.Unix(),
+	}
+	if err := config.Handlers["alertmanager.prod"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := <-posted
+	if len(alerts) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(alerts))
+	}
+	expectedLabels := map[string]string{
+		"alertname":  "ConsulHealth",
+		"team":       "infra",
+		"datacenter": "dc1",
+		"service":    "redis",
+		"tag":        "primary",
+	}
+	if !reflect.DeepEqual(alerts[0].Labels, expectedLabels) {
+		t.Errorf("expected labels %v, got %v", expectedLabels, alerts[0].Labels)
+	}
+	if alerts[0].Annotations["status"] != api.HealthCritical || alerts[0].StartsAt != "2020-01-01T12:00:00Z" || alerts[0].EndsAt == "" {
+		t.Errorf("unexpected alert: %+v", alerts[0])
+	}
+
+	// Recoveries end the alert when the status changed
+	alert.Status = api.HealthPassing
+	alert.Changed = changed.Add(time.Hour).Unix()
+	if err := config.Handlers["alertmanager.prod"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	alerts = <-posted
+	if alerts[0].StartsAt != "" || alerts[0].EndsAt != "2020-01-01T13:00:00Z" {
+		t.Errorf("unexpected recovery: %+v", alerts[0])
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The Azure services alerts can be sent to
+const (
+	AzureEventHub = "event_hub"
+	AzureMonitor  = "monitor"
+)
+
+var azureTargets = []string{AzureEventHub, AzureMonitor}
+
+// The scope of the tokens for the Logs Ingestion API
+const azureMonitorScope = "https://monitor.azure.com/"
+
+// How long the shared access signatures for Event Hubs are valid for
+const azureSASLifetime = time.Hour
+
+// Microsoft Entra ID's login endpoint, and the instance metadata endpoint for the managed
+// identity's token. Vars so tests can point them elsewhere.
+var (
+	azureLoginURL      = "https://login.microsoftonline.com"
+	azureIMDSTokenURL  = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureTokenLifetime = time.Hour
+)
+
+// Access tokens shared between handlers and kept across reloads, keyed by the tenant, client
+// (empty for the managed identity) and scope
+var azureTokens = struct {
+	lock  sync.Mutex
+	cache map[string]gcpToken
+}{cache: make(map[string]gcpToken)}
+
+// AzureHandler sends alerts to Azure, either as events on an Event Hub (authenticated with a
+// shared access policy) or as rows in a Log Analytics table through the Logs Ingestion API
+// (authenticated with an app registration's client secret, or the managed identity if no
+// secret is given), so Azure-hosted clusters can feed alerts into their own pipelines.
+type AzureHandler struct {
+	Target string `mapstructure:"target"`
+
+	// Event Hubs settings
+	Namespace string `mapstructure:"namespace"`
+	EventHub  string `mapstructure:"event_hub"`
+	KeyName   string `mapstructure:"key_name"`
+	Key       string `mapstructure:"key"`
+
+	// Logs Ingestion API settings
+	DataCollectionEndpoint string `mapstructure:"data_collection_endpoint"`
+	RuleID                 string `mapstructure:"rule_id"`
+	Stream                 string `mapstructure:"stream"`
+	TenantID               string `mapstructure:"tenant_id"`
+	ClientID               string `mapstructure:"client_id"`
+	ClientSecret           string `mapstructure:"client_secret"`
+
+	// Overrides the Event Hubs namespace's URL, such as for testing
+	Endpoint string `mapstructure:"endpoint"`
+
+	MaxRetries int    `mapstructure:"max_retries"`
+	Sandbox    bool   `mapstructure:"sandbox"`
+	Proxy      string `mapstructure:"proxy"`
+}
+
+// The alert as sent to either service. The field names are the column names a data
+// collection rule's stream has to declare.
+type azureAlert struct {
+	TimeGenerated string            `json:"TimeGenerated"`
+	Datacenter    string            `json:"Datacenter"`
+	Node          string            `json:"Node"`
+	Service       string            `json:"Service"`
+	Tag           string            `json:"Tag"`
+	Route         string            `json:"Route"`
+	Status        string            `json:"Status"`
+	Message       string            `json:"Message"`
+	Details       string            `json:"Details"`
+	Fields        map[string]string `json:"Fields,omitempty"`
+}
+
+func (handler AzureHandler) Alert(datacenter string, alert *AlertState) error {
+	record := azureAlert{
+		TimeGenerated: time.Now().UTC().Format(time.RFC3339),
+		Datacenter:    datacenter,
+		Node:          alert.Node,
+		Service:       alert.Service,
+		Tag:           alert.Tag,
+		Route:         alert.Route,
+		Status:        alert.Status,
+		Message:       alert.Message,
+		Details:       alert.Details,
+		Fields:        alert.Fields,
+	}
+
+	// The Logs Ingestion API takes a list of rows, Event Hubs a single event
+	var body []byte
+	var err error
+	if handler.Target == AzureMonitor {
+		body, err = json.Marshal([]azureAlert{record})
+	} else {
+		body, err = json.Marshal(record)
+	}
+	if err != nil {
+		return fmt.Errorf("Error forming Azure alert: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("azure", handler.destination(), string(body))
+		return nil
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if handler.Target == AzureMonitor {
+			err = handler.ingest(body, time.Now())
+		} else {
+			err = handler.sendEvent(body, alertPartitionKey(alert), time.Now())
+		}
+		if err == nil {
+			return nil
+		}
+
+		log.Errorf("Error sending alert to Azure (%s): %s", handler.destination(), err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying alert to Azure in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler AzureHandler) validate() error {
+	switch handler.Target {
+	case AzureEventHub:
+		if handler.Namespace == "" && handler.Endpoint == "" {
+			return fmt.Errorf("namespace must be set")
+		}
+		if handler.EventHub == "" {
+			return fmt.Errorf("event_hub must be set")
+		}
+		if handler.KeyName == "" || handler.Key == "" {
+			return fmt.Errorf("key_name and key must be set")
+		}
+	case AzureMonitor:
+		if !strings.HasPrefix(handler.DataCollectionEndpoint, "http://") && !strings.HasPrefix(handler.DataCollectionEndpoint, "https://") {
+			return fmt.Errorf("data_collection_endpoint must be an http:// or https:// URL")
+		}
+		if handler.RuleID == "" || handler.Stream == "" {
+			return fmt.Errorf("rule_id and stream must be set")
+		}
+		if handler.ClientSecret != "" && (handler.TenantID == "" || handler.ClientID == "") {
+			return fmt.Errorf("tenant_id and client_id must be set with client_secret")
+		}
+	default:
+		return fmt.Errorf("target must be one of %v", azureTargets)
+	}
+	return nil
+}
+
+// Returns where the handler sends alerts, for logging
+func (handler AzureHandler) destination() string {
+	if handler.Target == AzureMonitor {
+		return handler.ingestionURL()
+	}
+	return handler.eventHubURL()
+}
+
+// Returns the URL of the Event Hub
+func (handler AzureHandler) eventHubURL() string {
+	base := handler.Endpoint
+	if base == "" {
+		base = "https://" + handler.Namespace + ".servicebus.windows.net"
+	}
+	return strings.TrimSuffix(base, "/") + "/" + handler.EventHub
+}
+
+// Returns the Logs Ingestion API URL for the handler's rule and stream
+func (handler AzureHandler) ingestionURL() string {
+	return fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=2023-01-01",
+		strings.TrimSuffix(handler.DataCollectionEndpoint, "/"), handler.RuleID, handler.Stream)
+}
+
+// Returns the key to partition an alert's events by, so each entity's alerts stay in order
+func alertPartitionKey(alert *AlertState) string {
+	key := alert.Node
+	if alert.Service != "" {
+		key = alert.Service
+		if alert.Tag != "" {
+			key = key + ":" + alert.Tag
+		}
+	}
+	if alert.Route != "" {
+		key = key + "/" + alert.Route
+	}
+	return key
+}
+
+// Sends an event to the Event Hub
+func (handler AzureHandler) sendEvent(body []byte, partitionKey string, now time.Time) error {
+	resource := handler.eventHubURL()
+	req, err := http.NewRequest("POST", resource+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	properties, _ := json.Marshal(map[string]string{"PartitionKey": partitionKey})
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("BrokerProperties", string(properties))
+	req.Header.Set("Authorization", azureSAS(resource, handler.KeyName, handler.Key, now.Add(azureSASLifetime)))
+
+	return azureDo(req, handler.Proxy)
+}
+
+// Sends rows to the Logs Ingestion API
+func (handler AzureHandler) ingest(body []byte, now time.Time) error {
+	token, err := handler.token(now)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", handler.ingestionURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return azureDo(req, handler.Proxy)
+}
+
+// Returns an access token for the Logs Ingestion API, from the app registration's client
+// secret if one is set, or else the managed identity
+func (handler AzureHandler) token(now time.Time) (string, error) {
+	key := handler.TenantID + "/" + handler.ClientID + "/" + azureMonitorScope
+	azureTokens.lock.Lock()
+	defer azureTokens.lock.Unlock()
+
+	if cached, ok := azureTokens.cache[key]; ok && now.Add(gcpTokenRefreshWindow).Before(cached.Expiration) {
+		return cached.AccessToken, nil
+	}
+
+	var resp *http.Response
+	var err error
+	if handler.ClientSecret != "" {
+		resp, err = proxyHTTPClient(handler.Proxy).PostForm(azureLoginURL+"/"+handler.TenantID+"/oauth2/v2.0/token", url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {handler.ClientID},
+			"client_secret": {handler.ClientSecret},
+			"scope":         {azureMonitorScope + ".default"},
+		})
+	} else {
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureMonitorScope}}
+		if handler.ClientID != "" {
+			query.Set("client_id", handler.ClientID)
+		}
+		var req *http.Request
+		if req, err = http.NewRequest("GET", azureIMDSTokenURL+"?"+query.Encode(), nil); err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata", "true")
+
+		// The metadata endpoint is link-local, so it's never reached through a proxy
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error getting Azure token: %s", err)
+	}
+
+	token, err := parseAzureToken(resp, now)
+	if err != nil {
+		return "", err
+	}
+	azureTokens.cache[key] = token
+	return token.AccessToken, nil
+}
+
+// Reads a token from Entra ID's or the metadata endpoint's response. The metadata endpoint
+// returns expires_in as a string.
+func parseAzureToken(resp *http.Response, now time.Time) (gcpToken, error) {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	if resp.StatusCode != 200 {
+		return gcpToken{}, fmt.Errorf("Error getting Azure token: unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return gcpToken{}, fmt.Errorf("Error parsing Azure token: %s", err)
+	}
+
+	lifetime := azureTokenLifetime
+	if seconds, err := token.ExpiresIn.Int64(); err == nil {
+		lifetime = time.Duration(seconds) * time.Second
+	}
+	return gcpToken{AccessToken: token.AccessToken, Expiration: now.Add(lifetime)}, nil
+}
+
+// Builds a shared access signature for a resource, signed with a shared access policy's key
+func azureSAS(resource string, keyName string, key string, expiry time.Time) string {
+	uri := strings.ToLower(url.QueryEscape(resource))
+	se := strconv.FormatInt(expiry.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(uri + "\n" + se))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", uri, url.QueryEscape(signature), se, keyName)
+}
+
+// Sends a request to Azure, checking the response code
+func azureDo(req *http.Request, proxy string) error {
+	resp, err := proxyHTTPClient(proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAzureHandler_eventHub(t *testing.T) {
+	received := make(chan azureAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alerts/messages" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "SharedAccessSignature sr=") || !strings.HasSuffix(auth, "&skn=send") {
+			t.Errorf("unexpected authorization header %q", auth)
+		}
+		if properties := r.Header.Get("BrokerProperties"); properties != `{"PartitionKey":"redis:primary"}` {
+			t.Errorf("unexpected broker properties %q", properties)
+		}
+		var event azureAlert
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "azure" "hub" {
+		event_hub = "alerts"
+		key_name = "send"
+		key = "secret"
+		endpoint = "` + server.URL + `"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{Node: "node1", Service: "redis", Tag: "primary", Status: api.HealthCritical, Message: "redis is critical"}
+	if err := config.Handlers["azure.hub"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-received
+	if event.Datacenter != "dc1" || event.Service != "redis" || event.Status != api.HealthCritical || event.TimeGenerated == "" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
+
+func TestAzureHandler_monitor(t *testing.T) {
+	login := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tenant1/oauth2/v2.0/token" {
+			t.Errorf("unexpected token request to %s", r.URL.Path)
+		}
+		if r.FormValue("client_secret") != "secret" || r.FormValue("scope") != "https://monitor.azure.com/.default" {
+			t.Errorf("unexpected token request: %v", r.Form)
+		}
+		w.Write([]byte(`{"access_token": "monitor-token", "expires_in": 3600}`))
+	}))
+	defer login.Close()
+	defer func(url string) { azureLoginURL = url }(azureLoginURL)
+	azureLoginURL = login.URL
+
+	received := make(chan []azureAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dataCollectionRules/dcr-1234/streams/Custom-ConsulAlerts_CL" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer monitor-token" {
+			t.Errorf("unexpected authorization header %q", auth)
+		}
+		var rows []azureAlert
+		if err := json.NewDecoder(r.Body).Decode(&rows); err != nil {
+			t.Error(err)
+		}
+		received <- rows
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	handler := AzureHandler{
+		Target:                 AzureMonitor,
+		DataCollectionEndpoint: server.URL,
+		RuleID:                 "dcr-1234",
+		Stream:                 "Custom-ConsulAlerts_CL",
+		TenantID:               "tenant1",
+		ClientID:               "client1",
+		ClientSecret:           "secret",
+	}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.Alert("dc1", &AlertState{Node: "node1", Status: api.HealthWarning}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := <-received
+	if len(rows) != 1 || rows[0].Node != "node1" || rows[0].Status != api.HealthWarning {
+		t.Errorf("unexpected rows: %+v", rows)
+	}
+}
+
+func TestAzureHandler_sas(t *testing.T) {
+	// The resource is URL-encoded in the signature, and decodes back to the original
+	sas := azureSAS("https://myns.servicebus.windows.net/alerts", "send", "secret", time.Unix(1700000000, 0))
+	values, err := url.ParseQuery(strings.TrimPrefix(sas, "SharedAccessSignature "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("sr") != "https://myns.servicebus.windows.net/alerts" || values.Get("se") != "1700000000" || values.Get("skn") != "send" {
+		t.Errorf("unexpected signature fields: %s", sas)
+	}
+	if values.Get("sig") == "" {
+		t.Errorf("missing signature: %s", sas)
+	}
+}
+
+func TestAzureHandler_validate(t *testing.T) {
+	cases := []string{
+		`handler "azure" "hub" { namespace = "myns", event_hub = "alerts" }`,
+		`handler "azure" "logs" { target = "monitor", data_collection_endpoint = "https://dce.example.com", rule_id = "dcr-1234" }`,
+		`handler "azure" "logs" { target = "monitor", data_collection_endpoint = "https://dce.example.com", rule_id = "dcr-1234", stream = "Custom-Alerts_CL", client_secret = "secret" }`,
+		`handler "azure" "other" { target = "blob" }`,
+	}
+	for _, raw := range cases {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Cachet's component statuses
+const (
+	cachetOperational       = 1
+	cachetPerformanceIssues = 2
+	cachetPartialOutage     = 3
+	cachetMajorOutage       = 4
+)
+
+// Cachet's incident statuses, of which the handler uses investigating and fixed
+const (
+	cachetInvestigating = 1
+	cachetFixed         = 4
+)
+
+// CachetHandler updates the status of components on a Cachet status page to match the health
+// of the services they're mapped to, optionally opening an incident while a service is
+// critical. Components are identified by their numeric IDs in Cachet.
+type CachetHandler struct {
+	URL            string         `mapstructure:"url"`
+	APIToken       string         `mapstructure:"api_token"`
+	Components     map[string]int `mapstructure:"components"`
+	WarningStatus  int            `mapstructure:"warning_status"`
+	CriticalStatus int            `mapstructure:"critical_status"`
+	OpenIncidents  bool           `mapstructure:"open_incidents"`
+	MaxRetries     int            `mapstructure:"max_retries"`
+	Sandbox        bool           `mapstructure:"sandbox"`
+	Proxy          string         `mapstructure:"proxy"`
+}
+
+type cachetIncident struct {
+	ID              int    `json:"id,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Message         string `json:"message,omitempty"`
+	Status          int    `json:"status,omitempty"`
+	Visible         int    `json:"visible,omitempty"`
+	ComponentID     int    `json:"component_id,omitempty"`
+	ComponentStatus int    `json:"component_status,omitempty"`
+}
+
+// Setting a component's status twice has the same effect as setting it once, but sending an
+// alert again with open_incidents can open or fix the service's incident twice
+func (handler CachetHandler) Idempotent() bool {
+	return !handler.OpenIncidents
+}
+
+func (handler CachetHandler) Alert(datacenter string, alert *AlertState) error {
+	// Only services can be mapped to components
+	componentID, ok := handler.Components[alert.Service]
+	if alert.Service == "" || !ok {
+		return nil
+	}
+
+	status := handler.componentStatus(alert.Status)
+	err := handler.withRetries("updating component status", func() error {
+		return handler.request("PUT", fmt.Sprintf("/api/v1/components/%d", componentID), map[string]int{"status": status}, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !handler.OpenIncidents {
+		return nil
+	}
+
+	name := statuspageIncidentName(datacenter, alert)
+	switch alert.Status {
+	case api.HealthCritical:
+		return handler.withRetries("opening incident", func() error {
+			return handler.openIncident(name, alert.Details, componentID, status)
+		})
+	case api.HealthPassing:
+		return handler.withRetries("resolving incident", func() error {
+			return handler.resolveIncidents(name, alert.Message)
+		})
+	}
+
+	return nil
+}
+
+// Checks that the handler's settings are usable
+func (handler CachetHandler) validate() error {
+	if !strings.HasPrefix(handler.URL, "http://") && !strings.HasPrefix(handler.URL, "https://") {
+		return fmt.Errorf("url must be an http:// or https:// URL")
+	}
+	if handler.APIToken == "" {
+		return fmt.Errorf("api_token must be set")
+	}
+	if len(handler.Components) == 0 {
+		return fmt.Errorf("components must map at least one service to a component ID")
+	}
+	for service, componentID := range handler.Components {
+		if componentID <= 0 {
+			return fmt.Errorf("component ID for service %s must be a positive number", service)
+		}
+	}
+	for option, status := range map[string]int{"warning_status": handler.WarningStatus, "critical_status": handler.CriticalStatus} {
+		if status < cachetOperational || status > cachetMajorOutage {
+			return fmt.Errorf("%s must be between %d and %d, got %d", option, cachetOperational, cachetMajorOutage, status)
+		}
+	}
+	return nil
+}
+
+// Maps a Consul health status to the Cachet component status to use for it
+func (handler CachetHandler) componentStatus(health string) int {
+	switch health {
+	case api.HealthCritical:
+		return handler.CriticalStatus
+	case api.HealthWarning:
+		return handler.WarningStatus
+	default:
+		return cachetOperational
+	}
+}
+
+// Opens an incident for a component, unless one with the same name is still unresolved
+func (handler CachetHandler) openIncident(name string, message string, componentID int, status int) error {
+	open, err := handler.unresolvedIncidents(name)
+	if err != nil {
+		return err
+	}
+	if len(open) > 0 {
+		return nil
+	}
+
+	// Cachet requires a message
+	if message == "" {
+		message = name
+	}
+	incident := cachetIncident{
+		Name:            name,
+		Message:         message,
+		Status:          cachetInvestigating,
+		Visible:         1,
+		ComponentID:     componentID,
+		ComponentStatus: status,
+	}
+	return handler.request("POST", "/api/v1/incidents", incident, nil)
+}
+
+// Marks any unresolved incidents with the given name as fixed
+func (handler CachetHandler) resolveIncidents(name string, message string) error {
+	open, err := handler.unresolvedIncidents(name)
+	if err != nil {
+		return err
+	}
+
+	for _, incident := range open {
+		update := map[string]interface{}{"status": cachetFixed, "message": message}
+		if err := handler.request("POST", fmt.Sprintf("/api/v1/incidents/%d/updates", incident.ID), update, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the incidents with the given name that haven't been fixed
+func (handler CachetHandler) unresolvedIncidents(name string) ([]cachetIncident, error) {
+	var result struct {
+		Data []cachetIncident `json:"data"`
+	}
+	query := url.Values{"name": []string{name}, "per_page": []string{"100"}}
+	if err := handler.request("GET", "/api/v1/incidents?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+
+	open := make([]cachetIncident, 0)
+	for _, incident := range result.Data {
+		if incident.Name == name && incident.Status != cachetFixed {
+			open = append(open, incident)
+		}
+	}
+	return open, nil
+}
+
+// Runs the given function, retrying up to MaxRetries times if it fails
+func (handler CachetHandler) withRetries(action string, f func() error) error {
+	var err error
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		err = f()
+		if err == nil {
+			return nil
+		}
+
+		log.Errorf("Error %s on Cachet (url: %s): %s", action, handler.URL, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying Cachet request in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Makes a request to the Cachet API, decoding the response into result if it's non-nil
+func (handler CachetHandler) request(method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	if handler.Sandbox {
+		// Lookups are left out, so only the changes that would be made are logged
+		if method != "GET" {
+			logSandboxPayload("cachet", method+" "+handler.URL+path, string(payload))
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(handler.URL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Cachet-Token", handler.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if result != nil {
+		return json.Unmarshal(respBody, result)
+	}
+
+	return nil
+}
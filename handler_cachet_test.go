@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+type testCachetRequest struct {
+	method string
+	path   string
+	body   map[string]interface{}
+}
+
+// Starts a fake Cachet API that records the changes made to it, and keeps track of the
+// incidents opened and fixed through it
+func testCachetServer(t *testing.T) (*httptest.Server, func() []testCachetRequest) {
+	var lock sync.Mutex
+	requests := make([]testCachetRequest, 0)
+	incidents := make([]cachetIncident, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Cachet-Token"); token != "testtoken" {
+			t.Errorf("bad token header: %s", token)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if r.Method == "GET" && r.URL.Path == "/api/v1/incidents" {
+			matching := make([]cachetIncident, 0)
+			for _, incident := range incidents {
+				if incident.Name == r.URL.Query().Get("name") {
+					matching = append(matching, incident)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": matching})
+			return
+		}
+
+		req := testCachetRequest{method: r.Method, path: r.URL.Path}
+		raw, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(raw, &req.body); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, req)
+
+		switch {
+		case r.URL.Path == "/api/v1/incidents":
+			var incident cachetIncident
+			json.Unmarshal(raw, &incident)
+			incident.ID = len(incidents) + 1
+			incidents = append(incidents, incident)
+		case r.URL.Path == "/api/v1/incidents/1/updates":
+			incidents[0].Status = cachetFixed
+		}
+		w.Write([]byte(`{"data": {}}`))
+	}))
+
+	return server, func() []testCachetRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func testCachetHandler(url string) CachetHandler {
+	return CachetHandler{
+		URL:            url,
+		APIToken:       "testtoken",
+		Components:     map[string]int{"redis": 7},
+		WarningStatus:  cachetPerformanceIssues,
+		CriticalStatus: cachetMajorOutage,
+		OpenIncidents:  true,
+	}
+}
+
+func TestHandler_cachet(t *testing.T) {
+	server, requests := testCachetServer(t)
+	defer server.Close()
+	handler := testCachetHandler(server.URL)
+
+	critical := &AlertState{Service: "redis", Status: api.HealthCritical, Details: "connection refused"}
+	if err := handler.Alert("dc1", critical); err != nil {
+		t.Fatal(err)
+	}
+	// Sending the alert again doesn't open a second incident
+	if err := handler.Alert("dc1", critical); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthPassing, Message: "redis is now passing"}); err != nil {
+		t.Fatal(err)
+	}
+	// Unmapped services and nodes are ignored
+	handler.Alert("dc1", &AlertState{Service: "web", Status: api.HealthCritical})
+	handler.Alert("dc1", &AlertState{Node: "node1", Status: api.HealthCritical})
+
+	expected := []struct {
+		method, path string
+		status       float64
+	}{
+		{"PUT", "/api/v1/components/7", cachetMajorOutage},
+		{"POST", "/api/v1/incidents", cachetInvestigating},
+		{"PUT", "/api/v1/components/7", cachetMajorOutage},
+		{"PUT", "/api/v1/components/7", cachetOperational},
+		{"POST", "/api/v1/incidents/1/updates", cachetFixed},
+	}
+	reqs := requests()
+	if len(reqs) != len(expected) {
+		t.Fatalf("expected %d requests, got %+v", len(expected), reqs)
+	}
+	for i, req := range reqs {
+		if req.method != expected[i].method || req.path != expected[i].path || req.body["status"] != expected[i].status {
+			t.Errorf("request %d: expected %s %s with status %v, got %s %s %v", i, expected[i].method, expected[i].path, expected[i].status, req.method, req.path, req.body)
+		}
+	}
+
+	incident := reqs[1].body
+	if incident["name"] != "[dc1] redis outage" || incident["message"] != "connection refused" ||
+		incident["component_id"] != 7.0 || incident["component_status"] != float64(cachetMajorOutage) {
+		t.Errorf("unexpected incident: %v", incident)
+	}
+}
+
+func TestHandler_cachetValidate(t *testing.T) {
+	if err := testCachetHandler("https://status.example.com").validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []func(*CachetHandler){
+		func(h *CachetHandler) { h.URL = "status.example.com" },
+		func(h *CachetHandler) { h.APIToken = "" },
+		func(h *CachetHandler) { h.Components = nil },
+		func(h *CachetHandler) { h.Components = map[string]int{"redis": 0} },
+		func(h *CachetHandler) { h.CriticalStatus = 5 },
+		func(h *CachetHandler) { h.WarningStatus = 0 },
+	}
+	for i, modify := range cases {
+		handler := testCachetHandler("https://status.example.com")
+		modify(&handler)
+		if err := handler.validate(); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulEventHandler fires a Consul user event for each alert, with the serialized AlertState
+// as the payload, so that watches elsewhere in the cluster (such as `consul watch -type event`)
+// can react to health changes without a separate message bus.
+type ConsulEventHandler struct {
+	Name          string `mapstructure:"name"`
+	Address       string `mapstructure:"address"`
+	Token         string `mapstructure:"token"`
+	Datacenter    string `mapstructure:"datacenter"`
+	NodeFilter    string `mapstructure:"node_filter"`
+	ServiceFilter string `mapstructure:"service_filter"`
+	TagFilter     string `mapstructure:"tag_filter"`
+	MaxEventSize  int    `mapstructure:"max_event_size"`
+	MaxRetries    int    `mapstructure:"max_retries"`
+	Sandbox       bool   `mapstructure:"sandbox"`
+}
+
+// The Consul clients used by event handlers, keyed by address and token. These are kept
+// outside of the handlers so that handlers stay comparable when the config is reloaded.
+var consulEventClients = struct {
+	sync.Mutex
+	clients map[string]*api.Client
+}{clients: make(map[string]*api.Client)}
+
+func (handler ConsulEventHandler) Alert(datacenter string, alert *AlertState) error {
+	payload, err := handler.payload(alert)
+	if err != nil {
+		return err
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("consul_event", handler.Name, string(payload))
+		return nil
+	}
+
+	client, err := handler.client()
+	if err != nil {
+		return err
+	}
+
+	event := &api.UserEvent{
+		Name:          handler.Name,
+		Payload:       payload,
+		NodeFilter:    handler.NodeFilter,
+		ServiceFilter: handler.ServiceFilter,
+		TagFilter:     handler.TagFilter,
+	}
+	writeOpts := &api.WriteOptions{Datacenter: handler.Datacenter}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		_, _, err = client.Event().Fire(event, writeOpts)
+		if err == nil {
+			return nil
+		}
+
+		log.Errorf("Error firing Consul event %s: %s", handler.Name, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying Consul event in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return fmt.Errorf("Error firing Consul event %s: %s", handler.Name, err)
+}
+
+// Checks that the handler's settings are usable
+func (handler ConsulEventHandler) validate() error {
+	if handler.Name == "" {
+		return fmt.Errorf("name must be set")
+	}
+	if len(handler.Name) >= handler.MaxEventSize {
+		return fmt.Errorf("name must be shorter than max_event_size (%d bytes)", handler.MaxEventSize)
+	}
+	if handler.MaxRetries < 0 {
+		return fmt.Errorf("invalid max_retries: %d", handler.MaxRetries)
+	}
+	return nil
+}
+
+// Returns the serialized alert to fire the event with. Consul limits the combined size of a
+// user event's name and payload, so if the alert is too large, the fields that are only there
+// for display are left out in turn until it fits, keeping the ones that identify the alert and
+// its status.
+func (handler ConsulEventHandler) payload(alert *AlertState) ([]byte, error) {
+	maxSize := handler.MaxEventSize - len(handler.Name)
+	trimmed := *alert
+	trims := []func(*AlertState){
+		func(a *AlertState) { a.Checks = nil },
+		func(a *AlertState) { a.Links = nil },
+		func(a *AlertState) { a.Fields = nil },
+		func(a *AlertState) { a.Labels = nil },
+		func(a *AlertState) { a.Details = "" },
+	}
+
+	for i := 0; ; i++ {
+		payload, err := json.Marshal(&trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("Error forming Consul event payload: %s", err)
+		}
+		if len(payload) <= maxSize {
+			return payload, nil
+		}
+		if i == len(trims) {
+			return nil, fmt.Errorf("Alert '%s' is too large for a Consul event (%d bytes, with %d left after the name)", alert.Message, len(payload), maxSize)
+		}
+		trims[i](&trimmed)
+	}
+}
+
+// Returns the shared client for the handler's agent address and token
+func (handler ConsulEventHandler) client() (*api.Client, error) {
+	consulEventClients.Lock()
+	defer consulEventClients.Unlock()
+
+	key := handler.Address + "\x00" + handler.Token
+	if client, ok := consulEventClients.clients[key]; ok {
+		return client, nil
+	}
+
+	client, err := newConsulClient(&Config{ConsulAddress: handler.Address, ConsulToken: handler.Token})
+	if err != nil {
+		return nil, err
+	}
+	consulEventClients.clients[key] = client
+	return client, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestConsulEventHandler_alert(t *testing.T) {
+	var fired *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fired = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"ID": "b54fe110-7af5-cafc-d1fb-afc8ba432b1c"}`))
+	}))
+	defer server.Close()
+
+	handler := ConsulEventHandler{
+		Name:          "health-change",
+		Address:       server.URL,
+		Token:         "secret",
+		Datacenter:    "dc2",
+		ServiceFilter: "deployer",
+		MaxEventSize:  512,
+	}
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "[dc1] redis is now critical"}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	if fired == nil {
+		t.Fatal("expected an event to be fired")
+	}
+	if fired.Method != "PUT" || fired.URL.Path != "/v1/event/fire/health-change" {
+		t.Errorf("unexpected request %s %s", fired.Method, fired.URL.Path)
+	}
+	query := fired.URL.Query()
+	if query.Get("dc") != "dc2" || query.Get("service") != "deployer" || query.Get("token") != "secret" {
+		t.Errorf("unexpected request options: %s", fired.URL.RawQuery)
+	}
+
+	var payload AlertState
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Service != "redis" || payload.Status != api.HealthCritical || payload.Message != alert.Message {
+		t.Errorf("unexpected payload: %s", body)
+	}
+}
+
+func TestConsulEventHandler_payload(t *testing.T) {
+	handler := ConsulEventHandler{Name: "health-change", MaxEventSize: 512}
+
+	alert := &AlertState{
+		Service: "redis",
+		Status:  api.HealthCritical,
+		Message: "[dc1] redis is now critical",
+		Details: strings.Repeat("connection refused\n", 50),
+		Checks:  []CheckSummary{{Node: "node1", Name: "redis", Status: api.HealthCritical}},
+	}
+	payload, err := handler.payload(alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.Name)+len(payload) > handler.MaxEventSize {
+		t.Fatalf("expected the event to fit in %d bytes, got a %d byte payload", handler.MaxEventSize, len(payload))
+	}
+
+	var trimmed AlertState
+	if err := json.Unmarshal(payload, &trimmed); err != nil {
+		t.Fatal(err)
+	}
+	if trimmed.Details != "" || trimmed.Checks != nil || trimmed.Message != alert.Message || trimmed.Status != alert.Status {
+		t.Errorf("unexpected trimmed payload: %s", payload)
+	}
+	if alert.Details == "" || alert.Checks == nil {
+		t.Error("expected the alert itself to be left unchanged")
+	}
+
+	alert.Message = strings.Repeat("x", 1000)
+	if _, err := handler.payload(alert); err == nil {
+		t.Error("expected an error for an alert that can't fit")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The placeholder in an index name that's replaced with the alert's date
+const esDatePlaceholder = "{date}"
+
+// The index templates that have been installed, keyed by URL and template name, so each is
+// only installed once per process
+var esTemplates = struct {
+	lock      sync.Mutex
+	installed map[string]bool
+}{installed: make(map[string]bool)}
+
+// ElasticsearchHandler indexes each alert as a document in Elasticsearch or OpenSearch, for
+// building dashboards of past outages. Unless manage_template is turned off, it installs an
+// index template for the handler's indices first, so the alerts get a mapping with keyword
+// fields for filtering and aggregating rather than whatever dynamic mapping would guess.
+type ElasticsearchHandler struct {
+	URL            string `mapstructure:"url"`
+	Index          string `mapstructure:"index"`
+	Username       string `mapstructure:"username"`
+	Password       string `mapstructure:"password"`
+	APIKey         string `mapstructure:"api_key"`
+	ManageTemplate bool   `mapstructure:"manage_template"`
+	TemplateName   string `mapstructure:"template_name"`
+	MaxRetries     int    `mapstructure:"max_retries"`
+	Sandbox        bool   `mapstructure:"sandbox"`
+	Proxy          string `mapstructure:"proxy"`
+}
+
+// An alert as indexed into Elasticsearch
+type esAlert struct {
+	Timestamp   time.Time         `json:"@timestamp"`
+	Datacenter  string            `json:"datacenter"`
+	Node        string            `json:"node,omitempty"`
+	Service     string            `json:"service,omitempty"`
+	Tag         string            `json:"tag,omitempty"`
+	Route       string            `json:"route,omitempty"`
+	Status      string            `json:"status"`
+	LastStatus  string            `json:"last_status"`
+	Fingerprint string            `json:"fingerprint"`
+	Message     string            `json:"message"`
+	Details     string            `json:"details,omitempty"`
+	Checks      []CheckSummary    `json:"checks,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	Transitions int               `json:"transitions,omitempty"`
+	Downgraded  bool              `json:"downgraded,omitempty"`
+}
+
+// The mapping for indexed alerts. Labels and fields are free-form, so any of their keys are
+// mapped as keywords.
+var esMapping = map[string]interface{}{
+	"dynamic_templates": []interface{}{
+		map[string]interface{}{
+			"labels_and_fields": map[string]interface{}{
+				"path_match":         []string{"labels.*", "fields.*"},
+				"match_mapping_type": "string",
+				"mapping":            map[string]interface{}{"type": "keyword"},
+			},
+		},
+	},
+	"properties": map[string]interface{}{
+		"@timestamp":  map[string]interface{}{"type": "date"},
+		"datacenter":  map[string]interface{}{"type": "keyword"},
+		"node":        map[string]interface{}{"type": "keyword"},
+		"service":     map[string]interface{}{"type": "keyword"},
+		"tag":         map[string]interface{}{"type": "keyword"},
+		"route":       map[string]interface{}{"type": "keyword"},
+		"status":      map[string]interface{}{"type": "keyword"},
+		"last_status": map[string]interface{}{"type": "keyword"},
+		"fingerprint": map[string]interface{}{"type": "keyword"},
+		"message":     map[string]interface{}{"type": "text", "fields": map[string]interface{}{"raw": map[string]interface{}{"type": "keyword", "ignore_above": 512}}},
+		"details":     map[string]interface{}{"type": "text"},
+		"transitions": map[string]interface{}{"type": "integer"},
+		"downgraded":  map[string]interface{}{"type": "boolean"},
+		"checks": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"node":     map[string]interface{}{"type": "keyword"},
+				"check_id": map[string]interface{}{"type": "keyword"},
+				"name":     map[string]interface{}{"type": "keyword"},
+				"status":   map[string]interface{}{"type": "keyword"},
+				"output":   map[string]interface{}{"type": "text"},
+			},
+		},
+	},
+}
+
+// With delivery tracking, alerts are indexed with their delivery ID as the document ID, so
+// sending one again overwrites the same document
+func (handler ElasticsearchHandler) Idempotent() bool {
+	return true
+}
+
+func (handler ElasticsearchHandler) Alert(datacenter string, alert *AlertState) error {
+	now := time.Now().UTC()
+	body, err := json.Marshal(esAlert{
+		Timestamp:   now,
+		Datacenter:  datacenter,
+		Node:        alert.Node,
+		Service:     alert.Service,
+		Tag:         alert.Tag,
+		Route:       alert.Route,
+		Status:      alert.Status,
+		LastStatus:  alert.LastAlerted,
+		Fingerprint: alertFingerprint(alert),
+		Message:     alert.Message,
+		Details:     alert.Details,
+		Checks:      alert.Checks,
+		Labels:      alert.Labels,
+		Fields:      alert.Fields,
+		Transitions: alert.Transitions,
+		Downgraded:  alert.Downgraded,
+	})
+	if err != nil {
+		return fmt.Errorf("Error forming Elasticsearch document: %s", err)
+	}
+
+	index := handler.indexName(now)
+	if handler.Sandbox {
+		logSandboxPayload("elasticsearch", index, string(body))
+		return nil
+	}
+
+	if handler.ManageTemplate {
+		if err := handler.ensureTemplate(); err != nil {
+			log.Errorf("Error installing Elasticsearch index template %s: %s", handler.TemplateName, err)
+		}
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if err = handler.index(index, alert.DeliveryID, body); err == nil {
+			return nil
+		}
+
+		log.Errorf("Error indexing alert in Elasticsearch (index: %s): %s", index, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying Elasticsearch indexing in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler ElasticsearchHandler) validate() error {
+	if !strings.HasPrefix(handler.URL, "http://") && !strings.HasPrefix(handler.URL, "https://") {
+		return fmt.Errorf("url must be an http:// or https:// URL")
+	}
+	if handler.Index == "" {
+		return fmt.Errorf("index must be set")
+	}
+	if strings.ToLower(handler.Index) != handler.Index || strings.ContainsAny(handler.Index, `\/*?"<>| ,#`) {
+		return fmt.Errorf("index must be lowercase and can't contain any of \\/*?\"<>| ,#")
+	}
+	if handler.APIKey != "" && handler.Username != "" {
+		return fmt.Errorf("only one of api_key and username can be set")
+	}
+	if handler.ManageTemplate && handler.TemplateName == "" {
+		return fmt.Errorf("template_name must be set when manage_template is enabled")
+	}
+	return nil
+}
+
+// Returns the name of the index to write an alert to at the given time
+func (handler ElasticsearchHandler) indexName(now time.Time) string {
+	return strings.Replace(handler.Index, esDatePlaceholder, now.Format("2006.01.02"), -1)
+}
+
+// Installs the index template for the handler's indices, if it hasn't been already
+func (handler ElasticsearchHandler) ensureTemplate() error {
+	key := handler.URL + "/" + handler.TemplateName
+	esTemplates.lock.Lock()
+	defer esTemplates.lock.Unlock()
+	if esTemplates.installed[key] {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{strings.Replace(handler.Index, esDatePlaceholder, "*", -1)},
+		"template": map[string]interface{}{
+			"mappings": esMapping,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := handler.request("PUT", "/_index_template/"+url.PathEscape(handler.TemplateName), body); err != nil {
+		return err
+	}
+	esTemplates.installed[key] = true
+	return nil
+}
+
+// Indexes a document, with the given ID if it has one
+func (handler ElasticsearchHandler) index(index string, id string, body []byte) error {
+	if id != "" {
+		return handler.request("PUT", "/"+url.PathEscape(index)+"/_doc/"+url.PathEscape(id), body)
+	}
+	return handler.request("POST", "/"+url.PathEscape(index)+"/_doc", body)
+}
+
+// Sends a request to the cluster, checking the response code
+func (handler ElasticsearchHandler) request(method string, path string, body []byte) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(handler.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if handler.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+handler.APIKey)
+	} else if handler.Username != "" {
+		req.SetBasicAuth(handler.Username, handler.Password)
+	}
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestElasticsearchHandler_alert(t *testing.T) {
+	var lock sync.Mutex
+	var templates []map[string]interface{}
+	docs := make(map[string]esAlert)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "elastic" || pass != "changeme" {
+			t.Errorf("unexpected credentials %q/%q", user, pass)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/_index_template/alerts":
+			var template map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+				t.Error(err)
+			}
+			templates = append(templates, template)
+		case strings.Contains(r.URL.Path, "/_doc"):
+			var doc esAlert
+			if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+				t.Error(err)
+			}
+			docs[r.Method+" "+r.URL.Path] = doc
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "elasticsearch" "history" {
+		url = "` + server.URL + `"
+		index = "outages-{date}"
+		username = "elastic"
+		password = "changeme"
+		template_name = "alerts"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := config.Handlers["elasticsearch.history"]
+
+	alert := &AlertState{Node: "node1", Service: "redis", Status: api.HealthCritical, Message: "redis is critical", Fields: map[string]string{"team": "cache"}}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	alert.DeliveryID = "abc123"
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The template is only installed once, for all the handler's daily indices
+	if len(templates) != 1 {
+		t.Fatalf("expected the template to be installed once, got %d", len(templates))
+	}
+	if patterns, _ := templates[0]["index_patterns"].([]interface{}); len(patterns) != 1 || patterns[0] != "outages-*" {
+		t.Errorf("unexpected index patterns: %v", templates[0]["index_patterns"])
+	}
+
+	index := "/outages-" + time.Now().UTC().Format("2006.01.02")
+	doc, ok := docs["POST "+index+"/_doc"]
+	if !ok {
+		t.Fatalf("expected a document without an ID, got %v", docs)
+	}
+	if doc.Datacenter != "dc1" || doc.Service != "redis" || doc.Status != api.HealthCritical || doc.Fields["team"] != "cache" || doc.Timestamp.IsZero() {
+		t.Errorf("unexpected document: %+v", doc)
+	}
+	if _, ok := docs["PUT "+index+"/_doc/abc123"]; !ok {
+		t.Errorf("expected the delivery ID to be used as the document ID, got %v", docs)
+	}
+}
+
+func TestElasticsearchHandler_apiKey(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	handler := ElasticsearchHandler{URL: server.URL, Index: "alerts", APIKey: "a2V5OnNlY3JldA=="}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.Alert("dc1", &AlertState{Node: "node1", Status: api.HealthWarning}); err != nil {
+		t.Fatal(err)
+	}
+	if auth := <-received; auth != "ApiKey a2V5OnNlY3JldA==" {
+		t.Errorf("unexpected authorization header %q", auth)
+	}
+}
+
+func TestElasticsearchHandler_validate(t *testing.T) {
+	cases := []string{
+		`handler "elasticsearch" "es" { }`,
+		`handler "elasticsearch" "es" { url = "es.example.com:9200" }`,
+		`handler "elasticsearch" "es" { url = "https://es.example.com", index = "Alerts" }`,
+		`handler "elasticsearch" "es" { url = "https://es.example.com", api_key = "key", username = "elastic" }`,
+	}
+	for _, raw := range cases {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
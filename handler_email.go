@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The most emails that can be waiting for a retry at once. Alerts to a handler are returned
+// as failed when its emails can't be queued, so they go to the delivery queue if there is one.
+const emailOutboxSize = 1000
+
+// How long to wait before the first retry of a failed email, doubled for each retry after it
+var emailRetryInterval = 5 * time.Second
+
+// The port to deliver to mail exchangers on, and the MX lookup to use. Overridden in tests.
+var mxPort = 25
+var lookupMX = net.LookupMX
+
+// The address emails are sent from if the handler doesn't set one
+const emailDefaultFrom = "Consul Alerting <consul-alerting@noreply.com>"
+
+// EmailHandler sends alerts by email, either directly to each recipient's mail exchangers
+// (trying them in order of preference) or through a relay, optionally signing them with DKIM
+// so they pass spam filtering. Emails that can't be delivered are queued and retried in the
+// background, so an unreachable mail server doesn't hold up alerts to the other recipients
+// and handlers.
+type EmailHandler struct {
+	Recipients    []string            `mapstructure:"recipients"`
+	RecipientsMap map[string][]string `mapstructure:"recipients_map"`
+	From          string              `mapstructure:"from"`
+	MaxRetries    int                 `mapstructure:"max_retries"`
+	Relay         string              `mapstructure:"relay"`
+	RelayUsername string              `mapstructure:"relay_username"`
+	RelayPassword string              `mapstructure:"relay_password"`
+	RelayTLS      string              `mapstructure:"relay_tls"`
+	DomainRelays  map[string]string   `mapstructure:"domain_relays"`
+	DKIMDomain    string              `mapstructure:"dkim_domain"`
+	DKIMSelector  string              `mapstructure:"dkim_selector"`
+	DKIMKey       string              `mapstructure:"dkim_key"`
+	Sandbox       bool                `mapstructure:"sandbox"`
+}
+
+func (handler EmailHandler) Alert(datacenter string, alert *AlertState) error {
+	from, err := handler.fromAddress()
+	if err != nil {
+		return err
+	}
+
+	body := detailsWithFields(alert)
+	if alert.Links != nil {
+		body = strings.TrimSpace(body + "\n\n" + alert.Links.describe())
+	}
+
+	var lastErr error
+	for _, recipient := range handler.recipients(alert) {
+		message, err := handler.render(from, recipient, alert.Message, body, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if handler.Sandbox {
+			logSandboxPayload("email", recipient, string(message))
+			continue
+		}
+
+		err = handler.send(recipient, from.Address, message)
+		if err == nil {
+			continue
+		}
+		log.Errorf("Error sending alert email to %s: %s", recipient, err)
+
+		if handler.MaxRetries <= 0 {
+			lastErr = err
+			continue
+		}
+		email := &queuedEmail{handler: handler, recipient: recipient, from: from.Address, message: message}
+		if err := emailQueue.push(email, time.Now()); err != nil {
+			log.Errorf("Error queueing alert email to %s: %s", recipient, err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// Checks that the handler's settings are usable, loading the DKIM key if one is set
+func (handler EmailHandler) validate() error {
+	if _, err := handler.fromAddress(); err != nil {
+		return err
+	}
+	if handler.RelayTLS != "" {
+		if handler.Relay == "" {
+			return fmt.Errorf("relay_tls requires relay")
+		}
+		if !contains(smtpTLSModes, handler.RelayTLS) {
+			return fmt.Errorf("invalid relay_tls %q (must be one of %s)", handler.RelayTLS, strings.Join(smtpTLSModes, ", "))
+		}
+	}
+	for service, recipients := range handler.RecipientsMap {
+		if len(recipients) == 0 {
+			return fmt.Errorf("no recipients for service %s in recipients_map", service)
+		}
+	}
+	for domain, relay := range handler.DomainRelays {
+		if _, _, err := parseRelay(relay); err != nil {
+			return fmt.Errorf("invalid relay for domain %s: %s", domain, err)
+		}
+	}
+
+	dkim := []string{handler.DKIMDomain, handler.DKIMSelector, handler.DKIMKey}
+	if strings.Join(dkim, "") == "" {
+		return nil
+	}
+	for _, setting := range dkim {
+		if setting == "" {
+			return fmt.Errorf("dkim_domain, dkim_selector and dkim_key must be set together")
+		}
+	}
+	if _, err := loadDKIMKey(handler.DKIMKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns the addresses to email an alert to: the service's recipients in recipients_map if
+// it has any, otherwise the handler's recipients
+func (handler EmailHandler) recipients(alert *AlertState) []string {
+	if recipients, ok := handler.RecipientsMap[alert.Service]; ok && alert.Service != "" {
+		return recipients
+	}
+	return handler.Recipients
+}
+
+// Returns the address to send emails from
+func (handler EmailHandler) fromAddress() (*mail.Address, error) {
+	from := handler.From
+	if from == "" {
+		from = emailDefaultFrom
+	}
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %s", from, err)
+	}
+	return address, nil
+}
+
+// Renders the email for a recipient, signing it if DKIM is configured
+func (handler EmailHandler) render(from *mail.Address, recipient string, subject string, body string, now time.Time) ([]byte, error) {
+	m := &emailMessage{From: from, To: []string{recipient}, Subject: subject, Body: body}
+	message, err := m.render(now)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering alert email: %s", err)
+	}
+
+	if handler.DKIMKey == "" {
+		return message, nil
+	}
+	key, err := loadDKIMKey(handler.DKIMKey)
+	if err != nil {
+		return nil, err
+	}
+	return dkimSign(message, handler.DKIMDomain, handler.DKIMSelector, key, now)
+}
+
+// Tries to deliver the message to each of the recipient's mail servers in turn, returning
+// the last error if none of them accepted it
+func (handler EmailHandler) send(recipient string, from string, message []byte) error {
+	servers, err := handler.servers(recipient)
+	if err != nil {
+		return err
+	}
+
+	for _, server := range servers {
+		if err = emailSender.send(server, from, []string{recipient}, message); err == nil {
+			return nil
+		}
+		log.Warnf("Error sending alert email to %s through %s: %s", recipient, server.Host, err)
+	}
+
+	return err
+}
+
+// Returns the mail servers to try for a recipient, in order. This is the relay for the
+// recipient's domain in domain_relays if there is one, then the relay if one is set, otherwise
+// the recipient domain's mail exchangers by preference. A domain without MX records is used
+// as its own mail server.
+func (handler EmailHandler) servers(recipient string) ([]smtpServer, error) {
+	var domain string
+	if at := strings.LastIndex(recipient, "@"); at >= 0 {
+		domain = recipient[at+1:]
+	}
+
+	for relayDomain, relay := range handler.DomainRelays {
+		if domain != "" && strings.EqualFold(relayDomain, domain) {
+			host, port, err := parseRelay(relay)
+			if err != nil {
+				return nil, err
+			}
+			return []smtpServer{{Host: host, Port: port}}, nil
+		}
+	}
+
+	if handler.Relay != "" {
+		host, port, err := parseRelay(handler.Relay)
+		if err != nil {
+			return nil, err
+		}
+		return []smtpServer{{Host: host, Port: port, Username: handler.RelayUsername, Password: handler.RelayPassword, TLS: handler.RelayTLS}}, nil
+	}
+
+	if domain == "" {
+		return nil, fmt.Errorf("Invalid email address: %s", recipient)
+	}
+
+	records, err := lookupMX(domain)
+	if err != nil && len(records) == 0 {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, fmt.Errorf("Error looking up email server: %s", err)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+
+	servers := make([]smtpServer, 0, len(records))
+	for _, record := range records {
+		servers = append(servers, smtpServer{Host: strings.TrimSuffix(record.Host, "."), Port: mxPort})
+	}
+	if len(servers) == 0 {
+		servers = append(servers, smtpServer{Host: domain, Port: mxPort})
+	}
+
+	return servers, nil
+}
+
+// Splits a relay address into its host and port, defaulting to port 25
+func parseRelay(relay string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(relay)
+	if err != nil {
+		return relay, 25, nil
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid port for email relay %s", relay)
+	}
+	return host, port, nil
+}
+
+// An email waiting to be retried
+type queuedEmail struct {
+	handler   EmailHandler
+	recipient string
+	from      string
+	message   []byte
+	retries   int
+	next      time.Time
+}
+
+// EmailOutbox holds failed alert emails and retries them in the background with a growing
+// delay, until they're delivered or run out of retries
+type EmailOutbox struct {
+	lock    sync.Mutex
+	pending []*queuedEmail
+	running bool
+}
+
+var emailQueue = &EmailOutbox{}
+
+// Queues an email for its first retry, starting the retry loop if it isn't running
+func (o *EmailOutbox) push(email *queuedEmail, now time.Time) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if len(o.pending) >= emailOutboxSize {
+		return fmt.Errorf("Email queue is full (%d emails waiting)", len(o.pending))
+	}
+
+	email.next = now.Add(emailRetryInterval)
+	o.pending = append(o.pending, email)
+
+	if !o.running {
+		o.running = true
+		go o.run()
+	}
+	return nil
+}
+
+// Retries due emails until the queue is empty
+func (o *EmailOutbox) run() {
+	for {
+		time.Sleep(time.Second)
+		o.retry(time.Now())
+
+		o.lock.Lock()
+		if len(o.pending) == 0 {
+			o.running = false
+			o.lock.Unlock()
+			return
+		}
+		o.lock.Unlock()
+	}
+}
+
+// Tries to send each email that's due for a retry, requeueing the ones that fail again
+func (o *EmailOutbox) retry(now time.Time) {
+	o.lock.Lock()
+	due := make([]*queuedEmail, 0)
+	waiting := make([]*queuedEmail, 0, len(o.pending))
+	for _, email := range o.pending {
+		if now.Before(email.next) {
+			waiting = append(waiting, email)
+		} else {
+			due = append(due, email)
+		}
+	}
+	o.pending = waiting
+	o.lock.Unlock()
+
+	for _, email := range due {
+		err := email.handler.send(email.recipient, email.from, email.message)
+		if err == nil {
+			log.Infof("Delivered queued alert email to %s", email.recipient)
+			continue
+		}
+
+		email.retries++
+		if email.retries >= email.handler.MaxRetries {
+			log.Errorf("Giving up on alert email to %s after %d retries: %s", email.recipient, email.retries, err)
+			continue
+		}
+
+		log.Warnf("Error retrying alert email to %s: %s", email.recipient, err)
+		email.next = now.Add(emailRetryInterval << uint(email.retries))
+		o.lock.Lock()
+		o.pending = append(o.pending, email)
+		o.lock.Unlock()
+	}
+}
+
+// Returns the number of emails waiting to be retried
+func (o *EmailOutbox) size() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.pending)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Starts a fake SMTP server that records the recipients of the emails it accepts, or
+// rejects every email if reject is true
+func testSMTPServer(t *testing.T, reject bool) (net.Listener, func() []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	recipients := make([]string, 0)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					command := strings.ToUpper(strings.TrimSpace(line))
+					switch {
+					case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+						fmt.Fprint(conn, "250 localhost\r\n")
+					case strings.HasPrefix(command, "MAIL"):
+						if reject {
+							fmt.Fprint(conn, "421 try again later\r\n")
+							continue
+						}
+						fmt.Fprint(conn, "250 OK\r\n")
+					case strings.HasPrefix(command, "RCPT"):
+						lock.Lock()
+						recipients = append(recipients, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+						lock.Unlock()
+						fmt.Fprint(conn, "250 OK\r\n")
+					case command == "DATA":
+						fmt.Fprint(conn, "354 go ahead\r\n")
+						for {
+							data, err := r.ReadString('\n')
+							if err != nil || data == ".\r\n" {
+								break
+							}
+						}
+						fmt.Fprint(conn, "250 OK\r\n")
+					case command == "QUIT":
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 OK\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return listener, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, recipients...)
+	}
+}
+
+func TestEmailHandler_mxFailover(t *testing.T) {
+	server, recipients := testSMTPServer(t, false)
+	defer server.Close()
+
+	// The preferred MX record points at an address with nothing listening on the port,
+	// so delivery has to fall back to the next one
+	oldLookup, oldPort := lookupMX, mxPort
+	defer func() { lookupMX, mxPort = oldLookup, oldPort }()
+	mxPort = server.Addr().(*net.TCPAddr).Port
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		if domain != "example.com" {
+			t.Errorf("unexpected MX lookup for %s", domain)
+		}
+		return []*net.MX{
+			{Host: "127.0.0.1.", Pref: 20},
+			{Host: "127.0.0.2.", Pref: 10},
+		}, nil
+	}
+
+	handler := EmailHandler{Recipients: []string{"ops@example.com"}}
+	if err := handler.Alert("dc1", &AlertState{Message: "test", Status: api.HealthCritical}); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := recipients(); len(r) != 1 || r[0] != "ops@example.com" {
+		t.Errorf("expected the email to be delivered by the fallback server, got %v", r)
+	}
+}
+
+func TestEmailHandler_rejected(t *testing.T) {
+	server, recipients := testSMTPServer(t, true)
+	defer server.Close()
+
+	// Without retries, the failure is returned right away
+	handler := EmailHandler{Recipients: []string{"ops@example.com"}, Relay: server.Addr().String()}
+	if err := handler.Alert("dc1", &AlertState{Message: "test", Status: api.HealthCritical}); err == nil {
+		t.Fatal("expected an error from the rejecting server")
+	}
+	if r := recipients(); len(r) != 0 {
+		t.Errorf("expected nothing to be delivered, got %v", r)
+	}
+}
+
+func TestEmailHandler_relayTLS(t *testing.T) {
+	server, recipients := testSMTPServer(t, false)
+	defer server.Close()
+
+	// The test server doesn't offer STARTTLS, so requiring it fails rather than sending the
+	// email in plaintext
+	handler := EmailHandler{Recipients: []string{"ops@example.com"}, Relay: server.Addr().String(), RelayTLS: "starttls"}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+	err := handler.Alert("dc1", &AlertState{Message: "test", Status: api.HealthCritical})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected a STARTTLS error, got %v", err)
+	}
+	if r := recipients(); len(r) != 0 {
+		t.Errorf("expected nothing to be delivered, got %v", r)
+	}
+
+	handler.RelayTLS = "none"
+	if err := handler.Alert("dc1", &AlertState{Message: "test", Status: api.HealthCritical}); err != nil {
+		t.Fatal(err)
+	}
+	if r := recipients(); len(r) != 1 {
+		t.Errorf("expected the email to be delivered, got %v", r)
+	}
+
+	cases := []struct {
+		server   smtpServer
+		implicit bool
+	}{
+		{smtpServer{Port: 465}, true},
+		{smtpServer{Port: 465, TLS: "starttls"}, false},
+		{smtpServer{Port: 587}, false},
+		{smtpServer{Port: 2465, TLS: "tls"}, true},
+	}
+	for _, c := range cases {
+		if implicit := c.server.implicitTLS(); implicit != c.implicit {
+			t.Errorf("expected implicit TLS to be %v for %#v", c.implicit, c.server)
+		}
+	}
+
+	invalid := []EmailHandler{
+		{RelayTLS: "starttls"},
+		{Relay: "smtp.example.com", RelayTLS: "ssl"},
+	}
+	for _, handler := range invalid {
+		if err := handler.validate(); err == nil {
+			t.Errorf("expected an error for %+v", handler)
+		}
+	}
+}
+
+func TestEmailHandler_servers(t *testing.T) {
+	oldLookup := lookupMX
+	defer func() { lookupMX = oldLookup }()
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		if domain == "nomx.example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		}
+		return []*net.MX{
+			{Host: "mx3.example.com.", Pref: 30},
+			{Host: "mx1.example.com.", Pref: 10},
+			{Host: "mx2.example.com.", Pref: 20},
+		}, nil
+	}
+
+	handler := EmailHandler{}
+	servers, err := handler.servers("ops@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make([]string, 0)
+	for _, d := range servers {
+		hosts = append(hosts, d.Host)
+	}
+	if strings.Join(hosts, ",") != "mx1.example.com,mx2.example.com,mx3.example.com" {
+		t.Errorf("expected MX hosts in order of preference, got %v", hosts)
+	}
+
+	// A domain without MX records is its own mail server
+	servers, err = handler.servers("ops@nomx.example.com")
+	if err != nil || len(servers) != 1 || servers[0].Host != "nomx.example.com" {
+		t.Errorf("expected the domain itself, got %v (%v)", servers, err)
+	}
+
+	if _, err := handler.servers("not-an-address"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+
+	// The relay is used for every recipient
+	handler = EmailHandler{Relay: "smtp.example.com:587", RelayUsername: "user", RelayPassword: "pass"}
+	servers, err = handler.servers("ops@example.com")
+	if err != nil || len(servers) != 1 {
+		t.Fatalf("expected one relay server, got %v (%v)", servers, err)
+	}
+	if d := servers[0]; d.Host != "smtp.example.com" || d.Port != 587 || d.Username != "user" || d.Password != "pass" {
+		t.Errorf("unexpected relay server: %#v", d)
+	}
+
+	handler = EmailHandler{Relay: "smtp.example.com"}
+	if servers, _ := handler.servers("ops@example.com"); servers[0].Port != 25 {
+		t.Errorf("expected the relay to default to port 25, got %d", servers[0].Port)
+	}
+
+	// Domain relays take precedence, without the relay's credentials
+	handler = EmailHandler{
+		Relay:         "smtp.example.com:587",
+		RelayUsername: "user",
+		DomainRelays:  map[string]string{"corp.example.com": "mail.corp.example.com:2525"},
+	}
+	servers, err = handler.servers("ops@CORP.example.com")
+	if err != nil || len(servers) != 1 {
+		t.Fatalf("expected one domain relay server, got %v (%v)", servers, err)
+	}
+	if d := servers[0]; d.Host != "mail.corp.example.com" || d.Port != 2525 || d.Username != "" {
+		t.Errorf("unexpected domain relay server: %#v", d)
+	}
+	if servers, _ := handler.servers("ops@example.com"); servers[0].Host != "smtp.example.com" {
+		t.Errorf("expected other domains to use the relay, got %#v", servers[0])
+	}
+}
+
+func TestEmailHandler_render(t *testing.T) {
+	handler := EmailHandler{From: "Alerts <alerts@example.com>"}
+	from, err := handler.fromAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	message, err := handler.render(from, "ops@example.com", "[dc1] café is now critical", "Check failed: ✗ timeout\n"+strings.Repeat("x", 100), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := parsed.Header.Get("From"); from != `"Alerts" <alerts@example.com>` {
+		t.Errorf("unexpected From header %q", from)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != "[dc1] café is now critical" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if date, err := parsed.Header.Date(); err != nil || !date.Equal(now) {
+		t.Errorf("unexpected date %v (%v)", date, err)
+	}
+	if id := parsed.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("unexpected Message-ID %q", id)
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Check failed: ✗ timeout\r\n"+strings.Repeat("x", 100)+"\r\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+	for _, line := range strings.Split(string(message), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line longer than 78 characters: %q", line)
+		}
+	}
+
+	if _, err := (EmailHandler{From: "not an address"}).fromAddress(); err == nil {
+		t.Error("expected an error for an invalid from address")
+	}
+}
+
+func TestEmailHandler_connectionReuse(t *testing.T) {
+	server, recipients := testSMTPServer(t, false)
+
+	oldSender := emailSender
+	defer func() { emailSender = oldSender }()
+	emailSender = newSMTPPool()
+
+	handler := EmailHandler{Recipients: []string{"ops@example.com"}, Relay: server.Addr().String()}
+	alert := &AlertState{Message: "test", Status: api.HealthCritical}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the server stops accepting connections, emails can still be sent over the open one
+	server.Close()
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatalf("expected the connection to be reused, got %s", err)
+	}
+	if r := recipients(); len(r) != 2 {
+		t.Errorf("expected 2 emails to be delivered, got %v", r)
+	}
+}
+
+func TestEmailHandler_queueFailed(t *testing.T) {
+	server, recipients := testSMTPServer(t, false)
+	defer server.Close()
+
+	// Send through a relay that's down, so the email gets queued
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := listener.Addr().String()
+	listener.Close()
+
+	oldQueue := emailQueue
+	defer func() { emailQueue = oldQueue }()
+	emailQueue = &EmailOutbox{running: true}
+
+	handler := EmailHandler{Recipients: []string{"ops@example.com"}, MaxRetries: 2, Relay: down}
+	start := time.Now()
+	if err := handler.Alert("dc1", &AlertState{Message: "test", Status: api.HealthCritical}); err != nil {
+		t.Fatalf("expected the email to be queued, got %s", err)
+	}
+	if emailQueue.size() != 1 {
+		t.Fatalf("expected 1 queued email, got %d", emailQueue.size())
+	}
+
+	// Not retried before it's due
+	emailQueue.retry(start)
+	if emailQueue.size() != 1 {
+		t.Fatalf("expected the email to still be queued, got %d", emailQueue.size())
+	}
+
+	// Fails again, and is retried after the relay comes back
+	emailQueue.retry(start.Add(emailRetryInterval))
+	if emailQueue.size() != 1 {
+		t.Fatalf("expected the email to be requeued, got %d", emailQueue.size())
+	}
+	emailQueue.pending[0].handler.Relay = server.Addr().String()
+	emailQueue.retry(start.Add(emailRetryInterval * 4))
+	if emailQueue.size() != 0 {
+		t.Fatalf("expected the email to be delivered, got %d queued", emailQueue.size())
+	}
+	if r := recipients(); len(r) != 1 || r[0] != "ops@example.com" {
+		t.Errorf("expected the queued email to be delivered, got %v", r)
+	}
+
+	// Dropped once it runs out of retries
+	handler.MaxRetries = 1
+	if err := emailQueue.push(&queuedEmail{handler: handler, recipient: "ops@example.com", message: []byte("Subject: test\r\n\r\ntest\r\n")}, start); err != nil {
+		t.Fatal(err)
+	}
+	emailQueue.retry(start.Add(emailRetryInterval))
+	if emailQueue.size() != 0 {
+		t.Fatalf("expected the email to be dropped, got %d queued", emailQueue.size())
+	}
+}
+
+func TestEmailHandler_recipientsMap(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "email" "teams" {
+		recipients = ["ops@example.com"]
+		recipients_map {
+			postgres = ["dba@example.com", "dba-oncall@example.com"]
+			web = ["web@example.com"]
+		}
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := config.Handlers["email.teams"].(EmailHandler)
+
+	cases := []struct {
+		alert    AlertState
+		expected []string
+	}{
+		{AlertState{Service: "postgres"}, []string{"dba@example.com", "dba-oncall@example.com"}},
+		{AlertState{Service: "web"}, []string{"web@example.com"}},
+		{AlertState{Service: "redis"}, []string{"ops@example.com"}},
+		{AlertState{Node: "node1"}, []string{"ops@example.com"}},
+	}
+	for _, tc := range cases {
+		if recipients := handler.recipients(&tc.alert); strings.Join(recipients, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%+v: expected %v, got %v", tc.alert, tc.expected, recipients)
+		}
+	}
+
+	_, err = ParseConfig(`
+	handler "email" "teams" {
+		recipients_map {
+			postgres = []
+		}
+	}
+	`)
+	if err == nil {
+		t.Error("expected an error for a service without recipients")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The latest version of the JSON contract for alerts passed to exec commands. Fields are only
+// ever added within a version; removing or changing one needs a new version.
+const execProtocolVersion = 1
+
+// ExecHandler runs a command for each alert, for integrating with tools that don't have a
+// handler of their own. The alert is passed to the command as JSON on stdin, and its main
+// fields are also set as environment variables for simple shell scripts.
+type ExecHandler struct {
+	Command []string `mapstructure:"command"`
+	Timeout int      `mapstructure:"timeout"`
+	Sandbox bool     `mapstructure:"sandbox"`
+
+	// The version of the JSON contract to pass alerts in, or 0 to pass the alert state as
+	// it's stored, which changes along with it
+	Protocol int `mapstructure:"protocol"`
+}
+
+// An alert as passed to the command on stdin without a protocol version
+type execAlert struct {
+	Datacenter  string `json:"datacenter"`
+	Fingerprint string `json:"fingerprint"`
+	*AlertState
+}
+
+// Returns the JSON to pass an alert to the command in, according to the handler's protocol
+func (handler ExecHandler) input(datacenter string, alert *AlertState) ([]byte, error) {
+	if handler.Protocol == 0 {
+		return json.Marshal(execAlert{
+			Datacenter:  datacenter,
+			Fingerprint: alertFingerprint(alert),
+			AlertState:  alert,
+		})
+	}
+
+	// Version 1 is the same alert that's passed to handler plugins
+	return json.Marshal(newPluginAlert(datacenter, alert))
+}
+
+func (handler ExecHandler) Alert(datacenter string, alert *AlertState) error {
+	input, err := handler.input(datacenter, alert)
+	if err != nil {
+		return fmt.Errorf("Error forming alert for command: %s", err)
+	}
+	env := execEnv(datacenter, alert)
+	if handler.Protocol != 0 {
+		env = append(env, fmt.Sprintf("ALERT_PROTOCOL_VERSION=%d", handler.Protocol))
+	}
+
+	if handler.Sandbox {
+		payload := fmt.Sprintf("env: %s\nstdin: %s", strings.Join(env, " "), input)
+		logSandboxPayload("exec", strings.Join(handler.Command, " "), payload)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(handler.Timeout)*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, handler.Command[0], handler.Command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if output := strings.TrimSpace(stdout.String()); output != "" {
+		log.Debugf("Output from alert command %s: %s", handler.Command[0], output)
+	}
+	if output := strings.TrimSpace(stderr.String()); output != "" {
+		log.Warnf("Error output from alert command %s: %s", handler.Command[0], output)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Error running alert command %s: timed out after %ds", handler.Command[0], handler.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("Error running alert command %s: %s", handler.Command[0], err)
+	}
+	return nil
+}
+
+// Checks that the handler's settings are usable
+func (handler ExecHandler) validate() error {
+	if len(handler.Command) == 0 || handler.Command[0] == "" {
+		return fmt.Errorf("command must be set")
+	}
+	if handler.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout: %d", handler.Timeout)
+	}
+	if handler.Protocol < 0 || handler.Protocol > execProtocolVersion {
+		return fmt.Errorf("unsupported protocol %d (must be between 0 and %d)", handler.Protocol, execProtocolVersion)
+	}
+	return nil
+}
+
+// Returns the environment variables describing an alert
+func execEnv(datacenter string, alert *AlertState) []string {
+	env := []string{
+		"ALERT_STATUS=" + alert.Status,
+		"ALERT_LAST_STATUS=" + alert.LastAlerted,
+		"ALERT_DATACENTER=" + datacenter,
+		"ALERT_NODE=" + alert.Node,
+		"ALERT_SERVICE=" + alert.Service,
+		"ALERT_TAG=" + alert.Tag,
+		"ALERT_ROUTE=" + alert.Route,
+		"ALERT_FINGERPRINT=" + alertFingerprint(alert),
+		"ALERT_MESSAGE=" + alert.Message,
+	}
+
+	// Each of the alert's fields is set as ALERT_FIELD_<NAME>, with the name upper-cased and
+	// anything other than letters, digits and underscores replaced by underscores
+	for name, value := range alert.Fields {
+		env = append(env, "ALERT_FIELD_"+execEnvName(name)+"="+value)
+	}
+	return env
+}
+
+// Returns a field name in the form used for environment variable names
+func execEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestExecHandler_alert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	handler := ExecHandler{
+		Command: []string{"sh", "-c", `cat > "$1.json" && echo "$ALERT_STATUS $ALERT_SERVICE $ALERT_NODE" > "$1.env"`, "sh", out},
+		Timeout: 5,
+	}
+	alert := &AlertState{Node: "node1", Service: "redis", Status: api.HealthCritical, Message: "redis is now critical"}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := ioutil.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received map[string]interface{}
+	if err := json.Unmarshal(input, &received); err != nil {
+		t.Fatalf("invalid JSON on stdin %q: %s", input, err)
+	}
+	if received["datacenter"] != "dc1" || received["service"] != "redis" || received["fingerprint"] != alertFingerprint(alert) {
+		t.Errorf("unexpected stdin: %s", input)
+	}
+
+	env, err := ioutil.ReadFile(out + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(env)) != "critical redis node1" {
+		t.Errorf("unexpected environment: %q", env)
+	}
+}
+
+func TestExecHandler_failure(t *testing.T) {
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical}
+
+	handler := ExecHandler{Command: []string{"sh", "-c", "echo oops >&2; exit 3"}, Timeout: 5}
+	if err := handler.Alert("dc1", alert); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("expected exit status error, got %v", err)
+	}
+
+	handler = ExecHandler{Command: []string{"sleep", "10"}, Timeout: 1}
+	if err := handler.Alert("dc1", alert); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestExecHandler_protocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	handler := ExecHandler{
+		Command:  []string{"sh", "-c", `cat > "$1.json" && echo "$ALERT_PROTOCOL_VERSION" > "$1.env"`, "sh", out},
+		Timeout:  5,
+		Protocol: 1,
+	}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, LastAlerted: api.HealthPassing, UpdateIndex: 3, Team: "cache"}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := ioutil.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received map[string]interface{}
+	if err := json.Unmarshal(input, &received); err != nil {
+		t.Fatalf("invalid JSON on stdin %q: %s", input, err)
+	}
+	if received["version"] != float64(1) || received["last_status"] != "passing" || received["team"] != "cache" {
+		t.Errorf("unexpected stdin: %s", input)
+	}
+	if _, ok := received["update_index"]; ok {
+		t.Errorf("expected internal state to be left out, got %s", input)
+	}
+	if checks, ok := received["checks"].([]interface{}); !ok || len(checks) != 0 {
+		t.Errorf("expected an empty list of checks, got %s", input)
+	}
+
+	env, err := ioutil.ReadFile(out + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(env)) != "1" {
+		t.Errorf("unexpected protocol version in environment: %q", env)
+	}
+
+	handler.Protocol = 2
+	if err := handler.validate(); err == nil {
+		t.Error("expected an error for an unsupported protocol")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileHandler appends each alert as a JSON line to a local file, rotating it once it reaches
+// a maximum size. This is useful in air-gapped environments, where alerts are shipped on by
+// a log forwarder.
+type FileHandler struct {
+	Path       string `mapstructure:"path"`
+	MaxSizeMB  int    `mapstructure:"max_size_mb"`
+	MaxBackups int    `mapstructure:"max_backups"`
+	Sandbox    bool   `mapstructure:"sandbox"`
+}
+
+// An alert as written to the file
+type fileAlert struct {
+	Time        time.Time `json:"time"`
+	Datacenter  string    `json:"datacenter"`
+	Fingerprint string    `json:"fingerprint"`
+	*AlertState
+}
+
+// The open files written by file handlers, keyed by path. These are kept outside of the
+// handlers so that handlers stay comparable when the config is reloaded.
+var alertFiles = struct {
+	sync.Mutex
+	files map[string]*rotatingFile
+}{files: make(map[string]*rotatingFile)}
+
+func (handler FileHandler) Alert(datacenter string, alert *AlertState) error {
+	line, err := json.Marshal(fileAlert{
+		Time:        time.Now().UTC(),
+		Datacenter:  datacenter,
+		Fingerprint: alertFingerprint(alert),
+		AlertState:  alert,
+	})
+	if err != nil {
+		return fmt.Errorf("Error forming alert for file: %s", err)
+	}
+	line = append(line, '\n')
+
+	if handler.Sandbox {
+		logSandboxPayload("file", handler.Path, string(line))
+		return nil
+	}
+
+	if err := handler.file().write(line); err != nil {
+		return fmt.Errorf("Error writing alert to %s: %s", handler.Path, err)
+	}
+	return nil
+}
+
+// Checks that the handler's settings are usable
+func (handler FileHandler) validate() error {
+	if handler.Path == "" {
+		return fmt.Errorf("path must be set")
+	}
+	if handler.MaxSizeMB < 0 {
+		return fmt.Errorf("invalid max_size_mb: %d", handler.MaxSizeMB)
+	}
+	if handler.MaxBackups < 0 {
+		return fmt.Errorf("invalid max_backups: %d", handler.MaxBackups)
+	}
+	return nil
+}
+
+// Returns the shared file for the handler's path, using the handler's current rotation
+// settings
+func (handler FileHandler) file() *rotatingFile {
+	alertFiles.Lock()
+	defer alertFiles.Unlock()
+
+	file, ok := alertFiles.files[handler.Path]
+	if !ok {
+		file = &rotatingFile{path: handler.Path}
+		alertFiles.files[handler.Path] = file
+	}
+
+	file.lock.Lock()
+	file.maxSize = int64(handler.MaxSizeMB) * 1024 * 1024
+	file.maxBackups = handler.MaxBackups
+	file.lock.Unlock()
+
+	return file
+}
+
+// A file that's rotated to path.1, path.2 and so on once writing to it would take it past
+// maxSize. Rotation is disabled if maxSize is 0.
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	out  *os.File
+	size int64
+}
+
+// Appends data to the file, rotating it first if needed
+func (f *rotatingFile) write(data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.out == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.out.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+// Opens the file for appending, picking up the size of any existing contents
+func (f *rotatingFile) open() error {
+	out, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	f.out = out
+	f.size = info.Size()
+	return nil
+}
+
+// Shifts the file and its backups along by one, dropping the oldest backup, and opens a new
+// empty file in its place
+func (f *rotatingFile) rotate() error {
+	if err := f.out.Close(); err != nil {
+		return err
+	}
+	f.out = nil
+
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+
+	return f.open()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestFileHandler_alert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := FileHandler{Path: filepath.Join(dir, "alerts.jsonl"), MaxSizeMB: 100, MaxBackups: 5}
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "redis is now critical"}
+	for i := 0; i < 2; i++ {
+		if err := handler.Alert("dc1", alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(handler.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid JSON line %q: %s", scanner.Text(), err)
+		}
+		if line["datacenter"] != "dc1" || line["service"] != "redis" || line["fingerprint"] != alertFingerprint(alert) {
+			t.Errorf("unexpected line: %s", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 lines, got %d", lines)
+	}
+}
+
+func TestFileHandler_rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "alerts.jsonl")
+	file := &rotatingFile{path: path, maxSize: 10, maxBackups: 2}
+	for _, data := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if err := file.write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	}
+	for name, contents := range expected {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("expected %s to contain %q, got %q", name, contents, string(data))
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only 2 backups to be kept")
+	}
+}
+
+func TestFileHandler_validate(t *testing.T) {
+	if err := (FileHandler{}).validate(); err == nil {
+		t.Error("expected error without a path")
+	}
+	if err := (FileHandler{Path: "/tmp/alerts", MaxSizeMB: -1}).validate(); err == nil {
+		t.Error("expected error for negative max_size_mb")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ForwardHandler sends alerts on to a central consul-alerting aggregator, which routes and
+// deduplicates alerts from many clusters (see Aggregator). With a signing secret, each request
+// is signed so the aggregator can check it wasn't forged or replayed.
+type ForwardHandler struct {
+	Address       string `mapstructure:"address"`
+	Token         string `mapstructure:"token"`
+	SigningSecret string `mapstructure:"signing_secret"`
+	Cluster       string `mapstructure:"cluster"`
+	MaxRetries    int    `mapstructure:"max_retries"`
+	Sandbox       bool   `mapstructure:"sandbox"`
+	Proxy         string `mapstructure:"proxy"`
+}
+
+// An alert as forwarded from a cluster to the aggregator
+type forwardedAlert struct {
+	Cluster    string     `json:"cluster"`
+	Datacenter string     `json:"datacenter"`
+	Alert      AlertState `json:"alert"`
+	SentAt     time.Time  `json:"sent_at"`
+}
+
+func (handler ForwardHandler) Alert(datacenter string, alert *AlertState) error {
+	cluster := handler.Cluster
+	if cluster == "" {
+		cluster = datacenter
+	}
+
+	body, err := json.Marshal(forwardedAlert{
+		Cluster:    cluster,
+		Datacenter: datacenter,
+		Alert:      *alert,
+		SentAt:     time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("Error forming forwarded alert: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("forward", handler.Address, string(body))
+		return nil
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if err = handler.post(body); err == nil {
+			return nil
+		}
+
+		log.Errorf("Error forwarding alert to aggregator (address: %s): %s", handler.Address, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying forwarded alert in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler ForwardHandler) validate() error {
+	if handler.Address == "" {
+		return fmt.Errorf("address must be set")
+	}
+	if !strings.HasPrefix(handler.Address, "http://") && !strings.HasPrefix(handler.Address, "https://") {
+		return fmt.Errorf("address must start with http:// or https://")
+	}
+	return nil
+}
+
+// Posts a forwarded alert to the aggregator
+func (handler ForwardHandler) post(body []byte) error {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(handler.Address, "/")+aggregatorAlertsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if handler.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+handler.Token)
+	}
+	if handler.SigningSecret != "" {
+		setWebhookSignature(req, handler.SigningSecret, body, time.Now())
+	}
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
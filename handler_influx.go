@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+const influxKVPath = alertingKVRoot + "/influx/"
+
+// The largest UDP datagram to send, matching InfluxDB's default UDP read buffer
+const influxMaxDatagram = 8192
+
+// InfluxHandler writes the health of each node/service as InfluxDB line protocol, over HTTP or
+// UDP, whenever it changes. If a heartbeat interval is set, the current health of every
+// node/service is also written periodically, so dashboards and SLO queries over the health
+// series don't have gaps between transitions. VictoriaMetrics accepts the same writes.
+type InfluxHandler struct {
+	Address           string `mapstructure:"address"`
+	Database          string `mapstructure:"database"`
+	Token             string `mapstructure:"token"`
+	Measurement       string `mapstructure:"measurement"`
+	HeartbeatInterval int    `mapstructure:"heartbeat_interval"`
+	MaxRetries        int    `mapstructure:"max_retries"`
+	Sandbox           bool   `mapstructure:"sandbox"`
+	Proxy             string `mapstructure:"proxy"`
+}
+
+func (handler InfluxHandler) Alert(datacenter string, alert *AlertState) error {
+	return handler.write(influxLine(nil, handler.Measurement, datacenter, alert, true, time.Now()))
+}
+
+// Checks that the handler's settings are usable
+func (handler InfluxHandler) validate() error {
+	u, err := url.Parse(handler.Address)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("address must be a URL such as http://localhost:8086 or udp://localhost:8089")
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if handler.Database == "" {
+			return fmt.Errorf("database must be set when writing over HTTP")
+		}
+	case "udp":
+	default:
+		return fmt.Errorf("unsupported address scheme: %s", u.Scheme)
+	}
+
+	if handler.Measurement == "" {
+		return fmt.Errorf("measurement must be set")
+	}
+	if handler.HeartbeatInterval < 0 {
+		return fmt.Errorf("invalid heartbeat_interval: %d", handler.HeartbeatInterval)
+	}
+	return nil
+}
+
+// Writes a batch of lines, retrying HTTP writes on failure
+func (handler InfluxHandler) write(lines []byte) error {
+	if handler.Sandbox {
+		logSandboxPayload("influx", handler.Address, string(lines))
+		return nil
+	}
+
+	var err error
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if strings.HasPrefix(handler.Address, "udp://") {
+			// There's no response to retry on over UDP
+			return handler.writeUDP(lines)
+		}
+		if err = handler.writeHTTP(lines); err == nil {
+			return nil
+		}
+
+		log.Errorf("Error writing health to InfluxDB (address: %s): %s", handler.Address, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying InfluxDB write in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Posts lines to the v1 write endpoint, which InfluxDB 2 and VictoriaMetrics also serve
+func (handler InfluxHandler) writeHTTP(lines []byte) error {
+	query := url.Values{"db": []string{handler.Database}, "precision": []string{"ns"}}
+	endpoint := strings.TrimSuffix(handler.Address, "/") + "/write?" + query.Encode()
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if handler.Token != "" {
+		req.Header.Set("Authorization", "Token "+handler.Token)
+	}
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// Sends lines to a UDP listener, splitting them into datagrams of whole lines no larger than
+// influxMaxDatagram (unless a single line is larger)
+func (handler InfluxHandler) writeUDP(lines []byte) error {
+	conn, err := net.Dial("udp", strings.TrimPrefix(handler.Address, "udp://"))
+	if err != nil {
+		return fmt.Errorf("Error writing health to InfluxDB at %s: %s", handler.Address, err)
+	}
+	defer conn.Close()
+
+	for len(lines) > 0 {
+		end := len(lines)
+		if end > influxMaxDatagram {
+			if i := bytes.LastIndexByte(lines[:influxMaxDatagram], '\n'); i >= 0 {
+				end = i + 1
+			} else if i := bytes.IndexByte(lines, '\n'); i >= 0 {
+				end = i + 1
+			}
+		}
+
+		if _, err := conn.Write(lines[:end]); err != nil {
+			return fmt.Errorf("Error writing health to InfluxDB at %s: %s", handler.Address, err)
+		}
+		lines = lines[end:]
+	}
+	return nil
+}
+
+// Appends the line protocol point for an alert's health to buf. The numeric status_code
+// (0 passing or info, 1 warning, 2 critical) is for SLO math, and transition marks points
+// written for a change rather than a heartbeat.
+func influxLine(buf []byte, measurement string, datacenter string, alert *AlertState, transition bool, now time.Time) []byte {
+	buf = append(buf, influxEscape(measurement, ", ")...)
+	for _, tag := range [][2]string{
+		{"datacenter", datacenter},
+		{"node", alert.Node},
+		{"service", alert.Service},
+		{"tag", alert.Tag},
+		{"route", alert.Route},
+	} {
+		// Line protocol doesn't allow empty tag values
+		if tag[1] == "" {
+			continue
+		}
+		buf = append(buf, ',')
+		buf = append(buf, tag[0]...)
+		buf = append(buf, '=')
+		buf = append(buf, influxEscape(tag[1], ",= ")...)
+	}
+
+	buf = append(buf, ` status="`...)
+	buf = append(buf, influxEscape(alert.Status, `"\`)...)
+	buf = append(buf, `",status_code=`...)
+	buf = strconv.AppendInt(buf, int64(healthRank(alert.Status)), 10)
+	buf = append(buf, `i,transition=`...)
+	buf = strconv.AppendBool(buf, transition)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, now.UnixNano(), 10)
+	return append(buf, '\n')
+}
+
+// Backslash-escapes the given characters, as line protocol requires for names and tag values
+func influxEscape(s string, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+
+	var escaped bytes.Buffer
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// Periodically writes the current health of every node/service to each influx handler with
+// a heartbeat interval. Only one process writes heartbeats at a time, using a lock in the
+// KV store.
+func writeInfluxHeartbeats(config *Config, shutdownCh chan struct{}, client *api.Client) {
+	apiLock, err := client.LockKey(influxKVPath + "leader")
+	if err != nil {
+		fatalError(config, client, ExitLockFailure, fmt.Errorf("Error initializing lock for InfluxDB heartbeats: %s", err))
+	}
+
+	lock := LockHelper{
+		target:   "InfluxDB heartbeats",
+		client:   client,
+		lock:     apiLock,
+		stopCh:   make(chan struct{}, 1),
+		lockCh:   make(chan struct{}, 1),
+		callback: func() {},
+	}
+	go lock.start()
+
+	// When each handler last wrote a heartbeat
+	lastHeartbeat := make(map[string]time.Time)
+
+	for {
+		select {
+		case <-shutdownCh:
+			log.Info("Shutting down InfluxDB heartbeats")
+			lock.stop()
+			<-shutdownCh
+			return
+		case <-time.After(1 * time.Second):
+		}
+
+		// Heartbeats are paused while Consul is under duress, to avoid adding to its load
+		if !lock.acquired || consulThrottle.throttled() {
+			continue
+		}
+
+		now := time.Now()
+		due := make(map[string]InfluxHandler)
+		for id, handler := range config.handlerMap() {
+			influx, ok := unwrapHandler(handler).(InfluxHandler)
+			if !ok || influx.HeartbeatInterval <= 0 {
+				continue
+			}
+			if now.Sub(lastHeartbeat[id]) >= time.Duration(influx.HeartbeatInterval)*time.Second {
+				due[id] = influx
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+
+		alerts, err := listAlertStates(client)
+		if err != nil {
+			log.Errorf("Error loading alerts for InfluxDB heartbeat: %s", err)
+			continue
+		}
+
+		for id, handler := range due {
+			lastHeartbeat[id] = now
+
+			var lines []byte
+			for _, alert := range alerts {
+				lines = influxLine(lines, handler.Measurement, config.ConsulDatacenter, &alert.AlertState, false, now)
+			}
+			if len(lines) == 0 {
+				continue
+			}
+
+			if err := handler.write(lines); err != nil {
+				log.Errorf("Error writing InfluxDB heartbeat for %s: %s", id, err)
+			}
+		}
+	}
+}
+
+// Returns true if any influx handler writes heartbeats
+func (c *Config) influxHeartbeats() bool {
+	for _, handler := range c.handlerMap() {
+		if influx, ok := unwrapHandler(handler).(InfluxHandler); ok && influx.HeartbeatInterval > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestInfluxHandler_line(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	alert := &AlertState{Service: "web app", Tag: "", Node: "n1,a", Status: api.HealthCritical}
+
+	line := string(influxLine(nil, "consul_health", "dc1", alert, true, now))
+	expected := `consul_health,datacenter=dc1,node=n1\,a,service=web\ app status="critical",status_code=2i,transition=true 1500000000000000000` + "\n"
+	if line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+
+	line = string(influxLine(nil, "consul_health", "dc1", &AlertState{Node: "n1", Status: api.HealthPassing}, false, now))
+	if !strings.Contains(line, `status="passing",status_code=0i,transition=false`) {
+		t.Errorf("unexpected heartbeat line %q", line)
+	}
+}
+
+func TestInfluxHandler_http(t *testing.T) {
+	var body, query, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body, query, auth = string(data), r.URL.RawQuery, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	handler := InfluxHandler{Address: server.URL, Database: "health", Token: "secret", Measurement: "consul_health"}
+	if err := handler.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthWarning}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(body, "consul_health,datacenter=dc1,service=redis status=\"warning\",status_code=1i") {
+		t.Errorf("unexpected body %q", body)
+	}
+	if query != "db=health&precision=ns" {
+		t.Errorf("unexpected query %q", query)
+	}
+	if auth != "Token secret" {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+}
+
+func TestInfluxHandler_udp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Enough lines to need more than one datagram
+	var lines []byte
+	for i := 0; i < 200; i++ {
+		lines = influxLine(lines, "consul_health", "dc1", &AlertState{Node: "node", Status: api.HealthPassing}, false, time.Now())
+	}
+
+	handler := InfluxHandler{Address: "udp://" + conn.LocalAddr().String(), Measurement: "consul_health"}
+	if err := handler.write(lines); err != nil {
+		t.Fatal(err)
+	}
+
+	received := 0
+	buf := make([]byte, 65536)
+	for received < len(lines) {
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > influxMaxDatagram || buf[n-1] != '\n' {
+			t.Fatalf("expected datagrams of whole lines under %d bytes, got %d bytes", influxMaxDatagram, n)
+		}
+		received += n
+	}
+}
+
+func TestInfluxHandler_validate(t *testing.T) {
+	cases := map[string]InfluxHandler{
+		"missing address":  {Measurement: "m"},
+		"missing database": {Address: "http://localhost:8086", Measurement: "m"},
+		"bad scheme":       {Address: "tcp://localhost:8086", Measurement: "m"},
+		"bad heartbeat":    {Address: "udp://localhost:8089", Measurement: "m", HeartbeatInterval: -1},
+	}
+	for name, handler := range cases {
+		if err := handler.validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if err := (InfluxHandler{Address: "udp://localhost:8089", Measurement: "m"}).validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
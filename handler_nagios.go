@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The protocols the nagios handler can submit passive check results over
+const (
+	NSCAProtocol = "nsca"
+	NRDPProtocol = "nrdp"
+)
+
+// Sizes of the NSCA (version 3) protocol's packets and fields
+const (
+	nscaIVSize         = 128
+	nscaInitPacketSize = nscaIVSize + 4
+	nscaPacketSize     = 720
+	nscaHostSize       = 64
+	nscaServiceSize    = 128
+	nscaOutputSize     = 512
+)
+
+// NagiosHandler submits each alert to Nagios as a passive service check result, so Consul's
+// health can be mirrored into an existing Nagios setup. Results are sent to an NSCA daemon
+// (unencrypted or with XOR encryption) or to an NRDP server over HTTP.
+//
+// Service alerts are submitted for the service (with its tag, if set) on the service_host, and
+// node alerts for the node_service on a host named after the node.
+type NagiosHandler struct {
+	Protocol    string `mapstructure:"protocol"`
+	Address     string `mapstructure:"address"`
+	Password    string `mapstructure:"password"`
+	Encryption  string `mapstructure:"encryption"`
+	URL         string `mapstructure:"url"`
+	Token       string `mapstructure:"token"`
+	ServiceHost string `mapstructure:"service_host"`
+	NodeService string `mapstructure:"node_service"`
+	MaxRetries  int    `mapstructure:"max_retries"`
+	Sandbox     bool   `mapstructure:"sandbox"`
+	Proxy       string `mapstructure:"proxy"`
+}
+
+// A passive check result to submit to Nagios
+type nagiosResult struct {
+	Host       string
+	Service    string
+	ReturnCode int
+	Output     string
+}
+
+// Submitting the same check result twice only sets the check's state again
+func (handler NagiosHandler) Idempotent() bool {
+	return true
+}
+
+func (handler NagiosHandler) Alert(datacenter string, alert *AlertState) error {
+	result := handler.result(datacenter, alert)
+
+	if handler.Sandbox {
+		logSandboxPayload("nagios", handler.destination(), fmt.Sprintf("host=%s service=%s return_code=%d output=%q",
+			result.Host, result.Service, result.ReturnCode, result.Output))
+		return nil
+	}
+
+	var err error
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if handler.Protocol == NRDPProtocol {
+			err = handler.submitNRDP(result)
+		} else {
+			err = handler.submitNSCA(result)
+		}
+		if err == nil {
+			return nil
+		}
+
+		log.Errorf("Error submitting check result to Nagios (%s: %s): %s", handler.Protocol, handler.destination(), err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying check result to Nagios in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler NagiosHandler) validate() error {
+	switch handler.Protocol {
+	case NSCAProtocol:
+		if handler.Address == "" {
+			return fmt.Errorf("address must be set")
+		}
+		if !contains([]string{"none", "xor"}, handler.Encryption) {
+			return fmt.Errorf("invalid encryption: %s (only none and xor are supported)", handler.Encryption)
+		}
+	case NRDPProtocol:
+		if !strings.HasPrefix(handler.URL, "http://") && !strings.HasPrefix(handler.URL, "https://") {
+			return fmt.Errorf("url must be an http:// or https:// URL")
+		}
+		if handler.Token == "" {
+			return fmt.Errorf("token must be set")
+		}
+	default:
+		return fmt.Errorf("invalid protocol: %s", handler.Protocol)
+	}
+	if handler.NodeService == "" {
+		return fmt.Errorf("node_service must be set")
+	}
+	return nil
+}
+
+// Returns where check results are submitted to
+func (handler NagiosHandler) destination() string {
+	if handler.Protocol == NRDPProtocol {
+		return handler.URL
+	}
+	return handler.Address
+}
+
+// Returns the passive check result for an alert
+func (handler NagiosHandler) result(datacenter string, alert *AlertState) nagiosResult {
+	result := nagiosResult{
+		Host:       alert.Node,
+		Service:    handler.NodeService,
+		ReturnCode: nagiosReturnCode(alert.Status),
+		Output:     alert.Message,
+	}
+	if details := detailsWithFields(alert); details != "" {
+		result.Output = result.Output + "\n" + details
+	}
+
+	if alert.Node == "" {
+		result.Host = handler.ServiceHost
+		if result.Host == "" {
+			result.Host = datacenter
+		}
+
+		result.Service = alert.Service
+		if alert.Tag != "" {
+			result.Service = result.Service + ":" + alert.Tag
+		}
+		if result.Service == "" {
+			result.Service = alert.Route
+		}
+	}
+	return result
+}
+
+// Returns the Nagios return code for a status
+func nagiosReturnCode(status string) int {
+	switch status {
+	case api.HealthPassing, InfoStatus:
+		return 0
+	case api.HealthWarning:
+		return 1
+	case api.HealthCritical:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// Submits a check result to an NSCA daemon. The daemon starts by sending an IV and
+// timestamp, which the packet has to be encrypted with and carry.
+func (handler NagiosHandler) submitNSCA(result nagiosResult) error {
+	address := handler.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "5667")
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	init := make([]byte, nscaInitPacketSize)
+	if _, err := io.ReadFull(conn, init); err != nil {
+		return fmt.Errorf("error reading NSCA init packet: %s", err)
+	}
+
+	packet := nscaPacket(result, binary.BigEndian.Uint32(init[nscaIVSize:]))
+	if handler.Encryption == "xor" {
+		nscaXOR(packet, init[:nscaIVSize], handler.Password)
+	}
+
+	_, err = conn.Write(packet)
+	return err
+}
+
+// Builds an NSCA version 3 data packet for a check result, with its CRC32 filled in
+func nscaPacket(result nagiosResult, timestamp uint32) []byte {
+	packet := make([]byte, nscaPacketSize)
+	binary.BigEndian.PutUint16(packet[0:], 3)
+	binary.BigEndian.PutUint32(packet[8:], timestamp)
+	binary.BigEndian.PutUint16(packet[12:], uint16(result.ReturnCode))
+
+	// Each field is null-terminated, and newlines in the output are escaped the way send_nsca
+	// expects them
+	output := strings.Replace(result.Output, "\n", `\n`, -1)
+	copy(packet[14:14+nscaHostSize-1], result.Host)
+	copy(packet[78:78+nscaServiceSize-1], result.Service)
+	copy(packet[206:206+nscaOutputSize-1], output)
+
+	binary.BigEndian.PutUint32(packet[4:], crc32.ChecksumIEEE(packet))
+	return packet
+}
+
+// Encrypts (or decrypts) a packet with NSCA's XOR encryption: XORed with the IV from the
+// init packet, then with the password
+func nscaXOR(packet []byte, iv []byte, password string) {
+	for i := range packet {
+		packet[i] ^= iv[i%len(iv)]
+	}
+	if password == "" {
+		return
+	}
+	for i := range packet {
+		packet[i] ^= password[i%len(password)]
+	}
+}
+
+// The XML format NRDP accepts check results in
+type nrdpCheckResults struct {
+	XMLName xml.Name          `xml:"checkresults"`
+	Results []nrdpCheckResult `xml:"checkresult"`
+}
+
+type nrdpCheckResult struct {
+	Type    string `xml:"type,attr"`
+	Host    string `xml:"hostname"`
+	Service string `xml:"servicename"`
+	State   int    `xml:"state"`
+	Output  string `xml:"output"`
+}
+
+// Submits a check result to an NRDP server
+func (handler NagiosHandler) submitNRDP(result nagiosResult) error {
+	data, err := xml.Marshal(nrdpCheckResults{Results: []nrdpCheckResult{{
+		Type:    "service",
+		Host:    result.Host,
+		Service: result.Service,
+		State:   result.ReturnCode,
+		Output:  result.Output,
+	}}})
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"token":   {handler.Token},
+		"cmd":     {"submitcheck"},
+		"XMLDATA": {xml.Header + string(data)},
+	}
+	resp, err := proxyHTTPClient(handler.Proxy).PostForm(handler.URL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	// NRDP reports errors such as a bad token in the body, with a 200
+	var reply struct {
+		Status  int    `xml:"status"`
+		Message string `xml:"message"`
+	}
+	if err := xml.NewDecoder(bytes.NewReader(body)).Decode(&reply); err == nil && reply.Status != 0 {
+		return fmt.Errorf("NRDP error: %s", reply.Message)
+	}
+	return nil
+}
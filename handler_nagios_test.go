@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestNagiosHandler_nsca(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	iv := bytes.Repeat([]byte{0x5a, 0xa5}, nscaIVSize/2)
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		init := make([]byte, nscaInitPacketSize)
+		copy(init, iv)
+		binary.BigEndian.PutUint32(init[nscaIVSize:], 1234)
+		conn.Write(init)
+
+		packet := make([]byte, nscaPacketSize)
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			t.Error(err)
+		}
+		received <- packet
+	}()
+
+	config, err := ParseConfig(`
+	handler "nagios" "legacy" {
+		address = "` + listener.Addr().String() + `"
+		encryption = "xor"
+		password = "secret"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{
+		Node:    "node1",
+		Status:  api.HealthCritical,
+		Message: "[dc1] node node1 is now critical",
+		Details: "serfHealth: agent not alive",
+	}
+	if err := config.Handlers["nagios.legacy"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := <-received
+	nscaXOR(packet, iv, "secret")
+
+	crc := binary.BigEndian.Uint32(packet[4:])
+	binary.BigEndian.PutUint32(packet[4:], 0)
+	if crc != crc32.ChecksumIEEE(packet) {
+		t.Errorf("bad CRC32 in packet")
+	}
+	if version := binary.BigEndian.Uint16(packet[0:]); version != 3 {
+		t.Errorf("expected version 3, got %d", version)
+	}
+	if timestamp := binary.BigEndian.Uint32(packet[8:]); timestamp != 1234 {
+		t.Errorf("expected the init packet's timestamp, got %d", timestamp)
+	}
+	if code := binary.BigEndian.Uint16(packet[12:]); code != 2 {
+		t.Errorf("expected return code 2, got %d", code)
+	}
+
+	field := func(b []byte) string {
+		return string(b[:bytes.IndexByte(b, 0)])
+	}
+	if host := field(packet[14:78]); host != "node1" {
+		t.Errorf("expected host node1, got %q", host)
+	}
+	if service := field(packet[78:206]); service != "Consul Health" {
+		t.Errorf("expected service Consul Health, got %q", service)
+	}
+	if output := field(packet[206:]); output != `[dc1] node node1 is now critical\nserfHealth: agent not alive` {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestNagiosHandler_nrdp(t *testing.T) {
+	posted := make(chan nrdpCheckResults, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("token") != "nrdptoken" || r.FormValue("cmd") != "submitcheck" {
+			t.Errorf("unexpected form: %v", r.Form)
+		}
+		var results nrdpCheckResults
+		if err := xml.Unmarshal([]byte(r.FormValue("XMLDATA")), &results); err != nil {
+			t.Error(err)
+		}
+		posted <- results
+		w.Write([]byte("<result><status>0</status><message>OK</message></result>"))
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "nagios" "nrdp" {
+		protocol = "nrdp"
+		url = "` + server.URL + `"
+		token = "nrdptoken"
+		service_host = "consul"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{
+		Service: "redis",
+		Tag:     "primary",
+		Status:  api.HealthWarning,
+		Message: "[dc1] service redis (tag: primary) is now warning",
+	}
+	if err := config.Handlers["nagios.nrdp"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	results := <-posted
+	expected := nrdpCheckResult{Type: "service", Host: "consul", Service: "redis:primary", State: 1, Output: alert.Message}
+	if len(results.Results) != 1 || results.Results[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, results.Results)
+	}
+}
+
+func TestNagiosHandler_nrdpError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<result><status>-1</status><message>BAD TOKEN</message></result>"))
+	}))
+	defer server.Close()
+
+	handler := NagiosHandler{Protocol: NRDPProtocol, URL: server.URL, Token: "wrong"}
+	if err := handler.submitNRDP(nagiosResult{Host: "consul", Service: "redis"}); err == nil {
+		t.Fatal("expected an error for a rejected token")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// The PagerDuty Events API v2 endpoint, used when severities are mapped, and the REST API used
+// to set incident priorities
+var (
+	pagerdutyEventsV2URL = "https://events.pagerduty.com/v2/enqueue"
+	pagerdutyAPIURL      = "https://api.pagerduty.com"
+)
+
+// The severities the Events API v2 accepts
+var pagerdutySeverities = []string{"critical", "error", "warning", "info"}
+
+// How many times to look for a newly triggered incident to set its priority, and how long to
+// wait between tries, since PagerDuty creates incidents from events asynchronously
+var (
+	pagerdutyIncidentLookups       = 5
+	pagerdutyIncidentLookupBackoff = 2 * time.Second
+)
+
+// An event sent to the PagerDuty Events API v2
+type pagerdutyV2Event struct {
+	RoutingKey  string              `json:"routing_key"`
+	EventAction string              `json:"event_action"`
+	DedupKey    string              `json:"dedup_key"`
+	Payload     *pagerdutyV2Payload `json:"payload,omitempty"`
+}
+
+type pagerdutyV2Payload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	Component     string      `json:"component,omitempty"`
+	Group         string      `json:"group,omitempty"`
+	CustomDetails interface{} `json:"custom_details,omitempty"`
+}
+
+// The priority IDs of PagerDuty accounts by their names, keyed by API token. These are kept
+// outside of the handlers so that handlers stay comparable when the config is reloaded.
+var pagerdutyPriorities = struct {
+	sync.Mutex
+	ids map[string]map[string]string
+}{ids: make(map[string]map[string]string)}
+
+// Checks that the handler's severity, priority and manual resolution settings are usable
+func (handler PagerdutyHandler) validate() error {
+	for status, severity := range handler.Severities {
+		if status != api.HealthWarning && status != api.HealthCritical {
+			return fmt.Errorf("severities can only be set for warning and critical, got %s", status)
+		}
+		if !contains(pagerdutySeverities, severity) {
+			return fmt.Errorf("invalid severity %q for %s, must be one of %s", severity, status, strings.Join(pagerdutySeverities, ", "))
+		}
+	}
+
+	for status, priority := range handler.Priorities {
+		if status != api.HealthWarning && status != api.HealthCritical {
+			return fmt.Errorf("priorities can only be set for warning and critical, got %s", status)
+		}
+		if priority == "" {
+			return fmt.Errorf("empty priority for %s", status)
+		}
+	}
+	if len(handler.Priorities) > 0 && (handler.APIToken == "" || handler.FromEmail == "") {
+		return fmt.Errorf("priorities require api_token and from_email")
+	}
+
+	for _, service := range handler.ManualResolve {
+		if isServicePattern(service) {
+			if _, err := newServicePattern(service); err != nil {
+				return fmt.Errorf("invalid manual_resolve pattern %s: %s", service, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the alert is a recovery that shouldn't resolve its incident, because its
+// service is resolved by hand
+func (handler PagerdutyHandler) manuallyResolved(alert *AlertState) bool {
+	if alert.Status != api.HealthPassing || alert.Service == "" {
+		return false
+	}
+	for _, service := range handler.ManualResolve {
+		if service == alert.Service {
+			return true
+		}
+		if isServicePattern(service) {
+			if pattern, err := newServicePattern(service); err == nil && pattern.matches(alert.Service) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the Events API v2 event for an alert, with its severity mapped from the alert's status
+func (handler PagerdutyHandler) v2Event(datacenter string, alert *AlertState) *pagerdutyV2Event {
+	event := &pagerdutyV2Event{
+		RoutingKey:  handler.ServiceKey,
+		EventAction: "trigger",
+		DedupKey:    pagerdutyIncidentKey(datacenter, alert),
+	}
+	if alert.Status == api.HealthPassing {
+		event.EventAction = "resolve"
+		return event
+	}
+
+	severity, ok := handler.Severities[alert.Status]
+	if !ok {
+		severity = alert.Status
+	}
+	source := alert.Node
+	if source == "" {
+		source = datacenter
+	}
+	summary := alert.Message
+	if len(summary) > 1024 {
+		summary = summary[:1024]
+	}
+
+	event.Payload = &pagerdutyV2Payload{
+		Summary:       summary,
+		Source:        source,
+		Severity:      severity,
+		Component:     alert.Service,
+		Group:         alert.Tag,
+		CustomDetails: pagerdutyDetails(alert),
+	}
+	return event
+}
+
+// Sets the priority of the incident for a triggered alert, if one is mapped for its status
+func (handler PagerdutyHandler) setPriority(client *http.Client, datacenter string, alert *AlertState) error {
+	name, ok := handler.Priorities[alert.Status]
+	if !ok {
+		return nil
+	}
+
+	priorityID, err := handler.priorityID(client, name)
+	if err != nil {
+		return err
+	}
+
+	incidentKey := pagerdutyIncidentKey(datacenter, alert)
+	var incidentID string
+	for tries := 0; tries < pagerdutyIncidentLookups && incidentID == ""; tries++ {
+		if tries > 0 {
+			time.Sleep(pagerdutyIncidentLookupBackoff)
+		}
+		if incidentID, err = handler.findIncident(client, incidentKey); err != nil {
+			return err
+		}
+	}
+	if incidentID == "" {
+		return fmt.Errorf("no open incident found for %s", incidentKey)
+	}
+
+	update := map[string]interface{}{
+		"incident": map[string]interface{}{
+			"type":     "incident_reference",
+			"priority": map[string]string{"id": priorityID, "type": "priority_reference"},
+		},
+	}
+	return handler.restRequest(client, "PUT", "/incidents/"+incidentID, update, nil)
+}
+
+// Returns the ID of the open incident with the given incident key, or an empty string if
+// there isn't one yet
+func (handler PagerdutyHandler) findIncident(client *http.Client, incidentKey string) (string, error) {
+	query := url.Values{"incident_key": []string{incidentKey}, "statuses[]": []string{"triggered", "acknowledged"}}
+	var result struct {
+		Incidents []struct {
+			ID string `json:"id"`
+		} `json:"incidents"`
+	}
+	if err := handler.restRequest(client, "GET", "/incidents?"+query.Encode(), nil, &result); err != nil {
+		return "", err
+	}
+	if len(result.Incidents) == 0 {
+		return "", nil
+	}
+	return result.Incidents[0].ID, nil
+}
+
+// Returns the ID of the account's priority with the given name (such as "P1"), looking up the
+// account's priorities the first time
+func (handler PagerdutyHandler) priorityID(client *http.Client, name string) (string, error) {
+	pagerdutyPriorities.Lock()
+	defer pagerdutyPriorities.Unlock()
+
+	ids, ok := pagerdutyPriorities.ids[handler.APIToken]
+	if !ok {
+		var result struct {
+			Priorities []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"priorities"`
+		}
+		if err := handler.restRequest(client, "GET", "/priorities", nil, &result); err != nil {
+			return "", fmt.Errorf("Error looking up priorities: %s", err)
+		}
+
+		ids = make(map[string]string)
+		for _, priority := range result.Priorities {
+			ids[priority.Name] = priority.ID
+		}
+		pagerdutyPriorities.ids[handler.APIToken] = ids
+	}
+
+	id, ok := ids[name]
+	if !ok {
+		return "", fmt.Errorf("no priority named %s (priorities may not be enabled on the account)", name)
+	}
+	return id, nil
+}
+
+// Makes a request to the PagerDuty REST API, decoding the response into result if it's non-nil
+func (handler PagerdutyHandler) restRequest(client *http.Client, method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, pagerdutyAPIURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token token="+handler.APIToken)
+	req.Header.Set("Accept", "application/vnd.pagerduty+json;version=2")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("From", handler.FromEmail)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if result != nil {
+		return json.Unmarshal(respBody, result)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestPagerdutyHandler_severitiesAndPriorities(t *testing.T) {
+	var event pagerdutyV2Event
+	var update map[string]map[string]map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.URL.Path == "/v2/enqueue":
+			event = pagerdutyV2Event{}
+			json.Unmarshal(body, &event)
+			w.Write([]byte(`{"status": "success", "message": "Event processed", "dedup_key": "x"}`))
+		case r.URL.Path == "/priorities":
+			if r.Header.Get("Authorization") != "Token token=secret" || r.Header.Get("From") != "ops@example.com" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"priorities": [{"id": "PRIO1", "name": "P1"}, {"id": "PRIO3", "name": "P3"}]}`))
+		case r.Method == "GET" && r.URL.Path == "/incidents":
+			if r.URL.Query().Get("incident_key") != event.DedupKey {
+				w.Write([]byte(`{"incidents": []}`))
+				return
+			}
+			w.Write([]byte(`{"incidents": [{"id": "INC1"}]}`))
+		case r.Method == "PUT" && r.URL.Path == "/incidents/INC1":
+			json.Unmarshal(body, &update)
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	defaultEventsURL, defaultAPIURL, defaultBackoff := pagerdutyEventsV2URL, pagerdutyAPIURL, pagerdutyIncidentLookupBackoff
+	pagerdutyEventsV2URL, pagerdutyAPIURL, pagerdutyIncidentLookupBackoff = server.URL+"/v2/enqueue", server.URL, time.Millisecond
+	defer func() {
+		pagerdutyEventsV2URL, pagerdutyAPIURL, pagerdutyIncidentLookupBackoff = defaultEventsURL, defaultAPIURL, defaultBackoff
+	}()
+
+	handler := PagerdutyHandler{
+		ServiceKey: "routing-key",
+		Severities: map[string]string{api.HealthWarning: "warning", api.HealthCritical: "critical"},
+		Priorities: map[string]string{api.HealthCritical: "P1"},
+		APIToken:   "secret",
+		FromEmail:  "ops@example.com",
+	}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{Node: "node1", Service: "redis", Status: api.HealthCritical, Message: "[dc1] redis is now critical"}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	if event.RoutingKey != "routing-key" || event.EventAction != "trigger" || event.Payload == nil {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if event.Payload.Severity != "critical" || event.Payload.Source != "node1" || event.Payload.Component != "redis" {
+		t.Errorf("unexpected payload: %+v", event.Payload)
+	}
+	if priority := update["incident"]["priority"]; priority["id"] != "PRIO1" {
+		t.Errorf("expected the incident's priority to be set to P1, got %v", update)
+	}
+
+	// Warnings have no priority mapped, so the incident is left alone
+	update = nil
+	alert.Status = api.HealthWarning
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	if event.Payload.Severity != "warning" || update != nil {
+		t.Errorf("unexpected warning event %+v (update: %v)", event.Payload, update)
+	}
+
+	alert.Status = api.HealthPassing
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	if event.EventAction != "resolve" || event.Payload != nil {
+		t.Errorf("unexpected resolve event: %+v", event)
+	}
+}
+
+func TestPagerdutyHandler_manualResolve(t *testing.T) {
+	handler := PagerdutyHandler{ServiceKey: "key", ManualResolve: []string{"redis", "db-*"}}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		alert    *AlertState
+		expected bool
+	}{
+		{&AlertState{Service: "redis", Status: api.HealthPassing}, true},
+		{&AlertState{Service: "db-main", Status: api.HealthPassing}, true},
+		{&AlertState{Service: "redis", Status: api.HealthCritical}, false},
+		{&AlertState{Service: "web", Status: api.HealthPassing}, false},
+		{&AlertState{Node: "node1", Status: api.HealthPassing}, false},
+	}
+	for _, c := range cases {
+		if resolved := handler.manuallyResolved(c.alert); resolved != c.expected {
+			t.Errorf("expected manuallyResolved to be %v for %s (%s)", c.expected, alertName(c.alert), c.alert.Status)
+		}
+	}
+
+	// The recovery is dropped without contacting PagerDuty
+	defaultURL := pagerdutyEventsURL
+	pagerdutyEventsURL = "http://events.pagerduty.invalid/create_event.json"
+	defer func() { pagerdutyEventsURL = defaultURL }()
+	if err := handler.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthPassing}); err != nil {
+		t.Errorf("expected the recovery to be skipped, got %s", err)
+	}
+}
+
+func TestPagerdutyHandler_validate(t *testing.T) {
+	invalid := []PagerdutyHandler{
+		{Severities: map[string]string{api.HealthPassing: "info"}},
+		{Severities: map[string]string{api.HealthCritical: "urgent"}},
+		{Priorities: map[string]string{api.HealthCritical: "P1"}},
+		{Priorities: map[string]string{api.HealthCritical: ""}, APIToken: "secret", FromEmail: "ops@example.com"},
+		{ManualResolve: []string{"/[/"}},
+	}
+	for _, handler := range invalid {
+		if err := handler.validate(); err == nil {
+			t.Errorf("expected an error for %+v", handler)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/kyhavlov/consul-alerting/plugin"
+)
+
+// PluginHandler sends alerts to a handler plugin: a separate binary built with the plugin
+// package, which is started on the first alert and kept running to be sent alerts over
+// JSON-RPC on its stdin and stdout. Alerts are passed to it in version 1 of the exec
+// handlers' alert JSON contract.
+type PluginHandler struct {
+	Command string   `mapstructure:"command"`
+	Args    []string `mapstructure:"args"`
+	Timeout int      `mapstructure:"timeout"`
+	Sandbox bool     `mapstructure:"sandbox"`
+}
+
+// How long a plugin has to exit once its stdin is closed before it's killed
+const pluginStopTimeout = 2 * time.Second
+
+// The plugins, keyed by their command line. These are kept outside of the handlers so that
+// handlers stay comparable when the config is reloaded, and handlers running the same command
+// share a plugin.
+var handlerPlugins = struct {
+	sync.Mutex
+	slots map[string]*pluginSlot
+}{slots: make(map[string]*pluginSlot)}
+
+// The running process for a plugin, if any. Each slot has its own lock, so that a plugin
+// waiting on its handshake doesn't hold up alerts to the other plugins.
+type pluginSlot struct {
+	sync.Mutex
+	process *pluginProcess
+
+	// Set once the slot has been removed, so it isn't started again
+	stopped bool
+}
+
+// A running plugin
+type pluginProcess struct {
+	cmd    *exec.Cmd
+	client *plugin.Client
+
+	// Closed once the process has exited
+	done chan struct{}
+}
+
+func (handler PluginHandler) Alert(datacenter string, alert *AlertState) error {
+	input, err := json.Marshal(newPluginAlert(datacenter, alert))
+	if err != nil {
+		return fmt.Errorf("Error forming alert for plugin: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("plugin", handler.Command, string(input))
+		return nil
+	}
+
+	process, err := handler.process()
+	if err != nil {
+		return fmt.Errorf("Error starting plugin %s: %s", handler.Command, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(handler.Timeout)*time.Second)
+	defer cancel()
+
+	err = process.client.Send(ctx, input)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Error sending alert to plugin %s: timed out after %ds", handler.Command, handler.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("Error sending alert to plugin %s: %s", handler.Command, err)
+	}
+	return nil
+}
+
+// Returns an alert as it's passed to plugins and to exec commands using version 1 of the alert
+// JSON contract. Lists and maps are always present, so they don't have to check for nulls.
+func newPluginAlert(datacenter string, alert *AlertState) *plugin.Alert {
+	p := &plugin.Alert{
+		Version:     1,
+		Datacenter:  datacenter,
+		Fingerprint: alertFingerprint(alert),
+		Status:      alert.Status,
+		LastStatus:  alert.LastAlerted,
+		Node:        alert.Node,
+		Service:     alert.Service,
+		Tag:         alert.Tag,
+		Route:       alert.Route,
+		Team:        alert.Team,
+		Message:     alert.Message,
+		Details:     alert.Details,
+		Changed:     alert.Changed,
+		Checks:      make([]plugin.Check, len(alert.Checks)),
+		Fields:      alert.Fields,
+		Labels:      alert.Labels,
+		Links:       (*plugin.Links)(alert.Links),
+		DeliveryID:  alert.DeliveryID,
+	}
+	for i, check := range alert.Checks {
+		p.Checks[i] = plugin.Check(check)
+	}
+	if p.Fields == nil {
+		p.Fields = map[string]string{}
+	}
+	if p.Labels == nil {
+		p.Labels = map[string]string{}
+	}
+	return p
+}
+
+// Checks that the handler's settings are usable
+func (handler PluginHandler) validate() error {
+	if handler.Command == "" {
+		return fmt.Errorf("command must be set")
+	}
+	if handler.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout: %d", handler.Timeout)
+	}
+	return nil
+}
+
+// Returns the key the handler's plugin is kept under
+func (handler PluginHandler) key() string {
+	return strings.Join(append([]string{handler.Command}, handler.Args...), "\x00")
+}
+
+// Returns the handler's running plugin, starting it if it isn't running or restarting it if
+// it has exited
+func (handler PluginHandler) process() (*pluginProcess, error) {
+	key := handler.key()
+	handlerPlugins.Lock()
+	slot, ok := handlerPlugins.slots[key]
+	if !ok {
+		slot = &pluginSlot{}
+		handlerPlugins.slots[key] = slot
+	}
+	handlerPlugins.Unlock()
+
+	slot.Lock()
+	defer slot.Unlock()
+
+	if slot.stopped {
+		return nil, fmt.Errorf("plugin was stopped")
+	}
+	if slot.process != nil {
+		if !slot.process.exited() {
+			return slot.process, nil
+		}
+		log.Warnf("Plugin %s exited, restarting it", handler.Command)
+		slot.process.stop()
+		slot.process = nil
+	}
+
+	process, err := startPlugin(handler.Command, handler.Args, time.Duration(handler.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	slot.process = process
+	return process, nil
+}
+
+// Starts a plugin and waits up to timeout for its handshake
+func startPlugin(command string, args []string, timeout time.Duration) (*pluginProcess, error) {
+	stdout, stdoutWriter := io.Pipe()
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), plugin.MagicCookieKey+"="+plugin.ProtocolVersion)
+	stderr := pluginLogWriter(command)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		stderr.Close()
+		return nil, err
+	}
+
+	process := &pluginProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		stdoutWriter.Close()
+		stderr.Close()
+		close(process.done)
+	}()
+
+	dialed := make(chan error, 1)
+	go func() {
+		client, err := plugin.Dial(stdin, stdout)
+		process.client = client
+		dialed <- err
+	}()
+
+	select {
+	case err = <-dialed:
+	case <-time.After(timeout):
+		err = fmt.Errorf("no handshake after %s", timeout)
+	}
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		<-process.done
+		return nil, err
+	}
+	return process, nil
+}
+
+// Returns a writer logging each line a plugin writes to stderr as a warning
+func pluginLogWriter(command string) *io.PipeWriter {
+	r, w := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			log.Warnf("Plugin %s: %s", command, scanner.Text())
+		}
+	}()
+	return w
+}
+
+// Returns whether the plugin has exited
+func (p *pluginProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closes the plugin's stdin so it exits, killing it if it doesn't exit in time
+func (p *pluginProcess) stop() {
+	p.client.Close()
+	select {
+	case <-p.done:
+	case <-time.After(pluginStopTimeout):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// Stops the running plugins that none of the given handlers use, such as after a reload
+// removes their handlers
+func stopUnusedPlugins(handlers map[string]AlertHandler) {
+	used := make(map[string]bool)
+	for _, handler := range handlers {
+		if handler, ok := unwrapHandler(handler).(PluginHandler); ok {
+			used[handler.key()] = true
+		}
+	}
+
+	handlerPlugins.Lock()
+	unused := make([]*pluginSlot, 0)
+	for key, slot := range handlerPlugins.slots {
+		if !used[key] {
+			unused = append(unused, slot)
+			delete(handlerPlugins.slots, key)
+		}
+	}
+	handlerPlugins.Unlock()
+
+	for _, slot := range unused {
+		slot.Lock()
+		if slot.process != nil {
+			slot.process.stop()
+			slot.process = nil
+		}
+		slot.stopped = true
+		slot.Unlock()
+	}
+}
+
+// Stops all of the running plugins
+func stopPlugins() {
+	stopUnusedPlugins(nil)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/kyhavlov/consul-alerting/plugin"
+)
+
+// A handler plugin that writes the alerts it's sent to the file in TEST_PLUGIN_OUT
+type testPlugin struct{}
+
+func (testPlugin) Alert(alert *plugin.Alert) error {
+	if alert.Service == "fail" {
+		return errors.New("oops")
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(os.Getenv("TEST_PLUGIN_OUT"), body, 0644)
+}
+
+// Returns the number of plugins that are running
+func runningPlugins() int {
+	handlerPlugins.Lock()
+	defer handlerPlugins.Unlock()
+
+	running := 0
+	for _, slot := range handlerPlugins.slots {
+		slot.Lock()
+		if slot.process != nil && !slot.process.exited() {
+			running++
+		}
+		slot.Unlock()
+	}
+	return running
+}
+
+// Runs the test binary as a handler plugin when started by TestPluginHandler_alert
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("TEST_PLUGIN_OUT") == "" {
+		return
+	}
+	plugin.Serve(testPlugin{})
+	os.Exit(0)
+}
+
+func TestPluginHandler_alert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	os.Setenv("TEST_PLUGIN_OUT", out)
+	defer os.Unsetenv("TEST_PLUGIN_OUT")
+	defer stopPlugins()
+
+	handler := PluginHandler{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=TestPluginHelperProcess"},
+		Timeout: 5,
+	}
+	alert := &AlertState{Node: "node1", Service: "redis", Status: api.HealthCritical, Message: "redis is now critical"}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received plugin.Alert
+	if err := json.Unmarshal(body, &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Version != 1 || received.Datacenter != "dc1" || received.Service != "redis" || received.Fingerprint != alertFingerprint(alert) {
+		t.Errorf("unexpected alert: %s", body)
+	}
+
+	// The plugin is kept running between alerts, and its errors fail the alert
+	err = handler.Alert("dc1", &AlertState{Service: "fail", Status: api.HealthCritical})
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected the plugin's error, got %v", err)
+	}
+	if running := runningPlugins(); running != 1 {
+		t.Errorf("expected 1 running plugin, got %d", running)
+	}
+
+	stopUnusedPlugins(map[string]AlertHandler{"plugin.other": PluginHandler{Command: "other"}})
+	if running := runningPlugins(); running != 0 {
+		t.Errorf("expected the unused plugin to be stopped, got %d running", running)
+	}
+}
+
+func TestPluginHandler_notPlugin(t *testing.T) {
+	handler := PluginHandler{Command: "true", Timeout: 5}
+	if err := handler.Alert("dc1", &AlertState{Service: "redis"}); err == nil || !strings.Contains(err.Error(), "no handshake") {
+		t.Errorf("expected an error starting the plugin, got %v", err)
+	}
+	if running := runningPlugins(); running != 0 {
+		t.Errorf("expected the failed plugin to be dropped, got %d running", running)
+	}
+}
+
+// A plugin waiting on its handshake shouldn't hold up alerts to other plugins
+func TestPluginHandler_slowStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("TEST_PLUGIN_OUT", filepath.Join(dir, "out"))
+	defer os.Unsetenv("TEST_PLUGIN_OUT")
+	defer stopPlugins()
+
+	slow := PluginHandler{Command: "sleep", Args: []string{"10"}, Timeout: 3}
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		slow.Alert("dc1", &AlertState{Service: "redis"})
+	}()
+	<-started
+	time.Sleep(100 * time.Millisecond)
+
+	handler := PluginHandler{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=TestPluginHelperProcess"},
+		Timeout: 5,
+	}
+	start := time.Now()
+	if err := handler.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthCritical}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the alert not to wait on the other plugin's handshake, took %s", elapsed)
+	}
+}
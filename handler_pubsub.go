@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The OAuth2 scope needed for publishing to Pub/Sub
+const pubsubScope = "https://www.googleapis.com/auth/pubsub"
+
+// PubsubHandler publishes alerts to a GCP Pub/Sub topic, for fanning them out to Cloud
+// Functions, Dataflow and other subscribers. The message data is the alert as JSON, and the
+// status, datacenter, node, service and tag are attached as attributes so subscriptions can
+// filter on them. It authenticates with a service account key, or the metadata server's token
+// for the attached service account (such as with GKE workload identity) if no key is given.
+type PubsubHandler struct {
+	Project         string `mapstructure:"project"`
+	Topic           string `mapstructure:"topic"`
+	CredentialsFile string `mapstructure:"credentials_file"`
+	Endpoint        string `mapstructure:"endpoint"`
+	MaxRetries      int    `mapstructure:"max_retries"`
+	Sandbox         bool   `mapstructure:"sandbox"`
+	Proxy           string `mapstructure:"proxy"`
+}
+
+// The alert as published in the message data
+type pubsubAlert struct {
+	Datacenter string `json:"datacenter"`
+	*AlertState
+}
+
+// A message in Pub/Sub's publish request
+type pubsubMessage struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type pubsubPublishRequest struct {
+	Messages []pubsubMessage `json:"messages"`
+}
+
+func (handler PubsubHandler) Alert(datacenter string, alert *AlertState) error {
+	message, err := handler.message(datacenter, alert)
+	if err != nil {
+		return fmt.Errorf("Error forming Pub/Sub message: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("pubsub", handler.topicPath(), sandboxJSON(map[string]interface{}{
+			"data":       string(message.Data),
+			"attributes": message.Attributes,
+		}))
+		return nil
+	}
+
+	body, err := json.Marshal(pubsubPublishRequest{Messages: []pubsubMessage{message}})
+	if err != nil {
+		return fmt.Errorf("Error forming Pub/Sub message: %s", err)
+	}
+
+	auth := gcpAuthConfig{
+		CredentialsFile: handler.CredentialsFile,
+		Scope:           pubsubScope,
+		Proxy:           handler.Proxy,
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		var token string
+		if token, err = auth.token(time.Now()); err == nil {
+			err = handler.publish(token, body)
+		}
+		if err == nil {
+			return nil
+		}
+
+		log.Errorf("Error publishing alert to Pub/Sub (topic: %s): %s", handler.topicPath(), err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying Pub/Sub publish in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler PubsubHandler) validate() error {
+	if handler.Topic == "" {
+		return fmt.Errorf("topic must be set")
+	}
+	if !strings.HasPrefix(handler.Topic, "projects/") && handler.Project == "" {
+		return fmt.Errorf("project must be set when topic isn't a full topic path")
+	}
+	if !strings.HasPrefix(handler.Endpoint, "http://") && !strings.HasPrefix(handler.Endpoint, "https://") {
+		return fmt.Errorf("endpoint must be an http:// or https:// URL")
+	}
+	return nil
+}
+
+// Returns the full path of the topic, such as projects/my-project/topics/alerts
+func (handler PubsubHandler) topicPath() string {
+	if strings.HasPrefix(handler.Topic, "projects/") {
+		return handler.Topic
+	}
+	return fmt.Sprintf("projects/%s/topics/%s", handler.Project, handler.Topic)
+}
+
+// Returns the Pub/Sub message for an alert
+func (handler PubsubHandler) message(datacenter string, alert *AlertState) (pubsubMessage, error) {
+	data, err := json.Marshal(pubsubAlert{Datacenter: datacenter, AlertState: alert})
+	if err != nil {
+		return pubsubMessage{}, err
+	}
+
+	// Only set the attributes the alert has, so filters like attributes:node work
+	attributes := make(map[string]string)
+	for _, attribute := range [][2]string{
+		{"status", alert.Status},
+		{"datacenter", datacenter},
+		{"node", alert.Node},
+		{"service", alert.Service},
+		{"tag", alert.Tag},
+	} {
+		if attribute[1] != "" {
+			attributes[attribute[0]] = attribute[1]
+		}
+	}
+
+	return pubsubMessage{Data: data, Attributes: attributes}, nil
+}
+
+// Publishes a message to the topic
+func (handler PubsubHandler) publish(token string, body []byte) error {
+	endpoint := strings.TrimSuffix(handler.Endpoint, "/") + "/v1/" + handler.topicPath() + ":publish"
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
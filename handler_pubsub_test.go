@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Starts a fake Pub/Sub server that expects the given token, returning the published requests
+func testPubsubServer(t *testing.T, token string) (*httptest.Server, chan pubsubPublishRequest) {
+	published := make(chan pubsubPublishRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/my-project/topics/alerts:publish" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer "+token {
+			t.Errorf("unexpected authorization header %q", auth)
+		}
+		var req pubsubPublishRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		published <- req
+		w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	return server, published
+}
+
+func TestPubsubHandler_serviceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if grant := r.FormValue("grant_type"); grant != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("unexpected grant type %s", grant)
+		}
+
+		// Check the assertion is signed by the service account's key
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("malformed assertion: %s", r.FormValue("assertion"))
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("bad assertion signature: %s", err)
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if !strings.Contains(string(claims), `"iss":"alerts@my-project.iam.gserviceaccount.com"`) ||
+			!strings.Contains(string(claims), `"scope":"`+pubsubScope+`"`) {
+			t.Errorf("unexpected claims: %s", claims)
+		}
+
+		w.Write([]byte(`{"access_token": "sa-token", "expires_in": 3600}`))
+	}))
+	defer tokenServer.Close()
+
+	dir, err := ioutil.TempDir("", "pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	credentials, _ := json.Marshal(gcpServiceAccountKey{
+		Type:         "service_account",
+		ProjectID:    "my-project",
+		PrivateKeyID: "key1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		ClientEmail:  "alerts@my-project.iam.gserviceaccount.com",
+		TokenURI:     tokenServer.URL,
+	})
+	credentialsFile := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(credentialsFile, credentials, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, published := testPubsubServer(t, "sa-token")
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "pubsub" "gcp" {
+		project = "my-project"
+		topic = "alerts"
+		credentials_file = "` + credentialsFile + `"
+		endpoint = "` + server.URL + `"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{
+		Node:    "node1",
+		Service: "redis",
+		Status:  api.HealthCritical,
+		Message: "[dc1] service redis is now critical",
+	}
+	if err := config.Handlers["pubsub.gcp"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-published
+	if len(req.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(req.Messages))
+	}
+	expected := map[string]string{"status": api.HealthCritical, "datacenter": "dc1", "node": "node1", "service": "redis"}
+	if !reflect.DeepEqual(req.Messages[0].Attributes, expected) {
+		t.Errorf("expected attributes %v, got %v", expected, req.Messages[0].Attributes)
+	}
+	var data pubsubAlert
+	if err := json.Unmarshal(req.Messages[0].Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Datacenter != "dc1" || data.Message != alert.Message {
+		t.Errorf("unexpected message data: %s", req.Messages[0].Data)
+	}
+}
+
+func TestPubsubHandler_metadataServer(t *testing.T) {
+	os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Error("expected the Metadata-Flavor header")
+		}
+		w.Write([]byte(`{"access_token": "wi-token", "expires_in": 3600}`))
+	}))
+	defer metadata.Close()
+	defer func(url string) { gcpMetadataTokenURL = url }(gcpMetadataTokenURL)
+	gcpMetadataTokenURL = metadata.URL
+
+	server, published := testPubsubServer(t, "wi-token")
+	defer server.Close()
+
+	handler := PubsubHandler{Topic: "projects/my-project/topics/alerts", Endpoint: server.URL}
+	if err := handler.Alert("dc1", &AlertState{Node: "node1", Status: api.HealthWarning}); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-published; req.Messages[0].Attributes["status"] != api.HealthWarning {
+		t.Errorf("unexpected message: %+v", req.Messages[0])
+	}
+}
+
+func TestPubsubHandler_validate(t *testing.T) {
+	if _, err := ParseConfig(`handler "pubsub" "gcp" { topic = "alerts" }`); err == nil {
+		t.Fatal("expected an error for a topic name without a project")
+	}
+}
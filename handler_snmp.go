@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Well-known OIDs included in every SNMPv2 trap
+const (
+	snmpSysUpTimeOID = "1.3.6.1.2.1.1.3.0"
+	snmpTrapOIDOID   = "1.3.6.1.6.3.1.1.4.1.0"
+)
+
+// The default engine ID used for SNMPv3 traps: the net-snmp enterprise number in the
+// RFC 3411 text format, followed by "consul-alerting"
+const snmpDefaultEngineID = "80001f8804636f6e73756c2d616c657274696e67"
+
+// Used for computing sysUpTime and the engine time for SNMPv3
+var snmpStartTime = time.Now()
+
+// SNMPHandler sends an SNMP trap for each alert, for integrating with NOC consoles
+// that only speak SNMP. Both v2c (community-based) and v3 (USM, with optional
+// MD5/SHA authentication and AES privacy) traps are supported.
+//
+// Each trap has the alert's fields attached as string varbinds under varbind_oid:
+// .1 status, .2 datacenter, .3 node, .4 service, .5 tag, .6 message and .7 details.
+type SNMPHandler struct {
+	Address    string `mapstructure:"address"`
+	Version    string `mapstructure:"version"`
+	Community  string `mapstructure:"community"`
+	TrapOID    string `mapstructure:"trap_oid"`
+	VarbindOID string `mapstructure:"varbind_oid"`
+
+	User         string `mapstructure:"user"`
+	AuthProtocol string `mapstructure:"auth_protocol"`
+	AuthPassword string `mapstructure:"auth_password"`
+	PrivProtocol string `mapstructure:"priv_protocol"`
+	PrivPassword string `mapstructure:"priv_password"`
+	EngineID     string `mapstructure:"engine_id"`
+	Sandbox      bool   `mapstructure:"sandbox"`
+}
+
+func (handler SNMPHandler) Alert(datacenter string, alert *AlertState) error {
+	message, err := handler.trap(datacenter, alert)
+	if err != nil {
+		return fmt.Errorf("Error building SNMP trap: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("snmp", handler.Address, hex.Dump(message))
+		return nil
+	}
+
+	conn, err := net.Dial("udp", handler.Address)
+	if err != nil {
+		return fmt.Errorf("Error sending SNMP trap to %s: %s", handler.Address, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(message); err != nil {
+		return fmt.Errorf("Error sending SNMP trap to %s: %s", handler.Address, err)
+	}
+
+	return nil
+}
+
+// Checks that the handler's settings are usable
+func (handler SNMPHandler) validate() error {
+	if handler.Address == "" {
+		return fmt.Errorf("address must be set")
+	}
+
+	for _, oid := range []string{handler.TrapOID, handler.VarbindOID} {
+		if _, err := berOID(oid); err != nil {
+			return err
+		}
+	}
+
+	switch handler.Version {
+	case "2c":
+		return nil
+	case "3":
+	default:
+		return fmt.Errorf("invalid version: %s", handler.Version)
+	}
+
+	if handler.User == "" {
+		return fmt.Errorf("user must be set for SNMPv3")
+	}
+	if _, err := hex.DecodeString(handler.EngineID); err != nil {
+		return fmt.Errorf("invalid engine_id: %s", err)
+	}
+
+	switch handler.AuthProtocol {
+	case "":
+		if handler.PrivProtocol != "" {
+			return fmt.Errorf("priv_protocol requires auth_protocol to be set")
+		}
+	case "md5", "sha":
+		if len(handler.AuthPassword) < 8 {
+			return fmt.Errorf("auth_password must be at least 8 characters")
+		}
+	default:
+		return fmt.Errorf("invalid auth_protocol: %s", handler.AuthProtocol)
+	}
+
+	switch handler.PrivProtocol {
+	case "":
+	case "aes":
+		if len(handler.PrivPassword) < 8 {
+			return fmt.Errorf("priv_password must be at least 8 characters")
+		}
+	default:
+		return fmt.Errorf("invalid priv_protocol: %s", handler.PrivProtocol)
+	}
+
+	return nil
+}
+
+// Returns the encoded trap message for an alert
+func (handler SNMPHandler) trap(datacenter string, alert *AlertState) ([]byte, error) {
+	requestID, err := snmpRandomInt()
+	if err != nil {
+		return nil, err
+	}
+
+	uptime := uint32(time.Since(snmpStartTime) / (10 * time.Millisecond))
+	pdu, err := handler.trapPDU(requestID, uptime, datacenter, alert)
+	if err != nil {
+		return nil, err
+	}
+
+	if handler.Version != "3" {
+		return berSequence(
+			berInteger(0x02, 1), // SNMPv2c
+			berOctets([]byte(handler.Community)),
+			pdu,
+		), nil
+	}
+
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	engineTime := int64(time.Since(snmpStartTime) / time.Second)
+
+	return handler.v3Message(pdu, int64(requestID), 1, engineTime, salt)
+}
+
+// Builds an SNMPv2-Trap PDU with the standard sysUpTime/snmpTrapOID varbinds followed by
+// the alert's fields
+func (handler SNMPHandler) trapPDU(requestID int32, uptime uint32, datacenter string, alert *AlertState) ([]byte, error) {
+	trapOID, err := berOID(handler.TrapOID)
+	if err != nil {
+		return nil, err
+	}
+
+	varbinds := [][]byte{
+		berSequence(mustBerOID(snmpSysUpTimeOID), berInteger(0x43, int64(uptime))),
+		berSequence(mustBerOID(snmpTrapOIDOID), trapOID),
+	}
+
+	fields := []string{alert.Status, datacenter, alert.Node, alert.Service, alert.Tag, alert.Message, alert.Details}
+	for i, value := range fields {
+		oid, err := berOID(handler.VarbindOID + "." + strconv.Itoa(i+1))
+		if err != nil {
+			return nil, err
+		}
+		varbinds = append(varbinds, berSequence(oid, berOctets([]byte(value))))
+	}
+
+	return berTLV(0xa7, bytes.Join([][]byte{
+		berInteger(0x02, int64(requestID)),
+		berInteger(0x02, 0), // error-status
+		berInteger(0x02, 0), // error-index
+		berSequence(varbinds...),
+	}, nil)), nil
+}
+
+// Wraps a PDU in an SNMPv3 message using the user-based security model (RFC 3414),
+// encrypting (RFC 3826) and authenticating it if the handler is configured to
+func (handler SNMPHandler) v3Message(pdu []byte, msgID int64, boots int64, engineTime int64, salt []byte) ([]byte, error) {
+	engineID, err := hex.DecodeString(handler.EngineID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid engine_id: %s", err)
+	}
+
+	newHash := handler.authHash()
+	var flags byte
+	if newHash != nil {
+		flags |= 0x01
+	}
+
+	data := berSequence(berOctets(engineID), berOctets(nil), pdu)
+	privParams := []byte{}
+	if handler.PrivProtocol == "aes" {
+		flags |= 0x02
+		key := snmpLocalizeKey(handler.PrivPassword, engineID, newHash)[:16]
+
+		iv := make([]byte, 16)
+		binary.BigEndian.PutUint32(iv[0:4], uint32(boots))
+		binary.BigEndian.PutUint32(iv[4:8], uint32(engineTime))
+		copy(iv[8:], salt)
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		encrypted := make([]byte, len(data))
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, data)
+
+		data = berOctets(encrypted)
+		privParams = salt
+	}
+
+	// The authentication parameters are zeroed while computing the HMAC, then filled in
+	var authParams []byte
+	if newHash != nil {
+		authParams = make([]byte, 12)
+	}
+
+	secFields := [][]byte{
+		berOctets(engineID),
+		berInteger(0x02, boots),
+		berInteger(0x02, engineTime),
+		berOctets([]byte(handler.User)),
+	}
+	authOffset := len(bytes.Join(secFields, nil))
+	secFields = append(secFields, berOctets(authParams), berOctets(privParams))
+	secParams := berSequence(secFields...)
+	secOctets := berOctets(secParams)
+
+	parts := [][]byte{
+		berInteger(0x02, 3), // SNMPv3
+		berSequence(
+			berInteger(0x02, msgID),
+			berInteger(0x02, 65507), // max message size
+			berOctets([]byte{flags}),
+			berInteger(0x02, 3), // USM
+		),
+	}
+	authOffset += len(bytes.Join(parts, nil)) +
+		(len(secOctets) - len(secParams)) +
+		(len(secParams) - len(bytes.Join(secFields, nil))) +
+		2 // the tag and length of the auth parameters
+
+	body := bytes.Join(append(parts, secOctets, data), nil)
+	message := berTLV(0x30, body)
+	authOffset += len(message) - len(body)
+
+	if newHash != nil {
+		mac := hmac.New(newHash, snmpLocalizeKey(handler.AuthPassword, engineID, newHash))
+		mac.Write(message)
+		copy(message[authOffset:authOffset+12], mac.Sum(nil)[:12])
+	}
+
+	return message, nil
+}
+
+// Returns the hash function for the handler's auth protocol, or nil if there's no authentication
+func (handler SNMPHandler) authHash() func() hash.Hash {
+	switch handler.AuthProtocol {
+	case "md5":
+		return md5.New
+	case "sha":
+		return sha1.New
+	}
+	return nil
+}
+
+// Converts a password to a key localized to the given engine ID, as described in RFC 3414 A.2
+func snmpLocalizeKey(password string, engineID []byte, newHash func() hash.Hash) []byte {
+	h := newHash()
+	buf := make([]byte, 64)
+	index := 0
+	for count := 0; count < 1048576; count += len(buf) {
+		for i := range buf {
+			buf[i] = password[index%len(password)]
+			index++
+		}
+		h.Write(buf)
+	}
+	key := h.Sum(nil)
+
+	h.Reset()
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// Returns a random positive 32-bit integer for use as a request/message ID
+func snmpRandomInt() (int32, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(buf) & 0x7fffffff), nil
+}
+
+// Encodes a BER tag-length-value
+func berTLV(tag byte, value []byte) []byte {
+	encoded := []byte{tag}
+	if len(value) < 0x80 {
+		encoded = append(encoded, byte(len(value)))
+	} else {
+		var length []byte
+		for n := len(value); n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		encoded = append(encoded, 0x80|byte(len(length)))
+		encoded = append(encoded, length...)
+	}
+	return append(encoded, value...)
+}
+
+// Encodes an integer using the minimal two's complement form, with the given tag so it
+// can be used for application types like TimeTicks
+func berInteger(tag byte, n int64) []byte {
+	var value []byte
+	for {
+		value = append([]byte{byte(n)}, value...)
+		if n >= -128 && n < 128 {
+			break
+		}
+		n >>= 8
+	}
+	return berTLV(tag, value)
+}
+
+func berOctets(value []byte) []byte {
+	return berTLV(0x04, value)
+}
+
+func berSequence(parts ...[]byte) []byte {
+	return berTLV(0x30, bytes.Join(parts, nil))
+}
+
+// Encodes a dotted object identifier, such as 1.3.6.1.2.1.1.3.0
+func berOID(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID: %q", oid)
+	}
+
+	arcs := make([]uint64, len(parts))
+	for i, part := range parts {
+		arc, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID: %q", oid)
+		}
+		arcs[i] = arc
+	}
+	if arcs[0] > 2 || (arcs[0] < 2 && arcs[1] >= 40) {
+		return nil, fmt.Errorf("invalid OID: %q", oid)
+	}
+
+	value := berOIDArc(arcs[0]*40 + arcs[1])
+	for _, arc := range arcs[2:] {
+		value = append(value, berOIDArc(arc)...)
+	}
+	return berTLV(0x06, value), nil
+}
+
+// Encodes a single OID arc in base 128, with the high bit set on all but the last byte
+func berOIDArc(n uint64) []byte {
+	encoded := []byte{byte(n & 0x7f)}
+	for n >>= 7; n > 0; n >>= 7 {
+		encoded = append([]byte{byte(n&0x7f) | 0x80}, encoded...)
+	}
+	return encoded
+}
+
+// Encodes one of the constant OIDs above
+func mustBerOID(oid string) []byte {
+	encoded, err := berOID(oid)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSNMP_berEncoding(t *testing.T) {
+	cases := []struct {
+		encoded  []byte
+		expected string
+	}{
+		{berInteger(0x02, 0), "020100"},
+		{berInteger(0x02, 127), "02017f"},
+		{berInteger(0x02, 128), "02020080"},
+		{berInteger(0x02, -1), "0201ff"},
+		{berInteger(0x02, 65507), "020300ffe3"},
+		{mustBerOID(snmpSysUpTimeOID), "06082b06010201010300"},
+		{mustBerOID("1.3.6.1.4.1.8072"), "06072b06010401bf08"},
+		{berOctets(make([]byte, 200))[:3], "0481c8"},
+	}
+
+	for i, c := range cases {
+		if actual := hex.EncodeToString(c.encoded); actual != c.expected {
+			t.Errorf("case %d: expected %s, got %s", i, c.expected, actual)
+		}
+	}
+
+	for _, oid := range []string{"1", "1.3.x", "3.1", "1.40"} {
+		if _, err := berOID(oid); err == nil {
+			t.Errorf("expected an error for OID %q", oid)
+		}
+	}
+}
+
+// Test vectors from RFC 3414 A.3
+func TestSNMP_localizeKey(t *testing.T) {
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+
+	if key := hex.EncodeToString(snmpLocalizeKey("maplesyrup", engineID, md5.New)); key != "526f5eed9fcce26f8964c2930787d82b" {
+		t.Errorf("unexpected MD5 key: %s", key)
+	}
+
+	if key := hex.EncodeToString(snmpLocalizeKey("maplesyrup", engineID, sha1.New)); key != "6695febc9288e36282235fc7151f128497b38f3f" {
+		t.Errorf("unexpected SHA key: %s", key)
+	}
+}
+
+func TestSNMP_v2cTrap(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	handler := SNMPHandler{
+		Address:    conn.LocalAddr().String(),
+		Version:    "2c",
+		Community:  "noc",
+		TrapOID:    "1.3.6.1.4.1.8072.9999.9999.1.0.1",
+		VarbindOID: "1.3.6.1.4.1.8072.9999.9999.1.1",
+	}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.Alert("dc1", &AlertState{Status: "critical", Service: "redis", Message: "redis is now critical"}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trap := buf[:n]
+
+	// Version 1 (v2c) followed by the community, right after the message header
+	if !bytes.Contains(trap[:16], append(berInteger(0x02, 1), berOctets([]byte("noc"))...)) {
+		t.Errorf("unexpected trap header: %x", trap[:16])
+	}
+	for _, expected := range [][]byte{mustBerOID(snmpTrapOIDOID), mustBerOID(handler.TrapOID), []byte("redis is now critical")} {
+		if !bytes.Contains(trap, expected) {
+			t.Errorf("expected trap to contain %x", expected)
+		}
+	}
+}
+
+func TestSNMP_v3Authentication(t *testing.T) {
+	handler := SNMPHandler{
+		Version:      "3",
+		User:         "alerting",
+		AuthProtocol: "sha",
+		AuthPassword: "maplesyrup",
+		PrivProtocol: "aes",
+		PrivPassword: "maplesyrup",
+		EngineID:     snmpDefaultEngineID,
+	}
+
+	pdu := []byte{0xa7, 0x00}
+	message, err := handler.v3Message(pdu, 1, 1, 100, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the auth parameters, which directly follow the user name
+	user := berOctets([]byte("alerting"))
+	offset := bytes.Index(message, user) + len(user) + 2
+	if offset < len(user)+2 {
+		t.Fatal("user name not found in message")
+	}
+	authParams := append([]byte{}, message[offset:offset+12]...)
+
+	// The HMAC is computed over the message with the auth parameters zeroed
+	copy(message[offset:offset+12], make([]byte, 12))
+	engineID, _ := hex.DecodeString(snmpDefaultEngineID)
+	mac := hmac.New(sha1.New, snmpLocalizeKey("maplesyrup", engineID, sha1.New))
+	mac.Write(message)
+	if !bytes.Equal(authParams, mac.Sum(nil)[:12]) {
+		t.Errorf("expected auth parameters %x, got %x", mac.Sum(nil)[:12], authParams)
+	}
+
+	// The PDU should be encrypted
+	if bytes.Contains(message, pdu) {
+		t.Error("expected the scoped PDU to be encrypted")
+	}
+}
+
+func TestSNMP_validate(t *testing.T) {
+	base := SNMPHandler{
+		Address:    "127.0.0.1:162",
+		Version:    "3",
+		TrapOID:    "1.3.6.1.4.1.8072.9999.9999.1.0.1",
+		VarbindOID: "1.3.6.1.4.1.8072.9999.9999.1.1",
+		User:       "alerting",
+		EngineID:   snmpDefaultEngineID,
+	}
+	if err := base.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []func(h *SNMPHandler){
+		func(h *SNMPHandler) { h.Address = "" },
+		func(h *SNMPHandler) { h.Version = "1" },
+		func(h *SNMPHandler) { h.User = "" },
+		func(h *SNMPHandler) { h.TrapOID = "bogus" },
+		func(h *SNMPHandler) { h.AuthProtocol = "sha"; h.AuthPassword = "short" },
+		func(h *SNMPHandler) { h.PrivProtocol = "aes"; h.PrivPassword = "maplesyrup" },
+		func(h *SNMPHandler) { h.EngineID = "xyz" },
+	}
+	for i, modify := range invalid {
+		handler := base
+		modify(&handler)
+		if err := handler.validate(); err == nil {
+			t.Errorf("case %d: expected a validation error", i)
+		}
+	}
+}
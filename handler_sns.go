@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The longest subject SNS accepts, and the length SMS messages are cut to
+const (
+	snsMaxSubjectLength = 100
+	snsMaxSMSLength     = 140
+)
+
+// SNSHandler publishes alerts to an AWS SNS topic, for fanning them out to Lambda functions,
+// SQS queues, SMS and other subscribers. Each protocol gets its own form of the message: SQS
+// and Lambda subscribers get the alert as JSON, SMS subscribers get the message alone, and the
+// rest get the message followed by the details. The status, datacenter, node and service are
+// attached as message attributes so subscriptions can filter on them.
+type SNSHandler struct {
+	TopicARN     string `mapstructure:"topic_arn"`
+	Region       string `mapstructure:"region"`
+	AccessKey    string `mapstructure:"access_key"`
+	SecretKey    string `mapstructure:"secret_key"`
+	SessionToken string `mapstructure:"session_token"`
+	RoleARN      string `mapstructure:"role_arn"`
+	ExternalID   string `mapstructure:"external_id"`
+	Endpoint     string `mapstructure:"endpoint"`
+	STSEndpoint  string `mapstructure:"sts_endpoint"`
+	MaxRetries   int    `mapstructure:"max_retries"`
+	Sandbox      bool   `mapstructure:"sandbox"`
+	Proxy        string `mapstructure:"proxy"`
+}
+
+// The alert as sent to SQS and Lambda subscribers
+type snsAlert struct {
+	Datacenter string `json:"datacenter"`
+	*AlertState
+}
+
+func (handler SNSHandler) Alert(datacenter string, alert *AlertState) error {
+	params, err := handler.publishParams(datacenter, alert)
+	if err != nil {
+		return fmt.Errorf("Error forming SNS message: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("sns", handler.TopicARN, sandboxJSON(params))
+		return nil
+	}
+
+	auth := awsAuthConfig{
+		Region:       handler.region(),
+		AccessKey:    handler.AccessKey,
+		SecretKey:    handler.SecretKey,
+		SessionToken: handler.SessionToken,
+		RoleARN:      handler.RoleARN,
+		ExternalID:   handler.ExternalID,
+		STSEndpoint:  handler.STSEndpoint,
+		Proxy:        handler.Proxy,
+	}
+
+	endpoint := handler.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sns.%s.amazonaws.com", handler.region())
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		now := time.Now()
+		var creds awsCredentials
+		if creds, err = auth.credentials(now); err == nil {
+			_, err = awsRequest(proxyHTTPClient(handler.Proxy), endpoint, params, creds, handler.region(), "sns", now)
+		}
+		if err == nil {
+			return nil
+		}
+
+		log.Errorf("Error publishing alert to SNS (topic: %s): %s", handler.TopicARN, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying SNS publish in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler SNSHandler) validate() error {
+	if handler.TopicARN == "" {
+		return fmt.Errorf("topic_arn must be set")
+	}
+	parts := strings.Split(handler.TopicARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+		return fmt.Errorf("invalid topic_arn: %s", handler.TopicARN)
+	}
+	if handler.region() == "" {
+		return fmt.Errorf("region must be set when topic_arn doesn't include one")
+	}
+	if (handler.AccessKey == "") != (handler.SecretKey == "") {
+		return fmt.Errorf("access_key and secret_key must be set together")
+	}
+	return nil
+}
+
+// Returns the configured region, or the topic's region if none is set
+func (handler SNSHandler) region() string {
+	if handler.Region != "" {
+		return handler.Region
+	}
+	if parts := strings.Split(handler.TopicARN, ":"); len(parts) == 6 {
+		return parts[3]
+	}
+	return ""
+}
+
+// Returns the parameters for the Publish API call for an alert
+func (handler SNSHandler) publishParams(datacenter string, alert *AlertState) (url.Values, error) {
+	text := alert.Message
+	if alert.Details != "" {
+		text = text + "\n\n" + alert.Details
+	}
+
+	structured, err := json.Marshal(snsAlert{Datacenter: datacenter, AlertState: alert})
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := json.Marshal(map[string]string{
+		"default": text,
+		"sms":     truncate(alert.Message, snsMaxSMSLength),
+		"sqs":     string(structured),
+		"lambda":  string(structured),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{
+		"Action":           {"Publish"},
+		"Version":          {"2010-03-31"},
+		"TopicArn":         {handler.TopicARN},
+		"Subject":          {snsSubject(alert.Message)},
+		"Message":          {string(message)},
+		"MessageStructure": {"json"},
+	}
+
+	// Empty attribute values aren't allowed, so only set the ones the alert has
+	attributes := [][2]string{
+		{"status", alert.Status},
+		{"datacenter", datacenter},
+		{"node", alert.Node},
+		{"service", alert.Service},
+	}
+	entry := 1
+	for _, attribute := range attributes {
+		if attribute[1] == "" {
+			continue
+		}
+		prefix := "MessageAttributes.entry." + strconv.Itoa(entry)
+		params.Set(prefix+".Name", attribute[0])
+		params.Set(prefix+".Value.DataType", "String")
+		params.Set(prefix+".Value.StringValue", attribute[1])
+		entry++
+	}
+
+	return params, nil
+}
+
+// Returns the alert message as an SNS subject, which has to be printable ASCII on one line
+func snsSubject(message string) string {
+	subject := make([]byte, 0, len(message))
+	for _, r := range message {
+		if r < ' ' || r > '~' {
+			r = ' '
+		}
+		subject = append(subject, byte(r))
+	}
+	return truncate(strings.TrimSpace(string(subject)), snsMaxSubjectLength)
+}
+
+// Cuts s to at most max bytes, marking that it was cut with "..."
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	// Don't cut a character in half
+	end := max - 3
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "..."
+}
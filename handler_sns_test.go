@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAWS_signRequest(t *testing.T) {
+	// The get-vanilla case from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	creds := awsCredentials{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequest(req, nil, creds, "us-east-1", "service", now)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("bad authorization header:\nexpected: %s\ngot:      %s", expected, auth)
+	}
+}
+
+type testAWSRequest struct {
+	auth   string
+	token  string
+	params url.Values
+}
+
+// Starts a fake SNS/STS endpoint that records the requests made to it
+func testAWSServer(t *testing.T) (*httptest.Server, func() []testAWSRequest) {
+	var lock sync.Mutex
+	requests := make([]testAWSRequest, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+
+		lock.Lock()
+		requests = append(requests, testAWSRequest{
+			auth:   r.Header.Get("Authorization"),
+			token:  r.Header.Get("X-Amz-Security-Token"),
+			params: r.PostForm,
+		})
+		lock.Unlock()
+
+		switch r.PostForm.Get("Action") {
+		case "AssumeRole":
+			w.Write([]byte(`<AssumeRoleResponse><AssumeRoleResult><Credentials>
+				<AccessKeyId>ASIAROLE</AccessKeyId>
+				<SecretAccessKey>rolesecret</SecretAccessKey>
+				<SessionToken>roletoken</SessionToken>
+				<Expiration>` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `</Expiration>
+			</Credentials></AssumeRoleResult></AssumeRoleResponse>`))
+		case "Publish":
+			if r.PostForm.Get("TopicArn") == "arn:aws:sns:us-west-2:123456789012:missing" {
+				w.WriteHeader(404)
+				w.Write([]byte(`<ErrorResponse><Error><Code>NotFound</Code><Message>Topic does not exist</Message></Error></ErrorResponse>`))
+				return
+			}
+			w.Write([]byte(`<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>`))
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+
+	return server, func() []testAWSRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]testAWSRequest{}, requests...)
+	}
+}
+
+func TestSNSHandler_publish(t *testing.T) {
+	server, requests := testAWSServer(t)
+	defer server.Close()
+
+	handler := SNSHandler{
+		TopicARN:  "arn:aws:sns:us-west-2:123456789012:alerts",
+		AccessKey: "AKIDTEST",
+		SecretKey: "secret",
+		Endpoint:  server.URL,
+	}
+	alert := &AlertState{
+		Service: "redis",
+		Status:  api.HealthCritical,
+		Message: "[dc1] service redis is now critical\n",
+		Details: "=> (critical) Service 'redis' check",
+	}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	req := reqs[0]
+	if !strings.HasPrefix(req.auth, "AWS4-HMAC-SHA256 Credential=AKIDTEST/") || !strings.Contains(req.auth, "/us-west-2/sns/aws4_request") {
+		t.Errorf("bad authorization header: %s", req.auth)
+	}
+	if req.params.Get("TopicArn") != handler.TopicARN || req.params.Get("MessageStructure") != "json" {
+		t.Errorf("bad publish params: %v", req.params)
+	}
+	if subject := req.params.Get("Subject"); subject != "[dc1] service redis is now critical" {
+		t.Errorf("bad subject: %q", subject)
+	}
+
+	var message map[string]string
+	if err := json.Unmarshal([]byte(req.params.Get("Message")), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message["default"] != alert.Message+"\n\n"+alert.Details || message["sms"] != alert.Message {
+		t.Errorf("bad message: %v", message)
+	}
+	var structured map[string]interface{}
+	if err := json.Unmarshal([]byte(message["sqs"]), &structured); err != nil {
+		t.Fatal(err)
+	}
+	if structured["datacenter"] != "dc1" || structured["service"] != "redis" || structured["status"] != api.HealthCritical {
+		t.Errorf("bad structured message: %v", structured)
+	}
+
+	// Only non-empty attributes are set, so node is skipped
+	attributes := map[string]string{}
+	for i := 1; i <= 4; i++ {
+		prefix := "MessageAttributes.entry." + string('0'+rune(i))
+		if name := req.params.Get(prefix + ".Name"); name != "" {
+			attributes[name] = req.params.Get(prefix + ".Value.StringValue")
+		}
+	}
+	expected := map[string]string{"status": api.HealthCritical, "datacenter": "dc1", "service": "redis"}
+	if len(attributes) != len(expected) {
+		t.Errorf("expected attributes %v, got %v", expected, attributes)
+	}
+	for name, value := range expected {
+		if attributes[name] != value {
+			t.Errorf("expected attribute %s to be %q, got %q", name, value, attributes[name])
+		}
+	}
+
+	// Errors from SNS are returned
+	handler.TopicARN = "arn:aws:sns:us-west-2:123456789012:missing"
+	if err := handler.Alert("dc1", alert); err == nil || !strings.Contains(err.Error(), "Topic does not exist") {
+		t.Errorf("expected an error for the missing topic, got %v", err)
+	}
+}
+
+func TestSNSHandler_assumeRole(t *testing.T) {
+	server, requests := testAWSServer(t)
+	defer server.Close()
+
+	handler := SNSHandler{
+		TopicARN:    "arn:aws:sns:us-west-2:123456789012:alerts",
+		AccessKey:   "AKIDBASE",
+		SecretKey:   "secret",
+		RoleARN:     "arn:aws:iam::123456789012:role/alerting-test",
+		ExternalID:  "ext",
+		Endpoint:    server.URL,
+		STSEndpoint: server.URL,
+	}
+	alert := &AlertState{Node: "node1", Status: api.HealthCritical, Message: "node node1 is now critical"}
+	for i := 0; i < 2; i++ {
+		if err := handler.Alert("dc1", alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The role is assumed once, and its credentials are reused for both publishes
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(reqs))
+	}
+	if assume := reqs[0]; assume.params.Get("RoleArn") != handler.RoleARN || assume.params.Get("ExternalId") != "ext" ||
+		!strings.Contains(assume.auth, "Credential=AKIDBASE/") || !strings.Contains(assume.auth, "/sts/aws4_request") {
+		t.Errorf("bad assume role request: %v (%s)", assume.params, assume.auth)
+	}
+	for _, publish := range reqs[1:] {
+		if !strings.Contains(publish.auth, "Credential=ASIAROLE/") || publish.token != "roletoken" {
+			t.Errorf("expected publish to use the role's credentials, got %s (token %q)", publish.auth, publish.token)
+		}
+	}
+}
+
+func TestSNSHandler_validate(t *testing.T) {
+	cases := []struct {
+		handler SNSHandler
+		valid   bool
+	}{
+		{SNSHandler{TopicARN: "arn:aws:sns:us-east-1:123456789012:alerts"}, true},
+		{SNSHandler{}, false},
+		{SNSHandler{TopicARN: "arn:aws:sqs:us-east-1:123456789012:alerts"}, false},
+		{SNSHandler{TopicARN: "arn:aws:sns::123456789012:alerts"}, false},
+		{SNSHandler{TopicARN: "arn:aws:sns::123456789012:alerts", Region: "eu-west-1"}, true},
+		{SNSHandler{TopicARN: "arn:aws:sns:us-east-1:123456789012:alerts", AccessKey: "AKID"}, false},
+	}
+
+	for i, c := range cases {
+		if err := c.handler.validate(); (err == nil) != c.valid {
+			t.Errorf("case %d: expected valid=%v, got %v", i, c.valid, err)
+		}
+	}
+
+	if region := (SNSHandler{TopicARN: "arn:aws:sns:ap-south-1:123456789012:alerts"}).region(); region != "ap-south-1" {
+		t.Errorf("expected the region from the topic, got %s", region)
+	}
+}
+
+func TestSNSHandler_subject(t *testing.T) {
+	if subject := snsSubject("[dc1] service\tdb is now critical ✗"); subject != "[dc1] service db is now critical" {
+		t.Errorf("bad subject: %q", subject)
+	}
+
+	long := strings.Repeat("x", 200)
+	if subject := snsSubject(long); len(subject) != snsMaxSubjectLength || !strings.HasSuffix(subject, "...") {
+		t.Errorf("expected the subject to be truncated, got %q", subject)
+	}
+
+	if cut := truncate("aaaaébbbb", 8); cut != "aaaa..." {
+		t.Errorf("expected truncation at a character boundary, got %q", cut)
+	}
+}
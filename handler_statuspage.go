@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+const statuspageOperational = "operational"
+
+// The statuses a Statuspage component can be set to
+var statuspageComponentStatuses = []string{
+	statuspageOperational,
+	"degraded_performance",
+	"partial_outage",
+	"major_outage",
+	"under_maintenance",
+}
+
+// StatuspageHandler updates the status of Statuspage.io components to match the health
+// of the services they're mapped to, optionally opening an incident while a service is critical
+type StatuspageHandler struct {
+	APIKey         string            `mapstructure:"api_key"`
+	PageID         string            `mapstructure:"page_id"`
+	Components     map[string]string `mapstructure:"components"`
+	WarningStatus  string            `mapstructure:"warning_status"`
+	CriticalStatus string            `mapstructure:"critical_status"`
+	OpenIncidents  bool              `mapstructure:"open_incidents"`
+	BaseURL        string            `mapstructure:"base_url"`
+	MaxRetries     int               `mapstructure:"max_retries"`
+	Sandbox        bool              `mapstructure:"sandbox"`
+	Proxy          string            `mapstructure:"proxy"`
+}
+
+type statuspageIncident struct {
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Status string `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+
+	ComponentIDs []string          `json:"component_ids,omitempty"`
+	Components   map[string]string `json:"components,omitempty"`
+}
+
+// Setting a component's status twice has the same effect as setting it once, but sending an
+// alert again with open_incidents posts another update to the service's incident
+func (handler StatuspageHandler) Idempotent() bool {
+	return !handler.OpenIncidents
+}
+
+func (handler StatuspageHandler) Alert(datacenter string, alert *AlertState) error {
+	// Only services can be mapped to components
+	componentID, ok := handler.Components[alert.Service]
+	if alert.Service == "" || !ok {
+		return nil
+	}
+
+	status := handler.componentStatus(alert.Status)
+	path := fmt.Sprintf("/pages/%s/components/%s", handler.PageID, componentID)
+	body := map[string]interface{}{
+		"component": map[string]string{"status": status},
+	}
+
+	err := handler.withRetries("updating component status", func() error {
+		return handler.request("PATCH", path, body, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !handler.OpenIncidents {
+		return nil
+	}
+
+	name := statuspageIncidentName(datacenter, alert)
+	switch alert.Status {
+	case api.HealthCritical:
+		return handler.withRetries("opening incident", func() error {
+			return handler.openIncident(name, alert.Details, componentID, status)
+		})
+	case api.HealthPassing:
+		return handler.withRetries("resolving incident", func() error {
+			return handler.resolveIncident(name, alert.Message)
+		})
+	}
+
+	return nil
+}
+
+// Checks that the handler's settings are usable
+func (handler StatuspageHandler) validate() error {
+	if handler.APIKey == "" || handler.PageID == "" {
+		return fmt.Errorf("api_key and page_id must be set")
+	}
+	if len(handler.Components) == 0 {
+		return fmt.Errorf("components must map at least one service to a component ID")
+	}
+	for service, componentID := range handler.Components {
+		if componentID == "" {
+			return fmt.Errorf("component ID for service %s is empty", service)
+		}
+	}
+	for option, status := range map[string]string{"warning_status": handler.WarningStatus, "critical_status": handler.CriticalStatus} {
+		if !contains(statuspageComponentStatuses, status) {
+			return fmt.Errorf("%s must be one of %s, got %q", option, strings.Join(statuspageComponentStatuses, ", "), status)
+		}
+	}
+	return nil
+}
+
+// Maps a Consul health status to the Statuspage component status to use for it
+func (handler StatuspageHandler) componentStatus(health string) string {
+	switch health {
+	case api.HealthCritical:
+		return handler.CriticalStatus
+	case api.HealthWarning:
+		return handler.WarningStatus
+	default:
+		return statuspageOperational
+	}
+}
+
+// Opens an incident with the given name, or updates the unresolved one if it's already open
+// (such as for a reminder, or a service that went critical again before it recovered), so a
+// service never has more than one incident open at a time
+func (handler StatuspageHandler) openIncident(name string, body string, componentID string, status string) error {
+	incidents, err := handler.unresolvedIncidents(name)
+	if err != nil {
+		return err
+	}
+
+	if len(incidents) > 0 {
+		update := statuspageIncident{
+			Body:         body,
+			ComponentIDs: []string{componentID},
+			Components:   map[string]string{componentID: status},
+		}
+		return handler.request("PATCH", fmt.Sprintf("/pages/%s/incidents/%s", handler.PageID, incidents[0].ID),
+			map[string]interface{}{"incident": update}, nil)
+	}
+
+	incident := statuspageIncident{
+		Name:         name,
+		Status:       "investigating",
+		Body:         body,
+		ComponentIDs: []string{componentID},
+		Components:   map[string]string{componentID: status},
+	}
+	return handler.request("POST", fmt.Sprintf("/pages/%s/incidents", handler.PageID),
+		map[string]interface{}{"incident": incident}, nil)
+}
+
+// Resolves any unresolved incidents on the page with the given name
+func (handler StatuspageHandler) resolveIncident(name string, message string) error {
+	incidents, err := handler.unresolvedIncidents(name)
+	if err != nil {
+		return err
+	}
+
+	for _, incident := range incidents {
+		update := statuspageIncident{
+			Status: "resolved",
+			Body:   message,
+		}
+		err := handler.request("PATCH", fmt.Sprintf("/pages/%s/incidents/%s", handler.PageID, incident.ID),
+			map[string]interface{}{"incident": update}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the unresolved incidents on the page with the given name
+func (handler StatuspageHandler) unresolvedIncidents(name string) ([]statuspageIncident, error) {
+	var incidents []statuspageIncident
+	err := handler.request("GET", fmt.Sprintf("/pages/%s/incidents/unresolved", handler.PageID), nil, &incidents)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make([]statuspageIncident, 0)
+	for _, incident := range incidents {
+		if incident.Name == name {
+			matching = append(matching, incident)
+		}
+	}
+	return matching, nil
+}
+
+// Runs the given function, retrying up to MaxRetries times if it fails
+func (handler StatuspageHandler) withRetries(action string, f func() error) error {
+	var err error
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		err = f()
+		if err == nil {
+			return nil
+		}
+
+		log.Errorf("Error %s on Statuspage (page: %s): %s", action, handler.PageID, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying Statuspage request in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Makes a request to the Statuspage API, decoding the response into result if it's non-nil
+func (handler StatuspageHandler) request(method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("statuspage", method+" "+handler.BaseURL+path, string(payload))
+		return nil
+	}
+
+	req, err := http.NewRequest(method, handler.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "OAuth "+handler.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	if result != nil {
+		return json.Unmarshal(respBody, result)
+	}
+
+	return nil
+}
+
+// Returns the name to use for the incident opened for a critical service, which needs to be
+// consistent so the incident can be found again when resolving it
+func statuspageIncidentName(datacenter string, alert *AlertState) string {
+	name := alert.Service
+	if alert.Tag != "" {
+		name = name + " (" + alert.Tag + ")"
+	}
+	return fmt.Sprintf("[%s] %s outage", datacenter, name)
+}
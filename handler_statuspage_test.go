@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+type testStatuspageRequest struct {
+	method string
+	path   string
+	body   map[string]map[string]interface{}
+}
+
+// Starts a fake Statuspage API that records the requests made to it
+func testStatuspageServer(t *testing.T, unresolved string) (*httptest.Server, func() []testStatuspageRequest) {
+	var lock sync.Mutex
+	requests := make([]testStatuspageRequest, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "OAuth testkey" {
+			t.Errorf("bad authorization header: %s", r.Header.Get("Authorization"))
+		}
+
+		req := testStatuspageRequest{method: r.Method, path: r.URL.Path}
+		raw, _ := ioutil.ReadAll(r.Body)
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &req.body); err != nil {
+				t.Error(err)
+			}
+		}
+
+		lock.Lock()
+		requests = append(requests, req)
+		lock.Unlock()
+
+		if r.URL.Path == "/pages/page1/incidents/unresolved" {
+			w.Write([]byte(unresolved))
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+
+	return server, func() []testStatuspageRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func testStatuspageHandler(url string) StatuspageHandler {
+	return StatuspageHandler{
+		APIKey:         "testkey",
+		PageID:         "page1",
+		Components:     map[string]string{testServiceName: "comp1"},
+		WarningStatus:  "degraded_performance",
+		CriticalStatus: "major_outage",
+		OpenIncidents:  true,
+		BaseURL:        url,
+	}
+}
+
+func TestHandler_statuspageCritical(t *testing.T) {
+	server, requests := testStatuspageServer(t, "[]")
+	defer server.Close()
+
+	handler := testStatuspageHandler(server.URL)
+	handler.Alert("dc1", &AlertState{
+		Service: testServiceName,
+		Status:  api.HealthCritical,
+		Message: "redis is now critical",
+	})
+
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(reqs))
+	}
+
+	if reqs[0].method != "PATCH" || reqs[0].path != "/pages/page1/components/comp1" {
+		t.Errorf("unexpected component request: %s %s", reqs[0].method, reqs[0].path)
+	}
+	if status := reqs[0].body["component"]["status"]; status != "major_outage" {
+		t.Errorf("expected component status major_outage, got %v", status)
+	}
+
+	if reqs[2].method != "POST" || reqs[2].path != "/pages/page1/incidents" {
+		t.Errorf("unexpected incident request: %s %s", reqs[2].method, reqs[2].path)
+	}
+	if name := reqs[2].body["incident"]["name"]; name != "[dc1] redis outage" {
+		t.Errorf("unexpected incident name: %v", name)
+	}
+}
+
+// Make sure an incident that's already open is updated instead of opening another one
+func TestHandler_statuspageCriticalAgain(t *testing.T) {
+	server, requests := testStatuspageServer(t, `[{"id": "inc1", "name": "[dc1] redis outage"}]`)
+	defer server.Close()
+
+	handler := testStatuspageHandler(server.URL)
+	handler.Alert("dc1", &AlertState{
+		Service: testServiceName,
+		Status:  api.HealthCritical,
+		Message: "redis is now critical",
+		Details: "still down",
+	})
+
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(reqs))
+	}
+	if reqs[2].method != "PATCH" || reqs[2].path != "/pages/page1/incidents/inc1" {
+		t.Errorf("unexpected incident request: %s %s", reqs[2].method, reqs[2].path)
+	}
+	if body := reqs[2].body["incident"]["body"]; body != "still down" {
+		t.Errorf("unexpected incident update: %v", body)
+	}
+}
+
+func TestHandler_statuspageRecovery(t *testing.T) {
+	server, requests := testStatuspageServer(t, `[{"id": "inc1", "name": "[dc1] redis outage"}, {"id": "inc2", "name": "other"}]`)
+	defer server.Close()
+
+	handler := testStatuspageHandler(server.URL)
+	handler.Alert("dc1", &AlertState{
+		Service: testServiceName,
+		Status:  api.HealthPassing,
+		Message: "redis is now passing",
+	})
+
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(reqs))
+	}
+
+	if status := reqs[0].body["component"]["status"]; status != statuspageOperational {
+		t.Errorf("expected component status %s, got %v", statuspageOperational, status)
+	}
+
+	if reqs[2].method != "PATCH" || reqs[2].path != "/pages/page1/incidents/inc1" {
+		t.Errorf("unexpected resolve request: %s %s", reqs[2].method, reqs[2].path)
+	}
+	if status := reqs[2].body["incident"]["status"]; status != "resolved" {
+		t.Errorf("expected incident to be resolved, got %v", status)
+	}
+}
+
+func TestHandler_statuspageUnmappedService(t *testing.T) {
+	server, requests := testStatuspageServer(t, "[]")
+	defer server.Close()
+
+	handler := testStatuspageHandler(server.URL)
+	handler.Alert("dc1", &AlertState{
+		Service: "webapp",
+		Status:  api.HealthCritical,
+	})
+	handler.Alert("dc1", &AlertState{
+		Node:   "node1",
+		Status: api.HealthCritical,
+	})
+
+	if reqs := requests(); len(reqs) != 0 {
+		t.Fatalf("expected no requests, got %d", len(reqs))
+	}
+}
+
+func TestHandler_statuspageValidate(t *testing.T) {
+	if err := testStatuspageHandler("https://api.statuspage.io/v1").validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []func(*StatuspageHandler){
+		func(h *StatuspageHandler) { h.APIKey = "" },
+		func(h *StatuspageHandler) { h.PageID = "" },
+		func(h *StatuspageHandler) { h.Components = nil },
+		func(h *StatuspageHandler) { h.Components = map[string]string{"redis": ""} },
+		func(h *StatuspageHandler) { h.CriticalStatus = "outage" },
+		func(h *StatuspageHandler) { h.WarningStatus = "degraded" },
+	}
+	for i, modify := range cases {
+		handler := testStatuspageHandler("https://api.statuspage.io/v1")
+		modify(&handler)
+		if err := handler.validate(); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
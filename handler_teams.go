@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The card formats the Teams handler can post
+const (
+	TeamsMessageCard  = "message_card"
+	TeamsAdaptiveCard = "adaptive_card"
+)
+
+// TeamsHandler posts alerts to a Microsoft Teams incoming webhook, as either a legacy
+// MessageCard or an AdaptiveCard. Cards are colored by the alert's status, and the failing
+// checks are listed as facts.
+type TeamsHandler struct {
+	WebhookURL string `mapstructure:"webhook_url"`
+	CardFormat string `mapstructure:"card_format"`
+	MaxRetries int    `mapstructure:"max_retries"`
+	Sandbox    bool   `mapstructure:"sandbox"`
+	Proxy      string `mapstructure:"proxy"`
+}
+
+// A fact shown as a name/value row on a card
+type teamsFact struct {
+	Name  string `json:"name,omitempty"`
+	Title string `json:"title,omitempty"`
+	Value string `json:"value"`
+}
+
+func (handler TeamsHandler) Alert(datacenter string, alert *AlertState) error {
+	var card interface{}
+	if handler.CardFormat == TeamsAdaptiveCard {
+		card = teamsAdaptiveCard(alert)
+	} else {
+		card = teamsMessageCard(alert)
+	}
+
+	body, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("Error forming Teams card: %s", err)
+	}
+
+	if handler.Sandbox {
+		// The webhook URL contains its secret, so leave it out of the logs
+		logSandboxPayload("teams", "webhook", sandboxJSON(card))
+		return nil
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if err = handler.post(body); err == nil {
+			return nil
+		}
+
+		log.Errorf("Error sending alert to Teams: %s", err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying alert to Teams in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler TeamsHandler) validate() error {
+	if handler.WebhookURL == "" {
+		return fmt.Errorf("webhook_url must be set")
+	}
+	if !contains([]string{TeamsMessageCard, TeamsAdaptiveCard}, handler.CardFormat) {
+		return fmt.Errorf("invalid card_format: %s", handler.CardFormat)
+	}
+	return nil
+}
+
+// Posts a card to the webhook
+func (handler TeamsHandler) post(body []byte) error {
+	resp, err := proxyHTTPClient(handler.Proxy).Post(handler.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+// Returns a legacy Office 365 connector card for the alert
+func teamsMessageCard(alert *AlertState) map[string]interface{} {
+	section := map[string]interface{}{
+		"activityTitle": alert.Message,
+	}
+
+	facts := teamsFacts(alert, false)
+	if len(facts) > 0 {
+		section["facts"] = facts
+	} else if details := detailsWithFields(alert); details != "" {
+		// Teams renders card text as markdown, so keep line breaks in the details
+		section["text"] = strings.Replace(details, "\n", "  \n", -1)
+	}
+
+	color := presentationColor(alert, alert.Status, teamsColor(alert.Status))
+	return map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    alert.Message,
+		"themeColor": strings.TrimPrefix(color, "#"),
+		"sections":   []interface{}{section},
+	}
+}
+
+// Returns an AdaptiveCard for the alert, wrapped in the message format webhooks expect.
+// Adaptive cards only support a fixed set of colors, so the title is colored by status.
+func teamsAdaptiveCard(alert *AlertState) map[string]interface{} {
+	body := []interface{}{
+		map[string]interface{}{
+			"type":   "TextBlock",
+			"text":   alert.Message,
+			"weight": "bolder",
+			"size":   "medium",
+			"color":  teamsAdaptiveColor(alert.Status),
+			"wrap":   true,
+		},
+	}
+
+	facts := teamsFacts(alert, true)
+	if len(facts) > 0 {
+		body = append(body, map[string]interface{}{
+			"type":  "FactSet",
+			"facts": facts,
+		})
+	} else if details := detailsWithFields(alert); details != "" {
+		body = append(body, map[string]interface{}{
+			"type": "TextBlock",
+			"text": details,
+			"wrap": true,
+		})
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]interface{}{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.2",
+					"body":    body,
+				},
+			},
+		},
+	}
+}
+
+// Returns a fact for each failing check. MessageCards name the fact's label "name", while
+// AdaptiveCards call it "title".
+func teamsFacts(alert *AlertState, adaptive bool) []teamsFact {
+	facts := make([]teamsFact, 0, len(alert.Checks))
+	for _, check := range alert.Checks {
+		label := fmt.Sprintf("%s%s (%s)", presentationEmoji(alert, check.Status), check.Name, check.Node)
+		value := check.Status
+		if output := strings.TrimSpace(check.Output); output != "" {
+			value = value + ": " + output
+		}
+
+		if adaptive {
+			facts = append(facts, teamsFact{Title: label, Value: value})
+		} else {
+			facts = append(facts, teamsFact{Name: label, Value: value})
+		}
+	}
+
+	// The details aren't shown alongside the checks, so show the fields as facts too
+	if len(facts) > 0 {
+		keys := make([]string, 0, len(alert.Fields))
+		for key, _ := range alert.Fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if adaptive {
+				facts = append(facts, teamsFact{Title: key, Value: alert.Fields[key]})
+			} else {
+				facts = append(facts, teamsFact{Name: key, Value: alert.Fields[key]})
+			}
+		}
+	}
+	return facts
+}
+
+// Returns the default MessageCard theme color for a status
+func teamsColor(status string) string {
+	switch status {
+	case api.HealthCritical:
+		return "D00000"
+	case api.HealthWarning:
+		return "FFA500"
+	case api.HealthPassing:
+		return "2EB886"
+	default:
+		return "439FE0"
+	}
+}
+
+// Returns the AdaptiveCard text color for a status
+func teamsAdaptiveColor(status string) string {
+	switch status {
+	case api.HealthCritical:
+		return "attention"
+	case api.HealthWarning:
+		return "warning"
+	case api.HealthPassing:
+		return "good"
+	default:
+		return "accent"
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Starts a fake Teams webhook that sends each posted card to a channel
+func testTeamsServer(t *testing.T) (*httptest.Server, chan map[string]interface{}) {
+	cards := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		var card map[string]interface{}
+		if err := json.Unmarshal(raw, &card); err != nil {
+			t.Error(err)
+		}
+		cards <- card
+		w.Write([]byte("1"))
+	}))
+	return server, cards
+}
+
+func TestTeamsHandler_messageCard(t *testing.T) {
+	server, cards := testTeamsServer(t)
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "teams" "ops" {
+		webhook_url = "` + server.URL + `"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{
+		Status:  api.HealthCritical,
+		Message: "[dc1] service redis is now critical",
+		Checks: []CheckSummary{
+			{Node: "node1", Name: "mem", Status: api.HealthCritical, Output: "oom\n"},
+			{Node: "node2", Name: "disk", Status: api.HealthWarning},
+		},
+	}
+	if err := config.Handlers["teams.ops"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	card := <-cards
+	if card["@type"] != "MessageCard" || card["themeColor"] != "D00000" || card["summary"] != alert.Message {
+		t.Errorf("unexpected card: %v", card)
+	}
+	section := card["sections"].([]interface{})[0].(map[string]interface{})
+	facts := section["facts"].([]interface{})
+	if len(facts) != 2 {
+		t.Fatalf("expected 2 facts, got %v", facts)
+	}
+	if fact := facts[0].(map[string]interface{}); fact["name"] != "mem (node1)" || fact["value"] != "critical: oom" {
+		t.Errorf("unexpected fact: %v", fact)
+	}
+	if fact := facts[1].(map[string]interface{}); fact["value"] != "warning" {
+		t.Errorf("unexpected fact: %v", fact)
+	}
+
+	// Without checks, the details are the card's text, and presentation colors are used
+	alert = &AlertState{Status: api.HealthPassing, Message: "[dc1] node node1 is now passing", Details: "all good\nreally"}
+	alert.presentation = &PresentationMiddleware{Colors: map[string]string{api.HealthPassing: "#00ff00"}}
+	if err := config.Handlers["teams.ops"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	card = <-cards
+	section = card["sections"].([]interface{})[0].(map[string]interface{})
+	if card["themeColor"] != "00ff00" || section["text"] != "all good  \nreally" {
+		t.Errorf("unexpected card: %v", card)
+	}
+}
+
+func TestTeamsHandler_adaptiveCard(t *testing.T) {
+	server, cards := testTeamsServer(t)
+	defer server.Close()
+
+	handler := TeamsHandler{WebhookURL: server.URL, CardFormat: TeamsAdaptiveCard}
+	alert := &AlertState{
+		Status:  api.HealthWarning,
+		Message: "[dc1] service redis is now warning",
+		Checks:  []CheckSummary{{Node: "node1", Name: "mem", Status: api.HealthWarning, Output: "high"}},
+	}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	card := <-cards
+	attachment := card["attachments"].([]interface{})[0].(map[string]interface{})
+	content := attachment["content"].(map[string]interface{})
+	if card["type"] != "message" || attachment["contentType"] != "application/vnd.microsoft.card.adaptive" || content["type"] != "AdaptiveCard" {
+		t.Fatalf("unexpected card: %v", card)
+	}
+	body := content["body"].([]interface{})
+	if title := body[0].(map[string]interface{}); title["text"] != alert.Message || title["color"] != "warning" {
+		t.Errorf("unexpected title: %v", title)
+	}
+	facts := body[1].(map[string]interface{})["facts"].([]interface{})
+	if fact := facts[0].(map[string]interface{}); fact["title"] != "mem (node1)" || fact["value"] != "warning: high" {
+		t.Errorf("unexpected fact: %v", fact)
+	}
+
+	if err := (TeamsHandler{WebhookURL: server.URL, CardFormat: "bogus"}).validate(); err == nil {
+		t.Error("expected an error for an unknown card format")
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/Sirupsen/logrus/hooks/test"
+	"github.com/hashicorp/consul/api"
 	"github.com/nlopes/slack"
 )
 
@@ -28,7 +35,7 @@ func TestHandler_stdout(t *testing.T) {
 	}
 
 	if hook.Entries[0].Message != alert.Message {
-		t.Errorf("expected message line '%s', got '%s'", alert.Message, hook.Entries[0])
+		t.Errorf("expected message line '%s', got '%s'", alert.Message, hook.Entries[0].Message)
 	}
 
 	if hook.Entries[1].Message != detail1 || hook.Entries[2].Message != detail2 {
@@ -41,6 +48,42 @@ func TestHandler_stdout(t *testing.T) {
 	}
 }
 
+// Records the requests made through it without sending them
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.requests = append(r.requests, req)
+	return nil, errors.New("not sending requests in tests")
+}
+
+// Make sure catalog audit findings don't page anyone
+func TestHandler_pagerdutySkipsAudit(t *testing.T) {
+	transport := &recordingTransport{}
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	handler := PagerdutyHandler{ServiceKey: "test"}
+	err := handler.Alert("dc1", &AlertState{
+		Status:  AuditStatus,
+		Message: "catalog audit found 1 new registration anomalies",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.requests) != 0 {
+		t.Errorf("expected no PagerDuty events for an audit alert, got %d", len(transport.requests))
+	}
+
+	// Critical alerts still trigger an incident
+	handler.Alert("dc1", &AlertState{Status: "critical", Service: "redis"})
+	if len(transport.requests) == 0 {
+		t.Error("expected a PagerDuty event for a critical alert")
+	}
+}
+
 func TestHandler_slack(t *testing.T) {
 	token := os.Getenv("TEST_SLACK_TOKEN")
 	if token == "" {
@@ -89,9 +132,267 @@ func TestHandler_slack(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expected := fmt.Sprintf(slackMessageFormat, alert.Message, alert.Details)
+	attachments := history.Messages[0].Attachments
+	if len(attachments) != 1 || attachments[0].Title != alert.Message || attachments[0].Text != alert.Details {
+		t.Errorf("expected a summary attachment for `%s`, got %+v", alert.Message, attachments)
+	}
+}
+
+func TestHandler_slackWebhook(t *testing.T) {
+	var payload struct {
+		Attachments []slack.Attachment `json:"attachments"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/T000/B000/XXXX" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no_service"))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	handler := SlackHandler{WebhookURL: server.URL + "/services/T000/B000/XXXX"}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "service redis is now critical"}
+	if err := handler.Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Attachments) != 1 || payload.Attachments[0].Title != alert.Message || payload.Attachments[0].Color != "danger" {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
 
-	if history.Messages[0].Text != expected {
-		t.Errorf("expected `%s`, got `%s`", expected, history.Messages[0].Text)
+	// Rejected messages are reported with Slack's reason
+	if err := postSlackWebhook(http.DefaultClient, server.URL+"/services/revoked", nil); err == nil || !strings.Contains(err.Error(), "no_service") {
+		t.Errorf("expected a no_service error, got %v", err)
+	}
+
+	invalid := []SlackHandler{
+		{},
+		{Token: "token"},
+		{Token: "token", WebhookURL: "https://hooks.slack.com/services/T000/B000/XXXX"},
+		{WebhookURL: "hooks.slack.com/services/T000/B000/XXXX"},
+	}
+	for _, handler := range invalid {
+		if err := handler.validate(); err == nil {
+			t.Errorf("expected an error for %+v", handler)
+		}
+	}
+}
+
+func TestHandler_slackSummary(t *testing.T) {
+	handler := SlackHandler{ConsulUIURL: "https://consul.example.com/ui/"}
+
+	alert := &AlertState{
+		Service: "redis",
+		Status:  api.HealthWarning,
+		Message: "service redis is now warning",
+		Details: "disk is 90% full",
+		Fields:  map[string]string{"team": "storage", "env": "prod"},
+	}
+	summary := handler.summaryAttachment("dc1", alert)
+	if summary.Color != "warning" || summary.Title != alert.Message || summary.Text != alert.Details {
+		t.Errorf("unexpected summary attachment: %+v", summary)
+	}
+	if summary.TitleLink != "https://consul.example.com/ui/dc1/services/redis" {
+		t.Errorf("unexpected Consul UI link %s", summary.TitleLink)
+	}
+	if len(summary.Fields) != 2 || summary.Fields[0].Title != "env" || summary.Fields[1].Value != "storage" {
+		t.Errorf("expected the alert's fields sorted by name, got %+v", summary.Fields)
+	}
+
+	// With failing checks, the details are left to the checks' own attachments
+	alert = &AlertState{
+		Node:    "node1",
+		Status:  api.HealthPassing,
+		Message: "node node1 is now passing",
+		Details: "Failing checks:\n=> (check) mem:\noom",
+		Checks:  []CheckSummary{{Node: "node1", Name: "mem", Status: api.HealthCritical, Output: "oom"}},
+	}
+	summary = handler.summaryAttachment("dc1", alert)
+	if summary.Color != "good" || summary.Text != "" || summary.TitleLink != "https://consul.example.com/ui/dc1/nodes/node1" {
+		t.Errorf("unexpected summary attachment: %+v", summary)
+	}
+
+	// Without a UI URL, nothing is linked
+	if summary := (SlackHandler{}).summaryAttachment("dc1", alert); summary.TitleLink != "" {
+		t.Errorf("expected no link, got %s", summary.TitleLink)
+	}
+}
+
+func TestHandler_slackThreadRecoveries(t *testing.T) {
+	var posts, updates []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/chat.postMessage":
+			posts = append(posts, r.PostForm)
+			w.Write([]byte(`{"ok": true, "channel": "C0001", "ts": "1500000000.000100"}`))
+		case "/chat.update":
+			updates = append(updates, r.PostForm)
+			w.Write([]byte(`{"ok": true}`))
+		default:
+			w.Write([]byte(`{"ok": false, "error": "unknown_method"}`))
+		}
+	}))
+	defer server.Close()
+
+	defaultAPI := slack.SLACK_API
+	slack.SLACK_API = server.URL + "/"
+	defer func() { slack.SLACK_API = defaultAPI }()
+
+	handler := SlackHandler{Token: "token", ChannelName: "alerts", ThreadRecoveries: true, MarkResolved: true}
+	if err := handler.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failing alert starts a thread, which is kept in the alert state
+	state := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "service redis is now critical"}
+	alert := *state
+	alert.threads = newSlackThreadTracker(nil, "", nil)
+	if err := handler.Alert("dc1", &alert); err != nil {
+		t.Fatal(err)
+	}
+	alert.threads.apply(state)
+	if thread := state.SlackThreads["alerts"]; thread.Channel != "C0001" || thread.TS != "1500000000.000100" {
+		t.Fatalf("expected the message to be recorded as the thread, got %+v", state.SlackThreads)
+	}
+	if posts[0].Get("thread_ts") != "" {
+		t.Errorf("expected the failing alert to start a new thread, got %v", posts[0])
+	}
+
+	// The recovery is posted in the thread, which is then closed
+	state.Status = api.HealthPassing
+	state.Message = "service redis is now passing"
+	alert = *state
+	alert.threads = newSlackThreadTracker(nil, "", nil)
+	if err := handler.Alert("dc1", &alert); err != nil {
+		t.Fatal(err)
+	}
+	alert.threads.apply(state)
+	if posts[1].Get("thread_ts") != "1500000000.000100" {
+		t.Errorf("expected the recovery to be a reply in the thread, got %v", posts[1])
+	}
+	if len(updates) != 1 || updates[0].Get("channel") != "C0001" || updates[0].Get("ts") != "1500000000.000100" || !strings.HasPrefix(updates[0].Get("text"), "\u2705") {
+		t.Errorf("expected the original message to be marked resolved, got %v", updates)
+	}
+	if state.SlackThreads != nil {
+		t.Errorf("expected the thread to be closed, got %+v", state.SlackThreads)
+	}
+
+	invalid := []SlackHandler{
+		{Token: "token", ChannelName: "alerts", MarkResolved: true},
+		{WebhookURL: "https://hooks.slack.com/services/T000/B000/XXXX", ThreadRecoveries: true},
+	}
+	for _, handler := range invalid {
+		if err := handler.validate(); err == nil {
+			t.Errorf("expected an error for %+v", handler)
+		}
+	}
+}
+
+func TestHandler_slackScopedTokens(t *testing.T) {
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tokens = append(tokens, r.PostForm.Get("token"))
+		w.Write([]byte(`{"ok": true, "channel": "C0001", "ts": "1500000000.000100"}`))
+	}))
+	defer server.Close()
+
+	defaultAPI := slack.SLACK_API
+	slack.SLACK_API = server.URL + "/"
+	defer func() { slack.SLACK_API = defaultAPI }()
+
+	config, err := ParseConfig(`
+	handler "slack" "tenants" {
+		channel_name = "alerts"
+		api_tokens {
+			payments = "payments-token"
+			"service:search" = "search-token"
+		}
+	}
+	team "payments" {}
+	team "search" {}
+	service "billing" {
+		team = "payments"
+	}
+	service "search" {
+		team = "search"
+	}
+	service "catalog" {
+		team = "search"
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := config.Handlers["slack.tenants"].(SlackHandler)
+
+	// Alerts are posted with their service's or team's token, and not at all without one
+	for _, service := range []string{"billing", "search", "catalog", "redis"} {
+		alert := config.withAlertTeam(service, &AlertState{Service: service, Status: api.HealthCritical})
+		if err := handler.Alert("dc1", alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := []string{"payments-token", "search-token"}; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected tokens %v, got %v", expected, tokens)
+	}
+
+	// Sandboxed handlers render the payload even without a token
+	handler.Sandbox = true
+	output := captureLog(func() {
+		handler.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthCritical, Message: "redis is now critical"})
+	})
+	if !strings.Contains(output, "Not sending slack alert from sandboxed handler") {
+		t.Errorf("expected payload to be logged, got: %s", output)
+	}
+
+	_, err = ParseConfig(`
+	handler "slack" "tenants" {
+		channel_name = "alerts"
+		api_tokens {
+			missing = "token"
+		}
+	}
+	`)
+	if err == nil {
+		t.Error("expected an error for api_tokens with an unknown team")
+	}
+}
+
+func TestHandler_checkSummaryFormatting(t *testing.T) {
+	alert := &AlertState{
+		Details: "Failing checks:\n=> (check) mem:\noom",
+	}
+
+	// Without check summaries, the details are sent as-is
+	if details := pagerdutyDetails(alert); details != alert.Details {
+		t.Errorf("expected plain details, got %v", details)
+	}
+
+	alert.Checks = []CheckSummary{
+		CheckSummary{Node: "a", Name: "mem", Status: api.HealthCritical, Output: "oom"},
+		CheckSummary{Node: "a", Name: "disk", Status: api.HealthWarning, Output: "90% full"},
+	}
+	details, ok := pagerdutyDetails(alert).(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected structured details, got %v", pagerdutyDetails(alert))
+	}
+	if checks, ok := details["failing_checks"].([]CheckSummary); !ok || len(checks) != 2 {
+		t.Errorf("expected 2 failing checks in details, got %v", details["failing_checks"])
+	}
+
+	attachments := slackAttachments(alert)
+	if len(attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(attachments))
+	}
+	if attachments[0].Color != "danger" || attachments[1].Color != "warning" {
+		t.Errorf("expected attachments colored by status, got %s and %s", attachments[0].Color, attachments[1].Color)
 	}
 }
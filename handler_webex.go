@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// WebexHandler posts alerts to a Webex room as a bot, formatting the alert as markdown with
+// the failing checks listed along with their status and output.
+type WebexHandler struct {
+	BotToken   string `mapstructure:"bot_token"`
+	RoomID     string `mapstructure:"room_id"`
+	BaseURL    string `mapstructure:"base_url"`
+	MaxRetries int    `mapstructure:"max_retries"`
+	Sandbox    bool   `mapstructure:"sandbox"`
+	Proxy      string `mapstructure:"proxy"`
+}
+
+// A message posted to the Webex messages API. Text is shown by clients that can't render
+// markdown.
+type webexMessage struct {
+	RoomID   string `json:"roomId"`
+	Text     string `json:"text"`
+	Markdown string `json:"markdown"`
+}
+
+func (handler WebexHandler) Alert(datacenter string, alert *AlertState) error {
+	message := webexMessage{
+		RoomID:   handler.RoomID,
+		Text:     alert.Message,
+		Markdown: webexMarkdown(alert),
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("Error forming Webex message: %s", err)
+	}
+
+	if handler.Sandbox {
+		logSandboxPayload("webex", handler.RoomID, sandboxJSON(message))
+		return nil
+	}
+
+	for tries := 0; tries <= handler.MaxRetries; tries++ {
+		if err = handler.post(body); err == nil {
+			return nil
+		}
+
+		log.Errorf("Error sending alert to Webex (room: %s): %s", handler.RoomID, err)
+		if tries < handler.MaxRetries {
+			log.Errorf("Retrying alert to Webex in 5s...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	return err
+}
+
+// Checks that the handler's settings are usable
+func (handler WebexHandler) validate() error {
+	if handler.BotToken == "" {
+		return fmt.Errorf("bot_token must be set")
+	}
+	if handler.RoomID == "" {
+		return fmt.Errorf("room_id must be set")
+	}
+	return nil
+}
+
+// Posts a message to the room
+func (handler WebexHandler) post(body []byte) error {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(handler.BaseURL, "/")+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+handler.BotToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := proxyHTTPClient(handler.Proxy).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+// Returns the markdown for an alert: the message in bold, followed by a list of the failing
+// checks, or the details in a code block if there are no checks
+func webexMarkdown(alert *AlertState) string {
+	markdown := fmt.Sprintf("**%s%s**\n", presentationEmoji(alert, alert.Status), alert.Message)
+
+	if len(alert.Checks) > 0 {
+		markdown = markdown + "\n"
+		for _, check := range alert.Checks {
+			markdown = markdown + fmt.Sprintf("- %s**%s** on `%s` is %s\n", presentationEmoji(alert, check.Status), check.Name, check.Node, check.Status)
+			if output := strings.TrimSpace(check.Output); output != "" {
+				markdown = markdown + fmt.Sprintf("```\n%s\n```\n", output)
+			}
+		}
+	} else if details := strings.TrimSpace(alert.Details); details != "" {
+		markdown = markdown + fmt.Sprintf("\n```\n%s\n```\n", details)
+	}
+	if fields := alertFieldsText(alert); fields != "" {
+		markdown = markdown + "\n" + fields + "\n"
+	}
+
+	if alert.Links != nil {
+		markdown = markdown + fmt.Sprintf("\n[Acknowledge](%s) | [Silence](%s)\n", alert.Links.Ack, alert.Links.Silence)
+	}
+	return markdown
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestWebexHandler_alert(t *testing.T) {
+	messages := make(chan webexMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages" || r.Header.Get("Authorization") != "Bearer bot-token" {
+			t.Errorf("unexpected request to %s with auth %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var message webexMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Error(err)
+		}
+		messages <- message
+		w.Write([]byte(`{"id":"abc"}`))
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	handler "webex" "oncall" {
+		bot_token = "bot-token"
+		room_id = "room1"
+		base_url = "` + server.URL + `"
+		max_retries = 0
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := &AlertState{
+		Status:  api.HealthCritical,
+		Message: "[dc1] service redis is now critical",
+		Checks: []CheckSummary{
+			{Node: "node1", Name: "redis ping", Status: api.HealthCritical, Output: "connection refused\n"},
+		},
+	}
+	if err := config.Handlers["webex.oncall"].Alert("dc1", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-messages
+	if message.RoomID != "room1" || message.Text != alert.Message {
+		t.Errorf("unexpected message: %+v", message)
+	}
+	expected := "**[dc1] service redis is now critical**\n\n- **redis ping** on `node1` is critical\n```\nconnection refused\n```\n"
+	if message.Markdown != expected {
+		t.Errorf("expected markdown:\n%s\ngot:\n%s", expected, message.Markdown)
+	}
+
+	_, err = ParseConfig(`handler "webex" "oncall" { bot_token = "bot-token" }`)
+	if err == nil || !strings.Contains(err.Error(), "room_id must be set") {
+		t.Fatalf("expected missing room_id error, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The KV prefix alert histories are stored under, keyed by alert fingerprint
+const historyKVRoot = alertingKVRoot + "/history/"
+
+// The default and largest number of records returned by a page of the history API
+const (
+	historyPageSize    = 100
+	historyMaxPageSize = 1000
+)
+
+// HistoryRecord is a single lifecycle event for an alert, as kept in its history
+type HistoryRecord struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Datacenter  string    `json:"datacenter"`
+	Fingerprint string    `json:"fingerprint"`
+	Node        string    `json:"node"`
+	Service     string    `json:"service"`
+	Tag         string    `json:"tag"`
+	Route       string    `json:"route,omitempty"`
+	Status      string    `json:"status"`
+	LastAlerted string    `json:"last_alerted"`
+	Message     string    `json:"message"`
+	Details     string    `json:"details"`
+
+	// The handlers a sent alert or reminder was routed to
+	Handlers []string `json:"handlers,omitempty"`
+}
+
+// AlertHistory keeps the most recent lifecycle events for each alert in the KV store, so they
+// can be looked up through the status API when reviewing an incident. Each node/service's
+// events are only written by the process holding its watch's lock.
+type AlertHistory struct {
+	client *api.Client
+	size   int
+
+	// The KV prefix to keep the histories under, which is separate in shadow mode
+	prefix string
+}
+
+// Adds an event to the alert's history, dropping the oldest events past the history size
+func (h *AlertHistory) record(event string, datacenter string, alert *AlertState, now time.Time) error {
+	fingerprint := alertFingerprint(alert)
+	records, err := getHistory(h.prefix, fingerprint, h.client)
+	if err != nil {
+		return err
+	}
+
+	records = append(records, HistoryRecord{
+		Time:        now.UTC(),
+		Event:       event,
+		Datacenter:  datacenter,
+		Fingerprint: fingerprint,
+		Node:        alert.Node,
+		Service:     alert.Service,
+		Tag:         alert.Tag,
+		Route:       alert.Route,
+		Status:      alert.Status,
+		LastAlerted: alert.LastAlerted,
+		Message:     alert.Message,
+		Details:     alert.Details,
+		Handlers:    alert.handlers,
+	})
+	if len(records) > h.size {
+		records = records[len(records)-h.size:]
+	}
+
+	serialized, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("Error forming alert history: %s", err)
+	}
+
+	_, err = h.client.KV().Put(&api.KVPair{
+		Key:   h.prefix + fingerprint,
+		Value: serialized,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error storing alert history: %s", err)
+	}
+
+	return nil
+}
+
+// Loads the history under the prefix for the given alert fingerprint, oldest first
+func getHistory(prefix string, fingerprint string, client *api.Client) ([]HistoryRecord, error) {
+	kvPair, _, err := client.KV().Get(prefix+fingerprint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading alert history: %s", err)
+	}
+
+	records := make([]HistoryRecord, 0)
+	if kvPair == nil || len(kvPair.Value) == 0 {
+		return records, nil
+	}
+
+	if err := json.Unmarshal(kvPair.Value, &records); err != nil {
+		return nil, fmt.Errorf("Error parsing alert history: %s", err)
+	}
+	return records, nil
+}
+
+// Loads the history of every alert under the prefix
+func listHistory(prefix string, client *api.Client) ([]HistoryRecord, error) {
+	pairs, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing alert history: %s", err)
+	}
+
+	records := make([]HistoryRecord, 0)
+	for _, pair := range pairs {
+		var alertRecords []HistoryRecord
+		if err := json.Unmarshal(pair.Value, &alertRecords); err != nil {
+			log.Errorf("Skipping unreadable alert history at %s: %s", pair.Key, err)
+			continue
+		}
+		records = append(records, alertRecords...)
+	}
+	return records, nil
+}
+
+// The filters for a history query
+type historyFilter struct {
+	service, node, tag, status string
+	since, until               time.Time
+}
+
+func (f *historyFilter) matches(record *HistoryRecord) bool {
+	return (f.service == "" || record.Service == f.service) &&
+		(f.node == "" || record.Node == f.node) &&
+		(f.tag == "" || record.Tag == f.tag) &&
+		(f.status == "" || record.Status == f.status) &&
+		(f.since.IsZero() || !record.Time.Before(f.since)) &&
+		(f.until.IsZero() || record.Time.Before(f.until))
+}
+
+// A page of history records, with the offset of the next page if there is one
+type historyPage struct {
+	Records    []HistoryRecord `json:"records"`
+	Total      int             `json:"total"`
+	NextOffset *int            `json:"next_offset,omitempty"`
+}
+
+// Returns the page of records matching the filter, newest first
+func queryHistory(records []HistoryRecord, filter historyFilter, offset int, limit int) historyPage {
+	matched := make([]HistoryRecord, 0)
+	for i := range records {
+		if filter.matches(&records[i]) {
+			matched = append(matched, records[i])
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Time.After(matched[j].Time)
+	})
+
+	page := historyPage{Records: make([]HistoryRecord, 0), Total: len(matched)}
+	if offset >= len(matched) {
+		return page
+	}
+
+	end := offset + limit
+	if end < len(matched) {
+		page.NextOffset = &end
+	} else {
+		end = len(matched)
+	}
+	page.Records = matched[offset:end]
+	return page
+}
+
+// GET /v1/alerts/history lists alert lifecycle records, newest first. The results can be
+// filtered by service, node, tag and status, and by time with since and until (RFC3339), and
+// are paged with offset and limit.
+func (s *StatusServer) alertHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := historyFilter{
+		service: query.Get("service"),
+		node:    query.Get("node"),
+		tag:     query.Get("tag"),
+		status:  query.Get("status"),
+	}
+
+	for param, t := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %q", param, value), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	offset, limit := 0, historyPageSize
+	for param, n := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if value := query.Get(param); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 || (param == "limit" && (parsed == 0 || parsed > historyMaxPageSize)) {
+				http.Error(w, fmt.Sprintf("invalid %s: %q", param, value), http.StatusBadRequest)
+				return
+			}
+			*n = parsed
+		}
+	}
+
+	records, err := listHistory(s.config.historyKVPrefix(), s.client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, queryHistory(records, filter, offset, limit))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestHistory_query(t *testing.T) {
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	records := []HistoryRecord{
+		{Time: start, Event: EventSent, Node: "node1", Service: "redis", Tag: "alpha", Status: api.HealthCritical},
+		{Time: start.Add(1 * time.Minute), Event: EventSent, Node: "node2", Service: "redis", Status: api.HealthWarning},
+		{Time: start.Add(2 * time.Minute), Event: EventSent, Node: "node1", Service: "nginx", Status: api.HealthCritical},
+		{Time: start.Add(3 * time.Minute), Event: EventSent, Node: "node1", Service: "redis", Tag: "alpha", Status: api.HealthPassing},
+	}
+
+	cases := []struct {
+		filter   historyFilter
+		offset   int
+		limit    int
+		expected []time.Time
+		next     int
+	}{
+		// Everything, newest first
+		{historyFilter{}, 0, 10, []time.Time{start.Add(3 * time.Minute), start.Add(2 * time.Minute), start.Add(1 * time.Minute), start}, 0},
+		// Paged
+		{historyFilter{}, 0, 2, []time.Time{start.Add(3 * time.Minute), start.Add(2 * time.Minute)}, 2},
+		{historyFilter{}, 2, 2, []time.Time{start.Add(1 * time.Minute), start}, 0},
+		{historyFilter{}, 4, 2, []time.Time{}, 0},
+		// Filters
+		{historyFilter{service: "redis"}, 0, 10, []time.Time{start.Add(3 * time.Minute), start.Add(1 * time.Minute), start}, 0},
+		{historyFilter{service: "redis", node: "node1", tag: "alpha"}, 0, 10, []time.Time{start.Add(3 * time.Minute), start}, 0},
+		{historyFilter{status: api.HealthCritical}, 0, 10, []time.Time{start.Add(2 * time.Minute), start}, 0},
+		{historyFilter{since: start.Add(1 * time.Minute), until: start.Add(3 * time.Minute)}, 0, 10, []time.Time{start.Add(2 * time.Minute), start.Add(1 * time.Minute)}, 0},
+	}
+
+	for i, tc := range cases {
+		page := queryHistory(records, tc.filter, tc.offset, tc.limit)
+
+		if len(page.Records) != len(tc.expected) {
+			t.Fatalf("case %d: expected %d records, got %d", i, len(tc.expected), len(page.Records))
+		}
+		for j, record := range page.Records {
+			if !record.Time.Equal(tc.expected[j]) {
+				t.Errorf("case %d: expected record %d at %s, got %s", i, j, tc.expected[j], record.Time)
+			}
+		}
+
+		next := 0
+		if page.NextOffset != nil {
+			next = *page.NextOffset
+		}
+		if next != tc.next {
+			t.Errorf("case %d: expected next offset %d, got %d", i, tc.next, next)
+		}
+	}
+}
+
+func TestHistory_recordAndServe(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	history := &AlertHistory{client: client, size: 2, prefix: historyKVRoot}
+	alert := &AlertState{
+		Node:    "node1",
+		Service: testServiceName,
+		Status:  api.HealthCritical,
+	}
+
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	for i, event := range []string{EventPending, EventSent, EventReminder} {
+		if err := history.record(event, "dc1", alert, start.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the newest events past the size should be kept
+	records, err := getHistory(historyKVRoot, alertFingerprint(alert), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Event != EventSent || records[1].Event != EventReminder {
+		t.Fatalf("unexpected history: %+v", records)
+	}
+
+	s := &StatusServer{config: DefaultConfig(), client: client}
+	w := httptest.NewRecorder()
+	s.alertHistory(w, httptest.NewRequest("GET", "/v1/alerts/history?service="+testServiceName+"&limit=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var page historyPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Records) != 1 || page.Records[0].Event != EventReminder {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+	if page.NextOffset == nil || *page.NextOffset != 1 {
+		t.Fatalf("expected next offset 1, got %v", page.NextOffset)
+	}
+
+	// Bad parameters should be rejected
+	for _, query := range []string{"since=yesterday", "limit=0", "limit=5000", "offset=-1"} {
+		w := httptest.NewRecorder()
+		s.alertHistory(w, httptest.NewRequest("GET", "/v1/alerts/history?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// The prefix of the route set on alerts from HTTP watches, which have no node or service
+const httpWatchRoutePrefix = "http:"
+
+// The most of a response body to read when polling an endpoint, and to show in an alert
+const (
+	httpWatchMaxBody   = 1 << 20
+	httpWatchMaxOutput = 500
+)
+
+// HTTPWatchConfig polls an HTTP endpoint, by default on the Consul agent, and alerts when a
+// condition on its JSON response stops holding. This covers things that have no health check,
+// such as the operator endpoints for autopilot or raft.
+type HTTPWatchConfig struct {
+	Name            string
+	Path            string   `mapstructure:"path"`
+	URL             string   `mapstructure:"url"`
+	Interval        int      `mapstructure:"interval"`
+	Timeout         int      `mapstructure:"timeout"`
+	JSONPath        string   `mapstructure:"jsonpath"`
+	Condition       string   `mapstructure:"condition"`
+	Status          string   `mapstructure:"status"`
+	ChangeThreshold int      `mapstructure:"change_threshold"`
+	Handlers        []string `mapstructure:"handlers"`
+	Team            string   `mapstructure:"team"`
+
+	// Parsed versions of JSONPath and Condition
+	segments  []jsonPathSegment
+	condition httpCondition
+}
+
+// A step in a JSON path: an object key, an array index, or every element of either
+type jsonPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// A comparison of a value in a JSON response against a JSON literal
+type httpCondition struct {
+	op    string
+	value interface{}
+}
+
+var httpConditionOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// Parse the raw http_watch objects into the config
+func parseHTTPWatches(list *ast.ObjectList, config *Config) error {
+	for _, w := range list.Items {
+		name := w.Keys[0].Token.Value().(string)
+
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, w.Val); err != nil {
+			return err
+		}
+
+		watch := HTTPWatchConfig{
+			Interval:        30,
+			Timeout:         10,
+			Status:          api.HealthCritical,
+			ChangeThreshold: config.ChangeThreshold,
+		}
+		if err := mapstructure.WeakDecode(m, &watch); err != nil {
+			return err
+		}
+		watch.Name = name
+
+		if (watch.Path == "") == (watch.URL == "") {
+			return fmt.Errorf("Exactly one of path and url must be given for http_watch %s", name)
+		}
+		if watch.Path != "" && !strings.HasPrefix(watch.Path, "/") {
+			return fmt.Errorf("Invalid path for http_watch %s: must start with /", name)
+		}
+		if watch.URL != "" && !strings.HasPrefix(watch.URL, "http://") && !strings.HasPrefix(watch.URL, "https://") {
+			return fmt.Errorf("Invalid url for http_watch %s: must be an http:// or https:// URL", name)
+		}
+		if watch.Interval <= 0 {
+			return fmt.Errorf("Invalid interval for http_watch %s: %d", name, watch.Interval)
+		}
+		if watch.Timeout <= 0 {
+			return fmt.Errorf("Invalid timeout for http_watch %s: %d", name, watch.Timeout)
+		}
+		if watch.ChangeThreshold < 0 {
+			return fmt.Errorf("Invalid change_threshold for http_watch %s: %d", name, watch.ChangeThreshold)
+		}
+		if watch.Status != api.HealthWarning && watch.Status != api.HealthCritical {
+			return fmt.Errorf("Invalid status for http_watch %s: %s", name, watch.Status)
+		}
+
+		segments, err := parseJSONPath(watch.JSONPath)
+		if err != nil {
+			return fmt.Errorf("Invalid jsonpath for http_watch %s: %s", name, err)
+		}
+		watch.segments = segments
+
+		if watch.Condition == "" {
+			return fmt.Errorf("No condition given for http_watch %s", name)
+		}
+		condition, err := parseHTTPCondition(watch.Condition)
+		if err != nil {
+			return fmt.Errorf("Invalid condition for http_watch %s: %s", name, err)
+		}
+		watch.condition = condition
+
+		for _, id := range watch.Handlers {
+			_, isGroup := config.HandlerGroups[id]
+			if _, ok := config.Handlers[id]; !ok && !isGroup {
+				return fmt.Errorf("Unknown handler for http_watch %s: %s", name, id)
+			}
+		}
+		if _, ok := config.Teams[watch.Team]; watch.Team != "" && !ok {
+			return fmt.Errorf("Unknown team for http_watch %s: %s", name, watch.Team)
+		}
+		watch.Handlers = config.expandHandlerGroups(watch.Handlers)
+
+		config.HTTPWatches[name] = watch
+	}
+
+	return nil
+}
+
+// Parses a path like Servers[*].Healthy or $.Servers.*.Healthy. An empty path refers to the
+// whole document.
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	segments := make([]jsonPathSegment, 0)
+
+	for path != "" {
+		var token string
+		if strings.HasPrefix(path, "[") {
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [")
+			}
+			token, path = path[1:end], path[end+1:]
+			switch {
+			case token == "*":
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			case strings.HasPrefix(token, `"`) || strings.HasPrefix(token, "'"):
+				segments = append(segments, jsonPathSegment{key: strings.Trim(token, `"'`)})
+			default:
+				index, err := strconv.Atoi(token)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid index [%s]", token)
+				}
+				segments = append(segments, jsonPathSegment{index: index, isIndex: true})
+			}
+		} else {
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			token, path = path[:end], path[end:]
+			switch {
+			case token == "":
+				return nil, fmt.Errorf("empty key")
+			case token == "*":
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			default:
+				if index, err := strconv.Atoi(token); err == nil && index >= 0 {
+					segments = append(segments, jsonPathSegment{index: index, isIndex: true})
+				} else {
+					segments = append(segments, jsonPathSegment{key: token})
+				}
+			}
+		}
+		path = strings.TrimPrefix(path, ".")
+	}
+
+	return segments, nil
+}
+
+// Returns the values at the path in a decoded JSON document. Wildcards return every element
+// of an array or object, in order of their index or key.
+func jsonPathValues(doc interface{}, segments []jsonPathSegment) []interface{} {
+	values := []interface{}{doc}
+	for _, segment := range segments {
+		next := make([]interface{}, 0)
+		for _, value := range values {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				if segment.wildcard {
+					keys := make([]string, 0, len(v))
+					for key := range v {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						next = append(next, v[key])
+					}
+				} else if element, ok := v[segment.key]; ok && !segment.isIndex {
+					next = append(next, element)
+				} else if element, ok := v[strconv.Itoa(segment.index)]; ok && segment.isIndex {
+					next = append(next, element)
+				}
+			case []interface{}:
+				if segment.wildcard {
+					next = append(next, v...)
+				} else if segment.isIndex && segment.index < len(v) {
+					next = append(next, v[segment.index])
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+// Parses a condition like "== true", ">= 3" or `!= "follower"`
+func parseHTTPCondition(raw string) (httpCondition, error) {
+	raw = strings.TrimSpace(raw)
+	for _, op := range httpConditionOps {
+		if !strings.HasPrefix(raw, op) {
+			continue
+		}
+
+		var value interface{}
+		literal := strings.TrimSpace(strings.TrimPrefix(raw, op))
+		if err := json.Unmarshal([]byte(literal), &value); err != nil {
+			return httpCondition{}, fmt.Errorf("%q is not a JSON value", literal)
+		}
+		if op != "==" && op != "!=" {
+			switch value.(type) {
+			case float64, string:
+			default:
+				return httpCondition{}, fmt.Errorf("%s can only compare numbers and strings", op)
+			}
+		}
+		return httpCondition{op: op, value: value}, nil
+	}
+	return httpCondition{}, fmt.Errorf("%q must start with one of %v", raw, httpConditionOps)
+}
+
+// Returns true if the value satisfies the condition
+func (c httpCondition) holds(value interface{}) bool {
+	switch c.op {
+	case "==":
+		return reflect.DeepEqual(value, c.value)
+	case "!=":
+		return !reflect.DeepEqual(value, c.value)
+	}
+
+	var cmp int
+	switch expected := c.value.(type) {
+	case float64:
+		actual, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case actual < expected:
+			cmp = -1
+		case actual > expected:
+			cmp = 1
+		}
+	case string:
+		actual, ok := value.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(actual, expected)
+	}
+
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func (c httpCondition) String() string {
+	literal, _ := json.Marshal(c.value)
+	return c.op + " " + string(literal)
+}
+
+// Returns the URL the watch polls: its url, or its path on the Consul agent
+func (w *HTTPWatchConfig) target(consulAddress string) string {
+	if w.URL != "" {
+		return w.URL
+	}
+	if !strings.Contains(consulAddress, "://") {
+		consulAddress = "http://" + consulAddress
+	}
+	return strings.TrimSuffix(consulAddress, "/") + w.Path
+}
+
+// Polls the endpoint once, returning the status and the details to alert with. Error
+// responses are still evaluated if their body is JSON, since some endpoints (like autopilot's
+// health) report failure with the status code as well as in the body.
+func (w *HTTPWatchConfig) check(config *Config, client *http.Client) (string, string) {
+	target := w.target(config.ConsulAddress)
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return w.Status, fmt.Sprintf("Error creating request for %s: %s", target, err)
+	}
+	if w.Path != "" && config.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", config.ConsulToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return w.Status, fmt.Sprintf("Error polling %s: %s", target, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpWatchMaxBody))
+	if err != nil {
+		return w.Status, fmt.Sprintf("Error reading response from %s: %s", target, err)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return w.Status, fmt.Sprintf("GET %s returned %d with a body that isn't JSON: %s", target, resp.StatusCode, truncate(strings.TrimSpace(string(body)), httpWatchMaxOutput))
+	}
+
+	status, failures := w.evaluate(doc)
+	details := fmt.Sprintf("GET %s returned %d", target, resp.StatusCode)
+	if len(failures) > 0 {
+		details = details + "\n" + strings.Join(failures, "\n")
+	}
+	return status, details
+}
+
+// Checks the condition against every value at the watch's path, returning the status and a
+// description of each value that failed it
+func (w *HTTPWatchConfig) evaluate(doc interface{}) (string, []string) {
+	path := w.JSONPath
+	if path == "" {
+		path = "$"
+	}
+
+	values := jsonPathValues(doc, w.segments)
+	if len(values) == 0 {
+		return w.Status, []string{fmt.Sprintf("=> %s: no value (expected %s)", path, w.condition)}
+	}
+
+	failures := make([]string, 0)
+	for _, value := range values {
+		if !w.condition.holds(value) {
+			encoded, _ := json.Marshal(value)
+			failures = append(failures, fmt.Sprintf("=> %s: %s (expected %s)", path, truncate(string(encoded), httpWatchMaxOutput), w.condition))
+		}
+	}
+	if len(failures) > 0 {
+		return w.Status, failures
+	}
+	return api.HealthPassing, nil
+}
+
+// Returns the handlers for an HTTP watch's alerts: its handlers and team's handlers, or the
+// default handlers if it has neither
+func (c *Config) httpWatchHandlerIDs(name string, tier string) []string {
+	c.lock.RLock()
+	watch, ok := c.HTTPWatches[name]
+	var ids []string
+	if ok {
+		ids = append(ids, watch.Handlers...)
+		if team, ok := c.Teams[watch.Team]; ok {
+			ids = append(ids, team.handlerIDs...)
+		}
+	}
+	c.lock.RUnlock()
+
+	if len(ids) == 0 {
+		return c.serviceTierHandlerIDs("", tier)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Returns the name of the HTTP watch an alert is for, if it's from one
+func httpWatchName(alert *AlertState) (string, bool) {
+	if alert.Node != "" || alert.Service != "" || !strings.HasPrefix(alert.Route, httpWatchRoutePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(alert.Route, httpWatchRoutePrefix), true
+}
+
+// Polls an HTTP watch's endpoint every interval, alerting when its status changes and stays
+// changed for the change threshold. Like the node and service watches, only the process
+// holding the watch's lock polls it, and its alert state is kept in the KV store.
+func runHTTPWatch(watch HTTPWatchConfig, config *Config, shutdownCh chan struct{}, client *api.Client) {
+	keyPath := config.stateKVRoot() + "/http/" + escapeKVSegment(watch.Name) + "/"
+	alertPath := keyPath + "alert"
+	name := "http watch " + watch.Name
+
+	opts := &WatchOptions{
+		config:    config,
+		client:    client,
+		alertLock: &sync.Mutex{},
+		alertSeqs: make(map[string]uint64),
+	}
+
+	// The status last seen, loaded from the alert state on gaining the lock
+	lastStatus := api.HealthPassing
+	loadStatus := func() {
+		alert, err := getAlertState(alertPath, client)
+		if err != nil {
+			log.Errorf("Error loading alert state for %s: %s", name, err)
+			return
+		}
+		if alert != nil {
+			lastStatus = alert.Status
+		}
+	}
+
+	hookTarget := watchHookTarget(name, opts)
+	hookTarget.HTTPWatch = watch.Name
+	fireWatchHooks(config, WatchCreated, hookTarget)
+
+	var lock LockHelper
+	if config.ShadowMode {
+		loadStatus()
+		lock.acquired = true
+	} else {
+		apiLock, err := client.LockKey(keyPath + "leader")
+		if err != nil {
+			fatalError(config, client, ExitLockFailure, fmt.Errorf("Error initializing lock for %s: %s", name, err))
+		}
+		lock = LockHelper{
+			target: name,
+			client: client,
+			lock:   apiLock,
+			stopCh: make(chan struct{}, 1),
+			lockCh: make(chan struct{}, 1),
+			callback: func() {
+				loadStatus()
+				if config.DeliveryIntents {
+					go replayIntents(keyPath, opts)
+				}
+				fireWatchHooks(config, WatchLockAcquired, hookTarget)
+			},
+			lostCallback: func() {
+				fireWatchHooks(config, WatchLockLost, hookTarget)
+			},
+		}
+		go lock.start()
+	}
+
+	httpClient := &http.Client{Timeout: time.Duration(watch.Timeout) * time.Second}
+	// Poll right away, then every interval
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-shutdownCh:
+			log.Infof("Shutting down %s", name)
+			if !config.ShadowMode {
+				lock.stop()
+			}
+			fireWatchHooks(config, WatchRemoved, hookTarget)
+			<-shutdownCh
+			return
+		case <-time.After(wait):
+		}
+		wait = time.Duration(watch.Interval) * time.Second
+
+		if !lock.acquired {
+			continue
+		}
+
+		status, details := watch.check(config, httpClient)
+		if status == lastStatus {
+			continue
+		}
+		log.Debugf("Got status %s for %s", status, name)
+		lastStatus = status
+
+		opts.alertSeq++
+		go tryAlertAfter(alertPath, AlertState{
+			seq:     opts.alertSeq,
+			Route:   httpWatchRoutePrefix + watch.Name,
+			Status:  status,
+			Message: fmt.Sprintf("[%s] %s is now %s", config.ConsulDatacenter, name, status),
+			Details: details,
+		}, opts, time.Duration(watch.ChangeThreshold)*time.Second)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestHTTPWatch_jsonPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"Healthy": true,
+		"Servers": []interface{}{
+			map[string]interface{}{"Name": "server1", "Healthy": true},
+			map[string]interface{}{"Name": "server2", "Healthy": false},
+		},
+		"Voters": map[string]interface{}{"b": 2.0, "a": 1.0},
+	}
+
+	cases := []struct {
+		path     string
+		expected []interface{}
+	}{
+		{"", []interface{}{doc}},
+		{"Healthy", []interface{}{true}},
+		{"$.Healthy", []interface{}{true}},
+		{"Servers[1].Name", []interface{}{"server2"}},
+		{"Servers.0.Name", []interface{}{"server1"}},
+		{"Servers[*].Healthy", []interface{}{true, false}},
+		{"$.Voters.*", []interface{}{1.0, 2.0}},
+		{`Voters["a"]`, []interface{}{1.0}},
+		{"Servers[5].Name", []interface{}{}},
+		{"Missing.Key", []interface{}{}},
+	}
+	for _, tc := range cases {
+		segments, err := parseJSONPath(tc.path)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if values := jsonPathValues(doc, segments); !reflect.DeepEqual(values, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.path, tc.expected, values)
+		}
+	}
+
+	for _, path := range []string{"Servers[", "Servers[x]", "Servers..Name"} {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Errorf("expected an error for %s", path)
+		}
+	}
+}
+
+func TestHTTPWatch_condition(t *testing.T) {
+	cases := []struct {
+		condition string
+		value     interface{}
+		holds     bool
+	}{
+		{"== true", true, true},
+		{"== true", false, false},
+		{`!= "follower"`, "leader", true},
+		{">= 3", 3.0, true},
+		{">= 3", 2.0, false},
+		{"< 10", 2.5, true},
+		{"< 10", "2", false},
+		{`> "b"`, "c", true},
+		{"== null", nil, true},
+	}
+	for _, tc := range cases {
+		condition, err := parseHTTPCondition(tc.condition)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.condition, err)
+		}
+		if holds := condition.holds(tc.value); holds != tc.holds {
+			t.Errorf("%s on %v: expected %v, got %v", tc.condition, tc.value, tc.holds, holds)
+		}
+	}
+
+	for _, raw := range []string{"true", "== yes", "> true"} {
+		if _, err := parseHTTPCondition(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+func TestHTTPWatch_check(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/operator/autopilot/health" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if token := r.Header.Get("X-Consul-Token"); token != "secret" {
+			t.Errorf("unexpected token %q", token)
+		}
+		// Autopilot reports an unhealthy cluster with a 429
+		if !healthy {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"Healthy": false, "Servers": [{"Name": "s1", "Healthy": true}, {"Name": "s2", "Healthy": false}]}`))
+			return
+		}
+		w.Write([]byte(`{"Healthy": true, "Servers": [{"Name": "s1", "Healthy": true}, {"Name": "s2", "Healthy": true}]}`))
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	consul_address = "` + server.URL + `"
+	consul_token = "secret"
+	handler "stdout" "ops" {}
+
+	http_watch "autopilot" {
+		path = "/v1/operator/autopilot/health"
+		jsonpath = "Servers[*].Healthy"
+		condition = "== true"
+		handlers = ["stdout.ops"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watch := config.HTTPWatches["autopilot"]
+
+	if status, details := watch.check(config, http.DefaultClient); status != api.HealthPassing {
+		t.Errorf("expected passing, got %s: %s", status, details)
+	}
+
+	healthy = false
+	status, details := watch.check(config, http.DefaultClient)
+	if status != api.HealthCritical {
+		t.Errorf("expected critical, got %s", status)
+	}
+	if !strings.Contains(details, "returned 429") || strings.Count(details, "=> Servers[*].Healthy: false") != 1 {
+		t.Errorf("unexpected details: %s", details)
+	}
+
+	// The watch's alerts go to its own handlers
+	alert := &AlertState{Route: httpWatchRoutePrefix + "autopilot", Status: status}
+	if ids := config.alertHandlerIDs("", alert); !reflect.DeepEqual(ids, []string{"stdout.ops"}) {
+		t.Errorf("unexpected handlers %v", ids)
+	}
+	if name := alertName(alert); name != "http watch autopilot" {
+		t.Errorf("unexpected alert name %q", name)
+	}
+}
+
+func TestHTTPWatch_config(t *testing.T) {
+	cases := []string{
+		`http_watch "a" { condition = "== true" }`,
+		`http_watch "a" { path = "/v1/status/leader", url = "http://localhost:8080/health", condition = "== true" }`,
+		`http_watch "a" { path = "v1/status/leader", condition = "== true" }`,
+		`http_watch "a" { path = "/v1/status/leader" }`,
+		`http_watch "a" { path = "/v1/status/leader", condition = "!= \"\"", status = "info" }`,
+		`http_watch "a" { path = "/v1/status/leader", condition = "!= \"\"", handlers = ["missing"] }`,
+	}
+	for _, raw := range cases {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+const importCommandUsage = `Usage: consul-alerting import [options]
+
+Reads the configuration the consul-alerts project keeps in the Consul KV store (its
+notifiers, notification profiles and check blacklist) and prints an equivalent
+consul-alerting config. Settings that can't be carried over are listed as warnings.
+
+Options:
+
+    -config=<path>    Sets the path to a configuration file on disk, used for
+                      the Consul address and token.
+    -prefix=<path>    The KV prefix consul-alerts was run with. Defaults to
+                      consul-alerts.
+    -out=<path>       Writes the config to a file instead of stdout.
+`
+
+// Maps the settings of a consul-alerts notifier onto one of our handler types, by the
+// notifier's KV key and the handler option it becomes
+var consulAlertsNotifiers = map[string]struct {
+	handlerType string
+	options     map[string]string
+}{
+	"email": {"email", map[string]string{
+		"sender-email": "from",
+		"username":     "relay_username",
+		"password":     "relay_password",
+	}},
+	"slack":     {"slack", map[string]string{"url": "webhook_url"}},
+	"pagerduty": {"pagerduty", map[string]string{"service-key": "service_key", "max-retry": "max_retries"}},
+	"awssns":    {"sns", map[string]string{"region": "region", "topic-arn": "topic_arn"}},
+	"msteams":   {"teams", map[string]string{"webhookurl": "webhook_url"}},
+	"influxdb":  {"influx", map[string]string{"host": "address", "db": "database", "series-name": "measurement"}},
+	"log":       {"file", map[string]string{"path": "path"}},
+}
+
+// A notification profile, as consul-alerts stores it under notif-profiles/
+type consulAlertsProfile struct {
+	Interval     int
+	NotifList    map[string]bool
+	VarOverrides map[string]map[string]interface{}
+}
+
+// A handler block to write out, with its options in the order they're written
+type importedHandler struct {
+	handlerType string
+	name        string
+	options     [][2]string
+}
+
+// The config read from consul-alerts' keys, along with which keys were carried over so the
+// rest can be reported
+type consulAlertsImport struct {
+	values   map[string]string
+	used     map[string]bool
+	warnings []string
+}
+
+// Returns the value of a key under the config prefix, marking it as carried over
+func (i *consulAlertsImport) get(key string) (string, bool) {
+	value, ok := i.values[key]
+	if ok {
+		i.used[key] = true
+	}
+	return value, ok
+}
+
+// Returns the keys under a prefix of the config, sorted
+func (i *consulAlertsImport) keys(prefix string) []string {
+	keys := make([]string, 0)
+	for key := range i.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (i *consulAlertsImport) warn(format string, args ...interface{}) {
+	i.warnings = append(i.warnings, fmt.Sprintf(format, args...))
+}
+
+// Converts the consul-alerts config under the given KV prefix into consul-alerting's HCL,
+// returning it along with warnings for the settings that couldn't be carried over
+func importConsulAlerts(pairs api.KVPairs, prefix string) (string, []string) {
+	root := strings.TrimSuffix(prefix, "/") + "/config/"
+	imported := &consulAlertsImport{
+		values: make(map[string]string),
+		used:   make(map[string]bool),
+	}
+	for _, pair := range pairs {
+		if strings.HasPrefix(pair.Key, root) && !strings.HasSuffix(pair.Key, "/") {
+			imported.values[strings.TrimPrefix(pair.Key, root)] = string(pair.Value)
+		}
+	}
+
+	var out []string
+	setting := func(name string, value string) {
+		out = append(out, fmt.Sprintf("%s = %s", name, value))
+	}
+
+	if value, ok := imported.get("checks/change-threshold"); ok {
+		if threshold, err := strconv.Atoi(value); err == nil {
+			setting("change_threshold", strconv.Itoa(threshold))
+		} else {
+			imported.warn("Invalid checks/change-threshold %q", value)
+		}
+	}
+	// Checks are alerted on unless this is explicitly turned off, which has no equivalent
+	if value, ok := imported.get("checks/enabled"); ok && value == "false" {
+		imported.warn("checks/enabled is false, but alerting can't be turned off in the config")
+	}
+
+	handlers, notifierHandlers := imported.notifiers()
+	profiles := imported.profiles()
+
+	// Alerts go to every enabled notifier, unless the default profile picks some of them
+	defaultHandlers := make([]string, 0)
+	if profile, ok := profiles["default"]; ok {
+		defaultHandlers = profileHandlers(imported, "default", profile, notifierHandlers)
+		if profile.Interval > 0 {
+			setting("reminder_interval", strconv.Itoa(profile.Interval*60))
+		}
+	} else {
+		for _, handler := range handlers {
+			defaultHandlers = append(defaultHandlers, handler.handlerType+"."+handler.name)
+		}
+	}
+	if len(defaultHandlers) > 0 {
+		setting("default_handlers", hclList(defaultHandlers))
+	}
+
+	ignoreChecks := make([]string, 0)
+	for _, key := range imported.keys("checks/blacklist/") {
+		parts := strings.SplitN(strings.TrimPrefix(key, "checks/blacklist/"), "/", 2)
+		if len(parts) == 2 && parts[0] == "checks" {
+			imported.used[key] = true
+			ignoreChecks = append(ignoreChecks, parts[1])
+		}
+	}
+	if len(ignoreChecks) > 0 {
+		setting("ignore_checks", hclList(ignoreChecks))
+	}
+
+	for _, handler := range handlers {
+		out = append(out, "", fmt.Sprintf("handler %q %q {", handler.handlerType, handler.name))
+		for _, option := range handler.options {
+			out = append(out, fmt.Sprintf("  %s = %s", option[0], option[1]))
+		}
+		out = append(out, "}")
+	}
+
+	for _, key := range imported.keys("notif-selection/services/") {
+		service := strings.TrimPrefix(key, "notif-selection/services/")
+		name, _ := imported.get(key)
+		profile, ok := profiles[name]
+		if !ok {
+			imported.warn("Service %s uses unknown notification profile %s", service, name)
+			continue
+		}
+
+		out = append(out, "", fmt.Sprintf("service %q {", service))
+		out = append(out, "  handlers = "+hclList(profileHandlers(imported, name, profile, notifierHandlers)))
+		if profile.Interval > 0 {
+			out = append(out, fmt.Sprintf("  reminder_interval = %d", profile.Interval*60))
+		}
+		out = append(out, "}")
+	}
+
+	// Report everything that wasn't carried over, other than notifiers' enabled flags
+	for _, key := range imported.keys("") {
+		if !imported.used[key] && !strings.HasSuffix(key, "/enabled") {
+			imported.warn("Not imported: %s%s", root, key)
+		}
+	}
+
+	header := []string{fmt.Sprintf("# Imported from the consul-alerts config under %s", root)}
+	for _, warning := range imported.warnings {
+		header = append(header, "# WARNING: "+warning)
+	}
+	if len(out) > 0 {
+		header = append(header, "")
+	}
+	return strings.Join(append(header, out...), "\n") + "\n", imported.warnings
+}
+
+// Converts the enabled notifiers into handlers, returning them sorted along with the IDs of
+// the handlers made for each notifier
+func (i *consulAlertsImport) notifiers() ([]importedHandler, map[string][]string) {
+	handlers := make([]importedHandler, 0)
+	ids := make(map[string][]string)
+
+	names := make([]string, 0)
+	for _, key := range i.keys("notifiers/") {
+		name := strings.SplitN(strings.TrimPrefix(key, "notifiers/"), "/", 2)[0]
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		// Custom notifiers are a list of executables rather than a set of keys
+		if name == "custom" {
+			value, _ := i.get("notifiers/custom")
+			var commands []string
+			if err := json.Unmarshal([]byte(value), &commands); err != nil {
+				i.warn("Invalid notifiers/custom %q: %s", value, err)
+				continue
+			}
+			for n, command := range commands {
+				handler := importedHandler{handlerType: "exec", name: "custom"}
+				if n > 0 {
+					handler.name = fmt.Sprintf("custom%d", n+1)
+				}
+				handler.options = [][2]string{{"command", hclList([]string{command})}}
+				handlers = append(handlers, handler)
+				ids[name] = append(ids[name], "exec."+handler.name)
+			}
+			if len(commands) > 0 {
+				i.warn("Custom notifiers are imported as exec handlers, which are passed a single alert as JSON rather than consul-alerts' list of messages")
+			}
+			continue
+		}
+
+		// Disabled notifiers, and ones we have nothing like, are only reported once rather than
+		// for each of their keys
+		mapping, ok := consulAlertsNotifiers[name]
+		enabled, _ := i.get("notifiers/" + name + "/enabled")
+		if enabled != "true" || !ok {
+			for _, key := range i.keys("notifiers/" + name + "/") {
+				i.used[key] = true
+			}
+			if enabled == "true" {
+				i.warn("The %s notifier has no equivalent handler", name)
+			}
+			continue
+		}
+
+		handler := importedHandler{handlerType: mapping.handlerType, name: "default"}
+		keys := make([]string, 0, len(mapping.options))
+		for key := range mapping.options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, ok := i.get("notifiers/" + name + "/" + key)
+			if !ok {
+				continue
+			}
+			// Options are decoded weakly, so numbers can be given as strings too
+			handler.options = append(handler.options, [2]string{mapping.options[key], strconv.Quote(value)})
+		}
+
+		// The email notifier's server and receivers don't map onto a single option
+		if name == "email" {
+			if host, ok := i.get("notifiers/email/url"); ok {
+				port, ok := i.get("notifiers/email/port")
+				if !ok {
+					port = "25"
+				}
+				handler.options = append(handler.options, [2]string{"relay", strconv.Quote(host + ":" + port)})
+			}
+			if value, ok := i.get("notifiers/email/receivers"); ok {
+				var receivers []string
+				if err := json.Unmarshal([]byte(value), &receivers); err != nil {
+					receivers = strings.Split(value, ",")
+				}
+				for n := range receivers {
+					receivers[n] = strings.TrimSpace(receivers[n])
+				}
+				handler.options = append(handler.options, [2]string{"recipients", hclList(receivers)})
+			}
+		}
+
+		handlers = append(handlers, handler)
+		ids[name] = append(ids[name], handler.handlerType+"."+handler.name)
+	}
+
+	sort.Slice(handlers, func(a, b int) bool {
+		return handlers[a].handlerType+"."+handlers[a].name < handlers[b].handlerType+"."+handlers[b].name
+	})
+	return handlers, ids
+}
+
+// Parses the notification profiles, by name
+func (i *consulAlertsImport) profiles() map[string]consulAlertsProfile {
+	profiles := make(map[string]consulAlertsProfile)
+	for _, key := range i.keys("notif-profiles/") {
+		name := strings.TrimPrefix(key, "notif-profiles/")
+		value, _ := i.get(key)
+
+		var profile consulAlertsProfile
+		if err := json.Unmarshal([]byte(value), &profile); err != nil {
+			i.warn("Invalid notification profile %s: %s", name, err)
+			continue
+		}
+		if len(profile.VarOverrides) > 0 {
+			i.warn("Notification profile %s overrides notifier settings, which isn't imported; define separate handlers for it instead", name)
+		}
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+// Returns the handlers for the notifiers a profile enables
+func profileHandlers(i *consulAlertsImport, name string, profile consulAlertsProfile, notifierHandlers map[string][]string) []string {
+	notifiers := make([]string, 0)
+	for notifier, enabled := range profile.NotifList {
+		if enabled {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+	sort.Strings(notifiers)
+
+	ids := make([]string, 0)
+	for _, notifier := range notifiers {
+		handlers, ok := notifierHandlers[notifier]
+		if !ok {
+			i.warn("Notification profile %s uses the %s notifier, which isn't enabled or has no equivalent handler", name, notifier)
+			continue
+		}
+		ids = append(ids, handlers...)
+	}
+	return ids
+}
+
+// Formats a list of strings as an HCL list
+func hclList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = strconv.Quote(value)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// Runs the `import` subcommand, returning the exit code
+func importCommand(args []string) int {
+	// Keep the output to the command's results
+	log.SetLevel(log.WarnLevel)
+
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Print(importCommandUsage) }
+	configPath := flags.String("config", "", "")
+	prefix := flags.String("prefix", "consul-alerts", "")
+	outPath := flags.String("out", "", "")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 0 {
+		fmt.Print(importCommandUsage)
+		return 1
+	}
+
+	config := DefaultConfig()
+	if *configPath != "" {
+		var err error
+		config, err = ParseConfigFile(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	client, err := newConsulClient(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	root := strings.TrimSuffix(*prefix, "/") + "/config/"
+	pairs, _, err := client.KV().List(root, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the consul-alerts config: %s\n", err)
+		return 1
+	}
+	if len(pairs) == 0 {
+		fmt.Fprintf(os.Stderr, "No consul-alerts config found under %s\n", root)
+		return 1
+	}
+
+	hcl, warnings := importConsulAlerts(pairs, *prefix)
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning: "+warning)
+	}
+
+	// Make sure what we generated is a config we'd accept
+	if _, err := ParseConfig(hcl); err != nil {
+		fmt.Fprintf(os.Stderr, "The imported config is invalid and needs editing: %s\n", err)
+	}
+
+	if *outPath == "" {
+		fmt.Print(hcl)
+		return 0
+	}
+	if err := ioutil.WriteFile(*outPath, []byte(hcl), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestImport_consulAlerts(t *testing.T) {
+	values := map[string]string{
+		"checks/change-threshold":            "45",
+		"checks/blacklist/checks/serfHealth": "",
+		"checks/blacklist/nodes/node1":       "",
+		"notifiers/email/enabled":            "true",
+		"notifiers/email/url":                "smtp.example.com",
+		"notifiers/email/port":               "587",
+		"notifiers/email/sender-email":       "alerts@example.com",
+		"notifiers/email/receivers":          `["ops@example.com", "dev@example.com"]`,
+		"notifiers/slack/enabled":            "true",
+		"notifiers/slack/url":                "https://hooks.slack.com/services/T/B/X",
+		"notifiers/slack/channel":            "#ops",
+		"notifiers/pagerduty/enabled":        "false",
+		"notifiers/pagerduty/service-key":    "key",
+		"notifiers/hipchat/enabled":          "true",
+		"notifiers/hipchat/room-id":          "ops",
+		"notifiers/custom":                   `["/usr/local/bin/notify"]`,
+		"notif-profiles/default":             `{"Interval": 10, "NotifList": {"email": true}}`,
+		"notif-profiles/payments":            `{"NotifList": {"slack": true, "custom": true, "pagerduty": true}}`,
+		"notif-selection/services/payments":  "payments",
+		"notif-selection/services/inventory": "missing",
+		"notif-selection/hosts/node2":        "payments",
+	}
+	pairs := make(api.KVPairs, 0, len(values))
+	for key, value := range values {
+		pairs = append(pairs, &api.KVPair{Key: "consul-alerts/config/" + key, Value: []byte(value)})
+	}
+
+	hcl, warnings := importConsulAlerts(pairs, "consul-alerts")
+	config, err := ParseConfig(hcl)
+	if err != nil {
+		t.Fatalf("error parsing imported config: %s\n%s", err, hcl)
+	}
+
+	if config.ChangeThreshold != 45 || config.ReminderInterval != 600 {
+		t.Errorf("unexpected thresholds: %d, %d", config.ChangeThreshold, config.ReminderInterval)
+	}
+	if !reflect.DeepEqual(config.DefaultHandlers, []string{"email.default"}) {
+		t.Errorf("unexpected default handlers: %v", config.DefaultHandlers)
+	}
+	if !reflect.DeepEqual(config.IgnoreChecks, []string{"serfHealth"}) {
+		t.Errorf("unexpected ignored checks: %v", config.IgnoreChecks)
+	}
+
+	email, ok := config.Handlers["email.default"].(EmailHandler)
+	if !ok {
+		t.Fatalf("expected an email handler, got %#v", config.Handlers["email.default"])
+	}
+	if email.Relay != "smtp.example.com:587" || email.From != "alerts@example.com" || !reflect.DeepEqual(email.Recipients, []string{"ops@example.com", "dev@example.com"}) {
+		t.Errorf("unexpected email handler: %+v", email)
+	}
+	if slack, ok := config.Handlers["slack.default"].(SlackHandler); !ok || slack.WebhookURL != "https://hooks.slack.com/services/T/B/X" {
+		t.Errorf("unexpected slack handler: %#v", config.Handlers["slack.default"])
+	}
+	if _, ok := config.Handlers["pagerduty.default"]; ok {
+		t.Error("expected the disabled pagerduty notifier to be skipped")
+	}
+
+	if service := config.Services["payments"]; !reflect.DeepEqual(service.Handlers, []string{"exec.custom", "slack.default"}) {
+		t.Errorf("unexpected handlers for payments: %v", service.Handlers)
+	}
+
+	for _, expected := range []string{
+		"hipchat notifier",
+		"unknown notification profile missing",
+		"payments uses the pagerduty notifier",
+		"Not imported: consul-alerts/config/notifiers/slack/channel",
+		"Not imported: consul-alerts/config/checks/blacklist/nodes/node1",
+		"Not imported: consul-alerts/config/notif-selection/hosts/node2",
+	} {
+		found := false
+		for _, warning := range warnings {
+			found = found || strings.Contains(warning, expected)
+		}
+		if !found {
+			t.Errorf("expected a warning containing %q, got %v", expected, warnings)
+		}
+	}
+	if strings.Contains(strings.Join(warnings, "\n"), "pagerduty/service-key") {
+		t.Errorf("expected the disabled notifier's keys to be skipped quietly, got %v", warnings)
+	}
+}
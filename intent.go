@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The key an alert's delivery intent is stored under, at the alert's path in the intent
+// section of the KV root
+const intentKey = "intent"
+
+// A write-ahead record of an alert being sent, stored before its handlers are called and
+// removed once every one of them has it, so that a page isn't lost if the process crashes
+// partway through sending it
+type deliveryIntent struct {
+	Status     string      `json:"status"`
+	Datacenter string      `json:"datacenter"`
+	Service    string      `json:"service"`
+	Handlers   []string    `json:"handlers"`
+	Alert      *AlertState `json:"alert"`
+	Created    int64       `json:"created"`
+}
+
+// Tracks the handlers an alert still has to be delivered to, keeping its intent record in the
+// KV store up to date as each delivery finishes
+type intentTracker struct {
+	lock    sync.Mutex
+	client  *api.Client
+	key     string
+	intent  deliveryIntent
+	written bool
+}
+
+// Returns the tracker for the intent to alert on the given status for the alert stored at
+// kvPath under the given KV root. Nothing is written until the handlers it's going to are known.
+func newIntentTracker(client *api.Client, root string, kvPath string, status string) *intentTracker {
+	return &intentTracker{
+		client: client,
+		key:    alertRecordPath(root, "intent", kvPath) + intentKey,
+		intent: deliveryIntent{Status: status},
+	}
+}
+
+// Stores the intent to deliver the alert to the given handlers, replacing the intent of any
+// earlier transition. If the KV store can't be reached the alert is sent anyway, without the
+// guarantee.
+func (t *intentTracker) write(datacenter string, service string, handlerIDs []string, alert *AlertState) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	copied := *alert
+	t.intent = deliveryIntent{
+		Status:     t.intent.Status,
+		Datacenter: datacenter,
+		Service:    service,
+		Handlers:   append([]string{}, handlerIDs...),
+		Alert:      &copied,
+		Created:    time.Now().Unix(),
+	}
+	if err := t.store(); err != nil {
+		log.Errorf("Error storing delivery intent for '%s': %s", alert.Message, err)
+		return
+	}
+	t.written = true
+}
+
+// Marks the alert as delivered to a handler (or handed to the delivery queue, skipped, or
+// failed for good), removing the intent once no handlers are left. Does nothing for alerts
+// without an intent.
+func (t *intentTracker) done(handlerID string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.written {
+		return
+	}
+
+	remaining := make([]string, 0, len(t.intent.Handlers))
+	for _, id := range t.intent.Handlers {
+		if id != handlerID {
+			remaining = append(remaining, id)
+		}
+	}
+	if len(remaining) == len(t.intent.Handlers) {
+		return
+	}
+	t.intent.Handlers = remaining
+
+	var err error
+	if len(remaining) == 0 {
+		_, err = t.client.KV().Delete(t.key, nil)
+		t.written = false
+	} else {
+		err = t.store()
+	}
+	if err != nil {
+		log.Errorf("Error updating delivery intent for '%s': %s", t.intent.Alert.Message, err)
+	}
+}
+
+// Writes the intent record. Assumes the tracker's lock is held.
+func (t *intentTracker) store() error {
+	value, err := json.Marshal(t.intent)
+	if err != nil {
+		return err
+	}
+	if _, err := t.client.KV().Put(&api.KVPair{Key: t.key, Value: value}, nil); err != nil {
+		return err
+	}
+	atomic.AddUint64(&stateWrites, 1)
+	return nil
+}
+
+// Re-sends the alerts whose delivery was interrupted, for the watch whose state is under
+// keyPath (and its node routes'), to the handlers they hadn't reached yet. Called when a watch
+// gains its lock, so the alerts a crashed leader was sending are finished by the next one.
+// Intents for a transition that's since been superseded by another status change are dropped.
+// Alerts can be sent twice to a handler whose delivery finished just before the crash.
+func replayIntents(keyPath string, opts *WatchOptions) {
+	root := opts.config.stateKVRoot()
+	intentPath := alertRecordPath(root, "intent", keyPath+"alert")
+	keys := []string{intentPath + intentKey}
+	if opts.node != "" {
+		routeKeys, _, err := opts.client.KV().Keys(intentPath+"route/", "", nil)
+		if err != nil {
+			log.Errorf("Error listing delivery intents under %s: %s", intentPath, err)
+		}
+		for _, key := range routeKeys {
+			if parts := strings.Split(strings.TrimPrefix(key, intentPath+"route/"), "/"); len(parts) == 2 && parts[1] == intentKey {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		pair, _, err := opts.client.KV().Get(key, nil)
+		if err != nil {
+			log.Errorf("Error loading delivery intent %s: %s", key, err)
+			continue
+		}
+		if pair == nil {
+			continue
+		}
+
+		var intent deliveryIntent
+		if err := json.Unmarshal(pair.Value, &intent); err != nil || intent.Alert == nil {
+			log.Errorf("Dropping unreadable delivery intent %s: %v", key, err)
+			opts.client.KV().Delete(key, nil)
+			continue
+		}
+		replayIntent(keyPath+strings.TrimSuffix(strings.TrimPrefix(key, intentPath), intentKey)+"alert", &intent, opts)
+	}
+}
+
+// Re-sends a single interrupted alert, marking its transition as alerted on first if the crash
+// happened before the alert state was updated
+func replayIntent(kvPath string, intent *deliveryIntent, opts *WatchOptions) {
+	tracker := newIntentTracker(opts.client, opts.config.stateKVRoot(), kvPath, intent.Status)
+	tracker.intent = *intent
+	tracker.written = true
+	sent := intent.Alert
+
+	opts.alertLock.Lock()
+	alert, err := getAlertState(kvPath, opts.client)
+	if err != nil {
+		log.Error("Error fetching alert state: ", err)
+		opts.alertLock.Unlock()
+		return
+	}
+	if alert == nil || alert.Status != intent.Status {
+		opts.alertLock.Unlock()
+		log.Infof("Dropping interrupted delivery of '%s', which was superseded", sent.Message)
+		if _, err := opts.client.KV().Delete(tracker.key, nil); err != nil {
+			log.Errorf("Error removing delivery intent for '%s': %s", sent.Message, err)
+		}
+		return
+	}
+	if alert.LastAlerted != intent.Status {
+		alert.LastAlerted = intent.Status
+		if err := setAlertState(kvPath, alert, opts.client); err != nil {
+			log.Error("Error setting alert state: ", err)
+		}
+	}
+	opts.alertLock.Unlock()
+
+	// Deliveries the crashed leader finished are skipped if they were tracked
+	log.Warnf("Resending interrupted alert '%s' to %v", sent.Message, intent.Handlers)
+	if opts.config.DeliveryTracking {
+		sent.delivery = newDeliveryTracker(opts.client, opts.config, kvPath, sent)
+	}
+	sent.intent = tracker
+	dispatchAlertTo(opts.config, intent.Datacenter, intent.Service, sent, intent.Handlers)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Store an intent left behind by a crash before the alert state was updated, and make sure the
+// next leader sends the alert to the handler it hadn't reached and clears the intent
+func TestIntent_replay(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config, alertCh := testAlertConfig()
+	config.DeliveryIntents = true
+	opts := &WatchOptions{
+		client:    client,
+		config:    config,
+		alertLock: &sync.Mutex{},
+	}
+
+	keyPath := "service/consul-alerting/service/redis/"
+	alertPath := keyPath + "alert"
+	state := &AlertState{Service: "redis", Status: api.HealthCritical, LastAlerted: api.HealthPassing}
+	if err := setAlertState(alertPath, state, client); err != nil {
+		t.Fatal(err)
+	}
+
+	notification := *state
+	notification.Message = "redis is now critical"
+	tracker := newIntentTracker(client, alertingKVRoot, alertPath, api.HealthCritical)
+	tracker.write("dc1", "redis", []string{"missing", "test"}, &notification)
+	tracker.done("missing")
+
+	if tracker.key != alertingKVRoot+"/intent/service/redis/"+intentKey {
+		t.Errorf("unexpected intent key %s", tracker.key)
+	}
+
+	replayIntents(keyPath, opts)
+
+	select {
+	case alert := <-alertCh:
+		if alert.Message != "redis is now critical" {
+			t.Errorf("unexpected alert: %#v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("didn't get the replayed alert")
+	}
+
+	if pair, _, err := client.KV().Get(tracker.key, nil); err != nil || pair != nil {
+		t.Errorf("expected the intent to be cleared, got %v (%v)", pair, err)
+	}
+	if alert, _ := getAlertState(alertPath, client); alert.LastAlerted != api.HealthCritical {
+		t.Errorf("expected the transition to be marked as alerted on, got %#v", alert)
+	}
+}
+
+// Make sure an intent for a status the alert has since moved on from is dropped unsent
+func TestIntent_superseded(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config, alertCh := testAlertConfig()
+	opts := &WatchOptions{
+		client:    client,
+		config:    config,
+		alertLock: &sync.Mutex{},
+	}
+
+	keyPath := "service/consul-alerting/service/redis/"
+	state := &AlertState{Service: "redis", Status: api.HealthPassing, LastAlerted: api.HealthPassing}
+	if err := setAlertState(keyPath+"alert", state, client); err != nil {
+		t.Fatal(err)
+	}
+	intent, _ := json.Marshal(deliveryIntent{
+		Status:   api.HealthCritical,
+		Handlers: []string{"test"},
+		Alert:    &AlertState{Service: "redis", Status: api.HealthCritical},
+	})
+	intentPath := alertingKVRoot + "/intent/service/redis/" + intentKey
+	if _, err := client.KV().Put(&api.KVPair{Key: intentPath, Value: intent}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	replayIntents(keyPath, opts)
+
+	select {
+	case alert := <-alertCh:
+		t.Errorf("expected no alert, got %#v", alert)
+	default:
+	}
+	if pair, _, err := client.KV().Get(intentPath, nil); err != nil || pair != nil {
+		t.Errorf("expected the intent to be dropped, got %v (%v)", pair, err)
+	}
+}
+
+// Make sure a handler that fails for good is cleared from the intent, so the alert isn't sent
+// to it again long after the fact
+func TestIntent_failedDelivery(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	down := true
+	config := &Config{Handlers: map[string]AlertHandler{
+		"failing.test": testFlakyHandler{down: &down, delivered: &[]AlertState{}},
+	}}
+	alertPath := "service/consul-alerting/service/redis/alert"
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "redis is now critical"}
+	alert.intent = newIntentTracker(client, alertingKVRoot, alertPath, api.HealthCritical)
+
+	dispatchAlertTo(config, "dc1", "redis", alert, []string{"failing.test"})
+
+	if pair, _, err := client.KV().Get(alert.intent.key, nil); err != nil || pair != nil {
+		t.Errorf("expected the intent to be cleared, got %v (%v)", pair, err)
+	}
+}
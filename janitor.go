@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+const janitorKVPath = alertingKVRoot + "/janitor/"
+
+// Periodically removes the leader keys in the KV store that no process holds anymore, such as
+// the ones left behind by crashed instances or by watches on services and nodes that were
+// removed from the catalog, and closes alerts for removed nodes and services that have been
+// critical for longer than stale_alert_age. Only one process cleans up at a time, using a lock
+// in the KV store.
+func runJanitor(config *Config, shutdownCh chan struct{}, client *api.Client) {
+	interval := time.Duration(config.JanitorInterval) * time.Second
+
+	apiLock, err := client.LockKey(janitorKVPath + "leader")
+	if err != nil {
+		fatalError(config, client, ExitLockFailure, fmt.Errorf("Error initializing lock for lock cleanup: %s", err))
+	}
+
+	lock := LockHelper{
+		target:   "lock cleanup",
+		client:   client,
+		lock:     apiLock,
+		stopCh:   make(chan struct{}, 1),
+		lockCh:   make(chan struct{}, 1),
+		callback: func() {},
+	}
+	go lock.start()
+
+	for {
+		select {
+		case <-shutdownCh:
+			log.Info("Shutting down lock cleanup")
+			lock.stop()
+			<-shutdownCh
+			return
+		case <-time.After(interval):
+		}
+
+		// Cleaning up isn't urgent, so leave Consul alone while it's under duress
+		if !lock.acquired || consulThrottle.throttled() {
+			continue
+		}
+
+		removed, err := removeOrphanedLocks(client)
+		if err != nil {
+			log.Errorf("Error cleaning up orphaned locks: %s", err)
+		} else if removed > 0 {
+			log.Infof("Removed %d orphaned locks", removed)
+		}
+
+		if config.StaleAlertAge > 0 {
+			closed, err := closeStaleAlerts(config, client, time.Now())
+			if err != nil {
+				log.Errorf("Error closing stale alerts: %s", err)
+			} else if closed > 0 {
+				log.Infof("Closed %d stale alerts", closed)
+			}
+		}
+	}
+}
+
+// Deletes the orphaned leader keys under the KV root, returning how many were removed
+func removeOrphanedLocks(client *api.Client) (int, error) {
+	queryOpts := &api.QueryOptions{AllowStale: true}
+
+	pairs, _, err := client.KV().List(alertingKVRoot+"/", queryOpts)
+	if err != nil {
+		return 0, err
+	}
+
+	sessionList, _, err := client.Session().List(queryOpts)
+	if err != nil {
+		return 0, err
+	}
+	sessions := make(map[string]bool)
+	for _, session := range sessionList {
+		sessions[session.ID] = true
+	}
+
+	removed := 0
+	for _, pair := range orphanedLocks(pairs, sessions) {
+		// Only delete the key if it hasn't changed since it was read, so a process that just
+		// acquired the lock keeps it
+		ok, _, err := client.KV().DeleteCAS(pair, nil)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			log.Infof("Removed orphaned lock for %s (%s)", lockTarget(pair.Key), pair.Key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Returns the leader keys that aren't held by a live session. Consul releases a lock when its
+// session is invalidated, so these are left over from processes that stopped watching (or
+// crashed) without another process taking over.
+func orphanedLocks(pairs api.KVPairs, sessions map[string]bool) []*api.KVPair {
+	orphaned := make([]*api.KVPair, 0)
+	for _, pair := range pairs {
+		if !strings.HasSuffix(pair.Key, "/leader") || pair.Flags != api.LockFlagValue {
+			continue
+		}
+		if pair.Session != "" && sessions[pair.Session] {
+			continue
+		}
+		orphaned = append(orphaned, pair)
+	}
+	return orphaned
+}
+
+// Returns a readable description of what a leader key's lock was for
+func lockTarget(key string) string {
+	parts := strings.Split(strings.TrimPrefix(key, alertingKVRoot+"/"), "/")
+	parts = parts[:len(parts)-1]
+	for i := range parts {
+		parts[i] = unescapeKVSegment(parts[i])
+	}
+
+	switch {
+	case len(parts) >= 2 && parts[0] == "service":
+		if len(parts) > 2 {
+			return fmt.Sprintf("service %s (tag: %s)", parts[1], strings.Join(parts[2:], "/"))
+		}
+		return "service " + parts[1]
+	case len(parts) == 2 && parts[0] == "node":
+		return "node " + parts[1]
+	default:
+		return strings.Join(parts, "/")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestJanitor_orphanedLocks(t *testing.T) {
+	pairs := api.KVPairs{
+		// Held by a live session
+		{Key: alertingKVRoot + "/service/redis/leader", Flags: api.LockFlagValue, Session: "live"},
+		// Released, or held by a session that's gone
+		{Key: alertingKVRoot + "/service/web/v2/leader", Flags: api.LockFlagValue},
+		{Key: alertingKVRoot + "/node/node1/leader", Flags: api.LockFlagValue, Session: "dead"},
+		// Not lock keys
+		{Key: alertingKVRoot + "/service/web/v2/alert"},
+		{Key: alertingKVRoot + "/service/leader/alert"},
+		{Key: alertingKVRoot + "/snooze/leader"},
+	}
+
+	var keys []string
+	for _, pair := range orphanedLocks(pairs, map[string]bool{"live": true}) {
+		keys = append(keys, pair.Key)
+	}
+
+	expected := []string{alertingKVRoot + "/service/web/v2/leader", alertingKVRoot + "/node/node1/leader"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected %v, got %v", expected, keys)
+	}
+}
+
+func TestJanitor_lockTarget(t *testing.T) {
+	cases := map[string]string{
+		alertingKVRoot + "/service/redis/leader":    "service redis",
+		alertingKVRoot + "/service/web/v2/leader":   "service web (tag: v2)",
+		alertingKVRoot + "/node/node1/leader":       "node node1",
+		alertingKVRoot + "/audit/leader":            "audit",
+		alertingKVRoot + "/influx/heartbeat/leader": "influx/heartbeat",
+	}
+	for key, expected := range cases {
+		if target := lockTarget(key); target != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, target)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Returns true if a byte can appear unescaped in a KV path segment
+func kvSafeByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == ':' || c == '@' || c == '~'
+}
+
+// Escapes a node, service, tag or check name for use as a single segment of a KV path, so
+// that names with slashes, spaces or unicode can't change the layout under the KV root or
+// collide with another entity's keys. Names made up of letters, digits and -_.:@~ are left
+// as they are, so the usual names keep the paths they've always had; any other byte is
+// percent-encoded, as are the dots in a name made up only of dots. Names aren't normalized,
+// since Consul treats names that only differ in their unicode normalization as different.
+func escapeKVSegment(name string) string {
+	dots := strings.Trim(name, ".") == ""
+	escaped := !dots
+	for i := 0; i < len(name) && escaped; i++ {
+		escaped = kvSafeByte(name[i])
+	}
+	if escaped {
+		return name
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; kvSafeByte(c) && c != '.' || c == '.' && !dots {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// Reverses escapeKVSegment, returning segments that aren't validly escaped as they are
+func unescapeKVSegment(segment string) string {
+	name, err := url.PathUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	return name
+}
+
+// Returns the KV path a node watch keeps its state under, ending in a slash
+func nodeKVPath(root string, node string) string {
+	return root + "/node/" + escapeKVSegment(node) + "/"
+}
+
+// Returns the KV path a service watch keeps its state under, ending in a slash
+func serviceKVPath(root string, service string, tag string) string {
+	path := root + "/service/" + escapeKVSegment(service) + "/"
+	if tag != "" {
+		path = path + escapeKVSegment(tag) + "/"
+	}
+	return path
+}
+
+// Returns the KV path of a node route's alert under a node watch's path
+func routeAlertPath(keyPath string, route string) string {
+	return keyPath + "route/" + escapeKVSegment(route) + "/alert"
+}
+
+// Returns the KV path that the records of a section of the KV root (such as alert deliveries)
+// are kept under for the alert stored at alertPath, ending in a slash. These are kept outside
+// the watch's path, so they aren't read back as its check states.
+func alertRecordPath(root string, section string, alertPath string) string {
+	return root + "/" + section + "/" + strings.TrimSuffix(strings.TrimPrefix(alertPath, root+"/"), "alert")
+}
+
+// Returns the node/checkID key a watch tracks a check by from the check state's KV path,
+// which ends in the check's node and ID
+func checkKeyFromKVPath(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return unescapeKVSegment(path)
+	}
+	return unescapeKVSegment(parts[len(parts)-2]) + "/" + unescapeKVSegment(parts[len(parts)-1])
+}
+
+// Moves a watch's state from the unescaped path older versions kept it under to its escaped
+// path, the first time the watch runs with a name that needs escaping. An unescaped path can be
+// shared with another entity (service "a/b" and the tag "b" of service "a" used the same one),
+// so alerts are only moved if they're for this watch, and check states are copied but left in
+// place.
+func migrateLegacyState(legacyPath string, keyPath string, mode string, owns func(*AlertState) bool, client *api.Client) error {
+	if legacyPath == keyPath {
+		return nil
+	}
+
+	existing, _, err := client.KV().Keys(keyPath, "", nil)
+	if err != nil {
+		return fmt.Errorf("Error checking for migrated state: %s", err)
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	pairs, _, err := client.KV().List(legacyPath, nil)
+	if err != nil {
+		return fmt.Errorf("Error listing legacy state: %s", err)
+	}
+
+	migrated := 0
+	for _, pair := range pairs {
+		relative := strings.TrimPrefix(pair.Key, legacyPath)
+		parts := strings.Split(relative, "/")
+
+		var key string
+		move := false
+		switch {
+		case relative == "leader" || contains(parts, "delivery"):
+			continue
+		case relative == "alert" || len(parts) == 3 && parts[0] == "route" && parts[2] == "alert":
+			var alert AlertState
+			if err := json.Unmarshal(pair.Value, &alert); err != nil || !owns(&alert) {
+				continue
+			}
+			key = keyPath + "alert"
+			if alert.Route != "" {
+				key = routeAlertPath(keyPath, alert.Route)
+			}
+			move = true
+		case !isLegacyCheckState(parts, mode):
+			// The watch's index and intent, and the states of the tags nested under an
+			// untagged service's path, aren't this watch's check states
+			continue
+		default:
+			// Check states were always read back as the last two segments of their path
+			check := strings.Split(pair.Key, "/")
+			node, checkID := check[len(check)-2], check[len(check)-1]
+			if mode == NodeWatch {
+				key = keyPath + escapeKVSegment(checkID)
+			} else {
+				key = keyPath + escapeKVSegment(node) + "/" + escapeKVSegment(checkID)
+			}
+		}
+
+		if _, err := client.KV().Put(&api.KVPair{Key: key, Value: pair.Value}, nil); err != nil {
+			return fmt.Errorf("Error migrating state from %s: %s", pair.Key, err)
+		}
+		if move {
+			if _, err := client.KV().Delete(pair.Key, nil); err != nil {
+				return fmt.Errorf("Error removing migrated state at %s: %s", pair.Key, err)
+			}
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		log.Infof("Migrated %d states from %s to %s", migrated, legacyPath, keyPath)
+	}
+	return nil
+}
+
+// Returns true if the path of a key under a watch's legacy path, split into its segments, is
+// one of the watch's check states: checkID for a node watch, or node/checkID for a service watch
+func isLegacyCheckState(parts []string, mode string) bool {
+	if mode == NodeWatch && len(parts) != 1 || mode != NodeWatch && len(parts) != 2 {
+		return false
+	}
+	switch parts[len(parts)-1] {
+	case "alert", "leader", watchIndexKey, intentKey:
+		return false
+	}
+	return true
+}
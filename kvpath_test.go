@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestKVPath_escape(t *testing.T) {
+	cases := map[string]string{
+		"redis":           "redis",
+		"web-1.dc1":       "web-1.dc1",
+		"service:redis:1": "service:redis:1",
+		"a/b":             "a%2Fb",
+		"my service":      "my%20service",
+		"café":            "caf%C3%A9",
+		"100%":            "100%25",
+		"..":              "%2E%2E",
+		".hidden":         ".hidden",
+		"q?x#y":           "q%3Fx%23y",
+		"":                "",
+	}
+	for name, expected := range cases {
+		escaped := escapeKVSegment(name)
+		if escaped != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, escaped)
+		}
+		if unescaped := unescapeKVSegment(escaped); unescaped != name {
+			t.Errorf("%q: didn't round trip, got %q", name, unescaped)
+		}
+	}
+
+	// Service "a/b" and the tag "b" of service "a" no longer share a path
+	if serviceKVPath("root", "a/b", "") == serviceKVPath("root", "a", "b") {
+		t.Errorf("expected distinct paths, got %s", serviceKVPath("root", "a", "b"))
+	}
+	if path := nodeKVPath("root", "node 1"); path != "root/node/node%201/" {
+		t.Errorf("unexpected node path %s", path)
+	}
+	if key := checkKeyFromKVPath("root/service/web/node%201/service:web%2F1"); key != "node 1/service:web/1" {
+		t.Errorf("unexpected check key %s", key)
+	}
+}
+
+func TestKVPath_migrateLegacyState(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	put := func(key string, value interface{}) {
+		serialized, _ := json.Marshal(value)
+		if _, err := client.KV().Put(&api.KVPair{Key: key, Value: serialized}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Service "a/b" was stored where the tag "b" of service "a" would be
+	legacy := alertingKVRoot + "/service/a/b/"
+	put(legacy+"alert", AlertState{Service: "a/b", Status: api.HealthCritical})
+	put(legacy+"node1/check1", CheckState{Status: api.HealthCritical})
+	put(legacy+watchIndexKey, 10)
+	put(legacy+intentKey, deliveryIntent{Status: api.HealthCritical})
+	put(legacy+"tag1/alert", AlertState{Service: "a/b", Tag: "tag1", Status: api.HealthWarning})
+	put(legacy+"tag1/node1/check1", CheckState{Status: api.HealthWarning})
+
+	owns := func(alert *AlertState) bool { return alert.Service == "a/b" && alert.Tag == "" }
+	keyPath := serviceKVPath(alertingKVRoot, "a/b", "")
+	if err := migrateLegacyState(legacy, keyPath, ServiceWatch, owns, client); err != nil {
+		t.Fatal(err)
+	}
+
+	alert, err := getAlertState(keyPath+"alert", client)
+	if err != nil || alert == nil || alert.Status != api.HealthCritical {
+		t.Fatalf("expected the alert to be migrated, got %v (%v)", alert, err)
+	}
+	if pair, _, _ := client.KV().Get(legacy+"alert", nil); pair != nil {
+		t.Errorf("expected the legacy alert to be removed")
+	}
+	states, err := getCheckStates(keyPath, client)
+	if err != nil || states["node1/check1"] == nil || states["node1/check1"].Status != api.HealthCritical {
+		t.Errorf("expected the check state to be migrated, got %v (%v)", states, err)
+	}
+	if keys, _, _ := client.KV().Keys(keyPath, "", nil); len(keys) != 2 {
+		t.Errorf("expected only the alert and check state to be migrated, got %v", keys)
+	}
+
+	// Alerts for other entities at the legacy path are left alone
+	put(legacy+"alert", AlertState{Service: "a", Tag: "b", Status: api.HealthWarning})
+	other := serviceKVPath(alertingKVRoot, "a/b", "x")
+	if err := migrateLegacyState(legacy, other, ServiceWatch, owns, client); err != nil {
+		t.Fatal(err)
+	}
+	if pair, _, _ := client.KV().Get(legacy+"alert", nil); pair == nil {
+		t.Errorf("expected the other entity's alert to be left in place")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The environment variable to read the node name from when node_name isn't set, such as one
+// set from the pod's spec.nodeName in Kubernetes
+const nodeNameEnv = "CONSUL_ALERTING_NODE_NAME"
+
+// Paths of the liveness and readiness probes on the status API
+const (
+	livenessPath  = "/v1/health/live"
+	readinessPath = "/v1/health/ready"
+)
+
+// Whether the process has started its watches, and whether it's shutting down, for the
+// readiness probe
+var lifecycle struct {
+	started      int32
+	shuttingDown int32
+}
+
+// Returns the node to watch in local mode and create sessions as: node_name or the
+// environment if either is set, otherwise the Consul agent's own node name. Nothing is
+// asked of the agent when the name is configured, so Consul servers can be used directly.
+// In agentless mode there's no agent to ask, so the name has to be configured.
+func localNodeName(config *Config, client *api.Client) string {
+	if config.NodeName != "" {
+		return config.NodeName
+	}
+	if name := os.Getenv(nodeNameEnv); name != "" {
+		return name
+	}
+	if config.Agentless {
+		fatalError(config, client, ExitConfig, fmt.Errorf("agentless requires node_name or the %s environment variable", nodeNameEnv))
+	}
+
+	var nodeName string
+	retryStartup(config, client, "connecting to Consul agent", func() error {
+		var err error
+		nodeName, err = client.Agent().NodeName()
+		return err
+	})
+	return nodeName
+}
+
+// Retries a request to Consul made during startup until it succeeds. If Consul is still
+// unreachable after startup_timeout, this exits with ExitConsulUnreachable.
+func retryStartup(config *Config, client *api.Client, action string, request func() error) {
+	start := time.Now()
+	for {
+		err := request()
+		if err == nil {
+			return
+		}
+
+		timeout := time.Duration(config.StartupTimeout) * time.Second
+		if timeout > 0 && time.Since(start) >= timeout {
+			fatalError(config, client, ExitConsulUnreachable, fmt.Errorf("Error %s, giving up after %s: %s", action, timeout, err))
+		}
+
+		log.Errorf("Error %s: %s", action, err)
+		log.Error("Retrying in 10s...")
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// GET /v1/health/live reports that the process is running
+func (s *StatusServer) liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// GET /v1/health/ready reports whether the process has started its watches and can reach
+// Consul. It fails as soon as shutdown begins, so no more traffic is sent while locks are
+// being handed off.
+func (s *StatusServer) readiness(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	if atomic.LoadInt32(&lifecycle.shuttingDown) == 1 {
+		status = "shutting down"
+	} else if atomic.LoadInt32(&lifecycle.started) == 0 {
+		status = "starting"
+	} else if _, err := s.client.Status().Leader(); err != nil {
+		status = "consul unreachable: " + err.Error()
+	}
+
+	if status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, map[string]string{"status": status})
+}
+
+// Runs a step of the shutdown, returning false if it didn't finish by the deadline. A zero
+// deadline waits for as long as the step takes.
+func finishBy(deadline time.Time, step func()) bool {
+	done := make(chan struct{})
+	go func() {
+		step()
+		close(done)
+	}()
+
+	if deadline.IsZero() {
+		<-done
+		return true
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// What each running watch is doing, by name, so the ones still running when the shutdown
+// timeout passes can be logged
+var runningWatches = struct {
+	lock   sync.Mutex
+	states map[string]string
+}{states: make(map[string]string)}
+
+// Updates the state of a watch from one of its lifecycle events
+func trackWatch(name string, event string) {
+	runningWatches.lock.Lock()
+	defer runningWatches.lock.Unlock()
+
+	switch event {
+	case WatchCreated:
+		runningWatches.states[name] = "started"
+	case WatchLockAcquired:
+		runningWatches.states[name] = "holding its lock"
+	case WatchLockLost:
+		runningWatches.states[name] = "not holding its lock"
+	case WatchRemoved:
+		delete(runningWatches.states, name)
+	}
+}
+
+// Returns the state of each running watch
+func watchStates() map[string]string {
+	runningWatches.lock.Lock()
+	defer runningWatches.lock.Unlock()
+
+	states := make(map[string]string, len(runningWatches.states))
+	for name, state := range runningWatches.states {
+		states[name] = state
+	}
+	return states
+}
+
+// Logs the watches that are still running when shutdown gives up on a step, and exits with
+// ExitShutdownTimeout. Locks that weren't released expire with their sessions' TTL.
+func abandonShutdown(config *Config, step string) {
+	log.Errorf("Timed out %s after %ds, exiting with watches still running", step, config.ShutdownTimeout)
+
+	states := watchStates()
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Warnf("Abandoning %s (%s)", name, states[name])
+	}
+	if len(names) > 0 {
+		log.Warn("Locks that weren't released will expire with their sessions")
+	}
+	if config.dispatchQueue != nil {
+		if size := config.dispatchQueue.size(); size > 0 {
+			log.Warnf("Dropping %d queued notifications", size)
+		}
+	}
+
+	os.Exit(ExitShutdownTimeout)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLifecycle_localNodeName(t *testing.T) {
+	defer os.Unsetenv(nodeNameEnv)
+
+	// The environment is used when node_name isn't set, without asking the agent
+	os.Setenv(nodeNameEnv, "k8s-node-1")
+	if name := localNodeName(&Config{}, nil); name != "k8s-node-1" {
+		t.Errorf("expected node name from the environment, got %q", name)
+	}
+
+	if name := localNodeName(&Config{NodeName: "configured"}, nil); name != "configured" {
+		t.Errorf("expected configured node name, got %q", name)
+	}
+}
+
+func TestLifecycle_probes(t *testing.T) {
+	defer func() {
+		atomic.StoreInt32(&lifecycle.started, 0)
+		atomic.StoreInt32(&lifecycle.shuttingDown, 0)
+	}()
+
+	// The probes shouldn't need the status API's credentials
+	config := DefaultConfig()
+	config.StatusToken = "secret"
+	handler := (&StatusServer{config: config}).handler()
+
+	probe := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if code := probe(livenessPath); code != http.StatusOK {
+		t.Errorf("expected live, got %d", code)
+	}
+	if code := probe(readinessPath); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready before starting, got %d", code)
+	}
+
+	atomic.StoreInt32(&lifecycle.started, 1)
+	atomic.StoreInt32(&lifecycle.shuttingDown, 1)
+	if code := probe(readinessPath); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready while shutting down, got %d", code)
+	}
+	if code := probe(livenessPath); code != http.StatusOK {
+		t.Errorf("expected live while shutting down, got %d", code)
+	}
+
+	if code := probe("/v1/alerts"); code != http.StatusUnauthorized {
+		t.Errorf("expected other endpoints to stay authenticated, got %d", code)
+	}
+}
+
+func TestLifecycle_finishBy(t *testing.T) {
+	if !finishBy(time.Time{}, func() { time.Sleep(10 * time.Millisecond) }) {
+		t.Error("expected a step without a deadline to finish")
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	if finishBy(time.Now().Add(50*time.Millisecond), func() { <-block }) {
+		t.Error("expected the step to time out")
+	}
+}
+
+func TestLifecycle_trackWatch(t *testing.T) {
+	config := DefaultConfig()
+	target := watchHookTarget("service redis", &WatchOptions{service: "redis", config: config})
+
+	fireWatchHooks(config, WatchCreated, target)
+	fireWatchHooks(config, WatchLockAcquired, target)
+	if state := watchStates()["service redis"]; state != "holding its lock" {
+		t.Errorf("expected the watch to be holding its lock, got %q", state)
+	}
+
+	fireWatchHooks(config, WatchLockLost, target)
+	if state := watchStates()["service redis"]; state != "not holding its lock" {
+		t.Errorf("expected the watch to have lost its lock, got %q", state)
+	}
+
+	fireWatchHooks(config, WatchRemoved, target)
+	if _, ok := watchStates()["service redis"]; ok {
+		t.Error("expected the removed watch to no longer be tracked")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Checks the config for settings that are valid but have no effect, such as handlers
+// that no service would ever alert through. Returns a warning for each one found.
+func lintConfig(config *Config) []string {
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+
+	warnings := make([]string, 0)
+
+	// With service_meta_config, services can pick any handler at runtime
+	if !config.ServiceMetaConfig {
+		referenced := make(map[string]bool)
+		for _, id := range config.DefaultHandlers {
+			referenced[id] = true
+		}
+
+		// Without default_handlers, every handler except the teams' is a default
+		if len(config.DefaultHandlers) == 0 {
+			teamHandlers := make(map[string]bool)
+			for _, team := range config.Teams {
+				for _, id := range team.handlerIDs {
+					teamHandlers[id] = true
+				}
+			}
+			for id, _ := range config.Handlers {
+				if !teamHandlers[id] {
+					referenced[id] = true
+				}
+			}
+		}
+		for _, id := range config.expandHandlerGroups([]string{config.FatalHandler}) {
+			referenced[id] = true
+		}
+		for _, service := range config.Services {
+			for _, id := range service.Handlers {
+				referenced[id] = true
+			}
+			if team, ok := config.Teams[service.Team]; ok {
+				for _, id := range team.handlerIDs {
+					referenced[id] = true
+				}
+			}
+		}
+		for _, tier := range config.Tiers {
+			for _, id := range tier.Handlers {
+				referenced[id] = true
+			}
+		}
+		for _, route := range config.NodeRoutes {
+			for _, id := range route.Handlers {
+				referenced[id] = true
+			}
+			if team, ok := config.Teams[route.Team]; ok {
+				for _, id := range team.handlerIDs {
+					referenced[id] = true
+				}
+			}
+		}
+		for _, watch := range config.HTTPWatches {
+			for _, id := range watch.Handlers {
+				referenced[id] = true
+			}
+			if team, ok := config.Teams[watch.Team]; ok {
+				for _, id := range team.handlerIDs {
+					referenced[id] = true
+				}
+			}
+		}
+		for _, composite := range config.Composites {
+			for _, id := range composite.Handlers {
+				referenced[id] = true
+			}
+			if team, ok := config.Teams[composite.Team]; ok {
+				for _, id := range team.handlerIDs {
+					referenced[id] = true
+				}
+			}
+		}
+
+		for id, _ := range config.Handlers {
+			if !referenced[id] {
+				warnings = append(warnings, fmt.Sprintf("Handler %s is not used by default_handlers, fatal_handler, any service or any node route", id))
+			}
+		}
+	}
+
+	warnings = append(warnings, config.routingLocked().conflicts...)
+
+	for name, service := range config.Services {
+		if len(service.IgnoredTags) > 0 && !service.DistinctTags {
+			warnings = append(warnings, fmt.Sprintf("Service %s has ignored_tags set without distinct_tags, so they have no effect", name))
+		}
+	}
+
+	sort.Strings(warnings)
+	return warnings
+}
+
+// Checks the config's service blocks against the services registered in the catalog,
+// returning a warning for each service block that doesn't match a registered service
+func lintCatalog(config *Config, services map[string][]string) []string {
+	if config.NomadCompat {
+		services, _ = groupNomadServices(services)
+	}
+
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+
+	warnings := make([]string, 0)
+	for name, _ := range config.Services {
+		if _, ok := services[name]; ok {
+			continue
+		}
+		if !isServicePattern(name) {
+			warnings = append(warnings, fmt.Sprintf("Service %s has a service block but isn't registered in the catalog", name))
+		}
+	}
+
+	for _, pattern := range config.servicePatterns {
+		matched := false
+		for service, _ := range services {
+			if pattern.matches(service) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			warnings = append(warnings, fmt.Sprintf("Service pattern %s doesn't match any service in the catalog", pattern.name))
+		}
+	}
+
+	sort.Strings(warnings)
+	return warnings
+}
+
+// Lints the config at startup, including a check of the service blocks against the current
+// catalog. The warnings are logged, and are fatal if strict is set.
+func lintStartupConfig(config *Config, client *api.Client, strict bool) error {
+	warnings := lintConfig(config)
+
+	services, _, err := client.Catalog().Services(&api.QueryOptions{AllowStale: true})
+	if err != nil {
+		log.Warnf("Error fetching services from catalog, skipping check of service blocks: %s", err)
+	} else {
+		warnings = append(warnings, lintCatalog(config, services)...)
+	}
+
+	for _, warning := range warnings {
+		if strict {
+			log.Error(warning)
+		} else {
+			log.Warn(warning)
+		}
+	}
+
+	if strict && len(warnings) > 0 {
+		return fmt.Errorf("Found %d problems in config with -strict set", len(warnings))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLint_config(t *testing.T) {
+	config, err := ParseConfig(`
+	default_handlers = ["stdout.default"]
+	fatal_handler = "stdout.fatal"
+
+	service "redis" {
+		ignored_tags = ["seed"]
+	}
+
+	service "webapp" {
+		distinct_tags = true
+		ignored_tags = ["canary"]
+		handlers = ["stdout.webapp"]
+	}
+
+	service "db" {
+		team = "dba"
+	}
+
+	team "dba" {
+		email = ["dba@example.com"]
+	}
+
+	team "frontend" {
+		email = ["frontend@example.com"]
+	}
+
+	handler "stdout" "default" {}
+	handler "stdout" "fatal" {}
+	handler "stdout" "webapp" {}
+	handler "stdout" "unused" {}
+	handler "email" "admin" {
+		recipients = ["admin@example.com"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"Handler email.admin is not used by default_handlers, fatal_handler, any service or any node route",
+		"Handler email.team_frontend is not used by default_handlers, fatal_handler, any service or any node route",
+		"Handler stdout.unused is not used by default_handlers, fatal_handler, any service or any node route",
+		"Service redis has ignored_tags set without distinct_tags, so they have no effect",
+	}
+	if warnings := lintConfig(config); !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("expected warnings:\n%v\ngot:\n%v", expected, warnings)
+	}
+
+	expected = []string{"Service webapp has a service block but isn't registered in the catalog"}
+	if warnings := lintCatalog(config, map[string][]string{"redis": nil, "db": nil, "consul": nil}); !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("expected warnings %v, got %v", expected, warnings)
+	}
+}
@@ -29,6 +29,9 @@ type LockHelper struct {
 	// A function to be run after acquiring the lock
 	callback func()
 
+	// Optional. A function to be run after losing (or releasing) the lock
+	lostCallback func()
+
 	// Indicates whether we currently hold the lock
 	acquired bool
 }
@@ -58,6 +61,9 @@ func (l *LockHelper) start() {
 				log.Infof("Lost lock for %s", l.target)
 				l.lock.Unlock()
 				l.lock.Destroy()
+				if l.lostCallback != nil {
+					l.lostCallback()
+				}
 			} else {
 				if err != nil {
 					log.Warnf("Error getting lock for %s: %s", l.target, err)
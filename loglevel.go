@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Changes the log level at runtime. The configured log_level is left alone, so reloading
+// the config file resets the level to it (unless log_level_key is set).
+func setLogLevel(level string) error {
+	parsed, err := log.ParseLevel(strings.TrimSpace(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level '%s'", level)
+	}
+
+	if parsed != log.GetLevel() {
+		log.SetLevel(parsed)
+		log.Infof("Changed log level to %s", parsed)
+	}
+
+	return nil
+}
+
+// Watches the log_level_key in the KV store, changing the log level whenever it's updated.
+// When the key is removed, the configured log_level is restored.
+func watchLogLevelKey(config *Config, client *api.Client) {
+	queryOpts := &api.QueryOptions{
+		AllowStale: true,
+		WaitTime:   watchWaitTime,
+	}
+
+	log.Infof("Watching %s for log level changes", config.LogLevelKey)
+
+	for {
+		kvPair, queryMeta, err := client.KV().Get(config.LogLevelKey, queryOpts)
+		if err != nil {
+			log.Errorf("Error watching log level key: %s, retrying in 10s...", err)
+			time.Sleep(errorWaitTime)
+			continue
+		}
+
+		// Skip the update if the blocking query just timed out
+		if queryMeta.LastIndex == queryOpts.WaitIndex {
+			continue
+		}
+		queryOpts.WaitIndex = queryMeta.LastIndex
+
+		level := ""
+		if kvPair != nil {
+			level = string(kvPair.Value)
+		}
+		if strings.TrimSpace(level) == "" {
+			config.lock.RLock()
+			level = config.LogLevel
+			config.lock.RUnlock()
+		}
+
+		if err := setLogLevel(level); err != nil {
+			log.Errorf("Error setting log level from %s: %s", config.LogLevelKey, err)
+		}
+	}
+}
+
+// Returns the level to set after reloading the config. With log_level_key set, the key's
+// level is kept, and the reloaded log_level only applies while the key is unset.
+func reloadedLogLevel(config *Config, client *api.Client, level log.Level) log.Level {
+	if config.LogLevelKey == "" || client == nil {
+		return level
+	}
+
+	kvPair, _, err := client.KV().Get(config.LogLevelKey, &api.QueryOptions{AllowStale: true})
+	if err != nil {
+		log.Errorf("Error reading log level key %s, keeping the current level: %s", config.LogLevelKey, err)
+		return log.GetLevel()
+	}
+	if kvPair == nil || strings.TrimSpace(string(kvPair.Value)) == "" {
+		return level
+	}
+
+	parsed, err := log.ParseLevel(strings.TrimSpace(string(kvPair.Value)))
+	if err != nil {
+		log.Errorf("Error setting log level from %s: invalid log level '%s'", config.LogLevelKey, kvPair.Value)
+		return level
+	}
+	return parsed
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,10 +17,15 @@ import (
 )
 
 const usage = `Usage: consul-alerting [--help] [options]
+       consul-alerting watch <pause|resume|list> [options] [watch]
+       consul-alerting import [options]
 
 Options:
 
     -config=<path>    Sets the path to a configuration file on disk.
+
+    -strict           Exit with an error instead of logging warnings for config
+                      blocks that have no effect, such as unused handlers.
 `
 
 func init() {
@@ -32,11 +38,21 @@ func init() {
 }
 
 func main() {
+	// Run a subcommand if one was given
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		os.Exit(watchCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importCommand(os.Args[2:]))
+	}
+
 	// Parse command line options
 	var config_path string
 	var help bool
+	var strict bool
 	flag.StringVar(&config_path, "config", "", "")
 	flag.BoolVar(&help, "help", false, "")
+	flag.BoolVar(&strict, "strict", false, "")
 	flag.Parse()
 
 	if help {
@@ -51,8 +67,8 @@ func main() {
 		var err error
 		config, err = ParseConfigFile(config_path)
 		if err != nil {
-			log.Fatal(err)
-			os.Exit(2)
+			log.Error(err)
+			os.Exit(ExitConfig)
 		}
 	} else {
 		config = DefaultConfig()
@@ -62,64 +78,168 @@ func main() {
 	level, err := log.ParseLevel(config.LogLevel)
 	if err != nil {
 		log.Errorf("Error setting loglevel '%s': %s", level, err)
-		os.Exit(2)
+		os.Exit(ExitConfig)
 	}
 	log.SetLevel(level)
 
 	// Initialize Consul client
-	clientConfig := api.DefaultConfig()
-	clientConfig.Address = config.ConsulAddress
-	addressSplit := strings.Split(config.ConsulAddress, "://")
-	if len(addressSplit) > 1 {
-		clientConfig.Address = addressSplit[1]
-		clientConfig.Scheme = addressSplit[0]
+	if config.Agentless {
+		log.Infof("Using Consul servers at %s (agentless)", config.ConsulAddress)
+	} else {
+		log.Infof("Using Consul agent at %s", config.ConsulAddress)
 	}
-	clientConfig.Token = config.ConsulToken
-
-	log.Infof("Using Consul agent at %s", clientConfig.Address)
-	client, err := api.NewClient(clientConfig)
+	client, err := newConsulClient(config)
 	if err != nil {
-		log.Fatal("Error initializing client: ", err)
-	}
-	var nodeName string
-	for {
-		nodeName, err = client.Agent().NodeName()
-		if err == nil {
-			break
-		}
-		log.Error("Error connecting to Consul agent: ", err)
-		log.Error("Retrying in 10s...")
-		time.Sleep(10 * time.Second)
+		log.Error(err)
+		os.Exit(ExitConfig)
 	}
+	nodeName := localNodeName(config, client)
 
-	// Get datacenter info if it wasn't specified in the config
+	// Get datacenter info if it wasn't specified in the config (it always is in agentless mode)
 	if config.ConsulDatacenter == "" {
-		agentInfo, err := client.Agent().Self()
-
-		for err != nil {
+		var agentInfo map[string]map[string]interface{}
+		retryStartup(config, client, "fetching datacenter from Consul", func() error {
+			var err error
 			agentInfo, err = client.Agent().Self()
-			log.Error("Error fetching datacenter from Consul: ", err)
-			log.Error("Retrying in 10s...")
-			time.Sleep(10 * time.Second)
-		}
+			return err
+		})
 
 		config.ConsulDatacenter = agentInfo["Config"]["Datacenter"].(string)
 	}
 	log.Info("Using datacenter: ", config.ConsulDatacenter)
 
+	// Look for config blocks that would silently have no effect
+	if err := lintStartupConfig(config, client, strict); err != nil {
+		log.Error(err)
+		os.Exit(ExitConfig)
+	}
+
+	// Make sure the token can do everything we need before starting any watches
+	if err := checkStartupACLs(client, nodeName); err != nil {
+		log.Error(err)
+		os.Exit(ExitConfig)
+	}
+
 	if config.DevMode {
 		registerTestServices(client)
 	}
 
+	// Open the local queue for undelivered alerts, if configured
+	if config.QueuePath != "" {
+		queue, err := openDeliveryQueue(config.QueuePath)
+		if err != nil {
+			fatalError(config, client, ExitFatal, err)
+		}
+		config.deliveryQueue = queue
+		log.Infof("Using delivery queue at %s (%d queued alerts)", config.QueuePath, queue.size())
+		go queue.run(config, make(chan struct{}))
+	}
+
+	// Send alerts through a priority queue, so the most important ones go first under load
+	if config.DispatchWorkers > 0 {
+		config.dispatchQueue = newDispatchQueue()
+		config.dispatchQueue.run(config, config.DispatchWorkers)
+		log.Infof("Dispatching alerts with %d workers", config.DispatchWorkers)
+	}
+
+	if config.EventLogPath != "" {
+		eventLog, err := openEventLog(config.EventLogPath)
+		if err != nil {
+			fatalError(config, client, ExitFatal, err)
+		}
+		config.eventLog = eventLog
+		log.Infof("Writing alert events to %s", config.EventLogPath)
+	}
+
+	// Shadow deployments keep their state under their own prefix, starting from a copy of the
+	// active deployment's
+	if config.ShadowMode {
+		atomic.StoreInt32(&shadowing, 1)
+		var started time.Time
+		retryStartup(config, client, "preparing shadow state", func() error {
+			var err error
+			started, err = startShadow(config.ShadowKVPrefix, client)
+			return err
+		})
+		log.Infof("Running in shadow mode under %s since %s, alerts will be recorded but not sent", config.ShadowKVPrefix, started.Format(time.RFC3339))
+	}
+
+	if config.HistorySize > 0 {
+		config.history = &AlertHistory{client: client, size: config.HistorySize, prefix: config.historyKVPrefix()}
+	}
+
+	if config.SelfThrottle {
+		go monitorConsulDuress(config, client)
+	}
+
+	if config.LogLevelKey != "" {
+		go watchLogLevelKey(config, client)
+	}
+
+	go watchPausedWatches(config, client)
+
+	if config.DeploymentPrefix != "" {
+		go watchDeployments(config, client)
+	}
+
+	if config.StatusAddress != "" {
+		go newStatusServer(config, client).start()
+	}
+
+	if config.AggregatorAddress != "" {
+		go newAggregator(config, client).start()
+	}
+
 	// Use a shared stop channel between node/service discovery for faster shutdown
 	shutdownCh := make(chan struct{}, 0)
 
+	// The number of goroutines listening on shutdownCh
+	shutdownListeners := 2
+
 	go discoverServices(nodeName, config, shutdownCh, client)
 
+	if config.CatalogAuditInterval > 0 {
+		log.Infof("Auditing catalog for registration anomalies every %ds", config.CatalogAuditInterval)
+		shutdownListeners++
+		go auditCatalog(config, shutdownCh, client)
+	}
+
+	if config.JanitorInterval > 0 && !config.ShadowMode {
+		log.Infof("Cleaning up orphaned locks every %ds", config.JanitorInterval)
+		if config.StaleAlertAge > 0 {
+			log.Infof("Closing alerts for removed nodes and services after %ds critical", config.StaleAlertAge)
+		}
+		shutdownListeners++
+		go runJanitor(config, shutdownCh, client)
+	}
+
+	if config.influxHeartbeats() && !config.ShadowMode {
+		shutdownListeners++
+		go writeInfluxHeartbeats(config, shutdownCh, client)
+	}
+
+	if config.history != nil && config.hasSLOs() && !config.ShadowMode {
+		log.Info("Checking service SLOs against the alert history")
+		shutdownListeners++
+		go monitorSLOs(config, shutdownCh, client)
+	}
+
+	for _, watch := range config.HTTPWatches {
+		log.Infof("Polling %s for http watch %s", watch.target(config.ConsulAddress), watch.Name)
+		shutdownListeners++
+		go runHTTPWatch(watch, config, shutdownCh, client)
+	}
+
+	for _, composite := range config.Composites {
+		log.Infof("Watching services %v for composite %s", composite.Services, composite.Name)
+		shutdownListeners++
+		go runComposite(composite, config, shutdownCh, client)
+	}
+
 	// If NodeWatch is set to global mode, monitor the catalog for new nodes
 	if config.NodeWatch == GlobalMode {
 		log.Info("Discovering nodes from catalog")
-		go discoverNodes(config, shutdownCh, client)
+		go discoverNodes(nodeName, config, shutdownCh, client)
 	} else {
 		log.Infof("Monitoring local node (%s)'s checks", nodeName)
 		// We're in local mode so we don't need to discover the local node; it won't change
@@ -132,6 +252,8 @@ func main() {
 		go watch(opts)
 	}
 
+	atomic.StoreInt32(&lifecycle.started, 1)
+
 	// Set up signal handling for graceful shutdown
 	c := make(chan os.Signal, 1)
 
@@ -140,13 +262,17 @@ func main() {
 	for sig := range c {
 		switch sig {
 		case syscall.SIGINT:
-			shutdown(client, config, shutdownCh)
+			shutdown(client, config, shutdownCh, shutdownListeners)
 
 		case syscall.SIGTERM:
-			shutdown(client, config, shutdownCh)
+			shutdown(client, config, shutdownCh, shutdownListeners)
 
 		case syscall.SIGQUIT:
-			shutdown(client, config, shutdownCh)
+			shutdown(client, config, shutdownCh, shutdownListeners)
+
+		case syscall.SIGHUP:
+			log.Info("Got hangup signal, reloading config")
+			reloadConfig(config_path, config, client)
 
 		default:
 			log.Error("Unknown signal.")
@@ -154,13 +280,73 @@ func main() {
 	}
 }
 
-func shutdown(client *api.Client, config *Config, shutdownCh chan struct{}) {
+// Returns a Consul client for the configured agent address and token
+func newConsulClient(config *Config) (*api.Client, error) {
+	clientConfig := api.DefaultConfig()
+	clientConfig.Address = config.ConsulAddress
+	addressSplit := strings.Split(config.ConsulAddress, "://")
+	if len(addressSplit) > 1 {
+		clientConfig.Address = addressSplit[1]
+		clientConfig.Scheme = addressSplit[0]
+	}
+	clientConfig.Token = config.ConsulToken
+
+	client, err := api.NewClient(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing client: %s", err)
+	}
+
+	// The client shares its http.Client with clientConfig, including the one it sets up
+	// for unix sockets
+	if config.WatchBackend == BackendHealthService {
+		clientConfig.HttpClient.Transport = cachedHealthTransport{clientConfig.HttpClient.Transport}
+	}
+	return client, nil
+}
+
+// Shuts down in order: discovery stops, stopping each of its watches, which release their
+// locks as they stop; then the notifications still queued are sent. If this doesn't finish
+// within the shutdown timeout, the remaining watches are abandoned and the process exits with
+// ExitShutdownTimeout.
+func shutdown(client *api.Client, config *Config, shutdownCh chan struct{}, listeners int) {
 	log.Info("Got interrupt signal, shutting down")
-	log.Info("Releasing locks...")
-	// Send twice to the channel for each watch to stop; first to initiate shutdown and
-	// then to block until the shutdown has finished
-	for i := 0; i < 4; i++ {
-		shutdownCh <- struct{}{}
+	atomic.StoreInt32(&lifecycle.shuttingDown, 1)
+
+	var deadline time.Time
+	if config.ShutdownTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(config.ShutdownTimeout) * time.Second)
+	}
+
+	log.Info("Stopping watches and releasing locks...")
+	stopped := finishBy(deadline, func() {
+		// Send twice to the channel for each listener to stop; first to initiate shutdown and
+		// then to block until the shutdown has finished
+		for i := 0; i < listeners*2; i++ {
+			shutdownCh <- struct{}{}
+		}
+	})
+	if !stopped {
+		abandonShutdown(config, "stopping watches")
+	}
+
+	if config.dispatchQueue != nil {
+		log.Infof("Sending %d queued notifications...", config.dispatchQueue.size())
+		if !finishBy(deadline, config.dispatchQueue.drain) {
+			abandonShutdown(config, "sending queued notifications")
+		}
+	}
+	if size := emailQueue.size(); size > 0 {
+		log.Warnf("Dropping %d alert emails waiting to be retried", size)
+	}
+
+	stopPlugins()
+
+	if config.deliveryQueue != nil {
+		config.deliveryQueue.close()
+	}
+
+	if config.eventLog != nil {
+		config.eventLog.close()
 	}
 
 	if config.DevMode {
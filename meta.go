@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The prefix for service meta keys that configure alerting for a service
+const serviceMetaPrefix = "alerting_"
+
+// The service meta keys that can be set, without the prefix
+var serviceMetaKeys = []string{
+	"change_threshold",
+	"reminder_interval",
+	"max_staleness",
+	"handlers",
+	"team",
+	"ignore_checks",
+	"diff_strategy",
+}
+
+// The fields of a catalog service entry needed for reading its meta. The vendored api
+// package predates service meta, so the catalog endpoint is queried directly.
+type catalogServiceMeta struct {
+	Node        string
+	ServiceMeta map[string]string
+}
+
+// Fetches the alerting settings from the meta of a service's instances. If instances
+// disagree, the instance on the first node (by name) wins.
+func fetchServiceMeta(client *api.Client, service string) (map[string]string, error) {
+	var entries []catalogServiceMeta
+	_, err := client.Raw().Query("/v1/catalog/service/"+url.PathEscape(service), &entries, &api.QueryOptions{AllowStale: true})
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching meta for service %s: %s", service, err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Node < entries[j].Node
+	})
+
+	meta := make(map[string]string)
+	for _, entry := range entries {
+		for key, value := range entry.ServiceMeta {
+			if !strings.HasPrefix(key, serviceMetaPrefix) {
+				continue
+			}
+			key = strings.TrimPrefix(key, serviceMetaPrefix)
+			if _, ok := meta[key]; !ok {
+				meta[key] = value
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+// Validates and stores the alerting settings from a service's meta, which are merged over the
+// service's config from the file. Invalid settings are logged and left out.
+func (c *Config) setServiceMeta(service string, meta map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	valid := make(map[string]string)
+	for key, value := range meta {
+		if err := c.validateServiceMetaLocked(key, value); err != nil {
+			log.Warnf("Ignoring meta key %s%s on service %s: %s", serviceMetaPrefix, key, service, err)
+			continue
+		}
+		valid[key] = value
+	}
+
+	old := c.serviceMeta[service]
+	if (len(old) == 0 && len(valid) == 0) || reflect.DeepEqual(old, valid) {
+		return
+	}
+
+	if c.serviceMeta == nil {
+		c.serviceMeta = make(map[string]map[string]string)
+	}
+	if len(valid) == 0 {
+		delete(c.serviceMeta, service)
+	} else {
+		c.serviceMeta[service] = valid
+	}
+	log.WithField("meta", valid).Infof("Updated alerting config for service %s from its meta", service)
+}
+
+// Checks whether a service meta setting is usable, assuming the config lock is held
+func (c *Config) validateServiceMetaLocked(key string, value string) error {
+	switch key {
+	case "change_threshold", "reminder_interval", "max_staleness":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("invalid value %q", value)
+		}
+	case "handlers":
+		for _, id := range splitMetaList(value) {
+			_, isGroup := c.HandlerGroups[id]
+			if _, ok := c.Handlers[id]; !ok && !isGroup {
+				return fmt.Errorf("unknown handler %s", id)
+			}
+		}
+	case "team":
+		if _, ok := c.Teams[value]; !ok {
+			return fmt.Errorf("unknown team %s", value)
+		}
+	case "ignore_checks":
+	case "diff_strategy":
+		if !contains(diffStrategies, value) {
+			return fmt.Errorf("invalid value %q", value)
+		}
+	default:
+		return fmt.Errorf("unknown setting, expected one of: %s", strings.Join(serviceMetaKeys, ", "))
+	}
+
+	return nil
+}
+
+// Returns a copy of the service config with the validated meta settings applied
+func applyServiceMeta(service ServiceConfig, meta map[string]string) ServiceConfig {
+	for key, value := range meta {
+		switch key {
+		case "change_threshold":
+			service.ChangeThreshold, _ = strconv.Atoi(value)
+		case "reminder_interval":
+			service.ReminderInterval, _ = strconv.Atoi(value)
+		case "max_staleness":
+			service.MaxStaleness, _ = strconv.Atoi(value)
+		case "handlers":
+			service.Handlers = splitMetaList(value)
+		case "team":
+			service.Team = value
+		case "ignore_checks":
+			service.IgnoreChecks = splitMetaList(value)
+		case "diff_strategy":
+			service.DiffStrategy = value
+		}
+	}
+	return service
+}
+
+// Splits a comma-separated meta value, trimming whitespace and dropping empty items
+func splitMetaList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMeta_serviceOverrides(t *testing.T) {
+	config, err := ParseConfig(`
+	change_threshold = 60
+
+	service "redis" {
+		change_threshold = 30
+		handlers = ["stdout.log"]
+	}
+
+	handler "stdout" "log" {}
+	handler "stdout" "team" {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.setServiceMeta("redis", map[string]string{
+		"change_threshold": "15",
+		"handlers":         "stdout.team, stdout.log",
+		"team":             "missing",
+		"bogus":            "1",
+	})
+
+	// Valid meta settings override the file config, invalid ones are dropped
+	service := config.serviceConfig("redis")
+	if service.ChangeThreshold != 15 {
+		t.Errorf("expected change threshold 15, got %d", service.ChangeThreshold)
+	}
+	if expected := []string{"stdout.team", "stdout.log"}; !reflect.DeepEqual(service.Handlers, expected) {
+		t.Errorf("expected handlers %v, got %v", expected, service.Handlers)
+	}
+	if service.Team != "" {
+		t.Errorf("expected the unknown team to be ignored, got %s", service.Team)
+	}
+
+	// The file config itself is left alone
+	if config.Services["redis"].ChangeThreshold != 30 {
+		t.Errorf("expected file config to be unchanged, got %d", config.Services["redis"].ChangeThreshold)
+	}
+
+	// Services that are only configured through meta start from the global defaults
+	config.setServiceMeta("webapp", map[string]string{"reminder_interval": "600"})
+	service = config.serviceConfig("webapp")
+	if service == nil || service.ChangeThreshold != 60 || service.ReminderInterval != 600 {
+		t.Errorf("unexpected config for meta-only service: %#v", service)
+	}
+
+	// Removing the meta goes back to the file config
+	config.setServiceMeta("webapp", map[string]string{})
+	if service := config.serviceConfig("webapp"); service != nil {
+		t.Errorf("expected no config for webapp, got %#v", service)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The number of alerts dispatched for each node/service with entity metrics enabled, keyed by
+// the alert's fingerprint
+var firedAlerts = &statusCounter{counts: make(map[string]uint64)}
+
+// Returns true if per-entity metrics are reported for the alert's node or service, matching
+// service alerts by the service name and node alerts by the node name
+func (c *Config) entityMetricsEnabled(alert *AlertState) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	name := alert.Service
+	if name == "" {
+		name = alert.Node
+	}
+	if name == "" {
+		return false
+	}
+	for _, pattern := range c.entityMetricPatterns {
+		if pattern.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts an alert that's being dispatched, if its node or service has entity metrics enabled
+func recordFiredAlert(config *Config, alert *AlertState) {
+	if config.entityMetricsEnabled(alert) {
+		firedAlerts.add(alertFingerprint(alert))
+	}
+}
+
+// Writes the status API's metrics in the Prometheus text format: the internal counters, then
+// the current status, the seconds since the last status change and the number of alerts
+// fired for each node/service allowed by entity_metrics. Only the first entity_metrics_limit
+// entities (ordered by their labels) are written, so a large catalog can't blow up the number
+// of series; the rest are counted by consul_alerting_entity_metrics_dropped.
+func writePrometheusMetrics(buf *bytes.Buffer, config *Config, states []alertStatus, fired map[string]uint64, now time.Time) {
+	promMetric(buf, "consul_alerting_state_writes_total", "counter", "The number of check/alert state writes made to the KV store.")
+	fmt.Fprintf(buf, "consul_alerting_state_writes_total %d\n", atomic.LoadUint64(&stateWrites))
+
+	promMetric(buf, "consul_alerting_unknown_statuses_total", "counter", "The number of times checks were seen with each unknown status.")
+	unknown := unknownStatuses.snapshot()
+	statuses := make([]string, 0, len(unknown))
+	for status := range unknown {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(buf, "consul_alerting_unknown_statuses_total{status=\"%s\"} %d\n", promEscape(status), unknown[status])
+	}
+
+	throttled := 0
+	if consulThrottle.throttled() {
+		throttled = 1
+	}
+	promMetric(buf, "consul_alerting_throttled", "gauge", "Whether requests to Consul are being throttled.")
+	fmt.Fprintf(buf, "consul_alerting_throttled %d\n", throttled)
+
+	checkStates := currentCheckStateMetrics()
+	promMetric(buf, "consul_alerting_check_states", "gauge", "The number of check states held in memory by the watches.")
+	fmt.Fprintf(buf, "consul_alerting_check_states %d\n", checkStates.Entries)
+	promMetric(buf, "consul_alerting_check_state_evictions_total", "counter", "The number of check states evicted from memory by the cache limits.")
+	fmt.Fprintf(buf, "consul_alerting_check_state_evictions_total %d\n", checkStates.Evictions)
+	promMetric(buf, "consul_alerting_check_state_reloads_total", "counter", "The number of evicted check states reloaded from the KV store.")
+	fmt.Fprintf(buf, "consul_alerting_check_state_reloads_total %d\n", checkStates.Reloads)
+	promMetric(buf, "consul_alerting_node_feed_checks", "gauge", "The number of checks held by the shared node health feed.")
+	fmt.Fprintf(buf, "consul_alerting_node_feed_checks %d\n", checkStates.FeedChecks)
+	promMetric(buf, "consul_alerting_heap_bytes", "gauge", "The bytes of heap memory allocated by the process.")
+	fmt.Fprintf(buf, "consul_alerting_heap_bytes %d\n", heapBytes())
+
+	progress := startupSync.snapshot()
+	kinds := make([]string, 0, len(progress))
+	for kind := range progress {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	promMetric(buf, "consul_alerting_startup_sync_watches", "gauge", "The number of watches found by the initial catalog sync.")
+	for _, kind := range kinds {
+		fmt.Fprintf(buf, "consul_alerting_startup_sync_watches{kind=\"%s\"} %d\n", kind, progress[kind].Total)
+	}
+	promMetric(buf, "consul_alerting_startup_sync_started", "gauge", "The number of watches started so far by the initial catalog sync.")
+	for _, kind := range kinds {
+		fmt.Fprintf(buf, "consul_alerting_startup_sync_started{kind=\"%s\"} %d\n", kind, progress[kind].Started)
+	}
+
+	entities, dropped := limitEntities(config, states)
+
+	promMetric(buf, "consul_alerting_entity_status", "gauge", "The status of each node/service: 0 for passing, 1 for warning and 2 for critical.")
+	for _, entity := range entities {
+		fmt.Fprintf(buf, "consul_alerting_entity_status{%s} %d\n", entity.labels, healthRank(entity.Status))
+	}
+
+	promMetric(buf, "consul_alerting_entity_seconds_since_change", "gauge", "The number of seconds since each node/service's status last changed.")
+	for _, entity := range entities {
+		if entity.Changed == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "consul_alerting_entity_seconds_since_change{%s} %d\n", entity.labels, now.Unix()-entity.Changed)
+	}
+
+	promMetric(buf, "consul_alerting_entity_alerts_total", "counter", "The number of alerts fired by this process for each node/service.")
+	for _, entity := range entities {
+		fmt.Fprintf(buf, "consul_alerting_entity_alerts_total{%s} %d\n", entity.labels, fired[entity.Fingerprint])
+	}
+
+	promMetric(buf, "consul_alerting_entity_metrics_dropped", "gauge", "The number of nodes/services left out of the entity metrics by entity_metrics_limit.")
+	fmt.Fprintf(buf, "consul_alerting_entity_metrics_dropped %d\n", dropped)
+}
+
+// An alert state along with its rendered Prometheus labels
+type entityState struct {
+	alertStatus
+	labels string
+}
+
+// Returns the alert states allowed by entity_metrics, up to entity_metrics_limit of them, along
+// with the number that were left out by the limit
+func limitEntities(config *Config, states []alertStatus) ([]entityState, int) {
+	config.lock.RLock()
+	datacenter, limit := config.ConsulDatacenter, config.EntityMetricsLimit
+	config.lock.RUnlock()
+
+	entities := make([]entityState, 0)
+	for _, state := range states {
+		if !config.entityMetricsEnabled(&state.AlertState) {
+			continue
+		}
+		entities = append(entities, entityState{
+			alertStatus: state,
+			labels:      promLabels(datacenter, &state.AlertState),
+		})
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].labels < entities[j].labels
+	})
+
+	if len(entities) > limit {
+		return entities[:limit], len(entities) - limit
+	}
+	return entities, 0
+}
+
+// Renders the labels identifying an alert's node/service, leaving out empty ones
+func promLabels(datacenter string, alert *AlertState) string {
+	labels := make([]string, 0, 5)
+	for _, label := range [][2]string{
+		{"datacenter", datacenter},
+		{"node", alert.Node},
+		{"service", alert.Service},
+		{"tag", alert.Tag},
+		{"route", alert.Route},
+	} {
+		if label[1] != "" {
+			labels = append(labels, fmt.Sprintf("%s=\"%s\"", label[0], promEscape(label[1])))
+		}
+	}
+	return strings.Join(labels, ",")
+}
+
+// Writes the HELP and TYPE lines for a metric
+func promMetric(buf *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Escapes a label value for the Prometheus text format
+func promEscape(value string) string {
+	return promEscaper.Replace(value)
+}
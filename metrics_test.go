@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestMetrics_prometheusEntities(t *testing.T) {
+	config, err := ParseConfig(`
+	datacenter = "dc1"
+	entity_metrics = ["redis*", "node-*"]
+	entity_metrics_limit = 2
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1000, 0)
+	states := make([]alertStatus, 0)
+	for _, alert := range []AlertState{
+		{Service: "redis", Tag: "primary", Status: api.HealthCritical, Changed: 400},
+		{Service: "web", Status: api.HealthCritical},
+		{Service: "redis-replica", Status: api.HealthPassing},
+		{Node: "node-1", Status: api.HealthWarning, Changed: 900},
+	} {
+		alert := alert
+		states = append(states, alertStatus{Fingerprint: alertFingerprint(&alert), AlertState: alert})
+	}
+	fired := map[string]uint64{states[0].Fingerprint: 3}
+
+	var buf bytes.Buffer
+	writePrometheusMetrics(&buf, config, states, fired, now)
+	out := buf.String()
+
+	// Entities are ordered by their labels, so redis-replica is over the limit
+	for _, line := range []string{
+		`consul_alerting_entity_status{datacenter="dc1",node="node-1"} 1`,
+		`consul_alerting_entity_status{datacenter="dc1",service="redis",tag="primary"} 2`,
+		`consul_alerting_entity_seconds_since_change{datacenter="dc1",node="node-1"} 100`,
+		`consul_alerting_entity_seconds_since_change{datacenter="dc1",service="redis",tag="primary"} 600`,
+		`consul_alerting_entity_alerts_total{datacenter="dc1",service="redis",tag="primary"} 3`,
+		`consul_alerting_entity_alerts_total{datacenter="dc1",node="node-1"} 0`,
+		`consul_alerting_entity_metrics_dropped 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, out)
+		}
+	}
+	for _, entity := range []string{`service="web"`, `service="redis-replica"`} {
+		if strings.Contains(out, entity) {
+			t.Errorf("expected %s to be left out, got:\n%s", entity, out)
+		}
+	}
+}
+
+func TestMetrics_recordFiredAlert(t *testing.T) {
+	config, err := ParseConfig(`entity_metrics = ["/^cache-/"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := &AlertState{Service: "cache-eu", Status: api.HealthCritical}
+	before := firedAlerts.snapshot()[alertFingerprint(allowed)]
+	recordFiredAlert(config, allowed)
+	recordFiredAlert(config, &AlertState{Service: "web", Status: api.HealthCritical})
+
+	counts := firedAlerts.snapshot()
+	if counts[alertFingerprint(allowed)] != before+1 {
+		t.Errorf("expected the cache-eu alert to be counted, got %v", counts)
+	}
+	if _, ok := counts[alertFingerprint(&AlertState{Service: "web"})]; ok {
+		t.Errorf("expected the web alert not to be counted, got %v", counts)
+	}
+}
+
+func TestMetrics_promEscape(t *testing.T) {
+	if escaped := promEscape("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Errorf("unexpected escaping: %s", escaped)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// Middleware filters or transforms alerts before they reach a handler. Middleware is
+// configured per handler with `middleware "type" { ... }` blocks, and runs in the order
+// it's listed in. Alerts dropped by a middleware count as delivered, so they aren't queued.
+type Middleware interface {
+	wrap(next AlertHandler) AlertHandler
+}
+
+// Only passes on alerts with one of the given statuses and (if set) for one of the given services
+type FilterMiddleware struct {
+	Statuses []string `mapstructure:"statuses"`
+	Services []string `mapstructure:"services"`
+}
+
+func (m FilterMiddleware) wrap(next AlertHandler) AlertHandler {
+	return middlewareFunc(func(datacenter string, alert *AlertState) error {
+		if len(m.Statuses) > 0 && !contains(m.Statuses, alert.Status) {
+			return nil
+		}
+		if len(m.Services) > 0 && !contains(m.Services, alert.Service) {
+			return nil
+		}
+		return next.Alert(datacenter, alert)
+	})
+}
+
+// Adds a prefix/suffix to the alert message, and optionally drops the details
+type TransformMiddleware struct {
+	MessagePrefix string `mapstructure:"message_prefix"`
+	MessageSuffix string `mapstructure:"message_suffix"`
+	DropDetails   bool   `mapstructure:"drop_details"`
+}
+
+func (m TransformMiddleware) wrap(next AlertHandler) AlertHandler {
+	return middlewareFunc(func(datacenter string, alert *AlertState) error {
+		transformed := *alert
+		transformed.Message = m.MessagePrefix + alert.Message + m.MessageSuffix
+		if m.DropDetails {
+			transformed.Details = ""
+			transformed.Checks = nil
+		}
+		return next.Alert(datacenter, &transformed)
+	})
+}
+
+// Marks alerts with an emoji and prefix for their status, and sets the colors for handlers
+// that can show them (such as Slack), so alerts are easy to scan in chat without changing
+// the rest of the message. Each option is a map from status to the value to use for it.
+type PresentationMiddleware struct {
+	Emoji    map[string]string `mapstructure:"emoji"`
+	Colors   map[string]string `mapstructure:"colors"`
+	Prefixes map[string]string `mapstructure:"prefixes"`
+}
+
+func (m PresentationMiddleware) wrap(next AlertHandler) AlertHandler {
+	return middlewareFunc(func(datacenter string, alert *AlertState) error {
+		presented := *alert
+		presented.Message = m.Prefixes[alert.Status] + alert.Message
+		if emoji := m.Emoji[alert.Status]; emoji != "" {
+			presented.Message = emoji + " " + presented.Message
+		}
+		presented.presentation = &m
+		return next.Alert(datacenter, &presented)
+	})
+}
+
+// Checks that the maps are only keyed by known statuses
+func (m PresentationMiddleware) validate() error {
+	statuses := []string{api.HealthPassing, api.HealthWarning, api.HealthCritical, InfoStatus}
+	for option, values := range map[string]map[string]string{"emoji": m.Emoji, "colors": m.Colors, "prefixes": m.Prefixes} {
+		for status, _ := range values {
+			if !contains(statuses, status) {
+				return fmt.Errorf("unknown status in %s: %s", option, status)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the color the alert's presentation sets for the given status, or the fallback if
+// there isn't one
+func presentationColor(alert *AlertState, status string, fallback string) string {
+	if alert.presentation != nil {
+		if color, ok := alert.presentation.Colors[status]; ok {
+			return color
+		}
+	}
+	return fallback
+}
+
+// Returns the emoji the alert's presentation sets for the given status, followed by a space,
+// or an empty string if there isn't one
+func presentationEmoji(alert *AlertState, status string) string {
+	if alert.presentation != nil {
+		if emoji := alert.presentation.Emoji[status]; emoji != "" {
+			return emoji + " "
+		}
+	}
+	return ""
+}
+
+// Attaches a fixed set of labels to alerts, which are also appended to the details
+type LabelsMiddleware struct {
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+func (m LabelsMiddleware) wrap(next AlertHandler) AlertHandler {
+	return middlewareFunc(func(datacenter string, alert *AlertState) error {
+		labeled := *alert
+		labeled.Labels = make(map[string]string)
+		for key, value := range alert.Labels {
+			labeled.Labels[key] = value
+		}
+
+		keys := make([]string, 0, len(m.Labels))
+		for key, value := range m.Labels {
+			labeled.Labels[key] = value
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, key+"="+m.Labels[key])
+		}
+		labeled.Details = strings.TrimSpace(alert.Details + "\nLabels: " + strings.Join(pairs, ", "))
+
+		return next.Alert(datacenter, &labeled)
+	})
+}
+
+// Drops alerts past the first Max in each Period (in seconds)
+type RateLimitMiddleware struct {
+	Max    int `mapstructure:"max"`
+	Period int `mapstructure:"period"`
+}
+
+func (m RateLimitMiddleware) wrap(next AlertHandler) AlertHandler {
+	var lock sync.Mutex
+	sent := make([]time.Time, 0)
+	period := time.Duration(m.Period) * time.Second
+
+	return middlewareFunc(func(datacenter string, alert *AlertState) error {
+		lock.Lock()
+		now := time.Now()
+		for len(sent) > 0 && now.Sub(sent[0]) >= period {
+			sent = sent[1:]
+		}
+		if len(sent) >= m.Max {
+			lock.Unlock()
+			log.Warnf("Rate limit of %d alerts per %s reached, dropping alert: %s", m.Max, period, alert.Message)
+			return nil
+		}
+		sent = append(sent, now)
+		lock.Unlock()
+
+		return next.Alert(datacenter, alert)
+	})
+}
+
+// Drops alerts identical (same node/service/tag, status and message) to one that was
+// passed on within the last Window seconds
+type DedupeMiddleware struct {
+	Window int `mapstructure:"window"`
+}
+
+func (m DedupeMiddleware) wrap(next AlertHandler) AlertHandler {
+	var lock sync.Mutex
+	seen := make(map[string]time.Time)
+	window := time.Duration(m.Window) * time.Second
+
+	return middlewareFunc(func(datacenter string, alert *AlertState) error {
+		key := alertFingerprint(alert) + "/" + alert.Status + "/" + alert.Message
+
+		lock.Lock()
+		now := time.Now()
+		for k, t := range seen {
+			if now.Sub(t) >= window {
+				delete(seen, k)
+			}
+		}
+		if _, ok := seen[key]; ok {
+			lock.Unlock()
+			log.Debugf("Dropping duplicate alert: %s", alert.Message)
+			return nil
+		}
+		seen[key] = now
+		lock.Unlock()
+
+		return next.Alert(datacenter, alert)
+	})
+}
+
+// Adapts a function to the AlertHandler interface
+type middlewareFunc func(datacenter string, alert *AlertState) error
+
+func (f middlewareFunc) Alert(datacenter string, alert *AlertState) error {
+	return f(datacenter, alert)
+}
+
+// Parses the middleware blocks in a handler's config, in the order they're listed
+func parseMiddleware(handlerID string, val ast.Node) ([]Middleware, error) {
+	obj, ok := val.(*ast.ObjectType)
+	if !ok {
+		return nil, nil
+	}
+
+	middleware := make([]Middleware, 0)
+	for _, item := range obj.List.Filter("middleware").Items {
+		if len(item.Keys) < 1 {
+			return nil, fmt.Errorf("didn't specify type for middleware on handler %s at line %d", handlerID, item.Pos().Line)
+		}
+		middlewareType := item.Keys[0].Token.Value().(string)
+
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, item.Val); err != nil {
+			return nil, err
+		}
+
+		var mw Middleware
+		var err error
+		switch middlewareType {
+		case "filter":
+			var filter FilterMiddleware
+			err = mapstructure.WeakDecode(m, &filter)
+			mw = filter
+		case "transform":
+			var transform TransformMiddleware
+			err = mapstructure.WeakDecode(m, &transform)
+			mw = transform
+		case "labels":
+			var labels LabelsMiddleware
+			err = mapstructure.WeakDecode(m, &labels)
+			mw = labels
+		case "presentation":
+			var presentation PresentationMiddleware
+			err = mapstructure.WeakDecode(m, &presentation)
+			if err == nil {
+				if err = presentation.validate(); err != nil {
+					err = fmt.Errorf("Invalid presentation middleware on handler %s: %s", handlerID, err)
+				}
+			}
+			mw = presentation
+		case "rate_limit":
+			rateLimit := RateLimitMiddleware{Period: 60}
+			err = mapstructure.WeakDecode(m, &rateLimit)
+			if err == nil && (rateLimit.Max <= 0 || rateLimit.Period <= 0) {
+				err = fmt.Errorf("max and period must be positive for rate_limit middleware on handler %s", handlerID)
+			}
+			mw = rateLimit
+		case "dedupe":
+			dedupe := DedupeMiddleware{Window: 300}
+			err = mapstructure.WeakDecode(m, &dedupe)
+			if err == nil && dedupe.Window <= 0 {
+				err = fmt.Errorf("window must be positive for dedupe middleware on handler %s", handlerID)
+			}
+			mw = dedupe
+		default:
+			return nil, fmt.Errorf("Unknown middleware type for handler %s: %s", handlerID, middlewareType)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		middleware = append(middleware, mw)
+	}
+
+	return middleware, nil
+}
+
+// MiddlewareHandler is a handler wrapped in its chain of middleware
+type MiddlewareHandler struct {
+	Handler    AlertHandler
+	Middleware []Middleware
+
+	// The handler wrapped in each middleware, so the first middleware listed runs first
+	chain AlertHandler
+}
+
+func newMiddlewareHandler(handler AlertHandler, middleware []Middleware) MiddlewareHandler {
+	chain := handler
+	for i := len(middleware) - 1; i >= 0; i-- {
+		chain = middleware[i].wrap(chain)
+	}
+
+	return MiddlewareHandler{
+		Handler:    handler,
+		Middleware: middleware,
+		chain:      chain,
+	}
+}
+
+func (handler MiddlewareHandler) Alert(datacenter string, alert *AlertState) error {
+	return handler.chain.Alert(datacenter, alert)
+}
+
+// Returns the handler underneath any middleware
+func unwrapHandler(handler AlertHandler) AlertHandler {
+	if wrapped, ok := handler.(MiddlewareHandler); ok {
+		return wrapped.Handler
+	}
+	return handler
+}
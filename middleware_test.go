@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Parse a handler with a middleware chain and run alerts through it
+func TestMiddleware_chain(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "stdout" "log" {
+		middleware "filter" {
+			statuses = ["critical", "passing"]
+		}
+		middleware "transform" {
+			message_prefix = "[prod] "
+		}
+		middleware "labels" {
+			labels = {
+				env = "prod"
+			}
+		}
+		middleware "dedupe" {
+			window = 60
+		}
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, ok := config.Handlers["stdout.log"].(MiddlewareHandler)
+	if !ok {
+		t.Fatalf("expected a middleware handler, got %#v", config.Handlers["stdout.log"])
+	}
+	if len(handler.Middleware) != 4 {
+		t.Fatalf("expected 4 middleware, got %d", len(handler.Middleware))
+	}
+	if _, ok := unwrapHandler(handler).(StdoutHandler); !ok {
+		t.Errorf("expected the wrapped handler to be a stdout handler")
+	}
+
+	alertCh := make(chan *AlertState, 10)
+	chain := newMiddlewareHandler(testHandler{alertCh}, handler.Middleware)
+
+	chain.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthWarning, Message: "warning"})
+	chain.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthCritical, Message: "critical"})
+	chain.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthCritical, Message: "critical"})
+
+	if len(alertCh) != 1 {
+		t.Fatalf("expected 1 alert to make it through, got %d", len(alertCh))
+	}
+	alert := <-alertCh
+	if alert.Message != "[prod] critical" {
+		t.Errorf("expected transformed message, got %q", alert.Message)
+	}
+	if alert.Labels["env"] != "prod" || !strings.Contains(alert.Details, "Labels: env=prod") {
+		t.Errorf("expected labels to be attached, got %v / %q", alert.Labels, alert.Details)
+	}
+}
+
+func TestMiddleware_rateLimit(t *testing.T) {
+	alertCh := make(chan *AlertState, 10)
+	chain := newMiddlewareHandler(testHandler{alertCh}, []Middleware{RateLimitMiddleware{Max: 2, Period: 60}})
+
+	for i := 0; i < 5; i++ {
+		chain.Alert("dc1", &AlertState{Status: api.HealthCritical})
+	}
+
+	if len(alertCh) != 2 {
+		t.Fatalf("expected 2 alerts within the rate limit, got %d", len(alertCh))
+	}
+}
+
+func TestMiddleware_invalid(t *testing.T) {
+	_, err := ParseConfig(`
+	handler "stdout" "log" {
+		middleware "bogus" {}
+	}
+	`)
+	if err == nil || !strings.Contains(err.Error(), "Unknown middleware type") {
+		t.Fatalf("expected an unknown middleware error, got %v", err)
+	}
+
+	_, err = ParseConfig(`
+	handler "stdout" "log" {
+		middleware "rate_limit" {}
+	}
+	`)
+	if err == nil || !strings.Contains(err.Error(), "must be positive") {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+}
+
+func TestMiddleware_presentation(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "stdout" "chat" {
+		middleware "presentation" {
+			emoji = {
+				critical = ":red_circle:"
+				passing = ":white_check_mark:"
+			}
+			colors = {
+				critical = "#ff0000"
+			}
+			prefixes = {
+				critical = "[P1] "
+			}
+		}
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, ok := config.Handlers["stdout.chat"].(MiddlewareHandler)
+	if !ok || len(wrapped.Middleware) != 1 {
+		t.Fatalf("expected the handler to be wrapped in middleware, got %#v", config.Handlers["stdout.chat"])
+	}
+
+	alertCh := make(chan *AlertState, 10)
+	chain := newMiddlewareHandler(testHandler{alertCh}, wrapped.Middleware)
+	chain.Alert("dc1", &AlertState{
+		Status:  api.HealthCritical,
+		Message: "service redis is now critical",
+		Checks: []CheckSummary{
+			{Name: "mem", Status: api.HealthCritical},
+			{Name: "disk", Status: api.HealthWarning},
+		},
+	})
+	alert := <-alertCh
+	if alert.Message != ":red_circle: [P1] service redis is now critical" {
+		t.Errorf("unexpected message: %q", alert.Message)
+	}
+
+	// Colors fall back to the handler's defaults for statuses without one
+	attachments := slackAttachments(alert)
+	if attachments[0].Color != "#ff0000" || attachments[1].Color != "warning" {
+		t.Errorf("expected presentation colors, got %s and %s", attachments[0].Color, attachments[1].Color)
+	}
+	if attachments[0].Title != ":red_circle: mem" || attachments[1].Title != "disk" {
+		t.Errorf("expected emoji on check titles, got %q and %q", attachments[0].Title, attachments[1].Title)
+	}
+
+	chain.Alert("dc1", &AlertState{Status: api.HealthPassing, Message: "service redis is now passing"})
+	if alert := <-alertCh; alert.Message != ":white_check_mark: service redis is now passing" {
+		t.Errorf("unexpected message: %q", alert.Message)
+	}
+
+	_, err = ParseConfig(`
+	handler "stdout" "chat" {
+		middleware "presentation" {
+			emoji = {
+				broken = ":x:"
+			}
+		}
+	}
+	`)
+	if err == nil {
+		t.Error("expected an error for an unknown status")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// A shared feed of the node-level health checks for every node in the catalog, used in global
+// node mode so that each node watch doesn't need its own blocking query. A single blocking
+// query on /v1/health/state/any keeps the feed up to date, and node watches block on the
+// feed until their node's checks change.
+type nodeHealthFeed struct {
+	lock sync.Mutex
+
+	// The index of the last results, 0 until the first query succeeds
+	index uint64
+
+	// The node-level checks for each node, and the index they last changed at
+	checks  map[string][]*api.HealthCheck
+	changed map[string]uint64
+
+	// The ModifyIndex of each node-level check, keyed by node and then node/checkID
+	indexes map[string]map[string]uint64
+
+	// Closed and replaced whenever new results come in, to wake up waiting node watches
+	notify chan struct{}
+}
+
+func newNodeHealthFeed() *nodeHealthFeed {
+	return &nodeHealthFeed{
+		checks:  make(map[string][]*api.HealthCheck),
+		changed: make(map[string]uint64),
+		indexes: make(map[string]map[string]uint64),
+		notify:  make(chan struct{}),
+	}
+}
+
+// Runs the blocking query keeping the feed up to date until the stop channel is closed
+func (f *nodeHealthFeed) run(client *api.Client, stopCh chan struct{}) {
+	queryOpts := &api.QueryOptions{
+		AllowStale: true,
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		queryOpts.WaitTime = consulThrottle.waitTime()
+		checks, indexes, queryMeta, err := queryIndexedChecks(client, "/v1/health/state/any", queryOpts)
+		consulThrottle.observe(err)
+		if err != nil {
+			wait := consulThrottle.errorWaitTime()
+			log.Errorf("Error trying to watch node health: %s, retrying in %s...", err, wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		queryOpts.WaitIndex = queryMeta.LastIndex
+		f.update(checks, indexes, queryMeta.LastIndex)
+	}
+}
+
+// Updates the feed with the latest checks and their modify indexes (keyed by node/checkID),
+// and wakes up the watches waiting on it
+func (f *nodeHealthFeed) update(checks []*api.HealthCheck, indexes map[string]uint64, index uint64) {
+	// Node watches only look at node-level checks, so leave out the service checks
+	byNode := make(map[string][]*api.HealthCheck)
+	nodeIndexes := make(map[string]map[string]uint64)
+	count := 0
+	for _, check := range checks {
+		if check.ServiceID == "" {
+			byNode[check.Node] = append(byNode[check.Node], check)
+			count++
+
+			key := check.Node + "/" + check.CheckID
+			if modifyIndex, ok := indexes[key]; ok {
+				if nodeIndexes[check.Node] == nil {
+					nodeIndexes[check.Node] = make(map[string]uint64)
+				}
+				nodeIndexes[check.Node][key] = modifyIndex
+			}
+		}
+	}
+	atomic.StoreInt64(&checkStateMemory.feedChecks, int64(count))
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for node, nodeChecks := range byNode {
+		if !reflect.DeepEqual(f.checks[node], nodeChecks) {
+			f.changed[node] = index
+		}
+	}
+	for node, _ := range f.checks {
+		if _, ok := byNode[node]; !ok {
+			f.changed[node] = index
+		}
+	}
+
+	f.checks = byNode
+	f.indexes = nodeIndexes
+	f.index = index
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// Returns a node's checks like Health().Node, blocking until they've changed since the
+// query's WaitIndex or its WaitTime has passed
+func (f *nodeHealthFeed) Node(node string, q *api.QueryOptions) ([]*api.HealthCheck, *api.QueryMeta, error) {
+	timeout := time.After(q.WaitTime)
+
+	for {
+		f.lock.Lock()
+		index, changed, notify := f.index, f.changed[node], f.notify
+		checks := f.checks[node]
+		f.lock.Unlock()
+
+		if index != 0 && (q.WaitIndex == 0 || changed > q.WaitIndex) {
+			return checks, &api.QueryMeta{LastIndex: index}, nil
+		}
+
+		select {
+		case <-notify:
+		case <-timeout:
+			// The watch only uses the index to wait for the next change, so the latest
+			// index is fine to return when nothing changed
+			if index == 0 {
+				return nil, nil, fmt.Errorf("node health hasn't been loaded yet")
+			}
+			return checks, &api.QueryMeta{LastIndex: index}, nil
+		}
+	}
+}
+
+// Returns the modify indexes of a node's checks as of the latest results, keyed by node/checkID
+func (f *nodeHealthFeed) modifyIndexes(node string) map[string]uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.indexes[node]
+}
+
+// Drops a node that's no longer being watched from the feed's change tracking
+func (f *nodeHealthFeed) forget(node string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.changed, node)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestNodeFeed_node(t *testing.T) {
+	feed := newNodeHealthFeed()
+	queryOpts := &api.QueryOptions{WaitTime: 50 * time.Millisecond}
+
+	// Queries fail until the feed has loaded
+	if _, _, err := feed.Node("node1", queryOpts); err == nil {
+		t.Fatal("expected an error before the feed loaded")
+	}
+
+	feed.update([]*api.HealthCheck{
+		{Node: "node1", CheckID: "serfHealth", Status: api.HealthPassing},
+		{Node: "node1", CheckID: "service:redis", ServiceID: "redis", Status: api.HealthCritical},
+		{Node: "node2", CheckID: "serfHealth", Status: api.HealthPassing},
+	}, nil, 10)
+
+	checks, meta, err := feed.Node("node1", queryOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 1 || checks[0].CheckID != "serfHealth" || meta.LastIndex != 10 {
+		t.Fatalf("expected only node1's node-level checks at index 10, got %v at %d", checks, meta.LastIndex)
+	}
+	queryOpts.WaitIndex = meta.LastIndex
+
+	// Changes on other nodes don't wake up the watch
+	result := make(chan uint64, 1)
+	go func() {
+		_, meta, _ := feed.Node("node1", &api.QueryOptions{WaitIndex: 10, WaitTime: time.Second})
+		result <- meta.LastIndex
+	}()
+	feed.update([]*api.HealthCheck{
+		{Node: "node1", CheckID: "serfHealth", Status: api.HealthPassing},
+		{Node: "node2", CheckID: "serfHealth", Status: api.HealthCritical},
+	}, nil, 11)
+
+	select {
+	case <-result:
+		t.Fatal("expected the query to keep blocking without changes to node1")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Changes on the watched node do
+	feed.update([]*api.HealthCheck{
+		{Node: "node1", CheckID: "serfHealth", Status: api.HealthCritical},
+		{Node: "node2", CheckID: "serfHealth", Status: api.HealthCritical},
+	}, nil, 12)
+
+	select {
+	case index := <-result:
+		if index != 12 {
+			t.Fatalf("expected index 12, got %d", index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the query to return after node1 changed")
+	}
+
+	// A node leaving the catalog counts as a change, with no checks left
+	feed.update([]*api.HealthCheck{
+		{Node: "node1", CheckID: "serfHealth", Status: api.HealthCritical},
+	}, nil, 13)
+	checks, meta, err = feed.Node("node2", &api.QueryOptions{WaitIndex: 12, WaitTime: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 0 || meta.LastIndex != 13 {
+		t.Fatalf("expected no checks for node2 at index 13, got %v at %d", checks, meta.LastIndex)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Matches the allocation ID suffix that Nomad jobs commonly add to service names, either the
+// full allocation UUID or its 8 character short form
+var nomadAllocSuffix = regexp.MustCompile(`-[0-9a-f]{8}(-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})?$`)
+
+// Returns the logical service name for a Nomad-registered service, with any allocation
+// ID suffix removed so the instances of a job are alerted on together
+func nomadServiceGroup(service string) string {
+	if group := nomadAllocSuffix.ReplaceAllString(service, ""); group != "" {
+		return group
+	}
+	return service
+}
+
+// Groups the given catalog services (as returned by the catalog services endpoint) by
+// their logical Nomad service name, merging their tags
+func groupNomadServices(services map[string][]string) (map[string][]string, map[string][]string) {
+	tags := make(map[string][]string)
+	members := make(map[string][]string)
+
+	for service, serviceTags := range services {
+		group := nomadServiceGroup(service)
+		members[group] = append(members[group], service)
+		for _, tag := range serviceTags {
+			if !contains(tags[group], tag) {
+				tags[group] = append(tags[group], tag)
+			}
+		}
+		if _, ok := tags[group]; !ok {
+			tags[group] = []string{}
+		}
+	}
+
+	for group, _ := range members {
+		sort.Strings(members[group])
+	}
+
+	return tags, members
+}
+
+// ServiceGroup is the set of catalog services a watch covers. It's kept up to date by
+// discovery as allocations come and go. Each member has its own blocking query with its own
+// index, so a change to any allocation wakes up the group's watches right away. The queries
+// only keep running while a watch is waiting on the group.
+type ServiceGroup struct {
+	lock    sync.Mutex
+	members []string
+
+	// The latest service entries for each member, and the index they were read at. A member
+	// without an index hasn't been loaded yet.
+	entries map[string][]*api.ServiceEntry
+	indexes map[string]uint64
+
+	// Whether all of the members have been loaded at some point
+	ready bool
+
+	// The group's index, raised past the member's index whenever a member changes so that
+	// the watches always see it go up
+	index uint64
+
+	// Whether each member has a query running, and the number of watches waiting on the group
+	querying map[string]bool
+	waiting  int
+
+	// The error from the last failed query, returned to the next watch to wait on the group
+	err error
+
+	// Closed and replaced whenever a member changes or a query fails, to wake up the watches
+	notify chan struct{}
+}
+
+func newServiceGroup(members []string) *ServiceGroup {
+	return &ServiceGroup{
+		members:  members,
+		entries:  make(map[string][]*api.ServiceEntry),
+		indexes:  make(map[string]uint64),
+		querying: make(map[string]bool),
+		notify:   make(chan struct{}),
+	}
+}
+
+func (g *ServiceGroup) set(members []string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.members = members
+
+	// Forget the entries of removed members so the watches drop their checks, and wake up
+	// the watches to start querying any new members
+	for member := range g.indexes {
+		if !contains(members, member) {
+			delete(g.entries, member)
+			delete(g.indexes, member)
+			g.changed(g.index)
+		}
+	}
+	g.wake()
+}
+
+// Raises the group's index for a change at the given index, and wakes up the watches. The
+// lock must be held.
+func (g *ServiceGroup) changed(index uint64) {
+	if index > g.index {
+		g.index = index
+	} else {
+		g.index++
+	}
+	g.wake()
+}
+
+// Returns whether all of the group's members have been loaded. The lock must be held.
+func (g *ServiceGroup) loaded() bool {
+	for _, member := range g.members {
+		if _, ok := g.indexes[member]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Wakes up the watches waiting on the group. The lock must be held.
+func (g *ServiceGroup) wake() {
+	close(g.notify)
+	g.notify = make(chan struct{})
+}
+
+// Runs the blocking query for a member of the group while watches are waiting on it
+func (g *ServiceGroup) query(client *api.Client, member string, queryOpts *api.QueryOptions) {
+	for {
+		g.lock.Lock()
+		opts := &api.QueryOptions{
+			AllowStale: queryOpts.AllowStale,
+			WaitIndex:  g.indexes[member],
+			WaitTime:   queryOpts.WaitTime,
+		}
+		g.lock.Unlock()
+
+		entries, queryMeta, err := client.Health().Service(member, "", false, opts)
+
+		g.lock.Lock()
+		if err != nil {
+			g.err = err
+			g.querying[member] = false
+			g.wake()
+			g.lock.Unlock()
+			return
+		}
+		if !contains(g.members, member) {
+			g.querying[member] = false
+			g.lock.Unlock()
+			return
+		}
+		if index, ok := g.indexes[member]; !ok || queryMeta.LastIndex != index {
+			// The members' first loads make up the group's first result, so only raise the
+			// group's index to theirs until then
+			g.entries[member] = entries
+			g.indexes[member] = queryMeta.LastIndex
+			if !g.ready && queryMeta.LastIndex <= g.index {
+				g.wake()
+			} else {
+				g.changed(queryMeta.LastIndex)
+			}
+			g.ready = g.ready || g.loaded()
+		}
+		if g.waiting == 0 {
+			g.querying[member] = false
+			g.lock.Unlock()
+			return
+		}
+		g.lock.Unlock()
+	}
+}
+
+// Fetches the health checks for each service in a group, leaving out the instances tagged
+// as canaries and (if set) the instances without all of the given tags. Like a blocking
+// query, it returns once any member has changed since queryOpts' WaitIndex, or after its
+// WaitTime.
+func fetchServiceGroupChecks(client *api.Client, group *ServiceGroup, canaryTags []string, tags []string, queryOpts *api.QueryOptions) ([]*api.HealthCheck, *api.QueryMeta, error) {
+	timeout := time.After(queryOpts.WaitTime)
+
+	group.lock.Lock()
+	group.waiting++
+	defer func() {
+		group.lock.Lock()
+		group.waiting--
+		group.lock.Unlock()
+	}()
+	group.lock.Unlock()
+
+	for {
+		group.lock.Lock()
+		for _, member := range group.members {
+			if !group.querying[member] {
+				group.querying[member] = true
+				go group.query(client, member, queryOpts)
+			}
+		}
+		loaded := group.loaded()
+		err := group.err
+		group.err = nil
+		index, notify := group.index, group.notify
+		var checks []*api.HealthCheck
+		if loaded {
+			checks = group.checks(canaryTags, tags)
+		}
+		group.lock.Unlock()
+
+		if err != nil {
+			return nil, nil, err
+		}
+		if loaded && (queryOpts.WaitIndex == 0 || index > queryOpts.WaitIndex) {
+			return checks, &api.QueryMeta{LastIndex: index}, nil
+		}
+
+		select {
+		case <-notify:
+		case <-timeout:
+			// Like a blocking query, the first load isn't cut short by the wait time
+			if loaded {
+				return checks, &api.QueryMeta{LastIndex: index}, nil
+			}
+			timeout = nil
+		}
+	}
+}
+
+// Returns the service checks of the group's members. The lock must be held.
+func (g *ServiceGroup) checks(canaryTags []string, tags []string) []*api.HealthCheck {
+	checks := make([]*api.HealthCheck, 0)
+	for _, member := range g.members {
+		checks = append(checks, serviceEntryChecks(g.entries[member], canaryTags, tags)...)
+	}
+	return checks
+}
+
+// Returns the service checks of the given service entries, leaving out the instances tagged
+// as canaries and (if set) the instances without all of the given tags
+func serviceEntryChecks(entries []*api.ServiceEntry, canaryTags []string, tags []string) []*api.HealthCheck {
+	checks := make([]*api.HealthCheck, 0)
+	for _, entry := range entries {
+		if isCanary(entry.Service.Tags, canaryTags) || !containsAll(entry.Service.Tags, tags) {
+			continue
+		}
+
+		// Service entries include the node's checks as well
+		for _, check := range entry.Checks {
+			if check.ServiceID == entry.Service.ID {
+				checks = append(checks, check)
+			}
+		}
+	}
+	return checks
+}
+
+// Returns true if an instance's tags mark it as a canary allocation
+func isCanary(tags []string, canaryTags []string) bool {
+	for _, tag := range tags {
+		if contains(canaryTags, tag) {
+			return true
+		}
+	}
+	return false
+}
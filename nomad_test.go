@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestNomad_serviceGroup(t *testing.T) {
+	cases := map[string]string{
+		"redis":           "redis",
+		"webapp-1a2b3c4d": "webapp",
+		"webapp-1a2b3c4d-5e6f-7a8b-9c0d-1e2f3a4b5c6d": "webapp",
+		"api-v2":         "api-v2",
+		"cache-DEADBEEF": "cache-DEADBEEF",
+		"-1a2b3c4d":      "-1a2b3c4d",
+	}
+	for service, expected := range cases {
+		if actual := nomadServiceGroup(service); actual != expected {
+			t.Errorf("expected group %q for %q, got %q", expected, service, actual)
+		}
+	}
+
+	tags, members := groupNomadServices(map[string][]string{
+		"webapp-1a2b3c4d": []string{"http"},
+		"webapp-9f8e7d6c": []string{"http", "canary"},
+		"redis":           []string{},
+	})
+	if expected := []string{"webapp-1a2b3c4d", "webapp-9f8e7d6c"}; !reflect.DeepEqual(members["webapp"], expected) {
+		t.Errorf("expected members %v, got %v", expected, members["webapp"])
+	}
+	if len(tags["webapp"]) != 2 || !contains(tags["webapp"], "canary") {
+		t.Errorf("expected merged tags, got %v", tags["webapp"])
+	}
+	if _, ok := tags["redis"]; !ok {
+		t.Error("expected redis to be kept")
+	}
+}
+
+func TestNomad_fetchServiceGroupChecks(t *testing.T) {
+	entries := map[string][]*api.ServiceEntry{
+		"webapp-1a2b3c4d": []*api.ServiceEntry{{
+			Node:    &api.Node{Node: "node1"},
+			Service: &api.AgentService{ID: "_nomad-1a2b3c4d", Service: "webapp-1a2b3c4d", Tags: []string{"http"}},
+			Checks: []*api.HealthCheck{
+				{Node: "node1", CheckID: "serfHealth", Status: api.HealthPassing},
+				{Node: "node1", CheckID: "alloc1", ServiceID: "_nomad-1a2b3c4d", Status: api.HealthPassing},
+			},
+		}},
+		"webapp-9f8e7d6c": []*api.ServiceEntry{{
+			Node:    &api.Node{Node: "node2"},
+			Service: &api.AgentService{ID: "_nomad-9f8e7d6c", Service: "webapp-9f8e7d6c", Tags: []string{"http", "canary"}},
+			Checks: []*api.HealthCheck{
+				{Node: "node2", CheckID: "alloc2", ServiceID: "_nomad-9f8e7d6c", Status: api.HealthCritical},
+			},
+		}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		w.Header().Set("X-Consul-Index", "5")
+		json.NewEncoder(w).Encode(entries[service])
+	}))
+	defer server.Close()
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := newServiceGroup([]string{"webapp-1a2b3c4d", "webapp-9f8e7d6c"})
+	checks, meta, err := fetchServiceGroupChecks(client, group, []string{"canary"}, nil, &api.QueryOptions{WaitTime: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the service check from the non-canary allocation should be returned
+	if len(checks) != 1 || checks[0].CheckID != "alloc1" {
+		t.Errorf("unexpected checks: %#v", checks)
+	}
+	if meta.LastIndex != 5 {
+		t.Errorf("expected index 5, got %d", meta.LastIndex)
+	}
+}
+
+func TestNomad_fetchServiceGroupChecksBlocking(t *testing.T) {
+	members := []string{"webapp-1a2b3c4d", "webapp-9f8e7d6c"}
+	var lock sync.Mutex
+	indexes := map[string]uint64{members[0]: 10, members[1]: 20}
+	statuses := map[string]string{members[0]: api.HealthPassing, members[1]: api.HealthPassing}
+	changed := make(chan struct{})
+	done := make(chan struct{})
+
+	// Serves each member with its own index, blocking while the requested index is current
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+		lock.Lock()
+		for indexes[service] == wait {
+			ch := changed
+			lock.Unlock()
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+			lock.Lock()
+		}
+		index, status := indexes[service], statuses[service]
+		lock.Unlock()
+
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		json.NewEncoder(w).Encode([]*api.ServiceEntry{{
+			Node:    &api.Node{Node: "node1"},
+			Service: &api.AgentService{ID: service, Service: service},
+			Checks:  []*api.HealthCheck{{Node: "node1", CheckID: service, ServiceID: service, Status: status}},
+		}})
+	}))
+	defer server.Close()
+	defer close(done)
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := newServiceGroup(members)
+	queryOpts := &api.QueryOptions{WaitTime: 10 * time.Second}
+	_, meta, err := fetchServiceGroupChecks(client, group, nil, nil, queryOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryOpts.WaitIndex = meta.LastIndex
+
+	// Change only the second member, which has to wake up the blocked fetch on its own
+	result := make(chan []*api.HealthCheck, 1)
+	go func() {
+		checks, _, err := fetchServiceGroupChecks(client, group, nil, nil, queryOpts)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- checks
+	}()
+
+	lock.Lock()
+	indexes[members[1]] = 21
+	statuses[members[1]] = api.HealthCritical
+	close(changed)
+	changed = make(chan struct{})
+	lock.Unlock()
+
+	select {
+	case checks := <-result:
+		if len(checks) != 2 || checks[1].CheckID != members[1] || checks[1].Status != api.HealthCritical {
+			t.Errorf("unexpected checks: %#v", checks)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch didn't return after the second member changed")
+	}
+}
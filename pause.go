@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The KV prefix paused watches are stored under, keyed by watch ID
+const pausedKVRoot = alertingKVRoot + "/paused/"
+
+// PausedWatch records that a watch was paused, and who paused it
+type PausedWatch struct {
+	Watch  string    `json:"watch"`
+	User   string    `json:"user"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// Returns the ID used to pause a watch: service:<name>, service:<name>:<tag> or node:<name>
+func watchID(opts *WatchOptions) string {
+	if opts.service == "" {
+		return NodeWatch + ":" + opts.node
+	}
+	if opts.tag != "" {
+		return ServiceWatch + ":" + opts.service + ":" + opts.tag
+	}
+	return ServiceWatch + ":" + opts.service
+}
+
+// Checks that the given watch ID is well-formed
+func validateWatchID(id string) error {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 || parts[1] == "" || !contains([]string{ServiceWatch, NodeWatch}, parts[0]) {
+		return fmt.Errorf("invalid watch %q, expected service:<name>, service:<name>:<tag> or node:<name>", id)
+	}
+	return nil
+}
+
+// Stores a paused watch in the KV store, so every instance stops alerting for it
+func pauseWatch(paused *PausedWatch, client *api.Client) error {
+	if err := validateWatchID(paused.Watch); err != nil {
+		return err
+	}
+
+	serialized, err := json.Marshal(paused)
+	if err != nil {
+		return fmt.Errorf("Error forming paused watch: %s", err)
+	}
+
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   pausedKVRoot + paused.Watch,
+		Value: serialized,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error pausing watch: %s", err)
+	}
+
+	return nil
+}
+
+// Removes a paused watch from the KV store
+func resumeWatch(id string, client *api.Client) error {
+	if err := validateWatchID(id); err != nil {
+		return err
+	}
+
+	_, err := client.KV().Delete(pausedKVRoot+id, nil)
+	if err != nil {
+		return fmt.Errorf("Error resuming watch: %s", err)
+	}
+	return nil
+}
+
+// Loads the paused watches from the KV store, keyed by watch ID
+func listPausedWatches(client *api.Client, queryOpts *api.QueryOptions) (map[string]PausedWatch, *api.QueryMeta, error) {
+	kvPairs, queryMeta, err := client.KV().List(pausedKVRoot, queryOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error listing paused watches: %s", err)
+	}
+
+	paused := make(map[string]PausedWatch)
+	for _, kvPair := range kvPairs {
+		id := strings.TrimPrefix(kvPair.Key, pausedKVRoot)
+
+		var watch PausedWatch
+		if err := json.Unmarshal(kvPair.Value, &watch); err != nil {
+			log.Errorf("Error parsing paused watch %s: %s", id, err)
+		}
+		watch.Watch = id
+		paused[id] = watch
+	}
+
+	return paused, queryMeta, nil
+}
+
+// Watches the paused watches in the KV store, keeping the config's copy up to date
+func watchPausedWatches(config *Config, client *api.Client) {
+	queryOpts := &api.QueryOptions{
+		AllowStale: true,
+		WaitTime:   watchWaitTime,
+	}
+
+	for {
+		paused, queryMeta, err := listPausedWatches(client, queryOpts)
+		if err != nil {
+			log.Errorf("%s, retrying in 10s...", err)
+			time.Sleep(errorWaitTime)
+			continue
+		}
+
+		// Skip the update if the blocking query just timed out
+		if queryMeta.LastIndex == queryOpts.WaitIndex {
+			continue
+		}
+		queryOpts.WaitIndex = queryMeta.LastIndex
+
+		config.setPausedWatches(paused)
+	}
+}
+
+// Replaces the set of paused watches
+func (c *Config) setPausedWatches(paused map[string]PausedWatch) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pausedWatches = paused
+}
+
+// Returns true if the watch with the given ID is paused
+func (c *Config) watchPaused(id string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, ok := c.pausedWatches[id]
+	return ok
+}
+
+const watchCommandUsage = `Usage: consul-alerting watch <pause|resume|list> [options] [watch]
+
+Pauses or resumes alerting for a single watch across every consul-alerting instance.
+Watches are given as service:<name>, service:<name>:<tag> or node:<name>.
+
+Options:
+
+    -config=<path>    Sets the path to a configuration file on disk, used for
+                      the Consul address and token.
+    -user=<name>      The user pausing the watch. Defaults to $USER.
+    -reason=<text>    Why the watch is being paused.
+`
+
+// Runs the `watch` subcommand, returning the exit code
+func watchCommand(args []string) int {
+	if len(args) < 1 {
+		fmt.Print(watchCommandUsage)
+		return 1
+	}
+	action := args[0]
+
+	// Keep the output to the command's results
+	log.SetLevel(log.WarnLevel)
+
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Print(watchCommandUsage) }
+	configPath := flags.String("config", "", "")
+	user := flags.String("user", os.Getenv("USER"), "")
+	reason := flags.String("reason", "", "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	config := DefaultConfig()
+	if *configPath != "" {
+		var err error
+		config, err = ParseConfigFile(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	client, err := newConsulClient(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	switch action {
+	case "list":
+		paused, _, err := listPausedWatches(client, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		ids := make([]string, 0, len(paused))
+		for id, _ := range paused {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			watch := paused[id]
+			fmt.Printf("%s\tpaused by %s at %s\t%s\n", id, watch.User, watch.Since.Format(time.RFC3339), watch.Reason)
+		}
+	case "pause", "resume":
+		if flags.NArg() != 1 {
+			fmt.Print(watchCommandUsage)
+			return 1
+		}
+		id := flags.Arg(0)
+
+		if action == "pause" {
+			err = pauseWatch(&PausedWatch{Watch: id, User: *user, Reason: *reason, Since: time.Now()}, client)
+		} else {
+			err = resumeWatch(id, client)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Watch %s %sd\n", id, action)
+	default:
+		fmt.Print(watchCommandUsage)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestPause_watchID(t *testing.T) {
+	cases := []struct {
+		opts     *WatchOptions
+		expected string
+	}{
+		{&WatchOptions{node: "node1"}, "node:node1"},
+		{&WatchOptions{service: "redis"}, "service:redis"},
+		{&WatchOptions{service: "redis", tag: "primary"}, "service:redis:primary"},
+	}
+	for _, c := range cases {
+		id := watchID(c.opts)
+		if id != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, id)
+		}
+		if err := validateWatchID(id); err != nil {
+			t.Errorf("expected %s to be valid: %s", id, err)
+		}
+	}
+
+	for _, id := range []string{"redis", "service:", "check:redis", ""} {
+		if err := validateWatchID(id); err == nil {
+			t.Errorf("expected %q to be invalid", id)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Package plugin lets alert handlers for consul-alerting be shipped as separate binaries,
+// which consul-alerting runs and sends alerts to over JSON-RPC on the plugin's stdin and
+// stdout.
+//
+// A handler plugin implements AlertHandler and calls Serve from its main function:
+//
+//	type handler struct{}
+//
+//	func (handler) Alert(alert *plugin.Alert) error {
+//		// deliver the alert somewhere
+//		return nil
+//	}
+//
+//	func main() {
+//		plugin.Serve(handler{})
+//	}
+//
+// It's then configured with a handler "plugin" block, such as
+// `handler "plugin" "mine" { command = "./my-handler" }`. Stdout carries the protocol, so
+// plugins should log to stderr, which consul-alerting logs as warnings.
+//
+// The protocol follows hashicorp/go-plugin's design (a magic cookie in the environment, a
+// version handshake on stdout, then RPC over the process's pipes) without depending on it:
+// go-plugin talks gRPC, which would vendor gRPC, protobuf and x/net for a single optional
+// handler, and would make plugins in other languages need a gRPC toolchain rather than a JSON
+// encoder.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+)
+
+// The environment variable consul-alerting starts plugins with, so that a plugin run by hand
+// exits with a message instead of waiting for requests on stdin. Its value is the protocol
+// version, which the plugin writes back on the first line of its stdout once it's ready.
+const (
+	MagicCookieKey  = "CONSUL_ALERTING_PLUGIN"
+	ProtocolVersion = "1"
+)
+
+// The JSON-RPC method alerts are sent to plugins with
+const alertMethod = "Plugin.Alert"
+
+// AlertHandler is implemented by handler plugins to deliver alerts. An error is returned if
+// the alert couldn't be delivered, which fails the alert in consul-alerting.
+type AlertHandler interface {
+	Alert(alert *Alert) error
+}
+
+// Alert is an alert as passed to handler plugins, in version 1 of the alert JSON contract
+// shared with exec handlers. Fields are only ever added within a version.
+type Alert struct {
+	Version     int               `json:"version"`
+	Datacenter  string            `json:"datacenter"`
+	Fingerprint string            `json:"fingerprint"`
+	Status      string            `json:"status"`
+	LastStatus  string            `json:"last_status"`
+	Node        string            `json:"node"`
+	Service     string            `json:"service"`
+	Tag         string            `json:"tag"`
+	Route       string            `json:"route"`
+	Team        string            `json:"team"`
+	Message     string            `json:"message"`
+	Details     string            `json:"details"`
+	Changed     int64             `json:"changed"`
+	Checks      []Check           `json:"checks"`
+	Fields      map[string]string `json:"fields"`
+	Labels      map[string]string `json:"labels"`
+	Links       *Links            `json:"links"`
+	DeliveryID  string            `json:"delivery_id"`
+}
+
+// Check is the state of one of the health checks behind an alert
+type Check struct {
+	Node    string `json:"node"`
+	CheckID string `json:"check_id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Output  string `json:"output"`
+}
+
+// Links are the signed URLs for acknowledging or silencing an alert
+type Links struct {
+	Ack     string `json:"ack"`
+	Silence string `json:"silence"`
+}
+
+// Serve runs a handler plugin on stdin and stdout until consul-alerting closes stdin. It
+// should be called from the plugin's main function.
+func Serve(handler AlertHandler) {
+	if version := os.Getenv(MagicCookieKey); version != ProtocolVersion {
+		if version == "" {
+			fmt.Fprintln(os.Stderr, "This binary is a consul-alerting handler plugin, and is meant to be run by consul-alerting.")
+		} else {
+			fmt.Fprintf(os.Stderr, "Unsupported plugin protocol version %s (this plugin supports %s)\n", version, ProtocolVersion)
+		}
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stdout, ProtocolVersion)
+	ServeConn(handler, stdio{})
+}
+
+// ServeConn serves a handler on a single connection until it's closed
+func ServeConn(handler AlertHandler, conn io.ReadWriteCloser) {
+	server := rpc.NewServer()
+	server.RegisterName("Plugin", &rpcServer{handler})
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// Passes alerts received over JSON-RPC to the plugin's handler
+type rpcServer struct {
+	handler AlertHandler
+}
+
+func (s *rpcServer) Alert(alert *Alert, reply *bool) error {
+	if err := s.handler.Alert(alert); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Client sends alerts to a running handler plugin
+type Client struct {
+	rpc *rpc.Client
+}
+
+// NewClient returns a client sending alerts over a connection to a plugin, such as the
+// plugin's stdin and stdout
+func NewClient(conn io.ReadWriteCloser) *Client {
+	return &Client{rpc: jsonrpc.NewClient(conn)}
+}
+
+// Dial reads the handshake a plugin starts its output with, and returns a client sending
+// alerts to the plugin over its stdin and stdout
+func Dial(stdin io.WriteCloser, stdout io.Reader) (*Client, error) {
+	r := bufio.NewReader(stdout)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("no handshake from plugin: %s", err)
+	}
+	if version := strings.TrimSpace(line); version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported handshake from plugin: %q (expected protocol version %s)", version, ProtocolVersion)
+	}
+	return NewClient(conn{r, stdin}), nil
+}
+
+// A plugin's stdout and stdin, as the client's side of its connection
+type conn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// Send passes an alert, already encoded as version 1 of the alert JSON, to the plugin and
+// returns the error the plugin's handler failed with, if any
+func (c *Client) Send(ctx context.Context, alert []byte) error {
+	var reply bool
+	call := c.rpc.Go(alertMethod, json.RawMessage(alert), &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Alert encodes and sends an alert to the plugin
+func (c *Client) Alert(alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	return c.Send(context.Background(), body)
+}
+
+// Close closes the connection to the plugin
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// The plugin's side of its connection to consul-alerting
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error                { return os.Stdout.Close() }
@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+type recordingHandler struct {
+	alerts []*Alert
+}
+
+func (h *recordingHandler) Alert(alert *Alert) error {
+	if alert.Message == "fail" {
+		return errors.New("couldn't deliver")
+	}
+	h.alerts = append(h.alerts, alert)
+	return nil
+}
+
+func TestHandlerPlugin(t *testing.T) {
+	handler := &recordingHandler{}
+	pluginConn, clientConn := net.Pipe()
+	go ServeConn(handler, pluginConn)
+
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	alert := &Alert{
+		Version:    1,
+		Datacenter: "dc1",
+		Service:    "redis",
+		Status:     "critical",
+		Checks:     []Check{{Node: "node1", CheckID: "service:redis", Status: "critical"}},
+	}
+	if err := client.Alert(alert); err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.alerts) != 1 || handler.alerts[0].Service != "redis" || handler.alerts[0].Checks[0].Node != "node1" {
+		t.Errorf("unexpected alerts: %#v", handler.alerts)
+	}
+
+	err := client.Alert(&Alert{Message: "fail"})
+	if err == nil || err.Error() != "couldn't deliver" {
+		t.Errorf("expected the handler's error, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// The handler types that make HTTP requests, and so can send them through a proxy
+var proxyHandlerTypes = []string{"slack", "pagerduty", "statuspage", "cachet", "teams", "webex", "alertmanager", "alerta", "nagios", "pubsub", "azure", "elasticsearch", "forward", "influx", "sns"}
+
+// The proxy URL schemes supported by the http transport
+var proxySchemes = []string{"http", "https", "socks5"}
+
+// The HTTP clients for each proxy, shared between handlers so connections to the proxy are reused
+var proxyClients = struct {
+	lock    sync.Mutex
+	clients map[string]*http.Client
+}{clients: make(map[string]*http.Client)}
+
+// Returns an error if the proxy isn't an http://, https:// or socks5:// URL
+func validateProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %q: %s", proxy, err)
+	}
+	if !contains(proxySchemes, u.Scheme) || u.Host == "" {
+		return fmt.Errorf("invalid proxy %q: must be an http://, https:// or socks5:// URL", proxy)
+	}
+	return nil
+}
+
+// Returns the HTTP client for a handler to send requests through the given proxy with, or the
+// default client (which uses the HTTP_PROXY/HTTPS_PROXY environment variables) if the proxy
+// isn't set. The proxy must have been validated.
+func proxyHTTPClient(proxy string) *http.Client {
+	if proxy == "" {
+		return http.DefaultClient
+	}
+
+	proxyClients.lock.Lock()
+	defer proxyClients.lock.Unlock()
+
+	if client, ok := proxyClients.clients[proxy]; ok {
+		return client
+	}
+
+	proxyURL, _ := url.Parse(proxy)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	client := &http.Client{Transport: transport}
+	proxyClients.clients[proxy] = client
+	return client
+}
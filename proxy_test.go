@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestProxy_config(t *testing.T) {
+	config, err := ParseConfig(`
+	proxy = "http://proxy.example.com:3128"
+	handler "slack" "ops" {
+		api_token = "token"
+		channel_name = "ops"
+	}
+	handler "pagerduty" "oncall" {
+		service_key = "key"
+		proxy = "socks5://127.0.0.1:1080"
+	}
+	handler "stdout" "log" {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proxy := config.Handlers["slack.ops"].(SlackHandler).Proxy; proxy != "http://proxy.example.com:3128" {
+		t.Errorf("expected the global proxy for slack.ops, got %q", proxy)
+	}
+	if proxy := config.Handlers["pagerduty.oncall"].(PagerdutyHandler).Proxy; proxy != "socks5://127.0.0.1:1080" {
+		t.Errorf("expected the handler's own proxy for pagerduty.oncall, got %q", proxy)
+	}
+
+	_, err = ParseConfig(`
+	handler "teams" "ops" {
+		webhook_url = "https://outlook.office.com/webhook/abc"
+		proxy = "proxy.example.com:3128"
+	}
+	`)
+	if err == nil || !strings.Contains(err.Error(), "Invalid config for handler teams.ops") {
+		t.Fatalf("expected invalid proxy error, got %v", err)
+	}
+}
+
+// Make sure PagerDuty events are sent through the handler's proxy
+func TestProxy_pagerduty(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Write([]byte(`{"status":"success","message":"Event processed"}`))
+	}))
+	defer proxy.Close()
+
+	defaultURL := pagerdutyEventsURL
+	pagerdutyEventsURL = "http://events.pagerduty.invalid/create_event.json"
+	defer func() { pagerdutyEventsURL = defaultURL }()
+
+	handler := PagerdutyHandler{ServiceKey: "key", Proxy: proxy.URL}
+	if err := handler.Alert("dc1", &AlertState{Service: "redis", Status: api.HealthCritical}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.URL.String() != pagerdutyEventsURL {
+		t.Errorf("expected the proxy to get a request for %s, got %s", pagerdutyEventsURL, r.URL)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// How often to try redelivering queued alerts
+const queueRetryInterval = 30 * time.Second
+
+var queueBucket = []byte("alerts")
+
+// DeliveryQueue is a local, disk-backed queue of alerts that couldn't be delivered
+// to a handler, so they can be sent once the handler's endpoint becomes reachable again
+type DeliveryQueue struct {
+	db *bolt.DB
+
+	// The number of queued alerts for each handler, so checking whether a handler has any
+	// doesn't have to read through the whole queue
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// A single undelivered alert stored in the queue
+type queuedAlert struct {
+	Handler    string     `json:"handler"`
+	Datacenter string     `json:"datacenter"`
+	Alert      AlertState `json:"alert"`
+	QueuedAt   time.Time  `json:"queued_at"`
+}
+
+// Opens (or creates) the queue database at the given path
+func openDeliveryQueue(path string) (*DeliveryQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening delivery queue at %s: %s", path, err)
+	}
+
+	counts := make(map[string]int)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(queueBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var entry queuedAlert
+			if err := json.Unmarshal(v, &entry); err == nil {
+				counts[entry.Handler]++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error initializing delivery queue: %s", err)
+	}
+
+	return &DeliveryQueue{db: db, counts: counts}, nil
+}
+
+// Closes the underlying queue database
+func (q *DeliveryQueue) close() error {
+	return q.db.Close()
+}
+
+// Adds an undelivered alert for the given handler to the end of the queue
+func (q *DeliveryQueue) push(handlerID string, datacenter string, alert *AlertState) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queueBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		serialized, err := json.Marshal(queuedAlert{
+			Handler:    handlerID,
+			Datacenter: datacenter,
+			Alert:      *alert,
+			QueuedAt:   time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(queueKey(seq), serialized)
+	})
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	q.counts[handlerID]++
+	q.lock.Unlock()
+	return nil
+}
+
+// Returns true if there are queued alerts waiting to be delivered to the given handler
+func (q *DeliveryQueue) pending(handlerID string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.counts[handlerID] > 0
+}
+
+// Returns the number of alerts in the queue
+func (q *DeliveryQueue) size() int {
+	count := 0
+	q.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(queueBucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+// Tries to deliver each queued alert in order, removing the ones that succeed. If a handler
+// fails, the rest of its alerts are left in the queue so they stay in order.
+func (q *DeliveryQueue) flush(handlers map[string]AlertHandler) {
+	type entry struct {
+		key   []byte
+		alert queuedAlert
+	}
+	entries := make([]entry, 0)
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).ForEach(func(k, v []byte) error {
+			var alert queuedAlert
+			if err := json.Unmarshal(v, &alert); err != nil {
+				log.Errorf("Dropping unreadable entry from delivery queue: %s", err)
+				entries = append(entries, entry{key: append([]byte{}, k...)})
+				return nil
+			}
+			entries = append(entries, entry{key: append([]byte{}, k...), alert: alert})
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error("Error reading delivery queue: ", err)
+		return
+	}
+
+	failed := make(map[string]bool)
+	delivered := make([]entry, 0)
+	for _, e := range entries {
+		if e.alert.Handler == "" {
+			delivered = append(delivered, e)
+			continue
+		}
+
+		if failed[e.alert.Handler] {
+			continue
+		}
+
+		handler, ok := handlers[e.alert.Handler]
+		if !ok {
+			log.Warnf("Dropping queued alert for removed handler %s", e.alert.Handler)
+			delivered = append(delivered, e)
+			continue
+		}
+
+		alert := e.alert.Alert
+		alert.Message = fmt.Sprintf("(delayed since %s) %s", e.alert.QueuedAt.Format(time.RFC3339), alert.Message)
+		if err := handler.Alert(e.alert.Datacenter, &alert); err != nil {
+			log.Warnf("Still unable to deliver queued alerts to %s: %s", e.alert.Handler, err)
+			failed[e.alert.Handler] = true
+			continue
+		}
+
+		log.Infof("Delivered queued alert to %s: %s", e.alert.Handler, e.alert.Alert.Message)
+		delivered = append(delivered, e)
+	}
+
+	if len(delivered) == 0 {
+		return
+	}
+
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queueBucket)
+		for _, e := range delivered {
+			if err := bucket.Delete(e.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Error removing delivered alerts from queue: ", err)
+		return
+	}
+
+	q.lock.Lock()
+	for _, e := range delivered {
+		if q.counts[e.alert.Handler]--; q.counts[e.alert.Handler] <= 0 {
+			delete(q.counts, e.alert.Handler)
+		}
+	}
+	q.lock.Unlock()
+}
+
+// Periodically tries to redeliver queued alerts until the stop channel is closed
+func (q *DeliveryQueue) run(config *Config, stopCh chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(queueRetryInterval):
+		}
+
+		if q.size() > 0 {
+			q.flush(config.handlerMap())
+		}
+	}
+}
+
+// Encodes a sequence number as a big-endian key so that the queue is ordered by insertion
+func queueKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// A handler that fails until it's told to recover, recording the alerts it delivers
+type testFlakyHandler struct {
+	down      *bool
+	delivered *[]AlertState
+}
+
+func (t testFlakyHandler) Alert(datacenter string, alert *AlertState) error {
+	if *t.down {
+		return errors.New("handler is down")
+	}
+	*t.delivered = append(*t.delivered, *alert)
+	return nil
+}
+
+func testDeliveryQueue(t *testing.T) (*DeliveryQueue, func()) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := openDeliveryQueue(path.Join(dir, "queue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return queue, func() {
+		queue.close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Alerts that fail to deliver should be queued and sent in order once the handler recovers
+func TestQueue_redeliver(t *testing.T) {
+	queue, cleanup := testDeliveryQueue(t)
+	defer cleanup()
+
+	down := true
+	delivered := make([]AlertState, 0)
+	config := &Config{
+		Handlers: map[string]AlertHandler{
+			"flaky": testFlakyHandler{&down, &delivered},
+		},
+		deliveryQueue: queue,
+	}
+
+	dispatchAlert(config, "", &AlertState{Status: api.HealthCritical, Message: "critical"})
+	if queue.size() != 1 || !queue.pending("flaky") {
+		t.Fatalf("expected 1 queued alert, got %d", queue.size())
+	}
+
+	// The handler is back, but new alerts should still wait behind the queued one
+	down = false
+	dispatchAlert(config, "", &AlertState{Status: api.HealthPassing, Message: "passing"})
+	if len(delivered) != 0 || queue.size() != 2 {
+		t.Fatalf("expected new alert to be queued behind the failed one (delivered: %d, queued: %d)",
+			len(delivered), queue.size())
+	}
+
+	queue.flush(config.Handlers)
+
+	if queue.size() != 0 || queue.pending("flaky") {
+		t.Fatalf("expected empty queue, got %d", queue.size())
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("expected 2 delivered alerts, got %d", len(delivered))
+	}
+	if delivered[0].Status != api.HealthCritical || delivered[1].Status != api.HealthPassing {
+		t.Errorf("alerts delivered out of order: %s, %s", delivered[0].Status, delivered[1].Status)
+	}
+	if !strings.HasPrefix(delivered[0].Message, "(delayed since ") || !strings.HasSuffix(delivered[0].Message, "critical") {
+		t.Errorf("expected delayed annotation, got '%s'", delivered[0].Message)
+	}
+}
+
+// Queued alerts should be kept while the handler is still failing
+func TestQueue_stillFailing(t *testing.T) {
+	queue, cleanup := testDeliveryQueue(t)
+	defer cleanup()
+
+	down := true
+	delivered := make([]AlertState, 0)
+	handlers := map[string]AlertHandler{
+		"flaky": testFlakyHandler{&down, &delivered},
+	}
+
+	queue.push("flaky", "dc1", &AlertState{Message: "first"})
+	queue.push("removed", "dc1", &AlertState{Message: "second"})
+	queue.flush(handlers)
+
+	if queue.size() != 1 || !queue.pending("flaky") || queue.pending("removed") {
+		t.Fatalf("expected only the failing handler's alert to remain, got %d", queue.size())
+	}
+
+	// The counts are rebuilt from the queue when it's reopened
+	path := queue.db.Path()
+	queue.close()
+	reopened, err := openDeliveryQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.close()
+	if !reopened.pending("flaky") || reopened.pending("removed") {
+		t.Errorf("unexpected pending handlers after reopening: %v", reopened.counts)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The ways of probing whether a node is reachable from the alerting instance
+const (
+	ReachabilityTCP  = "tcp"
+	ReachabilityICMP = "icmp"
+)
+
+var reachabilityProbes = []string{"", ReachabilityTCP, ReachabilityICMP}
+
+// The sequence number of the next ICMP echo request
+var icmpSeq uint32
+
+// Adds the result of probing a failing node from the alerting instance to its alert details,
+// if reachability_probe is set, to tell a node that's down (or cut off from the network)
+// apart from one that's up with failing checks. Service alerts aren't probed.
+func applyReachability(alert *AlertState, config *Config, client *api.Client) *AlertState {
+	if config.ReachabilityProbe == "" || alert.Service != "" || alert.Node == "" ||
+		(alert.Status != api.HealthCritical && alert.Status != api.HealthWarning) {
+		return alert
+	}
+
+	node, _, err := client.Catalog().Node(alert.Node, nil)
+	if err != nil {
+		log.Errorf("Error looking up the address of node %s for a reachability probe: %s", alert.Node, err)
+		return alert
+	}
+	if node == nil || node.Node == nil {
+		return alert
+	}
+
+	timeout := time.Duration(config.ReachabilityTimeout) * time.Second
+	note := reachabilityNote(alert.Node, node.Node.Address, config.ReachabilityProbe, config.ReachabilityPort, timeout)
+
+	notification := *alert
+	notification.Details = strings.TrimSpace(note + "\n" + alert.Details)
+	return &notification
+}
+
+// Probes a node's address and describes the result
+func reachabilityNote(node string, address string, probe string, port int, timeout time.Duration) string {
+	var method string
+	var rtt time.Duration
+	var err error
+	switch probe {
+	case ReachabilityICMP:
+		method = "icmp echo"
+		rtt, err = probeICMP(address, timeout)
+	default:
+		method = fmt.Sprintf("tcp port %d", port)
+		rtt, err = probeTCP(net.JoinHostPort(address, strconv.Itoa(port)), timeout)
+	}
+
+	if err != nil {
+		return fmt.Sprintf("Reachability: node %s (%s) is unreachable from the alerter too (%s: %s)", node, address, method, err)
+	}
+	return fmt.Sprintf("Reachability: node %s (%s) is reachable from the alerter (%s in %s), only its checks are failing",
+		node, address, method, rtt.Round(time.Millisecond))
+}
+
+// Connects to a TCP port, returning how long it took
+func probeTCP(address string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// Sends an ICMP echo request and waits for the reply, returning the round trip time. This
+// needs a raw socket, so the process must run as root or have CAP_NET_RAW.
+func probeICMP(address string, timeout time.Duration) (time.Duration, error) {
+	ip, err := net.ResolveIPAddr("ip4", address)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open ICMP socket: %s", err)
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	seq := uint16(atomic.AddUint32(&icmpSeq, 1))
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+
+	if _, err := conn.WriteTo(icmpEchoRequest(id, seq), ip); err != nil {
+		return 0, err
+	}
+
+	// Other echo replies (such as for concurrent probes) arrive on the same socket
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n >= 8 && buf[0] == 0 && from.String() == ip.String() &&
+			binary.BigEndian.Uint16(buf[4:]) == id && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// Builds an ICMP echo request message
+func icmpEchoRequest(id uint16, seq uint16) []byte {
+	msg := append([]byte{8, 0, 0, 0, 0, 0, 0, 0}, "consul-alerting"...)
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	return msg
+}
+
+// Computes the internet checksum of an ICMP message
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
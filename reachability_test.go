@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestReachability_tcpNote(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	note := reachabilityNote("node1", "127.0.0.1", ReachabilityTCP, port, time.Second)
+	if !strings.Contains(note, "is reachable from the alerter") || !strings.Contains(note, "only its checks are failing") {
+		t.Errorf("unexpected note for a reachable node: %s", note)
+	}
+
+	// Nothing is listening once the listener is closed
+	listener.Close()
+	note = reachabilityNote("node1", "127.0.0.1", ReachabilityTCP, port, time.Second)
+	if !strings.HasPrefix(note, "Reachability: node node1 (127.0.0.1) is unreachable from the alerter too") {
+		t.Errorf("unexpected note for an unreachable node: %s", note)
+	}
+}
+
+func TestReachability_skipped(t *testing.T) {
+	config, err := ParseConfig(`reachability_probe = "tcp"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Service alerts and recoveries aren't probed, so the client is never used
+	for _, alert := range []*AlertState{
+		{Service: "redis", Status: api.HealthCritical, Details: "details"},
+		{Node: "node1", Status: api.HealthPassing, Details: "details"},
+	} {
+		if notification := applyReachability(alert, config, nil); notification != alert {
+			t.Errorf("expected %+v not to be probed", alert)
+		}
+	}
+}
+
+func TestReachability_icmpChecksum(t *testing.T) {
+	msg := icmpEchoRequest(0x1234, 1)
+	if msg[0] != 8 || msg[1] != 0 {
+		t.Fatalf("expected an echo request, got type %d code %d", msg[0], msg[1])
+	}
+
+	// A message with a valid checksum sums to zero
+	if sum := icmpChecksum(msg); sum != 0 {
+		t.Errorf("expected a valid checksum, got %#x", sum)
+	}
+}
+
+func TestReachability_invalidProbe(t *testing.T) {
+	if _, err := ParseConfig(`reachability_probe = "udp"`); err == nil {
+		t.Fatal("expected an error for an unknown probe")
+	}
+}
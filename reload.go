@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// ConfigDiff describes what changed between two versions of the config
+type ConfigDiff struct {
+	HandlersAdded   []string
+	HandlersRemoved []string
+	HandlersChanged []string
+
+	ServicesAdded   []string
+	ServicesRemoved []string
+	ServicesChanged []string
+
+	DefaultHandlersChanged  bool
+	ChangeThresholdChanged  bool
+	ReminderIntervalChanged bool
+	NewEntityAlertsChanged  bool
+	LogLevelChanged         bool
+	OutputPatternsChanged   bool
+	DiffSettingsChanged     bool
+	UnknownStatusChanged    bool
+	RunbooksChanged         bool
+	TiersChanged            bool
+	CheckStateCacheChanged  bool
+	TeamsChanged            bool
+	HandlerGroupsChanged    bool
+	NodeRoutesChanged       bool
+	WatchHooksChanged       bool
+	WatchIndexChanged       bool
+
+	// Settings that changed but only take effect after a restart
+	RestartRequired []string
+}
+
+// Returns true if nothing changed
+func (d *ConfigDiff) empty() bool {
+	return len(d.HandlersAdded) == 0 && len(d.HandlersRemoved) == 0 && len(d.HandlersChanged) == 0 &&
+		len(d.ServicesAdded) == 0 && len(d.ServicesRemoved) == 0 && len(d.ServicesChanged) == 0 &&
+		!d.DefaultHandlersChanged && !d.ChangeThresholdChanged && !d.ReminderIntervalChanged &&
+		!d.NewEntityAlertsChanged && !d.LogLevelChanged && !d.OutputPatternsChanged && !d.DiffSettingsChanged &&
+		!d.UnknownStatusChanged && !d.RunbooksChanged && !d.TiersChanged && !d.CheckStateCacheChanged &&
+		!d.TeamsChanged && !d.HandlerGroupsChanged && !d.NodeRoutesChanged && !d.WatchHooksChanged &&
+		!d.WatchIndexChanged && len(d.RestartRequired) == 0
+}
+
+// Returns the sorted names of the services whose running watches pick up a change from the
+// diff. If a global default changed, every service relying on it is affected.
+func (d *ConfigDiff) affectedServices(new *Config) []string {
+	affected := make(map[string]bool)
+	for _, list := range [][]string{d.ServicesAdded, d.ServicesRemoved, d.ServicesChanged} {
+		for _, service := range list {
+			affected[service] = true
+		}
+	}
+
+	// Services with their own handlers/threshold don't use the global defaults
+	for name, service := range new.Services {
+		if (d.DefaultHandlersChanged || d.TiersChanged || len(d.HandlersAdded) > 0 || len(d.HandlersRemoved) > 0 ||
+			len(d.HandlersChanged) > 0) && len(service.Handlers) == 0 {
+			affected[name] = true
+		}
+	}
+
+	services := make([]string, 0, len(affected))
+	for service, _ := range affected {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// Computes the differences between two configs
+func diffConfig(old *Config, new *Config) *ConfigDiff {
+	diff := &ConfigDiff{}
+
+	diff.HandlersAdded, diff.HandlersRemoved, diff.HandlersChanged = diffKeys(
+		reflect.ValueOf(old.Handlers), reflect.ValueOf(new.Handlers))
+	diff.ServicesAdded, diff.ServicesRemoved, diff.ServicesChanged = diffKeys(
+		reflect.ValueOf(old.Services), reflect.ValueOf(new.Services))
+
+	diff.DefaultHandlersChanged = !reflect.DeepEqual(old.DefaultHandlers, new.DefaultHandlers)
+	diff.ChangeThresholdChanged = old.ChangeThreshold != new.ChangeThreshold
+	diff.ReminderIntervalChanged = old.ReminderInterval != new.ReminderInterval
+	diff.NewEntityAlertsChanged = old.NewEntityAlerts != new.NewEntityAlerts
+	diff.LogLevelChanged = old.LogLevel != new.LogLevel
+	diff.OutputPatternsChanged = !reflect.DeepEqual(old.IgnoreOutputPatterns, new.IgnoreOutputPatterns) ||
+		old.OutputPatternStatus != new.OutputPatternStatus
+	diff.DiffSettingsChanged = old.DiffStrategy != new.DiffStrategy ||
+		!reflect.DeepEqual(old.IgnoreChecks, new.IgnoreChecks)
+	diff.UnknownStatusChanged = old.UnknownStatus != new.UnknownStatus
+	diff.RunbooksChanged = !reflect.DeepEqual(old.Runbooks, new.Runbooks)
+	diff.TiersChanged = !reflect.DeepEqual(old.Tiers, new.Tiers)
+	diff.CheckStateCacheChanged = old.CheckStateCacheSize != new.CheckStateCacheSize ||
+		old.CheckStateCacheTotal != new.CheckStateCacheTotal
+	diff.TeamsChanged = mapChanged(old.Teams, new.Teams)
+	diff.HandlerGroupsChanged = mapChanged(old.HandlerGroups, new.HandlerGroups)
+	diff.NodeRoutesChanged = mapChanged(old.NodeRoutes, new.NodeRoutes)
+	diff.WatchHooksChanged = mapChanged(old.WatchHooks, new.WatchHooks)
+	diff.WatchIndexChanged = old.WatchIndexInterval != new.WatchIndexInterval
+
+	restartSettings := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"consul_address", old.ConsulAddress, new.ConsulAddress},
+		{"consul_token", old.ConsulToken, new.ConsulToken},
+		{"node_name", old.NodeName, new.NodeName},
+		{"agentless", old.Agentless, new.Agentless},
+		{"node_watch", old.NodeWatch, new.NodeWatch},
+		{"node_watch_sharding", old.NodeWatchSharding, new.NodeWatchSharding},
+		{"service_watch", old.ServiceWatch, new.ServiceWatch},
+		{"watch_backend", old.WatchBackend, new.WatchBackend},
+		{"self_throttle", old.SelfThrottle, new.SelfThrottle},
+		{"throttle_rtt", old.ThrottleRTT, new.ThrottleRTT},
+		{"throttle_error_rate", old.ThrottleErrorRate, new.ThrottleErrorRate},
+		{"queue_path", old.QueuePath, new.QueuePath},
+		{"dispatch_workers", old.DispatchWorkers, new.DispatchWorkers},
+		{"shutdown_timeout", old.ShutdownTimeout, new.ShutdownTimeout},
+		{"max_notifications", old.MaxNotifications, new.MaxNotifications},
+		{"refresh_details", old.RefreshDetails, new.RefreshDetails},
+		{"status_address", old.StatusAddress, new.StatusAddress},
+		{"status_tls_cert", old.StatusTLSCert, new.StatusTLSCert},
+		{"status_tls_key", old.StatusTLSKey, new.StatusTLSKey},
+		{"status_tls_client_ca", old.StatusTLSClientCA, new.StatusTLSClientCA},
+		{"status_username", old.StatusUsername, new.StatusUsername},
+		{"status_password", old.StatusPassword, new.StatusPassword},
+		{"status_token", old.StatusToken, new.StatusToken},
+		{"delivery_tracking", old.DeliveryTracking, new.DeliveryTracking},
+		{"delivery_intents", old.DeliveryIntents, new.DeliveryIntents},
+		{"reachability_probe", old.ReachabilityProbe, new.ReachabilityProbe},
+		{"reachability_port", old.ReachabilityPort, new.ReachabilityPort},
+		{"reachability_timeout", old.ReachabilityTimeout, new.ReachabilityTimeout},
+		{"entity_metrics", strings.Join(old.EntityMetrics, ","), strings.Join(new.EntityMetrics, ",")},
+		{"entity_metrics_limit", old.EntityMetricsLimit, new.EntityMetricsLimit},
+		{"pagerduty_webhook_token", old.PagerdutyWebhookToken, new.PagerdutyWebhookToken},
+		{"ack_link_secret", old.AckLinkSecret, new.AckLinkSecret},
+		{"ack_link_base_url", old.AckLinkBaseURL, new.AckLinkBaseURL},
+		{"ack_link_ttl", old.AckLinkTTL, new.AckLinkTTL},
+		{"ack_link_silence", old.AckLinkSilence, new.AckLinkSilence},
+		{"log_level_key", old.LogLevelKey, new.LogLevelKey},
+		{"discovery_cache_dir", old.DiscoveryCacheDir, new.DiscoveryCacheDir},
+		{"fatal_on_reload_error", old.FatalOnReloadError, new.FatalOnReloadError},
+		{"removal_threshold", old.RemovalThreshold, new.RemovalThreshold},
+		{"removal_grace_period", old.RemovalGracePeriod, new.RemovalGracePeriod},
+		{"service_meta_config", old.ServiceMetaConfig, new.ServiceMetaConfig},
+		{"catalog_audit_interval", old.CatalogAuditInterval, new.CatalogAuditInterval},
+		{"janitor_interval", old.JanitorInterval, new.JanitorInterval},
+		{"stale_alert_age", old.StaleAlertAge, new.StaleAlertAge},
+		{"nomad_compat", old.NomadCompat, new.NomadCompat},
+		{"nomad_canary_tags", strings.Join(old.NomadCanaryTags, ","), strings.Join(new.NomadCanaryTags, ",")},
+		{"deployment_prefix", old.DeploymentPrefix, new.DeploymentPrefix},
+		{"health_summary_prefix", old.HealthSummaryPrefix, new.HealthSummaryPrefix},
+		{"health_summary_node", old.HealthSummaryNode, new.HealthSummaryNode},
+		{"event_log_path", old.EventLogPath, new.EventLogPath},
+		{"history_size", old.HistorySize, new.HistorySize},
+		{"shadow_mode", old.ShadowMode, new.ShadowMode},
+		{"shadow_kv_prefix", old.ShadowKVPrefix, new.ShadowKVPrefix},
+		{"aggregator_address", old.AggregatorAddress, new.AggregatorAddress},
+		{"aggregator_token", old.AggregatorToken, new.AggregatorToken},
+		{"aggregator_tls_cert", old.AggregatorTLSCert, new.AggregatorTLSCert},
+		{"aggregator_tls_key", old.AggregatorTLSKey, new.AggregatorTLSKey},
+		{"aggregator_history_size", old.AggregatorHistorySize, new.AggregatorHistorySize},
+		{"aggregator_signing_secret", old.AggregatorSigningSecret, new.AggregatorSigningSecret},
+		{"aggregator_replay_window", old.AggregatorReplayWindow, new.AggregatorReplayWindow},
+	}
+	// The datacenter is filled in from the agent if it isn't set in the file
+	if new.ConsulDatacenter != "" {
+		restartSettings = append(restartSettings, struct {
+			name     string
+			old, new interface{}
+		}{"datacenter", old.ConsulDatacenter, new.ConsulDatacenter})
+	}
+	if !reflect.DeepEqual(old.HTTPWatches, new.HTTPWatches) {
+		diff.RestartRequired = append(diff.RestartRequired, "http_watch")
+	}
+	if !reflect.DeepEqual(old.Composites, new.Composites) {
+		diff.RestartRequired = append(diff.RestartRequired, "composite")
+	}
+	for _, setting := range restartSettings {
+		if setting.old != setting.new {
+			diff.RestartRequired = append(diff.RestartRequired, setting.name)
+		}
+	}
+
+	return diff
+}
+
+// Compares two maps with string keys, returning the sorted keys that were added, removed
+// and whose values changed
+func diffKeys(old reflect.Value, new reflect.Value) ([]string, []string, []string) {
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	changed := make([]string, 0)
+
+	for _, key := range new.MapKeys() {
+		oldVal := old.MapIndex(key)
+		if !oldVal.IsValid() {
+			added = append(added, key.String())
+		} else if !reflect.DeepEqual(comparableValue(oldVal.Interface()), comparableValue(new.MapIndex(key).Interface())) {
+			changed = append(changed, key.String())
+		}
+	}
+	for _, key := range old.MapKeys() {
+		if !new.MapIndex(key).IsValid() {
+			removed = append(removed, key.String())
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// Returns true if any keys of two maps with string keys were added, removed or changed
+func mapChanged(old interface{}, new interface{}) bool {
+	added, removed, changed := diffKeys(reflect.ValueOf(old), reflect.ValueOf(new))
+	return len(added) > 0 || len(removed) > 0 || len(changed) > 0
+}
+
+// Returns a version of a config value that can be compared with reflect.DeepEqual. Handlers
+// with middleware are compared by their settings, since their built chains hold functions,
+// and node routes by their patterns rather than the compiled versions.
+func comparableValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case MiddlewareHandler:
+		value.chain = nil
+		return value
+	case NodeRouteConfig:
+		value.checkPatterns, value.notePatterns, value.outputPatterns = nil, nil, nil
+		return value
+	}
+	return v
+}
+
+// Logs a structured description of the diff
+func logConfigDiff(diff *ConfigDiff, affected []string) {
+	if diff.empty() {
+		log.Info("Reloaded config, no changes found")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"handlers_added":            diff.HandlersAdded,
+		"handlers_removed":          diff.HandlersRemoved,
+		"handlers_changed":          diff.HandlersChanged,
+		"services_added":            diff.ServicesAdded,
+		"services_removed":          diff.ServicesRemoved,
+		"services_changed":          diff.ServicesChanged,
+		"default_handlers_changed":  diff.DefaultHandlersChanged,
+		"change_threshold_changed":  diff.ChangeThresholdChanged,
+		"reminder_interval_changed": diff.ReminderIntervalChanged,
+		"new_entity_alerts_changed": diff.NewEntityAlertsChanged,
+		"log_level_changed":         diff.LogLevelChanged,
+		"output_patterns_changed":   diff.OutputPatternsChanged,
+		"diff_settings_changed":     diff.DiffSettingsChanged,
+		"unknown_status_changed":    diff.UnknownStatusChanged,
+		"runbooks_changed":          diff.RunbooksChanged,
+		"tiers_changed":             diff.TiersChanged,
+		"check_state_cache_changed": diff.CheckStateCacheChanged,
+		"teams_changed":             diff.TeamsChanged,
+		"handler_groups_changed":    diff.HandlerGroupsChanged,
+		"node_routes_changed":       diff.NodeRoutesChanged,
+		"watch_hooks_changed":       diff.WatchHooksChanged,
+		"watch_index_changed":       diff.WatchIndexChanged,
+	}).Info("Reloaded config")
+
+	if len(affected) > 0 {
+		log.WithField("services", affected).Info("Updated running watches for reloaded config")
+	}
+
+	if diff.DefaultHandlersChanged || diff.ChangeThresholdChanged || diff.ReminderIntervalChanged ||
+		diff.NewEntityAlertsChanged || diff.OutputPatternsChanged || diff.DiffSettingsChanged ||
+		diff.UnknownStatusChanged || diff.RunbooksChanged || diff.TiersChanged || diff.CheckStateCacheChanged ||
+		diff.WatchIndexChanged {
+		log.Info("Updated running watches for all services using the global defaults")
+	}
+
+	if len(diff.RestartRequired) > 0 {
+		log.WithField("settings", diff.RestartRequired).Warn("Some changed settings only take effect after a restart")
+	}
+}
+
+// Re-reads the config file and applies the settings that can be changed at runtime
+// (handlers, services, teams, handler groups, node routes, watch hooks, tiers, thresholds,
+// reminders, diff settings, unknown_status, runbooks, check state cache limits, the watch index
+// interval and log level) to the running config
+func reloadConfig(path string, config *Config, client *api.Client) {
+	if path == "" {
+		log.Warn("No config file was given, nothing to reload")
+		return
+	}
+
+	newConfig, err := ParseConfigFile(path)
+	if err != nil {
+		reloadFailed(config, client, err)
+		return
+	}
+
+	level, err := log.ParseLevel(newConfig.LogLevel)
+	if err != nil {
+		reloadFailed(config, client, fmt.Errorf("invalid log_level '%s'", newConfig.LogLevel))
+		return
+	}
+
+	for _, warning := range lintConfig(newConfig) {
+		log.Warn(warning)
+	}
+
+	config.lock.Lock()
+	diff := diffConfig(config, newConfig)
+	affected := diff.affectedServices(newConfig)
+
+	config.Handlers = newConfig.Handlers
+	config.Services = newConfig.Services
+	config.servicePatterns = newConfig.servicePatterns
+	config.Teams = newConfig.Teams
+	config.routing = nil
+	config.HandlerGroups = newConfig.HandlerGroups
+	config.NodeRoutes = newConfig.NodeRoutes
+	config.WatchHooks = newConfig.WatchHooks
+	config.Tiers = newConfig.Tiers
+	config.DefaultHandlers = newConfig.DefaultHandlers
+	config.ChangeThreshold = newConfig.ChangeThreshold
+	config.ReminderInterval = newConfig.ReminderInterval
+	config.NewEntityAlerts = newConfig.NewEntityAlerts
+	config.LogLevel = newConfig.LogLevel
+	config.IgnoreOutputPatterns = newConfig.IgnoreOutputPatterns
+	config.OutputPatternStatus = newConfig.OutputPatternStatus
+	config.outputPatterns = newConfig.outputPatterns
+	config.Runbooks = newConfig.Runbooks
+	config.runbooks = newConfig.runbooks
+	config.DiffStrategy = newConfig.DiffStrategy
+	config.IgnoreChecks = newConfig.IgnoreChecks
+	config.UnknownStatus = newConfig.UnknownStatus
+	config.CheckStateCacheSize = newConfig.CheckStateCacheSize
+	config.CheckStateCacheTotal = newConfig.CheckStateCacheTotal
+	config.WatchIndexInterval = newConfig.WatchIndexInterval
+	config.lock.Unlock()
+
+	stopUnusedPlugins(newConfig.Handlers)
+
+	log.SetLevel(reloadedLogLevel(config, client, level))
+	logConfigDiff(diff, affected)
+}
+
+// Handles a config that failed to reload. The current config is kept, unless
+// fatal_on_reload_error is set, in which case the failure is treated as fatal so that a
+// broken config doesn't go unnoticed until the next restart.
+func reloadFailed(config *Config, client *api.Client, err error) {
+	if config.FatalOnReloadError {
+		fatalError(config, client, ExitConfig, fmt.Errorf("Error reloading config: %s", err))
+	}
+	log.Errorf("Error reloading config, keeping the current one: %s", err)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+const testReloadConfigOld = `
+change_threshold = 30
+default_handlers = ["stdout.log"]
+
+service "redis" {
+	change_threshold = 15
+}
+
+service "webapp" {
+	handlers = ["email.admin"]
+}
+
+handler "stdout" "log" {
+	log_level = "warn"
+}
+
+handler "email" "admin" {
+	recipients = ["admin@example.com"]
+}
+`
+
+const testReloadConfigNew = `
+change_threshold = 30
+default_handlers = ["stdout.log"]
+service_watch = "global"
+
+service "redis" {
+	change_threshold = 45
+}
+
+service "nginx" {}
+
+handler "stdout" "log" {
+	log_level = "error"
+}
+
+handler "slack" "dev" {
+	api_token = "token"
+	channel_name = "alerts"
+}
+`
+
+func TestReload_diffConfig(t *testing.T) {
+	old, err := ParseConfig(testReloadConfigOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := ParseConfig(testReloadConfigNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &ConfigDiff{
+		HandlersAdded:   []string{"slack.dev"},
+		HandlersRemoved: []string{"email.admin"},
+		HandlersChanged: []string{"stdout.log"},
+		ServicesAdded:   []string{"nginx"},
+		ServicesRemoved: []string{"webapp"},
+		ServicesChanged: []string{"redis"},
+		RestartRequired: []string{"service_watch"},
+	}
+
+	diff := diffConfig(old, new)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expected, diff)
+	}
+
+	affected := diff.affectedServices(new)
+	if !reflect.DeepEqual(affected, []string{"nginx", "redis", "webapp"}) {
+		t.Fatalf("unexpected affected services: %v", affected)
+	}
+
+	if !diffConfig(old, old).empty() {
+		t.Fatal("expected an empty diff for the same config")
+	}
+}
+
+// Make sure changes to the blocks swapped in on reload show up in the diff, and that parsing
+// the same blocks twice doesn't
+func TestReload_diffConfigBlocks(t *testing.T) {
+	const blocks = `
+	team "db" {
+		pagerduty_key = "key1"
+	}
+	handler_group "oncall" {
+		members = ["pagerduty.team_db"]
+	}
+	node_route "disk" {
+		checks = ["^disk"]
+		team = "db"
+	}
+	watch_hook "inventory" {
+		url = "https://inventory.example.com/hooks"
+	}
+	`
+	old, err := ParseConfig(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := ParseConfig(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffConfig(old, same); !diff.empty() {
+		t.Fatalf("expected an empty diff, got %#v", diff)
+	}
+
+	new, err := ParseConfig(`
+	team "db" {
+		pagerduty_key = "key2"
+	}
+	node_route "disk" {
+		checks = ["^disk", "^inode"]
+		team = "db"
+	}
+	watch_index_interval = 60
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ConfigDiff{
+		HandlersRemoved:      []string{},
+		TeamsChanged:         true,
+		HandlerGroupsChanged: true,
+		NodeRoutesChanged:    true,
+		WatchHooksChanged:    true,
+		WatchIndexChanged:    true,
+	}
+	diff := diffConfig(old, new)
+	diff.HandlersAdded, diff.HandlersChanged = nil, nil
+	diff.ServicesAdded, diff.ServicesRemoved, diff.ServicesChanged = nil, nil, nil
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("expected \n%#v\n\n, got \n\n%#v\n\n", expected, diff)
+	}
+}
+
+func TestReload_reloadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	config, err := ParseConfig(testReloadConfigOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte(testReloadConfigNew), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloadConfig(file.Name(), config, nil)
+
+	if config.serviceChangeThreshold("redis") != 45 {
+		t.Errorf("expected reloaded change threshold of 45, got %d", config.serviceChangeThreshold("redis"))
+	}
+
+	if _, ok := config.handler("slack.dev"); !ok {
+		t.Error("expected new handler to be loaded")
+	}
+
+	// Settings that require a restart should be left alone
+	if config.ServiceWatch != LocalMode {
+		t.Errorf("expected service_watch to stay %s, got %s", LocalMode, config.ServiceWatch)
+	}
+
+	// A broken config should leave the current one in place
+	if err := ioutil.WriteFile(file.Name(), []byte(`node_watch = "bogus"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(file.Name(), config, nil)
+
+	if _, ok := config.handler("slack.dev"); !ok {
+		t.Error("expected config to be kept after a failed reload")
+	}
+}
+
+// Reloads the config file in TEST_RELOAD_CONFIG when started by TestReload_fatalOnReloadError
+func TestReloadHelperProcess(t *testing.T) {
+	path := os.Getenv("TEST_RELOAD_CONFIG")
+	if path == "" {
+		return
+	}
+	reloadConfig(path, &Config{FatalOnReloadError: true}, nil)
+	os.Exit(0)
+}
+
+func TestReload_fatalOnReloadError(t *testing.T) {
+	file, err := ioutil.TempFile("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := ioutil.WriteFile(file.Name(), []byte(`node_watch = "bogus"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestReloadHelperProcess")
+	cmd.Env = append(os.Environ(), "TEST_RELOAD_CONFIG="+file.Name())
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != ExitConfig {
+		t.Errorf("expected the reload to exit with code %d, got %v", ExitConfig, err)
+	}
+}
+
+// Make sure a reload keeps the level from log_level_key while it's set
+func TestReload_logLevelKey(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/consul-alerting/log-level" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "5")
+		w.Write([]byte(`[{"Key": "consul-alerting/log-level", "Value": "` + base64.StdEncoding.EncodeToString([]byte("debug")) + `"}]`))
+	}))
+	defer server.Close()
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if err := ioutil.WriteFile(file.Name(), []byte(testReloadConfigNew), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ParseConfig(testReloadConfigOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.LogLevelKey = "consul-alerting/log-level"
+
+	reloadConfig(file.Name(), config, client)
+	if level := log.GetLevel(); level != log.DebugLevel {
+		t.Errorf("expected the key's level to be kept, got %s", level)
+	}
+
+	// Without the key, the reloaded log_level applies
+	config.LogLevelKey = "consul-alerting/missing"
+	reloadConfig(file.Name(), config, client)
+	if level := log.GetLevel(); level != log.InfoLevel {
+		t.Errorf("expected log_level to be applied, got %s", level)
+	}
+}
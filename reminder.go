@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Re-checks the health of a watch's node/service directly against Consul and, if it's still
+// failing with the status that was last alerted on, re-sends the alert with the current check
+// output. This keeps the notifications for long incidents from only showing the output from
+// when the incident started. tracked is the set of check hashes that count towards the
+// watch's health.
+func sendReminder(alertPath string, mode string, name string, tracked map[string]bool, opts *WatchOptions) {
+	// Use a consistent read rather than the (possibly stale) results the watch is using
+	queryOpts := &api.QueryOptions{RequireConsistent: true}
+
+	var checks []*api.HealthCheck
+	var err error
+	if mode == NodeWatch {
+		checks, _, err = opts.client.Health().Node(opts.node, queryOpts)
+	} else {
+		checks, _, err = opts.client.Health().Checks(opts.service, queryOpts)
+	}
+	if err != nil {
+		log.Errorf("Error re-checking health for reminder on %s: %s", name, err)
+		return
+	}
+
+	patterns, mutedStatus := opts.config.serviceOutputPatterns(opts.service)
+	checks = muteCheckOutputs(checks, patterns, mutedStatus)
+
+	current := make(map[string]string)
+	for _, check := range checks {
+		key := check.Node + "/" + check.CheckID
+		if tracked[key] {
+			current[key] = check.Status
+		}
+	}
+	status := computeHealth(current)
+
+	opts.alertLock.Lock()
+	alert, err := getAlertState(alertPath, opts.client)
+	if err != nil {
+		log.Error("Error fetching alert state: ", err)
+		opts.alertLock.Unlock()
+		return
+	}
+
+	// Leave any change in status to the regular alerting path
+	if alert == nil || alert.LastAlerted == api.HealthPassing || alert.LastAlerted != status {
+		log.Debugf("Skipping reminder for %s, current status is %s", name, status)
+		opts.alertLock.Unlock()
+		return
+	}
+
+	// The on-call already knows about acked alerts
+	if alertAcked(alert, opts.client) {
+		log.Debugf("Skipping reminder for %s, which was acknowledged in PagerDuty", name)
+		opts.alertLock.Unlock()
+		return
+	}
+
+	if mode == NodeWatch {
+		alert.Details = nodeDetails(checks, opts.config.checkRunbooks())
+	} else {
+		alert.Details = serviceDetails(checks, opts.config.checkRunbooks())
+	}
+	alert.Checks = failingCheckSummaries(checks, mode)
+
+	// Count the reminder towards the incident's notifications before storing the alert state
+	reminder := *alert
+	reminder.Message = fmt.Sprintf("[%s] Reminder: %s is still %s", opts.config.ConsulDatacenter, name, status)
+	notification, _ := applyDeploymentWindow(&reminder, opts.config, time.Now())
+	notify, notification := applySnooze(notification, opts.client)
+	capped := false
+	if notify {
+		notify, notification = spendNotification(alert, notification, opts.config.MaxNotifications)
+		capped = !notify
+	}
+
+	if err := setAlertState(alertPath, alert, opts.client); err != nil {
+		log.Error("Error setting alert state: ", err)
+	}
+	opts.alertLock.Unlock()
+
+	if notify {
+		log.Infof("Sending reminder for %s (%s)", name, status)
+		dispatchAlert(opts.config, opts.service, notification)
+		opts.config.logEvent(EventReminder, notification)
+	} else if capped {
+		opts.config.logEvent(EventCapped, alert)
+	}
+}
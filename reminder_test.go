@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// A service that stays critical should get a reminder, but one that recovered shouldn't
+func TestReminder_sendReminder(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	server.AddService(testServiceName, structs.HealthCritical, nil)
+
+	config, alertCh := testAlertConfig()
+	config.ConsulDatacenter = "dc1"
+	opts := &WatchOptions{
+		service:   testServiceName,
+		client:    client,
+		config:    config,
+		alertLock: &sync.Mutex{},
+	}
+
+	alertPath := alertingKVRoot + "/service/" + testServiceName + "/alert"
+	err := setAlertState(alertPath, &AlertState{
+		Service:     testServiceName,
+		Status:      structs.HealthCritical,
+		LastAlerted: structs.HealthCritical,
+		Details:     "old output",
+	}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracked := map[string]bool{
+		server.Config.NodeName + "/service:" + testServiceName: true,
+	}
+	sendReminder(alertPath, ServiceWatch, "service "+testServiceName, tracked, opts)
+
+	select {
+	case alert := <-alertCh:
+		if !strings.Contains(alert.Message, "Reminder") {
+			t.Errorf("expected a reminder, got %q", alert.Message)
+		}
+		if alert.Details == "old output" {
+			t.Error("expected the reminder to have refreshed details")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get a reminder within the timeout")
+	}
+
+	// Once the service recovers, reminders stop
+	server.AddService(testServiceName, structs.HealthPassing, nil)
+	sendReminder(alertPath, ServiceWatch, "service "+testServiceName, tracked, opts)
+
+	select {
+	case alert := <-alertCh:
+		t.Fatalf("expected no reminder, got %q", alert.Message)
+	case <-time.After(1 * time.Second):
+	}
+}
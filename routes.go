@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// NodeRouteConfig claims the checks on each node matching its patterns, so that they're
+// alerted on separately from the rest of the node, through the route's own handlers. This lets
+// a node's checks be split between owners, such as disk checks going to a storage team. Checks
+// can be matched by their ID and name, or by their notes and output, so that teams can claim
+// checks by annotating them (such as with "team:db") in their own check definitions.
+type NodeRouteConfig struct {
+	Name     string
+	Checks   []string `mapstructure:"checks"`
+	Notes    []string `mapstructure:"notes"`
+	Output   []string `mapstructure:"output"`
+	Handlers []string `mapstructure:"handlers"`
+	Team     string   `mapstructure:"team"`
+
+	// Compiled versions of Checks, Notes and Output
+	checkPatterns  []*regexp.Regexp
+	notePatterns   []*regexp.Regexp
+	outputPatterns []*regexp.Regexp
+}
+
+// Returns true if the route claims the check, by its ID or name, notes or output
+func (r *NodeRouteConfig) matches(check *api.HealthCheck) bool {
+	for _, pattern := range r.checkPatterns {
+		if pattern.MatchString(check.CheckID) || pattern.MatchString(check.Name) {
+			return true
+		}
+	}
+	for _, pattern := range r.notePatterns {
+		if pattern.MatchString(check.Notes) {
+			return true
+		}
+	}
+	for _, pattern := range r.outputPatterns {
+		if pattern.MatchString(check.Output) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse the raw node route objects into the config
+func parseNodeRoutes(list *ast.ObjectList, config *Config) error {
+	for _, r := range list.Items {
+		name := r.Keys[0].Token.Value().(string)
+
+		var m map[string]interface{}
+		var route NodeRouteConfig
+		if err := hcl.DecodeObject(&m, r.Val); err != nil {
+			return err
+		}
+
+		if err := mapstructure.WeakDecode(m, &route); err != nil {
+			return err
+		}
+		route.Name = name
+
+		if len(route.Checks) == 0 && len(route.Notes) == 0 && len(route.Output) == 0 {
+			return fmt.Errorf("No checks, notes or output given for node route %s", name)
+		}
+		var err error
+		if route.checkPatterns, err = compilePatterns(route.Checks); err != nil {
+			return fmt.Errorf("Invalid checks for node route %s: %s", name, err)
+		}
+		if route.notePatterns, err = compilePatterns(route.Notes); err != nil {
+			return fmt.Errorf("Invalid notes for node route %s: %s", name, err)
+		}
+		if route.outputPatterns, err = compilePatterns(route.Output); err != nil {
+			return fmt.Errorf("Invalid output for node route %s: %s", name, err)
+		}
+
+		if len(route.Handlers) == 0 && route.Team == "" {
+			return fmt.Errorf("No handlers or team given for node route %s", name)
+		}
+		for _, id := range route.Handlers {
+			_, isGroup := config.HandlerGroups[id]
+			if _, ok := config.Handlers[id]; !ok && !isGroup {
+				return fmt.Errorf("Unknown handler for node route %s: %s", name, id)
+			}
+		}
+		if _, ok := config.Teams[route.Team]; route.Team != "" && !ok {
+			return fmt.Errorf("Unknown team for node route %s: %s", name, route.Team)
+		}
+		route.Handlers = config.expandHandlerGroups(route.Handlers)
+
+		config.NodeRoutes[name] = route
+	}
+
+	return nil
+}
+
+// The checks and check statuses claimed by a node route
+type routedChecks struct {
+	checks   []*api.HealthCheck
+	statuses map[string]string
+}
+
+// Splits a node's checks (and their statuses, keyed by node/checkID) between the node routes.
+// Checks that don't match any route are returned under the empty route name. If a check matches
+// more than one route, the first by name wins. Returns nil if there are no node routes.
+func (c *Config) splitNodeRoutes(checks []*api.HealthCheck, statuses map[string]string) map[string]*routedChecks {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if len(c.NodeRoutes) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(c.NodeRoutes))
+	for name, _ := range c.NodeRoutes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	routes := map[string]*routedChecks{
+		"": &routedChecks{statuses: make(map[string]string)},
+	}
+	checkRoutes := make(map[string]string)
+	for _, check := range checks {
+		route := ""
+		for _, name := range names {
+			nodeRoute := c.NodeRoutes[name]
+			if nodeRoute.matches(check) {
+				route = name
+				break
+			}
+		}
+
+		if _, ok := routes[route]; !ok {
+			routes[route] = &routedChecks{statuses: make(map[string]string)}
+		}
+		routes[route].checks = append(routes[route].checks, check)
+		checkRoutes[check.Node+"/"+check.CheckID] = route
+	}
+
+	for key, status := range statuses {
+		routes[checkRoutes[key]].statuses[key] = status
+	}
+
+	return routes
+}
+
+// Returns the sorted IDs of the alert handlers for a node route, including its team's handlers
+func (c *Config) nodeRouteHandlerIDs(route string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	nodeRoute, ok := c.NodeRoutes[route]
+	if !ok {
+		return []string{}
+	}
+
+	ids := append([]string{}, nodeRoute.Handlers...)
+	if team, ok := c.Teams[nodeRoute.Team]; ok {
+		ids = append(ids, team.handlerIDs...)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestRoutes_splitNodeRoutes(t *testing.T) {
+	config, err := ParseConfig(`
+	node_route "storage" {
+		checks = ["^disk"]
+		team = "storage"
+	}
+
+	node_route "infra" {
+		checks = ["ntp", "disk-latency"]
+		handlers = ["stdout.infra"]
+	}
+
+	team "storage" {
+		email = ["storage@example.com"]
+	}
+
+	handler "stdout" "infra" {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []*api.HealthCheck{
+		{Node: "node1", CheckID: "disk-usage", Name: "Disk usage", Status: api.HealthCritical},
+		{Node: "node1", CheckID: "disk-latency", Name: "Disk latency", Status: api.HealthPassing},
+		{Node: "node1", CheckID: "check-2", Name: "ntp drift", Status: api.HealthWarning},
+		{Node: "node1", CheckID: "serfHealth", Name: "Serf Health Status", Status: api.HealthPassing},
+	}
+	statuses := map[string]string{
+		"node1/disk-usage":   api.HealthCritical,
+		"node1/disk-latency": api.HealthPassing,
+		"node1/check-2":      api.HealthWarning,
+		"node1/serfHealth":   api.HealthPassing,
+	}
+
+	routes := config.splitNodeRoutes(checks, statuses)
+	expected := map[string]map[string]string{
+		"":        {"node1/serfHealth": api.HealthPassing},
+		"storage": {"node1/disk-usage": api.HealthCritical},
+		"infra":   {"node1/disk-latency": api.HealthPassing, "node1/check-2": api.HealthWarning},
+	}
+	if len(routes) != len(expected) {
+		t.Fatalf("expected %d routes, got %d", len(expected), len(routes))
+	}
+	for route, expectedStatuses := range expected {
+		if !reflect.DeepEqual(routes[route].statuses, expectedStatuses) {
+			t.Errorf("expected statuses %v for route %q, got %v", expectedStatuses, route, routes[route].statuses)
+		}
+		if len(routes[route].checks) != len(expectedStatuses) {
+			t.Errorf("expected %d checks for route %q, got %d", len(expectedStatuses), route, len(routes[route].checks))
+		}
+	}
+
+	if ids := config.nodeRouteHandlerIDs("storage"); !reflect.DeepEqual(ids, []string{"email.team_storage"}) {
+		t.Errorf("unexpected handlers for storage route: %v", ids)
+	}
+
+	// Route alerts go to the route's handlers and have their own fingerprint
+	alert := &AlertState{Node: "node1", Route: "storage"}
+	if alertFingerprint(alert) == alertFingerprint(&AlertState{Node: "node1"}) {
+		t.Error("expected route alerts to have their own fingerprint")
+	}
+	if name := alertName(alert); name != "node node1 (route: storage)" {
+		t.Errorf("unexpected alert name: %s", name)
+	}
+
+	// Without node routes, checks aren't split
+	if routes := DefaultConfig().splitNodeRoutes(checks, statuses); routes != nil {
+		t.Errorf("expected no routes, got %v", routes)
+	}
+
+	for _, raw := range []string{
+		`node_route "a" { handlers = ["stdout.x"] }`,
+		`node_route "a" { checks = ["disk"] }`,
+		`node_route "a" { checks = ["disk"], handlers = ["stdout.missing"] }`,
+		`node_route "a" { checks = ["("], team = "missing" }`,
+		`node_route "a" { notes = ["("], handlers = ["stdout.x"] }`,
+	} {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for config: %s", raw)
+		}
+	}
+}
+
+func TestRoutes_notesAndOutput(t *testing.T) {
+	config, err := ParseConfig(`
+	node_route "db" {
+		notes = ["\\bteam:db\\b"]
+		handlers = ["stdout.db"]
+	}
+
+	node_route "network" {
+		output = ["^owner=network"]
+		handlers = ["stdout.network"]
+	}
+
+	handler "stdout" "db" {}
+	handler "stdout" "network" {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []*api.HealthCheck{
+		{Node: "node1", CheckID: "pg-replication", Notes: "Replication lag. team:db", Status: api.HealthCritical},
+		{Node: "node1", CheckID: "pg-backup", Notes: "team:dba", Status: api.HealthPassing},
+		{Node: "node1", CheckID: "uplink", Output: "owner=network: packet loss 20%", Status: api.HealthWarning},
+		{Node: "node1", CheckID: "serfHealth", Status: api.HealthPassing},
+	}
+	statuses := map[string]string{
+		"node1/pg-replication": api.HealthCritical,
+		"node1/pg-backup":      api.HealthPassing,
+		"node1/uplink":         api.HealthWarning,
+		"node1/serfHealth":     api.HealthPassing,
+	}
+
+	routes := config.splitNodeRoutes(checks, statuses)
+	expected := map[string]map[string]string{
+		"":        {"node1/pg-backup": api.HealthPassing, "node1/serfHealth": api.HealthPassing},
+		"db":      {"node1/pg-replication": api.HealthCritical},
+		"network": {"node1/uplink": api.HealthWarning},
+	}
+	for route, expectedStatuses := range expected {
+		if routes[route] == nil || !reflect.DeepEqual(routes[route].statuses, expectedStatuses) {
+			t.Errorf("expected statuses %v for route %q, got %v", expectedStatuses, route, routes[route])
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// routingTable holds the handler IDs every alert can be sent to, computed once when the
+// config is loaded (and again when it's reloaded), so that dispatching an alert only does map
+// lookups rather than filtering the handlers each time. Services configured through their
+// meta aren't in the table, since their settings can change at any time.
+type routingTable struct {
+	// The handler IDs for each service block (by its name, which may be a pattern), by tier
+	services map[string]map[string][]string
+
+	// The handler IDs for services without a service block, by tier
+	defaults map[string][]string
+
+	// The service block each service name resolves to, filled in as services are looked up so
+	// each service's patterns are only matched once
+	blockLock sync.Mutex
+	blocks    map[string]string
+
+	// Routing problems found while building the table, reported by the config lint
+	conflicts []string
+}
+
+// Returns the config's routing table, building it if this is the first use since the config
+// was loaded or reloaded. Assumes the config lock is held.
+func (c *Config) routingLocked() *routingTable {
+	c.routingLock.Lock()
+	defer c.routingLock.Unlock()
+
+	if c.routing == nil {
+		c.routing = c.buildRoutingTable()
+	}
+	return c.routing
+}
+
+// Builds the routing table for the config. Assumes the config lock is held.
+func (c *Config) buildRoutingTable() *routingTable {
+	table := &routingTable{
+		services:  make(map[string]map[string][]string),
+		defaults:  make(map[string][]string),
+		blocks:    make(map[string]string),
+		conflicts: make([]string, 0),
+	}
+
+	// The empty tier is used for alerts whose class isn't routed through any tier
+	tiers := append([]string{""}, tierNames...)
+	for _, tier := range tiers {
+		table.defaults[tier] = c.filterHandlerIDsLocked(c.serviceHandlerFiltersLocked(nil, tier))
+	}
+
+	for name, service := range c.Services {
+		table.services[name] = make(map[string][]string)
+		for _, tier := range tiers {
+			table.services[name][tier] = c.filterHandlerIDsLocked(c.serviceHandlerFiltersLocked(&service, tier))
+		}
+
+		// Handlers listed for a service that don't exist are otherwise silently skipped
+		for _, id := range service.Handlers {
+			if _, ok := c.Handlers[id]; !ok {
+				table.conflicts = append(table.conflicts, fmt.Sprintf("Service %s lists handler %s, which doesn't exist", name, id))
+			}
+		}
+		if len(table.services[name][""]) == 0 {
+			table.conflicts = append(table.conflicts, fmt.Sprintf("Service %s has no handlers to send its alerts to", name))
+		}
+	}
+
+	sort.Strings(table.conflicts)
+	return table
+}
+
+// Returns the name of the service block for a service: its own block, or the first block
+// with a matching pattern, or an empty string if neither exists
+func (t *routingTable) serviceBlock(service string, patterns []servicePattern) string {
+	if _, ok := t.services[service]; ok {
+		return service
+	}
+
+	t.blockLock.Lock()
+	defer t.blockLock.Unlock()
+
+	block, ok := t.blocks[service]
+	if !ok {
+		block = matchServicePattern(service, patterns)
+		t.blocks[service] = block
+	}
+	return block
+}
+
+// Returns the handler IDs for alerts on a service block (or services without one, for an empty
+// name) routed through the given tier
+func (t *routingTable) serviceHandlerIDs(block string, tier string) []string {
+	byTier, ok := t.services[block]
+	if !ok {
+		byTier = t.defaults
+	}
+	if ids, ok := byTier[tier]; ok {
+		return ids
+	}
+	return byTier[""]
+}
+
+// Returns the name of the first service block whose pattern matches the service, or an empty
+// string if none do
+func matchServicePattern(service string, patterns []servicePattern) string {
+	for _, pattern := range patterns {
+		if pattern.matches(service) {
+			return pattern.name
+		}
+	}
+	return ""
+}
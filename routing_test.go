@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouting_table(t *testing.T) {
+	config, err := ParseConfig(`
+	default_handlers = ["stdout.log"]
+
+	handler "stdout" "log" {}
+	handler "stdout" "api" {}
+	handler "stdout" "page" {}
+
+	tier "page" {
+		handlers = ["stdout.page"]
+	}
+
+	service "api-*" {
+		handlers = ["stdout.api"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		service  string
+		tier     string
+		expected []string
+	}{
+		{"api-users", "", []string{"stdout.api"}},
+		{"api-users", TierPage, []string{"stdout.api"}},
+		{"web", "", []string{"stdout.log"}},
+		{"web", TierPage, []string{"stdout.page"}},
+		// Tiers without their own block fall back to the default handlers
+		{"web", TierWarn, []string{"stdout.log"}},
+	}
+	for _, tc := range cases {
+		if ids := config.serviceTierHandlerIDs(tc.service, tc.tier); !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("%s (tier %q): expected %v, got %v", tc.service, tc.tier, tc.expected, ids)
+		}
+	}
+
+	// Pattern matches are remembered, including services that don't match any pattern
+	expected := map[string]string{"api-users": "api-*", "web": ""}
+	if !reflect.DeepEqual(config.routing.blocks, expected) {
+		t.Errorf("expected resolved blocks %v, got %v", expected, config.routing.blocks)
+	}
+
+	// The table is rebuilt after a reload
+	config.routing = nil
+	if ids := config.serviceHandlerIDs("api-users"); !reflect.DeepEqual(ids, []string{"stdout.api"}) {
+		t.Errorf("unexpected handlers after rebuilding the table: %v", ids)
+	}
+}
+
+func TestRouting_conflicts(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "stdout" "log" {}
+
+	service "redis" {
+		handlers = ["stdout.missing"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"Service redis has no handlers to send its alerts to",
+		"Service redis lists handler stdout.missing, which doesn't exist",
+	}
+	if conflicts := config.routingLocked().conflicts; !reflect.DeepEqual(conflicts, expected) {
+		t.Fatalf("expected conflicts %v, got %v", expected, conflicts)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// A runbook link for the checks whose name or ID matches a pattern
+type checkRunbook struct {
+	pattern *regexp.Regexp
+	url     string
+}
+
+// Compiles the runbooks mapping of check patterns to links, ordered by pattern so checks
+// matching several patterns always list their links in the same order
+func compileRunbooks(raw map[string]string) ([]checkRunbook, error) {
+	patterns := make([]string, 0, len(raw))
+	for pattern, _ := range raw {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	var runbooks []checkRunbook
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		runbooks = append(runbooks, checkRunbook{pattern: compiled, url: raw[pattern]})
+	}
+	return runbooks, nil
+}
+
+// Returns the runbook lines to add after a failing check's output in the alert details
+func runbookLinks(check *api.HealthCheck, runbooks []checkRunbook) string {
+	links := ""
+	for _, runbook := range runbooks {
+		if runbook.pattern.MatchString(check.Name) || runbook.pattern.MatchString(check.CheckID) {
+			links = links + fmt.Sprintf("Runbook: %s\n", runbook.url)
+		}
+	}
+
+	if links != "" && check.Output != "" && !strings.HasSuffix(check.Output, "\n") {
+		links = "\n" + links
+	}
+	return links
+}
+
+// Returns the compiled runbook links for checks
+func (c *Config) checkRunbooks() []checkRunbook {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.runbooks
+}
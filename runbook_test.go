@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestRunbook_details(t *testing.T) {
+	config, err := ParseConfig(`
+	runbooks {
+		"^disk" = "https://wiki.example.com/runbooks/disk"
+		"redis" = "https://wiki.example.com/runbooks/redis"
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []*api.HealthCheck{
+		{Node: "node1", CheckID: "disk-usage", Name: "disk usage", Status: api.HealthCritical, Output: "97% full"},
+		{Node: "node1", CheckID: "service:redis", Name: "redis ping", Status: api.HealthWarning, Output: "slow\n"},
+		{Node: "node1", CheckID: "disk-iops", Name: "disk iops", Status: api.HealthPassing, Output: "ok"},
+		{Node: "node1", CheckID: "memory", Name: "memory", Status: api.HealthCritical, Output: "oom"},
+	}
+
+	details := serviceDetails(checks, config.checkRunbooks())
+	for _, expected := range []string{
+		"==> (check) disk usage:\n97% full\nRunbook: https://wiki.example.com/runbooks/disk\n",
+		"==> (check) redis ping:\nslow\nRunbook: https://wiki.example.com/runbooks/redis\n",
+	} {
+		if !strings.Contains(details, expected) {
+			t.Errorf("expected details to contain %q, got:\n%s", expected, details)
+		}
+	}
+
+	// Passing checks and checks without a runbook don't get links
+	if strings.Count(details, "Runbook:") != 2 {
+		t.Errorf("expected 2 runbook links, got:\n%s", details)
+	}
+
+	_, err = ParseConfig(`runbooks { "(unclosed" = "https://wiki.example.com" }`)
+	if err == nil || !strings.Contains(err.Error(), "Invalid runbooks") {
+		t.Fatalf("expected invalid runbooks error, got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Logs the payload a handler with sandbox set would have sent to the destination, instead of
+// sending it. Sandboxed handlers render their payloads exactly as they otherwise would, so
+// templates and routing can be checked against production traffic without notifying anyone.
+func logSandboxPayload(handlerType string, destination string, payload string) {
+	log.WithFields(log.Fields{
+		"handler":     handlerType,
+		"destination": destination,
+	}).Infof("Not sending %s alert from sandboxed handler, payload:\n%s", handlerType, payload)
+}
+
+// Formats a payload as indented JSON for logging
+func sandboxJSON(payload interface{}) string {
+	formatted, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%+v", payload)
+	}
+	return string(formatted)
+}
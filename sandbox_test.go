@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// Capture the standard logger's output while running f
+func captureLog(f func()) string {
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	f()
+	return buf.String()
+}
+
+// Sandboxed handlers should log their payloads without sending anything
+func TestSandbox_handlers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request from sandboxed handler: %s %s", r.Method, r.URL.Path)
+	}))
+	defer server.Close()
+
+	alert := &AlertState{
+		Service: "redis",
+		Status:  api.HealthCritical,
+		Message: "redis is now critical",
+		Details: "connection refused",
+	}
+
+	cases := map[string]AlertHandler{
+		"pagerduty":  PagerdutyHandler{ServiceKey: "secret-key", Sandbox: true},
+		"slack":      SlackHandler{Token: "token", ChannelName: "alerts", Sandbox: true},
+		"email":      EmailHandler{Recipients: []string{"ops@example.invalid"}, MaxRetries: 5, Sandbox: true},
+		"teams":      TeamsHandler{WebhookURL: server.URL, Sandbox: true},
+		"forward":    ForwardHandler{Address: server.URL, Sandbox: true},
+		"statuspage": StatuspageHandler{PageID: "page", Components: map[string]string{"redis": "c1"}, CriticalStatus: "major_outage", BaseURL: server.URL, Sandbox: true},
+		"sns":        SNSHandler{TopicARN: "arn:aws:sns:us-east-1:123456789012:alerts", Endpoint: server.URL, Sandbox: true},
+		"snmp":       SNMPHandler{Address: "127.0.0.1:1", Version: "2c", Community: "public", TrapOID: "1.3.6.1.4.1.1", VarbindOID: "1.3.6.1.4.1.2", Sandbox: true},
+	}
+
+	for name, handler := range cases {
+		var err error
+		output := captureLog(func() {
+			err = handler.Alert("dc1", alert)
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		}
+		if !strings.Contains(output, "Not sending "+name+" alert from sandboxed handler") {
+			t.Errorf("%s: expected payload to be logged, got: %s", name, output)
+		}
+		if name != "snmp" && !strings.Contains(output, "redis is now critical") && !strings.Contains(output, "major_outage") {
+			t.Errorf("%s: expected rendered alert in payload, got: %s", name, output)
+		}
+	}
+
+	if size := emailQueue.size(); size != 0 {
+		t.Errorf("expected no emails to be queued, got %d", size)
+	}
+}
+
+func TestSandbox_redacted(t *testing.T) {
+	alert := &AlertState{Status: api.HealthCritical, Message: "web is now critical"}
+
+	output := captureLog(func() {
+		PagerdutyHandler{ServiceKey: "secret-key", Sandbox: true}.Alert("dc1", alert)
+		TeamsHandler{WebhookURL: "https://example.invalid/webhook/secret-url", Sandbox: true}.Alert("dc1", alert)
+	})
+	for _, secret := range []string{"secret-key", "secret-url"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("expected %s to be left out of the sandbox log, got: %s", secret, output)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// How far apart the two deployments' alerts can be and still be considered the same alert in
+// a shadow report, by default
+const shadowReportTolerance = 5 * time.Minute
+
+// The kinds of divergence in a shadow report
+const (
+	// The active deployment sent an alert the shadow wouldn't have
+	ShadowMissing = "missing"
+
+	// The shadow would have sent an alert the active deployment didn't
+	ShadowExtra = "extra"
+
+	// Both sent the alert, but to different handlers
+	ShadowRerouted = "rerouted"
+)
+
+// Set in shadow mode, so that removing expired snoozes and acks is left to the active
+// deployment
+var shadowing int32
+
+func shadowed() bool {
+	return atomic.LoadInt32(&shadowing) == 1
+}
+
+// Returns the KV prefix the watches keep their check and alert states under, which is the
+// shadow_kv_prefix in shadow mode
+func (c *Config) stateKVRoot() string {
+	if c.ShadowMode {
+		return c.ShadowKVPrefix
+	}
+	return alertingKVRoot
+}
+
+// Returns the KV prefix the alert histories are kept under
+func (c *Config) historyKVPrefix() string {
+	return c.stateKVRoot() + "/history/"
+}
+
+// Returns the KV path a shadow deployment records when it started shadowing at
+func shadowStartedPath(prefix string) string {
+	return prefix + "/started"
+}
+
+// Prepares the shadow deployment's state the first time it runs under a prefix, by copying
+// the active deployment's check and alert states, so that the shadow starts out agreeing with
+// it on what's failing instead of alerting on everything that already is. The leader locks
+// aren't copied. Returns when the shadow started, which is kept across restarts.
+func startShadow(prefix string, client *api.Client) (time.Time, error) {
+	pair, _, err := client.KV().Get(shadowStartedPath(prefix), nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error loading shadow state: %s", err)
+	}
+	if pair != nil {
+		var started time.Time
+		if err := json.Unmarshal(pair.Value, &started); err != nil {
+			return time.Time{}, fmt.Errorf("Error parsing shadow start time: %s", err)
+		}
+		return started, nil
+	}
+
+	copied := 0
+	for _, kind := range []string{"/node/", "/service/"} {
+		pairs, _, err := client.KV().List(alertingKVRoot+kind, nil)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Error listing active state: %s", err)
+		}
+		for _, pair := range pairs {
+			if strings.HasSuffix(pair.Key, "/leader") {
+				continue
+			}
+			_, err := client.KV().Put(&api.KVPair{
+				Key:   prefix + strings.TrimPrefix(pair.Key, alertingKVRoot),
+				Value: pair.Value,
+			}, nil)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("Error copying active state: %s", err)
+			}
+			copied++
+		}
+	}
+	log.Infof("Copied %d check/alert states from the active deployment to %s", copied, prefix)
+
+	started := time.Now().UTC()
+	serialized, _ := json.Marshal(started)
+	if _, err := client.KV().Put(&api.KVPair{Key: shadowStartedPath(prefix), Value: serialized}, nil); err != nil {
+		return time.Time{}, fmt.Errorf("Error storing shadow start time: %s", err)
+	}
+	return started, nil
+}
+
+// ShadowDivergence is an alert that only one of the deployments sent, or that they sent to
+// different handlers
+type ShadowDivergence struct {
+	Kind        string         `json:"kind"`
+	Fingerprint string         `json:"fingerprint"`
+	Active      *HistoryRecord `json:"active,omitempty"`
+	Shadow      *HistoryRecord `json:"shadow,omitempty"`
+}
+
+// ShadowReport compares the alerts sent by the active deployment with the ones a shadow
+// deployment would have sent over the same period
+type ShadowReport struct {
+	Since       time.Time          `json:"since"`
+	Until       time.Time          `json:"until"`
+	Active      int                `json:"active"`
+	Shadow      int                `json:"shadow"`
+	Matched     int                `json:"matched"`
+	Divergences []ShadowDivergence `json:"divergences"`
+}
+
+// Compares the sent alerts in the active and shadow histories between since and until. An
+// active alert matches the first unmatched shadow alert for the same fingerprint and status
+// within the tolerance, since the deployments see check updates at slightly different times.
+// Reminders aren't compared, as their timing depends on when each watch started.
+func compareShadow(active []HistoryRecord, shadow []HistoryRecord, since time.Time, until time.Time, tolerance time.Duration) ShadowReport {
+	report := ShadowReport{Since: since, Until: until, Divergences: make([]ShadowDivergence, 0)}
+
+	sent := func(records []HistoryRecord) map[string][]HistoryRecord {
+		byFingerprint := make(map[string][]HistoryRecord)
+		for _, record := range records {
+			if record.Event != EventSent || record.Time.Before(since) || !record.Time.Before(until) {
+				continue
+			}
+			byFingerprint[record.Fingerprint] = append(byFingerprint[record.Fingerprint], record)
+		}
+		for _, records := range byFingerprint {
+			sort.SliceStable(records, func(i, j int) bool {
+				return records[i].Time.Before(records[j].Time)
+			})
+		}
+		return byFingerprint
+	}
+	activeSent, shadowSent := sent(active), sent(shadow)
+
+	for fingerprint, shadowRecords := range shadowSent {
+		report.Shadow += len(shadowRecords)
+		if _, ok := activeSent[fingerprint]; !ok {
+			for i := range shadowRecords {
+				report.Divergences = append(report.Divergences, ShadowDivergence{Kind: ShadowExtra, Fingerprint: fingerprint, Shadow: &shadowRecords[i]})
+			}
+		}
+	}
+
+	for fingerprint, activeRecords := range activeSent {
+		report.Active += len(activeRecords)
+		shadowRecords := shadowSent[fingerprint]
+		matched := make([]bool, len(shadowRecords))
+
+		for i := range activeRecords {
+			record := &activeRecords[i]
+			match := -1
+			for j := range shadowRecords {
+				if matched[j] || shadowRecords[j].Status != record.Status {
+					continue
+				}
+				if gap := shadowRecords[j].Time.Sub(record.Time); gap <= tolerance && gap >= -tolerance {
+					match = j
+					break
+				}
+			}
+
+			if match < 0 {
+				report.Divergences = append(report.Divergences, ShadowDivergence{Kind: ShadowMissing, Fingerprint: fingerprint, Active: record})
+				continue
+			}
+			matched[match] = true
+			report.Matched++
+
+			// Histories from before handlers were recorded can't be compared
+			if len(record.Handlers) > 0 && len(shadowRecords[match].Handlers) > 0 && !sameHandlers(record.Handlers, shadowRecords[match].Handlers) {
+				report.Divergences = append(report.Divergences, ShadowDivergence{Kind: ShadowRerouted, Fingerprint: fingerprint, Active: record, Shadow: &shadowRecords[match]})
+			}
+		}
+
+		for j := range shadowRecords {
+			if !matched[j] {
+				report.Divergences = append(report.Divergences, ShadowDivergence{Kind: ShadowExtra, Fingerprint: fingerprint, Shadow: &shadowRecords[j]})
+			}
+		}
+	}
+
+	sort.SliceStable(report.Divergences, func(i, j int) bool {
+		return report.Divergences[i].time().Before(report.Divergences[j].time())
+	})
+	return report
+}
+
+// Returns when the diverging alert was sent, by either deployment
+func (d *ShadowDivergence) time() time.Time {
+	if d.Active != nil {
+		return d.Active.Time
+	}
+	return d.Shadow.Time
+}
+
+// Returns true if both lists have the same handlers, in any order
+func sameHandlers(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	return strings.Join(sortedA, "\n") == strings.Join(sortedB, "\n")
+}
+
+// GET /v1/shadow/report compares the alerts the active deployment sent with the ones the
+// shadow deployment under shadow_kv_prefix would have sent. The period defaults to when the
+// shadow started until the tolerance ago, so alerts the other deployment is still about to
+// send aren't reported, and can be set with since and until (RFC3339). The tolerance for
+// matching alerts up defaults to 5m.
+func (s *StatusServer) shadowReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	tolerance := shadowReportTolerance
+	if value := query.Get("tolerance"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, fmt.Sprintf("invalid tolerance: %q", value), http.StatusBadRequest)
+			return
+		}
+		tolerance = parsed
+	}
+
+	prefix := s.config.ShadowKVPrefix
+	var since time.Time
+	until := time.Now().UTC().Add(-tolerance)
+	for param, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %q", param, value), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	if since.IsZero() {
+		pair, _, err := s.client.KV().Get(shadowStartedPath(prefix), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if pair == nil {
+			http.Error(w, fmt.Sprintf("no shadow deployment has run under %s", prefix), http.StatusNotFound)
+			return
+		}
+		if err := json.Unmarshal(pair.Value, &since); err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing shadow start time: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	active, err := listHistory(historyKVRoot, s.client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	shadow, err := listHistory(prefix+"/history/", s.client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, compareShadow(active, shadow, since, until, tolerance))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestShadow_compare(t *testing.T) {
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	record := func(fingerprint string, minutes int, status string, handlers ...string) HistoryRecord {
+		return HistoryRecord{
+			Time:        start.Add(time.Duration(minutes) * time.Minute),
+			Event:       EventSent,
+			Fingerprint: fingerprint,
+			Status:      status,
+			Handlers:    handlers,
+		}
+	}
+
+	active := []HistoryRecord{
+		record("//redis", 1, api.HealthCritical, "slack", "pagerduty"),
+		record("//redis", 10, api.HealthPassing, "slack", "pagerduty"),
+		record("//nginx", 20, api.HealthWarning, "slack"),
+		record("//db", 30, api.HealthCritical, "pagerduty"),
+		// Outside the compared period
+		record("//cache", 120, api.HealthCritical, "slack"),
+	}
+	reminder := record("//db", 45, api.HealthCritical, "pagerduty")
+	reminder.Event = EventReminder
+	shadow := []HistoryRecord{
+		// Seen a little later by the shadow, to the same handlers in a different order
+		record("//redis", 2, api.HealthCritical, "pagerduty", "slack"),
+		record("//redis", 11, api.HealthPassing, "pagerduty", "slack"),
+		// Routed differently after a config change
+		record("//db", 30, api.HealthCritical, "slack"),
+		record("//web", 40, api.HealthCritical, "slack"),
+		reminder,
+	}
+
+	report := compareShadow(active, shadow, start, start.Add(time.Hour), 5*time.Minute)
+	if report.Active != 4 || report.Shadow != 4 || report.Matched != 3 {
+		t.Fatalf("unexpected counts: %+v", report)
+	}
+
+	expected := []struct {
+		kind, fingerprint string
+	}{
+		{ShadowMissing, "//nginx"},
+		{ShadowRerouted, "//db"},
+		{ShadowExtra, "//web"},
+	}
+	if len(report.Divergences) != len(expected) {
+		t.Fatalf("expected %d divergences, got %+v", len(expected), report.Divergences)
+	}
+	for i, divergence := range report.Divergences {
+		if divergence.Kind != expected[i].kind || divergence.Fingerprint != expected[i].fingerprint {
+			t.Errorf("divergence %d: expected %s %s, got %s %s", i, expected[i].kind, expected[i].fingerprint, divergence.Kind, divergence.Fingerprint)
+		}
+	}
+}
+
+func TestShadow_compareTolerance(t *testing.T) {
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	active := []HistoryRecord{{Time: start, Event: EventSent, Fingerprint: "//redis", Status: api.HealthCritical}}
+	shadow := []HistoryRecord{{Time: start.Add(10 * time.Minute), Event: EventSent, Fingerprint: "//redis", Status: api.HealthCritical}}
+
+	// Too far apart to be the same alert
+	report := compareShadow(active, shadow, start, start.Add(time.Hour), 5*time.Minute)
+	if report.Matched != 0 || len(report.Divergences) != 2 {
+		t.Errorf("expected a missing and an extra alert, got %+v", report)
+	}
+
+	report = compareShadow(active, shadow, start, start.Add(time.Hour), 15*time.Minute)
+	if report.Matched != 1 || len(report.Divergences) != 0 {
+		t.Errorf("expected the alerts to match, got %+v", report)
+	}
+}
+
+func TestShadow_dispatch(t *testing.T) {
+	config, err := ParseConfig(`
+	shadow_mode = true
+	default_handlers = ["stdout.test"]
+	handler "stdout" "test" {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := config.stateKVRoot(); root != "service/consul-alerting-shadow" {
+		t.Errorf("unexpected state root %s", root)
+	}
+
+	alerts := make(chan *AlertState, 1)
+	config.Handlers["stdout.test"] = testHandler{alerts}
+
+	alert := &AlertState{Service: "redis", Status: api.HealthCritical, Message: "redis is critical"}
+	dispatchAlert(config, "redis", alert)
+	select {
+	case <-alerts:
+		t.Fatal("expected the alert not to be sent in shadow mode")
+	default:
+	}
+	if len(alert.handlers) != 1 || alert.handlers[0] != "stdout.test" {
+		t.Errorf("expected the handlers to be recorded, got %v", alert.handlers)
+	}
+}
+
+func TestShadow_config(t *testing.T) {
+	cases := []string{
+		`shadow_kv_prefix = "service/consul-alerting/shadow"`,
+		`shadow_kv_prefix = "service/consul-alerting/"`,
+		`shadow_mode = true
+		history_size = 0`,
+		`shadow_mode = true
+		node_watch = "global"
+		node_watch_sharding = true`,
+	}
+	for _, raw := range cases {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
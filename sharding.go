@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The KV prefix that instances register under when node watches are sharded
+const instancesKVPath = alertingKVRoot + "/instances/"
+
+// The TTL of an instance's registration session. If an instance dies, its registration is
+// removed once the session expires and its nodes are taken over by the others.
+const instanceSessionTTL = "15s"
+
+// An instance's entry in the registry
+type instanceRecord struct {
+	ID string `json:"id"`
+
+	// The hash of the member list the instance's node watches were last started for
+	View string `json:"view"`
+}
+
+// nodeSharder splits the nodes between the instances registered in the KV store, using
+// rendezvous hashing: each node is watched by the instance with the highest hash of the
+// instance and node's names. When an instance joins or leaves, only the nodes it gains or
+// loses move, so the other nodes' watches (and their locks and in-memory state) stay put.
+//
+// To avoid leaving nodes unwatched while instances rebalance, an instance keeps watching the
+// nodes it no longer owns until every instance reports having started the watches for the
+// same member list. Until then a node can be watched twice, which is safe since only the
+// holder of its leader lock alerts.
+type nodeSharder struct {
+	id     string
+	client *api.Client
+
+	// Closed to stop renewing the session, which destroys it
+	renewCh chan struct{}
+
+	lock    sync.Mutex
+	session string
+	members []string
+	views   map[string]string
+
+	// Closed once the registry has been read for the first time
+	readyCh   chan struct{}
+	readyOnce sync.Once
+}
+
+func newNodeSharder(id string, client *api.Client) *nodeSharder {
+	return &nodeSharder{
+		id:      id,
+		client:  client,
+		members: []string{id},
+		views:   make(map[string]string),
+		readyCh: make(chan struct{}),
+	}
+}
+
+// Returns the instance that should watch a node
+func rendezvousOwner(node string, members []string) string {
+	var owner string
+	var best uint64
+	for _, member := range members {
+		sum := sha1.Sum([]byte(member + "\x00" + node))
+		if score := binary.BigEndian.Uint64(sum[:8]); owner == "" || score > best || (score == best && member < owner) {
+			owner = member
+			best = score
+		}
+	}
+	return owner
+}
+
+// Returns a hash identifying a member list
+func membersView(members []string) string {
+	sum := sha1.Sum([]byte(strings.Join(members, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Registers the instance and follows the registry until shutdown, keeping the member list
+// up to date
+func (s *nodeSharder) run(stopCh chan struct{}) {
+	for {
+		if err := s.register(); err != nil {
+			log.Errorf("Error registering instance for node watch sharding: %s, retrying in 10s...", err)
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(10 * time.Second):
+				continue
+			}
+		}
+		break
+	}
+
+	queryOpts := &api.QueryOptions{WaitTime: watchWaitTime}
+	for {
+		select {
+		case <-stopCh:
+			close(s.renewCh)
+			return
+		default:
+		}
+
+		pairs, queryMeta, err := s.client.KV().List(instancesKVPath, queryOpts)
+		if err != nil {
+			log.Errorf("Error listing alerting instances: %s, retrying in 10s...", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		queryOpts.WaitIndex = queryMeta.LastIndex
+
+		// Make sure our own registration is still there, such as after a session was lost
+		if s.update(pairs) {
+			s.readyOnce.Do(func() { close(s.readyCh) })
+		} else {
+			log.Warn("Instance registration for node watch sharding was lost, re-registering")
+			if err := s.register(); err != nil {
+				log.Errorf("Error re-registering instance: %s", err)
+			}
+		}
+	}
+}
+
+// Creates the instance's session and registry entry
+func (s *nodeSharder) register() error {
+	if s.renewCh != nil {
+		close(s.renewCh)
+		s.renewCh = nil
+	}
+	session, _, err := s.client.Session().Create(&api.SessionEntry{
+		Name:      "consul-alerting instance " + s.id,
+		TTL:       instanceSessionTTL,
+		Behavior:  api.SessionBehaviorDelete,
+		LockDelay: time.Nanosecond,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	s.renewCh = make(chan struct{})
+	go s.client.Session().RenewPeriodic(instanceSessionTTL, session, nil, s.renewCh)
+
+	s.lock.Lock()
+	s.session = session
+	view := s.views[s.id]
+	s.lock.Unlock()
+	return s.publish(view)
+}
+
+// Updates the registry entry with the view the instance's watches were started for. Views
+// from before the instance has registered are published by register.
+func (s *nodeSharder) publish(view string) error {
+	s.lock.Lock()
+	session := s.session
+	s.lock.Unlock()
+	if session == "" {
+		return nil
+	}
+
+	value, err := json.Marshal(instanceRecord{ID: s.id, View: view})
+	if err != nil {
+		return err
+	}
+	_, _, err = s.client.KV().Acquire(&api.KVPair{
+		Key:     instancesKVPath + s.id,
+		Value:   value,
+		Session: session,
+	}, nil)
+	return err
+}
+
+// Replaces the member list with the registry's entries, returning whether the instance's own
+// entry was among them
+func (s *nodeSharder) update(pairs api.KVPairs) bool {
+	members := make([]string, 0, len(pairs))
+	views := make(map[string]string)
+	registered := false
+	for _, pair := range pairs {
+		var record instanceRecord
+		if err := json.Unmarshal(pair.Value, &record); err != nil || record.ID == "" {
+			continue
+		}
+		members = append(members, record.ID)
+		views[record.ID] = record.View
+		registered = registered || record.ID == s.id
+	}
+	if !registered {
+		members = append(members, s.id)
+	}
+	sort.Strings(members)
+
+	s.lock.Lock()
+	if strings.Join(members, "\n") != strings.Join(s.members, "\n") {
+		log.Infof("Alerting instances for node watch sharding: %v", members)
+	}
+	s.members = members
+	if registered {
+		s.views = views
+	}
+	s.lock.Unlock()
+
+	return registered
+}
+
+// Returns the current member list, its view, and whether every member has started the
+// watches for it
+func (s *nodeSharder) snapshot() ([]string, string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	view := membersView(s.members)
+	converged := true
+	for _, member := range s.members {
+		if member != s.id && s.views[member] != view {
+			converged = false
+		}
+	}
+	return append([]string{}, s.members...), view, converged
+}
+
+// Records that the instance's watches match a view, and announces it to the other instances
+func (s *nodeSharder) started(view string) {
+	s.lock.Lock()
+	unchanged := s.views[s.id] == view
+	s.views[s.id] = view
+	s.lock.Unlock()
+
+	if unchanged {
+		return
+	}
+	if err := s.publish(view); err != nil {
+		log.Errorf("Error updating instance registration: %s", err)
+	}
+}
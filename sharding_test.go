@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestSharding_rendezvousStable(t *testing.T) {
+	members := []string{"alerter1", "alerter2", "alerter3"}
+	joined := append(append([]string{}, members...), "alerter4")
+	left := []string{"alerter1", "alerter3"}
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		node := fmt.Sprintf("node%d", i)
+		owner := rendezvousOwner(node, members)
+		counts[owner]++
+
+		// A joining instance only takes nodes, it never moves them between the others
+		if newOwner := rendezvousOwner(node, joined); newOwner != owner && newOwner != "alerter4" {
+			t.Fatalf("node %s moved from %s to %s when alerter4 joined", node, owner, newOwner)
+		}
+
+		// Only the leaving instance's nodes move
+		if newOwner := rendezvousOwner(node, left); newOwner != owner && owner != "alerter2" {
+			t.Fatalf("node %s moved from %s to %s when alerter2 left", node, owner, newOwner)
+		}
+	}
+
+	// The nodes are spread roughly evenly
+	for _, member := range members {
+		if counts[member] < 800 || counts[member] > 1200 {
+			t.Errorf("expected about 1000 nodes for %s, got %d", member, counts[member])
+		}
+	}
+}
+
+func TestSharding_convergence(t *testing.T) {
+	sharder := newNodeSharder("alerter1", nil)
+	pairs := func(views map[string]string) api.KVPairs {
+		result := make(api.KVPairs, 0)
+		for id, view := range views {
+			value, _ := json.Marshal(instanceRecord{ID: id, View: view})
+			result = append(result, &api.KVPair{Key: instancesKVPath + id, Value: value})
+		}
+		return result
+	}
+
+	// Our own registration must be in the registry
+	if sharder.update(pairs(map[string]string{"alerter2": ""})) {
+		t.Fatal("expected the missing registration to be noticed")
+	}
+
+	members, view, converged := sharder.snapshot()
+	if len(members) != 2 || converged {
+		t.Fatalf("expected 2 members that haven't converged, got %v (converged: %v)", members, converged)
+	}
+
+	// Once the other instance has started its watches for the same members, it's converged
+	if !sharder.update(pairs(map[string]string{"alerter1": "", "alerter2": view})) {
+		t.Fatal("expected the registration to be found")
+	}
+	if _, _, converged := sharder.snapshot(); !converged {
+		t.Fatal("expected the members to have converged")
+	}
+}
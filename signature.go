@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The headers carrying a signed webhook's signature, and the Unix time it was signed at
+const (
+	signatureHeader          = "X-Consul-Alerting-Signature"
+	signatureTimestampHeader = "X-Consul-Alerting-Timestamp"
+)
+
+// The scheme prefixed to signatures, so receivers can tell how to verify them
+const signaturePrefix = "sha256="
+
+// Returns the signature of a webhook body sent at the given Unix time: the hex-encoded
+// HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signs a webhook request's body with the secret, setting the signature and timestamp headers
+func setWebhookSignature(req *http.Request, secret string, body []byte, now time.Time) {
+	timestamp := now.Unix()
+	req.Header.Set(signatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(signatureHeader, signWebhook(secret, timestamp, body))
+}
+
+// replayGuard verifies signed webhooks, rejecting ones signed outside the replay window and
+// ones whose signature has already been seen within it, so a captured request can't be sent
+// again later
+type replayGuard struct {
+	window time.Duration
+
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Checks a request's signature of the body against the secret, returning an error describing
+// why it was rejected
+func (g *replayGuard) verify(r *http.Request, secret string, body []byte, now time.Time) error {
+	signature := r.Header.Get(signatureHeader)
+	rawTimestamp := r.Header.Get(signatureTimestampHeader)
+	if signature == "" || rawTimestamp == "" {
+		return fmt.Errorf("missing %s or %s header", signatureHeader, signatureTimestampHeader)
+	}
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return fmt.Errorf("unsupported signature scheme")
+	}
+
+	timestamp, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", rawTimestamp)
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if skew := now.Sub(signedAt); skew > g.window || skew < -g.window {
+		return fmt.Errorf("timestamp is outside the %s replay window", g.window)
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(signWebhook(secret, timestamp, body))) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	// Signatures can only be replayed within the window, so older ones can be forgotten
+	for seen, expires := range g.seen {
+		if now.After(expires) {
+			delete(g.seen, seen)
+		}
+	}
+	if _, ok := g.seen[signature]; ok {
+		return fmt.Errorf("signature has already been used")
+	}
+	g.seen[signature] = signedAt.Add(g.window)
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignature_verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"status": "critical"}`)
+	guard := newReplayGuard(5 * time.Minute)
+
+	signed := func(secret string, at time.Time, body []byte) *http.Request {
+		req, _ := http.NewRequest("POST", "http://localhost/", nil)
+		setWebhookSignature(req, secret, body, at)
+		return req
+	}
+
+	req := signed("secret", now, body)
+	if sig := req.Header.Get(signatureHeader); !strings.HasPrefix(sig, "sha256=") || len(sig) != len("sha256=")+64 {
+		t.Errorf("unexpected signature %q", sig)
+	}
+	if ts := req.Header.Get(signatureTimestampHeader); ts != strconv.FormatInt(now.Unix(), 10) {
+		t.Errorf("unexpected timestamp %q", ts)
+	}
+
+	cases := []struct {
+		req   *http.Request
+		body  string
+		error string
+	}{
+		{signed("other", now, body), string(body), "invalid signature"},
+		{signed("secret", now, body), `{"status": "passing"}`, "invalid signature"},
+		{signed("secret", now.Add(-10*time.Minute), body), string(body), "replay window"},
+		{signed("secret", now.Add(10*time.Minute), body), string(body), "replay window"},
+		{&http.Request{Header: http.Header{}}, string(body), "missing"},
+	}
+	for i, tc := range cases {
+		if err := guard.verify(tc.req, "secret", []byte(tc.body), now); err == nil || !strings.Contains(err.Error(), tc.error) {
+			t.Errorf("case %d: expected an error containing %q, got %v", i, tc.error, err)
+		}
+	}
+
+	// Valid signatures are accepted once, within the window
+	if err := guard.verify(req, "secret", body, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.verify(req, "secret", body, now.Add(2*time.Minute)); err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Errorf("expected the replayed signature to be rejected, got %v", err)
+	}
+
+	// Seen signatures are forgotten once they've expired
+	guard.verify(signed("secret", now.Add(20*time.Minute), body), "secret", body, now.Add(20*time.Minute))
+	if len(guard.seen) != 1 {
+		t.Errorf("expected expired signatures to be forgotten, got %d", len(guard.seen))
+	}
+}
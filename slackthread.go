@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// A Slack message an alert was posted in, which its recovery is posted as a reply to
+type SlackThread struct {
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// Records the Slack threads that handlers start or close while an alert is being sent, so
+// they're kept in its alert state. Handlers that finish before the watch stores the alert
+// state have their threads stored along with it; ones that finish afterwards (such as from
+// the dispatch queue) update the stored state themselves.
+type slackThreadTracker struct {
+	lock      sync.Mutex
+	client    *api.Client
+	kvPath    string
+	alertLock *sync.Mutex
+	threads   map[string]SlackThread
+	stored    bool
+}
+
+func newSlackThreadTracker(client *api.Client, kvPath string, alertLock *sync.Mutex) *slackThreadTracker {
+	return &slackThreadTracker{
+		client:    client,
+		kvPath:    kvPath,
+		alertLock: alertLock,
+		threads:   make(map[string]SlackThread),
+	}
+}
+
+// Records the thread a channel was alerted in, or that its thread was closed if the thread
+// is empty
+func (t *slackThreadTracker) record(channel string, thread SlackThread) {
+	t.lock.Lock()
+	if !t.stored {
+		t.threads[channel] = thread
+		t.lock.Unlock()
+		return
+	}
+	t.lock.Unlock()
+
+	t.alertLock.Lock()
+	defer t.alertLock.Unlock()
+
+	alert, err := getAlertState(t.kvPath, t.client)
+	if err != nil {
+		log.Errorf("Error recording Slack thread for channel %s: %s", channel, err)
+		return
+	}
+	if alert == nil {
+		return
+	}
+	applySlackThreads(alert, map[string]SlackThread{channel: thread})
+	if err := setAlertState(t.kvPath, alert, t.client); err != nil {
+		log.Errorf("Error recording Slack thread for channel %s: %s", channel, err)
+	}
+}
+
+// Applies the threads recorded so far to the alert state about to be stored. Threads
+// recorded after this are written to the KV store directly.
+func (t *slackThreadTracker) apply(alert *AlertState) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	applySlackThreads(alert, t.threads)
+	t.stored = true
+}
+
+// Sets (or removes, for empty threads) the alert's thread for each channel. The map is
+// copied rather than changed in place, since handlers may still be reading the old one.
+func applySlackThreads(alert *AlertState, threads map[string]SlackThread) {
+	if len(threads) == 0 {
+		return
+	}
+	updated := make(map[string]SlackThread)
+	for channel, thread := range alert.SlackThreads {
+		updated[channel] = thread
+	}
+	for channel, thread := range threads {
+		if thread.TS == "" {
+			delete(updated, channel)
+		} else {
+			updated[channel] = thread
+		}
+	}
+	if len(updated) == 0 {
+		updated = nil
+	}
+	alert.SlackThreads = updated
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+const sloKVPath = alertingKVRoot + "/slo/"
+
+// The route SLO burn alerts are raised under, keeping them separate from the service's own
+// alert. Unlike node routes, they still go to the service's handlers.
+const sloRoute = "slo"
+
+// How often service availability is checked against the SLOs
+const sloCheckInterval = time.Minute
+
+// The defaults for a service's SLO window (in seconds) and burn rate threshold
+const (
+	defaultSLOWindow   = 3600
+	defaultSLOBurnRate = 1.0
+)
+
+// A service's availability objective, from its service block
+type serviceSLO struct {
+	target   float64
+	window   time.Duration
+	burnRate float64
+}
+
+// Returns the SLO for a service, if it has one
+func (c *Config) serviceSLO(service string) (serviceSLO, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	serviceConfig := c.serviceConfigLocked(service)
+	if serviceConfig == nil || serviceConfig.SLO == 0 {
+		return serviceSLO{}, false
+	}
+
+	slo := serviceSLO{
+		target:   serviceConfig.SLO,
+		window:   time.Duration(serviceConfig.SLOWindow) * time.Second,
+		burnRate: serviceConfig.SLOBurnRate,
+	}
+	if slo.window == 0 {
+		slo.window = defaultSLOWindow * time.Second
+	}
+	if slo.burnRate == 0 {
+		slo.burnRate = defaultSLOBurnRate
+	}
+	return slo, true
+}
+
+// Returns true if any service block has an SLO
+func (c *Config) hasSLOs() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, service := range c.Services {
+		if service.SLO != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how fast the error budget is being used up at the given availability, where 1 means
+// the service is exactly meeting its target
+func (s serviceSLO) burn(availability float64) float64 {
+	return (1 - availability) / (1 - s.target/100)
+}
+
+// Returns the fraction of the window before now that a service was healthy, according to
+// the status changes in its alert history. The service counts as unhealthy while any of its
+// alerts (such as one per tag) is critical.
+func serviceAvailability(records []HistoryRecord, service string, window time.Duration, now time.Time) float64 {
+	var serviceRecords []HistoryRecord
+	for _, record := range records {
+		if record.Service == service && record.Node == "" && record.Route == "" {
+			serviceRecords = append(serviceRecords, record)
+		}
+	}
+	sort.SliceStable(serviceRecords, func(i, j int) bool {
+		return serviceRecords[i].Time.Before(serviceRecords[j].Time)
+	})
+
+	// Walk the status changes in order, adding up the time spent failing
+	statuses := make(map[string]string)
+	failing := func() bool {
+		for _, status := range statuses {
+			if status == api.HealthCritical {
+				return true
+			}
+		}
+		return false
+	}
+
+	start := now.Add(-window)
+	last := start
+	var unhealthy time.Duration
+	for _, record := range serviceRecords {
+		if record.Time.After(now) {
+			break
+		}
+		if record.Time.After(start) {
+			if failing() {
+				unhealthy += record.Time.Sub(last)
+			}
+			last = record.Time
+		}
+		statuses[record.Fingerprint] = record.Status
+	}
+	if failing() {
+		unhealthy += now.Sub(last)
+	}
+
+	return 1 - unhealthy.Seconds()/window.Seconds()
+}
+
+// Periodically computes the availability of services with an SLO from the alert history,
+// alerting when their error budget burn rate goes over the threshold and again once it
+// recovers. Only one process checks the SLOs at a time, using a lock in the KV store.
+func monitorSLOs(config *Config, shutdownCh chan struct{}, client *api.Client) {
+	apiLock, err := client.LockKey(sloKVPath + "leader")
+	if err != nil {
+		fatalError(config, client, ExitLockFailure, fmt.Errorf("Error initializing lock for SLO alerts: %s", err))
+	}
+
+	// The services currently burning through their error budget, kept in the KV store so a
+	// new leader doesn't alert on them again
+	breaching := make(map[string]bool)
+
+	lock := LockHelper{
+		target: "SLO alerts",
+		client: client,
+		lock:   apiLock,
+		stopCh: make(chan struct{}, 1),
+		lockCh: make(chan struct{}, 1),
+		callback: func() {
+			stored, err := getSLOBreaches(client)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			breaching = stored
+		},
+	}
+	go lock.start()
+
+	for {
+		select {
+		case <-shutdownCh:
+			log.Info("Shutting down SLO alerts")
+			lock.stop()
+			<-shutdownCh
+			return
+		case <-time.After(sloCheckInterval):
+		}
+
+		if !lock.acquired {
+			continue
+		}
+
+		records, err := listHistory(config.historyKVPrefix(), client)
+		if err != nil {
+			log.Errorf("Error checking SLOs: %s", err)
+			continue
+		}
+
+		if checkSLOs(config, records, breaching, time.Now()) {
+			if err := setSLOBreaches(breaching, client); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// Checks the availability of every service in the history against its SLO, alerting on
+// services that started or stopped breaching it. Returns true if any changed.
+func checkSLOs(config *Config, records []HistoryRecord, breaching map[string]bool, now time.Time) bool {
+	services := make(map[string]bool)
+	for _, record := range records {
+		if record.Service != "" {
+			services[record.Service] = true
+		}
+	}
+
+	changed := false
+	for service, _ := range services {
+		slo, ok := config.serviceSLO(service)
+		if !ok {
+			continue
+		}
+
+		availability := serviceAvailability(records, service, slo.window, now)
+		burn := slo.burn(availability)
+		breach := burn > slo.burnRate
+		if breach == breaching[service] {
+			continue
+		}
+
+		status := api.HealthPassing
+		if breach {
+			status = api.HealthCritical
+			breaching[service] = true
+		} else {
+			delete(breaching, service)
+		}
+		changed = true
+
+		log.Infof("Service %s is %.3f%% available over the last %s (burn rate %.1fx)", service, availability*100, slo.window, burn)
+		dispatchAlert(config, service, &AlertState{
+			Status:  status,
+			Service: service,
+			Route:   sloRoute,
+			Message: fmt.Sprintf("[%s] %s SLO burn rate is now %s", config.ConsulDatacenter, service, status),
+			Details: fmt.Sprintf("%.3f%% available over the last %s (target %v%%), burning the error budget at %.1fx (threshold %.1fx)",
+				availability*100, slo.window, slo.target, burn, slo.burnRate),
+		})
+	}
+	return changed
+}
+
+func getSLOBreaches(client *api.Client) (map[string]bool, error) {
+	kvPair, _, err := client.KV().Get(sloKVPath+"breaches", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading SLO state: %s", err)
+	}
+
+	breaches := make(map[string]bool)
+	if kvPair == nil || len(kvPair.Value) == 0 {
+		return breaches, nil
+	}
+
+	if err := json.Unmarshal(kvPair.Value, &breaches); err != nil {
+		return nil, fmt.Errorf("Error parsing SLO state: %s", err)
+	}
+	return breaches, nil
+}
+
+func setSLOBreaches(breaches map[string]bool, client *api.Client) error {
+	serialized, err := json.Marshal(breaches)
+	if err != nil {
+		return fmt.Errorf("Error forming SLO state: %s", err)
+	}
+
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   sloKVPath + "breaches",
+		Value: serialized,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error storing SLO state: %s", err)
+	}
+	return nil
+}
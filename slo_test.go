@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestSLO_serviceAvailability(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	record := func(minutesAgo int, fingerprint string, status string) HistoryRecord {
+		return HistoryRecord{
+			Time:        now.Add(-time.Duration(minutesAgo) * time.Minute),
+			Fingerprint: fingerprint,
+			Service:     "redis",
+			Status:      status,
+		}
+	}
+
+	records := []HistoryRecord{
+		// Critical since before the window starts, recovering 50 minutes ago
+		record(90, "primary", api.HealthCritical),
+		record(50, "primary", api.HealthPassing),
+		// Overlapping failures on another tag only count once
+		record(30, "primary", api.HealthCritical),
+		record(25, "replica", api.HealthCritical),
+		record(20, "primary", api.HealthPassing),
+		record(15, "replica", api.HealthPassing),
+		// Warnings don't count against availability
+		record(10, "primary", api.HealthWarning),
+		// Other services and node alerts are ignored
+		{Time: now.Add(-40 * time.Minute), Service: "web", Status: api.HealthCritical},
+		{Time: now.Add(-40 * time.Minute), Service: "redis", Node: "node1", Status: api.HealthCritical},
+	}
+
+	availability := serviceAvailability(records, "redis", time.Hour, now)
+	if expected := 35.0 / 60.0; math.Abs(availability-expected) > 1e-9 {
+		t.Fatalf("expected availability %v, got %v", expected, availability)
+	}
+
+	if availability := serviceAvailability(nil, "redis", time.Hour, now); availability != 1 {
+		t.Fatalf("expected full availability without history, got %v", availability)
+	}
+}
+
+func TestSLO_checkSLOs(t *testing.T) {
+	alertCh := make(chan *AlertState, 1)
+	config, err := ParseConfig(`
+	service "redis" {
+		slo = 99
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Handlers["test"] = testHandler{alertCh}
+	config.DefaultHandlers = []string{"test"}
+
+	now := time.Now()
+	records := []HistoryRecord{
+		{Time: now.Add(-time.Minute), Fingerprint: "a", Service: "redis", Status: api.HealthCritical},
+		{Time: now.Add(-time.Minute), Fingerprint: "b", Service: "web", Status: api.HealthCritical},
+	}
+
+	// A minute of downtime in an hour burns the 1% budget at 1.7x
+	breaching := make(map[string]bool)
+	if !checkSLOs(config, records, breaching, now) || !breaching["redis"] {
+		t.Fatal("expected redis to start breaching its SLO")
+	}
+	alert := <-alertCh
+	if alert.Status != api.HealthCritical || alert.Route != sloRoute || !strings.Contains(alert.Details, "target 99%") {
+		t.Fatalf("unexpected alert: %+v", alert)
+	}
+
+	// No repeat alerts while it stays over the threshold
+	if checkSLOs(config, records, breaching, now) {
+		t.Fatal("expected no change while still breaching")
+	}
+
+	records = append(records, HistoryRecord{Time: now.Add(-30 * time.Second), Fingerprint: "a", Service: "redis", Status: api.HealthPassing})
+	if !checkSLOs(config, records, breaching, now) || breaching["redis"] {
+		t.Fatal("expected redis to recover")
+	}
+	if alert := <-alertCh; alert.Status != api.HealthPassing {
+		t.Fatalf("expected a recovery alert, got %s", alert.Status)
+	}
+
+	_, err = ParseConfig(`
+	history_size = 0
+	service "redis" {
+		slo = 99.9
+	}
+	`)
+	if err == nil || !strings.Contains(err.Error(), "requires history_size") {
+		t.Fatalf("expected history_size error, got %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait when connecting to a mail server
+const smtpDialTimeout = 10 * time.Second
+
+// How long an idle connection to a mail server is kept for reuse, and how many are kept for
+// each server. Mail servers commonly drop connections after a few minutes of inactivity.
+const (
+	smtpIdleTimeout = time.Minute
+	smtpMaxIdle     = 2
+)
+
+// How the connection to a mail server is secured
+const (
+	// TLS from the start on port 465, otherwise STARTTLS if the server offers it
+	smtpTLSAuto = "auto"
+	// STARTTLS, failing if the server doesn't offer it
+	smtpTLSStartTLS = "starttls"
+	// TLS from the start of the connection, on any port
+	smtpTLSImplicit = "tls"
+	// No TLS, even if the server offers STARTTLS
+	smtpTLSNone = "none"
+)
+
+var smtpTLSModes = []string{smtpTLSAuto, smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone}
+
+// A mail server to deliver emails through, with the credentials to log in with and how to
+// secure the connection if it's a relay. An empty TLS mode is the same as auto.
+type smtpServer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLS      string
+}
+
+// Returns whether the connection starts with TLS, rather than upgrading to it with STARTTLS
+func (s smtpServer) implicitTLS() bool {
+	return s.TLS == smtpTLSImplicit || ((s.TLS == "" || s.TLS == smtpTLSAuto) && s.Port == 465)
+}
+
+func (s smtpServer) address() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// smtpSender delivers rendered emails to a mail server. The default sender keeps connections
+// open for reuse; tests can replace it.
+type smtpSender interface {
+	send(server smtpServer, from string, to []string, message []byte) error
+}
+
+var emailSender smtpSender = newSMTPPool()
+
+// An email to render, with a plain text body
+type emailMessage struct {
+	From    *mail.Address
+	To      []string
+	Subject string
+	Body    string
+}
+
+// The headers of a rendered email, in the order they're written
+var emailHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// Renders the email as a MIME message with CRLF line endings, encoding the subject and body so
+// that any UTF-8 text survives transport
+func (m *emailMessage) render(now time.Time) ([]byte, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(m.From.Address, "@"); at >= 0 {
+		domain = m.From.Address[at+1:]
+	}
+
+	headers := map[string]string{
+		"From":                      m.From.String(),
+		"To":                        strings.Join(m.To, ", "),
+		"Subject":                   mime.QEncoding.Encode("UTF-8", m.Subject),
+		"Date":                      now.Format(time.RFC1123Z),
+		"Message-ID":                fmt.Sprintf("<%d.%s@%s>", now.UnixNano(), hex.EncodeToString(id), domain),
+		"MIME-Version":              "1.0",
+		"Content-Type":              `text/plain; charset="UTF-8"`,
+		"Content-Transfer-Encoding": "quoted-printable",
+	}
+
+	var buf bytes.Buffer
+	for _, name := range emailHeaders {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, headers[name])
+	}
+	buf.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	if _, err := body.Write([]byte(m.Body)); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// An open connection to a mail server, and when it was last used
+type smtpConn struct {
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+// smtpPool sends emails over connections that are kept open between alerts, so a burst of
+// alerts doesn't open a new connection (and TLS session) to the mail server for each email.
+// A connection is only used by one send at a time.
+type smtpPool struct {
+	lock sync.Mutex
+	idle map[smtpServer][]*smtpConn
+}
+
+func newSMTPPool() *smtpPool {
+	return &smtpPool{idle: make(map[smtpServer][]*smtpConn)}
+}
+
+func (p *smtpPool) send(server smtpServer, from string, to []string, message []byte) error {
+	conn, err := p.get(server)
+	if err != nil {
+		return err
+	}
+
+	if err := deliverSMTP(conn.client, from, to, message); err != nil {
+		// The connection is left in an unknown state, so it isn't reused
+		conn.client.Close()
+		return err
+	}
+
+	p.put(server, conn)
+	return nil
+}
+
+// Returns an idle connection to the server that's still alive, or opens a new one
+func (p *smtpPool) get(server smtpServer) (*smtpConn, error) {
+	now := time.Now()
+	for {
+		p.lock.Lock()
+		p.expire(now)
+		conns := p.idle[server]
+		if len(conns) == 0 {
+			p.lock.Unlock()
+			break
+		}
+		conn := conns[len(conns)-1]
+		p.idle[server] = conns[:len(conns)-1]
+		p.lock.Unlock()
+
+		if conn.client.Noop() == nil {
+			return conn, nil
+		}
+		conn.client.Close()
+	}
+
+	client, err := dialSMTP(server)
+	if err != nil {
+		return nil, err
+	}
+	return &smtpConn{client: client}, nil
+}
+
+// Returns a connection to the pool, closing it if the server already has enough idle ones
+func (p *smtpPool) put(server smtpServer, conn *smtpConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.idle[server]) >= smtpMaxIdle {
+		conn.client.Quit()
+		return
+	}
+	conn.lastUsed = time.Now()
+	p.idle[server] = append(p.idle[server], conn)
+}
+
+// Closes the connections that have been idle for too long. The lock must be held.
+func (p *smtpPool) expire(now time.Time) {
+	for server, conns := range p.idle {
+		active := conns[:0]
+		for _, conn := range conns {
+			if now.Sub(conn.lastUsed) > smtpIdleTimeout {
+				go conn.client.Quit()
+				continue
+			}
+			active = append(active, conn)
+		}
+		if len(active) == 0 {
+			delete(p.idle, server)
+		} else {
+			p.idle[server] = active
+		}
+	}
+}
+
+// Connects to a mail server, securing the connection as its TLS mode says (by default,
+// upgrading to TLS if it supports STARTTLS, or connecting with TLS on port 465) and logging in
+// if the server has credentials
+func dialSMTP(server smtpServer) (*smtp.Client, error) {
+	tlsConfig := &tls.Config{ServerName: server.Host}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	if server.implicitTLS() {
+		conn, err = tls.DialWithDialer(dialer, "tcp", server.address(), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", server.address())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := smtp.NewClient(conn, server.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Spam filters check that the HELO name is the sending host's
+	if hostname, err := os.Hostname(); err == nil {
+		if err := client.Hello(hostname); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if !server.implicitTLS() && server.TLS != smtpTLSNone {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, err
+			}
+		} else if server.TLS == smtpTLSStartTLS {
+			client.Close()
+			return nil, fmt.Errorf("%s doesn't support STARTTLS", server.address())
+		}
+	}
+
+	if server.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("%s doesn't support authentication", server.address())
+		}
+		if err := client.Auth(smtp.PlainAuth("", server.Username, server.Password, server.Host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// Sends a rendered email over an open connection
+func deliverSMTP(client *smtp.Client, from string, to []string, message []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
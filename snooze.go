@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// The KV prefix snoozes are stored under, keyed by alert fingerprint
+const snoozeKVRoot = alertingKVRoot + "/snooze/"
+
+// Snooze is a silence scoped to a single alert, attributed to the user that created it
+type Snooze struct {
+	Fingerprint string    `json:"fingerprint"`
+	User        string    `json:"user"`
+	Reason      string    `json:"reason"`
+	Until       time.Time `json:"until"`
+}
+
+// Returns a short identifier for the node/service/tag (and node route, if any) an alert is about
+func alertFingerprint(alert *AlertState) string {
+	key := alert.Node + "/" + alert.Service + "/" + alert.Tag
+	if alert.Route != "" {
+		key = key + "/" + alert.Route
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// Returns true if the snooze hasn't expired yet
+func (s *Snooze) active(now time.Time) bool {
+	return now.Before(s.Until)
+}
+
+// Describes the snooze for inclusion in notifications
+func (s *Snooze) describe() string {
+	description := fmt.Sprintf("Snoozed by %s until %s", s.User, s.Until.Format("Jan 2 15:04 MST"))
+	if s.Reason != "" {
+		description = description + fmt.Sprintf(" (%s)", s.Reason)
+	}
+	return description
+}
+
+// Loads the snooze for the given alert fingerprint, returning nil if there isn't one
+func getSnooze(fingerprint string, client *api.Client) (*Snooze, error) {
+	kvPair, _, err := client.KV().Get(snoozeKVRoot+fingerprint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading snooze: %s", err)
+	}
+
+	if kvPair == nil || len(kvPair.Value) == 0 {
+		return nil, nil
+	}
+
+	snooze := &Snooze{}
+	if err := json.Unmarshal(kvPair.Value, snooze); err != nil {
+		return nil, fmt.Errorf("Error parsing snooze: %s", err)
+	}
+
+	return snooze, nil
+}
+
+// Stores a snooze in the KV store
+func setSnooze(snooze *Snooze, client *api.Client) error {
+	serialized, err := json.Marshal(snooze)
+	if err != nil {
+		return fmt.Errorf("Error forming snooze: %s", err)
+	}
+
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   snoozeKVRoot + snooze.Fingerprint,
+		Value: serialized,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error storing snooze: %s", err)
+	}
+
+	return nil
+}
+
+// Removes the snooze for the given alert fingerprint
+func deleteSnooze(fingerprint string, client *api.Client) error {
+	_, err := client.KV().Delete(snoozeKVRoot+fingerprint, nil)
+	if err != nil {
+		return fmt.Errorf("Error removing snooze: %s", err)
+	}
+	return nil
+}
+
+// Checks for a snooze on the alert, returning whether the alert should still be sent along
+// with the notification to send, which includes the snooze's attribution if there is one.
+// Recoveries are sent even while snoozed, and expired snoozes are removed after being
+// mentioned in one last notification.
+func applySnooze(alert *AlertState, client *api.Client) (bool, *AlertState) {
+	fingerprint := alertFingerprint(alert)
+	snooze, err := getSnooze(fingerprint, client)
+	if err != nil {
+		log.Error(err)
+		return true, alert
+	}
+	if snooze == nil {
+		return true, alert
+	}
+
+	notification := *alert
+	notification.Details = strings.TrimSpace(snooze.describe() + "\n" + alert.Details)
+
+	if snooze.active(time.Now()) {
+		if alert.Status != api.HealthPassing {
+			log.Infof("Not sending alert '%s': %s", alert.Message, snooze.describe())
+			return false, nil
+		}
+		return true, &notification
+	}
+
+	if !shadowed() {
+		if err := deleteSnooze(fingerprint, client); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return true, &notification
+}
+
+// Waits for the alert's snooze to run out and then re-evaluates the alert, so an alert that
+// was held back by the snooze is sent if it's still failing
+func alertAfterSnooze(kvPath string, watchOpts *WatchOptions) {
+	watchOpts.alertLock.Lock()
+	alert, err := getAlertState(kvPath, watchOpts.client)
+	watchOpts.alertLock.Unlock()
+	if err != nil {
+		log.Error("Error fetching alert state: ", err)
+		return
+	}
+	if alert == nil {
+		return
+	}
+
+	snooze, err := getSnooze(alertFingerprint(alert), watchOpts.client)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if snooze != nil {
+		time.Sleep(snooze.Until.Sub(time.Now()))
+	}
+
+	watchOpts.alertLock.Lock()
+	alert, err = getAlertState(kvPath, watchOpts.client)
+	watchOpts.alertLock.Unlock()
+	if err != nil {
+		log.Error("Error fetching alert state: ", err)
+		return
+	}
+
+	// Anything sent in the meantime, like a recovery, will have caught LastAlerted up
+	if alert != nil && alert.Status != alert.LastAlerted {
+		tryAlert(kvPath, *alert, watchOpts)
+	}
+}
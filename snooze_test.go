@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnooze_fingerprint(t *testing.T) {
+	service := &AlertState{Service: testServiceName, Tag: "alpha"}
+	node := &AlertState{Node: "node1"}
+
+	if alertFingerprint(service) != alertFingerprint(&AlertState{Service: testServiceName, Tag: "alpha", Status: "critical"}) {
+		t.Error("expected fingerprint to only depend on the alert's node/service/tag")
+	}
+
+	if alertFingerprint(service) == alertFingerprint(node) {
+		t.Error("expected different fingerprints for different alerts")
+	}
+
+	if len(alertFingerprint(node)) != 16 {
+		t.Errorf("expected 16 character fingerprint, got %q", alertFingerprint(node))
+	}
+}
+
+func TestSnooze_describe(t *testing.T) {
+	until := time.Date(2016, 9, 6, 14, 0, 0, 0, time.UTC)
+	snooze := &Snooze{
+		User:   "alice",
+		Reason: "deploying",
+		Until:  until,
+	}
+
+	expected := "Snoozed by alice until Sep 6 14:00 UTC (deploying)"
+	if snooze.describe() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, snooze.describe())
+	}
+
+	if !snooze.active(until.Add(-time.Minute)) || snooze.active(until.Add(time.Minute)) {
+		t.Error("expected snooze to only be active before its end time")
+	}
+}
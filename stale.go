@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// alertAge is an entry in the alert aging report
+type alertAge struct {
+	alertStatus
+
+	// How long (in seconds) the alert has had its current status, or -1 if it's unknown
+	Age int64 `json:"age"`
+
+	// Whether the node/service the alert is for is no longer in the catalog
+	Removed bool `json:"removed"`
+}
+
+// Returns how long an alert has had its current status, or false if it's unknown because the
+// state was stored by a version that didn't record when the status changed
+func alertStatusAge(alert *AlertState, now time.Time) (time.Duration, bool) {
+	if alert.Changed == 0 {
+		return 0, false
+	}
+	return now.Sub(time.Unix(alert.Changed, 0)), true
+}
+
+// Returns whether a critical alert should be closed as stale: the node/service it's for has
+// been removed, and it's been critical (with the critical notification sent) for longer than
+// the maximum age
+func isStaleAlert(alert *AlertState, removed bool, maxAge time.Duration, now time.Time) bool {
+	if !removed || alert.Status != api.HealthCritical || alert.LastAlerted != api.HealthCritical {
+		return false
+	}
+	age, ok := alertStatusAge(alert, now)
+	return ok && age > maxAge
+}
+
+// Returns whether the node or service an alert is for has been removed from the catalog.
+// HTTP watches and composites are defined in the config rather than the catalog, so they're
+// never removed.
+func alertEntityRemoved(alert *AlertState, client *api.Client) (bool, error) {
+	if _, ok := httpWatchName(alert); ok {
+		return false, nil
+	}
+	if _, ok := compositeName(alert); ok {
+		return false, nil
+	}
+
+	queryOpts := &api.QueryOptions{AllowStale: true}
+	if alert.Service == "" {
+		node, _, err := client.Catalog().Node(alert.Node, queryOpts)
+		if err != nil {
+			return false, fmt.Errorf("Error looking up node %s: %s", alert.Node, err)
+		}
+		return node == nil, nil
+	}
+
+	services, _, err := client.Catalog().Service(alert.Service, alert.Tag, queryOpts)
+	if err != nil {
+		return false, fmt.Errorf("Error looking up service %s: %s", alert.Service, err)
+	}
+	return len(services) == 0, nil
+}
+
+// Closes the alerts that have been critical for longer than stale_alert_age for nodes and
+// services that no longer exist, sending a passing notification so the incident is resolved
+// on the handlers' side, and removing the alert state. Returns how many were closed.
+func closeStaleAlerts(config *Config, client *api.Client, now time.Time) (int, error) {
+	maxAge := time.Duration(config.StaleAlertAge) * time.Second
+
+	pairs, _, err := client.KV().List(alertingKVRoot+"/", &api.QueryOptions{AllowStale: true})
+	if err != nil {
+		return 0, fmt.Errorf("Error listing alerts: %s", err)
+	}
+
+	closed := 0
+	for _, pair := range pairs {
+		if !strings.HasSuffix(pair.Key, "/alert") || len(pair.Value) == 0 {
+			continue
+		}
+		alert := &AlertState{}
+		if err := json.Unmarshal(pair.Value, alert); err != nil || alert.Status != api.HealthCritical || alert.LastAlerted != api.HealthCritical {
+			continue
+		}
+
+		removed, err := alertEntityRemoved(alert, client)
+		if err != nil {
+			return closed, err
+		}
+		if !removed {
+			continue
+		}
+
+		// States stored before the change time was recorded start aging once their node or
+		// service is found to be gone
+		if alert.Changed == 0 {
+			alert.Changed = now.Unix()
+			if err := casAlertState(pair, alert, client); err != nil {
+				return closed, err
+			}
+			continue
+		}
+		if !isStaleAlert(alert, removed, maxAge, now) {
+			continue
+		}
+
+		// Only delete the state if it hasn't changed since it was read, in case the node or
+		// service came back and its watch updated the alert
+		ok, _, err := client.KV().DeleteCAS(pair, nil)
+		if err != nil {
+			return closed, fmt.Errorf("Error removing stale alert %s: %s", pair.Key, err)
+		}
+		if !ok {
+			continue
+		}
+
+		age, _ := alertStatusAge(alert, now)
+		notification := *alert
+		notification.Status = api.HealthPassing
+		notification.Message = fmt.Sprintf("[%s] %s is stale, entity removed", config.ConsulDatacenter, alertName(alert))
+		notification.Details = fmt.Sprintf("Closed after being critical for %s while no longer registered in Consul", age.Truncate(time.Second))
+		notification.Checks = nil
+		notification.Transitions = 0
+
+		log.Infof("Closing stale alert for %s, which was critical for %s after being removed", alertName(alert), age.Truncate(time.Second))
+		dispatchAlert(config, alert.Service, &notification)
+		config.logEvent(EventStale, &notification)
+		closed++
+	}
+
+	return closed, nil
+}
+
+// Stores an alert state if its key hasn't changed since the pair was read
+func casAlertState(pair *api.KVPair, alert *AlertState, client *api.Client) error {
+	serialized, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("Error forming state for alert in Consul: %s", err)
+	}
+
+	updated := *pair
+	updated.Value = serialized
+	if _, _, err := client.KV().CAS(&updated, nil); err != nil {
+		return fmt.Errorf("Error storing state for alert in Consul: %s", err)
+	}
+	return nil
+}
+
+// Serves the alert aging report: every alert that isn't passing, oldest first, with how long
+// it's had its status and whether its node/service has been removed
+func (s *StatusServer) alertAging(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	alerts, err := s.alerts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	report := make([]alertAge, 0)
+	for _, alert := range alerts {
+		if alert.Status == api.HealthPassing {
+			continue
+		}
+
+		removed, err := alertEntityRemoved(&alert.AlertState, s.client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		entry := alertAge{alertStatus: alert, Age: -1, Removed: removed}
+		if age, ok := alertStatusAge(&alert.AlertState, now); ok {
+			entry.Age = int64(age / time.Second)
+		}
+		report = append(report, entry)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Age != report[j].Age {
+			return report[i].Age > report[j].Age
+		}
+		return report[i].Fingerprint < report[j].Fingerprint
+	})
+
+	writeJSON(w, report)
+}
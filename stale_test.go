@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestStale_isStaleAlert(t *testing.T) {
+	now := time.Unix(100000, 0)
+	maxAge := time.Hour
+
+	cases := []struct {
+		alert    AlertState
+		removed  bool
+		expected bool
+	}{
+		// Critical for longer than the maximum age after being removed
+		{AlertState{Status: api.HealthCritical, LastAlerted: api.HealthCritical, Changed: now.Unix() - 7200}, true, true},
+		// Still registered
+		{AlertState{Status: api.HealthCritical, LastAlerted: api.HealthCritical, Changed: now.Unix() - 7200}, false, false},
+		// Not critical for long enough
+		{AlertState{Status: api.HealthCritical, LastAlerted: api.HealthCritical, Changed: now.Unix() - 60}, true, false},
+		// Only warning, or the critical alert was never sent
+		{AlertState{Status: api.HealthWarning, LastAlerted: api.HealthWarning, Changed: now.Unix() - 7200}, true, false},
+		{AlertState{Status: api.HealthCritical, LastAlerted: api.HealthPassing, Changed: now.Unix() - 7200}, true, false},
+		// Stored without a change time
+		{AlertState{Status: api.HealthCritical, LastAlerted: api.HealthCritical}, true, false},
+	}
+	for i, c := range cases {
+		if stale := isStaleAlert(&c.alert, c.removed, maxAge, now); stale != c.expected {
+			t.Errorf("case %d: expected %v, got %v", i, c.expected, stale)
+		}
+	}
+}
+
+func TestStale_closeStaleAlerts(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	config, alertCh := testAlertConfig()
+	config.ConsulDatacenter = "dc1"
+	config.StaleAlertAge = 3600
+
+	now := time.Now()
+	stale := &AlertState{Service: "removed", Status: api.HealthCritical, LastAlerted: api.HealthCritical, Changed: now.Unix() - 7200}
+	recent := &AlertState{Node: "gone", Status: api.HealthCritical, LastAlerted: api.HealthCritical, Changed: now.Unix() - 60}
+	if err := setAlertState(serviceKVPath(alertingKVRoot, "removed", "")+"alert", stale, client); err != nil {
+		t.Fatal(err)
+	}
+	if err := setAlertState(nodeKVPath(alertingKVRoot, "gone")+"alert", recent, client); err != nil {
+		t.Fatal(err)
+	}
+
+	closed, err := closeStaleAlerts(config, client, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed != 1 {
+		t.Fatalf("expected 1 alert to be closed, got %d", closed)
+	}
+
+	select {
+	case alert := <-alertCh:
+		if alert.Status != api.HealthPassing || alert.Message != "[dc1] service removed is stale, entity removed" {
+			t.Errorf("unexpected notification: %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification for the stale alert")
+	}
+
+	if alert, _ := getAlertState(serviceKVPath(alertingKVRoot, "removed", "")+"alert", client); alert != nil {
+		t.Errorf("expected the stale alert to be removed, got %+v", alert)
+	}
+	if alert, _ := getAlertState(nodeKVPath(alertingKVRoot, "gone")+"alert", client); alert == nil {
+		t.Error("expected the recent alert to be left in place")
+	}
+}
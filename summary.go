@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// HealthSummary is the aggregated health of a service, as computed for alerting, exported back
+// into Consul for other tools to consume
+type HealthSummary struct {
+	Service          string    `json:"service"`
+	Tag              string    `json:"tag,omitempty"`
+	Status           string    `json:"status"`
+	FailingInstances int       `json:"failing_instances"`
+	TotalInstances   int       `json:"total_instances"`
+	LastChange       time.Time `json:"last_change"`
+}
+
+// Summarizes the health of a watched service from its checks. Only the checks in lastStatus
+// (the ones that count towards alerting) are used. LastChange is carried over from the
+// previous summary unless the status changed.
+func summarizeHealth(opts *WatchOptions, checks []*api.HealthCheck, lastStatus map[string]string, previous *HealthSummary, now time.Time) *HealthSummary {
+	summary := &HealthSummary{
+		Service:    opts.service,
+		Tag:        opts.tag,
+		Status:     computeHealth(lastStatus),
+		LastChange: now,
+	}
+	if previous != nil && previous.Status == summary.Status {
+		summary.LastChange = previous.LastChange
+	}
+
+	instances := make(map[string]bool)
+	for _, check := range checks {
+		status, ok := lastStatus[check.Node+"/"+check.CheckID]
+		if !ok {
+			continue
+		}
+
+		instance := check.Node + "/" + check.ServiceID
+		instances[instance] = instances[instance] || status != api.HealthPassing
+	}
+
+	summary.TotalInstances = len(instances)
+	for _, failing := range instances {
+		if failing {
+			summary.FailingInstances++
+		}
+	}
+
+	return summary
+}
+
+// Returns true if the summary differs from the previous one in anything but its timestamp
+func (s *HealthSummary) changed(previous *HealthSummary) bool {
+	return previous == nil || s.Status != previous.Status || s.FailingInstances != previous.FailingInstances ||
+		s.TotalInstances != previous.TotalInstances
+}
+
+// Returns the name the summary is exported under: the service name, followed by the tag if
+// the watch is for a single tag
+func (s *HealthSummary) name() string {
+	if s.Tag != "" {
+		return s.Service + "/" + s.Tag
+	}
+	return s.Service
+}
+
+// Returns the KV key the summary is exported under in the health_summary_prefix, which is its
+// name with the service and tag escaped
+func (s *HealthSummary) kvKey() string {
+	if s.Tag != "" {
+		return escapeKVSegment(s.Service) + "/" + escapeKVSegment(s.Tag)
+	}
+	return escapeKVSegment(s.Service)
+}
+
+// Writes the summary to the health_summary_prefix in the KV store and/or as a check on the
+// health_summary_node in the catalog, depending on which are set
+func exportHealthSummary(summary *HealthSummary, config *Config, client *api.Client) error {
+	serialized, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("Error forming health summary: %s", err)
+	}
+
+	if config.HealthSummaryPrefix != "" {
+		_, err = client.KV().Put(&api.KVPair{
+			Key:   config.HealthSummaryPrefix + summary.kvKey(),
+			Value: serialized,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("Error storing health summary for %s: %s", summary.name(), err)
+		}
+	}
+
+	if config.HealthSummaryNode != "" {
+		_, err = client.Catalog().Register(&api.CatalogRegistration{
+			Node:       config.HealthSummaryNode,
+			Address:    "127.0.0.1",
+			Datacenter: config.ConsulDatacenter,
+			Check: &api.AgentCheck{
+				Node:    config.HealthSummaryNode,
+				CheckID: "consul-alerting:" + summary.name(),
+				Name:    "Alerting health for " + summary.name(),
+				Status:  summary.Status,
+				Output:  string(serialized),
+			},
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("Error registering health summary check for %s: %s", summary.name(), err)
+		}
+	}
+
+	return nil
+}
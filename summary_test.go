@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestSummary_summarizeHealth(t *testing.T) {
+	opts := &WatchOptions{service: "redis"}
+	checks := []*api.HealthCheck{
+		{Node: "node1", CheckID: "service:redis", ServiceID: "redis", Status: api.HealthPassing},
+		{Node: "node2", CheckID: "service:redis", ServiceID: "redis", Status: api.HealthWarning},
+		{Node: "node2", CheckID: "redis-mem", ServiceID: "redis", Status: api.HealthCritical},
+		{Node: "node3", CheckID: "service:redis", ServiceID: "redis", Status: api.HealthCritical},
+	}
+
+	// node3's check is ignored, so it doesn't count towards the summary
+	lastStatus := map[string]string{
+		"node1/service:redis": api.HealthPassing,
+		"node2/service:redis": api.HealthWarning,
+		"node2/redis-mem":     api.HealthPassing,
+	}
+
+	start := time.Now()
+	summary := summarizeHealth(opts, checks, lastStatus, nil, start)
+	if summary.Status != api.HealthWarning || summary.FailingInstances != 1 || summary.TotalInstances != 2 {
+		t.Errorf("unexpected summary: %#v", summary)
+	}
+	if !summary.LastChange.Equal(start) || !summary.changed(nil) {
+		t.Errorf("expected a new summary, got %#v", summary)
+	}
+
+	// The last change time is kept while the status stays the same
+	later := start.Add(time.Minute)
+	next := summarizeHealth(opts, checks, lastStatus, summary, later)
+	if !next.LastChange.Equal(start) || next.changed(summary) {
+		t.Errorf("expected an unchanged summary, got %#v", next)
+	}
+
+	lastStatus["node2/service:redis"] = api.HealthPassing
+	next = summarizeHealth(opts, checks, lastStatus, summary, later)
+	if next.Status != api.HealthPassing || next.FailingInstances != 0 || !next.LastChange.Equal(later) || !next.changed(summary) {
+		t.Errorf("expected a recovered summary, got %#v", next)
+	}
+
+	if name := summarizeHealth(&WatchOptions{service: "redis", tag: "primary"}, nil, nil, nil, start).name(); name != "redis/primary" {
+		t.Errorf("expected name redis/primary, got %s", name)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// How often Consul's responsiveness is probed, and the number of probe intervals the error
+// rate and round trip time are judged over
+const (
+	throttleProbeInterval = 5 * time.Second
+	throttleWindow        = 12
+)
+
+// While throttled, blocking queries wait longer between results, errors are retried more
+// slowly and change thresholds are widened
+const (
+	throttledWaitTime        = 5 * time.Minute
+	throttledErrorWaitTime   = 60 * time.Second
+	throttledThresholdFactor = 2
+)
+
+// The results of Consul requests over one probe interval
+type throttleSample struct {
+	requests, errors int
+	rtt              time.Duration
+	probeFailed      bool
+}
+
+// consulThrottle tracks the error rate and round trip time of requests to Consul, and whether
+// consul-alerting is backing off because Consul is under duress. Watches record the outcome
+// of their queries here, so errors from across the process count towards the error rate.
+var consulThrottle = &throttle{}
+
+type throttle struct {
+	active int32
+
+	lock    sync.Mutex
+	current throttleSample
+	samples []throttleSample
+}
+
+// Returns true if Consul is under duress and requests to it should be reduced
+func (t *throttle) throttled() bool {
+	return atomic.LoadInt32(&t.active) == 1
+}
+
+// Records the outcome of a request to Consul
+func (t *throttle) observe(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.current.requests++
+	if err != nil {
+		t.current.errors++
+	}
+}
+
+// Returns the wait time to use for blocking queries
+func (t *throttle) waitTime() time.Duration {
+	if t.throttled() {
+		return throttledWaitTime
+	}
+	return watchWaitTime
+}
+
+// Returns how long to wait before retrying a failed query
+func (t *throttle) errorWaitTime() time.Duration {
+	if t.throttled() {
+		return throttledErrorWaitTime
+	}
+	return errorWaitTime
+}
+
+// Closes the current interval with the probe's round trip time, and returns whether Consul
+// is under duress over the window: if the error rate or the median round trip time of the
+// successful probes reaches its threshold
+func (t *throttle) sample(rtt time.Duration, probeErr error, maxRTT time.Duration, maxErrorRate float64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sample := t.current
+	sample.requests++
+	if probeErr != nil {
+		sample.errors++
+		sample.probeFailed = true
+	}
+	sample.rtt = rtt
+	t.current = throttleSample{}
+
+	t.samples = append(t.samples, sample)
+	if len(t.samples) > throttleWindow {
+		t.samples = t.samples[len(t.samples)-throttleWindow:]
+	}
+
+	requests, errors := 0, 0
+	rtts := make([]time.Duration, 0, len(t.samples))
+	for _, s := range t.samples {
+		requests += s.requests
+		errors += s.errors
+		if !s.probeFailed {
+			rtts = append(rtts, s.rtt)
+		}
+	}
+
+	if float64(errors)/float64(requests) >= maxErrorRate {
+		return true
+	}
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		if rtts[len(rtts)/2] >= maxRTT {
+			return true
+		}
+	}
+	return false
+}
+
+// Periodically probes Consul, throttling consul-alerting's own load on it while the error
+// rate or round trip time stays elevated, until it recovers
+func monitorConsulDuress(config *Config, client *api.Client) {
+	maxRTT := time.Duration(config.ThrottleRTT) * time.Millisecond
+	for {
+		time.Sleep(throttleProbeInterval)
+
+		start := time.Now()
+		_, err := client.Status().Leader()
+		duress := consulThrottle.sample(time.Since(start), err, maxRTT, config.ThrottleErrorRate)
+
+		if duress && atomic.CompareAndSwapInt32(&consulThrottle.active, 0, 1) {
+			log.Warn("Consul appears to be under duress, throttling queries and pausing non-essential writes")
+		} else if !duress && atomic.CompareAndSwapInt32(&consulThrottle.active, 1, 0) {
+			log.Info("Consul has recovered, no longer throttling")
+		}
+	}
+}
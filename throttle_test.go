@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestThrottle_sample(t *testing.T) {
+	maxRTT := 100 * time.Millisecond
+	tracker := &throttle{}
+
+	// Healthy requests with fast probes
+	for i := 0; i < throttleWindow; i++ {
+		tracker.observe(nil)
+		if tracker.sample(10*time.Millisecond, nil, maxRTT, 0.25) {
+			t.Fatal("expected no duress while Consul is healthy")
+		}
+	}
+
+	// Slow probes should only cause duress once they're the median over the window
+	duress := false
+	for i := 0; i < throttleWindow/2; i++ {
+		duress = tracker.sample(time.Second, nil, maxRTT, 0.25)
+		if duress && i < throttleWindow/2-1 {
+			t.Fatalf("expected no duress after %d slow probes", i+1)
+		}
+	}
+	if !duress {
+		t.Fatal("expected duress once most probes were slow")
+	}
+
+	// Start over with a healthy window
+	tracker = &throttle{}
+	for i := 0; i < throttleWindow; i++ {
+		tracker.sample(10*time.Millisecond, nil, maxRTT, 0.25)
+	}
+
+	// Errors from watches count towards the error rate
+	for i := 0; i < 10; i++ {
+		tracker.observe(fmt.Errorf("Unexpected response code: 500"))
+	}
+	if !tracker.sample(10*time.Millisecond, nil, maxRTT, 0.25) {
+		t.Fatal("expected duress with an elevated error rate")
+	}
+}
+
+func TestThrottle_waitTimes(t *testing.T) {
+	tracker := &throttle{}
+	if tracker.waitTime() != watchWaitTime || tracker.errorWaitTime() != errorWaitTime {
+		t.Fatal("expected the normal wait times when not throttled")
+	}
+
+	tracker.active = 1
+	if tracker.waitTime() != throttledWaitTime || tracker.errorWaitTime() != throttledErrorWaitTime {
+		t.Fatal("expected longer wait times when throttled")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// The built-in notification tiers, from least to most urgent
+const (
+	TierInfo = "info"
+	TierWarn = "warn"
+	TierPage = "page"
+)
+
+var tierNames = []string{TierInfo, TierWarn, TierPage}
+
+// The alert classes each tier receives when its block doesn't list any
+var defaultTierClasses = map[string][]string{
+	TierInfo: []string{InfoStatus},
+	TierWarn: []string{api.HealthWarning},
+	TierPage: []string{api.HealthCritical},
+}
+
+// TierConfig routes alerts of some classes (critical, warning or info) to a set of handlers,
+// so services that don't list their own handlers are routed by how urgent each alert is
+// instead of every alert going to the default handlers
+type TierConfig struct {
+	Name     string
+	Handlers []string `mapstructure:"handlers"`
+	Classes  []string `mapstructure:"classes"`
+}
+
+// Parse the raw tier objects into the config
+func parseTiers(list *ast.ObjectList, config *Config) error {
+	classTiers := make(map[string]string)
+
+	for _, t := range list.Items {
+		name := t.Keys[0].Token.Value().(string)
+		if !contains(tierNames, name) {
+			return fmt.Errorf("Unknown tier %s, must be one of %v", name, tierNames)
+		}
+
+		var m map[string]interface{}
+		var tier TierConfig
+		if err := hcl.DecodeObject(&m, t.Val); err != nil {
+			return err
+		}
+
+		if err := mapstructure.WeakDecode(m, &tier); err != nil {
+			return err
+		}
+		tier.Name = name
+
+		if len(tier.Handlers) == 0 {
+			return fmt.Errorf("No handlers given for tier %s", name)
+		}
+		for _, id := range tier.Handlers {
+			_, isGroup := config.HandlerGroups[id]
+			if _, ok := config.Handlers[id]; !ok && !isGroup {
+				return fmt.Errorf("Unknown handler for tier %s: %s", name, id)
+			}
+		}
+		tier.Handlers = config.expandHandlerGroups(tier.Handlers)
+
+		if len(tier.Classes) == 0 {
+			tier.Classes = defaultTierClasses[name]
+		}
+		for _, class := range tier.Classes {
+			if !contains([]string{InfoStatus, api.HealthWarning, api.HealthCritical}, class) {
+				return fmt.Errorf("Invalid class for tier %s: %s", name, class)
+			}
+			if other, ok := classTiers[class]; ok && other != name {
+				return fmt.Errorf("Class %s is routed to both tier %s and tier %s", class, other, name)
+			}
+			classTiers[class] = name
+		}
+
+		config.Tiers[name] = tier
+	}
+
+	return nil
+}
+
+// Returns the name of the tier an alert is routed through, or an empty string if no tier
+// takes its class. Recoveries go through the tier of the status they recovered from, so
+// they reach whoever was notified of the failure.
+func (c *Config) alertTier(alert *AlertState) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	class := alert.Status
+	if class == api.HealthPassing {
+		class = alert.LastAlerted
+	}
+
+	for _, name := range tierNames {
+		if tier, ok := c.Tiers[name]; ok && contains(tier.Classes, class) {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestTiers_routing(t *testing.T) {
+	config, err := ParseConfig(`
+	handler "pagerduty" "ops" {
+		service_key = "abcd"
+	}
+
+	handler "slack" "alerts" {
+		api_token = "token"
+		channel_name = "alerts"
+	}
+
+	handler "stdout" "log" {}
+
+	tier "page" {
+		handlers = ["pagerduty.ops", "slack.alerts"]
+	}
+
+	tier "warn" {
+		handlers = ["slack.alerts"]
+		classes = ["warning", "info"]
+	}
+
+	service "redis" {
+		handlers = ["stdout.log"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		service  string
+		alert    AlertState
+		tier     string
+		expected []string
+	}{
+		{"webapp", AlertState{Status: api.HealthCritical}, TierPage, []string{"pagerduty.ops", "slack.alerts"}},
+		{"webapp", AlertState{Status: api.HealthWarning}, TierWarn, []string{"slack.alerts"}},
+		{"webapp", AlertState{Status: InfoStatus}, TierWarn, []string{"slack.alerts"}},
+		// Recoveries go through the tier of the status they recovered from
+		{"webapp", AlertState{Status: api.HealthPassing, LastAlerted: api.HealthCritical}, TierPage, []string{"pagerduty.ops", "slack.alerts"}},
+		{"webapp", AlertState{Status: api.HealthPassing, LastAlerted: api.HealthWarning}, TierWarn, []string{"slack.alerts"}},
+		// Services with their own handlers don't use tiers
+		{"redis", AlertState{Status: api.HealthCritical}, TierPage, []string{"stdout.log"}},
+	}
+
+	for i, tc := range cases {
+		tier := config.alertTier(&tc.alert)
+		if tier != tc.tier {
+			t.Errorf("case %d: expected tier %q, got %q", i, tc.tier, tier)
+		}
+		if ids := config.serviceTierHandlerIDs(tc.service, tier); !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("case %d: expected handlers %v, got %v", i, tc.expected, ids)
+		}
+	}
+
+	// Without a tier, the default handlers are used
+	expected := []string{"pagerduty.ops", "slack.alerts", "stdout.log"}
+	if ids := config.serviceHandlerIDs("webapp"); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected handlers %v, got %v", expected, ids)
+	}
+}
+
+func TestTiers_invalid(t *testing.T) {
+	cases := map[string]string{
+		`tier "urgent" { handlers = ["stdout.log"] }`: "Unknown tier urgent, must be one of [info warn page]",
+		`tier "page" {}`: "No handlers given for tier page",
+		`tier "page" { handlers = ["stdout.missing"] }`:                    "Unknown handler for tier page: stdout.missing",
+		`tier "page" { handlers = ["stdout.log"], classes = ["passing"] }`: "Invalid class for tier page: passing",
+		`tier "page" { handlers = ["stdout.log"] }
+		tier "warn" { handlers = ["stdout.log"], classes = ["critical"] }`: "Class critical is routed to both tier page and tier warn",
+	}
+
+	for raw, expected := range cases {
+		_, err := ParseConfig(`handler "stdout" "log" {}` + "\n" + raw)
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -27,6 +29,14 @@ type WatchOptions struct {
 	// the service will be used when checking its health.
 	tag string
 
+	// Optional. The tags every instance must carry to count towards the watch, for services
+	// with a tag_set. The tag is set to the tag set's name when this is used.
+	tagSet []string
+
+	// Optional. The catalog services to watch together as this service, used in Nomad
+	// compatibility mode. If not set, only the service itself is watched.
+	group *ServiceGroup
+
 	// The config to use for the watch
 	config *Config
 
@@ -36,8 +46,23 @@ type WatchOptions struct {
 	// A lock to use for avoiding race conditions with quiescence timers when alerting
 	alertLock *sync.Mutex
 
+	// The sequence number of the last update raised by the watch, and the latest one seen for
+	// each alert path (guarded by alertLock), for keeping updates in order
+	alertSeq  uint64
+	alertSeqs map[string]uint64
+
 	// A channel to use in order to stop the watch and release its lock.
 	stopCh chan struct{}
+
+	// Optional. The shared node health feed to read from instead of doing a blocking query
+	// per node, used when watching nodes in global mode.
+	feed *nodeHealthFeed
+
+	// The ModifyIndex of each check in the latest results, keyed by node/checkID, and the
+	// index each status change waiting to be confirmed was seen at. Only used with the
+	// modify_index diff strategy.
+	checkIndexes   map[string]uint64
+	pendingIndexes map[string]uint64
 }
 
 const ServiceWatch = "service"
@@ -73,19 +98,21 @@ func watch(opts *WatchOptions) {
 
 	// Initialize the mutex used for locking alert state
 	opts.alertLock = &sync.Mutex{}
+	opts.alertSeqs = make(map[string]uint64)
 
 	// Figure out whether we're watching a node or service
 	mode := NodeWatch
-	diffCheckFunc := diffNodeChecks
 	if opts.service != "" {
 		mode = ServiceWatch
-		diffCheckFunc = diffServiceChecks
 	}
 
 	name := mode + " " + opts.node
 
-	// The base path in the consul KV store to keep the state for this watch
-	keyPath := alertingKVRoot + "/node/" + opts.node + "/"
+	// The base path in the consul KV store to keep the state for this watch, with the names
+	// escaped, and the unescaped path older versions kept it under
+	stateRoot := opts.config.stateKVRoot()
+	keyPath := nodeKVPath(stateRoot, opts.node)
+	legacyKeyPath := stateRoot + "/node/" + opts.node + "/"
 	if mode == ServiceWatch {
 		name = mode + " " + opts.service
 		tagPath := ""
@@ -93,18 +120,62 @@ func watch(opts *WatchOptions) {
 			tagPath = opts.tag + "/"
 			name = name + fmt.Sprintf(" (tag: %s)", opts.tag)
 		}
-		keyPath = alertingKVRoot + "/service/" + opts.service + "/" + tagPath
+		keyPath = serviceKVPath(stateRoot, opts.service, opts.tag)
+		legacyKeyPath = stateRoot + "/service/" + opts.service + "/" + tagPath
 	}
 	lockPath := keyPath + "leader"
 	alertPath := keyPath + "alert"
+	indexPath := keyPath + watchIndexKey
+
+	// The index last saved for the watch, and when
+	var savedIndex uint64
+	var indexSaved time.Time
 
 	// Load previously stored check states for this watch from consul
-	lastCheckStatus := make(map[string]string)
+	checkStates := newCheckStateCache()
+	defer checkStates.release()
+	lastCheckStatus := checkStates.statuses
 	lastAlertStatus := api.HealthPassing
 
+	// The last status of each node route's checks, for node watches
+	lastRouteStatus := make(map[string]string)
+
+	// Whether the watch's first set of checks is still to be processed for a newly discovered
+	// node/service, which may be handled differently if it's already failing
+	bootstrapping := false
+
+	// The last time each check was seen changing, for tracking staleness
+	heartbeats := make(map[string]*checkHeartbeat)
+
+	// The details last stored for the watch's alert, for refreshing them when only the failing
+	// checks' output changes
+	var lastDetails string
+
+	// When to next send a reminder while the watch stays failing, and the status it's for
+	var nextReminder time.Time
+	reminderStatus := api.HealthPassing
+
+	// Whether the watch was paused as of the last iteration
+	id := watchID(opts)
+	wasPaused := false
+
+	// Whether the service had an open deployment window as of the last iteration
+	wasDeploying := false
+
+	// The last health summary exported for the service, if health summaries are enabled
+	var lastSummary *HealthSummary
+	exportSummaries := mode == ServiceWatch && !opts.config.ShadowMode && (opts.config.HealthSummaryPrefix != "" || opts.config.HealthSummaryNode != "")
+
 	// Set up a callback to be run when we acquire the lock/gain leadership so we can
 	// load the last check/alert states
 	loadCheckStates := func() {
+		owns := func(alert *AlertState) bool {
+			return alert.Node == opts.node && alert.Service == opts.service && alert.Tag == opts.tag
+		}
+		if err := migrateLegacyState(legacyKeyPath, keyPath, mode, owns, client); err != nil {
+			log.Errorf("Error migrating state for %s: %s", name, err)
+		}
+
 		storedCheckStates, err := getCheckStates(keyPath, client)
 
 		if err != nil {
@@ -113,26 +184,64 @@ func watch(opts *WatchOptions) {
 
 		for checkName, checkState := range storedCheckStates {
 			log.Debugf("Loaded check %s for %s, state: %s", checkName, name, checkState.Status)
-			lastCheckStatus[checkName] = checkState.Status
+			checkStates.set(checkName, checkState.Status)
+		}
+		checkStates.trim(opts.config.checkStateCacheLimit())
+
+		// With no stored state, this is a newly discovered node/service
+		bootstrapping = err == nil && len(storedCheckStates) == 0
+
+		// Resume blocking from the index the check states were saved at, so the first query
+		// waits for a change instead of returning right away. The query still returns every
+		// check, so nothing is missed if the saved index is behind.
+		if err == nil && !bootstrapping && opts.config.watchIndexInterval() > 0 {
+			index, err := loadWatchIndex(indexPath, client)
+			if err != nil {
+				log.Errorf("Error loading index for %s: %s", name, err)
+			} else if index > 0 {
+				log.Debugf("Resuming %s from index %d", name, index)
+				queryOpts.WaitIndex = index
+				savedIndex = index
+			}
 		}
 	}
 
-	// Set up the lock this thread will use to determine leader status
-	apiLock, err := client.LockKey(lockPath)
+	// Let the watch hooks know this instance has started the watch
+	hookTarget := watchHookTarget(name, opts)
+	fireWatchHooks(opts.config, WatchCreated, hookTarget)
 
-	if err != nil {
-		log.Fatalf("Error initializing lock for %s: %s", name, err)
-	}
+	// Set up the lock this thread will use to determine leader status. Shadow deployments
+	// keep their own state and don't alert, so they watch without taking the lock.
+	var lock LockHelper
+	if opts.config.ShadowMode {
+		loadCheckStates()
+		lock.acquired = true
+	} else {
+		apiLock, err := client.LockKey(lockPath)
 
-	lock := LockHelper{
-		target:   name,
-		client:   client,
-		lock:     apiLock,
-		stopCh:   make(chan struct{}, 1),
-		lockCh:   make(chan struct{}, 1),
-		callback: loadCheckStates,
+		if err != nil {
+			fatalError(opts.config, client, ExitLockFailure, fmt.Errorf("Error initializing lock for %s: %s", name, err))
+		}
+
+		lock = LockHelper{
+			target: name,
+			client: client,
+			lock:   apiLock,
+			stopCh: make(chan struct{}, 1),
+			lockCh: make(chan struct{}, 1),
+			callback: func() {
+				loadCheckStates()
+				if opts.config.DeliveryIntents {
+					go replayIntents(keyPath, opts)
+				}
+				fireWatchHooks(opts.config, WatchLockAcquired, hookTarget)
+			},
+			lostCallback: func() {
+				fireWatchHooks(opts.config, WatchLockLost, hookTarget)
+			},
+		}
+		go lock.start()
 	}
-	go lock.start()
 
 	log.Debugf("Initialized watch for %s", name)
 
@@ -142,7 +251,10 @@ func watch(opts *WatchOptions) {
 		// Check for shutdown event
 		select {
 		case <-opts.stopCh:
-			lock.stop()
+			if !opts.config.ShadowMode {
+				lock.stop()
+			}
+			fireWatchHooks(opts.config, WatchRemoved, hookTarget)
 			<-opts.stopCh
 			return
 		default:
@@ -158,76 +270,333 @@ func watch(opts *WatchOptions) {
 		var queryMeta *api.QueryMeta
 		var err error
 
-		// Do a blocking query (a consul watch) for the health checks
-		if mode == NodeWatch {
+		// Do a blocking query (a consul watch) for the health checks, waiting longer between
+		// results while Consul is under duress
+		// With the modify_index diff strategy, fetch the checks' indexes along with them
+		queryOpts.WaitTime = consulThrottle.waitTime()
+		indexed := opts.config.diffStrategy(mode, opts.service) == DiffModifyIndex
+		opts.checkIndexes = nil
+		if mode == NodeWatch && opts.feed != nil {
+			checks, queryMeta, err = opts.feed.Node(opts.node, queryOpts)
+			if indexed {
+				opts.checkIndexes = opts.feed.modifyIndexes(opts.node)
+			}
+		} else if mode == NodeWatch && indexed {
+			checks, opts.checkIndexes, queryMeta, err = queryIndexedChecks(client, "/v1/health/node/"+opts.node, queryOpts)
+		} else if mode == NodeWatch {
 			checks, queryMeta, err = client.Health().Node(opts.node, queryOpts)
+		} else if opts.group != nil {
+			checks, queryMeta, err = fetchServiceGroupChecks(client, opts.group, opts.config.NomadCanaryTags, opts.tags(), queryOpts)
+		} else if opts.config.WatchBackend == BackendHealthService {
+			checks, queryMeta, err = fetchServiceEntryChecks(client, opts.service, queryOpts)
+		} else if indexed {
+			checks, opts.checkIndexes, queryMeta, err = queryIndexedChecks(client, "/v1/health/checks/"+opts.service, queryOpts)
 		} else {
 			checks, queryMeta, err = client.Health().Checks(opts.service, queryOpts)
 		}
 
-		// Try again in 10s if we got an error during the blocking request
+		// Try again after a wait if we got an error during the blocking request
+		consulThrottle.observe(err)
 		if err != nil {
-			log.Errorf("Error trying to watch %s: %s, retrying in 10s...", mode, err)
-			time.Sleep(errorWaitTime)
+			wait := consulThrottle.errorWaitTime()
+			log.Errorf("Error trying to watch %s: %s, retrying in %s...", mode, err, wait)
+			time.Sleep(wait)
 			continue
 		}
 
-		// Update our WaitIndex for the next query
+		// Update our WaitIndex for the next query. An index going backwards means Consul's
+		// state was reset (or a saved index is from another cluster), so start over.
+		if queryMeta.LastIndex < queryOpts.WaitIndex {
+			log.Debugf("Index for %s went backwards (%d to %d), resetting", name, queryOpts.WaitIndex, queryMeta.LastIndex)
+			savedIndex = 0
+		}
 		queryOpts.WaitIndex = queryMeta.LastIndex
 
+		// Reclassify failing checks with known-benign output before they affect the alert state
+		patterns, mutedStatus := opts.config.serviceOutputPatterns(opts.service)
+		checks = muteCheckOutputs(checks, patterns, mutedStatus)
+
+		// Track maintenance mode separately, and map statuses Consul doesn't define so they
+		// aren't silently treated as passing
+		checks = normalizeCheckStatuses(checks, opts.config.unknownStatus())
+
+		// Alert on externally updated checks that have stopped getting heartbeats
+		if mode == ServiceWatch {
+			checks = markStaleChecks(checks, heartbeats, opts.config.serviceMaxStaleness(opts.service), time.Now())
+		}
+
+		// Checks evicted from the cache would look new to the diff, so leave out the ones that
+		// are still passing and load the stored states of the rest first
+		diffChecks := checkStates.reload(checks, opts.node, keyPath, client)
+
 		// Filter out health checks whose statuses haven't changed
-		updates := diffCheckFunc(checks, lastCheckStatus, opts)
+		updates := opts.config.checkDiffer(mode, opts.service).diff(diffChecks, lastCheckStatus, opts)
+
+		// A paused watch keeps its check states up to date, but doesn't alert until it's resumed
+		paused := opts.config.watchPaused(id)
+		if paused && !wasPaused {
+			log.Infof("Alerting for %s is paused", name)
+		} else if !paused && wasPaused {
+			log.Infof("Alerting for %s was resumed", name)
+		}
+		resumed := wasPaused && !paused
+		wasPaused = paused
 
 		// If there's any health check status changes, try to update the remote/local check caches and
 		// see if the alert status changed. If it has, we start a quiescence timer that will alert if
 		// it lives past the changeThreshold
+		checksUpdated := false
 		if len(updates) > 0 {
 			success := true
 
 			// Try to write the health updates to consul
 			for _, update := range updates {
 				log.Debugf("Got health check update for '%s' (%s) for %s", update.HealthCheck.Name, update.Status, name)
-				if !updateCheckState(update, client) {
+				if !updateCheckState(update, stateRoot, client) {
 					success = false
 				}
 			}
 
+			if success {
+				for checkHash, update := range updates {
+					checkStates.set(checkHash, update.Status)
+				}
+				checksUpdated = true
+			}
+		}
+
+		// Save the index once the check states are caught up to it
+		indexInterval := opts.config.watchIndexInterval()
+		if indexInterval > 0 && (len(updates) == 0 || checksUpdated) && queryOpts.WaitIndex != savedIndex && time.Since(indexSaved) >= indexInterval {
+			if err := saveWatchIndex(indexPath, queryOpts.WaitIndex, client); err != nil {
+				log.Errorf("Error saving index for %s: %s", name, err)
+			} else {
+				savedIndex = queryOpts.WaitIndex
+				indexSaved = time.Now()
+			}
+		}
+
+		// Split off the checks claimed by node routes, which are alerted on separately
+		alertChecks, alertCheckStatus := checks, lastCheckStatus
+		var routes map[string]*routedChecks
+		if mode == NodeWatch {
+			routes = opts.config.splitNodeRoutes(checks, lastCheckStatus)
+			if unrouted, ok := routes[""]; ok {
+				alertChecks, alertCheckStatus = unrouted.checks, unrouted.statuses
+				delete(routes, "")
+			}
+		}
+
+		// If the alert status changed (or changed while the watch was paused), try to trigger an alert
+		newStatus := computeHealth(alertCheckStatus)
+		if (checksUpdated || resumed) && !paused && lastAlertStatus != newStatus {
 			// Update the alert details to include info about any failing checks
 			alert := AlertState{}
 			if mode == NodeWatch {
-				alert.Details = nodeDetails(checks)
+				alert.Details = nodeDetails(alertChecks, opts.config.checkRunbooks())
 			} else {
-				alert.Details = serviceDetails(checks)
+				alert.Details = serviceDetails(alertChecks, opts.config.checkRunbooks())
+			}
+			alert.Checks = failingCheckSummaries(alertChecks, mode)
+			lastDetails = alert.Details
+
+			lastAlertStatus = newStatus
+			opts.alertSeq++
+			alert.seq = opts.alertSeq
+			alert.Status = newStatus
+			alert.Message = fmt.Sprintf("[%s] %s is now %s", opts.config.ConsulDatacenter, name, newStatus)
+
+			newEntityAlerts := NewEntityThreshold
+			if bootstrapping && newStatus != api.HealthPassing {
+				newEntityAlerts = opts.config.serviceNewEntityAlerts(opts.service)
 			}
 
-			if success {
-				for checkHash, update := range updates {
-					lastCheckStatus[checkHash] = update.Status
+			switch newEntityAlerts {
+			case NewEntityImmediate:
+				go tryAlertAfter(alertPath, alert, opts, 0)
+			case NewEntityTransition:
+				log.Infof("Not alerting on newly discovered %s, which is already %s", name, newStatus)
+				go setBaselineAlert(alertPath, alert, opts)
+			default:
+				go tryAlert(alertPath, alert, opts)
+			}
+		} else if opts.config.RefreshDetails && !paused && newStatus != api.HealthPassing && newStatus == lastAlertStatus {
+			// Keep the details of an ongoing alert current when only the failing checks' output
+			// changed, without alerting again
+			var details string
+			if mode == NodeWatch {
+				details = nodeDetails(alertChecks, opts.config.checkRunbooks())
+			} else {
+				details = serviceDetails(alertChecks, opts.config.checkRunbooks())
+			}
+			if details != lastDetails {
+				lastDetails = details
+				go refreshAlertDetails(alertPath, AlertState{
+					Status:  newStatus,
+					Details: details,
+					Checks:  failingCheckSummaries(alertChecks, mode),
+				}, opts)
+			}
+		}
+		bootstrapping = false
+
+		// Alert on each node route's checks with the route's handlers, including routes that no
+		// longer claim any checks so their alerts can resolve
+		if (checksUpdated || resumed) && !paused {
+			if routes == nil {
+				routes = make(map[string]*routedChecks)
+			}
+			for route, _ := range lastRouteStatus {
+				if _, ok := routes[route]; !ok {
+					routes[route] = &routedChecks{}
+				}
+			}
+			for route, routed := range routes {
+				routeStatus := computeHealth(routed.statuses)
+				lastStatus, ok := lastRouteStatus[route]
+				if !ok {
+					lastStatus = api.HealthPassing
+				}
+				if routeStatus == lastStatus {
+					continue
 				}
 
-				// If the alert status changed, try to trigger an alert
-				newStatus := computeHealth(lastCheckStatus)
-				if lastAlertStatus != newStatus {
-					lastAlertStatus = newStatus
-					alert.Status = newStatus
-					alert.Message = fmt.Sprintf("[%s] %s is now %s", opts.config.ConsulDatacenter, name, newStatus)
-					go tryAlert(alertPath, alert, opts)
+				if routeStatus == api.HealthPassing {
+					delete(lastRouteStatus, route)
+				} else {
+					lastRouteStatus[route] = routeStatus
 				}
+
+				routeName := fmt.Sprintf("%s (route: %s)", name, route)
+				opts.alertSeq++
+				go tryAlert(routeAlertPath(keyPath, route), AlertState{
+					seq:     opts.alertSeq,
+					Route:   route,
+					Status:  routeStatus,
+					Message: fmt.Sprintf("[%s] %s is now %s", opts.config.ConsulDatacenter, routeName, routeStatus),
+					Details: nodeDetails(routed.checks, opts.config.checkRunbooks()),
+					Checks:  failingCheckSummaries(routed.checks, mode),
+				}, opts)
+			}
+		}
+
+		// Once a deployment window closes, re-send any alert that was downgraded during it
+		if mode == ServiceWatch {
+			deploying := opts.config.serviceDeploying(opts.service, time.Now())
+			if wasDeploying && !deploying {
+				go rearmAlert(alertPath, name, opts)
+			}
+			wasDeploying = deploying
+		}
+
+		// Export the service's aggregated health back into Consul when it changes
+		if exportSummaries {
+			summary := summarizeHealth(opts, checks, lastCheckStatus, lastSummary, time.Now())
+			if summary.changed(lastSummary) {
+				if err := exportHealthSummary(summary, opts.config, client); err != nil {
+					log.Error(err)
+				} else {
+					lastSummary = summary
+				}
+			}
+		}
+
+		// While the watch stays failing, periodically re-check its health and send a reminder
+		// with the current check output
+		health := computeHealth(alertCheckStatus)
+		reminderInterval := opts.config.serviceReminderInterval(opts.service)
+		if reminderInterval <= 0 || paused || health == api.HealthPassing || health != reminderStatus {
+			nextReminder = time.Now().Add(reminderInterval)
+			reminderStatus = health
+		} else if time.Now().After(nextReminder) {
+			tracked := make(map[string]bool, len(alertCheckStatus))
+			for checkHash, _ := range alertCheckStatus {
+				tracked[checkHash] = true
 			}
+			go sendReminder(alertPath, mode, name, tracked, opts)
+			nextReminder = time.Now().Add(reminderInterval)
 		}
+
+		// Keep the cached check states within the watch's share of the memory limits
+		checkStates.trim(opts.config.checkStateCacheLimit())
+	}
+}
+
+// Fetches a service's checks from its health entries rather than /v1/health/checks, leaving
+// out the checks of the nodes the service runs on
+func fetchServiceEntryChecks(client *api.Client, service string, queryOpts *api.QueryOptions) ([]*api.HealthCheck, *api.QueryMeta, error) {
+	entries, queryMeta, err := client.Health().Service(service, "", false, queryOpts)
+	if err != nil {
+		return nil, nil, err
 	}
+	return serviceEntryChecks(entries, nil, nil), queryMeta, nil
 }
 
-// Returns a map of checks whose status differs from their entry in lastStatus
+// Adds the cached parameter to health service queries, so the agent serves them from its cache
+// instead of passing every watch's blocking query through to the servers. Agents with
+// use_streaming_backend enabled fill that cache from Consul's streaming backend. The vendored
+// API client predates QueryOptions.UseCache, so the parameter is added to the request here.
+type cachedHealthTransport struct {
+	http.RoundTripper
+}
+
+func (t cachedHealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, "/v1/health/service/") {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// Round trippers shouldn't modify the request they're given
+	cachedURL := *req.URL
+	query := cachedURL.Query()
+	query.Set("cached", "")
+	cachedURL.RawQuery = query.Encode()
+
+	cached := *req
+	cached.URL = &cachedURL
+	return t.RoundTripper.RoundTrip(&cached)
+}
+
+// Pool of buffers for building the node/checkID keys used in check diffing, so that
+// comparing an unchanged set of checks doesn't allocate a string per check
+var checkKeyPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 128)
+		return &buf
+	},
+}
+
+// Builds the node/checkID key for a check in the given buffer
+func appendCheckKey(buf []byte, node string, checkID string) []byte {
+	buf = append(buf[:0], node...)
+	buf = append(buf, '/')
+	return append(buf, checkID...)
+}
+
+// Returns a map of checks whose status differs from their entry in lastStatus. The
+// map is nil if nothing changed.
 func diffServiceChecks(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate {
-	updates := make(map[string]CheckUpdate)
+	var updates map[string]CheckUpdate
+
+	bufp := checkKeyPool.Get().(*[]byte)
+	defer checkKeyPool.Put(bufp)
 
 	for _, check := range checks {
-		checkHash := check.Node + "/" + check.CheckID
+		*bufp = appendCheckKey(*bufp, check.Node, check.CheckID)
 		// Determine whether the check changed status
-		if oldStatus, ok := lastStatus[checkHash]; ok && oldStatus != check.Status {
-			// If it did, make sure it's for our tag (if specified)
-			if opts.tag != "" {
+		oldStatus, ok := lastStatus[string(*bufp)]
+		if ok && oldStatus == check.Status {
+			continue
+		}
+
+		if updates == nil {
+			updates = make(map[string]CheckUpdate)
+		}
+		checkHash := string(*bufp)
+
+		if ok {
+			// If it did, make sure it's for our tag or tag set (if specified). Service
+			// groups are already queried by tag.
+			if opts.tag != "" && opts.group == nil {
 				node, _, err := opts.client.Catalog().Node(check.Node, &api.QueryOptions{})
 
 				if err != nil {
@@ -235,13 +604,13 @@ func diffServiceChecks(checks []*api.HealthCheck, lastStatus map[string]string,
 					continue
 				}
 
-				if nodeService, ok := node.Services[opts.service]; ok && contains(nodeService.Tags, opts.tag) {
+				if nodeService, ok := node.Services[opts.service]; ok && containsAll(nodeService.Tags, opts.tags()) {
 					updates[checkHash] = CheckUpdate{ServiceTag: opts.tag, HealthCheck: check}
 				}
 			} else {
-				updates[checkHash] = CheckUpdate{HealthCheck: check}
+				updates[checkHash] = CheckUpdate{ServiceTag: opts.tag, HealthCheck: check}
 			}
-		} else if !ok {
+		} else {
 			updates[checkHash] = CheckUpdate{ServiceTag: opts.tag, HealthCheck: check}
 		}
 	}
@@ -249,22 +618,29 @@ func diffServiceChecks(checks []*api.HealthCheck, lastStatus map[string]string,
 	return updates
 }
 
-// Returns a map of checks whose status differs from their entry in lastStatus
+// Returns a map of checks whose status differs from their entry in lastStatus. The
+// map is nil if nothing changed.
 func diffNodeChecks(checks []*api.HealthCheck, lastStatus map[string]string, opts *WatchOptions) map[string]CheckUpdate {
-	updates := make(map[string]CheckUpdate)
+	var updates map[string]CheckUpdate
+
+	bufp := checkKeyPool.Get().(*[]byte)
+	defer checkKeyPool.Put(bufp)
 
 	for _, check := range checks {
-		checkHash := opts.node + "/" + check.CheckID
-		if check.ServiceID == "" {
-			// Determine whether the check changed status
-			if oldStatus, ok := lastStatus[checkHash]; ok {
-				if oldStatus != check.Status {
-					updates[checkHash] = CheckUpdate{HealthCheck: check}
-				}
-			} else {
-				updates[checkHash] = CheckUpdate{HealthCheck: check}
-			}
+		if check.ServiceID != "" {
+			continue
 		}
+
+		*bufp = appendCheckKey(*bufp, opts.node, check.CheckID)
+		// Determine whether the check changed status
+		if oldStatus, ok := lastStatus[string(*bufp)]; ok && oldStatus == check.Status {
+			continue
+		}
+
+		if updates == nil {
+			updates = make(map[string]CheckUpdate)
+		}
+		updates[string(*bufp)] = CheckUpdate{HealthCheck: check}
 	}
 
 	return updates
@@ -278,3 +654,24 @@ func contains(s []string, e string) bool {
 	}
 	return false
 }
+
+// Returns true if s contains every element of e
+func containsAll(s []string, e []string) bool {
+	for _, a := range e {
+		if !contains(s, a) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the tags a service's instances must carry to count towards the watch
+func (opts *WatchOptions) tags() []string {
+	if len(opts.tagSet) > 0 {
+		return opts.tagSet
+	}
+	if opts.tag != "" {
+		return []string{opts.tag}
+	}
+	return nil
+}
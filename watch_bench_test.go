@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Builds a set of passing service checks spread across the given number of nodes,
+// along with the lastStatus map a watch would have after seeing them
+func testServiceChecks(nodes int) ([]*api.HealthCheck, map[string]string) {
+	checks := make([]*api.HealthCheck, 0, nodes)
+	lastStatus := make(map[string]string)
+	for i := 0; i < nodes; i++ {
+		check := &api.HealthCheck{
+			Node:        fmt.Sprintf("node-%d", i),
+			CheckID:     "service:" + testServiceName,
+			ServiceID:   testServiceName,
+			ServiceName: testServiceName,
+			Status:      api.HealthPassing,
+		}
+		checks = append(checks, check)
+		lastStatus[check.Node+"/"+check.CheckID] = check.Status
+	}
+	return checks, lastStatus
+}
+
+// Diffing an unchanged set of checks is the most common case in the watch loop,
+// and shouldn't allocate at all
+func TestWatch_diffAllocBudget(t *testing.T) {
+	checks, lastStatus := testServiceChecks(100)
+	opts := &WatchOptions{service: testServiceName, node: "node-0"}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		diffServiceChecks(checks, lastStatus, opts)
+	})
+	if allocs > 0 {
+		t.Errorf("diffServiceChecks budget is 0 allocations for unchanged checks, got %.1f", allocs)
+	}
+
+	nodeChecks := []*api.HealthCheck{
+		&api.HealthCheck{Node: "node-0", CheckID: "serfHealth", Status: api.HealthPassing},
+	}
+	nodeStatus := map[string]string{"node-0/serfHealth": api.HealthPassing}
+	allocs = testing.AllocsPerRun(100, func() {
+		diffNodeChecks(nodeChecks, nodeStatus, opts)
+	})
+	if allocs > 0 {
+		t.Errorf("diffNodeChecks budget is 0 allocations for unchanged checks, got %.1f", allocs)
+	}
+}
+
+func BenchmarkWatch_diffServiceChecksUnchanged(b *testing.B) {
+	checks, lastStatus := testServiceChecks(1000)
+	opts := &WatchOptions{service: testServiceName}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		diffServiceChecks(checks, lastStatus, opts)
+	}
+}
+
+func BenchmarkWatch_diffServiceChecksChanged(b *testing.B) {
+	checks, lastStatus := testServiceChecks(1000)
+	for _, check := range checks[:10] {
+		check.Status = api.HealthCritical
+	}
+	opts := &WatchOptions{service: testServiceName}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		diffServiceChecks(checks, lastStatus, opts)
+	}
+}
+
+func BenchmarkWatch_computeHealth(b *testing.B) {
+	_, lastStatus := testServiceChecks(1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		computeHealth(lastStatus)
+	}
+}
+
+// Measures how many health transitions per second a watch can process against a local
+// dev Consul, and how many KV writes each transition costs
+func BenchmarkWatch_transitions(b *testing.B) {
+	client, server := testConsul(b)
+	defer server.Stop()
+
+	server.AddService(testServiceName, structs.HealthPassing, nil)
+
+	config, alertCh := testAlertConfig()
+	go func() {
+		for range alertCh {
+		}
+	}()
+
+	stopCh := make(chan struct{})
+	go watch(&WatchOptions{
+		service: testServiceName,
+		client:  client,
+		config:  config,
+		stopCh:  stopCh,
+	})
+	defer func() {
+		stopCh <- struct{}{}
+		stopCh <- struct{}{}
+	}()
+
+	// Wait for the watch to acquire its lock and load the initial state
+	time.Sleep(2 * time.Second)
+
+	writesBefore := atomic.LoadUint64(&stateWrites)
+	statuses := []string{structs.HealthCritical, structs.HealthPassing}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		server.AddService(testServiceName, statuses[i%2], nil)
+	}
+	// Give the watch a moment to catch up with the last transition
+	time.Sleep(watchWaitTime / 10)
+	b.StopTimer()
+
+	writes := atomic.LoadUint64(&stateWrites) - writesBefore
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "transitions/s")
+	b.ReportMetric(float64(writes)/float64(b.N), "kvwrites/transition")
+}
+
+// Measures the memory held by each running watch
+func BenchmarkWatch_memoryPerWatch(b *testing.B) {
+	client, server := testConsul(b)
+	defer server.Stop()
+
+	config, _ := testAlertConfig()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	stopChs := make([]chan struct{}, 0, b.N)
+	for i := 0; i < b.N; i++ {
+		stopCh := make(chan struct{})
+		stopChs = append(stopChs, stopCh)
+		go watch(&WatchOptions{
+			service: fmt.Sprintf("%s-%d", testServiceName, i),
+			client:  client,
+			config:  config,
+			stopCh:  stopCh,
+		})
+	}
+	time.Sleep(1 * time.Second)
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	// The heap can shrink between the reads if garbage from setting up the server is
+	// collected, so subtract as signed values rather than wrapping around
+	grown := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	b.ReportMetric(float64(grown)/float64(b.N), "bytes/watch")
+
+	for _, stopCh := range stopChs {
+		stopCh <- struct{}{}
+		stopCh <- struct{}{}
+	}
+}
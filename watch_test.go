@@ -1,6 +1,8 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -17,12 +19,13 @@ type testHandler struct {
 	alerts chan *AlertState
 }
 
-func (t testHandler) Alert(datacenter string, alert *AlertState) {
+func (t testHandler) Alert(datacenter string, alert *AlertState) error {
 	t.alerts <- alert
+	return nil
 }
 
 // Create a test Consul server and a client for making calls to it
-func testConsul(t *testing.T) (*api.Client, *testutil.TestServer) {
+func testConsul(t testing.TB) (*api.Client, *testutil.TestServer) {
 	server := testutil.NewTestServer(t)
 
 	config := api.DefaultConfig()
@@ -79,6 +82,68 @@ func TestWatch_alertService(t *testing.T) {
 	}
 }
 
+// Service watches using the health_service backend should alert the same way
+func TestWatch_healthServiceBackend(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	server.AddService(testServiceName, structs.HealthPassing, nil)
+
+	config, alertCh := testAlertConfig()
+	config.WatchBackend = BackendHealthService
+
+	go watch(&WatchOptions{
+		service: testServiceName,
+		client:  client,
+		config:  config,
+	})
+
+	<-time.After(1 * time.Second)
+
+	server.AddService(testServiceName, structs.HealthCritical, nil)
+
+	select {
+	case alert := <-alertCh:
+		if alert.Status != structs.HealthCritical {
+			t.Fatalf("expected alert on status %s, got %s", structs.HealthCritical, alert.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get alert within the timeout")
+	}
+}
+
+// The health_service backend's queries should ask the agent to serve them from its cache,
+// while other queries are left alone
+func TestWatch_healthServiceCached(t *testing.T) {
+	cached := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.URL.Query()["cached"]
+		cached[r.URL.Path] = ok
+		w.Header().Set("X-Consul-Index", "1")
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	client, err := newConsulClient(&Config{ConsulAddress: server.URL, WatchBackend: BackendHealthService})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := fetchServiceEntryChecks(client, testServiceName, &api.QueryOptions{WaitIndex: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Health().Checks(testServiceName, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !cached["/v1/health/service/"+testServiceName] {
+		t.Error("expected the health service query to be cached")
+	}
+	if cached["/v1/health/checks/"+testServiceName] {
+		t.Error("expected the health checks query not to be cached")
+	}
+}
+
 // The basic flow of a node becoming unhealthy and then recovering
 func TestWatch_alertNode(t *testing.T) {
 	client, server := testConsul(t)
@@ -214,3 +279,38 @@ func TestWatch_multipleWatch(t *testing.T) {
 	case <-time.After(1 * time.Second):
 	}
 }
+
+// A service that's already failing when it's discovered shouldn't alert until its next
+// transition when new_entity_alerts is set to "transition"
+func TestWatch_newEntityTransition(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	server.AddService(testServiceName, structs.HealthCritical, nil)
+
+	config, alertCh := testAlertConfig()
+	config.NewEntityAlerts = NewEntityTransition
+
+	go watch(&WatchOptions{
+		service: testServiceName,
+		client:  client,
+		config:  config,
+	})
+
+	select {
+	case alert := <-alertCh:
+		t.Fatalf("expected no alert for the initial state, got %s", alert.Status)
+	case <-time.After(2 * time.Second):
+	}
+
+	server.AddService(testServiceName, structs.HealthPassing, nil)
+
+	select {
+	case alert := <-alertCh:
+		if alert.Status != structs.HealthPassing {
+			t.Fatalf("expected alert on status %s, got %s", structs.HealthPassing, alert.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get alert within the timeout")
+	}
+}
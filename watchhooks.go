@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// The lifecycle events of a watch that hooks can be fired on
+const (
+	WatchCreated      = "created"
+	WatchLockAcquired = "lock_acquired"
+	WatchLockLost     = "lock_lost"
+	WatchRemoved      = "removed"
+)
+
+var watchHookEvents = []string{WatchCreated, WatchLockAcquired, WatchLockLost, WatchRemoved}
+
+// How many lifecycle events can be waiting to be sent to the hooks. A startup sync of a large
+// catalog creates a watch for every node and service at once, so this is fairly large.
+const watchHookQueueSize = 10000
+
+// A watch_hook block: a webhook to post to, or a command to run, when a watch is created or
+// removed, or takes or loses its lock, so that other systems can track which instance is
+// responsible for which node or service
+type WatchHookConfig struct {
+	Name    string
+	URL     string   `mapstructure:"url"`
+	Command []string `mapstructure:"command"`
+	Events  []string `mapstructure:"events"`
+	Timeout int      `mapstructure:"timeout"`
+}
+
+// A watch lifecycle event, as posted to webhooks and passed to commands on stdin
+type watchHookEvent struct {
+	Event      string    `json:"event"`
+	Watch      string    `json:"watch"`
+	Node       string    `json:"node,omitempty"`
+	Service    string    `json:"service,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	HTTPWatch  string    `json:"http_watch,omitempty"`
+	Composite  string    `json:"composite,omitempty"`
+	Datacenter string    `json:"datacenter"`
+	Instance   string    `json:"instance"`
+	Time       time.Time `json:"time"`
+}
+
+// An event waiting to be sent, along with the hooks configured when it happened
+type queuedWatchHookEvent struct {
+	hooks map[string]WatchHookConfig
+	event watchHookEvent
+}
+
+// The queue of events waiting to be sent to the hooks. Events are sent one at a time, in the
+// order they happened, so hooks see a watch's lock being acquired after it was created.
+var watchHookQueue struct {
+	once   sync.Once
+	events chan queuedWatchHookEvent
+}
+
+func parseWatchHooks(list *ast.ObjectList, config *Config) error {
+	for _, h := range list.Items {
+		name := h.Keys[0].Token.Value().(string)
+
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, h.Val); err != nil {
+			return err
+		}
+
+		hook := WatchHookConfig{
+			Events:  watchHookEvents,
+			Timeout: 10,
+		}
+		if err := mapstructure.WeakDecode(m, &hook); err != nil {
+			return err
+		}
+		hook.Name = name
+
+		if (hook.URL == "") == (len(hook.Command) == 0) {
+			return fmt.Errorf("Exactly one of url and command must be given for watch_hook %s", name)
+		}
+		if hook.URL != "" && !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+			return fmt.Errorf("Invalid url for watch_hook %s: must be an http:// or https:// URL", name)
+		}
+		if len(hook.Command) > 0 && hook.Command[0] == "" {
+			return fmt.Errorf("Invalid command for watch_hook %s: empty command", name)
+		}
+		if hook.Timeout <= 0 {
+			return fmt.Errorf("Invalid timeout for watch_hook %s: %d", name, hook.Timeout)
+		}
+		for _, event := range hook.Events {
+			if !contains(watchHookEvents, event) {
+				return fmt.Errorf("Invalid event for watch_hook %s: %s (must be one of %s)", name, event, strings.Join(watchHookEvents, ", "))
+			}
+		}
+
+		config.WatchHooks[name] = hook
+	}
+
+	return nil
+}
+
+// Returns the configured watch hooks
+func (c *Config) watchHooks() map[string]WatchHookConfig {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.WatchHooks
+}
+
+// Returns the watch a node or service watch's events are for
+func watchHookTarget(name string, opts *WatchOptions) watchHookEvent {
+	return watchHookEvent{
+		Watch:      name,
+		Node:       opts.node,
+		Service:    opts.service,
+		Tag:        opts.tag,
+		Datacenter: opts.config.ConsulDatacenter,
+	}
+}
+
+// Queues a lifecycle event for the given watch to be sent to the hooks that want it. Shadow
+// deployments aren't responsible for anything, so they don't fire hooks, though the watch's
+// state is still tracked for shutdown.
+func fireWatchHooks(config *Config, name string, event watchHookEvent) {
+	// Keep track of what the watch is doing, in case it has to be abandoned on shutdown
+	trackWatch(event.Watch, name)
+
+	hooks := config.watchHooks()
+	if config.ShadowMode || len(hooks) == 0 {
+		return
+	}
+
+	event.Event = name
+	event.Instance, _ = os.Hostname()
+	event.Time = time.Now()
+
+	watchHookQueue.once.Do(func() {
+		watchHookQueue.events = make(chan queuedWatchHookEvent, watchHookQueueSize)
+		go sendWatchHookEvents(watchHookQueue.events)
+	})
+
+	select {
+	case watchHookQueue.events <- queuedWatchHookEvent{hooks: hooks, event: event}:
+	default:
+		log.Warnf("Watch hook queue is full, dropping %s event for %s", event.Event, event.Watch)
+	}
+}
+
+// Sends queued events to the hooks that want them
+func sendWatchHookEvents(queue chan queuedWatchHookEvent) {
+	for queued := range queue {
+		event := queued.event
+		for _, hook := range queued.hooks {
+			if !contains(hook.Events, event.Event) {
+				continue
+			}
+			if err := hook.fire(event); err != nil {
+				log.Errorf("Error firing watch_hook %s for %s event on %s: %s", hook.Name, event.Event, event.Watch, err)
+			}
+		}
+	}
+}
+
+// Posts the event to the hook's URL, or runs its command with the event on stdin
+func (hook WatchHookConfig) fire(event watchHookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(hook.Timeout) * time.Second
+
+	if hook.URL != "" {
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Post(hook.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"WATCH_EVENT="+event.Event,
+		"WATCH_NAME="+event.Watch,
+		"WATCH_NODE="+event.Node,
+		"WATCH_SERVICE="+event.Service,
+		"WATCH_TAG="+event.Tag,
+		"WATCH_HTTP_WATCH="+event.HTTPWatch,
+		"WATCH_COMPOSITE="+event.Composite,
+		"WATCH_DATACENTER="+event.Datacenter,
+		"WATCH_INSTANCE="+event.Instance,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if output := strings.TrimSpace(stderr.String()); output != "" {
+		log.Warnf("Error output from watch_hook command %s: %s", hook.Command[0], output)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %ds", hook.Timeout)
+	}
+	return err
+}
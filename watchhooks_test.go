@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchHooks_parse(t *testing.T) {
+	config, err := ParseConfig(`
+	watch_hook "inventory" {
+		url = "https://inventory.example.com/alerting"
+		events = ["lock_acquired", "lock_lost"]
+	}
+	watch_hook "script" {
+		command = ["/usr/local/bin/track-watch"]
+		timeout = 5
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]WatchHookConfig{
+		"inventory": {
+			Name:    "inventory",
+			URL:     "https://inventory.example.com/alerting",
+			Events:  []string{WatchLockAcquired, WatchLockLost},
+			Timeout: 10,
+		},
+		"script": {
+			Name:    "script",
+			Command: []string{"/usr/local/bin/track-watch"},
+			Events:  watchHookEvents,
+			Timeout: 5,
+		},
+	}
+	if !reflect.DeepEqual(config.WatchHooks, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, config.WatchHooks)
+	}
+
+	invalid := []string{
+		`watch_hook "none" {}`,
+		`watch_hook "both" { url = "http://example.com", command = ["true"] }`,
+		`watch_hook "scheme" { url = "example.com" }`,
+		`watch_hook "timeout" { url = "http://example.com", timeout = 0 }`,
+		`watch_hook "event" { url = "http://example.com", events = ["lock_stolen"] }`,
+	}
+	for _, raw := range invalid {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+func TestWatchHooks_webhook(t *testing.T) {
+	events := make(chan watchHookEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event watchHookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+
+	config, err := ParseConfig(`
+	datacenter = "dc1"
+	watch_hook "inventory" {
+		url = "` + server.URL + `"
+		events = ["created", "lock_acquired"]
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := watchHookTarget("service redis", &WatchOptions{service: "redis", config: config})
+	fireWatchHooks(config, WatchCreated, target)
+	fireWatchHooks(config, WatchLockLost, target)
+	fireWatchHooks(config, WatchLockAcquired, target)
+
+	// Events are sent in order, and only the ones the hook wants
+	for _, expected := range []string{WatchCreated, WatchLockAcquired} {
+		select {
+		case event := <-events:
+			if event.Event != expected || event.Service != "redis" || event.Watch != "service redis" || event.Datacenter != "dc1" {
+				t.Errorf("unexpected %s event: %+v", expected, event)
+			}
+			if event.Instance == "" || event.Time.IsZero() {
+				t.Errorf("expected the instance and time to be set: %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s event", expected)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchHooks_command(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-alerting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "event")
+
+	hook := WatchHookConfig{
+		Command: []string{"sh", "-c", `cat > "$1.json" && echo "$WATCH_EVENT $WATCH_NODE" > "$1.env"`, "sh", out},
+		Timeout: 5,
+	}
+	event := watchHookEvent{Event: WatchRemoved, Watch: "node node1", Node: "node1"}
+	if err := hook.fire(event); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := ioutil.ReadFile(out + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(env)) != "removed node1" {
+		t.Errorf("unexpected environment: %q", env)
+	}
+
+	var passed watchHookEvent
+	input, err := ioutil.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(input, &passed); err != nil || passed.Watch != "node node1" {
+		t.Errorf("unexpected input %q (%v)", input, err)
+	}
+
+	hook.Command = []string{"sh", "-c", "exit 1"}
+	if err := hook.fire(event); err == nil {
+		t.Error("expected an error from a failing command")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// The key under a watch's KV path that its last index is kept in
+const watchIndexKey = "index"
+
+// Loads the index a watch last saved, or 0 if it hasn't saved one
+func loadWatchIndex(indexPath string, client *api.Client) (uint64, error) {
+	pair, _, err := client.KV().Get(indexPath, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Error loading watch index: %s", err)
+	}
+	if pair == nil {
+		return 0, nil
+	}
+
+	index, err := strconv.ParseUint(string(pair.Value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing watch index at %s: %s", indexPath, err)
+	}
+	return index, nil
+}
+
+// Saves the index a watch has caught up to, so that it can resume its blocking queries from
+// it after a restart
+func saveWatchIndex(indexPath string, index uint64, client *api.Client) error {
+	_, err := client.KV().Put(&api.KVPair{
+		Key:   indexPath,
+		Value: []byte(strconv.FormatUint(index, 10)),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Error saving watch index: %s", err)
+	}
+	return nil
+}
+
+// Returns how often watches save their index, or 0 if they don't
+func (c *Config) watchIndexInterval() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return time.Duration(c.WatchIndexInterval) * time.Second
+}
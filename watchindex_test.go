@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestWatchIndex_saveAndLoad(t *testing.T) {
+	client, server := testConsul(t)
+	defer server.Stop()
+
+	keyPath := serviceKVPath(alertingKVRoot, "redis", "")
+	indexPath := keyPath + watchIndexKey
+
+	if index, err := loadWatchIndex(indexPath, client); err != nil || index != 0 {
+		t.Fatalf("expected no saved index, got %d (%v)", index, err)
+	}
+	if err := saveWatchIndex(indexPath, 1234, client); err != nil {
+		t.Fatal(err)
+	}
+	if index, err := loadWatchIndex(indexPath, client); err != nil || index != 1234 {
+		t.Fatalf("expected index 1234, got %d (%v)", index, err)
+	}
+
+	// The index isn't mistaken for a check state
+	if !updateCheckState(CheckUpdate{HealthCheck: &api.HealthCheck{
+		Node:        "node1",
+		CheckID:     "service:redis",
+		ServiceID:   "redis",
+		ServiceName: "redis",
+		Status:      api.HealthCritical,
+	}}, alertingKVRoot, client) {
+		t.Fatal("error storing check state")
+	}
+	states, err := getCheckStates(keyPath, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states["node1/service:redis"] == nil {
+		t.Errorf("expected only the check's state, got %v", states)
+	}
+}
+
+func TestWatchIndex_config(t *testing.T) {
+	config, err := ParseConfig(`watch_index_interval = 30`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval := config.watchIndexInterval().Seconds(); interval != 30 {
+		t.Errorf("expected a 30s interval, got %vs", interval)
+	}
+
+	if _, err := ParseConfig(`watch_index_interval = -1`); err == nil {
+		t.Error("expected an error for a negative watch_index_interval")
+	}
+}